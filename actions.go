@@ -1,6 +1,9 @@
 package goproxy
 
-import "net/http"
+import (
+	"io"
+	"net/http"
+)
 
 // ReqHandler will "tamper" with the request coming to the proxy server
 // If Handle returns req,nil the proxy will send the returned request
@@ -55,3 +58,33 @@ type FuncHttpsHandler func(host string, ctx *ProxyCtx) (*ConnectAction, string)
 func (f FuncHttpsHandler) HandleHttpConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
 	return f(host, ctx)
 }
+
+// HttpsReqHandler is a variant of HttpsHandler which also receives the CONNECT request,
+// giving access to its headers (Proxy-Authorization, User-Agent, routing headers...).
+type HttpsReqHandler interface {
+	HandleHttpConnectReq(req *http.Request, host string, ctx *ProxyCtx) (*ConnectAction, string)
+}
+
+// A wrapper that would convert a function to a HttpsReqHandler interface type
+type FuncHttpsReqHandler func(req *http.Request, host string, ctx *ProxyCtx) (*ConnectAction, string)
+
+// FuncHttpsReqHandler.HandleHttpConnectReq(req,host,ctx) <=> FuncHttpsReqHandler(req,host,ctx)
+func (f FuncHttpsReqHandler) HandleHttpConnectReq(req *http.Request, host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	return f(req, host, ctx)
+}
+
+// UpgradeHandler takes over a connection after the upstream server accepted to switch
+// it to another protocol (101 Switching Protocols), e.g. h2c or a proprietary protocol.
+// client and upstream carry the raw bytes of the new protocol, and are closed by the
+// proxy once HandleUpgrade returns. The response was already sent to the client.
+type UpgradeHandler interface {
+	HandleUpgrade(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx)
+}
+
+// A wrapper that would convert a function to an UpgradeHandler interface type
+type FuncUpgradeHandler func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx)
+
+// FuncUpgradeHandler.HandleUpgrade(resp,client,upstream,ctx) <=> FuncUpgradeHandler(resp,client,upstream,ctx)
+func (f FuncUpgradeHandler) HandleUpgrade(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx) {
+	f(resp, client, upstream, ctx)
+}
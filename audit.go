@@ -0,0 +1,101 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// String returns the name of the action, as reported in ConnectDecision.Action.
+func (a ConnectActionLiteral) String() string {
+	switch a {
+	case ConnectAccept:
+		return "tunnel"
+	case ConnectReject:
+		return "reject"
+	case ConnectMitm:
+		return "mitm"
+	case ConnectHijack:
+		return "hijack"
+	case ConnectHTTPMitm:
+		return "http-mitm"
+	case ConnectProxyAuthHijack:
+		return "proxy-auth"
+	}
+	return fmt.Sprintf("action-%d", int(a))
+}
+
+// ConnectDecision records how a CONNECT request was handled, see
+// ProxyHttpServer.ConnectAudit.
+type ConnectDecision struct {
+	Time       time.Time `json:"time"`
+	Session    int64     `json:"session"`
+	ClientAddr string    `json:"client_addr"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Host       string    `json:"host"`
+	// Action is the name of the ConnectAction chosen, such as "tunnel", "mitm" or
+	// "reject"
+	Action string `json:"action"`
+	// Handler is the index of the CONNECT handler which chose the action, -1 for the
+	// default one, and Rule the rule which matched if it was a RuleSet
+	Handler int    `json:"handler"`
+	Rule    string `json:"rule,omitempty"`
+	// SNI is the server name sent by a MITM'd client, and CertSerial the serial number,
+	// in hex, of the certificate presented to it
+	SNI        string `json:"sni,omitempty"`
+	CertSerial string `json:"cert_serial,omitempty"`
+	// Error is set when the action failed, e.g. the TLS handshake of a MITM'd client
+	Error string `json:"error,omitempty"`
+}
+
+// auditConnect reports d to ConnectAudit, completing it from ctx.
+func (proxy *ProxyHttpServer) auditConnect(ctx *ProxyCtx, d ConnectDecision) {
+	if proxy.ConnectAudit == nil {
+		return
+	}
+	d.Time = proxy.clock().Now()
+	d.Session = ctx.Session
+	d.ClientID = ctx.ClientID
+	d.Rule = ctx.Rule
+	d.ClientAddr = ctx.ClientAddr()
+	if ctx.Req != nil && d.Host == "" {
+		d.Host = ctx.Req.URL.Host
+	}
+	proxy.ConnectAudit(ctx, d)
+}
+
+func certSerial(cert *tls.Certificate) string {
+	if cert.Leaf != nil {
+		return cert.Leaf.SerialNumber.Text(16)
+	}
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.SerialNumber.Text(16)
+}
+
+// recordCertSerial returns config, recording the serial of the certificate it
+// presents to the client in serial.
+func recordCertSerial(config *tls.Config, serial *string) *tls.Config {
+	if config.GetCertificate == nil {
+		if len(config.Certificates) == 1 {
+			*serial = certSerial(&config.Certificates[0])
+		}
+		return config
+	}
+	config = config.Clone()
+	getCertificate := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := getCertificate(hello)
+		if cert != nil {
+			*serial = certSerial(cert)
+		}
+		return cert, err
+	}
+	return config
+}
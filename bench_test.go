@@ -0,0 +1,131 @@
+package goproxy_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+)
+
+// The benchmarks measure the proxy loops against the local test origins, e.g.
+//
+//	go test -run NONE -bench . -benchmem
+//
+// examples/goproxy-loadgen drives a running proxy with many concurrent clients.
+
+// benchProxy serves proxy, returning a client keeping enough idle connections to the
+// proxy for parallel benchmarks.
+func benchProxy(proxy *goproxy.ProxyHttpServer) (*http.Client, *httptest.Server) {
+	s := httptest.NewServer(proxy)
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyUrl), MaxIdleConnsPerHost: 256}
+	return &http.Client{Transport: tr}, s
+}
+
+func benchGet(b *testing.B, client *http.Client, url string) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			resp, err := client.Get(url)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+func BenchmarkPlainRequests(b *testing.B) {
+	proxy := goproxy.NewProxyHttpServer()
+	client, s := benchProxy(proxy)
+	defer s.Close()
+	benchGet(b, client, srv.URL+"/bobo")
+}
+
+func BenchmarkMitmRequests(b *testing.B) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmKeepAlive = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, s := benchProxy(proxy)
+	defer s.Close()
+	benchGet(b, client, https.URL+"/bobo")
+}
+
+// BenchmarkTunnelThroughput measures the bytes echoed through a CONNECT tunnel.
+func BenchmarkTunnelThroughput(b *testing.B) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	proxy := goproxy.NewProxyHttpServer()
+	_, s := benchProxy(proxy)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	panicOnErr(err, "Dial")
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	panicOnErr(err, "ReadResponse")
+	if resp.StatusCode != http.StatusOK {
+		b.Fatal("Unexpected CONNECT response", resp.Status)
+	}
+
+	chunk := make([]byte, 32*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ResetTimer()
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := c.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := io.CopyN(io.Discard, br, int64(b.N*len(chunk))); err != nil {
+		b.Fatal("Cannot read the echoed data", err)
+	}
+}
+
+// BenchmarkCertMinting measures the certificates forged for new MITM'd hosts, without
+// certificate store.
+func BenchmarkCertMinting(b *testing.B) {
+	proxy := goproxy.NewProxyHttpServer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			i++
+			ctx := &goproxy.ProxyCtx{Proxy: proxy}
+			config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)("example.com:443", ctx)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("host%d.example.com", i)}); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
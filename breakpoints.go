@@ -0,0 +1,159 @@
+package goproxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Breakpoint is a request or a response held by Breakpoints until a controller resumes
+// it, having possibly edited it.
+type Breakpoint struct {
+	ID  int64
+	Ctx *ProxyCtx
+	// Req is the request held, or the request of the response held, and Resp the
+	// response held, nil for requests. The controller may change them or their fields
+	// until it calls Continue; setting Resp for a request answers it with Resp instead
+	// of sending it upstream.
+	Req  *http.Request
+	Resp *http.Response
+	// Held is when the breakpoint was hit
+	Held time.Time
+
+	isResponse bool
+	once       sync.Once
+	done       chan struct{}
+}
+
+// IsResponse tells whether a response is held, rather than a request.
+func (b *Breakpoint) IsResponse() bool {
+	return b.isResponse
+}
+
+// Continue resumes the proxying of the request or response held.
+func (b *Breakpoint) Continue() {
+	b.once.Do(func() { close(b.done) })
+}
+
+// Done is closed once the breakpoint is resumed.
+func (b *Breakpoint) Done() <-chan struct{} {
+	return b.done
+}
+
+// Breakpoints holds the requests and responses of the handlers it returns, so that an
+// external controller, e.g. an interactive debugger, may edit them before they go on:
+//
+//	bps := &goproxy.Breakpoints{Notify: ch}
+//	proxy.OnRequest(goproxy.ReqHostIs("api.example.com:443")).Do(bps.Request())
+//	go func() {
+//		for b := range ch {
+//			b.Req.Header.Set("X-Debug", "1")
+//			b.Continue()
+//		}
+//	}()
+//
+// The breakpoints are resumed by their controller, or unchanged once Timeout elapsed or
+// when the client goes away; a controller must not touch a breakpoint once Done. Note that ProxyHttpServer.HandlerTimeout also applies to held
+// handlers.
+type Breakpoints struct {
+	// Notify, if set, receives the breakpoints as they are hit. It is never blocked
+	// on: the breakpoints it cannot receive are only listed by Held.
+	Notify chan<- *Breakpoint
+	// Timeout, if positive, resumes the breakpoints held longer
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	last int64
+	held map[int64]*Breakpoint
+}
+
+// Held returns the breakpoints currently held, in the order they were hit.
+func (bs *Breakpoints) Held() []*Breakpoint {
+	bs.mu.Lock()
+	held := make([]*Breakpoint, 0, len(bs.held))
+	for _, b := range bs.held {
+		held = append(held, b)
+	}
+	bs.mu.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i].ID < held[j].ID })
+	return held
+}
+
+// Get returns the breakpoint held with id, nil if none.
+func (bs *Breakpoints) Get(id int64) *Breakpoint {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.held[id]
+}
+
+// hold holds b until it is resumed, and tells whether it was resumed by its controller.
+func (bs *Breakpoints) hold(b *Breakpoint) bool {
+	clock := b.Ctx.Proxy.clock()
+	b.Held, b.done = clock.Now(), make(chan struct{})
+	// b is the controller's once published
+	ctx, reqCtx, method, u := b.Ctx, b.Req.Context(), b.Req.Method, b.Req.URL.String()
+	bs.mu.Lock()
+	if bs.held == nil {
+		bs.held = make(map[int64]*Breakpoint)
+	}
+	bs.last++
+	b.ID = bs.last
+	bs.held[b.ID] = b
+	bs.mu.Unlock()
+	defer func() {
+		bs.mu.Lock()
+		delete(bs.held, b.ID)
+		bs.mu.Unlock()
+	}()
+
+	ctx.Logf("Holding breakpoint %d at %s %s", b.ID, method, u)
+	if bs.Notify != nil {
+		select {
+		case bs.Notify <- b:
+		default:
+		}
+	}
+	var timeout <-chan time.Time
+	if bs.Timeout > 0 {
+		c, stop := clock.NewTimer(bs.Timeout)
+		defer stop()
+		timeout = c
+	}
+	select {
+	case <-b.done:
+		ctx.Logf("Breakpoint %d resumed", b.ID)
+		return true
+	case <-timeout:
+		ctx.Warnf("Breakpoint %d timed out", b.ID)
+	case <-reqCtx.Done():
+		ctx.Logf("Breakpoint %d abandoned by the client", b.ID)
+	}
+	b.Continue()
+	return false
+}
+
+// Request returns a request handler holding the requests.
+func (bs *Breakpoints) Request() ReqHandler {
+	return FuncReqHandler(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		b := &Breakpoint{Ctx: ctx, Req: req}
+		if !bs.hold(b) {
+			return req, nil
+		}
+		return b.Req, b.Resp
+	})
+}
+
+// Response returns a response handler holding the responses.
+func (bs *Breakpoints) Response() RespHandler {
+	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+		if resp == nil {
+			return resp
+		}
+		b := &Breakpoint{Ctx: ctx, Req: ctx.Req, Resp: resp, isResponse: true}
+		if !bs.hold(b) {
+			return resp
+		}
+		return b.Resp
+	})
+}
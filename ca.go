@@ -0,0 +1,232 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// The key types of generated CAs. MITM certificates are signed with keys of the same
+// algorithm.
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+)
+
+// DefaultCAValidity is the validity of generated CAs when CAOptions.Validity is zero.
+const DefaultCAValidity = 5 * 365 * 24 * time.Hour
+
+// ErrDemoCA is returned when the bundled GoproxyCa is used while refused, see
+// ProxyHttpServer.RefuseDemoCA.
+var ErrDemoCA = errors.New("goproxy: refusing to use the bundled demo CA, whose private key is public")
+
+// CAOptions configures GenerateCA. The zero value generates an ECDSA P-256 CA named
+// "goproxy MITM CA", valid for DefaultCAValidity, which cannot sign intermediate CAs.
+type CAOptions struct {
+	Subject pkix.Name
+	// KeyType is one of KeyRSA2048, KeyRSA4096, KeyECDSAP256 and KeyECDSAP384,
+	// KeyECDSAP256 if empty
+	KeyType  string
+	Validity time.Duration
+	// AllowIntermediates lifts the pathlen:0 constraint of the CA
+	AllowIntermediates bool
+	// ExtKeyUsage restricts the usages of the certificates the CA signs, to server
+	// authentication if empty
+	ExtKeyUsage []x509.ExtKeyUsage
+	// PermittedDNSDomains, if set, restricts the names the CA can sign certificates
+	// for, limiting the damage if its key leaks
+	PermittedDNSDomains []string
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256, "":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
+
+// GenerateCA generates a fresh CA keypair, to be used instead of the bundled GoproxyCa.
+func GenerateCA(opts *CAOptions) (*tls.Certificate, error) {
+	if opts == nil {
+		opts = &CAOptions{}
+	}
+	key, err := generateKey(opts.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyID := sha1.Sum(pub)
+	subject := opts.Subject
+	if subject.CommonName == "" && len(subject.Organization) == 0 {
+		subject.CommonName = "goproxy MITM CA"
+	}
+	validity := opts.Validity
+	if validity == 0 {
+		validity = DefaultCAValidity
+	}
+	extKeyUsage := opts.ExtKeyUsage
+	if len(extKeyUsage) == 0 {
+		extKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           extKeyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            0,
+		MaxPathLenZero:        !opts.AllowIntermediates,
+		SubjectKeyId:          keyID[:],
+		PermittedDNSDomains:   opts.PermittedDNSDomains,
+	}
+	if opts.AllowIntermediates {
+		template.MaxPathLen = -1
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// EncodeCA returns the PEM encoded certificate and private key of ca.
+func EncodeCA(ca *tls.Certificate) (certPEM, keyPEM []byte, err error) {
+	if len(ca.Certificate) == 0 {
+		return nil, nil, errors.New("no CA certificate")
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	return certPEM, keyPEM, nil
+}
+
+// LoadCA reads a CA from PEM encoded certificate and key files.
+func LoadCA(certFile, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	return &ca, nil
+}
+
+// LoadOrGenerateCA reads the CA from certFile and keyFile, or generates one with opts
+// and writes it there if certFile does not exist. The key file is only readable by
+// its owner.
+func LoadOrGenerateCA(certFile, keyFile string, opts *CAOptions) (*tls.Certificate, error) {
+	if _, err := os.Stat(certFile); err == nil {
+		return LoadCA(certFile, keyFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	ca, err := GenerateCA(opts)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := EncodeCA(ca)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return ca, nil
+}
+
+// SetCA makes ca the CA of the default ConnectActions, such as MitmConnect, by
+// replacing GoproxyCa. It must be called before the proxy serves requests.
+func SetCA(ca *tls.Certificate) error {
+	if len(ca.Certificate) == 0 {
+		return errors.New("no CA certificate")
+	}
+	c := *ca
+	if c.Leaf == nil {
+		var err error
+		if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	GoproxyCa = c
+	return nil
+}
+
+// IsDemoCA reports whether ca is the CA bundled with goproxy, whose private key is
+// public and must not be trusted outside of tests.
+func IsDemoCA(ca *tls.Certificate) bool {
+	return ca != nil && len(ca.Certificate) > 0 && demoCA != nil && bytes.Equal(ca.Certificate[0], demoCA.Bytes)
+}
+
+var demoCA, _ = pem.Decode(CA_CERT)
+
+// demoCAWarning is logged once per proxy when MITM uses the bundled CA
+const demoCAWarning = `WARN: *** MITM with the bundled goproxy demo CA, whose private key is public! ***
+Anyone can impersonate any site to the clients trusting it. Generate a CA with
+goproxy.GenerateCA, set ProxyHttpServer.RefuseDemoCA to prevent this, or
+AllowInsecureDefaultCA to silence this warning.`
+
+// warnDemoCA is cleared by the tests of goproxy, whose proxies MITM with the demo CA
+var warnDemoCA = true
+
+// checkDemoCA enforces RefuseDemoCA, and warns about the use of the demo CA.
+func (proxy *ProxyHttpServer) checkDemoCA(ca *tls.Certificate) error {
+	if !IsDemoCA(ca) {
+		return nil
+	}
+	if proxy.RefuseDemoCA {
+		return ErrDemoCA
+	}
+	if warnDemoCA && !proxy.AllowInsecureDefaultCA {
+		proxy.demoCAWarning.Do(func() {
+			proxy.Logger.Printf(demoCAWarning)
+		})
+	}
+	return nil
+}
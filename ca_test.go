@@ -0,0 +1,44 @@
+package goproxy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	warnDemoCA = false
+	os.Exit(m.Run())
+}
+
+func TestDemoCAWarning(t *testing.T) {
+	warnDemoCA = true
+	defer func() { warnDemoCA = false }()
+
+	var buf bytes.Buffer
+	proxy := NewProxyHttpServer()
+	proxy.Logger = log.New(&buf, "", 0)
+	for i := 0; i < 2; i++ {
+		if err := proxy.checkDemoCA(&GoproxyCa); err != nil {
+			t.Fatal("Expected the demo CA to be allowed, got", err)
+		}
+	}
+	if n := strings.Count(buf.String(), "demo CA"); n != 1 {
+		t.Errorf("Expected the warning to be logged once, got %d times: %q", n, buf.String())
+	}
+
+	buf.Reset()
+	proxy = NewProxyHttpServer()
+	proxy.Logger = log.New(&buf, "", 0)
+	proxy.AllowInsecureDefaultCA = true
+	if err := proxy.checkDemoCA(&GoproxyCa); err != nil || buf.Len() != 0 {
+		t.Errorf("Expected no warning with AllowInsecureDefaultCA, got %q %v", buf.String(), err)
+	}
+
+	proxy.RefuseDemoCA = true
+	if err := proxy.checkDemoCA(&GoproxyCa); err != ErrDemoCA {
+		t.Error("Expected the demo CA to be refused, got", err)
+	}
+}
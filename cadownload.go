@@ -0,0 +1,204 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	texttemplate "text/template"
+)
+
+// DefaultCAHost is the host serving the CA certificate by default, see CADownload.
+const DefaultCAHost = "goproxy.ca"
+
+// CADownload serves the CA certificate of the proxy, so that devices can be enrolled for
+// MITM by browsing a magic host through the proxy:
+//
+//	(&goproxy.CADownload{CA: &ca}).Install(proxy)
+//
+// Requests to http://goproxy.ca/ are then answered with a page of installation
+// instructions, linking to the certificate in the following formats:
+//
+//	/ca.pem          PEM, for Linux, Firefox and most tools
+//	/ca.crt          DER, for Windows and Android
+//	/ca.mobileconfig configuration profile, for iOS and macOS
+//
+// CADownload is also an http.Handler, e.g. to be used as the NonproxyHandler of the
+// proxy, answering the clients browsing the proxy address directly.
+type CADownload struct {
+	// Host is the magic host, DefaultCAHost if empty
+	Host string
+	// CA is the certificate served, GoproxyCa if nil. Its private key is never sent.
+	CA *tls.Certificate
+	// Name is the name of the certificate in the instructions and the configuration
+	// profile, the common name of the CA if empty
+	Name string
+}
+
+func (d *CADownload) host() string {
+	if d.Host == "" {
+		return DefaultCAHost
+	}
+	return d.Host
+}
+
+func (d *CADownload) cert() (*x509.Certificate, error) {
+	ca := d.CA
+	if ca == nil {
+		ca = &GoproxyCa
+	}
+	if ca.Leaf != nil {
+		return ca.Leaf, nil
+	}
+	if len(ca.Certificate) == 0 {
+		return nil, fmt.Errorf("no CA certificate")
+	}
+	return x509.ParseCertificate(ca.Certificate[0])
+}
+
+func (d *CADownload) name(cert *x509.Certificate) string {
+	if d.Name != "" {
+		return d.Name
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return "goproxy CA"
+}
+
+// Install answers the requests to the magic host of d on proxy.
+func (d *CADownload) Install(proxy *ProxyHttpServer) {
+	proxy.OnRequest(ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		return strings.EqualFold(hostWithoutPort(req.URL.Host), d.host())
+	})).DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Logf("Serving the CA certificate for %s", req.URL.Path)
+		return req, d.response(req)
+	})
+}
+
+func (d *CADownload) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, d.response(r))
+}
+
+func (d *CADownload) response(req *http.Request) *http.Response {
+	cert, err := d.cert()
+	if err != nil {
+		return NewResponse(req, ContentTypeText, http.StatusInternalServerError, err.Error())
+	}
+	var body []byte
+	contentType, filename := "", ""
+	switch req.URL.Path {
+	case "/", "":
+		var buf bytes.Buffer
+		if err := caPage.Execute(&buf, d.name(cert)); err != nil {
+			return NewResponse(req, ContentTypeText, http.StatusInternalServerError, err.Error())
+		}
+		return NewResponse(req, ContentTypeHtml, http.StatusOK, buf.String())
+	case "/ca.pem":
+		body = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		contentType, filename = "application/x-pem-file", "ca.pem"
+	case "/ca.crt", "/ca.der", "/ca.cer":
+		body = cert.Raw
+		contentType, filename = "application/x-x509-ca-cert", "ca.crt"
+	case "/ca.mobileconfig":
+		body = mobileConfig(cert, d.name(cert))
+		contentType, filename = "application/x-apple-aspen-config", "ca.mobileconfig"
+	default:
+		return NewResponse(req, ContentTypeText, http.StatusNotFound, "Not found\n")
+	}
+	resp := NewResponse(req, contentType, http.StatusOK, string(body))
+	resp.Header.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// uuid formats a UUID derived from the certificate, so that the profile is the same
+// on every download and reinstalling it replaces the previous one.
+func uuid(cert *x509.Certificate, salt string) string {
+	h := sha256.Sum256(append([]byte(salt), cert.Raw...))
+	h[6] = h[6]&0x0f | 0x50
+	h[8] = h[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", h[0:4], h[4:6], h[6:8], h[8:10], h[10:16])
+}
+
+func mobileConfig(cert *x509.Certificate, name string) []byte {
+	var buf bytes.Buffer
+	mobileConfigTemplate.Execute(&buf, map[string]string{
+		"Name":        name,
+		"Cert":        base64.StdEncoding.EncodeToString(cert.Raw),
+		"ProfileUUID": uuid(cert, "profile"),
+		"CertUUID":    uuid(cert, "certificate"),
+		"Identifier":  "com.github.mixcode.goproxy." + uuid(cert, "identifier"),
+	})
+	return buf.Bytes()
+}
+
+var mobileConfigTemplate = texttemplate.Must(texttemplate.New("mobileconfig").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>PayloadContent</key>
+	<array>
+		<dict>
+			<key>PayloadCertificateFileName</key>
+			<string>ca.crt</string>
+			<key>PayloadContent</key>
+			<data>{{.Cert}}</data>
+			<key>PayloadDisplayName</key>
+			<string>{{html .Name}}</string>
+			<key>PayloadIdentifier</key>
+			<string>{{.Identifier}}.certificate</string>
+			<key>PayloadType</key>
+			<string>com.apple.security.root</string>
+			<key>PayloadUUID</key>
+			<string>{{.CertUUID}}</string>
+			<key>PayloadVersion</key>
+			<integer>1</integer>
+		</dict>
+	</array>
+	<key>PayloadDisplayName</key>
+	<string>{{html .Name}}</string>
+	<key>PayloadIdentifier</key>
+	<string>{{.Identifier}}</string>
+	<key>PayloadType</key>
+	<string>Configuration</string>
+	<key>PayloadUUID</key>
+	<string>{{.ProfileUUID}}</string>
+	<key>PayloadVersion</key>
+	<integer>1</integer>
+</dict>
+</plist>
+`))
+
+var caPage = template.Must(template.New("ca").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><meta name="viewport" content="width=device-width"><title>Install {{.}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: auto">
+<h1>Install {{.}}</h1>
+<p>This proxy inspects HTTPS traffic. Install and trust its certificate authority to browse without warnings.</p>
+<h2>iOS</h2>
+<p>Download the <a href="/ca.mobileconfig">configuration profile</a> with Safari, install it in Settings, General, VPN &amp; Device Management,
+then enable full trust in Settings, General, About, Certificate Trust Settings.</p>
+<h2>macOS</h2>
+<p>Download the <a href="/ca.mobileconfig">configuration profile</a> and install it in System Settings, Privacy &amp; Security, Profiles,
+or add the <a href="/ca.pem">certificate</a> to the System keychain and set it to Always Trust.</p>
+<h2>Android</h2>
+<p>Download the <a href="/ca.crt">certificate</a>, then install it in Settings, Security, Encryption &amp; credentials, Install a certificate, CA certificate.
+Apps only trust it if they opt in to user certificates.</p>
+<h2>Windows</h2>
+<p>Download the <a href="/ca.crt">certificate</a>, open it, choose Install Certificate, Local Machine, and place it in Trusted Root Certification Authorities.</p>
+<h2>Linux</h2>
+<p>Download the <a href="/ca.pem">certificate</a>, copy it to /usr/local/share/ca-certificates/ with a .crt extension and run update-ca-certificates,
+or use trust anchor on Fedora.</p>
+<h2>Firefox</h2>
+<p>Firefox has its own store: import the <a href="/ca.pem">certificate</a> in Settings, Privacy &amp; Security, Certificates, View Certificates, Authorities,
+and check Trust this CA to identify websites.</p>
+</body>
+</html>
+`))
@@ -0,0 +1,179 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// DefaultCertRenewBefore is how long before their expiry the certificates of a
+// CertCache are renewed, unless its RenewBefore is set.
+const DefaultCertRenewBefore = 7 * 24 * time.Hour
+
+// CertCache is an in-memory CertStorage, keeping the certificates forged for MITM'd
+// hosts so that they are signed once:
+//
+//	proxy.CertStore = goproxy.NewCertCache()
+//
+// The certificates are renewed when they get close to their expiry: in the background
+// when they are fetched, or by StartRenewal, and synchronously if they expired, so that
+// an expired certificate is never served.
+type CertCache struct {
+	// RenewBefore is how long before their expiry certificates are renewed,
+	// DefaultCertRenewBefore if zero.
+	RenewBefore time.Duration
+	// Clock, if set, tells the time to compare with the expiry of the certificates,
+	// instead of the Clock of the proxy using the cache, see ProxyHttpServer.Clock.
+	Clock Clock
+
+	mu       sync.Mutex
+	certs    map[string]*cachedCert
+	renewals int64
+
+	proxyClock inheritedClock
+}
+
+type cachedCert struct {
+	cert     *tls.Certificate
+	gen      func() (*tls.Certificate, error)
+	notAfter time.Time
+	renewing bool
+}
+
+// NewCertCache returns an empty CertCache.
+func NewCertCache() *CertCache {
+	return &CertCache{certs: make(map[string]*cachedCert)}
+}
+
+func (c *CertCache) renewBefore() time.Duration {
+	if c.RenewBefore > 0 {
+		return c.RenewBefore
+	}
+	return DefaultCertRenewBefore
+}
+
+// certNotAfter returns the expiry of cert, using its Leaf if it is parsed already.
+func certNotAfter(cert *tls.Certificate) time.Time {
+	if cert.Leaf != nil {
+		return cert.Leaf.NotAfter
+	}
+	if len(cert.Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			return leaf.NotAfter
+		}
+	}
+	// unknown, never renewed
+	return time.Time{}
+}
+
+// Fetch returns the cached certificate of hostname, generating it with gen if needed.
+func (c *CertCache) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	now := c.proxyClock.or(c.Clock).Now()
+	c.mu.Lock()
+	e, ok := c.certs[hostname]
+	if ok && (e.notAfter.IsZero() || now.Before(e.notAfter)) {
+		if !e.notAfter.IsZero() && !e.renewing && now.After(e.notAfter.Add(-c.renewBefore())) {
+			e.renewing = true
+			go c.renew(hostname, e)
+		}
+		c.mu.Unlock()
+		return e.cert, nil
+	}
+	c.mu.Unlock()
+
+	cert, err := gen()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if ok {
+		// the cached certificate expired
+		c.renewals++
+	}
+	c.certs[hostname] = &cachedCert{cert: cert, gen: gen, notAfter: certNotAfter(cert)}
+	c.mu.Unlock()
+	return cert, nil
+}
+
+// renew replaces the certificate of e, unless it was flushed or replaced meanwhile.
+func (c *CertCache) renew(hostname string, e *cachedCert) bool {
+	cert, err := e.gen()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.renewing = false
+	if err != nil || c.certs[hostname] != e {
+		return false
+	}
+	c.certs[hostname] = &cachedCert{cert: cert, gen: e.gen, notAfter: certNotAfter(cert)}
+	c.renewals++
+	return true
+}
+
+// Renew renews the certificates close to their expiry, and returns how many of them
+// were renewed.
+func (c *CertCache) Renew() int {
+	deadline := c.proxyClock.or(c.Clock).Now().Add(c.renewBefore())
+	type pending struct {
+		hostname string
+		e        *cachedCert
+	}
+	var due []pending
+	c.mu.Lock()
+	for hostname, e := range c.certs {
+		if !e.notAfter.IsZero() && !e.renewing && deadline.After(e.notAfter) {
+			e.renewing = true
+			due = append(due, pending{hostname, e})
+		}
+	}
+	c.mu.Unlock()
+	n := 0
+	for _, p := range due {
+		if c.renew(p.hostname, p.e) {
+			n++
+		}
+	}
+	return n
+}
+
+// StartRenewal calls Renew every interval in the background, until the returned
+// function is called.
+func (c *CertCache) StartRenewal(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.Renew()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Renewals returns the number of certificates renewed because they got close to
+// their expiry, or expired.
+func (c *CertCache) Renewals() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.renewals
+}
+
+// Len returns the number of cached certificates.
+func (c *CertCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.certs)
+}
+
+// Flush removes all the cached certificates, e.g. after the CA changed.
+func (c *CertCache) Flush() {
+	c.mu.Lock()
+	c.certs = make(map[string]*cachedCert)
+	c.mu.Unlock()
+}
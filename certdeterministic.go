@@ -0,0 +1,131 @@
+package goproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// DeterministicCertPeriod is the period the validity of deterministic certificates is
+// aligned on, see ProxyHttpServer.DeterministicCerts. Their serial number changes every
+// period, their key does not.
+const DeterministicCertPeriod = 30 * 24 * time.Hour
+
+// certSecret derives the secrets of deterministic certificates from the key of a CA.
+type certSecret []byte
+
+func newCertSecret(ca tls.Certificate) (certSecret, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	h := sha512.Sum512(der)
+	return h[:], nil
+}
+
+// derive returns 128 bytes derived from the secret, the label and the hosts.
+func (s certSecret) derive(label string, hosts []string, extra ...byte) []byte {
+	sorted := append([]string{}, hosts...)
+	sort.Strings(sorted)
+	var out []byte
+	for block := byte(0); block < 2; block++ {
+		mac := hmac.New(sha512.New, s)
+		io.WriteString(mac, label)
+		for _, h := range sorted {
+			mac.Write([]byte{0})
+			io.WriteString(mac, h)
+		}
+		mac.Write([]byte{0})
+		mac.Write(extra)
+		mac.Write([]byte{block})
+		out = mac.Sum(out)
+	}
+	return out
+}
+
+// deterministicCert sets the serial number and validity of template, forged at now for
+// hosts, and returns the key of the certificate and the signer of the CA, all of them
+// depending only on the CA, the hosts and the period of now.
+func deterministicCert(ca tls.Certificate, hosts []string, template *x509.Certificate, now time.Time) (key, caSigner crypto.Signer, err error) {
+	secret, err := newCertSecret(ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch caKey := ca.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		// PKCS #1 v1.5 signatures are deterministic
+		caSigner = caKey
+	case *ecdsa.PrivateKey:
+		caSigner = deterministicECDSA{caKey}
+	default:
+		return nil, nil, fmt.Errorf("unsupported key type %T", ca.PrivateKey)
+	}
+
+	period := int64(DeterministicCertPeriod / time.Second)
+	n := now.Unix() / period
+	var index [8]byte
+	binary.BigEndian.PutUint64(index[:], uint64(n))
+	serial := secret.derive("serial", hosts, index[:]...)[:16]
+	serial[0] &= 0x7f
+	template.SerialNumber = new(big.Int).SetBytes(serial)
+	template.NotBefore = time.Unix((n-1)*period, 0)
+	template.NotAfter = template.NotBefore.Add(365 * 24 * time.Hour)
+
+	curve := elliptic.P256()
+	d := new(big.Int).SetBytes(secret.derive("key", hosts))
+	d.Mod(d, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+	priv := &ecdsa.PrivateKey{D: d, PublicKey: ecdsa.PublicKey{Curve: curve}}
+	priv.X, priv.Y = curve.ScalarBaseMult(d.Bytes())
+	return priv, caSigner, nil
+}
+
+// deterministicECDSA signs with nonces derived from the key and the digest, instead of
+// random ones, in the spirit of RFC 6979, so that a digest always gets the same
+// signature.
+type deterministicECDSA struct {
+	*ecdsa.PrivateKey
+}
+
+func (k deterministicECDSA) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	curve := k.Curve
+	n := curve.Params().N
+	e := new(big.Int).SetBytes(digest)
+	if excess := len(digest)*8 - n.BitLen(); excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+	secret := certSecret(k.D.Bytes())
+	for i := 0; i < 256; i++ {
+		nonce := new(big.Int).SetBytes(secret.derive("nonce", nil, append([]byte{byte(i)}, digest...)...))
+		nonce.Mod(nonce, n)
+		if nonce.Sign() == 0 {
+			continue
+		}
+		x, _ := curve.ScalarBaseMult(nonce.Bytes())
+		r := new(big.Int).Mod(x, n)
+		if r.Sign() == 0 {
+			continue
+		}
+		s := new(big.Int).Mul(r, k.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(nonce, n))
+		s.Mod(s, n)
+		if s.Sign() == 0 {
+			continue
+		}
+		return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	}
+	return nil, fmt.Errorf("cannot sign with a deterministic nonce")
+}
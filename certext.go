@@ -0,0 +1,32 @@
+package goproxy
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+)
+
+// The certificate transparency extensions, see RFC 6962.
+var (
+	OIDCTPoison  = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 3}
+	OIDCTSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+)
+
+// CTPoisonExtension is the critical poison extension of precertificates, which clients
+// do not accept, to be used in labs testing certificate transparency, see
+// ProxyHttpServer.CertExtensions.
+var CTPoisonExtension = pkix.Extension{Id: OIDCTPoison, Critical: true, Value: asn1.NullBytes}
+
+// SCTListExtension returns the extension embedding the given serialized signed
+// certificate timestamps in a certificate, e.g. placeholders for clients which only
+// check that some are present.
+func SCTListExtension(scts ...[]byte) pkix.Extension {
+	list := []byte{0, 0}
+	for _, sct := range scts {
+		list = append(list, byte(len(sct)>>8), byte(len(sct)))
+		list = append(list, sct...)
+	}
+	binary.BigEndian.PutUint16(list, uint16(len(list)-2))
+	value, _ := asn1.Marshal(list)
+	return pkix.Extension{Id: OIDCTSCTList, Value: value}
+}
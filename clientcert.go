@@ -0,0 +1,19 @@
+package goproxy
+
+import (
+	"crypto/tls"
+)
+
+// ClientCertsForHosts returns a function suitable for ProxyHttpServer.UpstreamClientCert,
+// presenting the certificate mapped to the upstream host name (without port).
+// Hosts missing from the map are contacted without a client certificate.
+func ClientCertsForHosts(certs map[string]tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Certificate, error) {
+	byHost := make(map[string]*tls.Certificate, len(certs))
+	for h, c := range certs {
+		c := c
+		byHost[h] = &c
+	}
+	return func(host string, ctx *ProxyCtx) (*tls.Certificate, error) {
+		return byHost[host], nil
+	}
+}
@@ -0,0 +1,304 @@
+package goproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientHello holds the fields of a TLS ClientHello relevant for fingerprinting
+// the client software. It is captured when ProxyHttpServer.CaptureClientHello is set.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	SupportedVersions   []uint16
+	ALPN                []string
+	ServerName          string
+
+	// Raw is the complete TLS record(s) carrying the ClientHello.
+	Raw []byte
+}
+
+var errNotClientHello = errors.New("not a TLS ClientHello")
+
+// isGREASE reports whether v is one of the reserved GREASE values of RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGREASE(lst []uint16) []uint16 {
+	res := make([]uint16, 0, len(lst))
+	for _, v := range lst {
+		if !isGREASE(v) {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func joinUint16(lst []uint16, sep string, format func(uint16) string) string {
+	s := make([]string, len(lst))
+	for i, v := range lst {
+		s[i] = format(v)
+	}
+	return strings.Join(s, sep)
+}
+
+func decimal(v uint16) string { return strconv.Itoa(int(v)) }
+func hex4(v uint16) string    { return fmt.Sprintf("%04x", v) }
+
+// JA3 returns the JA3 fingerprint string of the ClientHello, as in
+// "771,4865-4866,0-23-65281,29-23,0".
+func (h *ClientHello) JA3() string {
+	formats := make([]string, len(h.PointFormats))
+	for i, f := range h.PointFormats {
+		formats[i] = strconv.Itoa(int(f))
+	}
+	return strings.Join([]string{
+		decimal(h.Version),
+		joinUint16(withoutGREASE(h.CipherSuites), "-", decimal),
+		joinUint16(withoutGREASE(h.Extensions), "-", decimal),
+		joinUint16(withoutGREASE(h.SupportedGroups), "-", decimal),
+		strings.Join(formats, "-"),
+	}, ",")
+}
+
+// JA3Hash returns the MD5 hex digest of the JA3 string, the usual form JA3 is logged in.
+func (h *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, as in "t13d1516h2_8daaf6152771_e5627efa2ab1".
+func (h *ClientHello) JA4() string {
+	version := h.Version
+	if supported := withoutGREASE(h.SupportedVersions); len(supported) > 0 {
+		version = 0
+		for _, v := range supported {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	var ver string
+	switch version {
+	case 0x0304:
+		ver = "13"
+	case 0x0303:
+		ver = "12"
+	case 0x0302:
+		ver = "11"
+	case 0x0301:
+		ver = "10"
+	case 0x0300:
+		ver = "s3"
+	default:
+		ver = "00"
+	}
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(h.ALPN) > 0 && h.ALPN[0] != "" {
+		a := h.ALPN[0]
+		alpn = string(a[0]) + string(a[len(a)-1])
+	}
+	ciphers := withoutGREASE(h.CipherSuites)
+	exts := withoutGREASE(h.Extensions)
+	count := func(n int) string {
+		if n > 99 {
+			n = 99
+		}
+		return fmt.Sprintf("%02d", n)
+	}
+	a := "t" + ver + sni + count(len(ciphers)) + count(len(exts)) + alpn
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) bool { return sortedCiphers[i] < sortedCiphers[j] })
+	b := ja4Hash(joinUint16(sortedCiphers, ",", hex4))
+
+	var sortedExts []uint16
+	for _, e := range exts {
+		if e != 0x0000 && e != 0x0010 {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	sort.Slice(sortedExts, func(i, j int) bool { return sortedExts[i] < sortedExts[j] })
+	c := joinUint16(sortedExts, ",", hex4)
+	if sigs := joinUint16(h.SignatureAlgorithms, ",", hex4); sigs != "" {
+		c += "_" + sigs
+	}
+	if len(sortedExts) == 0 {
+		c = ""
+	}
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// readClientHello reads the TLS records carrying a ClientHello from r. The bytes
+// read are always returned, even on error, so that they can be replayed.
+func readClientHello(r io.Reader) ([]byte, *ClientHello, error) {
+	var raw, msg []byte
+	for {
+		var header [5]byte
+		if n, err := io.ReadFull(r, header[:]); err != nil {
+			return append(raw, header[:n]...), nil, err
+		}
+		raw = append(raw, header[:]...)
+		if header[0] != 0x16 { // handshake record
+			return raw, nil, errNotClientHello
+		}
+		n := int(binary.BigEndian.Uint16(header[3:]))
+		body := make([]byte, n)
+		if n, err := io.ReadFull(r, body); err != nil {
+			return append(raw, body[:n]...), nil, err
+		}
+		raw = append(raw, body...)
+		msg = append(msg, body...)
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != 0x01 { // client_hello
+			return raw, nil, errNotClientHello
+		}
+		length := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])
+		if len(msg) >= 4+length {
+			hello, err := parseClientHello(msg[4 : 4+length])
+			if hello != nil {
+				hello.Raw = raw
+			}
+			return raw, hello, err
+		}
+		if len(msg) > 1<<16 {
+			return raw, nil, errNotClientHello
+		}
+	}
+}
+
+type helloReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if r.err || len(r.b) < n {
+		r.err = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *helloReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *helloReader) vector8() *helloReader {
+	return &helloReader{b: r.bytes(int(r.u8())), err: r.err}
+}
+
+func (r *helloReader) vector16() *helloReader {
+	return &helloReader{b: r.bytes(int(r.u16())), err: r.err}
+}
+
+func (r *helloReader) u16list() []uint16 {
+	var lst []uint16
+	for len(r.b) >= 2 {
+		lst = append(lst, r.u16())
+	}
+	return lst
+}
+
+func parseClientHello(b []byte) (*ClientHello, error) {
+	r := &helloReader{b: b}
+	h := &ClientHello{Version: r.u16()}
+	r.bytes(32) // random
+	r.vector8() // session id
+	h.CipherSuites = r.vector16().u16list()
+	r.vector8() // compression methods
+	if r.err {
+		return nil, errNotClientHello
+	}
+	exts := r.vector16()
+	for len(exts.b) > 0 && !exts.err {
+		typ := exts.u16()
+		data := exts.vector16()
+		h.Extensions = append(h.Extensions, typ)
+		switch typ {
+		case 0: // server_name
+			list := data.vector16()
+			for len(list.b) > 0 && !list.err {
+				nameType := list.u8()
+				name := list.vector16()
+				if nameType == 0 {
+					h.ServerName = string(name.b)
+				}
+			}
+		case 10: // supported_groups
+			h.SupportedGroups = data.vector16().u16list()
+		case 11: // ec_point_formats
+			h.PointFormats = append([]uint8(nil), data.vector8().b...)
+		case 13: // signature_algorithms
+			h.SignatureAlgorithms = data.vector16().u16list()
+		case 16: // application_layer_protocol_negotiation
+			list := data.vector16()
+			for len(list.b) > 0 && !list.err {
+				h.ALPN = append(h.ALPN, string(list.vector8().b))
+			}
+		case 43: // supported_versions
+			list := data.vector8()
+			h.SupportedVersions = list.u16list()
+		}
+	}
+	if exts.err {
+		return h, errNotClientHello
+	}
+	return h, nil
+}
+
+// replayConn is a net.Conn which returns the already consumed bytes in
+// prefix before reading from the underlying connection.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newReplayConn(c net.Conn, prefix []byte) *replayConn {
+	return &replayConn{Conn: c, r: io.MultiReader(bytes.NewReader(prefix), c)}
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
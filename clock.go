@@ -0,0 +1,121 @@
+package goproxy
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Clock tells the time to the proxy. Tests set ProxyHttpServer.Clock to a fake clock,
+// such as the one of the goproxytest package, to check the expiry of certificates or
+// the handler timeouts without waiting for them.
+type Clock interface {
+	Now() time.Time
+	// NewTimer returns the channel receiving the time once d elapsed, and the function
+	// stopping the timer, reporting whether it was stopped before firing.
+	NewTimer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// SystemClock is the Clock of the proxies without Clock, telling the wall clock time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	t := time.NewTimer(d)
+	return t.C, t.Stop
+}
+
+// clockOrSystem returns c, or SystemClock if it is nil.
+func clockOrSystem(c Clock) Clock {
+	if c == nil {
+		return SystemClock
+	}
+	return c
+}
+
+// inheritedClock is the Clock of the proxy using a CertCache or a RateLimiter, which
+// they use unless they have their own.
+type inheritedClock struct {
+	v atomic.Value // holds a clockHolder
+}
+
+// clockHolder lets the clocks of any type be stored in an atomic.Value
+type clockHolder struct{ Clock }
+
+// inherit records the Clock of proxy, if it has one.
+func (c *inheritedClock) inherit(proxy *ProxyHttpServer) {
+	if proxy == nil || proxy.Clock == nil {
+		return
+	}
+	if h, ok := c.v.Load().(clockHolder); !ok || h.Clock != proxy.Clock {
+		c.v.Store(clockHolder{proxy.Clock})
+	}
+}
+
+// or returns own if it is set, else the inherited Clock, else SystemClock.
+func (c *inheritedClock) or(own Clock) Clock {
+	if own != nil {
+		return own
+	}
+	if h, ok := c.v.Load().(clockHolder); ok {
+		return h.Clock
+	}
+	return SystemClock
+}
+
+// afterFunc calls f in its own goroutine once d elapsed on clock, unless the returned
+// function is called first. It reports whether f was stopped from being called, and
+// waits for it to return otherwise. It must be called once.
+func afterFunc(clock Clock, d time.Duration, f func()) (stop func() bool) {
+	fire, stopTimer := clock.NewTimer(d)
+	done, stopped := make(chan struct{}), make(chan bool, 1)
+	go func() {
+		select {
+		case <-fire:
+			f()
+			stopped <- false
+		case <-done:
+			stopTimer()
+			stopped <- true
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-stopped
+	}
+}
+
+// interruptReadsAfter makes the reads of c fail once d elapsed on clock, like a read
+// deadline following clock, until the returned function is called.
+func interruptReadsAfter(clock Clock, c net.Conn, d time.Duration) (stop func()) {
+	stopTimer := afterFunc(clock, d, func() { c.SetReadDeadline(time.Unix(1, 0)) })
+	return func() {
+		if !stopTimer() {
+			c.SetReadDeadline(time.Time{})
+		}
+	}
+}
+
+// clock returns the Clock of proxy, SystemClock if it has none or proxy is nil.
+func (proxy *ProxyHttpServer) clock() Clock {
+	if proxy == nil {
+		return SystemClock
+	}
+	return clockOrSystem(proxy.Clock)
+}
+
+// random returns the source of randomness of proxy, crypto/rand if it has none or
+// proxy is nil.
+func (proxy *ProxyHttpServer) random() io.Reader {
+	if proxy == nil || proxy.Rand == nil {
+		return rand.Reader
+	}
+	return proxy.Rand
+}
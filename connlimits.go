@@ -0,0 +1,150 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Errors passed to ConnLimits.OnSaturated, telling which limit was reached.
+var (
+	ErrTooManyConns = errors.New("too many concurrent connections")
+	ErrTooManyMitm  = errors.New("too many concurrent MITM connections")
+)
+
+// ConnLimits caps the resources used by the CONNECT tunnels of all the clients of the
+// proxy, zero values meaning unlimited:
+//
+//	proxy.ConnLimits = &goproxy.ConnLimits{MaxConns: 10000, MaxMitm: 1000}
+//
+// Each hijacked connection holds its buffers and goroutines until it is closed, and
+// each MITM'd one the TLS state and the goroutines serving its requests. CONNECT
+// requests beyond the limits are answered with Status and the clients may retry
+// later, instead of the proxy running out of memory. Unlike RateLimiter, the limits
+// are global.
+type ConnLimits struct {
+	// rejected must stay first so that it is aligned on 32 bits platforms
+	rejected int64
+
+	// MaxConns is the number of hijacked client connections, the tunnels whether
+	// MITM'd or not, and MaxMitm the number of MITM'd ones (ConnectMitm and
+	// ConnectHTTPMitm)
+	MaxConns int
+	MaxMitm  int
+	// Status is the status of the responses to the rejected CONNECT requests, 503
+	// Service Unavailable by default, or e.g. 429 Too Many Requests
+	Status int
+	// RetryAfter, if set, is sent in the Retry-After header of the rejected requests
+	RetryAfter time.Duration
+	// OnSaturated, if set, is called for each CONNECT request rejected because of err,
+	// ErrTooManyConns or ErrTooManyMitm, e.g. to raise an alert. It must not block.
+	OnSaturated func(ctx *ProxyCtx, err error)
+
+	conns, mitm int32
+}
+
+// ConnLimitsUsage is the usage of the ConnLimits of a proxy.
+type ConnLimitsUsage struct {
+	Conns int `json:"conns"`
+	Mitm  int `json:"mitm"`
+	// Rejected is the number of CONNECT requests rejected since the proxy started
+	Rejected int64 `json:"rejected"`
+}
+
+// Usage returns the connections currently counted against the limits, and the number
+// of rejected CONNECT requests.
+func (l *ConnLimits) Usage() ConnLimitsUsage {
+	if l == nil {
+		return ConnLimitsUsage{}
+	}
+	return ConnLimitsUsage{
+		Conns:    int(atomic.LoadInt32(&l.conns)),
+		Mitm:     int(atomic.LoadInt32(&l.mitm)),
+		Rejected: atomic.LoadInt64(&l.rejected),
+	}
+}
+
+// acquireSlot reserves a slot of counter, unless it already holds max of them.
+func acquireSlot(counter *int32, max int) bool {
+	n := atomic.AddInt32(counter, 1)
+	if max > 0 && int(n) > max {
+		atomic.AddInt32(counter, -1)
+		return false
+	}
+	return true
+}
+
+func (l *ConnLimits) reject(req *http.Request, ctx *ProxyCtx, err error) *http.Response {
+	atomic.AddInt64(&l.rejected, 1)
+	ctx.Warnf("Rejecting CONNECT to %s: %v", req.URL.Host, err)
+	if l.OnSaturated != nil {
+		l.OnSaturated(ctx, err)
+	}
+	status := l.Status
+	if status == 0 {
+		status = http.StatusServiceUnavailable
+	}
+	resp := NewResponse(req, ContentTypeText, status, fmt.Sprintf("%s\n", err))
+	if l.RetryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(l.RetryAfter.Seconds()))))
+	}
+	return resp
+}
+
+// checkConnect rejects the CONNECT request req, or reserves a connection which is
+// released when the connection returned by wrapConn is closed.
+func (l *ConnLimits) checkConnect(req *http.Request, ctx *ProxyCtx) *http.Response {
+	if l == nil {
+		return nil
+	}
+	if !acquireSlot(&l.conns, l.MaxConns) {
+		return l.reject(req, ctx, ErrTooManyConns)
+	}
+	return nil
+}
+
+// checkMitm rejects the CONNECT request req about to be MITM'd, or reserves a MITM
+// connection which is released when the connection returned by wrapMitm is closed.
+func (l *ConnLimits) checkMitm(req *http.Request, ctx *ProxyCtx) *http.Response {
+	if l == nil {
+		return nil
+	}
+	if !acquireSlot(&l.mitm, l.MaxMitm) {
+		return l.reject(req, ctx, ErrTooManyMitm)
+	}
+	return nil
+}
+
+// slotConn releases a slot of counter once it is closed.
+type slotConn struct {
+	net.Conn
+	counter *int32
+	once    sync.Once
+}
+
+func (c *slotConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(c.counter, -1) })
+	return c.Conn.Close()
+}
+
+// wrapConn returns the client connection of a tunnel reserved by checkConnect.
+func (l *ConnLimits) wrapConn(conn net.Conn) net.Conn {
+	if l == nil {
+		return conn
+	}
+	return keepHalfClose(&slotConn{Conn: conn, counter: &l.conns}, conn)
+}
+
+// wrapMitm returns the client connection of a tunnel reserved by checkMitm.
+func (l *ConnLimits) wrapMitm(conn net.Conn) net.Conn {
+	if l == nil {
+		return conn
+	}
+	return keepHalfClose(&slotConn{Conn: conn, counter: &l.mitm}, conn)
+}
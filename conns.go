@@ -0,0 +1,230 @@
+package goproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of ConnInfo.
+const (
+	ConnHTTP     = "http"
+	ConnTunnel   = "tunnel"
+	ConnMitm     = "mitm"
+	ConnHTTPMitm = "http-mitm"
+)
+
+// ConnInfo describes a request being proxied, or a CONNECT tunnel.
+type ConnInfo struct {
+	Session    int64     `json:"session"`
+	Kind       string    `json:"kind"`
+	Host       string    `json:"host"`
+	ClientAddr string    `json:"client_addr"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Started    time.Time `json:"started"`
+}
+
+type trackedConn struct {
+	info    ConnInfo
+	closers []io.Closer
+}
+
+// connTracker records the active requests and tunnels of the proxy
+type connTracker struct {
+	mu       sync.Mutex
+	conns    map[int64]*trackedConn
+	draining bool
+	// servers are the servers started by ProxyHttpServer.Serve
+	servers map[*http.Server]struct{}
+}
+
+// track records the connection of ctx until the returned function is called. The
+// closers are closed when the connection is closed with CloseConn or Shutdown.
+func (t *connTracker) track(ctx *ProxyCtx, kind, host string, closers ...io.Closer) (untrack func()) {
+	c := &trackedConn{
+		info:    ConnInfo{Session: ctx.Session, Kind: kind, Host: host, ClientID: ctx.ClientID, Started: ctx.Proxy.clock().Now()},
+		closers: closers,
+	}
+	c.info.ClientAddr = ctx.ClientAddr()
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[int64]*trackedConn)
+	}
+	t.conns[c.info.Session] = c
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, c.info.Session)
+		t.mu.Unlock()
+		if kind != ConnHTTP && ctx.Proxy != nil && ctx.Proxy.TunnelClosed != nil {
+			stats := TunnelStats{ConnInfo: c.info, Duration: ctx.Proxy.clock().Now().Sub(c.info.Started)}
+			if ctx.tunnelBytes != nil {
+				stats.BytesIn = atomic.LoadInt64(&ctx.tunnelBytes.in)
+				stats.BytesOut = atomic.LoadInt64(&ctx.tunnelBytes.out)
+			}
+			ctx.Proxy.TunnelClosed(ctx, stats)
+		}
+	}
+}
+
+// TunnelStats describes a closed CONNECT tunnel, see ProxyHttpServer.TunnelClosed.
+type TunnelStats struct {
+	ConnInfo
+	Duration time.Duration
+	// BytesIn and BytesOut are the bytes received from and sent to the client, TLS
+	// included for MITM'd tunnels
+	BytesIn  int64
+	BytesOut int64
+}
+
+// tunnelBytes counts the bytes transferred with the client of a tunnel
+type tunnelBytes struct {
+	in, out int64
+}
+
+type countingConn struct {
+	net.Conn
+	counts *tunnelBytes
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.counts.in, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.counts.out, int64(n))
+	return n, err
+}
+
+// countTunnel counts the bytes of the client connection of a tunnel for TunnelClosed.
+func (proxy *ProxyHttpServer) countTunnel(ctx *ProxyCtx, conn net.Conn) net.Conn {
+	if proxy.TunnelClosed == nil {
+		return conn
+	}
+	ctx.tunnelBytes = &tunnelBytes{}
+	return keepHalfClose(countingConn{conn, ctx.tunnelBytes}, conn)
+}
+
+// halfClosableConn adds the half-close methods of a wrapped connection to its wrapper
+type halfClosableConn struct {
+	net.Conn
+	hc halfClosable
+}
+
+func (c halfClosableConn) CloseRead() error {
+	return c.hc.CloseRead()
+}
+
+func (c halfClosableConn) CloseWrite() error {
+	return c.hc.CloseWrite()
+}
+
+// keepHalfClose returns c, wrapping conn, with the half-close methods of conn if it has
+// them, so that tunnels keep closing each direction separately.
+func keepHalfClose(c, conn net.Conn) net.Conn {
+	if hc, ok := conn.(halfClosable); ok {
+		return halfClosableConn{c, hc}
+	}
+	return c
+}
+
+func (t *connTracker) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *connTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// closeConns closes the connections of the given session, or all if session is 0.
+func (t *connTracker) closeConns(session int64) bool {
+	t.mu.Lock()
+	var closers []io.Closer
+	for s, c := range t.conns {
+		if session == 0 || s == session {
+			closers = append(closers, c.closers...)
+		}
+	}
+	t.mu.Unlock()
+	for _, c := range closers {
+		c.Close()
+	}
+	return len(closers) > 0
+}
+
+// ActiveConns returns the requests being proxied and the open CONNECT tunnels, by session.
+func (proxy *ProxyHttpServer) ActiveConns() []ConnInfo {
+	proxy.conns.mu.Lock()
+	conns := make([]ConnInfo, 0, len(proxy.conns.conns))
+	for _, c := range proxy.conns.conns {
+		conns = append(conns, c.info)
+	}
+	proxy.conns.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Session < conns[j].Session })
+	return conns
+}
+
+// CloseConn closes the client and upstream connections of the tunnel of the given
+// session, and reports whether there was one. Plain HTTP requests cannot be closed.
+func (proxy *ProxyHttpServer) CloseConn(session int64) bool {
+	if session == 0 {
+		return false
+	}
+	return proxy.conns.closeConns(session)
+}
+
+// Drain makes the proxy answer new requests and CONNECT requests with 503 Service
+// Unavailable, and close kept-alive connections after their current request, while
+// letting the active ones complete.
+func (proxy *ProxyHttpServer) Drain() {
+	proxy.conns.mu.Lock()
+	proxy.conns.draining = true
+	proxy.conns.mu.Unlock()
+}
+
+// Draining reports whether Drain or Shutdown was called.
+func (proxy *ProxyHttpServer) Draining() bool {
+	return proxy.conns.isDraining()
+}
+
+// Shutdown drains the proxy and waits for its active requests and tunnels to complete.
+// When ctx is done first, the remaining tunnels are closed and ctx.Err() is returned.
+// The listeners of Serve are closed, but an http.Server serving the proxy otherwise is
+// not stopped.
+func (proxy *ProxyHttpServer) Shutdown(ctx context.Context) error {
+	proxy.Drain()
+	proxy.conns.shutdownServers()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for proxy.conns.len() > 0 {
+		select {
+		case <-ctx.Done():
+			proxy.conns.closeConns(0)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// rejectDraining answers w with 503 Service Unavailable if the proxy is draining.
+func (proxy *ProxyHttpServer) rejectDraining(w http.ResponseWriter) bool {
+	if !proxy.Draining() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	http.Error(w, "Proxy is shutting down", http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,335 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CookieJars keeps a cookie jar per client of the proxy, identified by
+// ProxyCtx.ClientID (see ClientIdentifier) or else by IP address:
+//
+//	proxy.CookieJars = &goproxy.CookieJars{Isolate: true}
+//
+// The cookies set by the responses are stored in the jar of the client, and the
+// cookies of the jar are added to the following requests of the client, the ones of
+// the jar replacing the ones of the same name sent by the client. The handlers may
+// inspect and modify the jar of the client with ProxyCtx.CookieJar, e.g. to inject a
+// session cookie or to freeze the jar.
+type CookieJars struct {
+	// Isolate removes the cookies sent by the clients and the Set-Cookie headers of the
+	// responses, so that the cookies are only known to the proxy
+	Isolate bool
+	// Load, if set, returns the saved cookies of a client, when its jar is created
+	Load func(client string) []JarCookie
+	// Save, if set, is called with all the cookies of a client whenever its jar
+	// changes. It is called synchronously, by the goroutine changing the jar.
+	Save func(client string, cookies []JarCookie)
+
+	mu   sync.Mutex
+	jars map[string]*CookieJar
+	// clock is the Clock of the proxy, telling the expiry of the cookies
+	clock inheritedClock
+}
+
+// JarCookie is a cookie stored in a CookieJar.
+type JarCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	// HostOnly cookies are only sent to Domain, not to its subdomains
+	HostOnly bool `json:"host_only,omitempty"`
+	// Expires is zero for session cookies
+	Expires  time.Time     `json:"expires"`
+	Secure   bool          `json:"secure,omitempty"`
+	HttpOnly bool          `json:"http_only,omitempty"`
+	SameSite http.SameSite `json:"same_site,omitempty"`
+	Created  time.Time     `json:"created"`
+}
+
+// CookieJar is the cookie jar of a client, see CookieJars. It implements
+// http.CookieJar. Domains are matched without public suffix list, but cookies for a
+// domain without dot other than the host setting them are refused.
+type CookieJar struct {
+	save  func([]JarCookie)
+	clock *inheritedClock
+
+	mu      sync.Mutex
+	cookies map[string]*JarCookie
+	frozen  bool
+}
+
+// Jar returns the jar of client, creating it if needed.
+func (jars *CookieJars) Jar(client string) *CookieJar {
+	jars.mu.Lock()
+	defer jars.mu.Unlock()
+	if jar, ok := jars.jars[client]; ok {
+		return jar
+	}
+	jar := &CookieJar{cookies: make(map[string]*JarCookie), clock: &jars.clock}
+	if jars.Load != nil {
+		for _, c := range jars.Load(client) {
+			c := c
+			jar.cookies[c.key()] = &c
+		}
+	}
+	if jars.Save != nil {
+		save := jars.Save
+		jar.save = func(cookies []JarCookie) { save(client, cookies) }
+	}
+	if jars.jars == nil {
+		jars.jars = make(map[string]*CookieJar)
+	}
+	jars.jars[client] = jar
+	return jar
+}
+
+// Forget drops the jar of client from memory, e.g. when its session ends. It is
+// loaded again by the following requests of the client.
+func (jars *CookieJars) Forget(client string) {
+	jars.mu.Lock()
+	defer jars.mu.Unlock()
+	delete(jars.jars, client)
+}
+
+// CookieJar returns the cookie jar of the client of the request, or nil if the proxy
+// has no CookieJars.
+func (ctx *ProxyCtx) CookieJar() *CookieJar {
+	if ctx.Proxy == nil || ctx.Proxy.CookieJars == nil || ctx.Req == nil {
+		return nil
+	}
+	return ctx.Proxy.CookieJars.Jar(clientKey(ctx.Req, ctx))
+}
+
+// applyRequest adds the cookies of the jar of the client to req.
+func (jars *CookieJars) applyRequest(req *http.Request, ctx *ProxyCtx) {
+	if jars == nil {
+		return
+	}
+	jars.clock.inherit(ctx.Proxy)
+	cookies := ctx.CookieJar().Cookies(req.URL)
+	if len(cookies) == 0 && !jars.Isolate {
+		return
+	}
+	var pairs []string
+	if !jars.Isolate {
+		fromJar := make(map[string]bool)
+		for _, c := range cookies {
+			fromJar[c.Name] = true
+		}
+		for _, line := range req.Header["Cookie"] {
+			for _, pair := range strings.Split(line, ";") {
+				pair = strings.TrimSpace(pair)
+				if pair != "" && !fromJar[strings.SplitN(pair, "=", 2)[0]] {
+					pairs = append(pairs, pair)
+				}
+			}
+		}
+	}
+	for _, c := range cookies {
+		pairs = append(pairs, c.String())
+	}
+	req.Header.Del("Cookie")
+	if len(pairs) > 0 {
+		req.Header.Set("Cookie", strings.Join(pairs, "; "))
+	}
+}
+
+// recordResponse stores the cookies set by resp in the jar of the client, unless frozen.
+func (jars *CookieJars) recordResponse(req *http.Request, resp *http.Response, ctx *ProxyCtx) {
+	if jars == nil || resp == nil {
+		return
+	}
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		jar := ctx.CookieJar()
+		jar.update(func() bool {
+			return !jar.frozen && jar.setCookies(req.URL, cookies, jar.now())
+		})
+	}
+	if jars.Isolate {
+		resp.Header.Del("Set-Cookie")
+	}
+}
+
+func (c *JarCookie) key() string {
+	return c.Domain + ";" + c.Path + ";" + c.Name
+}
+
+// Freeze stops storing the cookies set by the responses, or resumes storing them if
+// frozen is false. The handlers may still modify a frozen jar, e.g. with SetCookies.
+func (jar *CookieJar) Freeze(frozen bool) {
+	jar.mu.Lock()
+	jar.frozen = frozen
+	jar.mu.Unlock()
+}
+
+// Frozen returns whether the jar is frozen.
+func (jar *CookieJar) Frozen() bool {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	return jar.frozen
+}
+
+// SetCookies stores the cookies as set by a response from u.
+func (jar *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	jar.update(func() bool {
+		return jar.setCookies(u, cookies, jar.now())
+	})
+}
+
+// now returns the time of the Clock of the proxy using the jar.
+func (jar *CookieJar) now() time.Time {
+	if jar.clock == nil {
+		return time.Now()
+	}
+	return jar.clock.or(nil).Now()
+}
+
+func (jar *CookieJar) setCookies(u *url.URL, cookies []*http.Cookie, now time.Time) bool {
+	host := strings.ToLower(u.Hostname())
+	changed := false
+	for _, c := range cookies {
+		jc := &JarCookie{Name: c.Name, Value: c.Value, Domain: host, HostOnly: true, Path: c.Path,
+			Secure: c.Secure, HttpOnly: c.HttpOnly, SameSite: c.SameSite, Created: now}
+		if c.Domain != "" {
+			domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+			if domain != host && (!strings.HasSuffix(host, "."+domain) || !strings.Contains(domain, ".") || net.ParseIP(host) != nil) {
+				continue
+			}
+			jc.Domain, jc.HostOnly = domain, false
+		}
+		if !strings.HasPrefix(jc.Path, "/") {
+			jc.Path = defaultCookiePath(u.Path)
+		}
+		switch {
+		case c.MaxAge < 0:
+			jc.Expires = now.Add(-time.Second)
+		case c.MaxAge > 0:
+			jc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			jc.Expires = c.Expires
+		}
+		key := jc.key()
+		if !jc.Expires.IsZero() && !jc.Expires.After(now) {
+			if _, ok := jar.cookies[key]; ok {
+				delete(jar.cookies, key)
+				changed = true
+			}
+			continue
+		}
+		if old, ok := jar.cookies[key]; ok {
+			jc.Created = old.Created
+		}
+		jar.cookies[key] = jc
+		changed = true
+	}
+	return changed
+}
+
+// defaultCookiePath returns the path of the cookies set without Path from path
+func defaultCookiePath(path string) string {
+	i := strings.LastIndexByte(path, '/')
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// Cookies returns the cookies to send to u, the ones with the longest path first.
+func (jar *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	if jar == nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	now := jar.now()
+	jar.mu.Lock()
+	var matched []*JarCookie
+	for _, c := range jar.cookies {
+		if !c.Expires.IsZero() && !c.Expires.After(now) ||
+			c.Secure && u.Scheme != "https" ||
+			c.Domain != host && (c.HostOnly || !strings.HasSuffix(host, "."+c.Domain)) ||
+			!cookiePathMatch(c.Path, path) {
+			continue
+		}
+		matched = append(matched, c)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		if len(matched[i].Path) != len(matched[j].Path) {
+			return len(matched[i].Path) > len(matched[j].Path)
+		}
+		return matched[i].Created.Before(matched[j].Created)
+	})
+	cookies := make([]*http.Cookie, len(matched))
+	for i, c := range matched {
+		cookies[i] = &http.Cookie{Name: c.Name, Value: c.Value}
+	}
+	jar.mu.Unlock()
+	return cookies
+}
+
+func cookiePathMatch(cookiePath, path string) bool {
+	return path == cookiePath ||
+		strings.HasPrefix(path, cookiePath) && (strings.HasSuffix(cookiePath, "/") || path[len(cookiePath)] == '/')
+}
+
+// All returns all the cookies of the jar, including the expired ones not purged yet.
+func (jar *CookieJar) All() []JarCookie {
+	jar.mu.Lock()
+	defer jar.mu.Unlock()
+	return jar.all()
+}
+
+func (jar *CookieJar) all() []JarCookie {
+	cookies := make([]JarCookie, 0, len(jar.cookies))
+	for _, c := range jar.cookies {
+		cookies = append(cookies, *c)
+	}
+	sort.Slice(cookies, func(i, j int) bool { return cookies[i].key() < cookies[j].key() })
+	return cookies
+}
+
+// Delete removes the cookies named name for the given domain, from all paths. All
+// the cookies of domain are removed if name is empty.
+func (jar *CookieJar) Delete(domain, name string) {
+	domain = strings.TrimPrefix(strings.ToLower(domain), ".")
+	jar.update(func() bool {
+		changed := false
+		for key, c := range jar.cookies {
+			if c.Domain == domain && (name == "" || c.Name == name) {
+				delete(jar.cookies, key)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// Clear removes all the cookies of the jar.
+func (jar *CookieJar) Clear() {
+	jar.update(func() bool {
+		changed := len(jar.cookies) > 0
+		jar.cookies = make(map[string]*JarCookie)
+		return changed
+	})
+}
+
+// update applies f to the jar and saves it if f changed it
+func (jar *CookieJar) update(f func() bool) {
+	jar.mu.Lock()
+	if !f() || jar.save == nil {
+		jar.mu.Unlock()
+		return
+	}
+	cookies := jar.all()
+	jar.mu.Unlock()
+	jar.save(cookies)
+}
@@ -1,14 +1,24 @@
 package goproxy
 
 import (
+	"bufio"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
 	"net/http"
 	"regexp"
+	"sync/atomic"
+	"time"
 )
 
 // ProxyCtx is the Proxy context, contains useful information about every request. It is passed to
 // every user function. Also used as a logger.
 type ProxyCtx struct {
+	// tunnelSeq counts the requests MITM'd from the tunnel of a CONNECT context. It is
+	// updated atomically, and must stay first to be aligned on 32 bit platforms.
+	tunnelSeq int64
+
 	// May contain the remote host name
 	Host string
 
@@ -19,19 +29,171 @@ type ProxyCtx struct {
 	Resp         *http.Response
 	RoundTripper RoundTripper
 
+	// Transport, if set, is used instead of Proxy.Tr to send this request upstream.
+	// It allows a handler to change TLS verification, client certificates or even
+	// the protocol for a single request without touching the shared transport.
+	// When set on the CONNECT context, it is inherited by the MITM'd requests.
+	Transport http.RoundTripper
+
+	// ClientID is the identity of the client, as returned by the ClientIdentifier of
+	// the proxy. It is inherited by the requests MITM'd from a CONNECT tunnel.
+	ClientID string
+
+	// Rule is the rule of a RuleSet which matched the request, by name or else by index.
+	Rule string
+
+	// ClientCert is the certificate presented by the client during the MITM TLS
+	// handshake, if the proxy requested one (see ProxyHttpServer.MitmClientAuth).
+	ClientCert *x509.Certificate
+
+	// ClientHello is the TLS ClientHello sent by the client over a CONNECT tunnel,
+	// available when ProxyHttpServer.CaptureClientHello is set. Use its JA3 and JA4
+	// methods to fingerprint the client.
+	ClientHello *ClientHello
+
+	// ClientTLSState is the state of the TLS connection with a MITM'd client, and
+	// UpstreamTLSState the one of the connection the response was received on
+	// (nil for plain http). Both include version, cipher suite, ALPN and SNI.
+	ClientTLSState   *tls.ConnectionState
+	UpstreamTLSState *tls.ConnectionState
+
+	// Latency is the time the upstream took to answer the request with the headers of
+	// its response, set once RoundTrip returned. It is zero for responses made by
+	// handlers.
+	Latency time.Duration
+
+	// FollowRedirects, if set by a request handler, is the number of redirects the proxy
+	// follows upstream for the request, returning the final response to the client.
+	// Redirect loops are answered with 508 Loop Detected. The 307 and 308 redirects of
+	// requests with a body are followed only if the request has a GetBody function.
+	FollowRedirects int
+
+	// ConnectResponseHeader holds headers HttpsHandlers want to add to the
+	// "200 OK" response to the client CONNECT request.
+	ConnectResponseHeader http.Header
+
+	// UpstreamConnectHeader contains the headers of the upstream proxy response to our
+	// CONNECT request, when the tunnel was dialed with NewConnectDialToProxy.
+	UpstreamConnectHeader http.Header
+
 	// will contain the recent error that occurred while trying to send receive or parse traffic
 	Error error
 
 	// A handle for the user to keep data in the context, from the call of ReqHandler to the
-	// call of RespHandler
+	// call of RespHandler. The UserData of the CONNECT context is copied into the
+	// contexts of the requests MITM'd from its tunnel, later changes are not shared.
 	UserData interface{}
 
+	// ConnData is shared by all the contexts of a client connection: the CONNECT request,
+	// the requests MITM'd from its tunnel, and the websocket or upgraded streams they
+	// start. Requests proxied outside of a tunnel get their own ConnData.
+	// ReqData is private to a single request and its response.
+	// Both are never nil and safe for concurrent use.
+	ConnData *Data
+	ReqData  *Data
+
+	// clientAddr is the address of the client connection, see ClientAddr
+	clientAddr string
+	// tunnelBytes counts the bytes of the tunnel of a CONNECT context, see TunnelClosed
+	tunnelBytes *tunnelBytes
+	// rangeReq is the Range request removed from Req, see ProxyHttpServer.RangeMode
+	rangeReq *rangeRequest
+
+	// mitmConn is the decrypted connection of a MITM'd client, see HijackTLSConn
+	mitmConn *mitmConn
+	// httpMitm is the upstream connection of the ConnectHTTPMitm tunnel a request was
+	// read from, used for the requests to the CONNECT host
+	httpMitm *httpMitmUpstream
+	// http2 is set for the requests of MITM'd clients which negotiated HTTP/2
+	http2 bool
+	// abandoned is set when a handler timed out, still running on copies of the
+	// context, see ProxyHttpServer.HandlerTimeout
+	abandoned bool
+	// kept is set by Keep
+	kept bool
+
+	// TunnelID is the Session of the CONNECT context a request was MITM'd from, and Seq
+	// the number of the request in its tunnel, from 1. Both are zero outside of
+	// tunnels. See ID.
+	TunnelID int64
+	Seq      int64
+
+	// RequestID is the correlation ID of the request, sent upstream and back to the
+	// client, see ProxyHttpServer.RequestIDHeader.
+	RequestID string
+
 	// Will connect a request to a response
 	Session   int64
 	certStore CertStorage
 	Proxy     *ProxyHttpServer
 }
 
+// ClientAddr returns the address, "ip:port", of the client connection the request or
+// tunnel of ctx came from. It is shared by all the contexts of a connection, the
+// requests MITM'd from a CONNECT tunnel included, whatever handlers did to Req.
+func (ctx *ProxyCtx) ClientAddr() string {
+	if ctx.clientAddr == "" && ctx.Req != nil {
+		return ctx.Req.RemoteAddr
+	}
+	return ctx.clientAddr
+}
+
+// ErrNotMitmTLS is returned by HijackTLSConn outside of MITM'd TLS connections, and
+// ErrHijacked when the connection was already hijacked.
+var (
+	ErrNotMitmTLS = errors.New("goproxy: not a MITM'd TLS connection")
+	ErrHijacked   = errors.New("goproxy: connection already hijacked")
+)
+
+// mitmConn is the decrypted client side of a MITM'd TLS connection, shared by the
+// contexts of the requests read from it.
+type mitmConn struct {
+	conn   *tls.Conn
+	reader *bufio.Reader
+	// hijacked is set atomically, by a handler possibly outliving its HandlerTimeout
+	hijacked int32
+}
+
+func (c *mitmConn) close() {
+	if atomic.LoadInt32(&c.hijacked) == 0 {
+		c.conn.Close()
+	}
+}
+
+// HijackTLSConn lets a handler take over the decrypted connection with a MITM'd client,
+// like http.Hijacker does after TLS termination, e.g. to sniff or stream another protocol.
+// Reading from the returned connection first returns the data the client already sent
+// after the current request. Once hijacked, the proxy neither sends a response for the
+// current request nor reads further requests, and the caller must close the connection.
+//
+//	proxy.OnRequest(goproxy.UrlIs("example.com/stream")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		conn, err := ctx.HijackTLSConn()
+//		if err == nil {
+//			go serveStream(conn)
+//		}
+//		return req, nil
+//	})
+func (ctx *ProxyCtx) HijackTLSConn() (net.Conn, error) {
+	if ctx.mitmConn == nil {
+		return nil, ErrNotMitmTLS
+	}
+	if !atomic.CompareAndSwapInt32(&ctx.mitmConn.hijacked, 0, 1) {
+		return nil, ErrHijacked
+	}
+	return bufferedConn(ctx.mitmConn.conn, ctx.mitmConn.reader), nil
+}
+
+// Keep lets ctx be used once its exchange is over, e.g. by the goroutines a handler
+// starts: the proxies with PoolContexts do not reuse it. It must be called by the
+// handler, before it returns.
+func (ctx *ProxyCtx) Keep() {
+	ctx.kept = true
+}
+
+func (ctx *ProxyCtx) hijacked() bool {
+	return ctx.mitmConn != nil && atomic.LoadInt32(&ctx.mitmConn.hijacked) != 0
+}
+
 type RoundTripper interface {
 	RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Response, error)
 }
@@ -47,14 +209,56 @@ func (f RoundTripperFunc) RoundTrip(req *http.Request, ctx *ProxyCtx) (*http.Res
 }
 
 func (ctx *ProxyCtx) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := ctx.roundTripOnce(req)
+	if err != nil || ctx.FollowRedirects <= 0 {
+		return resp, err
+	}
+	return ctx.followRedirects(req, resp, ctx.roundTripOnce)
+}
+
+func (ctx *ProxyCtx) roundTripOnce(req *http.Request) (*http.Response, error) {
+	ctx.Proxy.CookieJars.applyRequest(req, ctx)
+	resp, err := ctx.Proxy.UpstreamLimiter.roundTrip(req, ctx, func() (*http.Response, error) {
+		// the time waiting for the limiter is not the latency of the upstream
+		clock := ctx.Proxy.clock()
+		start := clock.Now()
+		defer func() { ctx.Latency = clock.Now().Sub(start) }()
+		return ctx.roundTrip(req)
+	})
+	ctx.Proxy.CookieJars.recordResponse(req, resp, ctx)
+	if resp != nil {
+		// the challenges of upstream proxies are for this one, not its clients
+		resp.Header.Del("Proxy-Authenticate")
+		if resp.TLS != nil {
+			ctx.UpstreamTLSState = resp.TLS
+		}
+	}
+	return resp, err
+}
+
+func (ctx *ProxyCtx) roundTrip(req *http.Request) (*http.Response, error) {
 	if ctx.RoundTripper != nil {
 		return ctx.RoundTripper.RoundTrip(req, ctx)
 	}
-	return ctx.Proxy.Tr.RoundTrip(req)
+	if ctx.Transport != nil {
+		return ctx.Transport.RoundTrip(req)
+	}
+	if u := ctx.httpMitm; u != nil && req.URL.Scheme == "http" && req.URL.Host == u.ctx.Host {
+		return u.roundTrip(req)
+	}
+	tr, err := ctx.Proxy.upstreamTransport(req, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tr.RoundTrip(withProxyCtx(req, ctx))
 }
 
 func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
-	ctx.Proxy.Logger.Printf("[%03d] "+msg+"\n", append([]interface{}{ctx.Session & 0xFF}, argv...)...)
+	if ctx.ClientID != "" {
+		ctx.Proxy.Logger.Printf("[%s %s] "+msg+"\n", append([]interface{}{ctx.logID(), ctx.ClientID}, argv...)...)
+		return
+	}
+	ctx.Proxy.Logger.Printf("[%s] "+msg+"\n", append([]interface{}{ctx.logID()}, argv...)...)
 }
 
 // Logf prints a message to the proxy's log. Should be used in a ProxyHttpServer's filter
@@ -66,7 +270,7 @@ func (ctx *ProxyCtx) printf(msg string, argv ...interface{}) {
 //		return r, nil
 //	})
 func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
-	if ctx.Proxy.Verbose >= LOGLEVEL_VERBOSE {
+	if ctx.Proxy.LogLevel() >= LOGLEVEL_VERBOSE {
 		ctx.printf("INFO: "+msg, argv...)
 	}
 }
@@ -83,7 +287,7 @@ func (ctx *ProxyCtx) Logf(msg string, argv ...interface{}) {
 //		return r, nil
 //	})
 func (ctx *ProxyCtx) Warnf(msg string, argv ...interface{}) {
-	if ctx.Proxy.Verbose >= LOGLEVEL_WARN {
+	if ctx.Proxy.LogLevel() >= LOGLEVEL_WARN {
 		ctx.printf("WARN: "+msg, argv...)
 	}
 }
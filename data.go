@@ -0,0 +1,113 @@
+package goproxy
+
+import (
+	"sort"
+	"sync"
+)
+
+// Data is a key/value store safe for concurrent use, attached to every ProxyCtx as
+// ConnData and ReqData. The zero value is an empty store, and a nil *Data can be read.
+type Data struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+// NewData returns an empty Data.
+func NewData() *Data {
+	return &Data{}
+}
+
+// Get returns the value stored under key, and whether it exists.
+func (d *Data) Get(key string) (interface{}, bool) {
+	if d == nil {
+		return nil, false
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, ok := d.values[key]
+	return v, ok
+}
+
+// Set stores value under key.
+func (d *Data) Set(key string, value interface{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.values == nil {
+		d.values = make(map[string]interface{})
+	}
+	d.values[key] = value
+}
+
+// GetOrSet returns the value stored under key if it exists. Otherwise it stores and
+// returns value. loaded is true if the value already existed.
+func (d *Data) GetOrSet(key string, value interface{}) (actual interface{}, loaded bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := d.values[key]; ok {
+		return v, true
+	}
+	if d.values == nil {
+		d.values = make(map[string]interface{})
+	}
+	d.values[key] = value
+	return value, false
+}
+
+// Add adds delta to the int stored under key, starting from 0, and returns the new value.
+func (d *Data) Add(key string, delta int) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.values == nil {
+		d.values = make(map[string]interface{})
+	}
+	i, _ := d.values[key].(int)
+	i += delta
+	d.values[key] = i
+	return i
+}
+
+// Delete removes the value stored under key.
+func (d *Data) Delete(key string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.values, key)
+}
+
+// Keys returns the sorted keys of the stored values.
+func (d *Data) Keys() []string {
+	if d == nil {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	keys := make([]string, 0, len(d.values))
+	for k := range d.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// String returns the string stored under key, or "" if there is none.
+func (d *Data) String(key string) string {
+	v, _ := d.Get(key)
+	s, _ := v.(string)
+	return s
+}
+
+// Int returns the int stored under key, or 0 if there is none.
+func (d *Data) Int(key string) int {
+	v, _ := d.Get(key)
+	i, _ := v.(int)
+	return i
+}
+
+// Bool returns the bool stored under key, or false if there is none.
+func (d *Data) Bool(key string) bool {
+	v, _ := d.Get(key)
+	b, _ := v.(bool)
+	return b
+}
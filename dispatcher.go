@@ -2,11 +2,13 @@ package goproxy
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // ReqCondition.HandleReq will decide whether or not to use the ReqHandler on an HTTP request
@@ -127,8 +129,9 @@ func DstHostIs(host string) ReqConditionFunc {
 // SrcIpIs returns a ReqCondition testing whether the source IP of the request is one of the given strings
 func SrcIpIs(ips ...string) ReqCondition {
 	return ReqConditionFunc(func(req *http.Request, ctx *ProxyCtx) bool {
+		src := hostWithoutPort(req.RemoteAddr)
 		for _, ip := range ips {
-			if strings.HasPrefix(req.RemoteAddr, ip+":") {
+			if src == strings.Trim(ip, "[]") {
 				return true
 			}
 		}
@@ -177,13 +180,59 @@ func StatusCodeIs(codes ...int) RespCondition {
 	})
 }
 
+// StatusClassIs returns a RespCondition testing whether the HTTP status code is in one
+// of the given classes, e.g. StatusClassIs(5) for the 5xx server errors.
+func StatusClassIs(classes ...int) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		for _, class := range classes {
+			if resp.StatusCode/100 == class {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// LatencyOver returns a RespCondition testing whether the upstream took more than d to
+// answer, see ProxyCtx.Latency. Responses made by handlers never match.
+func LatencyOver(d time.Duration) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && ctx.Latency > d
+	})
+}
+
+// ResponseSizeOver returns a RespCondition testing whether the response body is larger
+// than size bytes, as announced by its Content-Length. Responses of unknown length never
+// match.
+func ResponseSizeOver(size int64) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.ContentLength > size
+	})
+}
+
+// UpgradeProtocolIs returns a ReqCondition testing whether the request asks to upgrade
+// the connection to one of the given protocols, e.g. UpgradeProtocolIs("h2c").
+func UpgradeProtocolIs(protocols ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, p := range protocols {
+			if headerContains(req.Header, "Upgrade", p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 // ProxyHttpServer.OnRequest Will return a temporary ReqProxyConds struct, aggregating the given condtions.
 // You will use the ReqProxyConds struct to register a ReqHandler, that would filter
 // the request, only if all the given ReqCondition matched.
 // Typical usage:
 //	proxy.OnRequest(UrlIs("example.com/foo"),UrlMatches(regexp.MustParse(`.*\.exampl.\com\./.*`)).Do(...)
 func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
-	return &ReqProxyConds{proxy, conds}
+	return &ReqProxyConds{proxy, conds, 0}
 }
 
 // ReqProxyConds aggregate ReqConditions for a ProxyHttpServer. Upon calling Do, it will register a ReqHandler that would
@@ -191,11 +240,21 @@ func (proxy *ProxyHttpServer) OnRequest(conds ...ReqCondition) *ReqProxyConds {
 type ReqProxyConds struct {
 	proxy    *ProxyHttpServer
 	reqConds []ReqCondition
+	priority int
+}
+
+// Priority sets the priority of the handlers registered with pcond. Handlers with a higher
+// priority run first, handlers of the same priority run in registration order. The
+// default priority is 0.
+//	proxy.OnRequest().Priority(10).DoFunc(...) // runs before handlers registered with OnRequest()
+func (pcond *ReqProxyConds) Priority(priority int) *ReqProxyConds {
+	pcond.priority = priority
+	return pcond
 }
 
 // DoFunc is equivalent to proxy.OnRequest().Do(FuncReqHandler(f))
-func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) {
-	pcond.Do(FuncReqHandler(f))
+func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response)) *Registration {
+	return pcond.Do(FuncReqHandler(f))
 }
 
 // ReqProxyConds.Do will register the ReqHandler on the proxy,
@@ -205,8 +264,9 @@ func (pcond *ReqProxyConds) DoFunc(f func(req *http.Request, ctx *ProxyCtx) (*ht
 //	proxy.OnRequest(cond1,cond2).Do(handler)
 //	// given request to the proxy, will test if cond1.HandleReq(req,ctx) && cond2.HandleReq(req,ctx) are true
 //	// if they are, will call handler.Handle(req,ctx)
-func (pcond *ReqProxyConds) Do(h ReqHandler) {
-	pcond.proxy.reqHandlers = append(pcond.proxy.reqHandlers,
+// The returned Registration removes the handler.
+func (pcond *ReqProxyConds) Do(h ReqHandler) *Registration {
+	return pcond.proxy.reqHandlers.add(
 		FuncReqHandler(func(r *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(r, ctx) {
@@ -214,7 +274,7 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 				}
 			}
 			return h.Handle(r, ctx)
-		}))
+		}), pcond.priority)
 }
 
 // HandleConnect is used when proxy receives an HTTP CONNECT request,
@@ -228,8 +288,8 @@ func (pcond *ReqProxyConds) Do(h ReqHandler) {
 // The ConnectAction struct contains possible tlsConfig that will be used for eavesdropping. If nil, the proxy
 // will use the default tls configuration.
 //	proxy.OnRequest().HandleConnect(goproxy.AlwaysReject) // rejects all CONNECT requests
-func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) *Registration {
+	return pcond.proxy.httpsHandlers.add(
 		FuncHttpsHandler(func(host string, proxyCtx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(proxyCtx.Req, proxyCtx) {
@@ -237,7 +297,7 @@ func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
 				}
 			}
 			return h.HandleHttpConnect(host, proxyCtx)
-		}))
+		}), pcond.priority)
 }
 
 // HandleConnectFunc is equivalent to HandleConnect,
@@ -252,12 +312,31 @@ func (pcond *ReqProxyConds) HandleConnect(h HttpsHandler) {
 //		}
 //		return RejectConnect, host
 //	})
-func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) {
-	pcond.HandleConnect(FuncHttpsHandler(f))
+func (pcond *ReqProxyConds) HandleConnectFunc(f func(host string, ctx *ProxyCtx) (*ConnectAction, string)) *Registration {
+	return pcond.HandleConnect(FuncHttpsHandler(f))
+}
+
+// HandleConnectReq is equivalent to HandleConnect, the handler also receives the CONNECT
+// request, for example to route according to a custom header
+//	proxy.OnRequest().HandleConnectReqFunc(func(req *http.Request, host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+//		if upstream := req.Header.Get("X-Route-To"); upstream != "" {
+//			return goproxy.OkConnect, upstream
+//		}
+//		return nil, ""
+//	})
+func (pcond *ReqProxyConds) HandleConnectReq(h HttpsReqHandler) *Registration {
+	return pcond.HandleConnect(FuncHttpsHandler(func(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+		return h.HandleHttpConnectReq(ctx.Req, host, ctx)
+	}))
+}
+
+// HandleConnectReqFunc is equivalent to proxy.OnRequest().HandleConnectReq(FuncHttpsReqHandler(f))
+func (pcond *ReqProxyConds) HandleConnectReqFunc(f func(req *http.Request, host string, ctx *ProxyCtx) (*ConnectAction, string)) *Registration {
+	return pcond.HandleConnectReq(FuncHttpsReqHandler(f))
 }
 
-func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) {
-	pcond.proxy.httpsHandlers = append(pcond.proxy.httpsHandlers,
+func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.Conn, ctx *ProxyCtx)) *Registration {
+	return pcond.proxy.httpsHandlers.add(
 		FuncHttpsHandler(func(host string, proxyCtx *ProxyCtx) (*ConnectAction, string) {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(proxyCtx.Req, proxyCtx) {
@@ -265,7 +344,7 @@ func (pcond *ReqProxyConds) HijackConnect(f func(req *http.Request, client net.C
 				}
 			}
 			return &ConnectAction{Action: ConnectHijack, Hijack: f}, host
-		}))
+		}), pcond.priority)
 }
 
 // ProxyConds is used to aggregate RespConditions for a ProxyHttpServer.
@@ -275,17 +354,24 @@ type ProxyConds struct {
 	proxy    *ProxyHttpServer
 	reqConds []ReqCondition
 	respCond []RespCondition
+	priority int
+}
+
+// Priority sets the priority of the handlers registered with pcond, see ReqProxyConds.Priority.
+func (pcond *ProxyConds) Priority(priority int) *ProxyConds {
+	pcond.priority = priority
+	return pcond
 }
 
 // ProxyConds.DoFunc is equivalent to proxy.OnResponse().Do(FuncRespHandler(f))
-func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) {
-	pcond.Do(FuncRespHandler(f))
+func (pcond *ProxyConds) DoFunc(f func(resp *http.Response, ctx *ProxyCtx) *http.Response) *Registration {
+	return pcond.Do(FuncRespHandler(f))
 }
 
 // ProxyConds.Do will register the RespHandler on the proxy, h.Handle(resp,ctx) will be called on every
-// request that matches the conditions aggregated in pcond.
-func (pcond *ProxyConds) Do(h RespHandler) {
-	pcond.proxy.respHandlers = append(pcond.proxy.respHandlers,
+// request that matches the conditions aggregated in pcond. The returned Registration removes the handler.
+func (pcond *ProxyConds) Do(h RespHandler) *Registration {
+	return pcond.proxy.respHandlers.add(
 		FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 			for _, cond := range pcond.reqConds {
 				if !cond.HandleReq(ctx.Req, ctx) {
@@ -298,14 +384,59 @@ func (pcond *ProxyConds) Do(h RespHandler) {
 				}
 			}
 			return h.Handle(resp, ctx)
-		}))
+		}), pcond.priority)
 }
 
 // OnResponse is used when adding a response-filter to the HTTP proxy, usual pattern is
 //	proxy.OnResponse(cond1,cond2).Do(handler) // handler.Handle(resp,ctx) will be used
 //				// if cond1.HandleResp(resp) && cond2.HandleResp(resp)
 func (proxy *ProxyHttpServer) OnResponse(conds ...RespCondition) *ProxyConds {
-	return &ProxyConds{proxy, make([]ReqCondition, 0), conds}
+	return &ProxyConds{proxy, make([]ReqCondition, 0), conds, 0}
+}
+
+// UpgradeProxyConds aggregates ReqConditions for a ProxyHttpServer. Upon calling Do, it will
+// register an UpgradeHandler that would take over upgraded connections whose request met
+// all conditions.
+type UpgradeProxyConds struct {
+	proxy    *ProxyHttpServer
+	reqConds []ReqCondition
+	priority int
+}
+
+// Priority sets the priority of the handlers registered with pcond, see ReqProxyConds.Priority.
+func (pcond *UpgradeProxyConds) Priority(priority int) *UpgradeProxyConds {
+	pcond.priority = priority
+	return pcond
+}
+
+// OnUpgrade is used to handle connections switched to another protocol by a 101 Switching
+// Protocols response, either on the plain proxy or inside MITM'd tunnels.
+// The first registered handler whose conditions match the request takes over the
+// connection, otherwise the upgraded connection is tunneled as is.
+//	proxy.OnUpgrade(goproxy.UpgradeProtocolIs("h2c")).DoFunc(func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *goproxy.ProxyCtx) {
+//		...
+//	})
+func (proxy *ProxyHttpServer) OnUpgrade(conds ...ReqCondition) *UpgradeProxyConds {
+	return &UpgradeProxyConds{proxy, conds, 0}
+}
+
+// UpgradeProxyConds.DoFunc is equivalent to proxy.OnUpgrade().Do(FuncUpgradeHandler(f))
+func (pcond *UpgradeProxyConds) DoFunc(f func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx)) *Registration {
+	return pcond.Do(FuncUpgradeHandler(f))
+}
+
+// UpgradeProxyConds.Do will register the UpgradeHandler on the proxy.
+func (pcond *UpgradeProxyConds) Do(h UpgradeHandler) *Registration {
+	return pcond.proxy.upgradeHandlers.add(
+		upgradeHandlerFunc(func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx) bool {
+			for _, cond := range pcond.reqConds {
+				if !cond.HandleReq(ctx.Req, ctx) {
+					return false
+				}
+			}
+			h.HandleUpgrade(resp, client, upstream, ctx)
+			return true
+		}), pcond.priority)
 }
 
 // AlwaysMitm is a HttpsHandler that always eavesdrop https connections, for example to
@@ -0,0 +1,96 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+// The causes of the failures of the proxy. The errors it sets in ProxyCtx.Error, passes
+// to HandlerFailed and logs match them with errors.Is, and errors.Unwrap returns their
+// underlying cause:
+//
+//	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+//		if resp == nil && errors.Is(ctx.Error, goproxy.ErrDialUpstream) {
+//			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "Site down\n")
+//		}
+//		return resp
+//	})
+var (
+	ErrDialUpstream         = errors.New("goproxy: cannot dial upstream")
+	ErrTLSHandshakeClient   = errors.New("goproxy: TLS handshake with the client failed")
+	ErrTLSHandshakeUpstream = errors.New("goproxy: TLS handshake with upstream failed")
+	ErrMalformedRequest     = errors.New("goproxy: malformed request")
+	ErrHandlerPanic         = errors.New("goproxy: handler panic")
+)
+
+// ProxyError is a failure of the proxy while serving a request or a tunnel.
+type ProxyError struct {
+	// Kind is the cause of the failure, such as ErrDialUpstream
+	Kind error
+	// ID is the ProxyCtx.ID of the request or tunnel, and Host the host it was sent to
+	ID   string
+	Host string
+	// Err is the underlying error
+	Err error
+}
+
+func (e *ProxyError) Error() string {
+	msg := e.Kind.Error()
+	if e.Host != "" {
+		msg += " " + e.Host
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *ProxyError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the Kind of e.
+func (e *ProxyError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// newProxyError returns err as a ProxyError of kind, unless it wraps one already.
+func newProxyError(ctx *ProxyCtx, kind error, host string, err error) error {
+	var proxyErr *ProxyError
+	if errors.As(err, &proxyErr) {
+		return err
+	}
+	e := &ProxyError{Kind: kind, Host: host, Err: err}
+	if ctx != nil {
+		e.ID = ctx.ID()
+	}
+	return e
+}
+
+// upstreamError returns the error of a request sent to host as a ProxyError if its
+// cause is known: the dial or the TLS handshake failed.
+func upstreamError(ctx *ProxyCtx, host string, err error) error {
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &opErr) && (opErr.Op == "remote error" || opErr.Op == "local error"),
+		errors.As(err, &recordErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr), errors.As(err, &hostnameErr):
+		// tls alerts are reported as remote or local errors
+		return newProxyError(ctx, ErrTLSHandshakeUpstream, host, err)
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return newProxyError(ctx, ErrDialUpstream, host, err)
+	}
+	return err
+}
+
+// Is reports whether target is ErrHandlerPanic.
+func (e *HandlerPanicError) Is(target error) bool {
+	return target == ErrHandlerPanic
+}
+
+// Is reports whether target is ErrMalformedRequest.
+func (e *InvalidRequestError) Is(target error) bool {
+	return target == ErrMalformedRequest
+}
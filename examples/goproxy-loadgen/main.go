@@ -0,0 +1,200 @@
+// goproxy-loadgen drives a proxy with concurrent clients against a local origin, and
+// reports the rate of requests or the throughput of tunnels.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+func main() {
+	proxyAddr := flag.String("proxy", "", "address of the proxy to load, an in-process goproxy if empty")
+	mode := flag.String("mode", "plain", "plain (HTTP requests), mitm (HTTPS requests) or tunnel (CONNECT tunnels echoing data)")
+	concurrency := flag.Int("c", 32, "number of concurrent clients")
+	duration := flag.Duration("d", 10*time.Second, "duration of the test")
+	size := flag.Int("size", 1024, "size of the response bodies, or of the chunks echoed through tunnels")
+	flag.Parse()
+
+	if *proxyAddr == "" {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.MitmKeepAlive = true
+		// the clients do not verify the certificates
+		proxy.AllowInsecureDefaultCA = true
+		if *mode == "mitm" {
+			proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		go http.Serve(l, proxy)
+		*proxyAddr = l.Addr().String()
+	}
+
+	body := bytes.Repeat([]byte("x"), *size)
+	origin := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	})
+	var target string
+	var worker func(stats *stats, deadline time.Time)
+	switch *mode {
+	case "plain", "mitm":
+		s := httptest.NewServer(origin)
+		if *mode == "mitm" {
+			s.Close()
+			s = httptest.NewTLSServer(origin)
+		}
+		defer s.Close()
+		target = s.URL
+		proxyURL := &url.URL{Scheme: "http", Host: *proxyAddr}
+		client := &http.Client{Transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			// the certificates are forged by the proxy, or those of the test origin
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+			MaxIdleConnsPerHost: *concurrency,
+		}}
+		worker = func(stats *stats, deadline time.Time) {
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				resp, err := client.Get(target)
+				if err != nil {
+					stats.fail(err)
+					continue
+				}
+				n, err := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if err != nil || resp.StatusCode != http.StatusOK {
+					stats.fail(fmt.Errorf("%s: %v", resp.Status, err))
+					continue
+				}
+				stats.done(n, time.Since(start))
+			}
+		}
+	case "tunnel":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer l.Close()
+		go echo(l)
+		target = l.Addr().String()
+		worker = func(stats *stats, deadline time.Time) {
+			if err := tunnel(*proxyAddr, target, body, stats, deadline); err != nil {
+				stats.fail(err)
+			}
+		}
+	default:
+		log.Fatalf("Unknown mode %q", *mode)
+	}
+
+	log.Printf("Loading %s through %s with %d clients for %v", target, *proxyAddr, *concurrency, *duration)
+	var stats stats
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(&stats, deadline)
+		}()
+	}
+	wg.Wait()
+	stats.report(time.Since(start))
+}
+
+// stats are the results of the clients
+type stats struct {
+	bytes, errors int64
+
+	mu        sync.Mutex
+	latencies []time.Duration
+	lastErr   error
+}
+
+func (s *stats) done(n int64, latency time.Duration) {
+	atomic.AddInt64(&s.bytes, n)
+	s.mu.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mu.Unlock()
+}
+
+func (s *stats) fail(err error) {
+	atomic.AddInt64(&s.errors, 1)
+	s.mu.Lock()
+	s.lastErr = err
+	s.mu.Unlock()
+}
+
+func (s *stats) report(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.latencies)
+	fmt.Printf("%d exchanges in %v, %.0f/s, %.1f MB/s\n", n, elapsed.Round(time.Millisecond),
+		float64(n)/elapsed.Seconds(), float64(s.bytes)/elapsed.Seconds()/1e6)
+	if n > 0 {
+		sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+		fmt.Printf("latency p50 %v p99 %v max %v\n", s.latencies[n/2], s.latencies[n*99/100], s.latencies[n-1])
+	}
+	if s.errors > 0 {
+		fmt.Printf("%d errors, last: %v\n", s.errors, s.lastErr)
+	}
+}
+
+func echo(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(c, c)
+			c.Close()
+		}()
+	}
+}
+
+// tunnel opens a CONNECT tunnel to target, and sends chunk through it until deadline,
+// reading back each echoed chunk.
+func tunnel(proxyAddr, target string, chunk []byte, stats *stats, deadline time.Time) error {
+	c, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s: %s", target, resp.Status)
+	}
+	for time.Now().Before(deadline) {
+		start := time.Now()
+		if _, err := c.Write(chunk); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(len(chunk))); err != nil {
+			return err
+		}
+		stats.done(int64(len(chunk)), time.Since(start))
+	}
+	return nil
+}
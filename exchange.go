@@ -0,0 +1,99 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// exchange proxies the requests read from a client connection. Plain proxy requests,
+// the requests of ConnectHTTPMitm tunnels and those of MITM'd TLS connections, over
+// HTTP/1.1 or HTTP/2, all go through it. They only differ in how requests are read,
+// sent upstream and answered, so that handlers, header hygiene and error handling
+// behave the same for all of them.
+type exchange struct {
+	proxy *ProxyHttpServer
+	ctx   *ProxyCtx
+	// roundTrip sends a request upstream, ctx.RoundTrip if nil
+	roundTrip func(req *http.Request) (*http.Response, error)
+	// prepare removes the headers of the client which must not be sent upstream,
+	// removeProxyHeaders unless the proxy KeepHeader if nil
+	prepare func(req *http.Request)
+	// intercept, if set, is called with the requests about to be sent upstream, and
+	// returns true if it served them itself, such as websocket requests
+	intercept func(req *http.Request) bool
+}
+
+// run proxies r. It returns the request as filtered by the handlers, the response to
+// write to the client, and origBody, the body of the upstream response, nil for
+// responses made by handlers. Upstream errors are passed to the response handlers in
+// ctx.Error, and answered with 502 Bad Gateway if they make no response. resp is nil
+// if the exchange is over: the connection was hijacked, the request was intercepted,
+// or the handlers returned no response.
+func (x *exchange) run(r *http.Request) (req *http.Request, resp *http.Response, origBody io.ReadCloser) {
+	proxy, ctx := x.proxy, x.ctx
+	req, resp = proxy.filterRequest(r, ctx)
+	if ctx.hijacked() {
+		ctx.Logf("Connection hijacked by a request handler")
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return req, nil, nil
+	}
+	if resp == nil {
+		resp = proxy.LoopGuard.checkRequest(req, ctx)
+	}
+	if resp == nil {
+		if x.intercept != nil && x.intercept(req) {
+			return req, nil, nil
+		}
+		if x.prepare != nil {
+			x.prepare(req)
+		} else if !proxy.KeepHeader {
+			removeProxyHeaders(ctx, req)
+		}
+		proxy.ForwardingHeaders.applyRequest(req)
+		proxy.LoopGuard.addRequestVia(proxy, req)
+		var err error
+		if x.roundTrip != nil {
+			resp, err = x.roundTrip(req)
+		} else {
+			resp, err = ctx.RoundTrip(req)
+		}
+		if err == ErrUpstreamBusy {
+			resp, err = upstreamBusyResponse(req), nil
+		}
+		if err != nil {
+			ctx.Error = upstreamError(ctx, req.URL.Host, err)
+			ctx.Warnf("Cannot read response of %v: %v", req.URL.Host, ctx.Error)
+		} else {
+			ctx.Logf("Received response %v", resp.Status)
+			// the challenges of upstream proxies are for this proxy, not its clients
+			resp.Header.Del("Proxy-Authenticate")
+			origBody = resp.Body
+		}
+	}
+
+	resp = proxy.filterResponse(resp, ctx)
+	if ctx.hijacked() {
+		ctx.Logf("Connection hijacked by a response handler")
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return req, nil, nil
+	}
+	if resp == nil {
+		if ctx.Error == nil {
+			ctx.Warnf("Response handlers returned no response for %v", req.URL)
+			if origBody != nil {
+				origBody.Close()
+			}
+			return req, nil, nil
+		}
+		resp = NewResponse(req, ContentTypeText, http.StatusBadGateway, ctx.Error.Error()+"\n")
+	}
+	removeResponseHopByHopHeaders(resp.Header)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		proxy.ForwardingHeaders.applyResponse(resp)
+	}
+	return req, resp, origBody
+}
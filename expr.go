@@ -0,0 +1,794 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a compiled expression of the small language used by ScriptPolicy. It supports
+// string, number, boolean and nil literals, lists ([a, b]), variables and their fields
+// (req.host), indexing (list[0], map["key"]), function calls, the operators
+// ! - + == != < <= > >= in && || and the conditional a ? b : c. There are no loops nor
+// assignments, and evaluation is bounded by a number of steps and a timeout.
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// ExprFunc is a function callable from expressions.
+type ExprFunc func(args ...interface{}) (interface{}, error)
+
+// ErrExprLimit is returned when the evaluation of an expression exceeds its step limit
+// or timeout.
+var ErrExprLimit = errors.New("goproxy: expression evaluation limit exceeded")
+
+// ExprLimits bound the evaluation of an expression. Zero values use the defaults.
+// Clock, if set, tells the time of Timeout instead of SystemClock, see
+// ProxyHttpServer.Clock.
+type ExprLimits struct {
+	MaxSteps int
+	Timeout  time.Duration
+	Clock    Clock
+}
+
+// Default evaluation limits of expressions.
+const (
+	DefaultExprMaxSteps = 10000
+	DefaultExprTimeout  = 10 * time.Millisecond
+)
+
+// CompileExpr parses an expression.
+func CompileExpr(src string) (*Expr, error) {
+	p := &exprParser{lex: exprLexer{src: src}}
+	p.next()
+	root, err := p.parseExpr()
+	if err == nil && p.tok.kind != tokEOF {
+		err = p.errorf("unexpected %q", p.tok.text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %v", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// MustCompileExpr is like CompileExpr but panics if the expression cannot be parsed.
+func MustCompileExpr(src string) *Expr {
+	e, err := CompileExpr(src)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Eval evaluates the expression with the given variables, which may hold strings,
+// float64 or int numbers, booleans, []interface{}, map[string]interface{} and ExprFunc.
+// The builtin functions contains, startsWith, endsWith, lower, upper, len and matches
+// are always available.
+func (e *Expr) Eval(vars map[string]interface{}, limits ExprLimits) (interface{}, error) {
+	if limits.MaxSteps <= 0 {
+		limits.MaxSteps = DefaultExprMaxSteps
+	}
+	if limits.Timeout <= 0 {
+		limits.Timeout = DefaultExprTimeout
+	}
+	clock := clockOrSystem(limits.Clock)
+	st := &exprState{vars: vars, maxSteps: limits.MaxSteps, clock: clock, deadline: clock.Now().Add(limits.Timeout)}
+	return e.root.eval(st)
+}
+
+type exprState struct {
+	vars     map[string]interface{}
+	steps    int
+	maxSteps int
+	clock    Clock
+	deadline time.Time
+}
+
+func (st *exprState) step() error {
+	st.steps++
+	// the clock is only checked every 64 steps
+	if st.steps > st.maxSteps || st.steps%64 == 1 && st.clock.Now().After(st.deadline) {
+		return ErrExprLimit
+	}
+	return nil
+}
+
+// lexer
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+type exprLexer struct {
+	src string
+	pos int
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "<=", ">=", "!", "<", ">", "+", "-", "?", ":", ".", ",", "(", ")", "[", "]"}
+
+func (l *exprLexer) next() (token, error) {
+	for l.pos < len(l.src) && strings.IndexByte(" \t\r\n", l.src[l.pos]) >= 0 {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.src) {
+		return token{tokEOF, "", start}, nil
+	}
+	c := l.src[l.pos]
+	switch {
+	case c >= '0' && c <= '9':
+		for l.pos < len(l.src) && (l.src[l.pos] >= '0' && l.src[l.pos] <= '9' || l.src[l.pos] == '.') {
+			l.pos++
+		}
+		return token{tokNumber, l.src[start:l.pos], start}, nil
+	case c == '"' || c == '\'':
+		l.pos++
+		for l.pos < len(l.src) && l.src[l.pos] != c {
+			if l.src[l.pos] == '\\' {
+				l.pos++
+			}
+			l.pos++
+		}
+		if l.pos >= len(l.src) {
+			return token{}, fmt.Errorf("unterminated string at %d", start)
+		}
+		l.pos++
+		text := l.src[start:l.pos]
+		if c == '\'' {
+			text = `"` + strings.Replace(text[1:len(text)-1], `"`, `\"`, -1) + `"`
+		}
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return token{}, fmt.Errorf("bad string at %d: %v", start, err)
+		}
+		return token{tokString, s, start}, nil
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		for l.pos < len(l.src) {
+			c := l.src[l.pos]
+			if c != '_' && !(c >= 'a' && c <= 'z') && !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+				break
+			}
+			l.pos++
+		}
+		return token{tokIdent, l.src[start:l.pos], start}, nil
+	}
+	for _, op := range exprOps {
+		if strings.HasPrefix(l.src[l.pos:], op) {
+			l.pos += len(op)
+			return token{tokOp, op, start}, nil
+		}
+	}
+	return token{}, fmt.Errorf("unexpected character %q at %d", c, start)
+}
+
+// parser
+
+type exprParser struct {
+	lex exprLexer
+	tok token
+	err error
+}
+
+func (p *exprParser) next() {
+	if p.err != nil {
+		return
+	}
+	p.tok, p.err = p.lex.next()
+	if p.err != nil {
+		p.tok = token{kind: tokEOF}
+	}
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf(format+" at %d", append(args, p.tok.pos)...)
+}
+
+func (p *exprParser) isOp(op string) bool {
+	return p.tok.kind == tokOp && p.tok.text == op
+}
+
+func (p *exprParser) expect(op string) error {
+	if !p.isOp(op) {
+		return p.errorf("expected %q", op)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	cond, err := p.parseBinary(0)
+	if err != nil || !p.isOp("?") {
+		return cond, err
+	}
+	p.next()
+	a, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	b, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	return &condNode{cond, a, b}, nil
+}
+
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3, "in": 3,
+	"+": 4, "-": 4,
+}
+
+func (p *exprParser) binaryOp() (string, int) {
+	if p.tok.kind == tokOp || p.tok.kind == tokIdent && p.tok.text == "in" {
+		if prec, ok := binaryPrecedence[p.tok.text]; ok {
+			return p.tok.text, prec
+		}
+	}
+	return "", 0
+}
+
+func (p *exprParser) parseBinary(minPrec int) (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec := p.binaryOp()
+		if prec == 0 || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op, left, right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!") || p.isOp("-") {
+		op := p.tok.text
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{op, x}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("expected field name")
+			}
+			x = &indexNode{x, &literalNode{p.tok.text}}
+			p.next()
+		case p.isOp("["):
+			p.next()
+			i, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			x = &indexNode{x, i}
+		case p.isOp("("):
+			p.next()
+			args, err := p.parseList(")")
+			if err != nil {
+				return nil, err
+			}
+			x = newCallNode(x, args)
+		default:
+			return x, p.err
+		}
+	}
+}
+
+func (p *exprParser) parseList(end string) ([]exprNode, error) {
+	var list []exprNode
+	for !p.isOp(end) {
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, x)
+		if !p.isOp(",") {
+			break
+		}
+		p.next()
+	}
+	return list, p.expect(end)
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.tok
+	switch {
+	case tok.kind == tokNumber:
+		p.next()
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", tok.text, tok.pos)
+		}
+		return &literalNode{f}, nil
+	case tok.kind == tokString:
+		p.next()
+		return &literalNode{tok.text}, nil
+	case tok.kind == tokIdent:
+		p.next()
+		switch tok.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "nil":
+			return &literalNode{nil}, nil
+		}
+		return &varNode{tok.text}, nil
+	case p.isOp("("):
+		p.next()
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	case p.isOp("["):
+		p.next()
+		list, err := p.parseList("]")
+		if err != nil {
+			return nil, err
+		}
+		return &listNode{list}, nil
+	}
+	if tok.kind == tokEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+// evaluation
+
+type exprNode interface {
+	eval(st *exprState) (interface{}, error)
+}
+
+type literalNode struct{ v interface{} }
+
+type varNode struct{ name string }
+
+type listNode struct{ items []exprNode }
+
+type indexNode struct{ x, index exprNode }
+
+type callNode struct {
+	fn   exprNode
+	args []exprNode
+	// re is the pattern of the matches calls with a valid string literal pattern,
+	// compiled once by CompileExpr
+	re *regexp.Regexp
+}
+
+func newCallNode(fn exprNode, args []exprNode) *callNode {
+	n := &callNode{fn: fn, args: args}
+	if v, ok := fn.(*varNode); ok && v.name == "matches" && len(args) == 2 {
+		if l, ok := args[1].(*literalNode); ok {
+			if pattern, ok := l.v.(string); ok {
+				// invalid patterns are reported when evaluated, as matches may be
+				// shadowed by a variable
+				n.re, _ = regexp.Compile(pattern)
+			}
+		}
+	}
+	return n
+}
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+type condNode struct{ cond, a, b exprNode }
+
+func (n *literalNode) eval(st *exprState) (interface{}, error) {
+	return n.v, st.step()
+}
+
+func (n *varNode) eval(st *exprState) (interface{}, error) {
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+	if v, ok := st.vars[n.name]; ok {
+		return normalize(v), nil
+	}
+	if f, ok := exprBuiltins[n.name]; ok {
+		return f, nil
+	}
+	if n.name == "matches" {
+		return ExprFunc(st.matches), nil
+	}
+	return nil, fmt.Errorf("undefined variable %q", n.name)
+}
+
+func (n *listNode) eval(st *exprState) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		v, err := item.eval(st)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, st.step()
+}
+
+func (n *indexNode) eval(st *exprState) (interface{}, error) {
+	x, err := n.x.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	i, err := n.index.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case map[string]interface{}:
+		key, ok := i.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %T", i)
+		}
+		return normalize(x[key]), nil
+	case []interface{}:
+		f, ok := i.(float64)
+		if !ok || f < 0 || int(f) >= len(x) {
+			return nil, fmt.Errorf("bad list index %v", i)
+		}
+		return x[int(f)], nil
+	case nil:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cannot index %T", x)
+}
+
+func (n *callNode) eval(st *exprState) (interface{}, error) {
+	fn, err := n.fn.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	f, ok := fn.(ExprFunc)
+	if !ok {
+		return nil, fmt.Errorf("cannot call %T", fn)
+	}
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		if args[i], err = arg.eval(st); err != nil {
+			return nil, err
+		}
+	}
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+	if _, shadowed := st.vars["matches"]; n.re != nil && !shadowed {
+		s, err := stringArgs("matches", 2, args)
+		if err != nil {
+			return nil, err
+		}
+		return n.re.MatchString(s[0]), nil
+	}
+	v, err := f(args...)
+	return normalize(v), err
+}
+
+func (n *unaryNode) eval(st *exprState) (interface{}, error) {
+	x, err := n.x.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "!" {
+		return !truthy(x), st.step()
+	}
+	f, ok := x.(float64)
+	if !ok {
+		return nil, fmt.Errorf("cannot negate %T", x)
+	}
+	return -f, st.step()
+}
+
+func (n *condNode) eval(st *exprState) (interface{}, error) {
+	cond, err := n.cond.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	if truthy(cond) {
+		return n.a.eval(st)
+	}
+	return n.b.eval(st)
+}
+
+func (n *binaryNode) eval(st *exprState) (interface{}, error) {
+	left, err := n.left.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	// short-circuit evaluation
+	switch n.op {
+	case "&&":
+		if !truthy(left) {
+			return false, nil
+		}
+		right, err := n.right.eval(st)
+		return truthy(right), err
+	case "||":
+		if truthy(left) {
+			return true, nil
+		}
+		right, err := n.right.eval(st)
+		return truthy(right), err
+	}
+	right, err := n.right.eval(st)
+	if err != nil {
+		return nil, err
+	}
+	if err := st.step(); err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		return contains(right, left)
+	case "+":
+		if l, ok := left.(string); ok {
+			return l + toString(right), nil
+		}
+	}
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if lok && rok {
+		switch n.op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	}
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		switch n.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid operation %T %s %T", left, n.op, right)
+}
+
+// normalize converts the Go values given as variables to the types of the language.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case []string:
+		list := make([]interface{}, len(v))
+		for i, s := range v {
+			list[i] = s
+		}
+		return list
+	case map[string]string:
+		m := make(map[string]interface{}, len(v))
+		for k, s := range v {
+			m[k] = s
+		}
+		return m
+	case func(args ...interface{}) (interface{}, error):
+		return ExprFunc(v)
+	}
+	return v
+}
+
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	}
+	return true
+}
+
+func equal(a, b interface{}) bool {
+	switch a.(type) {
+	case nil, bool, string, float64:
+		switch b.(type) {
+		case nil, bool, string, float64:
+			return a == b
+		}
+	}
+	return false
+}
+
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func contains(container, item interface{}) (bool, error) {
+	switch c := container.(type) {
+	case string:
+		s, ok := item.(string)
+		return ok && strings.Contains(c, s), nil
+	case []interface{}:
+		for _, v := range c {
+			if equal(v, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case map[string]interface{}:
+		s, ok := item.(string)
+		if !ok {
+			return false, nil
+		}
+		_, ok = c[s]
+		return ok, nil
+	case nil:
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid operation: in %T", container)
+}
+
+func stringArgs(name string, n int, args []interface{}) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name, n, len(args))
+	}
+	s := make([]string, n)
+	for i, arg := range args {
+		str, ok := arg.(string)
+		if !ok && arg != nil {
+			return nil, fmt.Errorf("%s expects string arguments, got %T", name, arg)
+		}
+		s[i] = str
+	}
+	return s, nil
+}
+
+func stringFunc2(name string, f func(a, b string) bool) ExprFunc {
+	return func(args ...interface{}) (interface{}, error) {
+		s, err := stringArgs(name, 2, args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0], s[1]), nil
+	}
+}
+
+func stringFunc1(name string, f func(s string) string) ExprFunc {
+	return func(args ...interface{}) (interface{}, error) {
+		s, err := stringArgs(name, 1, args)
+		if err != nil {
+			return nil, err
+		}
+		return f(s[0]), nil
+	}
+}
+
+var exprBuiltins = map[string]ExprFunc{
+	"contains":   stringFunc2("contains", strings.Contains),
+	"startsWith": stringFunc2("startsWith", strings.HasPrefix),
+	"endsWith":   stringFunc2("endsWith", strings.HasSuffix),
+	"lower":      stringFunc1("lower", strings.ToLower),
+	"upper":      stringFunc1("upper", strings.ToUpper),
+	"len": func(args ...interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("len expects 1 argument, got %d", len(args))
+		}
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v)), nil
+		case []interface{}:
+			return float64(len(v)), nil
+		case map[string]interface{}:
+			return float64(len(v)), nil
+		case nil:
+			return float64(0), nil
+		}
+		return nil, fmt.Errorf("len of %T", args[0])
+	},
+}
+
+// matches is the matches builtin. Its patterns, unless compiled by CompileExpr, are
+// compiled on each call and charged to the step limit by their length.
+func (st *exprState) matches(args ...interface{}) (interface{}, error) {
+	s, err := stringArgs("matches", 2, args)
+	if err != nil {
+		return nil, err
+	}
+	st.steps += len(s[1])
+	if st.steps > st.maxSteps {
+		return nil, ErrExprLimit
+	}
+	re, err := regexp.Compile(s[1])
+	if err != nil {
+		return nil, err
+	}
+	if st.clock.Now().After(st.deadline) {
+		return nil, ErrExprLimit
+	}
+	return re.MatchString(s[0]), nil
+}
@@ -0,0 +1,103 @@
+package goproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExprEval(t *testing.T) {
+	vars := map[string]interface{}{
+		"host":  "www.example.com",
+		"port":  443,
+		"tags":  []string{"a", "b"},
+		"attrs": map[string]string{"k": "v"},
+		"twice": ExprFunc(func(args ...interface{}) (interface{}, error) {
+			return args[0].(float64) * 2, nil
+		}),
+	}
+	for _, tc := range []struct {
+		src      string
+		expected interface{}
+	}{
+		{`1 + 2 - 4`, float64(-1)},
+		{`"a" + 'b' + 1`, "ab1"},
+		{`endsWith(host, ".example.com") && port == 443`, true},
+		{`!(port > 80) || false`, false},
+		{`"b" in tags && "k" in attrs && "example" in host`, true},
+		{`attrs.k + attrs["k"] + tags[1]`, "vvb"},
+		{`port == 443 ? "mitm" : "tunnel"`, "mitm"},
+		{`port != 443 ? "a" : port < 10 ? "b" : "c"`, "c"},
+		{`twice(port)`, float64(886)},
+		{`matches(host, "^www\\.") && len(tags) == 2`, true},
+		{`upper(lower("MiXeD"))`, "MIXED"},
+		{`attrs.missing == nil`, true},
+		{`[1, "x"][1]`, "x"},
+	} {
+		e, err := CompileExpr(tc.src)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		v, err := e.Eval(vars, ExprLimits{})
+		if err != nil || v != tc.expected {
+			t.Errorf("%s: expected %v, got %v %v", tc.src, tc.expected, v, err)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	for _, src := range []string{`1 +`, `(1`, `"unterminated`, `a b`, `f(1,`, `#`} {
+		if _, err := CompileExpr(src); err == nil {
+			t.Errorf("%s: expected a syntax error", src)
+		}
+	}
+	for _, src := range []string{`undefined`, `1 < "a"`, `-"a"`, `"a"(1)`, `[1][5]`} {
+		if _, err := MustCompileExpr(src).Eval(nil, ExprLimits{}); err == nil {
+			t.Errorf("%s: expected an evaluation error", src)
+		}
+	}
+	e := MustCompileExpr(`1 + 1 + 1 + 1 + 1`)
+	if _, err := e.Eval(nil, ExprLimits{MaxSteps: 5}); err != ErrExprLimit {
+		t.Error("Expected the step limit to be exceeded, got", err)
+	}
+	if _, err := e.Eval(nil, ExprLimits{Timeout: time.Nanosecond}); err != ErrExprLimit {
+		t.Error("Expected the timeout to be exceeded, got", err)
+	}
+	if _, err := e.Eval(nil, ExprLimits{Timeout: time.Nanosecond, Clock: stoppedClock{time.Now()}}); err != nil {
+		t.Error("Expected the timeout to follow the clock, got", err)
+	}
+}
+
+// stoppedClock is a Clock whose time does not pass
+type stoppedClock struct{ now time.Time }
+
+func (c stoppedClock) Now() time.Time { return c.now }
+
+func (c stoppedClock) NewTimer(d time.Duration) (<-chan time.Time, func() bool) {
+	return nil, func() bool { return true }
+}
+
+func TestExprMatches(t *testing.T) {
+	e := MustCompileExpr(`matches(host, "^www\\.")`)
+	if e.root.(*callNode).re == nil {
+		t.Error("Expected the constant pattern to be compiled by CompileExpr")
+	}
+	if _, err := MustCompileExpr(`matches(host, "(")`).Eval(nil, ExprLimits{}); err == nil {
+		t.Error("Expected an invalid pattern to fail the evaluation")
+	}
+	vars := map[string]interface{}{"host": "www.example.com", "pattern": "^www\\." + strings.Repeat("x?", 100)}
+	dynamic := MustCompileExpr(`matches(host, pattern)`)
+	if v, err := dynamic.Eval(vars, ExprLimits{}); err != nil || v != true {
+		t.Error("Expected the dynamic pattern to match, got", v, err)
+	}
+	if _, err := dynamic.Eval(vars, ExprLimits{MaxSteps: 100}); err != ErrExprLimit {
+		t.Error("Expected the compilation of the dynamic pattern to exceed the step limit, got", err)
+	}
+	vars["matches"] = ExprFunc(func(args ...interface{}) (interface{}, error) {
+		return "shadowed", nil
+	})
+	if v, err := e.Eval(vars, ExprLimits{}); err != nil || v != "shadowed" {
+		t.Error("Expected the matches variable to shadow the builtin, got", v, err)
+	}
+}
@@ -0,0 +1,314 @@
+// Package accesslog writes an access log of the proxy, one line per completed
+// exchange and per closed CONNECT tunnel, in Common or Combined Log Format or in JSON:
+//
+//	out, err := accesslog.OpenFile("/var/log/goproxy/access.log", 100<<20, 5)
+//	...
+//	accesslog.New(out, accesslog.FormatCombined).Install(proxy)
+//
+// Unlike the messages of ProxyCtx.Logf, the access log is meant to be kept and
+// processed by the usual log analysis tools.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// The formats of Logger.
+const (
+	// FormatCommon is the Common Log Format of the NCSA and Apache servers
+	FormatCommon = "common"
+	// FormatCombined adds the Referer and User-Agent headers to FormatCommon
+	FormatCombined = "combined"
+	// FormatJSON writes every entry as a JSON object
+	FormatJSON = "json"
+)
+
+// clfTime is the time format of the Common Log Format
+const clfTime = "02/Jan/2006:15:04:05 -0700"
+
+// Entry is a line of the access log.
+type Entry struct {
+	// Time is the time the request was received, or the tunnel opened
+	Time time.Time
+	// ClientAddr is the IP address of the client, and User its identity, see
+	// goproxy.ClientIdentifier
+	ClientAddr string
+	User       string
+	Session    int64
+	Method     string
+	URL        string
+	Proto      string
+	// Status is the status of the response sent to the client, 500 for requests
+	// which failed without response
+	Status int
+	// Size is the size of the response body sent to the client, or the bytes sent
+	// to the client through a tunnel
+	Size int64
+	// BytesIn is the number of bytes received from the client through a tunnel
+	BytesIn   int64
+	Referer   string
+	UserAgent string
+	Duration  time.Duration
+	// Tunnel is the kind of the tunnel for the entries of closed tunnels, such as
+	// goproxy.ConnTunnel or goproxy.ConnMitm
+	Tunnel string
+	Error  string
+	// Fields are the custom fields added by Logger.Fields
+	Fields map[string]interface{}
+	// ID is the hierarchical ID of the context, see goproxy.ProxyCtx.ID, and RequestID
+	// the correlation ID of the request, see goproxy.ProxyHttpServer.RequestIDHeader
+	ID        string
+	RequestID string
+}
+
+// Logger writes the access log of a proxy to Output.
+type Logger struct {
+	Output io.Writer
+	// Format is one of FormatCommon, FormatCombined and FormatJSON, FormatCommon if empty
+	Format string
+	// Fields, if set, returns custom fields to add to e, appended as key="value" pairs
+	// to the lines in Common and Combined Log Format.
+	Fields func(e *Entry, ctx *goproxy.ProxyCtx) map[string]interface{}
+
+	mu sync.Mutex
+}
+
+// New returns a Logger writing to w in format.
+func New(w io.Writer, format string) *Logger {
+	return &Logger{Output: w, Format: format}
+}
+
+// The priorities of the handlers of the logger, so that the request is timed before
+// the other handlers run and the response is logged as modified by them.
+const (
+	requestPriority  = 1 << 20
+	responsePriority = -1 << 20
+)
+
+const entryKey = "accesslog.entry"
+
+// Install logs the exchanges and the tunnels of proxy. Tunnels are logged by setting
+// proxy.TunnelClosed, after calling the previous one.
+func (l *Logger) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Priority(requestPriority).DoFunc(l.handleRequest)
+	proxy.OnResponse().Priority(responsePriority).DoFunc(l.handleResponse)
+	previous := proxy.TunnelClosed
+	proxy.TunnelClosed = func(ctx *goproxy.ProxyCtx, stats goproxy.TunnelStats) {
+		if previous != nil {
+			previous(ctx, stats)
+		}
+		l.logTunnel(ctx, stats)
+	}
+}
+
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func (l *Logger) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	ctx.ReqData.Set(entryKey, &Entry{
+		Time:       time.Now(),
+		ClientAddr: clientIP(req.RemoteAddr),
+		Session:    ctx.Session,
+		ID:         ctx.ID(),
+		RequestID:  ctx.RequestID,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Proto:      req.Proto,
+		Referer:    req.Referer(),
+		UserAgent:  req.UserAgent(),
+	})
+	return req, nil
+}
+
+// countingBody logs the entry of a response once its body was sent
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.n) })
+	return err
+}
+
+func (l *Logger) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := ctx.ReqData.Get(entryKey)
+	e, ok := v.(*Entry)
+	if !ok {
+		return resp
+	}
+	ctx.ReqData.Delete(entryKey)
+	e.User = ctx.ClientID
+	if resp == nil {
+		e.Status = http.StatusInternalServerError
+		if ctx.Error != nil {
+			e.Error = ctx.Error.Error()
+		}
+		l.log(e, ctx)
+		return resp
+	}
+	e.Status = resp.StatusCode
+	if resp.Body == nil {
+		l.log(e, ctx)
+		return resp
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+		e.Size = n
+		l.log(e, ctx)
+	}}
+	return resp
+}
+
+func (l *Logger) logTunnel(ctx *goproxy.ProxyCtx, stats goproxy.TunnelStats) {
+	e := &Entry{
+		Time:       stats.Started,
+		ClientAddr: clientIP(stats.ClientAddr),
+		User:       stats.ClientID,
+		Session:    stats.Session,
+		ID:         ctx.ID(),
+		Method:     http.MethodConnect,
+		URL:        stats.Host,
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusOK,
+		Size:       stats.BytesOut,
+		BytesIn:    stats.BytesIn,
+		Duration:   stats.Duration,
+		Tunnel:     stats.Kind,
+	}
+	if ctx.Req != nil {
+		e.Proto = ctx.Req.Proto
+		e.Referer, e.UserAgent = ctx.Req.Referer(), ctx.Req.UserAgent()
+	}
+	l.log(e, ctx)
+}
+
+func (l *Logger) log(e *Entry, ctx *goproxy.ProxyCtx) {
+	if e.Duration == 0 {
+		e.Duration = time.Since(e.Time)
+	}
+	if l.Fields != nil {
+		e.Fields = l.Fields(e, ctx)
+	}
+	if err := l.Log(e); err != nil {
+		ctx.Warnf("Cannot write access log: %v", err)
+	}
+}
+
+// Log writes e to the access log.
+func (l *Logger) Log(e *Entry) error {
+	line, err := l.format(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.Output.Write(line)
+	return err
+}
+
+func (l *Logger) format(e *Entry) ([]byte, error) {
+	switch l.Format {
+	case FormatCommon, "":
+		return formatCLF(e, false), nil
+	case FormatCombined:
+		return formatCLF(e, true), nil
+	case FormatJSON:
+		return formatJSON(e)
+	}
+	return nil, fmt.Errorf("unknown access log format %q", l.Format)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatCLF(e *Entry, combined bool) []byte {
+	var b strings.Builder
+	size := "-"
+	if e.Size > 0 {
+		size = strconv.FormatInt(e.Size, 10)
+	}
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s", orDash(e.ClientAddr), orDash(strings.Replace(e.User, " ", "_", -1)),
+		e.Time.Format(clfTime), strconv.Quote(e.Method+" "+e.URL+" "+e.Proto), e.Status, size)
+	if combined {
+		fmt.Fprintf(&b, " %s %s", strconv.Quote(orDash(e.Referer)), strconv.Quote(orDash(e.UserAgent)))
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%s", k, strconv.Quote(fmt.Sprint(e.Fields[k])))
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func formatJSON(e *Entry) ([]byte, error) {
+	m := map[string]interface{}{
+		"time":        e.Time.Format(time.RFC3339Nano),
+		"client_addr": e.ClientAddr,
+		"session":     e.Session,
+		"method":      e.Method,
+		"url":         e.URL,
+		"proto":       e.Proto,
+		"status":      e.Status,
+		"size":        e.Size,
+		"duration_ms": float64(e.Duration) / float64(time.Millisecond),
+	}
+	optional := map[string]string{
+		"user":       e.User,
+		"referer":    e.Referer,
+		"user_agent": e.UserAgent,
+		"tunnel":     e.Tunnel,
+		"error":      e.Error,
+		"id":         e.ID,
+		"request_id": e.RequestID,
+	}
+	for k, v := range optional {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if e.Tunnel != "" {
+		m["bytes_in"] = e.BytesIn
+	}
+	for k, v := range e.Fields {
+		if _, ok := m[k]; !ok {
+			m[k] = v
+		}
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
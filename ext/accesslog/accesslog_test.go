@@ -0,0 +1,156 @@
+package accesslog_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/accesslog"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+// syncBuffer is written by the proxy while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// waitLines waits for the buffer to hold n lines, which are logged once the responses
+// were sent and the tunnels closed.
+func (b *syncBuffer) waitLines(t *testing.T, n int) []string {
+	for i := 0; ; i++ {
+		b.mu.Lock()
+		lines := strings.SplitAfter(b.buf.String(), "\n")
+		b.mu.Unlock()
+		lines = lines[:len(lines)-1]
+		if len(lines) >= n {
+			return lines
+		}
+		if i == 100 {
+			t.Fatalf("Expected %d log lines, got %q", n, lines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Set("User-Agent", "test-agent")
+	req.Header.Set("Referer", "http://referer/")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func TestAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+
+	var out syncBuffer
+	proxy := goproxy.NewProxyHttpServer()
+	logger := accesslog.New(&out, accesslog.FormatCombined)
+	logger.Install(proxy)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	get(t, client, backend.URL+"/path")
+	get(t, client, tlsBackend.URL+"/")
+	lines := out.waitLines(t, 2)
+	exchange := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "GET http://127\.0\.0\.1:\d+/path HTTP/1\.1" 200 7 "http://referer/" "test-agent"\n$`)
+	if !exchange.MatchString(lines[0]) {
+		t.Errorf("Unexpected exchange line %q", lines[0])
+	}
+	tunnel := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^]]+\] "CONNECT 127\.0\.0\.1:\d+ HTTP/1\.1" 200 \d+ "-" "Go-http-client/1\.1"\n$`)
+	if !tunnel.MatchString(lines[1]) {
+		t.Errorf("Unexpected tunnel line %q", lines[1])
+	}
+
+	var jsonOut syncBuffer
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	logger = accesslog.New(&jsonOut, accesslog.FormatJSON)
+	logger.Fields = func(e *accesslog.Entry, ctx *goproxy.ProxyCtx) map[string]interface{} {
+		return map[string]interface{}{"custom": e.Method + " " + ctx.Req.URL.Scheme}
+	}
+	logger.Install(proxy)
+	client, s = oneShotProxy(proxy)
+	defer s.Close()
+
+	get(t, client, tlsBackend.URL+"/mitm")
+	lines = jsonOut.waitLines(t, 2)
+	var exchangeEntry, tunnelEntry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &exchangeEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &tunnelEntry); err != nil {
+		t.Fatal(err)
+	}
+	if exchangeEntry["url"] != tlsBackend.URL+"/mitm" || exchangeEntry["status"] != float64(200) ||
+		exchangeEntry["size"] != float64(7) || exchangeEntry["custom"] != "GET https" {
+		t.Errorf("Unexpected MITM'd exchange %v", exchangeEntry)
+	}
+	if tunnelEntry["method"] != "CONNECT" || tunnelEntry["tunnel"] != goproxy.ConnMitm ||
+		tunnelEntry["bytes_in"].(float64) == 0 || tunnelEntry["custom"] != "CONNECT " {
+		t.Errorf("Unexpected MITM'd tunnel %v", tunnelEntry)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	f, err := accesslog.OpenFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{"access.log": "fourth\n", "access.log.1": "third\n", "access.log.2": "second\n"} {
+		if b, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != expected {
+			t.Errorf("Expected %s to contain %q, got %q %v", name, expected, b, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups to be kept")
+	}
+}
@@ -0,0 +1,189 @@
+// Package adblock blocks the requests matching Adblock-style or hosts file block
+// lists, like EasyList, answering them with no-op responses:
+//
+//	lists := &adblock.Lists{Sources: []string{
+//		"https://easylist.to/easylist/easylist.txt",
+//		"/etc/proxy/hosts.block",
+//	}}
+//	if err := lists.Load(); err != nil {
+//		log.Fatal(err)
+//	}
+//	defer lists.Watch(24 * time.Hour)()
+//	adblock.Install(proxy, lists)
+//
+// The requests blocked get an empty 204 response, or an empty script or stylesheet, or
+// a 1x1 transparent GIF, depending on what they requested, so that pages keep working.
+// Documents are answered 403. The CONNECT requests to blocked domains are rejected,
+// the other rules apply to the HTTPS requests if the proxy MITMs them.
+package adblock
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Rules gives the Matcher of the current block lists.
+type Rules interface {
+	Matcher() *Matcher
+}
+
+// Lists are block lists loaded from URLs or files, which can be refreshed
+// periodically.
+type Lists struct {
+	// Sources are the http or https URLs or the paths of the lists
+	Sources []string
+	// Client fetches the lists, http.DefaultClient if nil
+	Client *http.Client
+
+	matcher atomic.Value
+	mu      sync.Mutex
+	logger  goproxy.Logger
+}
+
+// Matcher returns the Matcher of the lists last loaded, which blocks nothing before
+// the lists were loaded.
+func (l *Lists) Matcher() *Matcher {
+	if m, ok := l.matcher.Load().(*Matcher); ok {
+		return m
+	}
+	return &Matcher{}
+}
+
+func (l *Lists) open(source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+	client := l.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("adblock: cannot fetch " + source + ": " + resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Load loads and compiles the lists. On error, the lists previously loaded are kept.
+func (l *Lists) Load() error {
+	var readers []io.Reader
+	for _, source := range l.Sources {
+		r, err := l.open(source)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		readers = append(readers, r)
+	}
+	m, err := Compile(readers...)
+	if err != nil {
+		return err
+	}
+	l.matcher.Store(m)
+	return nil
+}
+
+// Watch reloads the lists at the given interval, logging the failures to the Logger of
+// the proxy the lists are installed on. Call the returned function to stop.
+func (l *Lists) Watch(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := l.Load()
+				l.mu.Lock()
+				if logger := l.logger; err != nil && logger != nil {
+					logger.Printf("Cannot reload block lists: %v", err)
+				}
+				l.mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Blocked returns a ReqCondition testing whether the request is blocked by rules.
+func Blocked(rules Rules) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		_, ok := match(rules, req, ctx)
+		return ok
+	}
+}
+
+// Rule returns the rule blocking the request of ctx, once matched by Blocked.
+func Rule(ctx *goproxy.ProxyCtx) string {
+	if v, ok := ctx.ReqData.Get("adblock.rule"); ok {
+		return v.(string)
+	}
+	return ""
+}
+
+func match(rules Rules, req *http.Request, ctx *goproxy.ProxyCtx) (string, bool) {
+	if v, ok := ctx.ReqData.Get("adblock.rule"); ok {
+		return v.(string), v.(string) != ""
+	}
+	rule, ok := rules.Matcher().Match(req.URL, req.Header)
+	ctx.ReqData.Set("adblock.rule", rule)
+	return rule, ok
+}
+
+// transparentGIF is a 1x1 transparent GIF
+var transparentGIF = "GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;"
+
+// Response returns the no-op response to a blocked request: an empty 204 response, an
+// empty script or stylesheet, a transparent GIF, or 403 for documents.
+func Response(req *http.Request) *http.Response {
+	var resp *http.Response
+	switch resourceType(req.URL, req.Header) {
+	case "image":
+		resp = goproxy.NewResponse(req, "image/gif", http.StatusOK, transparentGIF)
+	case "script":
+		resp = goproxy.NewResponse(req, "application/javascript", http.StatusOK, "")
+	case "stylesheet":
+		resp = goproxy.NewResponse(req, "text/css", http.StatusOK, "")
+	case "document", "subdocument":
+		resp = goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Blocked by the proxy")
+	default:
+		resp = goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNoContent, "")
+	}
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// Install makes proxy block the requests matching rules.
+func Install(proxy *goproxy.ProxyHttpServer, rules Rules) {
+	if l, ok := rules.(*Lists); ok {
+		l.mu.Lock()
+		l.logger = proxy.Logger
+		l.mu.Unlock()
+	}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if rule, ok := rules.Matcher().MatchHost(ctx.Req.URL.Hostname()); ok {
+			ctx.Logf("Rejecting CONNECT to %s, blocked by %s", host, rule)
+			return goproxy.RejectConnect, host
+		}
+		return nil, ""
+	})
+	proxy.OnRequest(Blocked(rules)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Logf("Blocking %s by %s", req.URL, Rule(ctx))
+		return req, Response(req)
+	})
+}
@@ -0,0 +1,157 @@
+package adblock_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/adblock"
+)
+
+const easylist = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+||cdn.example.net/ads/*$script
+/banner/*/img^
+-tracking-pixel.
+||stats.example.org^$third-party
+|https://exact.example.com/x.js|
+/\/pop(up|under)\.js/
+@@||ads.example.com/allowed.js
+@@||cdn.example.net/ads/ok.js$script
+example.com##.ad-banner
+||unsupported.example.com^$redirect=noopjs
+`
+
+const hosts = `# hosts file
+127.0.0.1 localhost
+0.0.0.0 tracker.example.io metrics.example.io # comment
+malware.example.biz
+`
+
+func TestMatch(t *testing.T) {
+	m, err := adblock.Compile(strings.NewReader(easylist), strings.NewReader(hosts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		url, referer, dest string
+		blocked            bool
+	}{
+		{"http://ads.example.com/x.gif", "", "", true},
+		{"https://sub.ads.example.com/", "", "", true},
+		{"http://notads.example.com/", "", "", false},
+		{"http://ads.example.com/allowed.js", "", "", false},
+		{"http://cdn.example.net/ads/a.js", "", "", true},
+		{"http://cdn.example.net/ads/a.js", "", "image", false},
+		{"http://cdn.example.net/ads/ok.js", "", "", false},
+		{"http://x.example.com/banner/123/img?x", "", "", true},
+		{"http://x.example.com/banner/123/img2", "", "", false},
+		{"http://x.example.com/a-tracking-pixel.gif", "", "", true},
+		{"http://stats.example.org/hit", "http://www.news.example/", "", true},
+		{"http://stats.example.org/hit", "http://www.example.org/", "", false},
+		{"http://stats.example.org/hit", "", "", false},
+		{"https://exact.example.com/x.js", "", "", true},
+		{"https://exact.example.com/x.js?y", "", "", false},
+		{"http://x.example.com/js/PopUnder.js", "", "", true},
+		{"http://metrics.example.io/", "", "", true},
+		{"http://a.malware.example.biz/", "", "", true},
+		{"http://localhost/", "", "", false},
+		{"http://unsupported.example.com/", "", "", false},
+	} {
+		u, _ := url.Parse(c.url)
+		header := http.Header{}
+		if c.referer != "" {
+			header.Set("Referer", c.referer)
+		}
+		if c.dest != "" {
+			header.Set("Sec-Fetch-Dest", c.dest)
+		}
+		if rule, blocked := m.Match(u, header); blocked != c.blocked {
+			t.Errorf("%s %s %s: expected blocked %v, got %v %s", c.url, c.referer, c.dest, c.blocked, blocked, rule)
+		}
+	}
+	if _, ok := m.MatchHost("ads.example.com"); ok {
+		t.Error("Expected CONNECT to a host with exceptions to be allowed")
+	}
+	if _, ok := m.MatchHost("tracker.example.io"); !ok {
+		t.Error("Expected CONNECT to a blocked host to be rejected")
+	}
+}
+
+func TestInstall(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer backend.Close()
+
+	dir, err := os.MkdirTemp("", "adblock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "list.txt")
+	os.WriteFile(file, []byte("/ads/\n"), 0644)
+	lists := &adblock.Lists{Sources: []string{file}}
+	if err := lists.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	adblock.Install(proxy, lists)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	get := func(path, dest string) (int, string, string) {
+		req, _ := http.NewRequest("GET", backend.URL+path, nil)
+		req.Header.Set("Sec-Fetch-Dest", dest)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+	}
+	for _, c := range []struct {
+		path, dest, contentType string
+		status                  int
+	}{
+		{"/ads/a.png", "image", "image/gif", 200},
+		{"/ads/a.js", "script", "application/javascript", 200},
+		{"/ads/a.css", "style", "text/css", 200},
+		{"/ads/", "document", "text/plain", 403},
+		{"/ads/beacon", "empty", "", 204},
+	} {
+		if status, contentType, body := get(c.path, c.dest); status != c.status || !strings.HasPrefix(contentType, c.contentType) || body == "content" {
+			t.Errorf("%s: expected %d %s, got %d %s %q", c.path, c.status, c.contentType, status, contentType, body)
+		}
+	}
+	if status, _, body := get("/page", "document"); status != 200 || body != "content" {
+		t.Errorf("Expected an allowed request, got %d %q", status, body)
+	}
+
+	// the lists are reloaded
+	os.WriteFile(file, []byte("/page\n"), 0644)
+	if err := lists.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if status, _, _ := get("/page", "document"); status != 403 {
+		t.Errorf("Expected the reloaded lists to block, got %d", status)
+	}
+	lists.Sources = append(lists.Sources, filepath.Join(dir, "missing.txt"))
+	if err := lists.Load(); err == nil {
+		t.Error("Expected an error loading a missing list")
+	}
+	if status, _, _ := get("/page", "document"); status != 403 {
+		t.Errorf("Expected the lists to be kept, got %d", status)
+	}
+}
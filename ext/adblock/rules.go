@@ -0,0 +1,447 @@
+package adblock
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// rule is a compiled network rule of an Adblock list
+type rule struct {
+	text      string
+	exception bool
+	re        *regexp.Regexp
+	// thirdParty is 1 for the rules applying to third-party requests only, -1 for the
+	// rules applying to first-party requests only
+	thirdParty int
+	// types and notTypes are the resource types the rule applies to, or not
+	types, notTypes map[string]bool
+	// domains and notDomains are the domains of the pages the rule applies to, or not
+	domains, notDomains []string
+}
+
+// index finds the rules matching a URL by their tokens: each rule is indexed by one of
+// the words which any URL it matches contains.
+type index struct {
+	byToken map[string][]*rule
+	other   []*rule
+}
+
+func (x *index) add(r *rule, token string) {
+	if token == "" {
+		x.other = append(x.other, r)
+		return
+	}
+	if x.byToken == nil {
+		x.byToken = map[string][]*rule{}
+	}
+	x.byToken[token] = append(x.byToken[token], r)
+}
+
+func (x *index) match(req *request) *rule {
+	for _, t := range req.tokens {
+		for _, r := range x.byToken[t] {
+			if r.matches(req) {
+				return r
+			}
+		}
+	}
+	for _, r := range x.other {
+		if r.matches(req) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Matcher is a compiled set of block lists.
+type Matcher struct {
+	// hosts are the domains blocked with their subdomains
+	hosts        map[string]bool
+	block, allow index
+	exceptions   []*rule
+	// Rules is the number of rules compiled
+	Rules int
+}
+
+// Matcher returns m, so that a Matcher is Rules.
+func (m *Matcher) Matcher() *Matcher {
+	return m
+}
+
+// Compile compiles block lists, in Adblock or hosts file format. The rules of the
+// lists which are not supported are skipped: element hiding rules, and network rules
+// with unknown options.
+//
+// Adblock lists are made of network rules: patterns of URLs where * matches any
+// characters, ^ a separator, | anchors the start or the end of the URL and || the
+// domain; rules starting with @@ are exceptions. Options after $ restrict the rules to
+// resource types (script, image, stylesheet, xmlhttprequest, document, subdocument,
+// font, media, ping, websocket, other), to third-party requests, and to the pages of
+// domain=. Hosts files list domains after an IP address, lines with a domain only
+// block it too.
+func Compile(lists ...io.Reader) (*Matcher, error) {
+	m := &Matcher{hosts: map[string]bool{}}
+	for _, list := range lists {
+		s := bufio.NewScanner(list)
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			m.addLine(s.Text())
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+var hostname = regexp.MustCompile(`^[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?(\.[a-z0-9_]([a-z0-9_-]*[a-z0-9_])?)+$`)
+
+func (m *Matcher) addLine(line string) {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "", line[0] == '!', line[0] == '[', line[0] == '#',
+		strings.Contains(line, "##"), strings.Contains(line, "#@#"), strings.Contains(line, "#?#"), strings.Contains(line, "#$#"):
+		return
+	}
+	// hosts file
+	if f := strings.Fields(line); len(f) >= 2 && net.ParseIP(f[0]) != nil {
+		for _, h := range f[1:] {
+			if strings.HasPrefix(h, "#") {
+				break
+			}
+			h = strings.ToLower(strings.TrimSuffix(h, "."))
+			if hostname.MatchString(h) && net.ParseIP(h) == nil && h != "localhost.localdomain" {
+				m.hosts[h] = true
+				m.Rules++
+			}
+		}
+		return
+	}
+	if h := strings.ToLower(line); hostname.MatchString(h) && net.ParseIP(h) == nil {
+		m.hosts[h] = true
+		m.Rules++
+		return
+	}
+	r := &rule{text: line}
+	if strings.HasPrefix(line, "@@") {
+		r.exception = true
+		line = line[2:]
+	}
+	pattern, options := line, ""
+	if !(len(line) > 1 && line[0] == '/' && line[len(line)-1] == '/') {
+		if i := strings.LastIndexByte(line, '$'); i >= 0 {
+			pattern, options = line[:i], line[i+1:]
+		}
+	}
+	matchCase, ok := r.parseOptions(options)
+	if !ok {
+		return
+	}
+	// ||domain^ blocks the domain, like a hosts file
+	if !r.exception && options == "" && strings.HasPrefix(pattern, "||") {
+		h := strings.TrimSuffix(strings.TrimSuffix(pattern[2:], "|"), "^")
+		if h = strings.ToLower(h); hostname.MatchString(h) && len(h) < len(pattern)-2 {
+			m.hosts[h] = true
+			m.Rules++
+			return
+		}
+	}
+	expr, token := compilePattern(pattern)
+	if !matchCase {
+		expr = "(?i)" + expr
+	}
+	var err error
+	if r.re, err = regexp.Compile(expr); err != nil {
+		return
+	}
+	if r.exception {
+		m.allow.add(r, token)
+		m.exceptions = append(m.exceptions, r)
+	} else {
+		m.block.add(r, token)
+	}
+	m.Rules++
+}
+
+var resourceTypes = map[string]bool{"script": true, "image": true, "stylesheet": true, "xmlhttprequest": true, "document": true,
+	"subdocument": true, "font": true, "media": true, "ping": true, "websocket": true, "other": true}
+
+// parseOptions sets the options of r, and tells whether they are supported.
+func (r *rule) parseOptions(options string) (matchCase bool, ok bool) {
+	if options == "" {
+		return false, true
+	}
+	for _, o := range strings.Split(options, ",") {
+		o = strings.ToLower(strings.TrimSpace(o))
+		switch {
+		case o == "third-party", o == "3p":
+			r.thirdParty = 1
+		case o == "~third-party", o == "~3p", o == "first-party", o == "1p":
+			r.thirdParty = -1
+		case o == "match-case":
+			matchCase = true
+		case o == "important":
+		case strings.HasPrefix(o, "domain="):
+			for _, d := range strings.Split(o[len("domain="):], "|") {
+				if strings.HasPrefix(d, "~") {
+					r.notDomains = append(r.notDomains, d[1:])
+				} else if d != "" {
+					r.domains = append(r.domains, d)
+				}
+			}
+		case resourceTypes[o]:
+			if r.types == nil {
+				r.types = map[string]bool{}
+			}
+			r.types[o] = true
+		case strings.HasPrefix(o, "~") && resourceTypes[o[1:]]:
+			if r.notTypes == nil {
+				r.notTypes = map[string]bool{}
+			}
+			r.notTypes[o[1:]] = true
+		default:
+			return false, false
+		}
+	}
+	return matchCase, true
+}
+
+// isToken tells whether c may be part of the words of URLs indexing the rules
+func isToken(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '%'
+}
+
+// commonTokens are in too many URLs to index the rules well
+var commonTokens = map[string]bool{"http": true, "https": true, "www": true, "com": true, "js": true}
+
+// compilePattern returns the regular expression of an Adblock pattern, and the token
+// indexing it, if any.
+func compilePattern(pattern string) (string, string) {
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		return pattern[1 : len(pattern)-1], ""
+	}
+	var b strings.Builder
+	// where the tokens of the pattern may start and end: they must be whole words of
+	// the URLs, not bounded by wildcards nor by the ends of an unanchored pattern
+	start, end := 0, len(pattern)
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		b.WriteString(`^[a-z][a-z0-9+.-]*://([^/?#]*\.)?`)
+		start = 2
+	case strings.HasPrefix(pattern, "|"):
+		b.WriteString("^")
+		start = 1
+	}
+	anchoredEnd := false
+	if end > start && pattern[end-1] == '|' {
+		end--
+		anchoredEnd = true
+	}
+	for i := start; i < end; i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '^':
+			b.WriteString(`(?:[^a-zA-Z0-9_.%-]|$)`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if anchoredEnd {
+		b.WriteString("$")
+	}
+
+	lower := strings.ToLower(pattern)
+	token := ""
+	for i := start; i < end; {
+		if !isToken(lower[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < end && isToken(lower[j]) {
+			j++
+		}
+		bounded := (i > start && pattern[i-1] != '*') || (i == start && start > 0)
+		bounded = bounded && ((j < end && pattern[j] != '*') || (j == end && anchoredEnd))
+		if t := lower[i:j]; bounded && !commonTokens[t] && len(t) > len(token) {
+			token = t
+		}
+		i = j
+	}
+	return b.String(), token
+}
+
+// request is what the rules match of a request
+type request struct {
+	url    string
+	host   string
+	tokens []string
+	typ    string
+	// source is the host of the page making the request, if known
+	source string
+}
+
+func newRequest(u *url.URL, header http.Header) *request {
+	req := &request{url: u.String(), host: strings.ToLower(u.Hostname())}
+	lower := strings.ToLower(req.url)
+	for i := 0; i < len(lower); {
+		if !isToken(lower[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(lower) && isToken(lower[j]) {
+			j++
+		}
+		req.tokens = append(req.tokens, lower[i:j])
+		i = j
+	}
+	req.typ = resourceType(u, header)
+	for _, h := range []string{"Referer", "Origin"} {
+		if s, err := url.Parse(header.Get(h)); err == nil && s.Host != "" {
+			req.source = strings.ToLower(s.Hostname())
+			break
+		}
+	}
+	return req
+}
+
+var fetchDestinations = map[string]string{"script": "script", "image": "image", "style": "stylesheet", "document": "document",
+	"iframe": "subdocument", "frame": "subdocument", "font": "font", "audio": "media", "video": "media", "track": "media",
+	"empty": "xmlhttprequest"}
+
+var extensionTypes = map[string]string{".js": "script", ".mjs": "script", ".css": "stylesheet", ".png": "image", ".gif": "image",
+	".jpg": "image", ".jpeg": "image", ".webp": "image", ".svg": "image", ".ico": "image", ".woff": "font", ".woff2": "font",
+	".ttf": "font", ".otf": "font", ".mp4": "media", ".webm": "media", ".mp3": "media"}
+
+// resourceType guesses the resource type of a request, from its Sec-Fetch-Dest header
+// or the extension of its path.
+func resourceType(u *url.URL, header http.Header) string {
+	if t, ok := fetchDestinations[header.Get("Sec-Fetch-Dest")]; ok {
+		return t
+	}
+	switch {
+	case header.Get("Ping-To") != "" || header.Get("Content-Type") == "text/ping":
+		return "ping"
+	case strings.EqualFold(header.Get("Upgrade"), "websocket"):
+		return "websocket"
+	}
+	if t, ok := extensionTypes[strings.ToLower(path.Ext(u.Path))]; ok {
+		return t
+	}
+	accept := header.Get("Accept")
+	switch {
+	case strings.HasPrefix(accept, "text/html"):
+		return "document"
+	case strings.HasPrefix(accept, "image/"):
+		return "image"
+	case strings.HasPrefix(accept, "text/css"):
+		return "stylesheet"
+	}
+	return "other"
+}
+
+// isSubdomain tells whether host is domain or one of its subdomains
+func isSubdomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func registrableDomain(host string) string {
+	if d, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return d
+	}
+	return host
+}
+
+func (r *rule) matches(req *request) bool {
+	if r.types != nil && !r.types[req.typ] || r.notTypes[req.typ] {
+		return false
+	}
+	if r.thirdParty != 0 {
+		if req.source == "" {
+			return false
+		}
+		third := registrableDomain(req.source) != registrableDomain(req.host)
+		if third != (r.thirdParty > 0) {
+			return false
+		}
+	}
+	if len(r.domains) > 0 || len(r.notDomains) > 0 {
+		if req.source == "" {
+			return false
+		}
+		for _, d := range r.notDomains {
+			if isSubdomain(req.source, d) {
+				return false
+			}
+		}
+		if len(r.domains) > 0 {
+			found := false
+			for _, d := range r.domains {
+				found = found || isSubdomain(req.source, d)
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return r.re.MatchString(req.url)
+}
+
+// blockedHost returns the blocked domain of host, if any
+func (m *Matcher) blockedHost(host string) (string, bool) {
+	for h := host; ; {
+		if m.hosts[h] {
+			return h, true
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return "", false
+		}
+		h = h[i+1:]
+	}
+}
+
+// match returns the rule blocking req, if any.
+func (m *Matcher) match(req *request) (string, bool) {
+	if m.allow.match(req) != nil {
+		return "", false
+	}
+	if h, ok := m.blockedHost(req.host); ok {
+		return "||" + h + "^", true
+	}
+	if r := m.block.match(req); r != nil {
+		return r.text, true
+	}
+	return "", false
+}
+
+// Match returns the rule blocking the request for u with header, if any.
+func (m *Matcher) Match(u *url.URL, header http.Header) (string, bool) {
+	return m.match(newRequest(u, header))
+}
+
+// MatchHost returns the rule blocking every request to host, if any.
+func (m *Matcher) MatchHost(host string) (string, bool) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	h, ok := m.blockedHost(host)
+	if !ok {
+		return "", false
+	}
+	// the requests of a host with exceptions must be seen to be matched
+	for _, r := range m.exceptions {
+		if strings.Contains(strings.ToLower(r.text), h) {
+			return "", false
+		}
+	}
+	return "||" + h + "^", true
+}
@@ -0,0 +1,335 @@
+// Package admin serves a JSON API to inspect and control a running proxy. It is meant
+// to be served on a separate, private listener:
+//
+//	api := admin.New(proxy)
+//	api.Rules = rules
+//	api.Token = os.Getenv("ADMIN_TOKEN")
+//	go http.ListenAndServe("127.0.0.1:8081", api)
+//
+// The API has the following endpoints:
+//
+//	GET    /status           draining state, number of active connections, cached and renewed certificates
+//	GET    /conns            active requests and CONNECT tunnels
+//	DELETE /conns/<session>  close a tunnel
+//	GET    /rules            current rules, as a goproxy.RulesConfig
+//	PUT    /rules            replace the rules with a goproxy.RulesConfig
+//	POST   /rules/reload     reload the rules file
+//	POST   /certs/flush      flush the certificate cache
+//	GET    /mitm             per host MITM overrides
+//	PUT    /mitm/<host>      override MITM for host with {"mitm": true} or {"mitm": false}
+//	DELETE /mitm/<host>      remove the override of host
+//	POST   /drain            stop accepting requests, see ProxyHttpServer.Drain
+//	POST   /shutdown         drain and wait for the active connections, ?timeout=30s
+//
+// If a Recorder is set, the traffic it records is also available:
+//
+//	GET    /ui               web page showing the live traffic
+//	GET    /traffic          recorded exchanges, ?q= filtering on the method and URL
+//	GET    /traffic/events   server-sent events of the exchanges as they are recorded, ?q=
+//
+// If Breakpoints are set, the requests and responses they hold can be edited and resumed:
+//
+//	GET    /breakpoints      held requests and responses
+//	POST   /breakpoints/<id> resume a breakpoint, edited with an optional BreakpointEdit
+//
+// The token may also be passed as a token query parameter, for browsers.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MitmPriority is the priority of the CONNECT handler applying the MITM overrides,
+// so that it runs before the handlers registered without priority.
+const MitmPriority = 1000
+
+// DefaultShutdownTimeout is the time /shutdown waits for active connections by default.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// Server is the http.Handler of the admin API.
+type Server struct {
+	Proxy *goproxy.ProxyHttpServer
+	// Rules, if set, can be viewed, replaced and reloaded.
+	Rules *goproxy.RuleSet
+	// Token, if set, must be sent by clients as "Authorization: Bearer <token>".
+	Token string
+	// MitmAction is the action of hosts overridden to be MITM'd, goproxy.MitmConnect
+	// if nil.
+	MitmAction *goproxy.ConnectAction
+	// OnShutdown, if set, is called after /shutdown drained the proxy, e.g. to stop
+	// its listener.
+	OnShutdown func()
+	// Recorder, if set, is the source of the traffic shown by the web UI. It must be
+	// installed on the proxy.
+	Recorder *Recorder
+	// Breakpoints, if set, are the breakpoints listed and resumed by the API. Their
+	// handlers must be registered on the proxy.
+	Breakpoints *goproxy.Breakpoints
+
+	mu   sync.RWMutex
+	mitm map[string]bool
+}
+
+// New returns the admin API of proxy, registering the handler of its MITM overrides.
+func New(proxy *goproxy.ProxyHttpServer) *Server {
+	s := &Server{Proxy: proxy, mitm: make(map[string]bool)}
+	proxy.OnRequest().Priority(MitmPriority).HandleConnectFunc(s.handleConnect)
+	return s
+}
+
+func (s *Server) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	s.mu.RLock()
+	mitm, ok := s.mitm[strings.ToLower(hostname)]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, ""
+	}
+	if !mitm {
+		ctx.Logf("MITM disabled for %s by the admin API", hostname)
+		return goproxy.OkConnect, host
+	}
+	ctx.Logf("MITM enabled for %s by the admin API", hostname)
+	if s.MitmAction != nil {
+		return s.MitmAction, host
+	}
+	return goproxy.MitmConnect, host
+}
+
+// SetMitm overrides whether CONNECT tunnels to host, a host name without port, are
+// MITM'd.
+func (s *Server) SetMitm(host string, mitm bool) {
+	s.mu.Lock()
+	s.mitm[strings.ToLower(host)] = mitm
+	s.mu.Unlock()
+}
+
+// ClearMitm removes the MITM override of host.
+func (s *Server) ClearMitm(host string) {
+	s.mu.Lock()
+	delete(s.mitm, strings.ToLower(host))
+	s.mu.Unlock()
+}
+
+// Status is the response of /status.
+type Status struct {
+	Draining    bool `json:"draining"`
+	ActiveConns int  `json:"active_conns"`
+	// CachedCerts is -1 if the CertStore of the proxy does not tell its size
+	CachedCerts int `json:"cached_certs"`
+	// CertRenewals is -1 if the CertStore of the proxy does not renew certificates
+	CertRenewals int64 `json:"cert_renewals"`
+}
+
+type mitmOverride struct {
+	Mitm bool `json:"mitm"`
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token && r.URL.Query().Get("token") != s.Token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="goproxy admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	path := strings.Trim(r.URL.Path, "/")
+	arg := ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path, arg = path[:i], path[i+1:]
+	}
+	switch {
+	case path == "status" && arg == "":
+		s.get(w, r, s.status)
+	case path == "conns" && arg == "":
+		s.get(w, r, func() interface{} { return s.Proxy.ActiveConns() })
+	case path == "conns":
+		s.closeConn(w, r, arg)
+	case path == "rules":
+		s.rules(w, r, arg)
+	case path == "certs" && arg == "flush":
+		s.flushCerts(w, r)
+	case path == "mitm" && arg == "":
+		s.get(w, r, s.mitmOverrides)
+	case path == "mitm":
+		s.overrideMitm(w, r, arg)
+	case path == "drain" && arg == "":
+		if s.post(w, r) {
+			s.Proxy.Drain()
+			writeJSON(w, s.status())
+		}
+	case path == "shutdown" && arg == "":
+		s.shutdown(w, r)
+	case path == "ui" && arg == "":
+		s.ui(w, r)
+	case path == "traffic":
+		s.traffic(w, r, arg)
+	case path == "breakpoints":
+		s.breakpoints(w, r, arg)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func (s *Server) get(w http.ResponseWriter, r *http.Request, f func() interface{}) {
+	if allow(w, r, http.MethodGet) {
+		writeJSON(w, f())
+	}
+}
+
+func (s *Server) post(w http.ResponseWriter, r *http.Request) bool {
+	return allow(w, r, http.MethodPost)
+}
+
+func (s *Server) status() interface{} {
+	status := Status{Draining: s.Proxy.Draining(), ActiveConns: len(s.Proxy.ActiveConns()), CachedCerts: -1, CertRenewals: -1}
+	if c, ok := s.Proxy.CertStore.(interface{ Len() int }); ok {
+		status.CachedCerts = c.Len()
+	}
+	if c, ok := s.Proxy.CertStore.(interface{ Renewals() int64 }); ok {
+		status.CertRenewals = c.Renewals()
+	}
+	return status
+}
+
+func (s *Server) closeConn(w http.ResponseWriter, r *http.Request, arg string) {
+	if !allow(w, r, http.MethodDelete) {
+		return
+	}
+	session, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || !s.Proxy.CloseConn(session) {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) rules(w http.ResponseWriter, r *http.Request, arg string) {
+	if s.Rules == nil {
+		http.Error(w, "No rules configured", http.StatusNotFound)
+		return
+	}
+	switch arg {
+	case "":
+		if !allow(w, r, http.MethodGet, http.MethodPut) {
+			return
+		}
+		if r.Method == http.MethodPut {
+			var config goproxy.RulesConfig
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.Rules.SetRules(config.Rules); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case "reload":
+		if !s.post(w, r) {
+			return
+		}
+		if err := s.Rules.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, goproxy.RulesConfig{Rules: s.Rules.Rules()})
+}
+
+func (s *Server) flushCerts(w http.ResponseWriter, r *http.Request) {
+	if !s.post(w, r) {
+		return
+	}
+	c, ok := s.Proxy.CertStore.(interface{ Flush() })
+	if !ok {
+		http.Error(w, "The certificate store cannot be flushed", http.StatusNotImplemented)
+		return
+	}
+	c.Flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) mitmOverrides() interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	overrides := make(map[string]mitmOverride, len(s.mitm))
+	for host, mitm := range s.mitm {
+		overrides[host] = mitmOverride{mitm}
+	}
+	return overrides
+}
+
+func (s *Server) overrideMitm(w http.ResponseWriter, r *http.Request, host string) {
+	if !allow(w, r, http.MethodPut, http.MethodDelete) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		s.ClearMitm(host)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var override mitmOverride
+	if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.SetMitm(host, override.Mitm)
+	writeJSON(w, override)
+}
+
+func (s *Server) shutdown(w http.ResponseWriter, r *http.Request) {
+	if !s.post(w, r) {
+		return
+	}
+	timeout := DefaultShutdownTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		var err error
+		if timeout, err = time.ParseDuration(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	err := s.Proxy.Shutdown(ctx)
+	if s.OnShutdown != nil {
+		defer s.OnShutdown()
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(s.status())
+		return
+	}
+	writeJSON(w, s.status())
+}
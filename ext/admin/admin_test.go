@@ -0,0 +1,289 @@
+package admin_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/admin"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func call(t *testing.T, api *httptest.Server, method, path, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, api.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdmin(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "https://")
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertStore = goproxy.NewCertCache()
+	rules, err := goproxy.ParseRules([]byte(`{"rules": []}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Install(proxy)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	a := admin.New(proxy)
+	a.Rules = rules
+	a.Token = "secret"
+	api := httptest.NewServer(a)
+	defer api.Close()
+
+	if resp, err := http.Get(api.URL + "/status"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected the API to require the token", resp, err)
+	}
+
+	issuer := func() string {
+		resp, err := client.Get(backend.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Issuer.String()
+	}
+	tunneled := issuer()
+	if code := call(t, api, "PUT", "/mitm/127.0.0.1", `{"mitm": true}`, nil); code != 200 {
+		t.Fatal("Cannot override MITM", code)
+	}
+	if issuer() == tunneled {
+		t.Error("Expected the connection to be MITM'd")
+	}
+	var status admin.Status
+	if call(t, api, "GET", "/status", "", &status); status.CachedCerts != 1 || status.CertRenewals != 0 {
+		t.Error("Expected a cached certificate, got", status)
+	}
+	if code := call(t, api, "POST", "/certs/flush", "", nil); code != http.StatusNoContent {
+		t.Error("Cannot flush the certificates", code)
+	}
+	if call(t, api, "GET", "/status", "", &status); status.CachedCerts != 0 {
+		t.Error("Expected the certificates to be flushed, got", status)
+	}
+	call(t, api, "DELETE", "/mitm/127.0.0.1", "", nil)
+	if issuer() != tunneled {
+		t.Error("Expected the connection to be tunneled")
+	}
+
+	var config goproxy.RulesConfig
+	if code := call(t, api, "PUT", "/rules", `{"rules": [{"hosts": ["127.0.0.1"], "action": "reject"}]}`, &config); code != 200 || len(config.Rules) != 1 {
+		t.Fatal("Cannot replace the rules", code, config)
+	}
+	if _, err := client.Get(backend.URL); err == nil {
+		t.Error("Expected the CONNECT to be rejected by the new rules")
+	}
+	if code := call(t, api, "PUT", "/rules", `{"rules": [{"action": "bogus"}]}`, nil); code != http.StatusBadRequest {
+		t.Error("Expected invalid rules to be refused, got", code)
+	}
+	call(t, api, "PUT", "/rules", `{"rules": []}`, nil)
+
+	// open a tunnel, list it and close it
+	c, err := net.Dial("tcp", strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", backendHost, backendHost)
+	br := bufio.NewReader(c)
+	if resp, err := http.ReadResponse(br, nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot open tunnel", resp, err)
+	}
+	var conns []goproxy.ConnInfo
+	call(t, api, "GET", "/conns", "", &conns)
+	var tunnel *goproxy.ConnInfo
+	for i := range conns {
+		if conns[i].Kind == goproxy.ConnTunnel {
+			tunnel = &conns[i]
+		}
+	}
+	if tunnel == nil || tunnel.Host != backendHost {
+		t.Fatal("Expected the tunnel to be listed, got", conns)
+	}
+	if code := call(t, api, "DELETE", fmt.Sprintf("/conns/%d", tunnel.Session), "", nil); code != http.StatusNoContent {
+		t.Error("Cannot close the tunnel", code)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error("Expected the tunnel to be closed, got", err)
+	}
+
+	if code := call(t, api, "POST", "/shutdown?timeout=1s", "", &status); code != 200 || !status.Draining {
+		t.Error("Cannot shut the proxy down", code, status)
+	}
+	resp, err := client.Get(strings.Replace(backend.URL, "https", "http", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Expected the drained proxy to refuse requests, got", resp.Status)
+	}
+}
+
+func TestTrafficRecorder(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "echo "+string(body))
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	rec := admin.NewRecorder()
+	rec.Install(proxy)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	a := admin.New(proxy)
+	a.Recorder = rec
+	a.Token = "secret"
+	api := httptest.NewServer(a)
+	defer api.Close()
+
+	resp, err := http.Get(api.URL + "/traffic/events?token=secret&q=upload")
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot stream events", resp, err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+
+	getResp, err := client.Get(backend.URL + "/ignored")
+	if err != nil {
+		t.Fatal(err)
+	}
+	getResp.Body.Close()
+	postResp, err := client.Post(backend.URL+"/upload", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(postResp.Body)
+	postResp.Body.Close()
+
+	var e admin.Exchange
+	for !e.Done {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		if err := json.Unmarshal([]byte(line[6:]), &e); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(e.URL, "/upload") {
+			t.Fatal("Expected only the filtered exchanges, got", e.URL)
+		}
+	}
+	if e.Method != "POST" || e.Status != 200 || e.RequestBody != "hello" || e.ResponseBody != "echo hello" || e.ResponseSize != 10 {
+		t.Errorf("Unexpected exchange %+v", e)
+	}
+
+	var exchanges []admin.Exchange
+	if call(t, api, "GET", "/traffic", "", &exchanges); len(exchanges) != 2 || exchanges[0].Method != "GET" {
+		t.Error("Expected both exchanges to be recorded, got", exchanges)
+	}
+	if call(t, api, "GET", "/traffic?q=POST", "", &exchanges); len(exchanges) != 1 {
+		t.Error("Expected the exchanges to be filtered, got", exchanges)
+	}
+	if code := call(t, api, "GET", "/ui", "", nil); code != 200 {
+		t.Error("Cannot get the web UI", code)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, b)
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	bps := &goproxy.Breakpoints{Timeout: 5 * time.Second}
+	proxy.OnRequest().Do(bps.Request())
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+	srv := admin.New(proxy)
+	srv.Token = "secret"
+	srv.Breakpoints = bps
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	held := func() []admin.Breakpoint {
+		var bps []admin.Breakpoint
+		for i := 0; i < 100; i++ {
+			if call(t, api, "GET", "/breakpoints", "", &bps); len(bps) > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return bps
+	}
+	result := make(chan string, 1)
+	get := func(path string) {
+		resp, err := client.Get(backend.URL + path)
+		if err != nil {
+			result <- err.Error()
+			return
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		result <- fmt.Sprint(resp.StatusCode, " ", string(b))
+	}
+
+	go get("/original")
+	bp := held()
+	if len(bp) != 1 || bp[0].Method != "GET" || bp[0].URL != backend.URL+"/original" || bp[0].Response {
+		t.Fatalf("Unexpected breakpoints %+v", bp)
+	}
+	edit := `{"method": "POST", "url": "` + backend.URL + `/edited", "body": "data"}`
+	if status := call(t, api, "POST", fmt.Sprint("/breakpoints/", bp[0].ID), edit, nil); status != http.StatusNoContent {
+		t.Errorf("Expected the breakpoint to be resumed, got %d", status)
+	}
+	if r := <-result; r != "200 POST /edited data" {
+		t.Errorf("Expected the edited request to be sent, got %q", r)
+	}
+
+	go get("/answered")
+	bp = held()
+	if status := call(t, api, "POST", fmt.Sprint("/breakpoints/", bp[0].ID), `{"status": 418, "body": "teapot"}`, nil); status != http.StatusNoContent {
+		t.Errorf("Expected the breakpoint to be resumed, got %d", status)
+	}
+	if r := <-result; r != "418 teapot" {
+		t.Errorf("Expected the request to be answered, got %q", r)
+	}
+	if status := call(t, api, "POST", "/breakpoints/999", "", nil); status != http.StatusNotFound {
+		t.Errorf("Expected an unknown breakpoint to be 404, got %d", status)
+	}
+}
@@ -0,0 +1,136 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Breakpoint is a breakpoint held, as listed by /breakpoints.
+type Breakpoint struct {
+	ID       int64       `json:"id"`
+	Session  int64       `json:"session"`
+	Response bool        `json:"response"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status,omitempty"`
+	Header   http.Header `json:"header"`
+	Held     time.Time   `json:"held"`
+}
+
+// BreakpointEdit is the optional body of the POST /breakpoints/<id> requests, changing
+// the request or the response held before it is resumed. The empty fields are left as
+// they are.
+type BreakpointEdit struct {
+	// Method and URL change the request held
+	Method string `json:"method,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Status changes the response held, or answers the request held with a response
+	// of Header and Body
+	Status int `json:"status,omitempty"`
+	// Header replaces the header of the request or response
+	Header http.Header `json:"header,omitempty"`
+	// Body replaces the body of the request or response
+	Body *string `json:"body,omitempty"`
+}
+
+func (s *Server) breakpoints(w http.ResponseWriter, r *http.Request, arg string) {
+	if s.Breakpoints == nil {
+		http.Error(w, "No breakpoints configured", http.StatusNotFound)
+		return
+	}
+	if arg == "" {
+		s.get(w, r, s.heldBreakpoints)
+		return
+	}
+	if !s.post(w, r) {
+		return
+	}
+	id, err := strconv.ParseInt(arg, 10, 64)
+	b := s.Breakpoints.Get(id)
+	if err != nil || b == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var edit BreakpointEdit
+	if err := json.NewDecoder(r.Body).Decode(&edit); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyEdit(b, &edit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Continue()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) heldBreakpoints() interface{} {
+	held := []Breakpoint{}
+	for _, b := range s.Breakpoints.Held() {
+		bp := Breakpoint{ID: b.ID, Session: b.Ctx.Session, Response: b.IsResponse(),
+			Method: b.Req.Method, URL: b.Req.URL.String(), Header: b.Req.Header, Held: b.Held}
+		if b.Resp != nil {
+			bp.Status, bp.Header = b.Resp.StatusCode, b.Resp.Header
+		}
+		held = append(held, bp)
+	}
+	return held
+}
+
+func applyEdit(b *goproxy.Breakpoint, edit *BreakpointEdit) error {
+	var u *url.URL
+	if edit.URL != "" {
+		var err error
+		if u, err = url.Parse(edit.URL); err != nil {
+			return err
+		}
+	}
+	var body io.ReadCloser
+	var length int64
+	if edit.Body != nil {
+		body, length = io.NopCloser(strings.NewReader(*edit.Body)), int64(len(*edit.Body))
+	}
+	if !b.IsResponse() {
+		if edit.Status != 0 {
+			resp := goproxy.NewResponse(b.Req, goproxy.ContentTypeText, edit.Status, "")
+			b.Resp = resp
+		}
+		if edit.Method != "" {
+			b.Req.Method = edit.Method
+		}
+		if u != nil {
+			b.Req.URL, b.Req.Host = u, u.Host
+		}
+	} else if edit.Status != 0 {
+		b.Resp.StatusCode, b.Resp.Status = edit.Status, strconv.Itoa(edit.Status)+" "+http.StatusText(edit.Status)
+	}
+	if b.Resp != nil {
+		if edit.Header != nil {
+			b.Resp.Header = edit.Header
+		}
+		if body != nil {
+			if b.Resp.Body != nil {
+				b.Resp.Body.Close()
+			}
+			b.Resp.Body, b.Resp.ContentLength = body, length
+		}
+		return nil
+	}
+	if edit.Header != nil {
+		b.Req.Header = edit.Header
+	}
+	if body != nil {
+		if b.Req.Body != nil {
+			b.Req.Body.Close()
+		}
+		b.Req.Body, b.Req.ContentLength = body, length
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// DefaultMaxExchanges and DefaultPreviewSize are the defaults of Recorder.
+const (
+	DefaultMaxExchanges = 500
+	DefaultPreviewSize  = 4096
+)
+
+// Exchange is a recorded request and its response. It is published once when the
+// request is sent, and once when the response body was sent to the client, with Done
+// set.
+type Exchange struct {
+	ID             int64       `json:"id"`
+	Time           time.Time   `json:"time"`
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	ClientAddr     string      `json:"client_addr"`
+	ClientID       string      `json:"client_id,omitempty"`
+	RequestHeader  http.Header `json:"request_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"response_header,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+	ResponseSize   int64       `json:"response_size"`
+	// Duration is the time until the response body was sent, in milliseconds
+	Duration float64 `json:"duration_ms"`
+	Error    string  `json:"error,omitempty"`
+	Done     bool    `json:"done"`
+	// TunnelID and Seq relate the exchanges MITM'd from a CONNECT tunnel to it, see
+	// goproxy.ProxyCtx.ID
+	TunnelID  int64  `json:"tunnel_id,omitempty"`
+	Seq       int64  `json:"seq,omitempty"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func (e *Exchange) matches(q string) bool {
+	return q == "" || strings.Contains(strings.ToLower(e.Method+" "+e.URL), strings.ToLower(q))
+}
+
+// Recorder keeps the latest exchanges of the proxy, and publishes them live to its
+// subscribers. Bodies are recorded up to PreviewSize bytes.
+type Recorder struct {
+	MaxExchanges int
+	PreviewSize  int
+
+	mu        sync.Mutex
+	exchanges []*Exchange
+	subs      map[chan Exchange]struct{}
+}
+
+// NewRecorder returns a Recorder with the default limits.
+func NewRecorder() *Recorder {
+	return &Recorder{MaxExchanges: DefaultMaxExchanges, PreviewSize: DefaultPreviewSize}
+}
+
+const exchangeKey = "admin.exchange"
+
+// Install records the traffic of proxy. Since handlers run in registration order,
+// it should be installed after the handlers modifying requests, to record them as
+// they are sent.
+func (rec *Recorder) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().DoFunc(rec.handleRequest)
+	proxy.OnResponse().DoFunc(rec.handleResponse)
+}
+
+// preview records the first bytes read from a body
+type preview struct {
+	io.ReadCloser
+	limit int
+	once  sync.Once
+	done  func()
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	n   int64
+}
+
+func (p *preview) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.mu.Lock()
+	if room := p.limit - p.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		p.buf.Write(b[:room])
+	}
+	p.n += int64(n)
+	p.mu.Unlock()
+	return n, err
+}
+
+// read returns the preview and the number of bytes read so far
+func (p *preview) read() (string, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.buf.String(), p.n
+}
+
+func (p *preview) Close() error {
+	err := p.ReadCloser.Close()
+	if p.done != nil {
+		p.once.Do(p.done)
+	}
+	return err
+}
+
+func (rec *Recorder) previewSize() int {
+	if rec.PreviewSize == 0 {
+		return DefaultPreviewSize
+	}
+	return rec.PreviewSize
+}
+
+func (rec *Recorder) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	e := &Exchange{
+		ID:            ctx.Session,
+		TunnelID:      ctx.TunnelID,
+		Seq:           ctx.Seq,
+		RequestID:     ctx.RequestID,
+		Time:          time.Now(),
+		Method:        req.Method,
+		URL:           req.URL.String(),
+		ClientAddr:    req.RemoteAddr,
+		ClientID:      ctx.ClientID,
+		RequestHeader: req.Header.Clone(),
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		body := &preview{ReadCloser: req.Body, limit: rec.previewSize()}
+		req.Body = body
+		ctx.ReqData.Set(exchangeKey+".body", body)
+	}
+	ctx.ReqData.Set(exchangeKey, e)
+	rec.publish(e, true)
+	return req, nil
+}
+
+func (rec *Recorder) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := ctx.ReqData.Get(exchangeKey)
+	e, ok := v.(*Exchange)
+	if !ok {
+		return resp
+	}
+	ctx.ReqData.Delete(exchangeKey)
+	if v, _ := ctx.ReqData.Get(exchangeKey + ".body"); v != nil {
+		body := v.(*preview)
+		preview, _ := body.read()
+		rec.mu.Lock()
+		e.RequestBody = preview
+		rec.mu.Unlock()
+	}
+	finish := func() {
+		rec.mu.Lock()
+		e.Duration = float64(time.Since(e.Time)) / float64(time.Millisecond)
+		e.Done = true
+		rec.mu.Unlock()
+		rec.publish(e, false)
+	}
+	if resp == nil {
+		if ctx.Error != nil {
+			rec.mu.Lock()
+			e.Error = ctx.Error.Error()
+			rec.mu.Unlock()
+		}
+		finish()
+		return resp
+	}
+	rec.mu.Lock()
+	e.Status = resp.StatusCode
+	e.ResponseHeader = resp.Header.Clone()
+	rec.mu.Unlock()
+	body := &preview{ReadCloser: resp.Body, limit: rec.previewSize()}
+	body.done = func() {
+		preview, n := body.read()
+		rec.mu.Lock()
+		e.ResponseBody, e.ResponseSize = preview, n
+		rec.mu.Unlock()
+		finish()
+	}
+	resp.Body = body
+	return resp
+}
+
+// publish sends a copy of e to the subscribers, and stores e if it is new.
+func (rec *Recorder) publish(e *Exchange, add bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if add {
+		max := rec.MaxExchanges
+		if max == 0 {
+			max = DefaultMaxExchanges
+		}
+		rec.exchanges = append(rec.exchanges, e)
+		if len(rec.exchanges) > max {
+			rec.exchanges = append([]*Exchange(nil), rec.exchanges[len(rec.exchanges)-max:]...)
+		}
+	}
+	for sub := range rec.subs {
+		select {
+		case sub <- *e:
+		default:
+			// the subscriber is too slow, drop the event
+		}
+	}
+}
+
+// Exchanges returns the recorded exchanges whose method or URL contain q, oldest first.
+func (rec *Recorder) Exchanges(q string) []Exchange {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	exchanges := make([]Exchange, 0, len(rec.exchanges))
+	for _, e := range rec.exchanges {
+		if e.matches(q) {
+			exchanges = append(exchanges, *e)
+		}
+	}
+	return exchanges
+}
+
+// Subscribe returns a channel receiving the exchanges as they are recorded, until
+// cancel is called. Events are dropped when the channel is full.
+func (rec *Recorder) Subscribe() (events <-chan Exchange, cancel func()) {
+	ch := make(chan Exchange, 64)
+	rec.mu.Lock()
+	if rec.subs == nil {
+		rec.subs = make(map[chan Exchange]struct{})
+	}
+	rec.subs[ch] = struct{}{}
+	rec.mu.Unlock()
+	return ch, func() {
+		rec.mu.Lock()
+		delete(rec.subs, ch)
+		rec.mu.Unlock()
+	}
+}
@@ -0,0 +1,171 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// sseKeepAlive is the interval of the comments keeping idle event streams open
+const sseKeepAlive = 15 * time.Second
+
+func (s *Server) traffic(w http.ResponseWriter, r *http.Request, arg string) {
+	if s.Recorder == nil {
+		http.Error(w, "Traffic is not recorded", http.StatusNotFound)
+		return
+	}
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	q := r.URL.Query().Get("q")
+	switch arg {
+	case "":
+		writeJSON(w, s.Recorder.Exchanges(q))
+	case "events":
+		s.trafficEvents(w, r, q)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// trafficEvents streams the recorded exchanges as server-sent events.
+func (s *Server) trafficEvents(w http.ResponseWriter, r *http.Request, q string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events, cancel := s.Recorder.Subscribe()
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case e := <-events:
+			if !e.matches(q) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			io.WriteString(w, "data: ")
+			w.Write(data)
+			io.WriteString(w, "\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) ui(w http.ResponseWriter, r *http.Request) {
+	if s.Recorder == nil {
+		http.Error(w, "Traffic is not recorded", http.StatusNotFound)
+		return
+	}
+	if allow(w, r, http.MethodGet) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, uiPage)
+	}
+}
+
+// uiPage lists the recorded exchanges, then the ones streamed from /traffic/events.
+// The admin token, if any, is passed in the URL since EventSource cannot send headers.
+const uiPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>goproxy traffic</title>
+<style>
+body { font: 13px sans-serif; margin: 0; display: flex; height: 100vh; }
+#list { flex: 1; overflow: auto; }
+#detail { flex: 1; overflow: auto; border-left: 1px solid #ccc; padding: 0 8px; }
+#bar { position: sticky; top: 0; background: #eee; padding: 4px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 2px 4px; white-space: nowrap; overflow: hidden; text-overflow: ellipsis; max-width: 40em; }
+tr:hover, tr.selected { background: #def; cursor: pointer; }
+tr.pending { color: #888; }
+tr.error { color: #c00; }
+pre { white-space: pre-wrap; word-break: break-all; background: #f8f8f8; padding: 4px; }
+</style>
+</head>
+<body>
+<div id="list">
+<div id="bar"><input id="filter" placeholder="Filter method or URL" size="40"> <button id="clear">Clear</button> <span id="state"></span></div>
+<table><tbody id="rows"></tbody></table>
+</div>
+<div id="detail"><p>Select a request.</p></div>
+<script>
+var exchanges = {}, selected = null;
+var token = new URLSearchParams(location.search).get("token") || "";
+var rows = document.getElementById("rows"), filter = document.getElementById("filter");
+
+function text(tag, s) { var e = document.createElement(tag); e.textContent = s; return e; }
+function visible(e) {
+	var q = filter.value.toLowerCase();
+	return !q || (e.method + " " + e.url).toLowerCase().indexOf(q) >= 0;
+}
+function headers(h) {
+	var lines = [];
+	for (var k in h || {}) h[k].forEach(function(v) { lines.push(k + ": " + v); });
+	return lines.join("\n");
+}
+function show(e) {
+	var d = document.getElementById("detail");
+	d.innerHTML = "";
+	d.appendChild(text("h3", e.method + " " + e.url));
+	d.appendChild(text("p", "Client " + e.client_addr + (e.done ? ", " + e.duration_ms.toFixed(1) + " ms, " + e.response_size + " bytes" : ", pending")));
+	if (e.error) d.appendChild(text("p", "Error: " + e.error));
+	d.appendChild(text("h4", "Request"));
+	d.appendChild(text("pre", headers(e.request_header) + (e.request_body ? "\n\n" + e.request_body : "")));
+	if (e.status) {
+		d.appendChild(text("h4", "Response " + e.status));
+		d.appendChild(text("pre", headers(e.response_header) + (e.response_body ? "\n\n" + e.response_body : "")));
+	}
+}
+function render(e) {
+	var row = document.getElementById("x" + e.id);
+	if (!row) {
+		row = document.createElement("tr");
+		row.id = "x" + e.id;
+		row.onclick = function() {
+			if (selected) selected.classList.remove("selected");
+			selected = row;
+			row.classList.add("selected");
+			show(exchanges[e.id]);
+		};
+		rows.insertBefore(row, rows.firstChild);
+	}
+	row.innerHTML = "";
+	row.className = (e.done ? "" : "pending") + (e.error || e.status >= 400 ? " error" : "") + (row === selected ? " selected" : "");
+	[e.time.substr(11, 8), e.method, e.status || "", e.url, e.done ? e.duration_ms.toFixed(0) + " ms" : ""].forEach(function(s) {
+		row.appendChild(text("td", s));
+	});
+	row.style.display = visible(e) ? "" : "none";
+	if (row === selected) show(e);
+}
+function record(e) { exchanges[e.id] = e; render(e); }
+
+filter.oninput = function() { for (var id in exchanges) render(exchanges[id]); };
+document.getElementById("clear").onclick = function() { exchanges = {}; rows.innerHTML = ""; };
+
+var q = token ? "?token=" + encodeURIComponent(token) : "";
+fetch("traffic" + q).then(function(r) { return r.json(); }).then(function(list) {
+	list.forEach(record);
+	var source = new EventSource("traffic/events" + q);
+	source.onopen = function() { document.getElementById("state").textContent = "live"; };
+	source.onerror = function() { document.getElementById("state").textContent = "disconnected"; };
+	source.onmessage = function(m) { record(JSON.parse(m.data)); };
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,168 @@
+// Package audit keeps a tamper-evident log of the handling of the CONNECT requests of
+// a proxy: whether each tunnel was accepted, MITM'd or rejected, by which rule, for
+// which client, with the SNI and the serial of the certificate forged for MITM'd
+// clients.
+//
+// Every record is a line of JSON carrying the hash of the previous record and its own,
+// so that removing, reordering or altering records breaks the chain, see Verify. With
+// a Key, hashes are HMACs which cannot be recomputed without it. Removing the last
+// records is only detected by comparing with a hash exported earlier, see Log.Last.
+//
+//	log, err := audit.OpenFile("/var/log/goproxy/audit.log", key)
+//	...
+//	log.Install(proxy)
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Record is a line of the audit log.
+type Record struct {
+	Seq int64 `json:"seq"`
+	goproxy.ConnectDecision
+	// Prev is the hash of the previous record, empty for the first one, and Hash the
+	// hash of this record, computed with Hash empty
+	Prev string `json:"prev"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// Log writes hash-chained records to Output.
+type Log struct {
+	Output io.Writer
+	// Key, if set, makes the hashes HMAC-SHA256 with this key instead of SHA-256
+	Key []byte
+
+	mu   sync.Mutex
+	seq  int64
+	last string
+}
+
+// New returns a Log writing a new chain to w.
+func New(w io.Writer, key []byte) *Log {
+	return &Log{Output: w, Key: key}
+}
+
+// OpenFile returns a Log appending to the file path, continuing the chain of the
+// records it holds, which are verified first.
+func OpenFile(path string, key []byte) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	last, err := verify(f, key)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	l := New(f, key)
+	if last != nil {
+		l.seq, l.last = last.Seq, last.Hash
+	}
+	return l, nil
+}
+
+// Install records the CONNECT decisions of proxy, by setting proxy.ConnectAudit after
+// calling the previous one.
+func (l *Log) Install(proxy *goproxy.ProxyHttpServer) {
+	previous := proxy.ConnectAudit
+	proxy.ConnectAudit = func(ctx *goproxy.ProxyCtx, d goproxy.ConnectDecision) {
+		if previous != nil {
+			previous(ctx, d)
+		}
+		if err := l.Record(d); err != nil {
+			ctx.Warnf("Cannot write audit record: %v", err)
+		}
+	}
+}
+
+func newHash(key []byte) hash.Hash {
+	if key != nil {
+		return hmac.New(sha256.New, key)
+	}
+	return sha256.New()
+}
+
+// hashRecord returns the hash of r, ignoring r.Hash.
+func hashRecord(r Record, key []byte) (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h := newHash(key)
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Record appends d to the log.
+func (l *Log) Record(d goproxy.ConnectDecision) error {
+	d.Time = d.Time.UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r := Record{Seq: l.seq + 1, ConnectDecision: d, Prev: l.last}
+	var err error
+	if r.Hash, err = hashRecord(r, l.Key); err != nil {
+		return err
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.Output.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.last = r.Seq, r.Hash
+	return nil
+}
+
+// Last returns the sequence number and the hash of the last record.
+func (l *Log) Last() (seq int64, digest string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.seq, l.last
+}
+
+// Verify checks the chain of the records read from r, which were written with key,
+// and returns an error if it was tampered with.
+func Verify(r io.Reader, key []byte) error {
+	_, err := verify(r, key)
+	return err
+}
+
+// verify returns the last record of the chain read from r, nil if empty.
+func verify(r io.Reader, key []byte) (*Record, error) {
+	var last *Record
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		prev, seq := "", int64(1)
+		if last != nil {
+			prev, seq = last.Hash, last.Seq+1
+		}
+		h, err := hashRecord(rec, key)
+		if err != nil {
+			return nil, err
+		}
+		if rec.Prev != prev || rec.Seq != seq || rec.Hash != h {
+			return nil, fmt.Errorf("audit: broken hash chain at line %d", line)
+		}
+		last = &rec
+	}
+	return last, scanner.Err()
+}
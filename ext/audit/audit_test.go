@@ -0,0 +1,145 @@
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/audit"
+)
+
+// syncBuffer is written by the proxy while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestAudit(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "backend")
+	}))
+	defer backend.Close()
+	backendHost := strings.TrimPrefix(backend.URL, "https://")
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientIdentifier = goproxy.IdentifyBySourceIP
+	rules, err := goproxy.ParseRules([]byte(`{"rules": [
+		{"name": "inspect", "hosts": ["localhost"], "action": "mitm"},
+		{"hosts": ["blocked.example"], "action": "reject"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Install(proxy)
+	var out syncBuffer
+	key := []byte("secret")
+	audit.New(&out, key).Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+
+	for _, u := range []string{
+		backend.URL,
+		"https://" + strings.Replace(backendHost, "127.0.0.1", "localhost", 1),
+		"https://blocked.example/",
+	} {
+		if resp, err := client.Get(u); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	log := out.String()
+	if err := audit.Verify(strings.NewReader(log), key); err != nil {
+		t.Fatal(err)
+	}
+	var records []audit.Record
+	scanner := bufio.NewScanner(strings.NewReader(log))
+	for scanner.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf("Expected 3 records, got %q", log)
+	}
+	tunnel, mitm, reject := records[0], records[1], records[2]
+	if tunnel.Action != "tunnel" || tunnel.Handler != -1 || tunnel.ClientID != "127.0.0.1" || tunnel.Host != backendHost {
+		t.Errorf("Unexpected tunnel record %+v", tunnel)
+	}
+	if mitm.Action != "mitm" || mitm.Rule != "inspect" || mitm.SNI != "localhost" || mitm.CertSerial == "" || mitm.Error != "" {
+		t.Errorf("Unexpected MITM record %+v", mitm)
+	}
+	if reject.Action != "reject" || reject.Rule != "#1" || reject.Host != "blocked.example:443" {
+		t.Errorf("Unexpected reject record %+v", reject)
+	}
+
+	tampered := strings.Replace(log, `"action":"reject"`, `"action":"tunnel"`, 1)
+	if audit.Verify(strings.NewReader(tampered), key) == nil {
+		t.Error("Expected a changed record to break the chain")
+	}
+	lines := strings.SplitAfter(log, "\n")
+	if audit.Verify(strings.NewReader(lines[0]+lines[2]), key) == nil {
+		t.Error("Expected a removed record to break the chain")
+	}
+	if audit.Verify(strings.NewReader(log), []byte("other key")) == nil {
+		t.Error("Expected the chain not to verify with another key")
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := os.MkdirTemp("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	for i := 0; i < 2; i++ {
+		log, err := audit.OpenFile(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := log.Record(goproxy.ConnectDecision{Host: "example.com:443", Action: "tunnel"}); err != nil {
+			t.Fatal(err)
+		}
+		log.Output.(io.Closer).Close()
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := audit.Verify(bytes.NewReader(b), nil); err != nil || bytes.Count(b, []byte("\n")) != 2 {
+		t.Errorf("Expected the chain to continue in the reopened file, got %v %q", err, b)
+	}
+	if err := os.WriteFile(path, bytes.Replace(b, []byte(`"seq":2`), []byte(`"seq":3`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := audit.OpenFile(path, nil); err == nil {
+		t.Error("Expected a tampered file not to be opened")
+	}
+}
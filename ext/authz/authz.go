@@ -0,0 +1,288 @@
+// Package authz consults an external authorization service before proxying requests
+// and CONNECT tunnels, in the spirit of Envoy's ext_authz HTTP service.
+//
+// For every request, a CheckRequest is POSTed as JSON to the service, which answers
+// with a CheckResponse deciding whether the request is allowed, and how its headers
+// are changed:
+//
+//	checker := &authz.Checker{URL: "http://127.0.0.1:9000/check", CacheTTL: time.Minute}
+//	checker.Install(proxy)
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// CheckRequest describes the request to authorize.
+type CheckRequest struct {
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Host     string              `json:"host"`
+	Headers  map[string][]string `json:"headers,omitempty"`
+	ClientIP string              `json:"client_ip"`
+	// ClientCert is the subject of the certificate presented by a MITM'd client
+	ClientCert string `json:"client_cert,omitempty"`
+	// Connect is true for CONNECT requests, whose URL is the tunnel host
+	Connect bool `json:"connect"`
+}
+
+// CheckResponse is the decision of the authorization service. A denied request is
+// answered with Status (403 by default), Body and ResponseHeaders. An allowed request
+// is sent with the headers in SetHeaders set and the ones in RemoveHeaders removed.
+// CacheSeconds, if positive, overrides Checker.CacheTTL for this decision.
+type CheckResponse struct {
+	Allow           bool              `json:"allow"`
+	Status          int               `json:"status,omitempty"`
+	Body            string            `json:"body,omitempty"`
+	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
+	SetHeaders      map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders   []string          `json:"remove_headers,omitempty"`
+	CacheSeconds    int               `json:"cache_seconds,omitempty"`
+}
+
+// DefaultTimeout is the default timeout of calls to the authorization service.
+const DefaultTimeout = 2 * time.Second
+
+// maxCacheEntries bounds the number of cached decisions
+const maxCacheEntries = 10000
+
+// Checker sends CheckRequests to the authorization service at URL.
+type Checker struct {
+	URL string
+	// Client is used to call the service, http.DefaultClient if nil
+	Client *http.Client
+	// Timeout of a call to the service, DefaultTimeout if zero
+	Timeout time.Duration
+	// Headers restricts the request headers sent to the service. All headers are
+	// sent if empty.
+	Headers []string
+	// FailOpen allows requests when the service cannot be reached or answers with
+	// an error, instead of denying them with 503 Service Unavailable.
+	FailOpen bool
+	// CacheTTL enables caching decisions for the given time, per CacheKey.
+	CacheTTL time.Duration
+	// CacheKey returns the cache key of a request, by default its method, URL,
+	// client IP and credentials.
+	CacheKey func(r *CheckRequest) string
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision
+}
+
+type cachedDecision struct {
+	resp    *CheckResponse
+	expires time.Time
+}
+
+// DefaultCacheKey is the default Checker.CacheKey.
+func DefaultCacheKey(r *CheckRequest) string {
+	return strings.Join([]string{
+		r.Method, r.URL, r.ClientIP, r.ClientCert,
+		strings.Join(r.Headers["Authorization"], ","),
+		strings.Join(r.Headers["Proxy-Authorization"], ","),
+	}, "\n")
+}
+
+// NewCheckRequest describes req for the authorization service.
+func (c *Checker) NewCheckRequest(req *http.Request, ctx *goproxy.ProxyCtx) *CheckRequest {
+	r := &CheckRequest{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Host:    req.URL.Host,
+		Connect: req.Method == http.MethodConnect,
+	}
+	if r.Host == "" {
+		r.Host = req.Host
+	}
+	if r.Connect {
+		r.URL = r.Host
+	}
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		r.ClientIP = ip
+	} else {
+		r.ClientIP = req.RemoteAddr
+	}
+	if ctx.ClientCert != nil {
+		r.ClientCert = ctx.ClientCert.Subject.String()
+	}
+	if len(c.Headers) == 0 {
+		r.Headers = req.Header.Clone()
+	} else {
+		r.Headers = make(map[string][]string)
+		for _, name := range c.Headers {
+			if values := req.Header.Values(name); len(values) > 0 {
+				r.Headers[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+	return r
+}
+
+// Check returns the decision of the authorization service for r, possibly cached.
+func (c *Checker) Check(ctx context.Context, r *CheckRequest) (*CheckResponse, error) {
+	key := ""
+	if c.CacheTTL > 0 {
+		if c.CacheKey != nil {
+			key = c.CacheKey(r)
+		} else {
+			key = DefaultCacheKey(r)
+		}
+		if resp := c.cached(key); resp != nil {
+			return resp, nil
+		}
+	}
+	resp, err := c.call(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if c.CacheTTL > 0 {
+		ttl := c.CacheTTL
+		if resp.CacheSeconds > 0 {
+			ttl = time.Duration(resp.CacheSeconds) * time.Second
+		}
+		c.store(key, resp, ttl)
+	}
+	return resp, nil
+}
+
+func (c *Checker) call(ctx context.Context, r *CheckRequest) (*CheckResponse, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("authorization service returned %s", resp.Status)
+	}
+	var decision CheckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return nil, fmt.Errorf("bad authorization service response: %v", err)
+	}
+	return &decision, nil
+}
+
+func (c *Checker) cached(key string) *CheckResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.cache[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(c.cache, key)
+		return nil
+	}
+	return d.resp
+}
+
+func (c *Checker) store(key string, resp *CheckResponse, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.cache == nil {
+		c.cache = make(map[string]cachedDecision)
+	}
+	if len(c.cache) >= maxCacheEntries {
+		for k, d := range c.cache {
+			if now.After(d.expires) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxCacheEntries {
+			c.cache = make(map[string]cachedDecision)
+		}
+	}
+	c.cache[key] = cachedDecision{resp, now.Add(ttl)}
+}
+
+// decide returns the decision for req, or an error response.
+func (c *Checker) decide(req *http.Request, ctx *goproxy.ProxyCtx) (*CheckResponse, *http.Response) {
+	decision, err := c.Check(req.Context(), c.NewCheckRequest(req, ctx))
+	if err != nil {
+		ctx.Warnf("Authorization check of %s failed: %v", req.URL, err)
+		if c.FailOpen {
+			return &CheckResponse{Allow: true}, nil
+		}
+		return nil, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusServiceUnavailable, "Authorization service unavailable\n")
+	}
+	if !decision.Allow {
+		status := decision.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, status, decision.Body)
+		for name, value := range decision.ResponseHeaders {
+			resp.Header.Set(name, value)
+		}
+		return nil, resp
+	}
+	return decision, nil
+}
+
+// Handler returns a ReqHandler authorizing requests.
+func (c *Checker) Handler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		decision, resp := c.decide(req, ctx)
+		if resp != nil {
+			return req, resp
+		}
+		for _, name := range decision.RemoveHeaders {
+			req.Header.Del(name)
+		}
+		for name, value := range decision.SetHeaders {
+			req.Header.Set(name, value)
+		}
+		return req, nil
+	})
+}
+
+// ConnectHandler returns a HttpsHandler rejecting the CONNECT requests the service denies,
+// and leaving the allowed ones to the next handlers.
+func (c *Checker) ConnectHandler() goproxy.HttpsHandler {
+	return goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if _, resp := c.decide(ctx.Req, ctx); resp != nil {
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+		return nil, ""
+	})
+}
+
+// Install authorizes all requests and CONNECT requests of proxy. It should be called
+// before registering other handlers, so that they only see authorized requests.
+func (c *Checker) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().Do(c.Handler())
+	proxy.OnRequest().HandleConnect(c.ConnectHandler())
+}
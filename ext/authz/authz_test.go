@@ -0,0 +1,86 @@
+package authz_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/authz"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string) {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+func TestChecker(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "user="+r.Header.Get("X-User")+" secret="+r.Header.Get("X-Secret"))
+	}))
+	defer backend.Close()
+	var calls int32
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		var check authz.CheckRequest
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			t.Error("Cannot decode check request", err)
+		}
+		decision := authz.CheckResponse{Allow: true, SetHeaders: map[string]string{"X-User": "alice"}, RemoveHeaders: []string{"X-Secret"}}
+		if strings.HasSuffix(check.URL, "/denied") {
+			decision = authz.CheckResponse{Status: 451, Body: "denied", ResponseHeaders: map[string]string{"X-Reason": "policy"}}
+		}
+		if check.Method != "GET" || check.ClientIP != "127.0.0.1" || check.Connect {
+			t.Errorf("Unexpected check request %+v", check)
+		}
+		json.NewEncoder(w).Encode(decision)
+	}))
+	defer service.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	checker := &authz.Checker{URL: service.URL, CacheTTL: time.Minute}
+	checker.Install(proxy)
+	client, l := oneShotProxy(proxy)
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		if status, body := get(t, client, backend.URL+"/ok"); status != 200 || body != "user=alice secret=" {
+			t.Error("Expected the request to be allowed with its headers changed, got", status, body)
+		}
+	}
+	if status, body := get(t, client, backend.URL+"/denied"); status != 451 || body != "denied" {
+		t.Error("Expected the request to be denied, got", status, body)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Error("Expected the decision to be cached, got calls:", n)
+	}
+
+	service.Close()
+	if status, _ := get(t, client, backend.URL+"/uncached"); status != http.StatusServiceUnavailable {
+		t.Error("Expected requests to be denied when the service is down, got", status)
+	}
+	checker.FailOpen = true
+	if status, _ := get(t, client, backend.URL+"/uncached"); status != 200 {
+		t.Error("Expected requests to be allowed with FailOpen, got", status)
+	}
+}
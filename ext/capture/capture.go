@@ -0,0 +1,267 @@
+// Package capture stores the bodies of selected requests and responses of a proxy,
+// with a JSON sidecar describing each of them, for forensic retention:
+//
+//	c := capture.New(capture.Dir("/var/lib/goproxy/capture"))
+//	c.SampleRate = 0.01
+//	c.Install(proxy, goproxy.ReqHostIs("api.example.com"))
+//
+// Bodies are stored once the response was sent to the client, in the background.
+// They are cut at MaxBodySize bytes.
+package capture
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// DefaultMaxBodySize is the size at which bodies are cut when Capturer.MaxBodySize is zero.
+const DefaultMaxBodySize = 1 << 20
+
+// Metadata describes a captured body, it is stored as the sidecar KEY.json of the
+// body stored as KEY.
+type Metadata struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Session    int64     `json:"session"`
+	ClientAddr string    `json:"client_addr"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Status     int       `json:"status,omitempty"`
+	// Part is "request" or "response"
+	Part   string      `json:"part"`
+	Header http.Header `json:"header"`
+	// Size is the size of the whole body, and Captured the size of the stored part,
+	// smaller when Truncated
+	Size      int64 `json:"size"`
+	Captured  int64 `json:"captured"`
+	Truncated bool  `json:"truncated,omitempty"`
+	// SHA256 is the hash of the stored part, in hex
+	SHA256 string `json:"sha256"`
+	// CtxID is the hierarchical ID of the exchange, see goproxy.ProxyCtx.ID, and
+	// RequestID its correlation ID, see goproxy.ProxyHttpServer.RequestIDHeader
+	CtxID     string `json:"ctx_id"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Sink stores the captured bodies.
+type Sink interface {
+	// Put stores body under key, with meta as its sidecar.
+	Put(key string, body []byte, meta *Metadata) error
+}
+
+// Capturer captures the bodies of the exchanges of a proxy to Sink.
+type Capturer struct {
+	Sink Sink
+	// SampleRate is the fraction of the selected exchanges which are captured, all of
+	// them if zero
+	SampleRate float64
+	// MaxBodySize is the number of bytes stored of each body, DefaultMaxBodySize if zero
+	MaxBodySize int64
+	// Requests and Responses select the bodies captured
+	Requests  bool
+	Responses bool
+	// ContentTypes, if set, restricts the captured responses to the ones whose
+	// Content-Type starts with one of them, e.g. "application/json"
+	ContentTypes []string
+
+	mu      sync.Mutex
+	rand    *rand.Rand
+	pending sync.WaitGroup
+}
+
+// New returns a Capturer storing all the request and response bodies to sink.
+func New(sink Sink) *Capturer {
+	return &Capturer{Sink: sink, Requests: true, Responses: true}
+}
+
+const exchangeKey = "capture.exchange"
+
+// exchange is a request selected for capture
+type exchange struct {
+	meta    Metadata
+	reqBody *body
+}
+
+// body keeps the first bytes read from a body
+type body struct {
+	io.ReadCloser
+	limit int64
+	once  sync.Once
+	done  func()
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	n   int64
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if room := b.limit - int64(b.buf.Len()); room > 0 {
+		if room > int64(n) {
+			room = int64(n)
+		}
+		b.buf.Write(p[:room])
+	}
+	b.n += int64(n)
+	b.mu.Unlock()
+	return n, err
+}
+
+func (b *body) Close() error {
+	err := b.ReadCloser.Close()
+	if b.done != nil {
+		b.once.Do(b.done)
+	}
+	return err
+}
+
+// captured returns the bytes kept and the size of the whole body read so far
+func (b *body) captured() ([]byte, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...), b.n
+}
+
+// Install captures the exchanges of proxy whose request matches conds.
+func (c *Capturer) Install(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).DoFunc(c.handleRequest)
+	proxy.OnResponse().DoFunc(c.handleResponse)
+}
+
+// Wait waits for the captures in progress to be stored.
+func (c *Capturer) Wait() {
+	c.pending.Wait()
+}
+
+func (c *Capturer) sampled() bool {
+	if c.SampleRate <= 0 || c.SampleRate >= 1 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rand == nil {
+		c.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return c.rand.Float64() < c.SampleRate
+}
+
+func (c *Capturer) maxBodySize() int64 {
+	if c.MaxBodySize == 0 {
+		return DefaultMaxBodySize
+	}
+	return c.MaxBodySize
+}
+
+func (c *Capturer) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !c.sampled() {
+		return req, nil
+	}
+	now := time.Now()
+	e := &exchange{meta: Metadata{
+		ID:         fmt.Sprintf("%s-%d", now.UTC().Format("20060102T150405.000000000Z"), ctx.Session),
+		Time:       now,
+		Session:    ctx.Session,
+		CtxID:      ctx.ID(),
+		RequestID:  ctx.RequestID,
+		ClientAddr: req.RemoteAddr,
+		ClientID:   ctx.ClientID,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+	}}
+	if c.Requests && req.Body != nil && req.Body != http.NoBody {
+		e.reqBody = &body{ReadCloser: req.Body, limit: c.maxBodySize()}
+		req.Body = e.reqBody
+	}
+	e.meta.Header = req.Header.Clone()
+	ctx.ReqData.Set(exchangeKey, e)
+	return req, nil
+}
+
+func (c *Capturer) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, _ := ctx.ReqData.Get(exchangeKey)
+	e, ok := v.(*exchange)
+	if !ok {
+		return resp
+	}
+	ctx.ReqData.Delete(exchangeKey)
+	if resp == nil || resp.Body == nil || !c.Responses || !c.matchContentType(resp) {
+		c.store(ctx, e, nil, resp)
+		return resp
+	}
+	b := &body{ReadCloser: resp.Body, limit: c.maxBodySize()}
+	b.done = func() { c.store(ctx, e, b, resp) }
+	resp.Body = b
+	return resp
+}
+
+func (c *Capturer) matchContentType(resp *http.Response) bool {
+	if len(c.ContentTypes) == 0 {
+		return true
+	}
+	contentType := resp.Header.Get("Content-Type")
+	for _, prefix := range c.ContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// store puts the captured bodies of e in the background.
+func (c *Capturer) store(ctx *goproxy.ProxyCtx, e *exchange, respBody *body, resp *http.Response) {
+	type part struct {
+		meta Metadata
+		data []byte
+	}
+	var parts []part
+	add := func(name string, b *body, header http.Header) {
+		if b == nil {
+			return
+		}
+		data, size := b.captured()
+		if size == 0 {
+			return
+		}
+		meta := e.meta
+		meta.Part = name
+		meta.Header = header
+		meta.Size, meta.Captured, meta.Truncated = size, int64(len(data)), int64(len(data)) < size
+		sum := sha256.Sum256(data)
+		meta.SHA256 = hex.EncodeToString(sum[:])
+		if resp != nil {
+			meta.Status = resp.StatusCode
+		}
+		parts = append(parts, part{meta, data})
+	}
+	add("request", e.reqBody, e.meta.Header)
+	if resp != nil {
+		add("response", respBody, resp.Header.Clone())
+	}
+	if len(parts) == 0 {
+		return
+	}
+	// the bodies are stored once the exchange is over
+	ctx.Keep()
+	c.pending.Add(1)
+	go func() {
+		defer c.pending.Done()
+		prefix := e.meta.Time.UTC().Format("2006/01/02/") + e.meta.ID + "."
+		for _, p := range parts {
+			if err := c.Sink.Put(prefix+p.meta.Part, p.data, &p.meta); err != nil {
+				ctx.Warnf("Cannot store captured %s body of %s: %v", p.meta.Part, e.meta.URL, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,139 @@
+package capture_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/capture"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func post(t *testing.T, client *http.Client, url, body string) {
+	resp, err := client.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.ReadAll(r.Body)
+	if r.URL.Path == "/json" {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"a": 1}`)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "a long response")
+}))
+
+func TestCaptureDir(t *testing.T) {
+	dir, err := os.MkdirTemp("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	proxy := goproxy.NewProxyHttpServer()
+	c := capture.New(capture.Dir(dir))
+	c.MaxBodySize = 6
+	c.ContentTypes = []string{"application/json"}
+	c.Install(proxy, goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://")+"/"))
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	post(t, client, backend.URL+"/json", "request")
+	post(t, client, backend.URL+"/text", "")
+	c.Wait()
+
+	captured := map[string]string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			b, _ := os.ReadFile(path)
+			captured[filepath.Base(path)] = string(b)
+		}
+		return nil
+	})
+	if len(captured) != 4 {
+		t.Fatalf("Expected the request and response bodies of /json and their sidecars, got %v", captured)
+	}
+	for name, content := range captured {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		var meta capture.Metadata
+		if err := json.Unmarshal([]byte(content), &meta); err != nil {
+			t.Fatal(err)
+		}
+		data := captured[strings.TrimSuffix(name, ".json")]
+		sum := sha256.Sum256([]byte(data))
+		expected := map[string]string{"request": "reques", "response": `{"a": `}[meta.Part]
+		if data != expected || !meta.Truncated || meta.Captured != 6 || meta.SHA256 != hex.EncodeToString(sum[:]) ||
+			meta.Method != "POST" || meta.URL != backend.URL+"/json" || meta.Status != 200 {
+			t.Errorf("Unexpected capture %q %+v", data, meta)
+		}
+	}
+}
+
+func TestCaptureS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	storage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Method != "PUT" || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			t.Errorf("Unexpected storage request %s %s %v", r.Method, r.URL, r.Header)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		objects[r.URL.Path] = string(body)
+		mu.Unlock()
+	}))
+	defer storage.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	c := capture.New(&capture.S3{Endpoint: storage.URL, Bucket: "captures", Region: "eu-west-1", AccessKey: "key", SecretKey: "secret", Prefix: "proxy/"})
+	c.Requests = false
+	c.Install(proxy)
+	client, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	post(t, client, backend.URL+"/text", "request")
+	c.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(objects) != 2 {
+		t.Fatalf("Expected the response body and its sidecar, got %v", objects)
+	}
+	for path, content := range objects {
+		if !strings.HasPrefix(path, "/captures/proxy/") {
+			t.Error("Unexpected object", path)
+		}
+		if strings.HasSuffix(path, ".response") && content != "a long response" {
+			t.Errorf("Unexpected response body %q", content)
+		}
+	}
+}
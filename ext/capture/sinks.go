@@ -0,0 +1,107 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mixcode/goproxy/ext/signing"
+)
+
+// Dir stores the captured bodies as files under a directory.
+type Dir string
+
+func (d Dir) Put(key string, body []byte, meta *Metadata) error {
+	path := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	sidecar, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(path+".json", sidecar, 0600)
+}
+
+// S3 stores the captured bodies in a bucket of an S3-compatible object storage, such
+// as AWS S3, MinIO or Ceph, signing its requests with AWS Signature Version 4, see
+// signing.SigV4.
+type S3 struct {
+	// Endpoint is the URL of the storage, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string
+	Bucket   string
+	// Region is the region of the bucket, us-east-1 if empty
+	Region    string
+	AccessKey string
+	SecretKey string
+	// SessionToken is the token of temporary credentials
+	SessionToken string
+	// Prefix is prepended to the keys of the objects
+	Prefix string
+	// Client is used to send the requests, http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (s *S3) Put(key string, body []byte, meta *Metadata) error {
+	sidecar, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if err := s.put(s.Prefix+key, body, "application/octet-stream"); err != nil {
+		return err
+	}
+	return s.put(s.Prefix+key+".json", sidecar, "application/json")
+}
+
+func (s *S3) put(key string, body []byte, contentType string) error {
+	url := strings.TrimSuffix(s.Endpoint, "/") + "/" + awsEscape(s.Bucket, false) + "/" + awsEscape(key, true)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	signer := &signing.SigV4{AccessKey: s.AccessKey, SecretKey: s.SecretKey, SessionToken: s.SessionToken, Region: s.Region, Service: "s3"}
+	if err := signer.Sign(req, body); err != nil {
+		return err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("PUT %s: %s %s", key, resp.Status, msg)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// awsEscape escapes s as in the paths signed by AWS, keeping the slashes of object
+// keys if keepSlash.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
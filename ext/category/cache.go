@@ -0,0 +1,52 @@
+package category
+
+import (
+	"container/list"
+	"time"
+)
+
+// lru is a cache of the categories of URLs, evicting the least recently used
+type lru struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type entry struct {
+	key        string
+	categories []string
+	expires    time.Time
+}
+
+func newLRU(size int) *lru {
+	return &lru{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lru) get(key string, now time.Time) ([]string, bool) {
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if ent := e.Value.(*entry); now.Before(ent.expires) {
+		c.ll.MoveToFront(e)
+		return ent.categories, true
+	}
+	c.ll.Remove(e)
+	delete(c.items, key)
+	return nil, false
+}
+
+func (c *lru) add(key string, categories []string, expires time.Time) {
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		ent := e.Value.(*entry)
+		ent.categories, ent.expires = categories, expires
+		return
+	}
+	c.items[key] = c.ll.PushFront(&entry{key, categories, expires})
+	for c.ll.Len() > c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*entry).key)
+	}
+}
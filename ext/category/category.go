@@ -0,0 +1,327 @@
+// Package category applies a policy to the requests of the proxy by the categories of
+// their URLs, looked up in a local table or with a remote service:
+//
+//	policy := &category.Policy{
+//		Categorizer: category.Table{
+//			"casino.example.com":    {"gambling"},
+//			"news.example.com":      {"news"},
+//			"news.example.com/bets": {"gambling"},
+//		},
+//		Actions: map[string]category.Action{"gambling": category.Block, "social": category.Warn},
+//	}
+//	policy.Install(proxy)
+//
+// The CONNECT requests are categorized by host, and the requests of the MITM'd
+// tunnels by URL. Blocked requests are answered with a block page; requests to be
+// warned about get a warning page, from which the user may click through to the site,
+// which is then allowed for the client during BypassDuration. Warnings need the
+// tunnels of the sites to be MITM'd, which the policy does for them.
+package category
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Categorizer returns the categories of URLs. The URLs have no query, and no path for
+// the CONNECT requests.
+type Categorizer interface {
+	Categorize(ctx context.Context, u *url.URL) ([]string, error)
+}
+
+// CategorizerFunc is a function implementing Categorizer.
+type CategorizerFunc func(ctx context.Context, u *url.URL) ([]string, error)
+
+func (f CategorizerFunc) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	return f(ctx, u)
+}
+
+// Table is a local Categorizer, giving the categories of hosts with their subdomains,
+// or of URL prefixes written as host/path. The longest key matching wins.
+type Table map[string][]string
+
+func (t Table) Categorize(ctx context.Context, u *url.URL) ([]string, error) {
+	host := strings.ToLower(u.Hostname())
+	// URL prefixes first, by path segment, then the domains of the host
+	for p := host + u.Path; strings.IndexByte(p, '/') >= 0; p = p[:strings.LastIndexByte(p, '/')] {
+		if categories, ok := t[p]; ok {
+			return categories, nil
+		}
+	}
+	for h := host; ; {
+		if categories, ok := t[h]; ok {
+			return categories, nil
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			return nil, nil
+		}
+		h = h[i+1:]
+	}
+}
+
+// Action is what a Policy does with the requests of a category.
+type Action int
+
+const (
+	Allow Action = iota
+	Warn
+	Block
+)
+
+func (a Action) String() string {
+	switch a {
+	case Warn:
+		return "warn"
+	case Block:
+		return "block"
+	}
+	return "allow"
+}
+
+const (
+	// DefaultCacheSize is the number of verdicts cached, unless specified
+	DefaultCacheSize = 10000
+	// DefaultCacheTTL is how long verdicts are cached, unless specified
+	DefaultCacheTTL = time.Hour
+	// DefaultBypassDuration is how long a site stays allowed after a click-through,
+	// unless specified
+	DefaultBypassDuration = time.Hour
+)
+
+// ProceedParam is the query parameter of the click-through links of warning pages.
+const ProceedParam = "goproxy-category-proceed"
+
+// Policy applies Actions to the requests by category. It must not be copied after
+// first use.
+type Policy struct {
+	Categorizer Categorizer
+	// Actions are the actions of categories, the most restrictive one of the
+	// categories of a URL applies
+	Actions map[string]Action
+	// Default is the action of the URLs without categories or whose categories have no
+	// action, and of the URLs which cannot be categorized
+	Default Action
+	// CacheSize and CacheTTL are the size of the verdict cache and how long verdicts
+	// are cached, DefaultCacheSize and DefaultCacheTTL if zero
+	CacheSize int
+	CacheTTL  time.Duration
+	// BypassDuration is how long a client may access a site after clicking through
+	// its warning page, DefaultBypassDuration if zero
+	BypassDuration time.Duration
+
+	mu       sync.Mutex
+	cache    *lru
+	tokens   map[string]bypass
+	bypasses map[bypass]time.Time
+}
+
+// bypass is the permission of a client to access a site after a warning
+type bypass struct {
+	client, host string
+}
+
+// categories returns the categories of u, possibly cached.
+func (p *Policy) categories(c context.Context, u *url.URL) ([]string, error) {
+	key := u.Host + u.Path
+	now := time.Now()
+	p.mu.Lock()
+	if p.cache == nil {
+		size := p.CacheSize
+		if size <= 0 {
+			size = DefaultCacheSize
+		}
+		p.cache = newLRU(size)
+	}
+	categories, ok := p.cache.get(key, now)
+	p.mu.Unlock()
+	if ok {
+		return categories, nil
+	}
+	categories, err := p.Categorizer.Categorize(c, u)
+	if err != nil {
+		return nil, err
+	}
+	ttl := p.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	p.mu.Lock()
+	p.cache.add(key, categories, now.Add(ttl))
+	p.mu.Unlock()
+	return categories, nil
+}
+
+// Verdict returns the action for u, and its categories. The query of u is ignored.
+func (p *Policy) Verdict(c context.Context, u *url.URL) (Action, []string, error) {
+	stripped := &url.URL{Scheme: u.Scheme, Host: strings.ToLower(u.Host), Path: u.Path}
+	categories, err := p.categories(c, stripped)
+	if err != nil {
+		return p.Default, nil, err
+	}
+	action, found := Allow, false
+	for _, category := range categories {
+		if a, ok := p.Actions[category]; ok {
+			found = true
+			if a > action {
+				action = a
+			}
+		}
+	}
+	if !found {
+		action = p.Default
+	}
+	return action, categories, nil
+}
+
+// clientKey identifies the client of ctx for the bypasses
+func clientKey(ctx *goproxy.ProxyCtx) string {
+	if ctx.ClientID != "" {
+		return ctx.ClientID
+	}
+	if ip, _, err := net.SplitHostPort(ctx.Req.RemoteAddr); err == nil {
+		return ip
+	}
+	return ctx.Req.RemoteAddr
+}
+
+func (p *Policy) bypassed(b bypass) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expires, ok := p.bypasses[b]
+	if ok && time.Now().After(expires) {
+		delete(p.bypasses, b)
+		return false
+	}
+	return ok
+}
+
+// newToken returns the token of the click-through link allowing b.
+func (p *Policy) newToken(b bypass) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	token := hex.EncodeToString(buf)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.tokens == nil {
+		p.tokens = make(map[string]bypass)
+		p.bypasses = make(map[bypass]time.Time)
+	}
+	// the tokens of the warnings never clicked through are forgotten at some point
+	if len(p.tokens) >= DefaultCacheSize {
+		p.tokens = make(map[string]bypass)
+	}
+	p.tokens[token] = b
+	return token
+}
+
+// proceed allows b if token is its click-through token.
+func (p *Policy) proceed(token string, b bypass) bool {
+	duration := p.BypassDuration
+	if duration <= 0 {
+		duration = DefaultBypassDuration
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if t, ok := p.tokens[token]; !ok || t != b {
+		return false
+	}
+	delete(p.tokens, token)
+	p.bypasses[b] = time.Now().Add(duration)
+	return true
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Title}}</title></head>
+<body><h1>{{.Title}}</h1>
+<p>{{.URL}} is categorized as {{range $i, $c := .Categories}}{{if $i}}, {{end}}{{$c}}{{else}}unknown{{end}}.</p>
+{{if .Proceed}}<p><a href="{{.Proceed}}">Proceed anyway</a></p>{{end}}
+</body></html>
+`))
+
+func page(req *http.Request, status int, title string, categories []string, proceed string) *http.Response {
+	var b strings.Builder
+	pageTemplate.Execute(&b, struct {
+		Title, URL, Proceed string
+		Categories          []string
+	}{title, req.URL.String(), proceed, categories})
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeHtml, status, b.String())
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
+
+// BlockPage returns the page answering a request blocked by category.
+func BlockPage(req *http.Request, categories []string) *http.Response {
+	return page(req, http.StatusForbidden, "Blocked", categories, "")
+}
+
+// WarnPage returns the page warning about a request, with a link to proceed.
+func WarnPage(req *http.Request, categories []string, proceed string) *http.Response {
+	return page(req, http.StatusForbidden, "Warning", categories, proceed)
+}
+
+// Install applies p to the requests of proxy.
+func (p *Policy) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest().HandleConnectFunc(p.handleConnect)
+	proxy.OnRequest().DoFunc(p.handleRequest)
+}
+
+func (p *Policy) handleConnect(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	hostname := ctx.Req.URL.Hostname()
+	action, categories, err := p.Verdict(ctx.Req.Context(), &url.URL{Scheme: "https", Host: hostname})
+	if err != nil {
+		ctx.Warnf("Cannot categorize %s: %v", hostname, err)
+	}
+	switch {
+	case action == Block:
+		ctx.Logf("Blocking CONNECT to %s, categorized as %v", host, categories)
+		ctx.Resp = BlockPage(ctx.Req, categories)
+		return goproxy.RejectConnect, host
+	case action == Warn && !p.bypassed(bypass{clientKey(ctx), hostname}):
+		// the warning page is shown to the requests of the tunnel
+		return goproxy.MitmConnect, host
+	}
+	return nil, ""
+}
+
+func (p *Policy) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	b := bypass{clientKey(ctx), strings.ToLower(req.URL.Hostname())}
+	if q := req.URL.Query(); q.Get(ProceedParam) != "" {
+		if p.proceed(q.Get(ProceedParam), b) {
+			ctx.Logf("Client %s proceeds to %s", b.client, b.host)
+			q.Del(ProceedParam)
+			u := *req.URL
+			u.RawQuery = q.Encode()
+			resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusFound, "")
+			resp.Header.Set("Location", u.String())
+			return req, resp
+		}
+	}
+	action, categories, err := p.Verdict(req.Context(), req.URL)
+	if err != nil {
+		ctx.Warnf("Cannot categorize %s: %v", req.URL, err)
+	}
+	switch {
+	case action == Block:
+		ctx.Logf("Blocking %s, categorized as %v", req.URL, categories)
+		return req, BlockPage(req, categories)
+	case action == Warn && !p.bypassed(b):
+		ctx.Logf("Warning about %s, categorized as %v", req.URL, categories)
+		u := *req.URL
+		q := u.Query()
+		q.Set(ProceedParam, p.newToken(b))
+		u.RawQuery = q.Encode()
+		return req, WarnPage(req, categories, u.String())
+	}
+	return req, nil
+}
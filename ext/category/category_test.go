@@ -0,0 +1,108 @@
+package category_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/category"
+)
+
+func TestTable(t *testing.T) {
+	table := category.Table{
+		"example.com":           {"misc"},
+		"news.example.com":      {"news"},
+		"news.example.com/bets": {"gambling"},
+	}
+	for u, expected := range map[string]string{
+		"http://example.com/":                "misc",
+		"http://www.news.example.com/":       "news",
+		"http://News.example.com/bets/today": "gambling",
+		"http://news.example.com/bets":       "gambling",
+		"http://news.example.com/betsy":      "news",
+		"http://example.org/":                "",
+	} {
+		parsed, _ := url.Parse(u)
+		categories, _ := table.Categorize(context.Background(), parsed)
+		if got := strings.Join(categories, ","); got != expected {
+			t.Errorf("%s: expected %s, got %s", u, expected, got)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("content"))
+	}))
+	defer backend.Close()
+	tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+	defer tlsBackend.Close()
+	tlsHost, _ := url.Parse(tlsBackend.URL)
+
+	var calls int32
+	table := category.Table{"127.0.0.1/casino": {"gambling"}, "127.0.0.1/social": {"social", "news"}}
+	policy := &category.Policy{
+		Categorizer: category.CategorizerFunc(func(ctx context.Context, u *url.URL) ([]string, error) {
+			atomic.AddInt32(&calls, 1)
+			if u.Path == "" && u.Host == tlsHost.Hostname() {
+				return []string{"gambling"}, nil
+			}
+			return table.Categorize(ctx, u)
+		}),
+		Actions: map[string]category.Action{"gambling": category.Block, "social": category.Warn, "news": category.Allow},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	policy.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	get := func(u string) (int, string) {
+		resp, err := client.Get(u)
+		if err != nil {
+			return 0, err.Error()
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode, string(b)
+	}
+	if status, body := get(backend.URL + "/page"); status != 200 || body != "content" {
+		t.Errorf("Expected an allowed request, got %d %s", status, body)
+	}
+	if status, body := get(backend.URL + "/casino/roulette?x=1"); status != 403 || !strings.Contains(body, "gambling") {
+		t.Errorf("Expected a blocked request, got %d %s", status, body)
+	}
+	get(backend.URL + "/casino/roulette?x=2")
+	if calls != 2 {
+		t.Errorf("Expected the verdicts to be cached, got %d calls", calls)
+	}
+
+	status, body := get(backend.URL + "/social/feed?page=2")
+	link := regexp.MustCompile(`href="([^"]*)"`).FindStringSubmatch(body)
+	if status != 403 || !strings.Contains(body, "social, news") || link == nil {
+		t.Fatalf("Expected a warning page, got %d %s", status, body)
+	}
+	proceed := strings.Replace(link[1], "&amp;", "&", -1)
+	if status, body := get(proceed); status != 200 || body != "content" {
+		t.Errorf("Expected to proceed after the warning, got %d %s", status, body)
+	}
+	if status, body := get(backend.URL + "/social/other"); status != 200 || body != "content" {
+		t.Errorf("Expected the site to stay allowed, got %d %s", status, body)
+	}
+	if status, _ := get(proceed); status != 200 {
+		t.Errorf("Expected a used token to be ignored, got %d", status)
+	}
+
+	if status, _ := get(tlsBackend.URL + "/"); status != 0 {
+		t.Errorf("Expected the CONNECT to a blocked host to fail, got %d", status)
+	}
+}
@@ -0,0 +1,244 @@
+// Package doh answers the DNS-over-HTTPS queries (RFC 8484) going through the proxy,
+// so that clients resolving names with DoH don't bypass the policies of the proxy:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("dns.google:443", "cloudflare-dns.com:443")).HandleConnect(goproxy.AlwaysMitm)
+//	proxy.OnRequest(doh.IsDoH).Do(doh.Handle(doh.Chain(
+//		doh.Block("ads.example.com", "tracker.example.net"),
+//		doh.Hosts{"intranet.example.com": {net.ParseIP("10.0.0.1")}},
+//	)))
+//
+// DoH runs over HTTPS, the proxy must MITM the connections to the DoH servers, and
+// set MitmHTTP2 for the clients speaking HTTP/2 only. The queries not answered by the
+// Resolver go to the DoH server.
+package doh
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ContentType is the media type of the DNS messages of DoH.
+const ContentType = "application/dns-message"
+
+// MaxMessageSize is the size of the largest DNS message read.
+const MaxMessageSize = 65535
+
+// DefaultTTL is the TTL of the records made by Reply.
+const DefaultTTL = 60
+
+var errNotDoH = errors.New("doh: not a DoH query")
+
+type query struct {
+	msg *dnsmessage.Message
+	err error
+}
+
+// Query returns the DNS query of a DoH request, sent with POST or as the dns parameter
+// of GET. The body of the request is read and put back.
+func Query(req *http.Request, ctx *goproxy.ProxyCtx) (*dnsmessage.Message, error) {
+	if v, ok := ctx.ReqData.Get("doh.query"); ok {
+		q := v.(*query)
+		return q.msg, q.err
+	}
+	q := &query{}
+	var data []byte
+	switch req.Method {
+	case "GET":
+		if dns := req.URL.Query().Get("dns"); dns != "" {
+			data, q.err = base64.RawURLEncoding.DecodeString(strings.TrimRight(dns, "="))
+		} else {
+			q.err = errNotDoH
+		}
+	case "POST":
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != ContentType || req.Body == nil {
+			q.err = errNotDoH
+			break
+		}
+		data, q.err = io.ReadAll(io.LimitReader(req.Body, MaxMessageSize+1))
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(data))
+		if q.err == nil && len(data) > MaxMessageSize {
+			q.err = errors.New("doh: query too large")
+		}
+	default:
+		q.err = errNotDoH
+	}
+	if q.err == nil {
+		q.msg = &dnsmessage.Message{}
+		if q.err = q.msg.Unpack(data); q.err != nil || q.msg.Response || len(q.msg.Questions) == 0 {
+			q.msg = nil
+			if q.err == nil {
+				q.err = errors.New("doh: not a query")
+			}
+		}
+	}
+	ctx.ReqData.Set("doh.query", q)
+	return q.msg, q.err
+}
+
+// IsDoH is a ReqCondition testing whether the request is a DoH query.
+var IsDoH goproxy.ReqConditionFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	_, err := Query(req, ctx)
+	return err == nil
+}
+
+// Resolver answers DNS queries. It returns nil to let a query go to the DoH server.
+type Resolver interface {
+	Resolve(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message
+}
+
+// ResolverFunc is a function implementing Resolver.
+type ResolverFunc func(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message
+
+func (f ResolverFunc) Resolve(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message {
+	return f(q, ctx)
+}
+
+// Handle returns a ReqHandler answering the DoH queries with r.
+func Handle(r Resolver) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		q, err := Query(req, ctx)
+		if err != nil {
+			return req, nil
+		}
+		answer := r.Resolve(q, ctx)
+		if answer == nil {
+			return req, nil
+		}
+		answer.ID = q.ID
+		answer.Response = true
+		answer.RecursionDesired = q.RecursionDesired
+		answer.RecursionAvailable = true
+		if len(answer.Questions) == 0 {
+			answer.Questions = q.Questions
+		}
+		data, err := answer.Pack()
+		if err != nil {
+			ctx.Warnf("Cannot answer DoH query for %s: %v", q.Questions[0].Name, err)
+			return req, nil
+		}
+		ctx.Logf("Answering DoH query for %s with %s", q.Questions[0].Name, answer.RCode)
+		resp := goproxy.NewResponse(req, ContentType, http.StatusOK, string(data))
+		resp.Header.Set("Cache-Control", "max-age="+strconv.Itoa(int(minTTL(answer))))
+		return req, resp
+	})
+}
+
+func minTTL(m *dnsmessage.Message) uint32 {
+	ttl := uint32(DefaultTTL)
+	for _, rrs := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+		for _, rr := range rrs {
+			if rr.Header.TTL < ttl {
+				ttl = rr.Header.TTL
+			}
+		}
+	}
+	return ttl
+}
+
+// name returns the lower case name of the question of q, without the final dot
+func name(q *dnsmessage.Message) string {
+	return strings.ToLower(strings.TrimSuffix(q.Questions[0].Name.String(), "."))
+}
+
+// Reply returns an answer to q with rcode and the records of ips matching the type of
+// its question, A or AAAA.
+func Reply(q *dnsmessage.Message, rcode dnsmessage.RCode, ips ...net.IP) *dnsmessage.Message {
+	question := q.Questions[0]
+	m := &dnsmessage.Message{Header: dnsmessage.Header{RCode: rcode, Authoritative: true}, Questions: q.Questions}
+	for _, ip := range ips {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: DefaultTTL}
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA {
+			var a dnsmessage.AResource
+			copy(a.A[:], ip4)
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: header, Body: &a})
+		} else if ip4 == nil && len(ip) == net.IPv6len && question.Type == dnsmessage.TypeAAAA {
+			var aaaa dnsmessage.AAAAResource
+			copy(aaaa.AAAA[:], ip)
+			m.Answers = append(m.Answers, dnsmessage.Resource{Header: header, Body: &aaaa})
+		}
+	}
+	return m
+}
+
+// Block returns a Resolver answering that domains and their subdomains don't exist.
+func Block(domains ...string) Resolver {
+	return ResolverFunc(func(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message {
+		n := name(q)
+		for _, d := range domains {
+			d = strings.ToLower(strings.TrimSuffix(d, "."))
+			if n == d || strings.HasSuffix(n, "."+d) {
+				return Reply(q, dnsmessage.RCodeNameError)
+			}
+		}
+		return nil
+	})
+}
+
+// Hosts is a Resolver answering the A and AAAA queries for its names with their IPs,
+// like a hosts file. The other queries for its names are answered without records.
+type Hosts map[string][]net.IP
+
+func (h Hosts) Resolve(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message {
+	for n, ips := range h {
+		if strings.EqualFold(strings.TrimSuffix(n, "."), name(q)) {
+			return Reply(q, dnsmessage.RCodeSuccess, ips...)
+		}
+	}
+	return nil
+}
+
+// Chain returns a Resolver answering with the first of resolvers answering.
+func Chain(resolvers ...Resolver) Resolver {
+	return ResolverFunc(func(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message {
+		for _, r := range resolvers {
+			if answer := r.Resolve(q, ctx); answer != nil {
+				return answer
+			}
+		}
+		return nil
+	})
+}
+
+// Local returns a Resolver answering the A and AAAA queries with resolver, the
+// default resolver of the system if nil, the other queries go to the DoH server.
+func Local(resolver *net.Resolver) Resolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return ResolverFunc(func(q *dnsmessage.Message, ctx *goproxy.ProxyCtx) *dnsmessage.Message {
+		network := "ip4"
+		switch q.Questions[0].Type {
+		case dnsmessage.TypeA:
+		case dnsmessage.TypeAAAA:
+			network = "ip6"
+		default:
+			return nil
+		}
+		c := context.Background()
+		if ctx.Req != nil {
+			c = ctx.Req.Context()
+		}
+		ips, err := resolver.LookupIP(c, network, name(q))
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+				return Reply(q, dnsmessage.RCodeNameError)
+			}
+			ctx.Warnf("Cannot resolve %s: %v", name(q), err)
+			return Reply(q, dnsmessage.RCodeServerFailure)
+		}
+		return Reply(q, dnsmessage.RCodeSuccess, ips...)
+	})
+}
@@ -0,0 +1,104 @@
+package doh_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/doh"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func query(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 0x1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}
+	data, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestHandle(t *testing.T) {
+	// the DoH server answers every query with SERVFAIL
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		if r.Method == "GET" {
+			data, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		var m dnsmessage.Message
+		if err := m.Unpack(data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Response, m.RCode = true, dnsmessage.RCodeServerFailure
+		data, _ = m.Pack()
+		w.Header().Set("Content-Type", doh.ContentType)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(doh.IsDoH).Do(doh.Handle(doh.Chain(
+		doh.Block("ads.example.com."),
+		doh.Hosts{"intranet.example.com": {net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}},
+	)))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	for _, c := range []struct {
+		name   string
+		typ    dnsmessage.Type
+		get    bool
+		rcode  dnsmessage.RCode
+		answer string
+	}{
+		{"track.ads.example.com.", dnsmessage.TypeA, false, dnsmessage.RCodeNameError, ""},
+		{"Intranet.example.com.", dnsmessage.TypeA, false, dnsmessage.RCodeSuccess, "10.0.0.1"},
+		{"intranet.example.com.", dnsmessage.TypeAAAA, true, dnsmessage.RCodeSuccess, "fd00::1"},
+		{"intranet.example.com.", dnsmessage.TypeMX, true, dnsmessage.RCodeSuccess, ""},
+		{"www.example.com.", dnsmessage.TypeA, false, dnsmessage.RCodeServerFailure, ""},
+		{"www.example.com.", dnsmessage.TypeA, true, dnsmessage.RCodeServerFailure, ""},
+	} {
+		data := query(t, c.name, c.typ)
+		req, _ := http.NewRequest("POST", server.URL+"/dns-query", bytes.NewReader(data))
+		req.Header.Set("Content-Type", doh.ContentType)
+		if c.get {
+			req, _ = http.NewRequest("GET", server.URL+"/dns-query?dns="+base64.RawURLEncoding.EncodeToString(data), nil)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		var m dnsmessage.Message
+		if err := m.Unpack(data); err != nil {
+			t.Fatal(c.name, err)
+		}
+		answer := ""
+		for _, rr := range m.Answers {
+			switch rr := rr.Body.(type) {
+			case *dnsmessage.AResource:
+				answer = net.IP(rr.A[:]).String()
+			case *dnsmessage.AAAAResource:
+				answer = net.IP(rr.AAAA[:]).String()
+			}
+		}
+		if m.ID != 0x1234 || m.RCode != c.rcode || answer != c.answer {
+			t.Errorf("%s %s: expected %s %s, got %x %s %s", c.name, c.typ, c.rcode, c.answer, m.ID, m.RCode, answer)
+		}
+	}
+}
@@ -5,4 +5,8 @@ go 1.16
 require (
 	github.com/mixcode/goproxy v0.0.0-20210427112856-bd191b4558d9
 	github.com/rogpeppe/go-charset v0.0.0-20180617210344-2471d30d28b4
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.26.0
 )
+
+replace github.com/mixcode/goproxy => ../
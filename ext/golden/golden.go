@@ -0,0 +1,259 @@
+// Package golden compares the responses going through the proxy with the golden ones
+// of an archive, for API regression testing: the requests are forwarded as usual, and
+// the differences of their responses with the archived ones reported.
+//
+//	t := &golden.Tester{
+//		Archive: golden.Dir("testdata/golden"),
+//		Record:  *update,
+//		OnDiff: func(ctx *goproxy.ProxyCtx, d *golden.Diff) {
+//			log.Printf("%s: %s", d.Key, strings.Join(d.Changes, "; "))
+//		},
+//	}
+//	t.Install(proxy, goproxy.ReqHostIs("api.example.com:443"))
+//
+// The statuses, the headers but the ignored ones, and the bodies are compared, the
+// bodies once normalized, JSON ones being compared regardless of formatting and key
+// order.
+package golden
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MaxBodySize is the size of the largest body compared, larger ones are reported as
+// differing.
+const MaxBodySize = 8 << 20
+
+// DefaultIgnoredHeaders are the headers left out of the comparisons, unless
+// Tester.IgnoreHeaders is set, because they change between identical responses.
+var DefaultIgnoredHeaders = []string{
+	"Age", "Connection", "Content-Length", "Date", "Etag", "Expires", "Keep-Alive",
+	"Last-Modified", "Server", "Set-Cookie", "Transfer-Encoding", "Via", "X-Request-Id",
+}
+
+// Response is a golden response.
+type Response struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Archive stores the golden responses by key, see Key.
+type Archive interface {
+	// Get returns the response of key, nil if there is none
+	Get(key string) (*Response, error)
+	Put(resp *Response) error
+}
+
+// Dir is an Archive storing the responses as JSON files in a directory.
+type Dir string
+
+func (d Dir) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(string(d), hex.EncodeToString(sum[:16])+".json")
+}
+
+func (d Dir) Get(key string) (*Response, error) {
+	data, err := os.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var resp Response
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (d Dir) Put(resp *Response) error {
+	data, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(string(d), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(d.path(resp.Key), data, 0600)
+}
+
+// Key identifies the golden response of req: its method and URL, the query parameters
+// sorted.
+func Key(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = u.Query().Encode()
+	return req.Method + " " + u.String()
+}
+
+// Diff is the difference of a response with its golden one.
+type Diff struct {
+	Key string
+	// Golden is nil if the archive has no golden response for the request
+	Golden *Response
+	Actual *Response
+	// Changes describe the differences, e.g. "status 200, golden 404"
+	Changes []string
+}
+
+// NormalizeJSON returns the JSON bodies indented with sorted keys, and the others as
+// they are.
+func NormalizeJSON(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return body
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+	normalized, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return body
+	}
+	return normalized
+}
+
+// Tester compares the responses of the proxy with the ones of Archive.
+type Tester struct {
+	Archive Archive
+	// Record stores the responses missing from the archive as golden ones, instead of
+	// reporting them
+	Record bool
+	// IgnoreHeaders are the headers not compared, DefaultIgnoredHeaders if nil
+	IgnoreHeaders []string
+	// Normalize normalizes the bodies before they are compared, NormalizeJSON if nil
+	Normalize func(contentType string, body []byte) []byte
+	// OnDiff is called with the responses differing from their golden one, or
+	// without one when not recording
+	OnDiff func(ctx *goproxy.ProxyCtx, d *Diff)
+}
+
+// Install compares the responses to the requests of proxy matching conds.
+func (t *Tester) Install(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	const keyData = "golden.key"
+	proxy.OnRequest(conds...).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ReqData.Set(keyData, Key(req))
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		key, ok := ctx.ReqData.Get(keyData)
+		if !ok || resp == nil {
+			return resp
+		}
+		ctx.ReqData.Delete(keyData)
+		return t.check(key.(string), resp, ctx)
+	})
+}
+
+func (t *Tester) check(key string, resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	orig := resp.Body
+	body, err := io.ReadAll(io.LimitReader(orig, MaxBodySize+1))
+	if err != nil {
+		orig.Close()
+		ctx.Warnf("Cannot read the response of %s: %v", key, err)
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read the response body")
+	}
+	// the rest of the bodies too large to be compared is streamed
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), orig), orig}
+	actual := &Response{Key: key, Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body}
+	golden, err := t.Archive.Get(key)
+	if err != nil {
+		ctx.Warnf("Cannot read the golden response of %s: %v", key, err)
+		return resp
+	}
+	var changes []string
+	switch {
+	case golden == nil && t.Record:
+		if err := t.Archive.Put(actual); err != nil {
+			ctx.Warnf("Cannot record the golden response of %s: %v", key, err)
+		} else {
+			ctx.Logf("Recorded the golden response of %s", key)
+		}
+		return resp
+	case golden == nil:
+		changes = []string{"no golden response"}
+	default:
+		changes = t.compare(golden, actual)
+	}
+	if len(changes) > 0 {
+		ctx.Logf("Response of %s differs from the golden one: %s", key, strings.Join(changes, "; "))
+		if t.OnDiff != nil {
+			t.OnDiff(ctx, &Diff{Key: key, Golden: golden, Actual: actual, Changes: changes})
+		}
+	}
+	return resp
+}
+
+// compare returns the differences of actual with golden.
+func (t *Tester) compare(golden, actual *Response) []string {
+	var changes []string
+	if actual.Status != golden.Status {
+		changes = append(changes, fmt.Sprintf("status %d, golden %d", actual.Status, golden.Status))
+	}
+	ignored := t.IgnoreHeaders
+	if ignored == nil {
+		ignored = DefaultIgnoredHeaders
+	}
+	names := map[string]bool{}
+	for name := range golden.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range actual.Header {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range ignored {
+		delete(names, http.CanonicalHeaderKey(name))
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if a, g := actual.Header.Values(name), golden.Header.Values(name); !reflect.DeepEqual(a, g) {
+			changes = append(changes, fmt.Sprintf("header %s %q, golden %q", name, a, g))
+		}
+	}
+	normalize := t.Normalize
+	if normalize == nil {
+		normalize = NormalizeJSON
+	}
+	a := normalize(actual.Header.Get("Content-Type"), actual.Body)
+	g := normalize(golden.Header.Get("Content-Type"), golden.Body)
+	if len(actual.Body) > MaxBodySize {
+		changes = append(changes, "body too large to be compared")
+	} else if !bytes.Equal(a, g) {
+		changes = append(changes, fmt.Sprintf("body differs at byte %d", firstDifference(a, g)))
+	}
+	return changes
+}
+
+// firstDifference returns the offset of the first byte differing between a and b.
+func firstDifference(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
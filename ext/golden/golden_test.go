@@ -0,0 +1,81 @@
+package golden_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/golden"
+)
+
+func TestTester(t *testing.T) {
+	version := "1"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Version", version)
+		if version == "1" {
+			w.Write([]byte(`{"b": 2, "a": [1, 2]}`))
+		} else {
+			w.Write([]byte(`{"a":[1,2],"b":3}`))
+		}
+	}))
+	defer backend.Close()
+	dir, err := os.MkdirTemp("", "golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var diffs []*golden.Diff
+	tester := &golden.Tester{
+		Archive: golden.Dir(dir),
+		Record:  true,
+		OnDiff: func(ctx *goproxy.ProxyCtx, d *golden.Diff) {
+			mu.Lock()
+			diffs = append(diffs, d)
+			mu.Unlock()
+		},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	tester.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+	get := func(u string) string {
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b)
+	}
+
+	// recorded, then compared
+	get(backend.URL + "/items?b=1&a=2")
+	tester.Record = false
+	if body := get(backend.URL + "/items?a=2&b=1"); body != `{"b": 2, "a": [1, 2]}` || len(diffs) != 0 {
+		t.Errorf("Expected the same response, got %q and %d diffs", body, len(diffs))
+	}
+
+	version = "2"
+	if body := get(backend.URL + "/items?a=2&b=1"); body != `{"a":[1,2],"b":3}` {
+		t.Errorf("Expected the response to be forwarded, got %q", body)
+	}
+	if len(diffs) != 1 || len(diffs[0].Changes) != 2 || !strings.HasPrefix(diffs[0].Changes[0], "header X-Version") ||
+		!strings.HasPrefix(diffs[0].Changes[1], "body differs") {
+		t.Fatalf("Unexpected diffs %+v", diffs)
+	}
+	get(backend.URL + "/other")
+	if len(diffs) != 2 || diffs[1].Golden != nil || diffs[1].Key != "GET "+backend.URL+"/other" {
+		t.Errorf("Expected a missing golden response, got %+v", diffs[1])
+	}
+}
@@ -0,0 +1,73 @@
+package grpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxMessageSize is the size of the largest message read, the default limit of gRPC
+// servers.
+const MaxMessageSize = 4 << 20
+
+// Frame is a length-prefixed message of a gRPC stream.
+type Frame struct {
+	// Compressed tells whether Data is compressed with the grpc-encoding of the stream
+	Compressed bool
+	Data       []byte
+}
+
+// ReadFrame reads the next frame of r. It returns io.EOF at the end of the stream,
+// and io.ErrUnexpectedEOF if the stream ends in the middle of a frame.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxMessageSize {
+		return Frame{}, fmt.Errorf("grpc: message of %d bytes exceeds the maximum size", size)
+	}
+	f := Frame{Compressed: header[0]&1 != 0, Data: make([]byte, size)}
+	if _, err := io.ReadFull(r, f.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	return f, nil
+}
+
+// WriteFrame writes f to w.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf := make([]byte, 5+len(f.Data))
+	if f.Compressed {
+		buf[0] = 1
+	}
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(f.Data)))
+	copy(buf[5:], f.Data)
+	_, err := w.Write(buf)
+	return err
+}
+
+// decompress returns the uncompressed data of a frame compressed with encoding.
+func decompress(encoding string, data []byte) ([]byte, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("grpc: unsupported grpc-encoding %q", encoding)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, MaxMessageSize))
+}
+
+func compress(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
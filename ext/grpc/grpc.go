@@ -0,0 +1,308 @@
+// Package grpc inspects the gRPC calls going through the proxy, letting handlers deny
+// calls by method and read, change or refuse each of their messages:
+//
+//	proxy.MitmHTTP2 = true
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	grpc.Install(proxy, &grpc.Interceptor{
+//		OnCall: func(call *grpc.Call, ctx *goproxy.ProxyCtx) *grpc.Status {
+//			if call.Service() == "admin.Admin" {
+//				return &grpc.Status{Code: grpc.PermissionDenied, Message: "admin calls are not allowed"}
+//			}
+//			return nil
+//		},
+//		OnMessage: func(msg *grpc.Message, ctx *goproxy.ProxyCtx) *grpc.Status {
+//			ctx.Logf("%s %d bytes", msg.Call.Method, len(msg.Data))
+//			return nil
+//		},
+//	})
+//
+// gRPC runs over HTTP/2, the proxy must MITM the connections and set MitmHTTP2. The
+// messages are protocol buffers, which the package leaves to the Codecs given by the
+// user, e.g. built from the descriptors of the services with dynamicpb.
+package grpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Code is the status code of a gRPC call.
+type Code uint32
+
+const (
+	OK Code = iota
+	Canceled
+	Unknown
+	InvalidArgument
+	DeadlineExceeded
+	NotFound
+	AlreadyExists
+	PermissionDenied
+	ResourceExhausted
+	FailedPrecondition
+	Aborted
+	OutOfRange
+	Unimplemented
+	Internal
+	Unavailable
+	DataLoss
+	Unauthenticated
+)
+
+// Status ends a gRPC call, with its grpc-status and grpc-message fields.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) set(h http.Header) {
+	h.Set("Grpc-Status", strconv.FormatUint(uint64(s.Code), 10))
+	h.Del("Grpc-Message")
+	if s.Message != "" {
+		h.Set("Grpc-Message", encodeMessage(s.Message))
+	}
+}
+
+// Response returns a response ending the call of req with s, without any message.
+func (s *Status) Response(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, "application/grpc", http.StatusOK, "")
+	s.set(resp.Header)
+	return resp
+}
+
+// encodeMessage percent-encodes a grpc-message, as required by the gRPC protocol.
+func encodeMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// IsGRPC matches the gRPC requests, by their content type.
+var IsGRPC goproxy.ReqConditionFunc = func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+	contentType := req.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "application/grpc") {
+		return false
+	}
+	rest := contentType[len("application/grpc"):]
+	return rest == "" || rest[0] == '+' || rest[0] == ';'
+}
+
+// Call is a gRPC call going through the proxy.
+type Call struct {
+	// Method is the full name of the method called, e.g. "/helloworld.Greeter/SayHello"
+	Method  string
+	Request *http.Request
+
+	mu sync.Mutex
+	// status ends the call, once a handler aborted it
+	status *Status
+}
+
+// Service returns the service of the method called, e.g. "helloworld.Greeter".
+func (c *Call) Service() string {
+	parts := strings.SplitN(strings.TrimPrefix(c.Method, "/"), "/", 2)
+	return parts[0]
+}
+
+// Name returns the name of the method called, e.g. "SayHello".
+func (c *Call) Name() string {
+	return c.Method[strings.LastIndex(c.Method, "/")+1:]
+}
+
+func (c *Call) abort(s *Status) {
+	c.mu.Lock()
+	if c.status == nil {
+		c.status = s
+	}
+	c.mu.Unlock()
+}
+
+func (c *Call) aborted() *Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Codec decodes and encodes the messages of a method.
+type Codec interface {
+	Unmarshal(data []byte) (interface{}, error)
+	Marshal(v interface{}) ([]byte, error)
+}
+
+// MethodCodec holds the codecs of the requests and responses of a method.
+type MethodCodec struct {
+	Request, Response Codec
+}
+
+// Message is a message of a gRPC call.
+type Message struct {
+	Call *Call
+	// FromClient tells whether the message is sent by the client, or by the server
+	FromClient bool
+	// Data is the uncompressed message, which handlers may replace
+	Data []byte
+	// Value is Data decoded by the Codec of the method, nil without Codec
+	Value interface{}
+
+	codec Codec
+}
+
+// SetValue replaces the message with v, encoded by the Codec of the method.
+func (m *Message) SetValue(v interface{}) error {
+	if m.codec == nil {
+		return errors.New("grpc: no codec for " + m.Call.Method)
+	}
+	data, err := m.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Data, m.Value = data, v
+	return nil
+}
+
+// Interceptor holds the handlers of the gRPC calls.
+type Interceptor struct {
+	// OnCall, if set, is called before a call is sent upstream. Returning a non-nil
+	// Status denies the call with it.
+	OnCall func(call *Call, ctx *goproxy.ProxyCtx) *Status
+	// OnMessage, if set, is called with every message of the calls, in both directions,
+	// before it is forwarded. Returning a non-nil Status aborts the call with it.
+	OnMessage func(msg *Message, ctx *goproxy.ProxyCtx) *Status
+	// Codecs decode the messages of the methods, by full method name, into Message.Value
+	Codecs map[string]MethodCodec
+}
+
+const callKey = "grpc.call"
+
+// Install intercepts with i the gRPC calls of the requests of proxy matching conds.
+//
+// A message refused by OnMessage aborts the call: the client receives the Status in
+// the trailer of the response, or sees the stream reset if the server did not respond
+// yet. Compressed messages can be inspected if they use gzip, other encodings abort
+// the call. Servers are asked not to compress their messages.
+func Install(proxy *goproxy.ProxyHttpServer, i *Interceptor, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(append(conds[:len(conds):len(conds)], IsGRPC)...).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		call := &Call{Method: req.URL.Path, Request: req}
+		if i.OnCall != nil {
+			if s := i.OnCall(call, ctx); s != nil {
+				ctx.Logf("gRPC call %s denied: %d %s", call.Method, s.Code, s.Message)
+				return req, s.Response(req)
+			}
+		}
+		if i.OnMessage == nil {
+			return req, nil
+		}
+		req.Header.Del("Grpc-Accept-Encoding")
+		if req.Body != nil && req.Body != http.NoBody {
+			req.Body = i.filter(call, req.Body, true, req.Header.Get("Grpc-Encoding"), nil, ctx)
+		}
+		ctx.ReqData.Set(callKey, call)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		v, ok := ctx.ReqData.Get(callKey)
+		if !ok || resp == nil {
+			return resp
+		}
+		ctx.ReqData.Delete(callKey)
+		call := v.(*Call)
+		if s := call.aborted(); s != nil {
+			resp.Body.Close()
+			return s.Response(ctx.Req)
+		}
+		if resp.Trailer == nil {
+			resp.Trailer = make(http.Header)
+		}
+		resp.Body = i.filter(call, resp.Body, false, resp.Header.Get("Grpc-Encoding"), resp.Trailer, ctx)
+		return resp
+	})
+}
+
+var errAborted = errors.New("grpc: call aborted by the proxy")
+
+// filter returns the stream of the messages of body passed through OnMessage. The
+// Status of an aborted call is set in trailer, for the responses.
+func (i *Interceptor) filter(call *Call, body io.ReadCloser, fromClient bool, encoding string, trailer http.Header, ctx *goproxy.ProxyCtx) io.ReadCloser {
+	var codec Codec
+	if c, ok := i.Codecs[call.Method]; ok {
+		codec = c.Response
+		if fromClient {
+			codec = c.Request
+		}
+	}
+	pr, pw := io.Pipe()
+	end := func(err error) {
+		if s := call.aborted(); s != nil && trailer != nil {
+			s.set(trailer)
+			err = nil
+		}
+		pw.CloseWithError(err)
+	}
+	// the messages may still be read once the exchange is over
+	ctx.Keep()
+	go func() {
+		for {
+			f, err := ReadFrame(body)
+			if err != nil {
+				if err != io.EOF && call.aborted() == nil {
+					ctx.Warnf("Cannot read gRPC message of %s: %v", call.Method, err)
+				}
+				end(err)
+				return
+			}
+			msg := &Message{Call: call, FromClient: fromClient, Data: f.Data, codec: codec}
+			if f.Compressed {
+				if msg.Data, err = decompress(encoding, f.Data); err != nil {
+					call.abort(&Status{Code: Unimplemented, Message: err.Error()})
+					end(errAborted)
+					return
+				}
+			}
+			data := msg.Data
+			if codec != nil {
+				if msg.Value, err = codec.Unmarshal(data); err != nil {
+					ctx.Warnf("Cannot decode gRPC message of %s: %v", call.Method, err)
+				}
+			}
+			if s := i.OnMessage(msg, ctx); s != nil {
+				ctx.Logf("gRPC call %s aborted: %d %s", call.Method, s.Code, s.Message)
+				call.abort(s)
+				end(errAborted)
+				return
+			}
+			if f.Compressed && !bytes.Equal(msg.Data, data) {
+				f.Data = compress(msg.Data)
+			} else if !f.Compressed {
+				f.Data = msg.Data
+			}
+			if err := WriteFrame(pw, f); err != nil {
+				body.Close()
+				return
+			}
+		}
+	}()
+	return &filteredBody{pr, body}
+}
+
+type filteredBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+func (b *filteredBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
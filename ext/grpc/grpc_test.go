@@ -0,0 +1,181 @@
+package grpc_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/grpc"
+)
+
+type stringCodec struct{}
+
+func (stringCodec) Unmarshal(data []byte) (interface{}, error) { return string(data), nil }
+func (stringCodec) Marshal(v interface{}) ([]byte, error)      { return []byte(v.(string)), nil }
+
+// stream is the client side of a gRPC call
+type stream struct {
+	w    *io.PipeWriter
+	resp *http.Response
+}
+
+func (s *stream) send(t *testing.T, msg string, compressed bool) {
+	f := grpc.Frame{Data: []byte(msg)}
+	if compressed {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		io.WriteString(w, msg)
+		w.Close()
+		f = grpc.Frame{Compressed: true, Data: buf.Bytes()}
+	}
+	if err := grpc.WriteFrame(s.w, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *stream) recv() (string, error) {
+	f, err := grpc.ReadFrame(s.resp.Body)
+	return string(f.Data), err
+}
+
+func TestInstall(t *testing.T) {
+	var calls int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Grpc-Accept-Encoding"))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			f, err := grpc.ReadFrame(r.Body)
+			if err != nil {
+				break
+			}
+			if f.Compressed {
+				zr, _ := gzip.NewReader(bytes.NewReader(f.Data))
+				f.Data, _ = io.ReadAll(zr)
+			}
+			grpc.WriteFrame(w, grpc.Frame{Data: append([]byte("echo "), f.Data...)})
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmHTTP2 = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	grpc.Install(proxy, &grpc.Interceptor{
+		OnCall: func(call *grpc.Call, ctx *goproxy.ProxyCtx) *grpc.Status {
+			if call.Service() == "admin.Admin" {
+				return &grpc.Status{Code: grpc.PermissionDenied, Message: "no admin"}
+			}
+			return nil
+		},
+		OnMessage: func(msg *grpc.Message, ctx *goproxy.ProxyCtx) *grpc.Status {
+			if bytes.Contains(msg.Data, []byte("secret")) {
+				return &grpc.Status{Code: grpc.PermissionDenied, Message: "no secrets"}
+			}
+			if msg.FromClient && msg.Call.Name() == "Shout" {
+				if err := msg.SetValue(strings.ToUpper(msg.Value.(string))); err != nil {
+					t.Error(err)
+				}
+			}
+			return nil
+		},
+		Codecs: map[string]grpc.MethodCodec{"/test.Echo/Shout": {Request: stringCodec{}, Response: stringCodec{}}},
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+
+	call := func(method string) *stream {
+		pr, pw := io.Pipe()
+		req, _ := http.NewRequest("POST", server.URL+method, pr)
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		req.Header.Set("Grpc-Accept-Encoding", "gzip")
+		req.Header.Set("Grpc-Encoding", "gzip")
+		req.Header.Set("Te", "trailers")
+		s := &stream{w: pw}
+		done := make(chan error)
+		go func() {
+			var err error
+			s.resp, err = client.Do(req)
+			done <- err
+		}()
+		// the response only starts once the stream is sent
+		if err := grpc.WriteFrame(pw, grpc.Frame{Data: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if s.resp.ProtoMajor != 2 {
+			t.Fatal("Expected HTTP/2, got", s.resp.Proto)
+		}
+		return s
+	}
+
+	// messages are changed on their way
+	st := call("/test.Echo/Shout")
+	st.send(t, "world", true)
+	st.w.Close()
+	for _, expected := range []string{"echo HELLO", "echo WORLD"} {
+		if msg, err := st.recv(); err != nil || msg != expected {
+			t.Errorf("Expected %q, got %q %v", expected, msg, err)
+		}
+	}
+	if _, err := st.recv(); err != io.EOF || st.resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected the call to succeed, got %v %v", err, st.resp.Trailer)
+	}
+	if st.resp.Header.Get("X-Accept-Encoding") != "" {
+		t.Error("Expected the server not to be offered compression")
+	}
+	st.resp.Body.Close()
+
+	// a message from the client aborts the call
+	st = call("/test.Echo/Say")
+	if msg, err := st.recv(); err != nil || msg != "echo hello" {
+		t.Errorf("Expected the first message to go through, got %q %v", msg, err)
+	}
+	st.send(t, "my secret", false)
+	if _, err := st.recv(); err != io.EOF || st.resp.Trailer.Get("Grpc-Status") != "7" || st.resp.Trailer.Get("Grpc-Message") != "no secrets" {
+		t.Errorf("Expected the call to be aborted, got %v %v", err, st.resp.Trailer)
+	}
+	st.w.Close()
+	st.resp.Body.Close()
+
+	// and so does a message from the server
+	st = call("/test.Echo/Say")
+	st.recv()
+	st.send(t, "secret", true)
+	if _, err := st.recv(); err != io.EOF || st.resp.Trailer.Get("Grpc-Status") != "7" {
+		t.Errorf("Expected the call to be aborted, got %v %v", err, st.resp.Trailer)
+	}
+	st.w.Close()
+	st.resp.Body.Close()
+
+	// a denied call never reaches the server
+	before := atomic.LoadInt32(&calls)
+	req, _ := http.NewRequest("POST", server.URL+"/admin.Admin/Reset", strings.NewReader(""))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Grpc-Status") != "7" || resp.Header.Get("Grpc-Message") != "no admin" || atomic.LoadInt32(&calls) != before {
+		t.Errorf("Expected the call to be denied, got %v", resp.Header)
+	}
+}
@@ -0,0 +1,116 @@
+package headers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// CORS sets the Cross-Origin Resource Sharing headers of the responses to the requests
+// from allowed origins, replacing those of the server.
+type CORS struct {
+	// AllowOrigins are the origins allowed, e.g. "https://app.example.com", or "*"
+	// for any. The origin of the request is sent back, never a wildcard, so that
+	// credentials may be allowed.
+	AllowOrigins []string
+	// AllowCredentials lets the requests send and receive cookies
+	AllowCredentials bool
+	// AllowMethods and AllowHeaders are the methods and the request headers allowed
+	// by the preflight requests, those asked for if empty
+	AllowMethods []string
+	AllowHeaders []string
+	// ExposeHeaders are the response headers readable by the scripts
+	ExposeHeaders []string
+	// MaxAge is how long browsers may cache the preflight responses
+	MaxAge time.Duration
+	// Preflight answers the preflight requests at the proxy, instead of sending them
+	// upstream, for servers which do not support them
+	Preflight bool
+}
+
+func (c *CORS) allowed(origin string) bool {
+	for _, o := range c.AllowOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsHeaders are the response headers set by CORS
+var corsHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// apply sets the CORS headers of h for req, whose origin is allowed.
+func (c *CORS) apply(h http.Header, req *http.Request) {
+	for _, name := range corsHeaders {
+		h.Del(name)
+	}
+	h.Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+	h.Add("Vary", "Origin")
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposeHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+	if !isPreflight(req) {
+		return
+	}
+	if len(c.AllowMethods) > 0 {
+		h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowMethods, ", "))
+	} else {
+		h.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	}
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if v := req.Header.Get("Access-Control-Request-Headers"); v != "" {
+		h.Set("Access-Control-Allow-Headers", v)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge/time.Second)))
+	}
+}
+
+// Install applies c to the requests of proxy matching all the conditions.
+func (c *CORS) Install(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	if c.Preflight {
+		proxy.OnRequest(conds...).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			if !isPreflight(req) || !c.allowed(req.Header.Get("Origin")) {
+				return req, nil
+			}
+			ctx.Logf("Answering CORS preflight from %s", req.Header.Get("Origin"))
+			resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusNoContent, "")
+			c.apply(resp.Header, req)
+			return req, resp
+		})
+	}
+	respConds := make([]goproxy.RespCondition, len(conds))
+	for i, cond := range conds {
+		respConds[i] = cond
+	}
+	proxy.OnResponse(respConds...).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || !c.allowed(ctx.Req.Header.Get("Origin")) {
+			return resp
+		}
+		c.apply(resp.Header, ctx.Req)
+		if isPreflight(ctx.Req) && resp.StatusCode >= 300 {
+			// the servers ignoring preflights answer them with errors, failing them
+			resp.StatusCode, resp.Status = http.StatusNoContent, "204 No Content"
+		}
+		return resp
+	})
+}
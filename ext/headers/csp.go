@@ -0,0 +1,191 @@
+// Package headers rewrites the multi-directive policy headers of the responses going
+// through the proxy, Content-Security-Policy and CORS, e.g. so that pages accept the
+// scripts injected by the proxy, or that a web application may call an intercepted API:
+//
+//	proxy.OnResponse().Do(headers.AllowSources("script-src", "https://inject.example.com"))
+//	(&headers.CORS{AllowOrigins: []string{"http://localhost:3000"}, AllowCredentials: true}).
+//		Install(proxy, goproxy.ReqHostIs("api.example.com:443"))
+package headers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Directive is a directive of a Content Security Policy, with its source list.
+type Directive struct {
+	Name   string
+	Values []string
+}
+
+// CSP is a Content Security Policy, as found in one Content-Security-Policy header.
+// Its directives keep their order.
+type CSP struct {
+	Directives []Directive
+}
+
+// ParseCSP parses the value of a Content-Security-Policy header. The directive names are
+// lowercased, and the repeated directives ignored as by the browsers.
+func ParseCSP(s string) *CSP {
+	p := &CSP{}
+	for _, d := range strings.Split(s, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		if p.index(name) >= 0 {
+			continue
+		}
+		p.Directives = append(p.Directives, Directive{Name: name, Values: fields[1:]})
+	}
+	return p
+}
+
+func (p *CSP) String() string {
+	parts := make([]string, 0, len(p.Directives))
+	for _, d := range p.Directives {
+		parts = append(parts, strings.Join(append([]string{d.Name}, d.Values...), " "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (p *CSP) index(name string) int {
+	for i, d := range p.Directives {
+		if d.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the source list of a directive, and whether it is present.
+func (p *CSP) Get(name string) ([]string, bool) {
+	if i := p.index(strings.ToLower(name)); i >= 0 {
+		return p.Directives[i].Values, true
+	}
+	return nil, false
+}
+
+// Set sets the source list of a directive, adding it if missing.
+func (p *CSP) Set(name string, values ...string) {
+	name = strings.ToLower(name)
+	if i := p.index(name); i >= 0 {
+		p.Directives[i].Values = values
+		return
+	}
+	p.Directives = append(p.Directives, Directive{Name: name, Values: values})
+}
+
+// Del removes a directive.
+func (p *CSP) Del(name string) {
+	if i := p.index(strings.ToLower(name)); i >= 0 {
+		p.Directives = append(p.Directives[:i], p.Directives[i+1:]...)
+	}
+}
+
+// fallbacks are the directives applying to the fetches of a directive when it is
+// missing, in order (CSP Level 3, section 6.8.3).
+var fallbacks = map[string][]string{
+	"script-src-elem": {"script-src", "default-src"},
+	"script-src-attr": {"script-src", "default-src"},
+	"style-src-elem":  {"style-src", "default-src"},
+	"style-src-attr":  {"style-src", "default-src"},
+	"worker-src":      {"child-src", "script-src", "default-src"},
+	"frame-src":       {"child-src", "default-src"},
+	"child-src":       {"default-src"},
+	"script-src":      {"default-src"},
+	"style-src":       {"default-src"},
+	"img-src":         {"default-src"},
+	"connect-src":     {"default-src"},
+	"font-src":        {"default-src"},
+	"media-src":       {"default-src"},
+	"object-src":      {"default-src"},
+	"manifest-src":    {"default-src"},
+}
+
+// Allow adds sources to the source list of a directive, so that the policy allows
+// them. A missing directive is added with the sources of the one it falls back to, so
+// that the other fetches stay restricted; it is left missing if nothing restricts it.
+// The 'none' keyword is removed from the source list.
+func (p *CSP) Allow(name string, sources ...string) {
+	name = strings.ToLower(name)
+	values, ok := p.Get(name)
+	if !ok {
+		for _, fallback := range fallbacks[name] {
+			if values, ok = p.Get(fallback); ok {
+				break
+			}
+		}
+		if !ok {
+			return
+		}
+	}
+	allowed := make([]string, 0, len(values)+len(sources))
+	for _, v := range values {
+		if strings.ToLower(v) != "'none'" {
+			allowed = append(allowed, v)
+		}
+	}
+next:
+	for _, s := range sources {
+		for _, v := range allowed {
+			if strings.EqualFold(v, s) {
+				continue next
+			}
+		}
+		allowed = append(allowed, s)
+	}
+	p.Set(name, allowed...)
+}
+
+// cspHeaders are the headers holding Content Security Policies
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+// RewriteCSP returns a response handler calling f with the policies of the responses,
+// enforced or report-only, to change them. Every header holds a policy, all of them
+// being enforced by the browsers. The policies f leaves without directives are removed.
+func RewriteCSP(f func(p *CSP, ctx *goproxy.ProxyCtx)) goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil {
+			return resp
+		}
+		for _, name := range cspHeaders {
+			values := resp.Header.Values(name)
+			if len(values) == 0 {
+				continue
+			}
+			var rewritten []string
+			for _, v := range values {
+				p := ParseCSP(v)
+				f(p, ctx)
+				if len(p.Directives) > 0 {
+					rewritten = append(rewritten, p.String())
+				}
+			}
+			if strings.Join(rewritten, ", ") == strings.Join(values, ", ") {
+				continue
+			}
+			ctx.Logf("Rewriting %s: %s to %s", name, strings.Join(values, ", "), strings.Join(rewritten, ", "))
+			resp.Header.Del(name)
+			for _, v := range rewritten {
+				resp.Header.Add(name, v)
+			}
+		}
+		return resp
+	})
+}
+
+// AllowSources returns a response handler adding sources to a directive of the policies
+// of the responses, see CSP.Allow.
+func AllowSources(directive string, sources ...string) goproxy.RespHandler {
+	return RewriteCSP(func(p *CSP, ctx *goproxy.ProxyCtx) {
+		p.Allow(directive, sources...)
+		// the more specific directive would still apply to the elements
+		if _, ok := p.Get(directive + "-elem"); ok {
+			p.Allow(directive+"-elem", sources...)
+		}
+	})
+}
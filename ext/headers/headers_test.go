@@ -0,0 +1,91 @@
+package headers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/headers"
+)
+
+func TestCSPAllow(t *testing.T) {
+	for _, tc := range []struct {
+		policy, directive, expected string
+	}{
+		{"default-src 'self'; img-src *", "script-src", "default-src 'self'; img-src *; script-src 'self' https://cdn.test"},
+		{"Script-Src 'none'; script-src 'self'", "script-src", "script-src https://cdn.test"},
+		{"script-src 'self' https://cdn.test", "script-src", "script-src 'self' https://cdn.test"},
+		{"script-src 'self'", "script-src-elem", "script-src 'self'; script-src-elem 'self' https://cdn.test"},
+		{"img-src 'self'", "script-src", "img-src 'self'"},
+	} {
+		p := headers.ParseCSP(tc.policy)
+		p.Allow(tc.directive, "https://cdn.test")
+		if got := p.String(); got != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.policy, tc.expected, got)
+		}
+	}
+}
+
+func TestInstall(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Security-Policy", "default-src 'self'")
+		w.Header().Add("Content-Security-Policy", "script-src 'none'; report-uri /csp")
+		w.Header().Set("Access-Control-Allow-Origin", "https://other.test")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(headers.AllowSources("script-src", "https://inject.test"))
+	cors := &headers.CORS{AllowOrigins: []string{"https://app.test"}, AllowCredentials: true, MaxAge: time.Hour}
+	cors.Install(proxy, goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://")+"/api"))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	do := func(method, path, origin string) *http.Response {
+		req, _ := http.NewRequest(method, backend.URL+path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == http.MethodOptions {
+			req.Header.Set("Access-Control-Request-Method", "PUT")
+			req.Header.Set("Access-Control-Request-Headers", "X-Token")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodGet, "/page", "")
+	csp := resp.Header.Values("Content-Security-Policy")
+	if len(csp) != 2 || csp[0] != "default-src 'self'; script-src 'self' https://inject.test" || csp[1] != "script-src https://inject.test; report-uri /csp" {
+		t.Errorf("Unexpected policies %q", csp)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://other.test" {
+		t.Errorf("Expected the CORS headers of other paths to be kept, got %q", got)
+	}
+
+	resp = do(http.MethodGet, "/api/items", "https://app.test")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "https://app.test" || resp.Header.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Unexpected CORS headers %v", resp.Header)
+	}
+	resp = do(http.MethodOptions, "/api/items", "https://app.test")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Methods") != "PUT" ||
+		resp.Header.Get("Access-Control-Allow-Headers") != "X-Token" || resp.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Errorf("Unexpected preflight response %d %v", resp.StatusCode, resp.Header)
+	}
+	resp = do(http.MethodGet, "/api/items", "https://evil.test")
+	if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "https://other.test" {
+		t.Errorf("Expected other origins to be left alone, got %q", got)
+	}
+}
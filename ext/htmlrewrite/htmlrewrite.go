@@ -0,0 +1,406 @@
+// Package htmlrewrite transforms the HTML pages going through the proxy element by
+// element, in a single streaming pass of the golang.org/x/net/html tokenizer, rather
+// than with regular expressions over the whole body:
+//
+//	r := htmlrewrite.New()
+//	r.OnElement("head", htmlrewrite.InjectScript("https://example.com/inject.js"))
+//	r.OnElement("script", htmlrewrite.StripHosts("tracker.example.net"))
+//	proxy.OnResponse().Do(r.Handler())
+//
+// The markup no handler modified is written back as is, but for the tag names which are
+// lowercased, so that pages in any ASCII-compatible charset go through unchanged. The modified start tags and the
+// inserted markup are written in UTF-8.
+package htmlrewrite
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Element is an element of a page, as found by its start tag, given to the
+// ElementHandlers.
+type Element struct {
+	name        string
+	attrs       []html.Attribute
+	selfClosing bool
+
+	modified bool
+	removed  bool
+
+	before, prepend, append, after string
+}
+
+// ElementHandler transforms an element of a page.
+type ElementHandler func(e *Element, ctx *goproxy.ProxyCtx)
+
+// Name returns the lowercase tag name of e.
+func (e *Element) Name() string {
+	return e.name
+}
+
+// Attr returns the value of the attribute name of e, and whether it is set.
+func (e *Element) Attr(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, a := range e.attrs {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+// Attrs returns the attributes of e, which must not be modified.
+func (e *Element) Attrs() []html.Attribute {
+	return e.attrs
+}
+
+// SetAttr sets the value of the attribute name of e.
+func (e *Element) SetAttr(name, value string) {
+	name = strings.ToLower(name)
+	e.modified = true
+	for i := range e.attrs {
+		if e.attrs[i].Key == name {
+			e.attrs[i].Val = value
+			return
+		}
+	}
+	e.attrs = append(e.attrs, html.Attribute{Key: name, Val: value})
+}
+
+// RemoveAttr removes the attribute name of e.
+func (e *Element) RemoveAttr(name string) {
+	name = strings.ToLower(name)
+	attrs := e.attrs[:0]
+	for _, a := range e.attrs {
+		if a.Key != name {
+			attrs = append(attrs, a)
+		}
+	}
+	if len(attrs) != len(e.attrs) {
+		e.modified = true
+	}
+	e.attrs = attrs
+}
+
+// Remove removes e and its content from the page. The markup inserted with Before and
+// After is still written, replacing e.
+func (e *Element) Remove() {
+	e.removed = true
+}
+
+// Removed returns whether e was removed by a previous handler.
+func (e *Element) Removed() bool {
+	return e.removed
+}
+
+// Before inserts the markup fragment before the start tag of e.
+func (e *Element) Before(fragment string) {
+	e.before += fragment
+}
+
+// Prepend inserts the markup fragment right after the start tag of e.
+func (e *Element) Prepend(fragment string) {
+	e.prepend += fragment
+}
+
+// Append inserts the markup fragment right before the end tag of e. If e has no
+// explicit end tag, e.g. a <p> closed by the next one, the fragment is written at the
+// end of the page.
+func (e *Element) Append(fragment string) {
+	e.append += fragment
+}
+
+// After inserts the markup fragment after the end tag of e, with the same caveat as
+// Append.
+func (e *Element) After(fragment string) {
+	e.after += fragment
+}
+
+// void reports whether e has no content nor end tag.
+func (e *Element) void() bool {
+	if e.selfClosing {
+		return true
+	}
+	switch atom.Lookup([]byte(e.name)) {
+	case atom.Area, atom.Base, atom.Br, atom.Col, atom.Embed, atom.Hr, atom.Img, atom.Input,
+		atom.Link, atom.Meta, atom.Param, atom.Source, atom.Track, atom.Wbr:
+		return true
+	}
+	return false
+}
+
+// Rewriter applies the ElementHandlers registered with OnElement to the HTML pages.
+type Rewriter struct {
+	handlers map[string][]ElementHandler
+}
+
+// New returns a Rewriter without handlers.
+func New() *Rewriter {
+	return &Rewriter{handlers: make(map[string][]ElementHandler)}
+}
+
+// OnElement registers f for the elements of the given tag name, or for all the
+// elements if tag is "*". The handlers of an element are called in the order they
+// were registered, the ones of "*" last.
+func (r *Rewriter) OnElement(tag string, f ElementHandler) *Rewriter {
+	tag = strings.ToLower(tag)
+	r.handlers[tag] = append(r.handlers[tag], f)
+	return r
+}
+
+// isHtml is the condition of the responses Handler rewrites.
+var isHtml goproxy.RespCondition = goproxy.ContentTypeIs("text/html", "application/xhtml+xml")
+
+// Handler returns a RespHandler rewriting the HTML responses, as the client reads
+// them. Compressed responses are passed through, since the proxy transport usually
+// decompresses them already.
+func (r *Rewriter) Handler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil || resp.Body == nil || resp.Body == http.NoBody || !isHtml.HandleResp(resp, ctx) {
+			return resp
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+			ctx.Logf("Not rewriting HTML with Content-Encoding %s", encoding)
+			return resp
+		}
+		body := resp.Body
+		pr, pw := io.Pipe()
+		// Rewrite may outlive the exchange if the client goes away
+		ctx.Keep()
+		go func() {
+			err := r.Rewrite(pw, body, ctx)
+			body.Close()
+			pw.CloseWithError(err)
+		}()
+		resp.Body = &rewrittenBody{pr, body}
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return resp
+	})
+}
+
+// rewrittenBody closes the original body with the pipe, to stop Rewrite when the
+// client goes away
+type rewrittenBody struct {
+	*io.PipeReader
+	original io.Closer
+}
+
+func (b *rewrittenBody) Close() error {
+	b.PipeReader.Close()
+	return b.original.Close()
+}
+
+// pending is an element whose end tag is awaited to insert markup
+type pending struct {
+	e *Element
+	// depth is the number of open descendants of the same name
+	depth int
+}
+
+// Rewrite copies the page src to dst, applying the handlers of r.
+func (r *Rewriter) Rewrite(dst io.Writer, src io.Reader, ctx *goproxy.ProxyCtx) error {
+	w := bufio.NewWriter(dst)
+	z := html.NewTokenizer(src)
+	var (
+		stack     []pending
+		skip      string
+		skipDepth int
+	)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.EndTagToken && tt != html.SelfClosingTagToken {
+			if skip == "" {
+				w.Write(z.Raw())
+			}
+			continue
+		}
+		raw := z.Raw()
+		name, hasAttr := z.TagName()
+		tag := string(name)
+
+		if skip != "" {
+			if tag == skip && tt == html.StartTagToken {
+				skipDepth++
+			} else if tag == skip && tt == html.EndTagToken {
+				if skipDepth == 0 {
+					skip = ""
+				} else {
+					skipDepth--
+				}
+			}
+			continue
+		}
+
+		if tt == html.EndTagToken {
+			var closed []*Element
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].e.name != tag {
+					continue
+				}
+				if stack[i].depth == 0 {
+					closed = append(closed, stack[i].e)
+					stack = append(stack[:i], stack[i+1:]...)
+				} else {
+					stack[i].depth--
+				}
+			}
+			for _, e := range closed {
+				w.WriteString(e.append)
+			}
+			w.Write(raw)
+			for _, e := range closed {
+				w.WriteString(e.after)
+			}
+			continue
+		}
+
+		handlers, all := r.handlers[tag], r.handlers["*"]
+		if tt == html.StartTagToken {
+			for i := range stack {
+				if stack[i].e.name == tag {
+					stack[i].depth++
+				}
+			}
+		}
+		if len(handlers) == 0 && len(all) == 0 {
+			w.Write(raw)
+			continue
+		}
+
+		e := &Element{name: tag, selfClosing: tt == html.SelfClosingTagToken}
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = z.TagAttr()
+			e.attrs = append(e.attrs, html.Attribute{Key: atom.String(key), Val: string(val)})
+		}
+		for _, f := range handlers {
+			f(e, ctx)
+		}
+		for _, f := range all {
+			f(e, ctx)
+		}
+
+		w.WriteString(e.before)
+		if e.removed {
+			if !e.void() {
+				skip, skipDepth = tag, 0
+			}
+			w.WriteString(e.after)
+			continue
+		}
+		if e.modified {
+			w.WriteString(html.Token{Type: tt, Data: tag, Attr: e.attrs}.String())
+		} else {
+			w.Write(raw)
+		}
+		w.WriteString(e.prepend)
+		if e.void() {
+			w.WriteString(e.append)
+			w.WriteString(e.after)
+		} else if e.append != "" || e.after != "" {
+			stack = append(stack, pending{e: e})
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		w.WriteString(stack[i].e.append)
+		w.WriteString(stack[i].e.after)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := z.Err(); err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// InjectScript returns an ElementHandler appending a script loaded from src to the
+// element, usually "head" or "body".
+func InjectScript(src string) ElementHandler {
+	return InjectHTML(`<script src="` + html.EscapeString(src) + `"></script>`)
+}
+
+// InjectHTML returns an ElementHandler appending the markup fragment to the element.
+func InjectHTML(fragment string) ElementHandler {
+	return func(e *Element, ctx *goproxy.ProxyCtx) {
+		e.Append(fragment)
+	}
+}
+
+// urlAttrs are the attributes holding a URL
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"cite":       true,
+	"data":       true,
+	"background": true,
+	"manifest":   true,
+}
+
+// RewriteURLs returns an ElementHandler replacing the URLs of the attributes of the
+// element, such as href, src, action or srcset, with the result of f. The URLs are
+// given as written in the page, they may be relative.
+func RewriteURLs(f func(u string, ctx *goproxy.ProxyCtx) string) ElementHandler {
+	return func(e *Element, ctx *goproxy.ProxyCtx) {
+		for _, a := range e.attrs {
+			switch {
+			case urlAttrs[a.Key]:
+				if u := f(a.Val, ctx); u != a.Val {
+					e.SetAttr(a.Key, u)
+				}
+			case a.Key == "srcset":
+				candidates := strings.Split(a.Val, ",")
+				for i, c := range candidates {
+					fields := strings.Fields(c)
+					if len(fields) > 0 {
+						fields[0] = f(fields[0], ctx)
+						candidates[i] = strings.Join(fields, " ")
+					}
+				}
+				if srcset := strings.Join(candidates, ", "); srcset != a.Val {
+					e.SetAttr(a.Key, srcset)
+				}
+			}
+		}
+	}
+}
+
+// StripHosts returns an ElementHandler removing the element if its src or href
+// attribute refers to one of hosts or to their subdomains, e.g. the scripts and pixels
+// of trackers.
+func StripHosts(hosts ...string) ElementHandler {
+	return func(e *Element, ctx *goproxy.ProxyCtx) {
+		for _, name := range []string{"src", "href"} {
+			v, ok := e.Attr(name)
+			if !ok {
+				continue
+			}
+			u, err := url.Parse(strings.TrimSpace(v))
+			if err != nil {
+				continue
+			}
+			host := strings.ToLower(u.Hostname())
+			for _, h := range hosts {
+				h = strings.ToLower(h)
+				if host == h || strings.HasSuffix(host, "."+h) {
+					e.Remove()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package htmlrewrite_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/htmlrewrite"
+)
+
+func rewrite(t *testing.T, r *htmlrewrite.Rewriter, page string) string {
+	var out bytes.Buffer
+	if err := r.Rewrite(&out, strings.NewReader(page), nil); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestRewrite(t *testing.T) {
+	r := htmlrewrite.New()
+	r.OnElement("head", htmlrewrite.InjectScript("/inject.js?a=1&b=2"))
+	r.OnElement("script", htmlrewrite.StripHosts("tracker.net"))
+	r.OnElement("*", htmlrewrite.RewriteURLs(func(u string, ctx *goproxy.ProxyCtx) string {
+		return strings.Replace(u, "http://old.com/", "https://new.com/", 1)
+	}))
+	r.OnElement("div", func(e *htmlrewrite.Element, ctx *goproxy.ProxyCtx) {
+		if class, _ := e.Attr("class"); class == "ad" {
+			e.Remove()
+			e.Before("<!-- ad -->")
+		}
+	})
+
+	for _, c := range []struct{ in, out string }{
+		{`<html><HEAD><title>t</title></head></html>`,
+			`<html><head><title>t</title><script src="/inject.js?a=1&amp;b=2"></script></head></html>`},
+		{`<a href="http://old.com/x" id=a>x</a><img SRC='http://old.com/i.png'/><p class=kept>`,
+			`<a href="https://new.com/x" id="a">x</a><img src="https://new.com/i.png"/><p class=kept>`},
+		{`<img srcset="http://old.com/1.png 1x, http://old.com/2.png 2x">`,
+			`<img srcset="https://new.com/1.png 1x, https://new.com/2.png 2x">`},
+		{`<script src="https://cdn.tracker.net/t.js">var a = "</div>";</script><script>ok()</script>`,
+			`<script>ok()</script>`},
+		{`<div class=ad><div>nested</div><p>text</div><div>kept</div>`,
+			`<!-- ad --><div>kept</div>`},
+		{"<p>caf\xe9 &eacute;</p>", "<p>caf\xe9 &eacute;</p>"},
+	} {
+		if out := rewrite(t, r, c.in); out != c.out {
+			t.Errorf("Rewriting %q: expected %q, got %q", c.in, c.out, out)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	r := htmlrewrite.New()
+	r.OnElement("section", func(e *htmlrewrite.Element, ctx *goproxy.ProxyCtx) {
+		id, _ := e.Attr("id")
+		e.Prepend("[" + id)
+		e.Append(id + "]")
+		e.After("|")
+		e.RemoveAttr("id")
+	})
+	in := `<section id=a><section id=b>x</section></section><section id=c>`
+	expected := `<section>[a<section>[bxb]</section>|a]</section>|<section>[cc]|`
+	if out := rewrite(t, r, in); out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/text" {
+			w.Header().Set("Content-Type", "text/plain")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		io.WriteString(w, "<body><b>bold</b></body>")
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	r := htmlrewrite.New().OnElement("b", htmlrewrite.InjectHTML("!"))
+	proxy.OnResponse().Do(r.Handler())
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	for path, expected := range map[string]string{
+		"/html": "<body><b>bold!</b></body>",
+		"/text": "<body><b>bold</b></body>",
+	} {
+		resp, err := client.Get(backend.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || string(b) != expected {
+			t.Errorf("%s: expected %q, got %q %v", path, expected, b, err)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+// Package icap is an ICAP (RFC 3507) client, used to submit the traffic of the proxy to
+// content adaptation services such as antivirus or DLP engines:
+//
+//	client := &icap.Client{ReqModURL: "icap://127.0.0.1:1344/reqmod", RespModURL: "icap://127.0.0.1:1344/respmod", Preview: 1024}
+//	proxy.OnRequest().Do(client.RequestHandler())
+//	proxy.OnResponse(goproxy.ContentTypeIs("application/octet-stream")).Do(client.ResponseHandler())
+//
+// The client supports previews, and the 204 No Content answer for unmodified messages.
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// DefaultPort is the port of ICAP URLs without one.
+const DefaultPort = "1344"
+
+// DefaultTimeout bounds an ICAP transaction when Client.Timeout is zero.
+const DefaultTimeout = 30 * time.Second
+
+// Client sends REQMOD and RESPMOD requests to ICAP services.
+type Client struct {
+	// ReqModURL and RespModURL are the icap:// URLs of the services adapting
+	// requests and responses.
+	ReqModURL  string
+	RespModURL string
+	// Preview, if positive, is the number of body bytes sent before the service
+	// decides whether it needs the rest of the message. The service tells the size
+	// it wants in its OPTIONS response.
+	Preview int
+	// Timeout bounds an ICAP transaction, DefaultTimeout if zero. For adapted
+	// messages, the deadline includes reading their body.
+	Timeout time.Duration
+	// FailOpen lets traffic through unmodified when the ICAP service fails,
+	// instead of answering 502 Bad Gateway.
+	FailOpen bool
+	// Dial connects to the ICAP service, net.Dial if nil.
+	Dial func(network, addr string) (net.Conn, error)
+}
+
+// Response is the answer of an ICAP service.
+type Response struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	// Request is the adapted request of a REQMOD transaction, and Response the
+	// adapted response, or the response to send instead of the request. Both are
+	// nil if the message was not modified (204 No Content).
+	Request  *http.Request
+	Response *http.Response
+}
+
+// Error is returned when the ICAP service answers with an error status.
+type Error struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *Error) Error() string {
+	return "icap: " + e.Status
+}
+
+var errBadEncapsulated = errors.New("icap: bad Encapsulated header")
+
+func (c *Client) dial(u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	dial := c.Dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	return conn, nil
+}
+
+// Options sends an OPTIONS request to the ICAP service at rawurl, and returns the
+// headers of its response, such as Methods, Preview and ISTag.
+func (c *Client) Options(rawurl string) (textproto.MIMEHeader, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.dial(u)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "OPTIONS %s ICAP/1.0\r\nHost: %s\r\nEncapsulated: null-body=0\r\n\r\n", rawurl, u.Host); err != nil {
+		return nil, err
+	}
+	resp, err := readResponse(bufio.NewReader(conn), conn)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+// ReqMod submits req to the REQMOD service. The body of req is read and replaced, so
+// that req can still be sent if the service did not modify it.
+func (c *Client) ReqMod(req *http.Request) (*Response, error) {
+	var hdr bytes.Buffer
+	writeRequestHeader(&hdr, req)
+	sections := []section{{"req-hdr", hdr.Bytes()}}
+	resp, body, err := c.roundTrip("REQMOD", c.ReqModURL, sections, "req-body", req.Body)
+	if req.Body != nil {
+		req.Body = body
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.Request != nil {
+		adapted := resp.Request
+		if !adapted.URL.IsAbs() {
+			adapted.URL.Scheme, adapted.URL.Host = req.URL.Scheme, req.URL.Host
+		}
+		adapted.RemoteAddr = req.RemoteAddr
+		adapted = adapted.WithContext(req.Context())
+		resp.Request = adapted
+	}
+	if resp.Response != nil {
+		resp.Response.Request = req
+	}
+	return resp, nil
+}
+
+// RespMod submits resp, the response to req, to the RESPMOD service. The body of resp
+// is read and replaced, so that resp can still be used if the service did not modify it.
+func (c *Client) RespMod(req *http.Request, resp *http.Response) (*Response, error) {
+	var reqHdr, respHdr bytes.Buffer
+	writeRequestHeader(&reqHdr, req)
+	fmt.Fprintf(&respHdr, "HTTP/1.1 %03d %s\r\n", resp.StatusCode, http.StatusText(resp.StatusCode))
+	resp.Header.Write(&respHdr)
+	respHdr.WriteString("\r\n")
+	sections := []section{{"req-hdr", reqHdr.Bytes()}, {"res-hdr", respHdr.Bytes()}}
+	icapResp, body, err := c.roundTrip("RESPMOD", c.RespModURL, sections, "res-body", resp.Body)
+	if resp.Body != nil {
+		resp.Body = body
+	}
+	if err != nil {
+		return nil, err
+	}
+	if icapResp.Response != nil {
+		icapResp.Response.Request = req
+	}
+	return icapResp, nil
+}
+
+func writeRequestHeader(w *bytes.Buffer, req *http.Request) {
+	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	fmt.Fprintf(w, "Host: %s\r\n", host)
+	req.Header.WriteSubset(w, map[string]bool{"Host": true})
+	w.WriteString("\r\n")
+}
+
+type section struct {
+	name string
+	data []byte
+}
+
+// replayBody returns the bytes of a body already sent to the service, followed by the
+// rest of the body.
+type replayBody struct {
+	io.Reader
+	io.Closer
+}
+
+// roundTrip runs an ICAP transaction. It returns the body of the original message,
+// which can be read again.
+func (c *Client) roundTrip(method, rawurl string, sections []section, bodyName string, body io.ReadCloser) (*Response, io.ReadCloser, error) {
+	var sent bytes.Buffer
+	orig := body
+	replay := func() io.ReadCloser {
+		if body == nil || sent.Len() == 0 {
+			return orig
+		}
+		return replayBody{io.MultiReader(bytes.NewReader(sent.Bytes()), body), body}
+	}
+	if body == http.NoBody {
+		body = nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, replay(), err
+	}
+	conn, err := c.dial(u)
+	if err != nil {
+		return nil, replay(), err
+	}
+	var src io.Reader
+	if body != nil {
+		src = io.TeeReader(body, &sent)
+	}
+
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "%s %s ICAP/1.0\r\nHost: %s\r\nAllow: 204\r\n", method, rawurl, u.Host)
+	preview := c.Preview > 0 && src != nil
+	if preview {
+		fmt.Fprintf(&hdr, "Preview: %d\r\n", c.Preview)
+	}
+	var encapsulated []string
+	offset := 0
+	for _, s := range sections {
+		encapsulated = append(encapsulated, s.name+"="+strconv.Itoa(offset))
+		offset += len(s.data)
+	}
+	if src != nil {
+		encapsulated = append(encapsulated, bodyName+"="+strconv.Itoa(offset))
+	} else {
+		encapsulated = append(encapsulated, "null-body="+strconv.Itoa(offset))
+	}
+	fmt.Fprintf(&hdr, "Encapsulated: %s\r\n\r\n", strings.Join(encapsulated, ", "))
+	for _, s := range sections {
+		hdr.Write(s.data)
+	}
+
+	w := bufio.NewWriter(conn)
+	r := bufio.NewReader(conn)
+	fail := func(err error) (*Response, io.ReadCloser, error) {
+		conn.Close()
+		return nil, replay(), err
+	}
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return fail(err)
+	}
+	eof := src == nil
+	if preview {
+		buf := make([]byte, c.Preview)
+		n, err := io.ReadFull(src, buf)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			eof = true
+		default:
+			return fail(err)
+		}
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if eof {
+			w.WriteString("0; ieof\r\n\r\n")
+		} else {
+			w.WriteString("0\r\n\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return fail(err)
+		}
+		resp, err := readResponse(r, conn)
+		if err != nil {
+			return fail(err)
+		}
+		if resp.StatusCode != http.StatusContinue {
+			return resp, replay(), nil
+		}
+	}
+	if !eof {
+		cw := httputil.NewChunkedWriter(w)
+		if _, err := io.Copy(cw, src); err != nil {
+			return fail(err)
+		}
+		cw.Close()
+		w.WriteString("\r\n")
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	resp, err := readResponse(r, conn)
+	if err != nil {
+		return fail(err)
+	}
+	if resp.StatusCode == http.StatusContinue {
+		return fail(errors.New("icap: unexpected 100 Continue"))
+	}
+	return resp, replay(), nil
+}
+
+// connBody is the body of an adapted message, read from the ICAP connection.
+type connBody struct {
+	io.Reader
+	conn net.Conn
+}
+
+func (b *connBody) Close() error {
+	return b.conn.Close()
+}
+
+// readResponse reads an ICAP response and the HTTP messages it encapsulates. The
+// connection is closed unless the body of an adapted message remains to be read.
+func readResponse(r *bufio.Reader, conn net.Conn) (*Response, error) {
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return nil, fmt.Errorf("icap: bad status line %q", line)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("icap: bad status line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	resp := &Response{StatusCode: code, Status: strings.Join(parts[1:], " "), Header: header}
+	switch {
+	case code == http.StatusContinue:
+		return resp, nil
+	case code == http.StatusNoContent:
+		conn.Close()
+		return resp, nil
+	case code != http.StatusOK:
+		conn.Close()
+		return nil, &Error{code, resp.Status}
+	}
+
+	// parse "req-hdr=0, res-hdr=137, res-body=296"
+	type entity struct {
+		name   string
+		offset int
+	}
+	var entities []entity
+	for _, e := range strings.Split(header.Get("Encapsulated"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		if len(kv) != 2 {
+			conn.Close()
+			return nil, errBadEncapsulated
+		}
+		offset, err := strconv.Atoi(kv[1])
+		if err != nil || len(entities) > 0 && offset < entities[len(entities)-1].offset {
+			conn.Close()
+			return nil, errBadEncapsulated
+		}
+		entities = append(entities, entity{kv[0], offset})
+	}
+	var reqHdr, resHdr []byte
+	var body io.ReadCloser
+	for i, e := range entities {
+		switch e.name {
+		case "req-hdr", "res-hdr":
+			if i+1 >= len(entities) {
+				conn.Close()
+				return nil, errBadEncapsulated
+			}
+			data := make([]byte, entities[i+1].offset-e.offset)
+			if _, err := io.ReadFull(r, data); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			if e.name == "req-hdr" {
+				reqHdr = data
+			} else {
+				resHdr = data
+			}
+		case "req-body", "res-body":
+			body = &connBody{httputil.NewChunkedReader(r), conn}
+		case "null-body", "opt-body":
+		default:
+			conn.Close()
+			return nil, errBadEncapsulated
+		}
+	}
+	if body == nil {
+		conn.Close()
+		body = http.NoBody
+	}
+	if resHdr != nil {
+		resp.Response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(resHdr)), nil)
+		if err == nil {
+			resp.Response.Body = body
+			resp.Response.ContentLength = -1
+			resp.Response.Header.Del("Content-Length")
+			resp.Response.TransferEncoding = nil
+		}
+	} else if reqHdr != nil {
+		resp.Request, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(reqHdr)))
+		if err == nil {
+			resp.Request.Body = body
+			resp.Request.ContentLength = -1
+			resp.Request.Header.Del("Content-Length")
+			resp.Request.TransferEncoding = nil
+			if body == http.NoBody {
+				resp.Request.ContentLength = 0
+			}
+		}
+	}
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *Client) failed(req *http.Request, ctx *goproxy.ProxyCtx, err error) *http.Response {
+	ctx.Warnf("ICAP adaptation of %s failed: %v", req.URL, err)
+	if c.FailOpen {
+		return nil
+	}
+	return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Content adaptation failed\n")
+}
+
+// RequestHandler returns a ReqHandler submitting requests to the REQMOD service. The
+// request is replaced by the adapted one, or answered with the response of the service.
+func (c *Client) RequestHandler() goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		resp, err := c.ReqMod(req)
+		if err != nil {
+			return req, c.failed(req, ctx, err)
+		}
+		if resp.Response != nil {
+			ctx.Logf("ICAP service answered %s instead of %s", resp.Response.Status, req.URL)
+			return req, resp.Response
+		}
+		if resp.Request != nil {
+			return resp.Request, nil
+		}
+		return req, nil
+	})
+}
+
+// ResponseHandler returns a RespHandler submitting responses to the RESPMOD service,
+// and replacing them with the adapted ones.
+func (c *Client) ResponseHandler() goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil {
+			return nil
+		}
+		icapResp, err := c.RespMod(ctx.Req, resp)
+		if err != nil {
+			if failed := c.failed(ctx.Req, ctx, err); failed != nil {
+				resp.Body.Close()
+				return failed
+			}
+			return resp
+		}
+		if icapResp.Response != nil {
+			resp.Body.Close()
+			return icapResp.Response
+		}
+		return resp
+	})
+}
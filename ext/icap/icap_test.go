@@ -0,0 +1,222 @@
+package icap_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/icap"
+)
+
+func oneShotProxy(proxy *goproxy.ProxyHttpServer) (client *http.Client, s *httptest.Server) {
+	s = httptest.NewServer(proxy)
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl)}
+	client = &http.Client{Transport: tr}
+	return
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string) {
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b)
+}
+
+// readChunked reads a chunked body, and tells whether it ended with ieof.
+func readChunked(r *bufio.Reader) ([]byte, bool, error) {
+	var body bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, false, err
+		}
+		line = strings.TrimSpace(line)
+		size := line
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			size = strings.TrimSpace(line[:i])
+		}
+		n, err := strconv.ParseInt(size, 16, 64)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			_, err := r.ReadString('\n')
+			return body.Bytes(), strings.Contains(line, "ieof"), err
+		}
+		if _, err := io.CopyN(&body, r, n); err != nil {
+			return nil, false, err
+		}
+		r.ReadString('\n')
+	}
+}
+
+func writeAdapted(w io.Writer, name, hdr, body string) {
+	encapsulated := fmt.Sprintf("%s=0, null-body=%d", name, len(hdr))
+	if body != "" {
+		encapsulated = fmt.Sprintf("%s=0, %s-body=%d", name, name[:3], len(hdr))
+	}
+	fmt.Fprintf(w, "ICAP/1.0 200 OK\r\nISTag: \"test\"\r\nEncapsulated: %s\r\n\r\n%s", encapsulated, hdr)
+	if body != "" {
+		fmt.Fprintf(w, "%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+	}
+}
+
+// serveICAP blocks messages whose body contains "virus", adds a header to requests
+// to /rewrite, upper-cases the responses to /upper, and leaves other messages alone.
+func serveICAP(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	method := strings.Fields(line)[0]
+	if method == "OPTIONS" {
+		io.WriteString(conn, "ICAP/1.0 200 OK\r\nMethods: REQMOD, RESPMOD\r\nPreview: 4\r\nEncapsulated: null-body=0\r\n\r\n")
+		return
+	}
+	var sections [][]byte
+	offset, hasBody := 0, false
+	for _, e := range strings.Split(header.Get("Encapsulated"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(e), "=", 2)
+		n, _ := strconv.Atoi(kv[1])
+		if n > offset {
+			data := make([]byte, n-offset)
+			io.ReadFull(r, data)
+			sections = append(sections, data)
+			offset = n
+		}
+		hasBody = strings.HasSuffix(kv[0], "-body") && kv[0] != "null-body"
+	}
+	var body []byte
+	if hasBody {
+		var ieof bool
+		body, ieof, err = readChunked(r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if header.Get("Preview") != "" && !ieof {
+			if strings.Contains(string(sections[0]), "/clean") {
+				io.WriteString(conn, "ICAP/1.0 204 No Content\r\n\r\n")
+				return
+			}
+			io.WriteString(conn, "ICAP/1.0 100 Continue\r\n\r\n")
+			rest, _, err := readChunked(r)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = append(body, rest...)
+		}
+	}
+	reqHdr := string(sections[0])
+	switch {
+	case bytes.Contains(body, []byte("virus")):
+		writeAdapted(conn, "res-hdr", "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n", "blocked")
+	case method == "REQMOD" && strings.Contains(reqHdr, "/rewrite"):
+		writeAdapted(conn, "req-hdr", strings.TrimSuffix(reqHdr, "\r\n")+"X-Icap: adapted\r\n\r\n", "")
+	case method == "RESPMOD" && strings.Contains(reqHdr, "/upper"):
+		writeAdapted(conn, "res-hdr", string(sections[1]), strings.ToUpper(string(body)))
+	default:
+		io.WriteString(conn, "ICAP/1.0 204 No Content\r\n\r\n")
+	}
+}
+
+func TestICAP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveICAP(t, conn)
+		}
+	}()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/infected":
+			io.WriteString(w, "a long body with a virus")
+		case "/clean":
+			io.WriteString(w, "a long clean body")
+		default:
+			io.WriteString(w, "x-icap="+r.Header.Get("X-Icap"))
+		}
+	}))
+	defer backend.Close()
+
+	client := &icap.Client{
+		ReqModURL:  "icap://" + l.Addr().String() + "/reqmod",
+		RespModURL: "icap://" + l.Addr().String() + "/respmod",
+	}
+	options, err := client.Options(client.ReqModURL)
+	if err != nil || options.Get("Methods") != "REQMOD, RESPMOD" {
+		t.Fatal("Unexpected OPTIONS response", options, err)
+	}
+	client.Preview, _ = strconv.Atoi(options.Get("Preview"))
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(client.RequestHandler())
+	proxy.OnResponse().Do(client.ResponseHandler())
+	c, s := oneShotProxy(proxy)
+	defer s.Close()
+
+	for _, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/", 200, "x-icap="},
+		{"/rewrite", 200, "x-icap=adapted"},
+		{"/upper", 200, "X-ICAP="},
+		{"/clean", 200, "a long clean body"},
+		{"/infected", 403, "blocked"},
+	} {
+		if status, body := get(t, c, backend.URL+test.path); status != test.status || body != test.body {
+			t.Errorf("%s: expected %d %q, got %d %q", test.path, test.status, test.body, status, body)
+		}
+	}
+	resp, err := c.Post(backend.URL+"/upload", "text/plain", strings.NewReader("uploading a virus"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 403 {
+		t.Error("Expected the upload to be blocked, got", resp.Status)
+	}
+
+	l.Close()
+	if status, _ := get(t, c, backend.URL+"/"); status != http.StatusBadGateway {
+		t.Error("Expected 502 when the ICAP service is down, got", status)
+	}
+	client.FailOpen = true
+	if status, body := get(t, c, backend.URL+"/"); status != 200 || body != "x-icap=" {
+		t.Error("Expected the request to pass with FailOpen, got", status, body)
+	}
+}
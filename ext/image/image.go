@@ -3,24 +3,117 @@ package goproxy_image
 import (
 	"bytes"
 	. "github.com/mixcode/goproxy"
-	"github.com/mixcode/goproxy/regretable"
 	"image"
 	_ "image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp"
 )
 
 var RespIsImage = ContentTypeIs("image/gif",
 	"image/jpeg",
 	"image/pjpeg",
 	"application/octet-stream",
-	"image/png")
+	"image/png",
+	"image/webp",
+	"image/avif")
 
 // "image/tiff" tiff support is in external package, and rarely used, so we omitted it
+//
+// WebP images are decoded with golang.org/x/image/webp. AVIF images are decoded once a
+// decoder registering the "avif" format with image.RegisterFormat is imported, such as
+// github.com/gen2brain/avif. The images of the formats without encoder, see
+// RegisterEncoder, are transcoded when modified, see Options.Format.
+
+// The default limits of Options.
+const (
+	DefaultMaxSize   = 16 << 20
+	DefaultMaxPixels = 40 << 20
+)
+
+// Options configures HandleImageWithOptions.
+type Options struct {
+	// MaxSize is the size above which image bodies are passed through unmodified,
+	// without being buffered entirely, DefaultMaxSize if zero
+	MaxSize int64
+	// MaxPixels is the number of pixels above which images are passed through
+	// without being decoded, DefaultMaxPixels if zero
+	MaxPixels int
+	// Format, if set, returns the format, "jpeg", "png" or one of RegisterEncoder, an
+	// image of format from is sent as, or "auto" to let the handler choose between the
+	// formats of the standard library, e.g. for the clients not supporting from. The image is
+	// sent unmodified if it returns "" and f is nil. See CompatibleFormat. The responses
+	// it is called for get a "Vary: Accept" header.
+	Format func(from string, ctx *ProxyCtx) string
+	// JPEGQuality is the quality of encoded JPEG images, jpeg.DefaultQuality if zero
+	JPEGQuality int
+}
+
+// CompatibleFormat is an Options.Format transcoding WebP and AVIF images to JPEG, or
+// to PNG if they are transparent, for the clients which do not announce their support
+// in their Accept header, such as old browsers.
+func CompatibleFormat(from string, ctx *ProxyCtx) string {
+	if from != "webp" && from != "avif" {
+		return ""
+	}
+	if ctx.Req != nil && strings.Contains(ctx.Req.Header.Get("Accept"), "image/"+from) {
+		return ""
+	}
+	return "auto"
+}
+
+// encoder encodes images in a format registered with RegisterEncoder
+type encoder struct {
+	contentType string
+	encode      func(w io.Writer, img image.Image) error
+}
+
+// encodable are the formats encoded with the standard library, and their content type
+var encodable = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// encoders are the formats registered with RegisterEncoder
+var encoders = map[string]encoder{}
+
+// RegisterEncoder registers the encoder of the images of format, the name returned by
+// image.DecodeConfig for this format, sent with contentType. The modified images of
+// format are then encoded in their own format, and Options.Format may return it.
+// Like image.RegisterFormat, it is meant to be called by the init function of the
+// packages providing the encoder, before the handlers run.
+//
+//	goproxy_image.RegisterEncoder("avif", "image/avif", func(w io.Writer, img image.Image) error {
+//		return avif.Encode(w, img)
+//	})
+func RegisterEncoder(format, contentType string, encode func(w io.Writer, img image.Image) error) {
+	encoders[format] = encoder{contentType, encode}
+}
 
 func HandleImage(f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler {
+	return HandleImageWithOptions(Options{}, f)
+}
+
+// HandleImageWithOptions returns a RespHandler modifying the images of the responses
+// with f, if not nil, and transcoding them as configured by opts. Images too large, or
+// which cannot be decoded, are passed through unmodified.
+//
+//	proxy.OnResponse().Do(goproxy_image.HandleImageWithOptions(goproxy_image.Options{Format: goproxy_image.CompatibleFormat}, nil))
+func HandleImageWithOptions(opts Options, f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler {
+	maxSize := opts.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	maxPixels := opts.MaxPixels
+	if maxPixels == 0 {
+		maxPixels = DefaultMaxPixels
+	}
 	return FuncRespHandler(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
 		if !RespIsImage.HandleResp(resp, ctx) {
 			return resp
@@ -29,50 +122,131 @@ func HandleImage(f func(img image.Image, ctx *ProxyCtx) image.Image) RespHandler
 			// we might get 304 - not modified response without data
 			return resp
 		}
-		contentType := resp.Header.Get("Content-Type")
+		if resp.ContentLength > maxSize {
+			ctx.Logf("Image of %d bytes is too large, passing it through", resp.ContentLength)
+			return resp
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+		if int64(len(data)) > maxSize || err != nil {
+			ctx.Logf("Image is too large or cannot be read, passing it through: %v", err)
+			resp.Body = &struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(data), &errReader{resp.Body, err}), resp.Body}
+			return resp
+		}
+		resp.Body.Close()
+		original := func() *http.Response {
+			resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+			return resp
+		}
 
-		const kb = 1024
-		regret := regretable.NewRegretableReaderCloserSize(resp.Body, 16*kb)
-		resp.Body = regret
-		img, imgType, err := image.Decode(resp.Body)
+		config, imgType, err := image.DecodeConfig(bytes.NewReader(data))
 		if err != nil {
-			regret.Regret()
-			ctx.Warnf("%s: %s", ctx.Req.Method+" "+ctx.Req.URL.String()+" Image from "+ctx.Req.RequestURI+"content type"+
-				contentType+"cannot be decoded returning original image", err)
-			return resp
+			ctx.Warnf("%s %s: image of content type %q cannot be decoded, returning original image: %v",
+				ctx.Req.Method, ctx.Req.URL, resp.Header.Get("Content-Type"), err)
+			return original()
 		}
-		result := f(img, ctx)
-		buf := bytes.NewBuffer([]byte{})
-		switch contentType {
-		// No gif image encoder in go - convert to png
-		case "image/gif", "image/png":
-			if err := png.Encode(buf, result); err != nil {
-				ctx.Warnf("Cannot encode image, returning orig %v %v", ctx.Req.URL.String(), err)
-				return resp
-			}
-			resp.Header.Set("Content-Type", "image/png")
-		case "image/jpeg", "image/pjpeg":
-			if err := jpeg.Encode(buf, result, nil); err != nil {
-				ctx.Warnf("Cannot encode image, returning orig %v %v", ctx.Req.URL.String(), err)
-				return resp
-			}
-		case "application/octet-stream":
-			switch imgType {
-			case "jpeg":
-				if err := jpeg.Encode(buf, result, nil); err != nil {
-					ctx.Warnf("Cannot encode image as jpeg, returning orig %v %v", ctx.Req.URL.String(), err)
-					return resp
-				}
-			case "png", "gif":
-				if err := png.Encode(buf, result); err != nil {
-					ctx.Warnf("Cannot encode image as png, returning orig %v %v", ctx.Req.URL.String(), err)
-					return resp
-				}
+		// in int64, not to overflow on 32 bit platforms
+		if int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+			ctx.Logf("Image of %dx%d pixels is too large, passing it through", config.Width, config.Height)
+			return original()
+		}
+		format := ""
+		if opts.Format != nil {
+			format = opts.Format(imgType, ctx)
+			addVary(resp.Header, "Accept")
+		}
+		if f == nil && format == "" {
+			return original()
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			ctx.Warnf("%s %s: image cannot be decoded, returning original image: %v", ctx.Req.Method, ctx.Req.URL, err)
+			return original()
+		}
+		if f != nil {
+			img = f(img, ctx)
+		}
+		if format == "" || format == "auto" {
+			format = outputFormat(imgType, img, format == "")
+		}
+		var buf bytes.Buffer
+		switch format {
+		// gif images are converted to png, as before
+		case "png", "gif":
+			format = "png"
+			err = png.Encode(&buf, img)
+		case "jpeg":
+			quality := opts.JPEGQuality
+			if quality == 0 {
+				quality = jpeg.DefaultQuality
 			}
+			err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
 		default:
-			panic("unhandlable type" + contentType)
+			e, ok := encoders[format]
+			if !ok {
+				ctx.Warnf("Cannot encode image as %q, returning original image", format)
+				return original()
+			}
+			err = e.encode(&buf, img)
+		}
+		if err != nil {
+			ctx.Warnf("Cannot encode image, returning orig %v %v", ctx.Req.URL.String(), err)
+			return original()
 		}
-		resp.Body = ioutil.NopCloser(buf)
+		contentType, ok := encodable[format]
+		if !ok {
+			contentType = encoders[format].contentType
+		}
+		// the validators and length of the original image do not match the new one
+		resp.Header.Del("ETag")
+		resp.Header.Del("Content-MD5")
+		resp.Header.Set("Content-Type", contentType)
+		resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+		resp.ContentLength = int64(buf.Len())
+		resp.Body = ioutil.NopCloser(&buf)
 		return resp
 	})
 }
+
+// outputFormat returns the format a modified image of format from is encoded in: its
+// own format if the standard library, or if registered is set RegisterEncoder, can
+// encode it.
+func outputFormat(from string, img image.Image, registered bool) string {
+	if _, ok := encodable[from]; ok || from == "gif" {
+		return from
+	}
+	if _, ok := encoders[from]; ok && registered {
+		return from
+	}
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return "jpeg"
+	}
+	return "png"
+}
+
+// addVary adds name to the Vary header h, unless it is already listed.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// errReader reads r, unless reading its first bytes failed with err
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,128 @@
+package goproxy_image_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	goproxy_image "github.com/mixcode/goproxy/ext/image"
+)
+
+// a transparent 1x1 lossless WebP image
+var webpImage, _ = base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+
+// a fake AVIF image, decoded by the "avif" format registered by init as an opaque
+// 1x1 image, and encoded by its encoder
+var avifImage = []byte("\x00\x00\x00\x1cftypavif")
+
+func init() {
+	image.RegisterFormat("avif", "????ftypavif", func(r io.Reader) (image.Image, error) {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, color.White)
+		return img, nil
+	}, func(r io.Reader) (image.Config, error) {
+		return image.Config{ColorModel: color.RGBAModel, Width: 1, Height: 1}, nil
+	})
+}
+
+var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", `"original"`)
+	if r.URL.Path == "/avif" {
+		w.Header().Set("Content-Type", "image/avif")
+		w.Write(avifImage)
+		return
+	}
+	w.Header().Set("Content-Type", "image/webp")
+	w.Write(webpImage)
+}))
+
+func fetch(t *testing.T, opts goproxy_image.Options, accept string) (string, []byte) {
+	resp, b := fetchPath(t, opts, "/", accept)
+	return resp.Header.Get("Content-Type"), b
+}
+
+func fetchPath(t *testing.T, opts goproxy_image.Options, path, accept string) (*http.Response, []byte) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse().Do(goproxy_image.HandleImageWithOptions(opts, nil))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	req, _ := http.NewRequest("GET", backend.URL+path, nil)
+	req.Header.Set("Accept", accept)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, b
+}
+
+func TestCompatibleFormat(t *testing.T) {
+	opts := goproxy_image.Options{Format: goproxy_image.CompatibleFormat}
+	if contentType, b := fetch(t, opts, "image/webp,*/*"); contentType != "image/webp" || string(b) != string(webpImage) {
+		t.Errorf("Expected the original image for a client accepting WebP, got %s", contentType)
+	}
+	contentType, b := fetch(t, opts, "image/png,*/*")
+	if contentType != "image/png" {
+		t.Fatalf("Expected the transparent WebP image to be transcoded to PNG, got %s", contentType)
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil || format != "png" || config.Width != 1 || config.Height != 1 {
+		t.Errorf("Unexpected transcoded image %s %+v %v", format, config, err)
+	}
+
+	opts.MaxSize = 8
+	if contentType, b := fetch(t, opts, "image/png,*/*"); contentType != "image/webp" || string(b) != string(webpImage) {
+		t.Errorf("Expected an image above MaxSize to be passed through, got %s", contentType)
+	}
+	opts.MaxSize, opts.MaxPixels = 0, -1
+	if contentType, _ := fetch(t, opts, "image/png,*/*"); contentType != "image/webp" {
+		t.Errorf("Expected an image above MaxPixels to be passed through, got %s", contentType)
+	}
+}
+
+func TestAVIF(t *testing.T) {
+	opts := goproxy_image.Options{Format: goproxy_image.CompatibleFormat}
+	resp, b := fetchPath(t, opts, "/avif", "image/avif,*/*")
+	if resp.Header.Get("Content-Type") != "image/avif" || string(b) != string(avifImage) || resp.Header.Get("ETag") == "" {
+		t.Errorf("Expected the original image for a client accepting AVIF, got %s", resp.Header.Get("Content-Type"))
+	}
+	if vary := resp.Header.Get("Vary"); vary != "Accept" {
+		t.Errorf("Expected the response to vary on Accept, got %q", vary)
+	}
+	resp, b = fetchPath(t, opts, "/avif", "image/png,*/*")
+	if resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("Expected the opaque AVIF image to be transcoded to JPEG, got %s", resp.Header.Get("Content-Type"))
+	}
+	if resp.Header.Get("ETag") != "" || resp.ContentLength != int64(len(b)) {
+		t.Errorf("Expected the ETag and length of the original image to be removed, got %q %d", resp.Header.Get("ETag"), resp.ContentLength)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(b)); err != nil || format != "jpeg" {
+		t.Errorf("Unexpected transcoded image %s %v", format, err)
+	}
+
+	goproxy_image.RegisterEncoder("avif", "image/avif", func(w io.Writer, img image.Image) error {
+		_, err := w.Write(append(avifImage, "encoded"...))
+		return err
+	})
+	if resp, _ := fetchPath(t, opts, "/avif", "image/png,*/*"); resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Expected the AVIF image to be transcoded for a client not accepting AVIF, got %s", resp.Header.Get("Content-Type"))
+	}
+	opts.Format = func(from string, ctx *goproxy.ProxyCtx) string { return "avif" }
+	if resp, b := fetchPath(t, opts, "/", "*/*"); resp.Header.Get("Content-Type") != "image/avif" || !bytes.HasSuffix(b, []byte("encoded")) {
+		t.Errorf("Expected the WebP image to be encoded with the registered encoder, got %s", resp.Header.Get("Content-Type"))
+	}
+}
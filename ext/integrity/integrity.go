@@ -0,0 +1,257 @@
+// Package integrity verifies the responses of configured origins before they reach the
+// clients, with their Content-Digest or signature headers or with pinned Subresource
+// Integrity hashes, e.g. when the proxy goes through untrusted upstream proxies:
+//
+//	integrity.Install(proxy, integrity.All(
+//		integrity.ContentDigest{},
+//		&integrity.Ed25519Signature{Header: "X-Body-Signature", Keys: keys},
+//	), goproxy.ReqHostIs("updates.example.com:443"))
+//
+// The responses failing verification are replaced with 502 Bad Gateway. The bodies are
+// read whole before being verified, so that no tampered byte reaches the client.
+package integrity
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MaxBodySize is the size of the largest body verified, larger responses fail
+// verification.
+const MaxBodySize = 32 << 20
+
+// Verifier checks the integrity of a response, given its whole body.
+type Verifier interface {
+	Verify(resp *http.Response, body []byte) error
+}
+
+// VerifierFunc is a function implementing Verifier.
+type VerifierFunc func(resp *http.Response, body []byte) error
+
+func (f VerifierFunc) Verify(resp *http.Response, body []byte) error {
+	return f(resp, body)
+}
+
+// All returns a Verifier requiring all of verifiers to succeed.
+func All(verifiers ...Verifier) Verifier {
+	return VerifierFunc(func(resp *http.Response, body []byte) error {
+		for _, v := range verifiers {
+			if err := v.Verify(resp, body); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Install verifies with v the responses to the requests of proxy matching conds.
+func Install(proxy *goproxy.ProxyHttpServer, v Verifier, conds ...goproxy.ReqCondition) {
+	const verifiedKey = "integrity.verified"
+	proxy.OnRequest(conds...).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.ReqData.Set(verifiedKey, true)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if _, ok := ctx.ReqData.Get(verifiedKey); !ok || resp == nil {
+			return resp
+		}
+		ctx.ReqData.Delete(verifiedKey)
+		if err := verify(v, resp, ctx); err != nil {
+			ctx.Warnf("Response of %s fails integrity verification: %v", ctx.Req.URL, err)
+			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Response integrity verification failed")
+		}
+		return resp
+	})
+}
+
+func verify(v Verifier, resp *http.Response, ctx *goproxy.ProxyCtx) error {
+	if resp.StatusCode == http.StatusNotModified || ctx.Req.Method == http.MethodHead {
+		return nil
+	}
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(resp.Body, MaxBodySize+1))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		if len(body) > MaxBodySize {
+			return errors.New("body too large to be verified")
+		}
+	}
+	return v.Verify(resp, body)
+}
+
+// digests are the hashes of Content-Digest and Digest, and the SRI ones
+var digests = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+	"sha256":  sha256.New,
+	"sha384":  sha512.New384,
+	"sha512":  sha512.New,
+}
+
+func digestMatches(algorithm, encoded string, body []byte) (known bool, ok bool) {
+	newHash, known := digests[strings.ToLower(algorithm)]
+	if !known {
+		return false, false
+	}
+	expected, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return true, false
+	}
+	h := newHash()
+	h.Write(body)
+	return true, subtle.ConstantTimeCompare(h.Sum(nil), expected) == 1
+}
+
+// ContentDigest verifies the SHA-256 and SHA-512 digests of the Content-Digest header
+// (RFC 9530), or else of the Digest header (RFC 3230), of the responses.
+//
+// The digests are computed over the body as received, the transport of the proxy must
+// not decompress it, see http.Transport.DisableCompression: the responses it
+// decompressed fail verification.
+type ContentDigest struct {
+	// Optional accepts the responses without digest, or with digests of unknown
+	// algorithms only
+	Optional bool
+}
+
+func (d ContentDigest) Verify(resp *http.Response, body []byte) error {
+	type digest struct{ algorithm, value string }
+	var found []digest
+	if values := resp.Header.Values("Content-Digest"); len(values) > 0 {
+		for _, value := range values {
+			for _, member := range strings.Split(value, ",") {
+				kv := strings.SplitN(strings.TrimSpace(member), "=", 2)
+				if len(kv) == 2 {
+					found = append(found, digest{kv[0], strings.Trim(kv[1], ":")})
+				}
+			}
+		}
+	} else {
+		for _, value := range resp.Header.Values("Digest") {
+			for _, member := range strings.Split(value, ",") {
+				kv := strings.SplitN(strings.TrimSpace(member), "=", 2)
+				if len(kv) == 2 {
+					found = append(found, digest{kv[0], kv[1]})
+				}
+			}
+		}
+	}
+	if len(found) > 0 && resp.Uncompressed {
+		return errors.New("cannot verify the digest of a response decompressed by the transport")
+	}
+	verified := false
+	for _, f := range found {
+		known, ok := digestMatches(f.algorithm, f.value, body)
+		if known && !ok {
+			return fmt.Errorf("%s digest mismatch", f.algorithm)
+		}
+		verified = verified || ok
+	}
+	if !verified && !d.Optional {
+		return errors.New("no digest to verify")
+	}
+	return nil
+}
+
+// Pinned verifies the bodies of the responses against the Subresource Integrity
+// metadata of their URL, e.g. "sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC".
+// One of the hashes of the strongest algorithm given must match. The responses of URLs
+// without metadata are accepted.
+type Pinned map[string]string
+
+func (p Pinned) Verify(resp *http.Response, body []byte) error {
+	if resp.Request == nil {
+		return errors.New("response without request")
+	}
+	metadata, ok := p[resp.Request.URL.String()]
+	if !ok {
+		return nil
+	}
+	strongest, matched := "", false
+	rank := map[string]int{"sha256": 1, "sha384": 2, "sha512": 3}
+	for _, item := range strings.Fields(metadata) {
+		kv := strings.SplitN(item, "-", 2)
+		algorithm := strings.ToLower(kv[0])
+		if len(kv) != 2 || rank[algorithm] == 0 {
+			continue
+		}
+		// SRI options after '?' are ignored
+		value := strings.SplitN(kv[1], "?", 2)[0]
+		if rank[algorithm] > rank[strongest] {
+			strongest, matched = algorithm, false
+		}
+		if algorithm == strongest && !matched {
+			_, matched = digestMatches(algorithm, value, body)
+		}
+	}
+	if strongest == "" {
+		return fmt.Errorf("no valid integrity metadata for %s", resp.Request.URL)
+	}
+	if !matched {
+		return fmt.Errorf("%s integrity mismatch", strongest)
+	}
+	return nil
+}
+
+// Ed25519Signature verifies the Ed25519 signature of the bodies, sent base64-encoded in
+// Header, with one of Keys.
+type Ed25519Signature struct {
+	Header string
+	Keys   []ed25519.PublicKey
+}
+
+func (s *Ed25519Signature) Verify(resp *http.Response, body []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(resp.Header.Get(s.Header))
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return errors.New("missing or malformed " + s.Header + " signature")
+	}
+	for _, key := range s.Keys {
+		if ed25519.Verify(key, body, signature) {
+			return nil
+		}
+	}
+	return errors.New("bad " + s.Header + " signature")
+}
+
+// HMACSignature verifies the HMAC of the bodies, sent base64-encoded in Header.
+type HMACSignature struct {
+	Header string
+	Key    []byte
+	// Hash is sha256.New if nil
+	Hash func() hash.Hash
+}
+
+func (s *HMACSignature) Verify(resp *http.Response, body []byte) error {
+	signature, err := base64.StdEncoding.DecodeString(resp.Header.Get(s.Header))
+	if err != nil || len(signature) == 0 {
+		return errors.New("missing or malformed " + s.Header + " signature")
+	}
+	newHash := s.Hash
+	if newHash == nil {
+		newHash = sha256.New
+	}
+	mac := hmac.New(newHash, s.Key)
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("bad " + s.Header + " signature")
+	}
+	return nil
+}
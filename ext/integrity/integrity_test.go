@@ -0,0 +1,102 @@
+package integrity_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/integrity"
+)
+
+func TestInstall(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	body := []byte("package contents")
+	sum := sha256.Sum256(body)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, body))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tampered":
+			w.Header().Set("Content-Digest", "sha-256=:"+digest+":")
+			w.Header().Set("X-Body-Signature", signature)
+			w.Write([]byte("malicious contents"))
+			return
+		case "/unsigned":
+			w.Header().Set("Content-Digest", "sha-256=:"+digest+":")
+		case "/legacy":
+			w.Header().Set("Digest", "SHA-256="+digest)
+			w.Header().Set("X-Body-Signature", signature)
+		case "/plain":
+		default:
+			w.Header().Set("Content-Digest", "sha-256=:"+digest+":, unknown=:AAAA:")
+			w.Header().Set("X-Body-Signature", signature)
+		}
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	integrity.Install(proxy, integrity.All(
+		integrity.ContentDigest{},
+		&integrity.Ed25519Signature{Header: "X-Body-Signature", Keys: []ed25519.PublicKey{public}},
+	), goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.URL.Path != "/plain"
+	}))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	for path, status := range map[string]int{
+		"/":         200,
+		"/legacy":   200,
+		"/plain":    200,
+		"/tampered": http.StatusBadGateway,
+		"/unsigned": http.StatusBadGateway,
+	} {
+		resp, err := client.Get(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: expected %d, got %d %q", path, status, resp.StatusCode, b)
+		}
+		if status == 200 && string(b) != string(body) {
+			t.Errorf("%s: unexpected body %q", path, b)
+		}
+	}
+}
+
+func TestPinned(t *testing.T) {
+	body := []byte("alert(1)")
+	sum := sha512.Sum384(body)
+	good := "sha384-" + base64.StdEncoding.EncodeToString(sum[:])
+	weak := sha256.Sum256([]byte("other"))
+	resp := &http.Response{Request: &http.Request{URL: &url.URL{Scheme: "https", Host: "cdn.example.com", Path: "/lib.js"}}}
+	for metadata, ok := range map[string]bool{
+		good: true,
+		"sha256-" + base64.StdEncoding.EncodeToString(weak[:]) + " " + good: true,
+		"sha384-AAAA " + good + "?opt":                                      true,
+		"sha512-AAAA " + good:                                               false,
+		"md5-AAAA":                                                          false,
+	} {
+		pins := integrity.Pinned{"https://cdn.example.com/lib.js": metadata}
+		if err := pins.Verify(resp, body); (err == nil) != ok {
+			t.Errorf("%q: expected success %v, got %v", metadata, ok, err)
+		}
+	}
+	if err := (integrity.Pinned{}).Verify(resp, []byte(strings.Repeat("x", 10))); err != nil {
+		t.Error("Expected URLs without metadata to be accepted, got", err)
+	}
+}
@@ -0,0 +1,250 @@
+// Package jsonbody matches the requests and responses of the proxy on the values of
+// their JSON bodies, and patches these bodies:
+//
+//	proxy.OnResponse(jsonbody.RespIs("user.role", "guest")).Do(jsonbody.PatchResponse(jsonbody.JSONPatch{
+//		{Op: "replace", Path: "/user/role", Value: "admin"},
+//	}))
+//
+// The bodies are read whole, up to MaxBodySize, and decompressed if needed. A patched
+// body is sent uncompressed, with its Content-Length and without the digests of the
+// original body.
+package jsonbody
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MaxBodySize is the size of the largest body parsed, larger bodies are left alone.
+const MaxBodySize = 8 << 20
+
+// message gives access to the body of a request or a response
+type message struct {
+	header           http.Header
+	body             *io.ReadCloser
+	contentLength    *int64
+	transferEncoding *[]string
+	data             *goproxy.Data
+	key              string
+}
+
+func requestMessage(req *http.Request, ctx *goproxy.ProxyCtx) message {
+	return message{req.Header, &req.Body, &req.ContentLength, &req.TransferEncoding, ctx.ReqData, "jsonbody.request"}
+}
+
+func responseMessage(resp *http.Response, ctx *goproxy.ProxyCtx) message {
+	return message{resp.Header, &resp.Body, &resp.ContentLength, &resp.TransferEncoding, ctx.ReqData, "jsonbody.response"}
+}
+
+// parsed is the document of a body, once parsed
+type parsed struct {
+	body io.ReadCloser
+	doc  interface{}
+	ok   bool
+}
+
+// isJSON tells whether a media type is JSON: application/json or a +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	var r io.Reader
+	var err error
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return data, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(data))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		return nil, errUnsupportedEncoding
+	}
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(r, MaxBodySize))
+}
+
+var errUnsupportedEncoding = errors.New("jsonbody: unsupported Content-Encoding")
+
+// document returns the document of the body of m, reading it the first time. The
+// bytes read are put back in front of the body.
+func (m message) document() (interface{}, bool) {
+	if v, ok := m.data.Get(m.key); ok {
+		if p := v.(*parsed); p.body == *m.body {
+			return p.doc, p.ok
+		}
+	}
+	if *m.body == nil || *m.body == http.NoBody || !isJSON(m.header.Get("Content-Type")) {
+		return nil, false
+	}
+	body := *m.body
+	buf := make([]byte, MaxBodySize+1)
+	n, err := io.ReadFull(body, buf)
+	*m.body = &peekedBody{io.MultiReader(bytes.NewReader(buf[:n]), &errReader{body, err}), body}
+	p := &parsed{body: *m.body}
+	if n <= MaxBodySize && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		if data, err := decompress(m.header.Get("Content-Encoding"), buf[:n]); err == nil {
+			p.doc, err = decode(data)
+			p.ok = err == nil
+		}
+	}
+	m.data.Set(m.key, p)
+	return p.doc, p.ok
+}
+
+// replace replaces the body of m with doc.
+func (m message) replace(doc interface{}) error {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(doc); err != nil {
+		return err
+	}
+	data := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	(*m.body).Close()
+	*m.body = io.NopCloser(bytes.NewReader(data))
+	*m.contentLength = int64(len(data))
+	*m.transferEncoding = nil
+	for _, h := range []string{"Content-Encoding", "Transfer-Encoding", "Content-MD5", "Digest", "Content-Digest", "Repr-Digest"} {
+		m.header.Del(h)
+	}
+	m.header.Set("Content-Length", strconv.Itoa(len(data)))
+	m.data.Set(m.key, &parsed{body: *m.body, doc: doc, ok: true})
+	return nil
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// errReader reads r, unless reading its first bytes failed with err
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err != nil && r.err != io.EOF && r.err != io.ErrUnexpectedEOF {
+		return 0, r.err
+	}
+	return r.r.Read(p)
+}
+
+// RequestDocument returns the JSON document of the body of req, and whether the body
+// is JSON. The document is shared by the handlers of the request, and must not be
+// changed but with PatchRequest.
+func RequestDocument(req *http.Request, ctx *goproxy.ProxyCtx) (interface{}, bool) {
+	return requestMessage(req, ctx).document()
+}
+
+// ResponseDocument returns the JSON document of the body of resp, and whether the
+// body is JSON. The document is shared by the handlers of the response, and must not
+// be changed but with PatchResponse.
+func ResponseDocument(resp *http.Response, ctx *goproxy.ProxyCtx) (interface{}, bool) {
+	if resp == nil {
+		return nil, false
+	}
+	return responseMessage(resp, ctx).document()
+}
+
+// matches tells whether the value at path in doc is one of values, or exists if
+// values is empty.
+func matches(doc interface{}, ok bool, path string, values []interface{}) bool {
+	if !ok {
+		return false
+	}
+	v, ok := Get(doc, path)
+	if !ok || len(values) == 0 {
+		return ok
+	}
+	for _, value := range values {
+		if value, err := normalize(value); err == nil && equal(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReqHas returns a ReqCondition testing whether the JSON body of the request has a
+// value at path, see Get for the syntax of paths.
+func ReqHas(path string) goproxy.ReqConditionFunc {
+	return ReqIs(path)
+}
+
+// ReqIs returns a ReqCondition testing whether the value at path in the JSON body of
+// the request is equal to one of values, once encoded in JSON.
+func ReqIs(path string, values ...interface{}) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		doc, ok := RequestDocument(req, ctx)
+		return matches(doc, ok, path, values)
+	}
+}
+
+// RespHas returns a RespCondition testing whether the JSON body of the response has a
+// value at path.
+func RespHas(path string) goproxy.RespConditionFunc {
+	return RespIs(path)
+}
+
+// RespIs returns a RespCondition testing whether the value at path in the JSON body of
+// the response is equal to one of values, once encoded in JSON.
+func RespIs(path string, values ...interface{}) goproxy.RespConditionFunc {
+	return func(resp *http.Response, ctx *goproxy.ProxyCtx) bool {
+		doc, ok := ResponseDocument(resp, ctx)
+		return matches(doc, ok, path, values)
+	}
+}
+
+// apply patches the body of m, leaving it unchanged if p fails.
+func apply(m message, p Patch, ctx *goproxy.ProxyCtx) {
+	doc, ok := m.document()
+	if !ok {
+		return
+	}
+	// p gets its own copy, which it may change in place
+	doc, err := normalize(doc)
+	if err == nil {
+		doc, err = p.Apply(doc)
+	}
+	if err == nil {
+		err = m.replace(doc)
+	}
+	if err != nil {
+		ctx.Logf("Not patching JSON body of %s: %v", ctx.Req.URL, err)
+	}
+}
+
+// PatchRequest returns a ReqHandler applying p to the JSON bodies of the requests.
+// The requests without JSON body are left alone.
+func PatchRequest(p Patch) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		apply(requestMessage(req, ctx), p, ctx)
+		return req, nil
+	})
+}
+
+// PatchResponse returns a RespHandler applying p to the JSON bodies of the responses.
+// The responses without JSON body are left alone.
+func PatchResponse(p Patch) goproxy.RespHandler {
+	return goproxy.FuncRespHandler(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp != nil {
+			apply(responseMessage(resp, ctx), p, ctx)
+		}
+		return resp
+	})
+}
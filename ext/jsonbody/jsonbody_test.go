@@ -0,0 +1,155 @@
+package jsonbody_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/jsonbody"
+)
+
+func decode(t *testing.T, s string) interface{} {
+	d := json.NewDecoder(bytes.NewReader([]byte(s)))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func encode(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func TestGet(t *testing.T) {
+	doc := decode(t, `{"name": {"first": "Tom", "last": "Anderson"}, "a.b": 1, "friends": [{"first": "Dale", "nets": ["ig"]}, {"first": "Roger"}]}`)
+	for path, expected := range map[string]string{
+		"name.last":        `"Anderson"`,
+		"friends.1.first":  `"Roger"`,
+		"friends.#":        `2`,
+		"friends.#.first":  `["Dale","Roger"]`,
+		"friends.#.nets.0": `["ig"]`,
+		"na*.fir?t":        `"Tom"`,
+		`a\.b`:             `1`,
+		"friends.2":        "",
+		"name.first.x":     "",
+		"name.middle":      "",
+	} {
+		v, ok := jsonbody.Get(doc, path)
+		if got := encode(v); ok != (expected != "") || (ok && got != expected) {
+			t.Errorf("%s: expected %s, got %s %v", path, expected, got, ok)
+		}
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, c := range []struct {
+		doc, patch, expected string
+	}{
+		// examples of RFC 6902 appendix A
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo":"bar"}`},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, ""},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`, `{"foo":["bar",["abc","def"]]}`},
+		{`{"/": 9, "~1": 10}`, `[{"op": "copy", "from": "/~01", "path": "/~1x"}]`, `{"/":9,"/x":10,"~1":10}`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, ""},
+		{`{"a": [[1]]}`, `[{"op": "add", "path": "/a/0/0", "value": 0}]`, `{"a":[[0,1]]}`},
+		// failed patches leave the document unchanged
+		{`{"a": 1}`, `[{"op": "remove", "path": "/a"}, {"op": "remove", "path": "/b"}]`, ""},
+	} {
+		patch, err := jsonbody.ParseJSONPatch([]byte(c.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := decode(t, c.doc)
+		v, err := patch.Apply(doc)
+		if got := encode(v); (c.expected == "") != (err != nil) || (err == nil && got != c.expected) {
+			t.Errorf("%s %s: expected %s, got %s %v", c.doc, c.patch, c.expected, got, err)
+		}
+		if err != nil && encode(doc) != encode(decode(t, c.doc)) {
+			t.Errorf("%s %s: the document was changed to %s", c.doc, c.patch, encode(doc))
+		}
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// example of RFC 7396
+	patch, err := jsonbody.ParseMergePatch([]byte(`{"title": "Hello!", "author": {"familyName": null}, "phoneNumber": "+01-123-456-7890", "tags": ["example"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := patch.Apply(decode(t, `{"title": "Goodbye!", "author": {"givenName": "John", "familyName": "Doe"}, "tags": ["example", "sample"], "content": "This will be unchanged"}`))
+	expected := `{"author":{"givenName":"John"},"content":"This will be unchanged","phoneNumber":"+01-123-456-7890","tags":["example"],"title":"Hello!"}`
+	if got := encode(v); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Content-Encoding", r.Header.Get("Content-Encoding"))
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(jsonbody.ReqHas("user.id")).Do(jsonbody.PatchRequest(jsonbody.JSONPatch{
+		{Op: "add", Path: "/user/roles/-", Value: "audited"},
+	}))
+	merge, _ := jsonbody.ParseMergePatch([]byte(`{"user": {"admin": false, "token": null}}`))
+	proxy.OnResponse(jsonbody.RespIs("user.admin", true)).Do(jsonbody.PatchResponse(merge))
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	for _, c := range []struct {
+		body, expected string
+		gzip           bool
+	}{
+		{`{"user": {"id": 1, "roles": ["<dev>"], "admin": true, "token": "x", "n": 1.50}}`, `{"user":{"admin":false,"id":1,"n":1.50,"roles":["<dev>","audited"]}}`, true},
+		{`{"user": {"id": 2, "roles": []}}`, `{"user":{"id":2,"roles":["audited"]}}`, false},
+		{`{"user": {"name": "x"}}`, `{"user": {"name": "x"}}`, false},
+		{`{"user": `, `{"user": `, false},
+	} {
+		body := []byte(c.body)
+		if c.gzip {
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			w.Write(body)
+			w.Close()
+			body = buf.Bytes()
+		}
+		req, _ := http.NewRequest("POST", backend.URL, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		if c.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != c.expected || resp.Header.Get("X-Content-Encoding") != "" || resp.ContentLength != int64(len(b)) {
+			t.Errorf("Expected %s, got %s %s %d", c.expected, b, resp.Header.Get("X-Content-Encoding"), resp.ContentLength)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package jsonbody
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Patch changes a document decoded from JSON.
+type Patch interface {
+	Apply(doc interface{}) (interface{}, error)
+}
+
+// PatchFunc is a function implementing Patch.
+type PatchFunc func(doc interface{}) (interface{}, error)
+
+func (f PatchFunc) Apply(doc interface{}) (interface{}, error) {
+	return f(doc)
+}
+
+// decode decodes data keeping its numbers as json.Number, so that they are written
+// back unchanged.
+func decode(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("jsonbody: data after the JSON value")
+	}
+	return v, nil
+}
+
+// normalize returns v as it would be decoded from its JSON encoding.
+func normalize(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decode(data)
+}
+
+// Operation is an operation of a JSON Patch.
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// JSONPatch is a JSON Patch (RFC 6902), applied atomically: the document is left
+// unchanged if an operation fails.
+type JSONPatch []Operation
+
+// ParseJSONPatch parses a JSON Patch document.
+func ParseJSONPatch(data []byte) (JSONPatch, error) {
+	v, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	ops, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("jsonbody: a JSON Patch must be an array")
+	}
+	patch := make(JSONPatch, 0, len(ops))
+	for _, op := range ops {
+		fields, ok := op.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("jsonbody: a JSON Patch operation must be an object")
+		}
+		o := Operation{Value: fields["value"]}
+		o.Op, _ = fields["op"].(string)
+		o.Path, _ = fields["path"].(string)
+		o.From, _ = fields["from"].(string)
+		if _, ok := fields["value"]; !ok && (o.Op == "add" || o.Op == "replace" || o.Op == "test") {
+			return nil, fmt.Errorf("jsonbody: %s operation without value", o.Op)
+		}
+		patch = append(patch, o)
+	}
+	return patch, nil
+}
+
+func (p JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	// operations change the document in place, they are applied to a copy
+	doc, err := normalize(doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range p {
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("jsonbody: %s %s: %v", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add":
+		value, err := normalize(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err = remove(doc, path)
+		return doc, err
+	case "replace":
+		value, err := normalize(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		if doc, _, err = remove(doc, path); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if op.Op == "move" {
+			if len(path) > len(from) && reflect.DeepEqual(path[:len(from)], from) {
+				return nil, errors.New("cannot move a value into itself")
+			}
+			doc, value, err = remove(doc, from)
+		} else if value, err = pointerGet(doc, from); err == nil {
+			value, err = normalize(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "test":
+		value, err := normalize(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(actual, value) {
+			return nil, errors.New("test failed")
+		}
+		return doc, nil
+	}
+	return nil, errors.New("unknown operation")
+}
+
+// equal compares decoded JSON values, numbers by value.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, err1 := a.Float64()
+		y, err2 := b.Float64()
+		return err1 == nil && err2 == nil && x == y
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			if w, ok := b[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// parsePointer returns the reference tokens of a JSON Pointer (RFC 6901).
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON Pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > length || (i == length && !appending) {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func pointerGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			child, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			doc = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[i]
+		default:
+			return nil, fmt.Errorf("no member %q in a scalar", token)
+		}
+	}
+	return doc, nil
+}
+
+// add adds value at path in doc, returning the new document.
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	token := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[token] = value
+		return doc, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(p), true)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, nil)
+		copy(p[i+1:], p[i:])
+		p[i] = value
+		return set(doc, path[:len(path)-1], p)
+	}
+	return nil, fmt.Errorf("cannot add %q to a scalar", token)
+}
+
+// set replaces the existing value at path in doc, returning the new document.
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[path[len(path)-1]] = value
+	case []interface{}:
+		i, err := arrayIndex(path[len(path)-1], len(p), false)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = value
+	}
+	return doc, nil
+}
+
+// remove removes the value at path in doc, returning the new document and the value.
+func remove(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	token := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		value, ok := p[token]
+		if !ok {
+			return nil, nil, fmt.Errorf("no member %q", token)
+		}
+		delete(p, token)
+		return doc, value, nil
+	case []interface{}:
+		i, err := arrayIndex(token, len(p), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := p[i]
+		p = append(p[:i:i], p[i+1:]...)
+		doc, err = set(doc, path[:len(path)-1], p)
+		return doc, value, err
+	}
+	return nil, nil, fmt.Errorf("no member %q in a scalar", token)
+}
+
+// MergePatch is a JSON Merge Patch (RFC 7396): its members replace those of the
+// document, recursively, and its null members remove them.
+type MergePatch struct {
+	patch interface{}
+}
+
+// ParseMergePatch parses a JSON Merge Patch document.
+func ParseMergePatch(data []byte) (*MergePatch, error) {
+	v, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+	return &MergePatch{v}, nil
+}
+
+func (p *MergePatch) Apply(doc interface{}) (interface{}, error) {
+	// the document must not share the values of the patch, which is applied again
+	patch, err := normalize(p.patch)
+	if err != nil {
+		return nil, err
+	}
+	return merge(doc, patch), nil
+}
+
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge(t[k], v)
+		}
+	}
+	return t
+}
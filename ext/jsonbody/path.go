@@ -0,0 +1,130 @@
+package jsonbody
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Get returns the value at path in doc, a document decoded from JSON. Paths are
+// written like those of gjson: keys separated by dots, with dots and wildcards escaped
+// by a backslash, array indexes as keys, and # for the length of an array:
+//
+//	name.first        the first field of the name object
+//	friends.0.name    the name of the first friend
+//	friends.#         the number of friends
+//	friends.#.name    the array of the names of the friends
+//	na*.first         * and ? match any characters of the first matching key
+func Get(doc interface{}, path string) (interface{}, bool) {
+	return get(doc, splitPath(path))
+}
+
+// splitPath splits path on its unescaped dots, unescaping its components. Wildcards
+// stay escaped, to be told apart from literal characters.
+func splitPath(path string) []string {
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		switch c := path[i]; {
+		case c == '\\' && i+1 < len(path):
+			i++
+			if path[i] == '*' || path[i] == '?' || path[i] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(path[i])
+		case c == '.':
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(parts, b.String())
+}
+
+func get(v interface{}, parts []string) (interface{}, bool) {
+	if len(parts) == 0 {
+		return v, true
+	}
+	part, rest := parts[0], parts[1:]
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if !strings.ContainsAny(part, "*?") {
+			child, ok := v[unescape(part)]
+			if !ok {
+				return nil, false
+			}
+			return get(child, rest)
+		}
+		// as gjson, the first matching key in the document order wins, the keys are
+		// sorted here since the order is lost by the decoding
+		for _, k := range sortedKeys(v) {
+			if wildcardMatch(part, k) {
+				return get(v[k], rest)
+			}
+		}
+	case []interface{}:
+		if part == "#" {
+			if len(rest) == 0 {
+				return len(v), true
+			}
+			values := []interface{}{}
+			for _, e := range v {
+				if value, ok := get(e, rest); ok {
+					values = append(values, value)
+				}
+			}
+			return values, true
+		}
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return get(v[i], rest)
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unescape(part string) string {
+	return strings.NewReplacer(`\*`, "*", `\?`, "?", `\\`, `\`).Replace(part)
+}
+
+// wildcardMatch tells whether s matches pattern, where * matches any characters and ?
+// any single character, unless escaped.
+func wildcardMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if wildcardMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+		}
+		if s == "" || s[0] != pattern[0] {
+			return false
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
@@ -0,0 +1,309 @@
+// Package mirror serves a site through the proxy under another host, rewriting the
+// absolute URLs of the site in the HTML, CSS, JavaScript and JSON bodies and in the
+// Location, Set-Cookie and Content-Security-Policy headers, so that the browser stays
+// on the mirror:
+//
+//	m, err := mirror.New("https://www.example.com", "http://localhost:8080")
+//	...
+//	m.Install(proxy)
+//
+// Both the clients using the proxy and the clients connecting to it directly, as to a
+// reverse proxy, with the host of the mirror in their Host header, are served. For an
+// https mirror, the proxy must MITM the CONNECT requests to it.
+package mirror
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+const mirrorKey = "mirror.mirror"
+
+// Mirror rewrites the requests to its mirror host into requests to its origin site,
+// and their responses the other way around.
+type Mirror struct {
+	from, to *url.URL
+	// toOrigin rewrites the mirror URLs into the origin ones, and toMirror the other way
+	toOrigin, toMirror *replacer
+}
+
+// New returns a Mirror of the site from, e.g. "https://www.example.com", under the
+// scheme and host of to, e.g. "http://localhost:8080".
+func New(from, to string) (*Mirror, error) {
+	f, err := parseSite(from)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseSite(to)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		from:     f,
+		to:       t,
+		toOrigin: newReplacer(t.Host, f.Scheme+"://"+f.Host),
+		toMirror: newReplacer(f.Host, t.Scheme+"://"+t.Host),
+	}, nil
+}
+
+func parseSite(site string) (*url.URL, error) {
+	u, err := url.Parse(site)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("mirror: not an http or https site: " + site)
+	}
+	u.Host = strings.ToLower(u.Host)
+	return u, nil
+}
+
+// IsMirror returns a ReqCondition testing whether the request is sent to the host of m.
+func (m *Mirror) IsMirror() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return sameHost(req.URL.Host, m.to)
+	}
+}
+
+// sameHost returns whether host is the one of u, ignoring the default port
+func sameHost(host string, u *url.URL) bool {
+	host = strings.ToLower(host)
+	if host == u.Host {
+		return true
+	}
+	port := map[string]string{"http": ":80", "https": ":443"}[u.Scheme]
+	return strings.TrimSuffix(host, port) == strings.TrimSuffix(u.Host, port)
+}
+
+// Install registers the handlers of m on proxy, and serves the requests received
+// without absolute URL for the host of m, falling back to the previous
+// NonproxyHandler of proxy for the other ones.
+func (m *Mirror) Install(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest(m.IsMirror()).DoFunc(m.HandleRequest)
+	proxy.OnResponse().DoFunc(m.HandleResponse)
+	next := proxy.NonproxyHandler
+	proxy.NonproxyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameHost(r.Host, m.to) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		r.URL.Scheme = m.to.Scheme
+		r.URL.Host = r.Host
+		proxy.ServeHTTP(w, r)
+	})
+}
+
+// HandleRequest sends req to the origin site, rewriting its Origin and Referer headers.
+func (m *Mirror) HandleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	req.URL.Scheme = m.from.Scheme
+	req.URL.Host = m.from.Host
+	req.Host = m.from.Host
+	for _, name := range []string{"Origin", "Referer"} {
+		if v := req.Header.Get(name); v != "" {
+			req.Header.Set(name, m.toOrigin.replaceString(v))
+		}
+	}
+	// the body must not be compressed to be rewritten
+	req.Header.Del("Accept-Encoding")
+	ctx.ReqData.Set(mirrorKey, m)
+	return req, nil
+}
+
+// rewritten are the media types of the bodies rewritten
+var rewritten = goproxy.ContentTypeIs("text/html",
+	"application/xhtml+xml",
+	"text/css",
+	"text/javascript", "application/javascript", "application/x-javascript",
+	"application/json",
+	"application/manifest+json",
+	"image/svg+xml")
+
+// HandleResponse rewrites the URLs of the origin site in the response to a request
+// handled by HandleRequest.
+func (m *Mirror) HandleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if v, _ := ctx.ReqData.Get(mirrorKey); v != m || resp == nil {
+		return resp
+	}
+	for _, name := range []string{"Location", "Content-Location", "Refresh", "Link", "Access-Control-Allow-Origin"} {
+		if v := resp.Header.Get(name); v != "" {
+			resp.Header.Set(name, m.toMirror.replaceString(v))
+		}
+	}
+	for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		for i, v := range resp.Header[name] {
+			resp.Header[name][i] = m.rewriteCSP(v)
+		}
+	}
+	for i, v := range resp.Header["Set-Cookie"] {
+		resp.Header["Set-Cookie"][i] = m.rewriteCookie(v)
+	}
+
+	if resp.Body == nil || resp.Body == http.NoBody || !rewritten.HandleResp(resp, ctx) {
+		return resp
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		ctx.Warnf("Not rewriting %s body with Content-Encoding %s", ctx.Req.URL, encoding)
+		return resp
+	}
+	body := resp.Body
+	pr, pw := io.Pipe()
+	go func() {
+		err := m.toMirror.stream(pw, body)
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+	resp.Body = &rewrittenBody{pr, body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return resp
+}
+
+// rewrittenBody closes the original body with the pipe
+type rewrittenBody struct {
+	*io.PipeReader
+	original io.Closer
+}
+
+func (b *rewrittenBody) Close() error {
+	b.PipeReader.Close()
+	return b.original.Close()
+}
+
+// rewriteCSP replaces the origin host in the sources of a Content-Security-Policy
+// header, with or without scheme.
+func (m *Mirror) rewriteCSP(policy string) string {
+	directives := strings.Split(m.toMirror.replaceString(policy), ";")
+	for i, directive := range directives {
+		sources := strings.Fields(directive)
+		replaced := false
+		for j, source := range sources {
+			if sameHost(source, m.from) {
+				sources[j], replaced = m.to.Host, true
+			}
+		}
+		if replaced {
+			directives[i] = " " + strings.Join(sources, " ")
+		}
+	}
+	return strings.TrimSpace(strings.Join(directives, ";"))
+}
+
+// rewriteCookie removes the Domain attribute of a Set-Cookie header, making the cookie
+// valid for the mirror host only, and its Secure attribute when the mirror is served
+// over http.
+func (m *Mirror) rewriteCookie(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	kept := attrs[:1]
+	for _, attr := range attrs[1:] {
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(attr, "=", 2)[0]))
+		if name == "domain" || (name == "secure" && m.to.Scheme == "http") {
+			continue
+		}
+		kept = append(kept, attr)
+	}
+	return strings.Join(kept, ";")
+}
+
+// replacer replaces the absolute URLs of a host, in their plain, scheme-relative,
+// JavaScript-escaped and percent-encoded forms
+type replacer struct {
+	old, new []string
+	maxLen   int
+}
+
+func newReplacer(host, target string) *replacer {
+	r := &replacer{}
+	add := func(old, new string) {
+		r.old = append(r.old, old)
+		r.new = append(r.new, new)
+		if len(old) > r.maxLen {
+			r.maxLen = len(old)
+		}
+	}
+	scheme := target[:strings.Index(target, "://")]
+	targetHost := target[len(scheme)+3:]
+	for _, s := range []string{"https", "http"} {
+		add(s+"://"+host, target)
+		add(s+`:\/\/`+host, scheme+`:\/\/`+targetHost)
+		add(s+"%3A%2F%2F"+host, scheme+"%3A%2F%2F"+targetHost)
+	}
+	add("//"+host, "//"+targetHost)
+	add(`\/\/`+host, `\/\/`+targetHost)
+	return r
+}
+
+// hostByte returns whether c may continue a host name or port, in which case the
+// host found is not the one replaced, e.g. example.com.evil.net
+func hostByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '.' || c == '-' || c == ':'
+}
+
+// replace appends buf to dst with the URLs replaced, up to the point where a URL may
+// continue in the following bytes unless eof, and returns the rest of buf.
+func (r *replacer) replace(dst, buf []byte, eof bool) ([]byte, []byte) {
+	for {
+		// the bytes after a match are needed to check its end
+		limit := len(buf) - r.maxLen - 1
+		if eof {
+			limit = len(buf)
+		}
+		at, which := -1, -1
+		for i, old := range r.old {
+			j := bytes.Index(buf, []byte(old))
+			for j >= 0 && j+len(old) < len(buf) && hostByte(buf[j+len(old)]) {
+				next := bytes.Index(buf[j+1:], []byte(old))
+				if next < 0 {
+					j = -1
+				} else {
+					j += 1 + next
+				}
+			}
+			if j >= 0 && (at < 0 || j < at || j == at && len(old) > len(r.old[which])) {
+				at, which = j, i
+			}
+		}
+		if at < 0 || at > limit {
+			if limit < 0 {
+				return dst, buf
+			}
+			return append(dst, buf[:limit]...), buf[limit:]
+		}
+		dst = append(dst, buf[:at]...)
+		dst = append(dst, r.new[which]...)
+		buf = buf[at+len(r.old[which]):]
+	}
+}
+
+func (r *replacer) replaceString(s string) string {
+	out, _ := r.replace(nil, []byte(s), true)
+	return string(out)
+}
+
+// stream copies src to dst, replacing the URLs on the fly.
+func (r *replacer) stream(dst io.Writer, src io.Reader) error {
+	var (
+		buf       = make([]byte, 32*1024)
+		out, rest []byte
+		n         int
+		err       error
+	)
+	pending := 0
+	for err == nil {
+		n, err = src.Read(buf[pending:])
+		out, rest = r.replace(out[:0], buf[:pending+n], err != nil)
+		if _, werr := dst.Write(out); werr != nil {
+			return werr
+		}
+		pending = copy(buf, rest)
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package mirror_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/mirror"
+)
+
+func TestMirror(t *testing.T) {
+	var origin *httptest.Server
+	origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.SetCookie(w, &http.Cookie{Name: "a", Value: "1", Domain: "127.0.0.1", Secure: true, Path: "/"})
+			w.Header().Set("Content-Security-Policy", "default-src 'self' "+origin.URL+"; img-src "+strings.TrimPrefix(origin.URL, "http://"))
+			http.Redirect(w, r, origin.URL+"/page", http.StatusFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("X-Referer", r.Header.Get("Referer"))
+		// split the URLs across several writes
+		for _, part := range []string{
+			`<a href="` + origin.URL[:10], origin.URL[10:] + `/x">`,
+			`<script>var u = "http:\/\/` + strings.TrimPrefix(origin.URL, "http://") + `\/y";</script>`,
+			`<a href="` + origin.URL + `.evil.net/">`,
+			`<img src="//` + strings.TrimPrefix(origin.URL, "http://") + `/i.png">`,
+		} {
+			io.WriteString(w, part)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer origin.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	m, err := mirror.New(origin.URL, "http://mirror.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Install(proxy)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{
+		Transport:     &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Get("http://mirror.test/redirect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if location := resp.Header.Get("Location"); location != "http://mirror.test/page" {
+		t.Error("Unexpected Location", location)
+	}
+	if cookie := resp.Header.Get("Set-Cookie"); cookie != "a=1; Path=/" {
+		t.Error("Unexpected Set-Cookie", cookie)
+	}
+	if csp := resp.Header.Get("Content-Security-Policy"); csp != "default-src 'self' http://mirror.test; img-src mirror.test" {
+		t.Error("Unexpected Content-Security-Policy", csp)
+	}
+
+	expected := `<a href="http://mirror.test/x">` +
+		`<script>var u = "http:\/\/mirror.test\/y";</script>` +
+		`<a href="` + origin.URL + `.evil.net/">` +
+		`<img src="//mirror.test/i.png">`
+	req, _ := http.NewRequest("GET", "http://mirror.test/page", nil)
+	req.Header.Set("Referer", "http://mirror.test/from")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != expected {
+		t.Errorf("Expected %q, got %q", expected, b)
+	}
+	if referer := resp.Header.Get("X-Referer"); referer != origin.URL+"/from" {
+		t.Error("Unexpected Referer", referer)
+	}
+
+	// as a reverse proxy
+	req, _ = http.NewRequest("GET", s.URL+"/page", nil)
+	req.Host = "mirror.test"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.HasPrefix(string(b), `<a href="http://mirror.test/x">`) {
+		t.Errorf("Unexpected reverse proxy response %q", b)
+	}
+}
@@ -0,0 +1,253 @@
+// Package oauth2 attaches OAuth2 bearer tokens to the requests going through the proxy
+// to selected APIs, so that the clients of the proxy don't need to authenticate:
+//
+//	tokens := &oauth2.ClientCredentials{TokenURL: "https://auth.example.com/oauth/token", ClientID: id, ClientSecret: secret}
+//	oauth2.Install(proxy, tokens, "https://api.example.com", goproxy.ReqHostIs("api.example.com:443"))
+//
+// Tokens are cached per audience until they expire. A request answered with 401
+// Unauthorized is sent again once with a new token, if its body was small enough to
+// be kept. The requests to HTTPS APIs must be MITM'd.
+package oauth2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// TokenSource returns the access tokens for an audience.
+type TokenSource interface {
+	// Token returns a valid access token for audience.
+	Token(audience string) (string, error)
+	// Invalidate drops token, rejected by the API of audience, from the cache.
+	Invalidate(audience, token string)
+}
+
+// expiryMargin is the time before their expiry at which tokens are renewed
+const expiryMargin = 30 * time.Second
+
+// ClientCredentials is a TokenSource obtaining its tokens with the client credentials
+// grant of OAuth2 (RFC 6749 section 4.4). The audience is sent as the audience
+// parameter of the token requests, as expected by many providers, unless empty.
+type ClientCredentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// AuthInBody sends the client credentials as parameters of the token requests,
+	// rather than with Basic authentication
+	AuthInBody bool
+	// Client sends the token requests, http.DefaultClient if nil
+	Client *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+type cachedToken struct {
+	// mu serializes the renewals of the token
+	mu     sync.Mutex
+	value  string
+	expiry time.Time
+}
+
+func (c *ClientCredentials) cached(audience string) *cachedToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tokens == nil {
+		c.tokens = make(map[string]*cachedToken)
+	}
+	t, ok := c.tokens[audience]
+	if !ok {
+		t = &cachedToken{}
+		c.tokens[audience] = t
+	}
+	return t
+}
+
+func (c *ClientCredentials) Token(audience string) (string, error) {
+	t := c.cached(audience)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.value != "" && (t.expiry.IsZero() || time.Now().Before(t.expiry)) {
+		return t.value, nil
+	}
+	value, expiresIn, err := c.fetch(audience)
+	if err != nil {
+		return "", err
+	}
+	t.value, t.expiry = value, time.Time{}
+	if expiresIn > 0 {
+		t.expiry = time.Now().Add(time.Duration(expiresIn)*time.Second - expiryMargin)
+	}
+	return value, nil
+}
+
+func (c *ClientCredentials) Invalidate(audience, token string) {
+	t := c.cached(audience)
+	t.mu.Lock()
+	if t.value == token {
+		t.value = ""
+	}
+	t.mu.Unlock()
+}
+
+// tokenResponse is the response of the token endpoint
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (c *ClientCredentials) fetch(audience string) (string, int64, error) {
+	params := url.Values{"grant_type": {"client_credentials"}}
+	if len(c.Scopes) > 0 {
+		params.Set("scope", strings.Join(c.Scopes, " "))
+	}
+	if audience != "" {
+		params.Set("audience", audience)
+	}
+	if c.AuthInBody {
+		params.Set("client_id", c.ClientID)
+		params.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, c.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if !c.AuthInBody {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	var token tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil && resp.StatusCode == http.StatusOK {
+		return "", 0, fmt.Errorf("oauth2: cannot parse token response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		if token.Error != "" {
+			return "", 0, fmt.Errorf("oauth2: token request failed: %s %s %s", resp.Status, token.Error, token.ErrorDescription)
+		}
+		return "", 0, errors.New("oauth2: token request failed: " + resp.Status)
+	}
+	if token.TokenType != "" && !strings.EqualFold(token.TokenType, "bearer") {
+		return "", 0, errors.New("oauth2: unsupported token type " + token.TokenType)
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
+
+// MaxReplayedBody is the size of the largest request body kept to send the request
+// again with a new token.
+const MaxReplayedBody = 1 << 20
+
+const injectedKey = "oauth2.injected"
+
+// injected is a request a token was attached to
+type injected struct {
+	req      *http.Request
+	audience string
+	token    string
+	// body is the body of the request if it can be sent again
+	body   []byte
+	replay bool
+}
+
+// Install attaches the tokens of source for audience to the requests of proxy
+// matching conds, replacing their Authorization header.
+func Install(proxy *goproxy.ProxyHttpServer, source TokenSource, audience string, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		token, err := source.Token(audience)
+		if err != nil {
+			ctx.Warnf("Cannot get a token for %s: %v", audience, err)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot get an access token")
+		}
+		in := &injected{req: req, audience: audience, token: token, replay: true}
+		if req.Body != nil && req.Body != http.NoBody {
+			body, err := io.ReadAll(io.LimitReader(req.Body, MaxReplayedBody+1))
+			if err != nil {
+				ctx.Warnf("Cannot read the body of %s: %v", req.URL, err)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read request body")
+			}
+			if len(body) > MaxReplayedBody {
+				// too large to be kept, the request is not sent again
+				req.Body = &struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+				in.replay = false
+			} else {
+				req.Body.Close()
+				req.Body = io.NopCloser(bytes.NewReader(body))
+				in.body = body
+			}
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		ctx.ReqData.Set(injectedKey, in)
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		v, ok := ctx.ReqData.Get(injectedKey)
+		if !ok || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp
+		}
+		in := v.(*injected)
+		if in.audience != audience {
+			return resp
+		}
+		ctx.ReqData.Delete(injectedKey)
+		source.Invalidate(audience, in.token)
+		if !in.replay {
+			return resp
+		}
+		token, err := source.Token(audience)
+		if err != nil {
+			ctx.Warnf("Cannot renew the token for %s: %v", audience, err)
+			return resp
+		}
+		// keep the first response, returned if the second attempt fails, with its body
+		// truncated to 64 KiB
+		first, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(first))
+		resp.ContentLength = int64(len(first))
+		resp.TransferEncoding = nil
+		resp.Header.Set("Content-Length", strconv.Itoa(len(first)))
+		if err != nil {
+			return resp
+		}
+		ctx.Logf("Sending %s again with a new token", in.req.URL)
+		req := in.req.Clone(in.req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(in.body))
+		if in.body == nil {
+			req.Body = nil
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		again, err := ctx.RoundTrip(req)
+		if err != nil {
+			ctx.Warnf("Cannot send %s again: %v", req.URL, err)
+			return resp
+		}
+		return again
+	})
+}
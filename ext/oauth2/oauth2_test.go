@@ -0,0 +1,145 @@
+package oauth2_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/oauth2"
+)
+
+func TestInstall(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		issued    int
+		rejectAll bool
+		valid     = map[string]string{}
+		c         int
+	)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "proxy" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" || r.FormValue("scope") != "read write" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		mu.Lock()
+		issued++
+		token := fmt.Sprintf("%s-%d", r.FormValue("audience"), issued)
+		valid[r.FormValue("audience")] = token
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+	}))
+	defer auth.Close()
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		audience := strings.Trim(r.URL.Path, "/")
+		mu.Lock()
+		ok := r.Header.Get("Authorization") == "Bearer "+valid[audience] && !rejectAll
+		mu.Unlock()
+		if audience == "c" {
+			// a large rejection, then the connection is lost
+			mu.Lock()
+			c++
+			first := c == 1
+			mu.Unlock()
+			if !first {
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(100<<10))
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(make([]byte, 100<<10))
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Header.Get("Authorization"), body)
+	}))
+	defer api.Close()
+
+	tokens := &oauth2.ClientCredentials{TokenURL: auth.URL, ClientID: "proxy", ClientSecret: "s3cret", Scopes: []string{"read", "write"}}
+	proxy := goproxy.NewProxyHttpServer()
+	apiHost := strings.TrimPrefix(api.URL, "http://")
+	oauth2.Install(proxy, tokens, "a", goproxy.UrlHasPrefix(apiHost+"/a"))
+	oauth2.Install(proxy, tokens, "b", goproxy.UrlHasPrefix(apiHost+"/b"))
+	oauth2.Install(proxy, tokens, "c", goproxy.UrlHasPrefix(apiHost+"/c"))
+	var length int64
+	var lengthHeader string
+	proxy.OnResponse(goproxy.UrlHasPrefix(apiHost + "/c")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		length, lengthHeader = resp.ContentLength, resp.Header.Get("Content-Length")
+		return resp
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	post := func(path string) (int, string) {
+		resp, err := client.Post(api.URL+path, "text/plain", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Errorf("%s: cannot read the response: %v", path, err)
+		}
+		return resp.StatusCode, string(b)
+	}
+	for _, c := range []struct {
+		path, expected string
+	}{
+		{"/a", "Bearer a-1 body"},
+		{"/a", "Bearer a-1 body"},
+		{"/b", "Bearer b-2 body"},
+	} {
+		if status, body := post(c.path); status != 200 || body != c.expected {
+			t.Errorf("%s: expected %q, got %d %q", c.path, c.expected, status, body)
+		}
+	}
+
+	// the token is revoked, the request is sent again with a new one
+	mu.Lock()
+	valid["a"] = "revoked"
+	mu.Unlock()
+	if status, body := post("/a"); status != 200 || body != "Bearer a-3 body" {
+		t.Errorf("Expected the request to be sent again with a new token, got %d %q", status, body)
+	}
+	// but only once
+	mu.Lock()
+	rejectAll = true
+	mu.Unlock()
+	status, _ := post("/a")
+	mu.Lock()
+	if status != 401 || issued != 4 {
+		t.Errorf("Expected the request to be sent again once, got %d after %d tokens", status, issued)
+	}
+	rejectAll = false
+	mu.Unlock()
+
+	// the first response is returned if the second attempt fails
+	if status, body := post("/c"); status != 401 || len(body) != 64<<10 {
+		t.Errorf("Expected the first response with its body truncated, got %d with %d bytes", status, len(body))
+	}
+	if length != 64<<10 || lengthHeader != strconv.Itoa(64<<10) {
+		t.Errorf("Expected the length of the truncated body, got %d %q", length, lengthHeader)
+	}
+
+	tokens.ClientSecret = "wrong"
+	tokens.Invalidate("b", "b-2")
+	if status, _ := post("/b"); status != http.StatusBadGateway {
+		t.Error("Expected a token request failure to fail the request, got", status)
+	}
+}
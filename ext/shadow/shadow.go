@@ -0,0 +1,230 @@
+// Package shadow mirrors selected requests of the proxy to a secondary backend, e.g. to
+// shadow the production traffic to a staging environment:
+//
+//	s := &shadow.Shadow{Target: "https://staging.example.com", SampleRate: 0.1}
+//	s.Install(proxy, goproxy.ReqHostIs("api.example.com:443"))
+//
+// The shadow requests are sent in the background, tagged with a header, and their
+// responses discarded, or compared with the ones of the primary backend if Compare is
+// set. The clients only ever get the responses of the primary backend. HTTPS requests
+// can only be shadowed from MITM'd tunnels.
+package shadow
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+const (
+	// DefaultHeader is the header tagging the shadow requests, unless specified
+	DefaultHeader = "X-Shadow-Request"
+	// DefaultMaxBodySize is the size of the largest body shadowed or compared, unless
+	// specified
+	DefaultMaxBodySize = 1 << 20
+	// DefaultMaxInFlight is the number of shadow requests sent at once, unless specified
+	DefaultMaxInFlight = 100
+	// DefaultTimeout bounds the shadow requests sent with the default client
+	DefaultTimeout = 30 * time.Second
+)
+
+var defaultClient = &http.Client{
+	Timeout: DefaultTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Result is the response of a backend to a shadowed request.
+type Result struct {
+	Status int
+	Header http.Header
+	// Body is cut at MaxBodySize bytes
+	Body    []byte
+	Latency time.Duration
+	// Err is the error sending the shadow request
+	Err error
+}
+
+// Shadow sends a copy of requests to Target.
+type Shadow struct {
+	// Target is the scheme and host of the secondary backend, the path and query of
+	// the requests being kept
+	Target string
+	// SampleRate is the fraction of the selected requests which are shadowed, all of
+	// them if zero
+	SampleRate float64
+	// Header tags the shadow requests with the session of the original one,
+	// DefaultHeader if empty
+	Header string
+	// MaxBodySize is the size of the largest request body shadowed, and of the
+	// response bodies compared, DefaultMaxBodySize if zero
+	MaxBodySize int64
+	// MaxInFlight is the number of shadow requests sent at once, beyond which the
+	// requests are not shadowed, DefaultMaxInFlight if zero
+	MaxInFlight int
+	// Client sends the shadow requests, a client with DefaultTimeout not following
+	// redirects if nil
+	Client *http.Client
+	// Compare, if set, is called in the background with the responses of the primary
+	// backend and of the secondary one
+	Compare func(ctx *goproxy.ProxyCtx, primary, shadow *Result)
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	inFlight int
+	pending  sync.WaitGroup
+}
+
+const shadowKey = "shadow.result"
+
+// Wait waits for the shadow requests in flight, and their comparisons.
+func (s *Shadow) Wait() {
+	s.pending.Wait()
+}
+
+func (s *Shadow) maxBodySize() int64 {
+	if s.MaxBodySize == 0 {
+		return DefaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+// acquire tells whether a request is sampled, and may be sent.
+func (s *Shadow) acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.SampleRate > 0 && s.SampleRate < 1 {
+		if s.rand == nil {
+			s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		if s.rand.Float64() >= s.SampleRate {
+			return false
+		}
+	}
+	max := s.MaxInFlight
+	if max <= 0 {
+		max = DefaultMaxInFlight
+	}
+	if s.inFlight >= max {
+		return false
+	}
+	s.inFlight++
+	s.pending.Add(1)
+	return true
+}
+
+func (s *Shadow) release() {
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+	s.pending.Done()
+}
+
+// readBody reads up to max bytes of body, and returns them with a body reading them
+// again followed by the rest.
+func readBody(body io.ReadCloser, max int64) ([]byte, io.ReadCloser, error) {
+	b, err := io.ReadAll(io.LimitReader(body, max+1))
+	return b, struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), body), body}, err
+}
+
+// Install shadows the requests of proxy matching conds.
+func (s *Shadow) Install(proxy *goproxy.ProxyHttpServer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).DoFunc(s.handleRequest)
+	proxy.OnResponse().DoFunc(s.handleResponse)
+}
+
+func (s *Shadow) handleRequest(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	target, err := url.Parse(s.Target)
+	if err != nil {
+		ctx.Warnf("Bad shadow target %q: %v", s.Target, err)
+		return req, nil
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if body, req.Body, err = readBody(req.Body, s.maxBodySize()); err != nil || int64(len(body)) > s.maxBodySize() {
+			return req, nil
+		}
+	}
+	if !s.acquire() {
+		return req, nil
+	}
+	u := *req.URL
+	u.Scheme, u.Host = target.Scheme, target.Host
+	shadowReq, err := http.NewRequest(req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		s.release()
+		return req, nil
+	}
+	shadowReq.Header = req.Header.Clone()
+	header := s.Header
+	if header == "" {
+		header = DefaultHeader
+	}
+	shadowReq.Header.Set(header, strconv.FormatInt(ctx.Session, 10))
+	ctx.Logf("Shadowing %s to %s", req.URL, u.Host)
+
+	result := make(chan *Result, 1)
+	if s.Compare != nil {
+		ctx.ReqData.Set(shadowKey, result)
+	}
+	go func() {
+		defer s.release()
+		result <- s.send(shadowReq)
+	}()
+	return req, nil
+}
+
+func (s *Shadow) send(req *http.Request) *Result {
+	client := s.Client
+	if client == nil {
+		client = defaultClient
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return &Result{Err: err, Latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, s.maxBodySize()))
+	return &Result{Status: resp.StatusCode, Header: resp.Header, Body: body, Latency: time.Since(start), Err: err}
+}
+
+func (s *Shadow) handleResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	v, ok := ctx.ReqData.Get(shadowKey)
+	if !ok {
+		return resp
+	}
+	ctx.ReqData.Delete(shadowKey)
+	primary := &Result{Latency: ctx.Latency}
+	if resp == nil {
+		primary.Err = ctx.Error
+	} else {
+		primary.Status, primary.Header = resp.StatusCode, resp.Header.Clone()
+		var err error
+		if resp.Body != nil {
+			if primary.Body, resp.Body, err = readBody(resp.Body, s.maxBodySize()); int64(len(primary.Body)) > s.maxBodySize() {
+				primary.Body = primary.Body[:s.maxBodySize()]
+			}
+			primary.Err = err
+		}
+	}
+	// Compare is given ctx once the exchange is over
+	ctx.Keep()
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.Compare(ctx, primary, <-v.(chan *Result))
+	}()
+	return resp
+}
@@ -0,0 +1,111 @@
+package shadow_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/shadow"
+)
+
+func TestShadow(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write([]byte("primary " + string(b)))
+	}))
+	defer primary.Close()
+	var mu sync.Mutex
+	var shadowed []string
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		shadowed = append(shadowed, r.Method+" "+r.URL.RequestURI()+" "+string(b)+" "+r.Header.Get(shadow.DefaultHeader))
+		mu.Unlock()
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("staging"))
+	}))
+	defer staging.Close()
+
+	var compared []string
+	s := &shadow.Shadow{
+		Target: staging.URL,
+		Compare: func(ctx *goproxy.ProxyCtx, p, sh *shadow.Result) {
+			mu.Lock()
+			compared = append(compared, string(p.Body)+"|"+string(sh.Body)+"|"+http.StatusText(sh.Status))
+			mu.Unlock()
+			// the context is kept for Compare
+			ctx.Logf("Compared %s", ctx.Req.URL)
+		},
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.PoolContexts = true
+	s.Install(proxy, goproxy.UrlHasPrefix(strings.TrimPrefix(primary.URL, "http://")+"/api"))
+	ps := httptest.NewServer(proxy)
+	defer ps.Close()
+	proxyUrl, _ := url.Parse(ps.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+	post := func(path, body string) string {
+		resp, err := client.Post(primary.URL+path, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b)
+	}
+
+	if got := post("/api/x?a=1", "hello"); got != "primary hello" {
+		t.Errorf("client got %q", got)
+	}
+	if got := post("/other", "world"); got != "primary world" {
+		t.Errorf("client got %q", got)
+	}
+	s.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(shadowed) != 1 || !strings.HasPrefix(shadowed[0], "POST /api/x?a=1 hello ") || strings.HasSuffix(shadowed[0], " ") {
+		t.Errorf("shadowed %q", shadowed)
+	}
+	if len(compared) != 1 || compared[0] != "primary hello|staging|I'm a teapot" {
+		t.Errorf("compared %q", compared)
+	}
+}
+
+func TestShadowSampling(t *testing.T) {
+	var mu sync.Mutex
+	count := 0
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+	}))
+	defer staging.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+
+	s := &shadow.Shadow{Target: staging.URL, SampleRate: 0.5}
+	proxy := goproxy.NewProxyHttpServer()
+	s.Install(proxy)
+	ps := httptest.NewServer(proxy)
+	defer ps.Close()
+	proxyUrl, _ := url.Parse(ps.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+	for i := 0; i < 100; i++ {
+		resp, err := client.Get(primary.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	s.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if count < 20 || count > 80 {
+		t.Errorf("%d requests of 100 shadowed at a rate of 0.5", count)
+	}
+}
@@ -0,0 +1,62 @@
+// Package signing signs the requests going through the proxy to selected hosts, so
+// that the clients of the proxy don't need the credentials of the upstream APIs:
+//
+//	signer := &signing.SigV4{AccessKey: key, SecretKey: secret, Region: "eu-west-1", Service: "s3"}
+//	signing.Install(proxy, signer, goproxy.ReqHostMatches(regexp.MustCompile(`\.amazonaws\.com(:443)?$`)))
+//
+// The requests to HTTPS hosts must be MITM'd to be signed.
+package signing
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MaxBodySize is the size of the largest request body signed, larger requests are
+// answered with 413 Request Entity Too Large.
+const MaxBodySize = 32 << 20
+
+// Signer signs a request, given its whole body.
+type Signer interface {
+	Sign(req *http.Request, body []byte) error
+}
+
+// handlerPriority runs the handler after the other request handlers, which may modify
+// the request
+const handlerPriority = -1 << 20
+
+// Install signs the requests of proxy matching conds with signer, once the other
+// request handlers ran.
+func Install(proxy *goproxy.ProxyHttpServer, signer Signer, conds ...goproxy.ReqCondition) {
+	proxy.OnRequest(conds...).Priority(handlerPriority).Do(Handler(signer))
+}
+
+// Handler returns a ReqHandler signing the requests with signer.
+func Handler(signer Signer) goproxy.ReqHandler {
+	return goproxy.FuncReqHandler(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		var body []byte
+		if req.Body != nil && req.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(req.Body, MaxBodySize+1))
+			req.Body.Close()
+			if err != nil {
+				ctx.Warnf("Cannot read the body of %s to sign it: %v", req.URL, err)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read request body")
+			}
+			if len(body) > MaxBodySize {
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusRequestEntityTooLarge, "Request body too large to be signed")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.TransferEncoding = nil
+		}
+		if err := signer.Sign(req, body); err != nil {
+			ctx.Warnf("Cannot sign request to %s: %v", req.URL, err)
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot sign request")
+		}
+		return req, nil
+	})
+}
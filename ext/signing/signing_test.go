@@ -0,0 +1,90 @@
+package signing_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/signing"
+)
+
+// the get-vanilla cases of the AWS Signature Version 4 test suite
+func TestSigV4(t *testing.T) {
+	signer := &signing.SigV4{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Service:   "service",
+		Now:       func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	for url, signature := range map[string]string{
+		"https://example.amazonaws.com/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"https://example.amazonaws.com/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		if err := signer.Sign(req, nil); err != nil {
+			t.Fatal(err)
+		}
+		expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + signature
+		if auth := req.Header.Get("Authorization"); auth != expected {
+			t.Errorf("%s: expected %s, got %s", url, expected, auth)
+		}
+	}
+}
+
+func TestHMAC(t *testing.T) {
+	key := []byte("secret")
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodyHash := sha256.Sum256(body)
+		mac := hmac.New(sha256.New, key)
+		io.WriteString(mac, strings.Join([]string{r.Method, r.URL.RequestURI(), r.Header.Get("X-Timestamp"),
+			"host:" + r.Host, "x-tenant:" + r.Header.Get("X-Tenant"), hex.EncodeToString(bodyHash[:])}, "\n"))
+		if r.Header.Get("X-Signature") != "v1="+hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	signing.Install(proxy, &signing.HMAC{Key: key, Prefix: "v1=", SignedHeaders: []string{"Host", "X-Tenant"}},
+		goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://")+"/signed"))
+	// runs before the signing handler, although registered after it
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-Tenant", "acme")
+		return req, nil
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+
+	for path, status := range map[string]int{"/signed?a=1": 200, "/unsigned": 401} {
+		resp, err := client.Post(backend.URL+path, "text/plain", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status || string(b) != "payload" {
+			t.Errorf("%s: expected %d, got %d %q", path, status, resp.StatusCode, b)
+		}
+	}
+
+	resp, err := client.Post(backend.URL+"/signed", "text/plain", strings.NewReader(strings.Repeat("x", signing.MaxBodySize+1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected a body too large to be signed to be refused, got", resp.Status)
+	}
+}
@@ -0,0 +1,303 @@
+// Package smtp applies a policy to the SMTP sessions tunneled through the proxy with
+// CONNECT, like those of mail clients submitting on port 587:
+//
+//	smtp.Install(proxy, &smtp.Policy{
+//		RequireSTARTTLS: true,
+//		AllowRecipient:  smtp.RecipientDomains("example.com"),
+//		OnMail: func(ctx *goproxy.ProxyCtx, env *smtp.Envelope) {
+//			ctx.Logf("mail from %s to %v", env.From, env.To)
+//		},
+//	})
+//
+// The sessions are recognized by the tunnel sniffing of the proxy, and relayed command
+// by command until the client starts TLS, after which the proxy only sees encrypted
+// data: the envelopes of the mails sent over TLS are not known, and the policy applies
+// to cleartext sessions only.
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/mixcode/goproxy"
+)
+
+// MaxLineLength is the length of the longest command or reply line relayed.
+const MaxLineLength = 64 << 10
+
+// Envelope is what the proxy knows of a mail sent through an SMTP session.
+type Envelope struct {
+	// Host is the target of the tunnel
+	Host string
+	// Helo is the name given by the client with EHLO or HELO
+	Helo string
+	From string
+	To   []string
+}
+
+// Policy is applied to the cleartext SMTP sessions.
+type Policy struct {
+	// RequireSTARTTLS refuses to relay mails before the client started TLS
+	RequireSTARTTLS bool
+	// AllowRecipient, if set, tells whether rcpt may be relayed to. Refused recipients
+	// are answered 550 without reaching the server.
+	AllowRecipient func(ctx *goproxy.ProxyCtx, env *Envelope, rcpt string) bool
+	// OnMail, if set, is called when the client sends the data of a mail
+	OnMail func(ctx *goproxy.ProxyCtx, env *Envelope)
+}
+
+// Install makes proxy apply p to the SMTP tunnels, after its TunnelPolicy if any.
+func Install(proxy *goproxy.ProxyHttpServer, p *Policy) {
+	next := proxy.TunnelPolicy
+	proxy.TunnelPolicy = func(ctx *goproxy.ProxyCtx, sniff *goproxy.TunnelSniff) goproxy.TunnelDecision {
+		var d goproxy.TunnelDecision
+		if next != nil {
+			d = next(ctx, sniff)
+		}
+		if sniff.Protocol == goproxy.TunnelSMTP && d.Action == goproxy.TunnelAllow && d.Handle == nil {
+			host := ctx.Req.URL.Host
+			d.Handle = func(client, server net.Conn) {
+				p.relay(ctx, host, client, server)
+			}
+		}
+		return d
+	}
+}
+
+// RecipientDomains returns an AllowRecipient function accepting the recipients of
+// domains only, to prevent relaying to other domains.
+func RecipientDomains(domains ...string) func(ctx *goproxy.ProxyCtx, env *Envelope, rcpt string) bool {
+	return func(ctx *goproxy.ProxyCtx, env *Envelope, rcpt string) bool {
+		i := strings.LastIndexByte(rcpt, '@')
+		if i < 0 {
+			return false
+		}
+		for _, d := range domains {
+			if strings.EqualFold(rcpt[i+1:], d) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+var errLineTooLong = errors.New("smtp: line too long")
+
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > MaxLineLength {
+			return "", errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// reply is a reply of the server, possibly on several lines
+type reply struct {
+	code  string
+	lines []string
+}
+
+func readReply(r *bufio.Reader) (*reply, error) {
+	rep := &reply{}
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 3 {
+			return nil, errors.New("smtp: malformed reply")
+		}
+		rep.code = line[:3]
+		text := strings.TrimRight(line[3:], "\r\n")
+		more := strings.HasPrefix(text, "-")
+		if len(text) > 0 {
+			text = text[1:]
+		}
+		rep.lines = append(rep.lines, text)
+		if !more {
+			return rep, nil
+		}
+	}
+}
+
+func (rep *reply) write(w io.Writer) error {
+	var b bytes.Buffer
+	for i, line := range rep.lines {
+		sep := "-"
+		if i == len(rep.lines)-1 {
+			sep = " "
+		}
+		b.WriteString(rep.code + sep + line + "\r\n")
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// withoutExtensions removes from an EHLO reply the extensions the proxy cannot relay
+func (rep *reply) withoutExtensions(names ...string) {
+	lines := rep.lines[:1]
+	for _, line := range rep.lines[1:] {
+		keep := true
+		for _, name := range names {
+			if f := strings.Fields(line); len(f) > 0 && strings.EqualFold(f[0], name) {
+				keep = false
+			}
+		}
+		if keep {
+			lines = append(lines, line)
+		}
+	}
+	rep.lines = lines
+}
+
+// address returns the path of a MAIL FROM or RCPT TO argument
+func address(arg string) string {
+	if i := strings.IndexByte(arg, ':'); i >= 0 {
+		arg = arg[i+1:]
+	}
+	arg = strings.TrimSpace(arg)
+	if strings.HasPrefix(arg, "<") {
+		if i := strings.IndexByte(arg, '>'); i > 0 {
+			return arg[1:i]
+		}
+	}
+	if f := strings.Fields(arg); len(f) > 0 {
+		return f[0]
+	}
+	return ""
+}
+
+// relay relays the SMTP session between client and server, applying p.
+func (p *Policy) relay(ctx *goproxy.ProxyCtx, host string, client, server net.Conn) {
+	defer client.Close()
+	defer server.Close()
+	cr, sr := bufio.NewReader(client), bufio.NewReader(server)
+	// forward sends line to the server and its reply to the client
+	forward := func(line string) (*reply, error) {
+		if _, err := io.WriteString(server, line); err != nil {
+			return nil, err
+		}
+		rep, err := readReply(sr)
+		if err != nil {
+			return nil, err
+		}
+		return rep, rep.write(client)
+	}
+	answer := func(s string) error {
+		_, err := io.WriteString(client, s+"\r\n")
+		return err
+	}
+
+	greeting, err := readReply(sr)
+	if err == nil {
+		err = greeting.write(client)
+	}
+	env := &Envelope{Host: host}
+	for err == nil {
+		var line string
+		if line, err = readLine(cr); err != nil {
+			break
+		}
+		verb, arg := strings.ToUpper(strings.TrimRight(line, "\r\n")), ""
+		if i := strings.IndexByte(verb, ' '); i >= 0 {
+			verb, arg = verb[:i], strings.TrimRight(line, "\r\n")[i+1:]
+		}
+		switch verb {
+		case "EHLO", "HELO":
+			env = &Envelope{Host: host, Helo: arg}
+			if _, err = io.WriteString(server, line); err != nil {
+				break
+			}
+			var rep *reply
+			if rep, err = readReply(sr); err == nil {
+				// the data of BDAT is not parsed
+				rep.withoutExtensions("CHUNKING", "BINARYMIME")
+				err = rep.write(client)
+			}
+		case "STARTTLS":
+			var rep *reply
+			if rep, err = forward(line); err == nil && rep.code == "220" {
+				ctx.Logf("SMTP session to %s started TLS", host)
+				pipe(client, server, cr, sr)
+				return
+			}
+		case "MAIL":
+			if p.RequireSTARTTLS {
+				ctx.Warnf("Refusing SMTP mail to %s without STARTTLS", host)
+				err = answer("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			env.From, env.To = address(arg), nil
+			_, err = forward(line)
+		case "RCPT":
+			rcpt := address(arg)
+			if p.AllowRecipient != nil && !p.AllowRecipient(ctx, env, rcpt) {
+				ctx.Warnf("Refusing SMTP relaying to %s through %s", rcpt, host)
+				err = answer("550 5.7.1 Relaying denied")
+				break
+			}
+			var rep *reply
+			if rep, err = forward(line); err == nil && rep.code[0] == '2' {
+				env.To = append(env.To, rcpt)
+			}
+		case "DATA":
+			ctx.Logf("SMTP mail to %s from %s to %v", host, env.From, env.To)
+			if p.OnMail != nil {
+				p.OnMail(ctx, env)
+			}
+			var rep *reply
+			if rep, err = forward(line); err != nil || rep.code != "354" {
+				break
+			}
+			for err == nil && line != ".\r\n" && line != ".\n" {
+				if line, err = readLine(cr); err == nil {
+					_, err = io.WriteString(server, line)
+				}
+			}
+			if err == nil {
+				_, err = forward("")
+			}
+			env = &Envelope{Host: host, Helo: env.Helo}
+		case "BDAT":
+			err = answer("502 5.5.1 BDAT not supported")
+		case "RSET":
+			env = &Envelope{Host: host, Helo: env.Helo}
+			_, err = forward(line)
+		case "QUIT":
+			forward(line)
+			return
+		default:
+			_, err = forward(line)
+		}
+	}
+	if err != nil && err != io.EOF {
+		ctx.Warnf("SMTP session to %s: %v", host, err)
+	}
+}
+
+// pipe relays the raw data of client and server until one of them closes.
+func pipe(client, server net.Conn, cr, sr io.Reader) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, cr)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, sr)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+}
@@ -0,0 +1,203 @@
+package smtp_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	netsmtp "net/smtp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/ext/smtp"
+)
+
+// server is a fake SMTP server, recording the mails it receives
+type server struct {
+	net.Listener
+	mu    sync.Mutex
+	mails []string
+}
+
+func newServer(t *testing.T) *server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{Listener: l}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(c net.Conn) {
+	defer func() { c.Close() }()
+	r := bufio.NewReader(c)
+	fmt.Fprint(c, "220 mail.example.com ESMTP\r\n")
+	var mail []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.Fields(line + " x")[0]); cmd {
+		case "EHLO":
+			fmt.Fprint(c, "250-mail.example.com\r\n250-STARTTLS\r\n250-CHUNKING\r\n250 PIPELINING\r\n")
+		case "STARTTLS":
+			fmt.Fprint(c, "220 Ready to start TLS\r\n")
+			tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{goproxy.GoproxyCa}})
+			c, r = tc, bufio.NewReader(tc)
+		case "DATA":
+			fmt.Fprint(c, "354 Go ahead\r\n")
+			for line != ".\r\n" {
+				if line, err = r.ReadString('\n'); err != nil {
+					return
+				}
+			}
+			s.mu.Lock()
+			s.mails = append(s.mails, strings.Join(mail, " "))
+			s.mu.Unlock()
+			mail = nil
+			fmt.Fprint(c, "250 Queued\r\n")
+		case "RSET":
+			mail = nil
+			fmt.Fprint(c, "250 OK\r\n")
+		case "QUIT":
+			fmt.Fprint(c, "221 Bye\r\n")
+			return
+		default:
+			mail = append(mail, strings.TrimSpace(line))
+			fmt.Fprint(c, "250 OK\r\n")
+		}
+	}
+}
+
+// bufConn reads a connection through the reader of its CONNECT response
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func dial(t *testing.T, proxy *httptest.Server, target string) *netsmtp.Client {
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT", err)
+	}
+	client, err := netsmtp.NewClient(bufConn{c, r}, "mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func send(client *netsmtp.Client, from string, to ...string) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(w, "Subject: hi\r\n\r\n.hello\r\n")
+	return w.Close()
+}
+
+func TestPolicy(t *testing.T) {
+	backend := newServer(t)
+	defer backend.Close()
+
+	var mails []string
+	proxy := goproxy.NewProxyHttpServer()
+	smtp.Install(proxy, &smtp.Policy{
+		AllowRecipient: smtp.RecipientDomains("example.com"),
+		OnMail: func(ctx *goproxy.ProxyCtx, env *smtp.Envelope) {
+			mails = append(mails, fmt.Sprint(env.Helo, " ", env.From, " ", env.To))
+		},
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	client := dial(t, s, backend.Addr().String())
+	if ok, _ := client.Extension("CHUNKING"); ok {
+		t.Error("Expected CHUNKING to be removed")
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		t.Error("Expected STARTTLS to be kept")
+	}
+	if err := send(client, "alice@example.org", "bob@example.com", "eve@example.net"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Error("Expected relaying to be denied, got", err)
+	}
+	if err := client.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(client, "alice@example.org", "bob@example.com", "carol@EXAMPLE.COM"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Error(err)
+	}
+	expected := "[client.example.org alice@example.org [bob@example.com carol@EXAMPLE.COM]]"
+	if fmt.Sprint(mails) != expected {
+		t.Errorf("Expected %s, got %v", expected, mails)
+	}
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	expected = "[MAIL FROM:<alice@example.org> RCPT TO:<bob@example.com> RCPT TO:<carol@EXAMPLE.COM>]"
+	if fmt.Sprint(backend.mails) != expected {
+		t.Errorf("Expected the server to get %s, got %v", expected, backend.mails)
+	}
+}
+
+func TestRequireSTARTTLS(t *testing.T) {
+	backend := newServer(t)
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	smtp.Install(proxy, &smtp.Policy{RequireSTARTTLS: true})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	client := dial(t, s, backend.Addr().String())
+	if err := send(client, "alice@example.org", "bob@example.com"); err == nil || !strings.HasPrefix(err.Error(), "530") {
+		t.Error("Expected the mail to be refused without TLS, got", err)
+	}
+	client.Quit()
+
+	client = dial(t, s, backend.Addr().String())
+	if err := client.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(client, "alice@example.org", "bob@example.com"); err != nil {
+		t.Error("Expected the mail to be sent over TLS, got", err)
+	}
+	client.Quit()
+}
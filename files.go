@@ -0,0 +1,118 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileServer is a request handler answering requests with local files, e.g. to stub a
+// CDN during development:
+//
+//	proxy.OnRequest(goproxy.ReqHostIs("cdn.example.com:443")).Do(&goproxy.FileServer{
+//		Root:        http.Dir("./stubs"),
+//		Prefix:      "/assets/",
+//		Fallthrough: true,
+//	})
+//
+// The files are served by http.FileServer, with their content types, the conditional
+// and Range requests and the directory listings. Root may also be an fs.FS wrapped with
+// http.FS.
+type FileServer struct {
+	Root http.FileSystem
+	// Prefix, if set, is the prefix of the request paths served, stripped from them to
+	// look the files up in Root. The requests of other paths are sent upstream.
+	Prefix string
+	// Fallthrough sends the requests of the missing files upstream, instead of
+	// answering them 404 Not Found.
+	Fallthrough bool
+}
+
+func (s *FileServer) Handle(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	if !strings.HasPrefix(req.URL.Path, s.Prefix) {
+		return req, nil
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		resp := NewResponse(req, ContentTypeText, http.StatusMethodNotAllowed, "Method not allowed\n")
+		resp.Header.Set("Allow", "GET, HEAD")
+		return req, resp
+	}
+	name := "/" + strings.TrimPrefix(req.URL.Path, s.Prefix)
+	if s.Fallthrough {
+		f, err := s.Root.Open(path.Clean(name))
+		if os.IsNotExist(err) {
+			return req, nil
+		}
+		if err == nil {
+			f.Close()
+		}
+	}
+	ctx.Logf("Serving %s from local files", name)
+	r := req.Clone(req.Context())
+	r.URL.Path, r.URL.RawPath = name, ""
+	return req, handlerResponse(http.FileServer(s.Root), r, req)
+}
+
+// handlerResponse returns the response of h to r, whose body is streamed as h writes
+// it. The response is made for req.
+func handlerResponse(h http.Handler, r, req *http.Request) *http.Response {
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{header: make(http.Header), pw: pw, req: req, ready: make(chan *http.Response, 1)}
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				pw.CloseWithError(fmt.Errorf("handler panic: %v", err))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			pw.Close()
+		}()
+		h.ServeHTTP(w, r)
+	}()
+	resp := <-w.ready
+	resp.Body = pr
+	return resp
+}
+
+// pipeResponseWriter is the http.ResponseWriter of handlerResponse.
+type pipeResponseWriter struct {
+	header http.Header
+	pw     *io.PipeWriter
+	req    *http.Request
+	once   sync.Once
+	ready  chan *http.Response
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		resp := &http.Response{
+			Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.header.Clone(),
+			ContentLength: -1,
+			Request:       w.req,
+		}
+		if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+			resp.ContentLength = n
+		}
+		w.ready <- resp
+	})
+}
+
+func (w *pipeResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
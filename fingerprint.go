@@ -0,0 +1,202 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+)
+
+// TLSFingerprint describes the ClientHello the proxy sends to upstream https servers,
+// so that servers fingerprinting TLS clients, e.g. with JA3 or JA4, see a browser
+// rather than a Go program. crypto/tls lets the versions, cipher suites, groups and
+// ALPN be chosen, not their order nor the extensions; set Handshake to hand the
+// handshake to a library such as uTLS for a byte-exact ClientHello.
+type TLSFingerprint struct {
+	// Name identifies the fingerprint. Upstream connections are pooled per name, so
+	// that a connection made with one fingerprint is never reused for another.
+	Name string
+	// MinVersion and MaxVersion bound the offered TLS versions, zero values leave
+	// the crypto/tls defaults in place.
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites lists the offered TLS 1.0-1.2 cipher suites, TLS 1.3 suites are
+	// not configurable.
+	CipherSuites []uint16
+	// CurvePreferences lists the offered key exchange groups.
+	CurvePreferences []tls.CurveID
+	// NextProtos lists the offered ALPN protocols. "h2" is only offered on the
+	// connections of MITM'd HTTP/2 clients, the others being served over HTTP/1.1.
+	NextProtos []string
+	// Handshake, if set, performs the handshake of conn instead of crypto/tls. config
+	// holds the settings of the proxy transport with the fields above applied, and
+	// the protocols in config.NextProtos are the only ones it may negotiate.
+	Handshake func(conn net.Conn, config *tls.Config) (net.Conn, error)
+}
+
+// Presets approximating the ClientHello of current browsers with crypto/tls.
+var (
+	FingerprintChrome = &TLSFingerprint{
+		Name:       "chrome",
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	FingerprintFirefox = &TLSFingerprint{
+		Name:       "firefox",
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	FingerprintSafari = &TLSFingerprint{
+		Name:       "safari",
+		MinVersion: tls.VersionTLS10,
+		MaxVersion: tls.VersionTLS13,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+)
+
+// FingerprintOf returns a fingerprint mimicking hello, as far as crypto/tls
+// supports its cipher suites and groups, e.g. to contact upstream servers the way
+// the connecting client would have (see CaptureClientHello). It is named after
+// the JA3 hash of hello, so that clients sharing a fingerprint share connections.
+func FingerprintOf(hello *ClientHello) *TLSFingerprint {
+	fp := &TLSFingerprint{Name: "ja3:" + hello.JA3Hash()}
+	supported := make(map[uint16]bool)
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		supported[s.ID] = true
+	}
+	for _, id := range hello.CipherSuites {
+		if supported[id] {
+			fp.CipherSuites = append(fp.CipherSuites, id)
+		}
+	}
+	for _, g := range hello.SupportedGroups {
+		switch c := tls.CurveID(g); c {
+		case tls.X25519, tls.CurveP256, tls.CurveP384, tls.CurveP521:
+			fp.CurvePreferences = append(fp.CurvePreferences, c)
+		}
+	}
+	versions := withoutGREASE(hello.SupportedVersions)
+	if len(versions) == 0 {
+		versions = []uint16{hello.Version}
+	}
+	for _, v := range versions {
+		if fp.MinVersion == 0 || v < fp.MinVersion {
+			fp.MinVersion = v
+		}
+		if v > fp.MaxVersion {
+			fp.MaxVersion = v
+		}
+	}
+	fp.NextProtos = append([]string{}, hello.ALPN...)
+	return fp
+}
+
+// FingerprintsForHosts returns a function suitable for ProxyHttpServer.UpstreamFingerprint,
+// using the fingerprint mapped to the upstream host name (without port). Hosts
+// missing from the map are contacted with the fingerprint of crypto/tls.
+func FingerprintsForHosts(fingerprints map[string]*TLSFingerprint) func(host string, ctx *ProxyCtx) *TLSFingerprint {
+	return func(host string, ctx *ProxyCtx) *TLSFingerprint {
+		return fingerprints[host]
+	}
+}
+
+// apply sets the fingerprint on config, offering HTTP/2 only if http2 is set.
+func (fp *TLSFingerprint) apply(config *tls.Config, http2 bool) {
+	if fp.MinVersion != 0 {
+		config.MinVersion = fp.MinVersion
+	}
+	if fp.MaxVersion != 0 {
+		config.MaxVersion = fp.MaxVersion
+	}
+	if fp.CipherSuites != nil {
+		config.CipherSuites = fp.CipherSuites
+	}
+	if fp.CurvePreferences != nil {
+		config.CurvePreferences = fp.CurvePreferences
+	}
+	if fp.NextProtos != nil {
+		config.NextProtos = nil
+		for _, p := range fp.NextProtos {
+			if p != "h2" || http2 {
+				config.NextProtos = append(config.NextProtos, p)
+			}
+		}
+	}
+}
+
+type fingerprintKey struct {
+	base *http.Transport
+	id   interface{}
+}
+
+// fingerprintTransport returns the transport derived from base which handshakes
+// with fp, one per fingerprint name, or per fingerprint for unnamed ones.
+func (proxy *ProxyHttpServer) fingerprintTransport(base *http.Transport, fp *TLSFingerprint) *http.Transport {
+	var id interface{} = fp.Name
+	if fp.Name == "" {
+		id = fp
+	}
+	return proxy.transports.get(fingerprintKey{base, id}, func() *http.Transport {
+		t := base.Clone()
+		t.DialTLSContext = proxy.dialTLS(base, func(conn net.Conn, config *tls.Config, ctx *ProxyCtx) (net.Conn, error) {
+			fp.apply(config, base.ForceAttemptHTTP2)
+			if fp.Handshake != nil {
+				return fp.Handshake(conn, config)
+			}
+			return nil, nil
+		})
+		return t
+	})
+}
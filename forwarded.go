@@ -0,0 +1,129 @@
+package goproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedMode tells how the proxy treats a forwarding header identifying the client
+type ForwardedMode int
+
+const (
+	// ForwardedKeep leaves the header as sent by the client
+	ForwardedKeep ForwardedMode = iota
+	// ForwardedAppend appends the client address to the header
+	ForwardedAppend
+	// ForwardedAnonymize replaces the header with an obfuscated "unknown" client
+	ForwardedAnonymize
+	// ForwardedStrip removes the header
+	ForwardedStrip
+	// ForwardedSet replaces the header with the one of this hop, ignoring the values
+	// sent by the client
+	ForwardedSet
+)
+
+// ForwardingHeaders configures the Via, X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host and Forwarded (RFC 7239) headers handling, applied the same way to
+// plain HTTP, HTTP MITM and TLS MITM traffic. The Host header of requests is sent as the
+// client sent it, and the protocol is the one between the client and the proxy, https
+// for TLS MITM'd requests, so that upstreams behind the proxy can build the absolute
+// URLs the client sees.
+type ForwardingHeaders struct {
+	// Via, if not empty, is the pseudonym appended to the Via header of requests and
+	// responses, e.g. "goproxy"
+	Via string
+	// XForwardedFor tells how to treat the X-Forwarded-For header
+	XForwardedFor ForwardedMode
+	// XForwardedProto and XForwardedHost tell how to treat the X-Forwarded-Proto and
+	// X-Forwarded-Host headers, ForwardedAnonymize removing them
+	XForwardedProto ForwardedMode
+	XForwardedHost  ForwardedMode
+	// Forwarded tells how to treat the Forwarded header
+	Forwarded ForwardedMode
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func viaValue(major, minor int, pseudonym string) string {
+	if major == 1 || major == 0 {
+		return fmt.Sprintf("%d.%d %s", major, minor, pseudonym)
+	}
+	return fmt.Sprintf("%d %s", major, pseudonym)
+}
+
+// applyRequest sets the forwarding headers of a request about to be sent upstream.
+func (f *ForwardingHeaders) applyRequest(req *http.Request) {
+	if f == nil {
+		return
+	}
+	ip := clientIP(req)
+	proto := "http"
+	if req.URL.Scheme == "https" {
+		proto = "https"
+	}
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	applyForwarded(req.Header, "X-Forwarded-For", ip, "unknown", f.XForwardedFor)
+	applyForwarded(req.Header, "X-Forwarded-Proto", proto, "", f.XForwardedProto)
+	applyForwarded(req.Header, "X-Forwarded-Host", host, "", f.XForwardedHost)
+
+	node := ip
+	if strings.Contains(node, ":") {
+		node = `"[` + node + `]"`
+	}
+	element := "for=" + node + ";proto=" + proto
+	if host != "" {
+		element += `;host="` + host + `"`
+	}
+	applyForwarded(req.Header, "Forwarded", element, "for=unknown", f.Forwarded)
+	if f.Via != "" {
+		req.Header.Add("Via", viaValue(req.ProtoMajor, req.ProtoMinor, f.Via))
+	}
+}
+
+// applyForwarded sets the header name of h, value being the one of this hop and
+// anonymized the one replacing it, the header being removed if empty.
+func applyForwarded(h http.Header, name, value, anonymized string, mode ForwardedMode) {
+	switch mode {
+	case ForwardedAppend:
+		if prior := h.Values(name); len(prior) > 0 {
+			value = strings.Join(prior, ", ") + ", " + value
+		}
+		h.Set(name, value)
+	case ForwardedSet:
+		h.Set(name, value)
+	case ForwardedAnonymize:
+		if anonymized == "" {
+			h.Del(name)
+		} else {
+			h.Set(name, anonymized)
+		}
+	case ForwardedStrip:
+		h.Del(name)
+	}
+}
+
+// applyResponse sets the forwarding headers of a response about to be sent to the client.
+func (f *ForwardingHeaders) applyResponse(resp *http.Response) {
+	if f == nil || f.Via == "" {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	major, minor := resp.ProtoMajor, resp.ProtoMinor
+	if major == 0 {
+		major, minor = 1, 1
+	}
+	resp.Header.Add("Via", viaValue(major, minor, f.Via))
+}
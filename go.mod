@@ -2,4 +2,7 @@ module github.com/mixcode/goproxy
 
 go 1.16
 
-require github.com/mixcode/goproxy/ext v0.0.0-20210427112856-bd191b4558d9
+require (
+	github.com/mixcode/goproxy/ext v0.0.0-20210427112856-bd191b4558d9
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,283 @@
+package goproxytest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Mode tells whether a Cassette records or replays the exchanges.
+type Mode int
+
+const (
+	// Replay answers the requests with the recorded responses, without network. The
+	// requests without recorded response are answered 502 Bad Gateway, and reported
+	// by Missing.
+	Replay Mode = iota
+	// Record sends the requests upstream and records their responses, replacing the
+	// ones recorded before.
+	Record
+	// ReplayOrRecord replays the recorded responses, and records the missing ones.
+	ReplayOrRecord
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Replay:
+		return "replay"
+	case Record:
+		return "record"
+	case ReplayOrRecord:
+		return "replay or record"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// firstPriority makes the upstream responses recorded before the other response
+// handlers change them.
+const firstPriority = 1 << 20
+
+// Interaction is a recorded response.
+type Interaction struct {
+	Key    string      `json:"key"`
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// Cassette records the responses to the requests of a proxy in a JSON file, and
+// replays them, for hermetic integration tests (VCR-style):
+//
+//	c, err := goproxytest.LoadCassette("testdata/api.json", goproxytest.Replay)
+//	...
+//	c.Install(proxy)
+//	defer c.Save()
+//
+// Requests are matched to their recorded response by Key. Requests with the same key
+// are answered with their responses in the order they were recorded, the last one being
+// repeated. The requests answered by a request handler of the proxy are neither
+// recorded nor replayed, and tunnels only when they are MITM'd. Server.UseCassette
+// installs a cassette for the duration of a test.
+type Cassette struct {
+	Path string
+	Mode Mode
+	// Key identifies the response of a request, RequestKey if nil. See KeyWith to
+	// match requests on headers or bodies too.
+	Key func(req *http.Request) string
+
+	mu           sync.Mutex
+	interactions []*Interaction
+	replayed     map[string]int
+	missing      []string
+	dirty        bool
+}
+
+// LoadCassette returns the cassette of path, reading the responses recorded there
+// unless mode is Record. The file does not need to exist.
+func LoadCassette(path string, mode Mode) (*Cassette, error) {
+	c := &Cassette{Path: path, Mode: mode, replayed: make(map[string]int)}
+	if mode == Record {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file cassetteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("goproxytest: cannot parse cassette %s: %v", path, err)
+	}
+	c.interactions = file.Interactions
+	return c, nil
+}
+
+// cassetteFile is the content of the file of a cassette
+type cassetteFile struct {
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Save writes the responses recorded since the cassette was loaded to its file, if any.
+func (c *Cassette) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(cassetteFile{c.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.Path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.Path, data, 0644); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Missing returns the keys of the requests replayed without recorded response.
+func (c *Cassette) Missing() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.missing...)
+}
+
+// RequestKey identifies a request by its method and URL, the query parameters sorted.
+func RequestKey(req *http.Request) string {
+	u := *req.URL
+	u.RawQuery = u.Query().Encode()
+	return req.Method + " " + u.String()
+}
+
+// KeyWith returns a Cassette.Key identifying the requests by their RequestKey, the
+// values of headers, and the SHA-256 of their body if body is set.
+func KeyWith(body bool, headers ...string) func(req *http.Request) string {
+	return func(req *http.Request) string {
+		key := RequestKey(req)
+		sorted := append([]string(nil), headers...)
+		sort.Strings(sorted)
+		for _, h := range sorted {
+			key += " " + http.CanonicalHeaderKey(h) + "=" + strings.Join(req.Header.Values(h), ",")
+		}
+		if body && req.Body != nil && req.Body != http.NoBody {
+			b, err := io.ReadAll(req.Body)
+			req.Body.Close()
+			req.Body = io.NopCloser(bytes.NewReader(b))
+			if err == nil {
+				sum := sha256.Sum256(b)
+				key += " body=" + hex.EncodeToString(sum[:8])
+			}
+		}
+		return key
+	}
+}
+
+func (c *Cassette) key(req *http.Request) string {
+	if c.Key != nil {
+		return c.Key(req)
+	}
+	return RequestKey(req)
+}
+
+// Install records or replays the exchanges of proxy. The requests are matched once the
+// other request handlers ran.
+func (c *Cassette) Install(proxy *goproxy.ProxyHttpServer) {
+	const keyData = "goproxytest.cassette"
+	proxy.OnRequest().Priority(lastPriority).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		key := c.key(req)
+		if c.Mode != Record {
+			if resp := c.replay(key, req); resp != nil {
+				ctx.Logf("Replaying the recorded response of %s", key)
+				return req, resp
+			}
+			if c.Mode == Replay {
+				ctx.Warnf("No recorded response for %s", key)
+				return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusBadGateway,
+					fmt.Sprintf("goproxytest: no recorded response for %s\n", key))
+			}
+		}
+		ctx.ReqData.Set(keyData, key)
+		return req, nil
+	})
+	proxy.OnResponse().Priority(firstPriority).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		key, ok := ctx.ReqData.Get(keyData)
+		if !ok || resp == nil {
+			return resp
+		}
+		ctx.ReqData.Delete(keyData)
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			ctx.Warnf("Cannot record the response of %s: %v", key, err)
+			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, "Cannot read the response body")
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		c.record(&Interaction{Key: key.(string), Status: resp.StatusCode, Header: resp.Header.Clone(), Body: body})
+		ctx.Logf("Recorded the response of %s", key)
+		return resp
+	})
+}
+
+func (c *Cassette) record(i *Interaction) {
+	c.mu.Lock()
+	c.interactions = append(c.interactions, i)
+	c.dirty = true
+	c.mu.Unlock()
+}
+
+// replay returns the next recorded response of key, nil if there is none and records
+// key as missing in Replay mode.
+func (c *Cassette) replay(key string, req *http.Request) *http.Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var matches []*Interaction
+	for _, i := range c.interactions {
+		if i.Key == key {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 0 {
+		if c.Mode == Replay {
+			c.missing = append(c.missing, key)
+		}
+		return nil
+	}
+	if c.replayed == nil {
+		c.replayed = make(map[string]int)
+	}
+	n := c.replayed[key]
+	c.replayed[key]++
+	if n >= len(matches) {
+		n = len(matches) - 1
+	}
+	i := matches[n]
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode:    i.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        i.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(i.Body)),
+		ContentLength: int64(len(i.Body)),
+		Request:       req,
+	}
+}
+
+// UseCassette records or replays the exchanges of the proxy of s with the cassette of
+// path, see Cassette, until the test ends. The recorded responses are then saved, and
+// the requests replayed without recorded response reported as errors.
+func (s *Server) UseCassette(t testing.TB, path string, mode Mode) *Cassette {
+	t.Helper()
+	c, err := LoadCassette(path, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Install(s.Proxy)
+	t.Cleanup(func() {
+		if err := c.Save(); err != nil {
+			t.Errorf("Cannot save cassette %s: %v", path, err)
+		}
+		if missing := c.Missing(); len(missing) > 0 {
+			t.Errorf("No recorded response in cassette %s for %s", path, strings.Join(missing, ", "))
+		}
+	})
+	return c
+}
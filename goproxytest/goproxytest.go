@@ -0,0 +1,189 @@
+// Package goproxytest provides utilities to test programs using goproxy, in the spirit
+// of net/http/httptest: a proxy served on a random local port, with its own CA, a client
+// using it and trusting that CA, and the exchanges it proxied.
+//
+//	proxy := goproxy.NewProxyHttpServer()
+//	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+//	s := goproxytest.NewServer(t, proxy)
+//	resp, err := s.Client().Get(backend.URL)
+//	...
+//	s.Expect(t, "GET", backend.URL+"/", http.StatusOK)
+//
+// Do runs the handlers of a proxy on a single request, without network, and a Cassette
+// records the exchanges of a proxy to replay them in later runs.
+package goproxytest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// lastPriority is the priority of the handlers registered by the package, running
+// after the other handlers.
+const lastPriority = -1 << 20
+
+// Exchange is a request proxied by a Server, and its response.
+type Exchange struct {
+	// ID is the ProxyCtx.ID of the request
+	ID     string
+	Method string
+	// URL is the URL of the request as sent upstream, https for MITM'd requests
+	URL            string
+	RequestHeader  http.Header
+	Status         int
+	ResponseHeader http.Header
+	// Error is the error of the request if it had no response
+	Error error
+	Time  time.Time
+}
+
+func (e Exchange) String() string {
+	if e.Error != nil {
+		return fmt.Sprintf("%s %s: %v", e.Method, e.URL, e.Error)
+	}
+	return fmt.Sprintf("%s %s: %d", e.Method, e.URL, e.Status)
+}
+
+// Server is a proxy served on a local port for tests.
+type Server struct {
+	Proxy *goproxy.ProxyHttpServer
+	// URL is the URL of the proxy, http://127.0.0.1:<port>
+	URL string
+	// CA is the CA forging the certificates of the MITM'd hosts, generated for the
+	// server unless the proxy had one
+	CA *tls.Certificate
+
+	server *httptest.Server
+	roots  *x509.CertPool
+
+	mu        sync.Mutex
+	exchanges []Exchange
+}
+
+// NewServer serves proxy, a new proxy if nil, on a random local port until the test
+// ends, recording its exchanges. The default ConnectActions of the proxy, such as
+// goproxy.MitmConnect, sign with the CA of the server.
+func NewServer(t testing.TB, proxy *goproxy.ProxyHttpServer) *Server {
+	t.Helper()
+	if proxy == nil {
+		proxy = goproxy.NewProxyHttpServer()
+	}
+	if proxy.CA == nil {
+		ca, err := goproxy.GenerateCA(nil)
+		if err != nil {
+			t.Fatal("Cannot generate the CA of the test proxy:", err)
+		}
+		proxy.CA = ca
+	}
+	leaf, err := x509.ParseCertificate(proxy.CA.Certificate[0])
+	if err != nil {
+		t.Fatal("Cannot parse the CA of the test proxy:", err)
+	}
+	s := &Server{Proxy: proxy, CA: proxy.CA, roots: x509.NewCertPool()}
+	s.roots.AddCert(leaf)
+	proxy.OnResponse().Priority(lastPriority).DoFunc(s.record)
+	s.server = httptest.NewServer(proxy)
+	s.URL = s.server.URL
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Close stops serving the proxy, closing its connections.
+func (s *Server) Close() {
+	s.server.CloseClientConnections()
+	s.server.Close()
+}
+
+// Trust adds the certificate of the TLS test server ts to the roots trusted by the
+// clients of s, for the tunnels which are not MITM'd. It must be called before the
+// clients send their requests.
+func (s *Server) Trust(ts *httptest.Server) {
+	s.roots.AddCert(ts.Certificate())
+}
+
+// Client returns a new client sending its requests through the proxy, and trusting the
+// CA of the proxy and the servers passed to Trust.
+func (s *Server) Client() *http.Client {
+	proxyURL, _ := url.Parse(s.URL)
+	return &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyURL(proxyURL),
+		TLSClientConfig: &tls.Config{RootCAs: s.roots},
+	}}
+}
+
+func (s *Server) record(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if ctx.Req == nil {
+		return resp
+	}
+	e := Exchange{
+		ID:            ctx.ID(),
+		Method:        ctx.Req.Method,
+		URL:           ctx.Req.URL.String(),
+		RequestHeader: ctx.Req.Header.Clone(),
+		Time:          time.Now(),
+	}
+	if resp != nil {
+		e.Status = resp.StatusCode
+		e.ResponseHeader = resp.Header.Clone()
+	} else {
+		e.Error = ctx.Error
+	}
+	s.mu.Lock()
+	s.exchanges = append(s.exchanges, e)
+	s.mu.Unlock()
+	return resp
+}
+
+// Exchanges returns the exchanges proxied so far, in the order their responses were
+// received.
+func (s *Server) Exchanges() []Exchange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Exchange(nil), s.exchanges...)
+}
+
+// Reset forgets the exchanges proxied so far.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	s.exchanges = nil
+	s.mu.Unlock()
+}
+
+// Find returns the first exchange with method whose URL is url, or starts with it if
+// it ends with "*".
+func (s *Server) Find(method, url string) (Exchange, bool) {
+	for _, e := range s.Exchanges() {
+		if e.Method != method {
+			continue
+		}
+		if e.URL == url || strings.HasSuffix(url, "*") && strings.HasPrefix(e.URL, url[:len(url)-1]) {
+			return e, true
+		}
+	}
+	return Exchange{}, false
+}
+
+// Expect reports an error to t unless an exchange with method and url, see Find, was
+// proxied with status, and returns it.
+func (s *Server) Expect(t testing.TB, method, url string, status int) Exchange {
+	t.Helper()
+	e, ok := s.Find(method, url)
+	if !ok {
+		t.Errorf("Expected %s %s to be proxied, got %v", method, url, s.Exchanges())
+		return e
+	}
+	if e.Status != status {
+		t.Errorf("Expected %s %s to be answered %d, got %v", method, url, status, e)
+	}
+	return e
+}
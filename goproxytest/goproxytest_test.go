@@ -0,0 +1,241 @@
+package goproxytest_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+	"github.com/mixcode/goproxy/goproxytest"
+)
+
+func TestServer(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-Proxied", "1")
+		return req, nil
+	})
+	s := goproxytest.NewServer(t, proxy)
+	client := s.Client()
+
+	// the certificate forged by the proxy is trusted by the client
+	resp, err := client.Get(backend.URL + "/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "/hello" {
+		t.Errorf("Unexpected body %q", body)
+	}
+	resp, err = client.Get(plain.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	e := s.Expect(t, "GET", backend.URL+"/hello", http.StatusOK)
+	if e.RequestHeader.Get("X-Proxied") != "1" {
+		t.Errorf("Expected the request to be recorded as sent upstream, got %v", e.RequestHeader)
+	}
+	s.Expect(t, "GET", plain.URL+"/*", http.StatusNotFound)
+	if n := len(s.Exchanges()); n != 2 {
+		t.Errorf("Expected 2 exchanges, got %d", n)
+	}
+	s.Reset()
+	if _, ok := s.Find("GET", backend.URL+"/hello"); ok {
+		t.Error("Expected the exchanges to be forgotten")
+	}
+}
+
+func TestServerTrust(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tunneled")
+	}))
+	defer backend.Close()
+	s := goproxytest.NewServer(t, nil)
+	if _, err := s.Client().Get(backend.URL); err == nil {
+		t.Error("Expected the certificate of the backend to be untrusted")
+	}
+	s.Trust(backend)
+	resp, err := s.Client().Get(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "tunneled" {
+		t.Errorf("Unexpected body %q", body)
+	}
+}
+
+func TestDo(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix("example.com/ads/")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "blocked")
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-Proxied", "1")
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Filtered", "1")
+		return resp
+	})
+
+	res := goproxytest.Do(proxy, httptest.NewRequest("GET", "http://example.com/ads/banner.gif", nil), nil)
+	if res.Upstream != nil || res.Response.StatusCode != http.StatusForbidden || string(res.Body) != "blocked" {
+		t.Errorf("Expected the request to be blocked, got %v %q", res.Response.Status, res.Body)
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "page "+r.Header.Get("X-Proxied"))
+	})
+	res = goproxytest.Do(proxy, httptest.NewRequest("GET", "http://example.com/page", nil), upstream)
+	if res.Upstream == nil || res.Upstream.URL.String() != "http://example.com/page" {
+		t.Fatalf("Expected the request to reach upstream, got %v", res.Upstream)
+	}
+	if string(res.Body) != "page 1" || res.Response.Header.Get("X-Filtered") != "1" {
+		t.Errorf("Expected the request and response handlers to run, got %q %v", res.Body, res.Response.Header)
+	}
+}
+
+func TestCassette(t *testing.T) {
+	hits := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("X-Hit", strconv.Itoa(hits))
+		fmt.Fprintf(w, "%s %d", r.URL.Query().Get("q"), hits)
+	}))
+	dir, err := os.MkdirTemp("", "cassette")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testdata", "cassette.json")
+	get := func(client *http.Client, url string) string {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.Status + " " + string(body)
+	}
+
+	t.Run("record", func(t *testing.T) {
+		s := goproxytest.NewServer(t, nil)
+		s.UseCassette(t, path, goproxytest.Record)
+		for _, url := range []string{"/?q=a&r=1", "/?r=1&q=a", "/?q=b"} {
+			get(s.Client(), backend.URL+url)
+		}
+	})
+	backend.Close()
+
+	t.Run("replay", func(t *testing.T) {
+		s := goproxytest.NewServer(t, nil)
+		s.UseCassette(t, path, goproxytest.ReplayOrRecord)
+		expected := []string{"200 OK a 1", "200 OK a 2", "200 OK a 2", "200 OK b 3"}
+		for i, url := range []string{"/?q=a&r=1", "/?q=a&r=1", "/?r=1&q=a", "/?q=b"} {
+			if got := get(s.Client(), backend.URL+url); got != expected[i] {
+				t.Errorf("Expected %s to be replayed as %q, got %q", url, expected[i], got)
+			}
+		}
+	})
+
+	c, err := goproxytest.LoadCassette(path, goproxytest.Replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	c.Install(proxy)
+	res := goproxytest.Do(proxy, httptest.NewRequest("GET", backend.URL+"/?q=b", nil), nil)
+	if string(res.Body) != "b 3" || res.Upstream != nil {
+		t.Errorf("Expected the response to be replayed, got %q", res.Body)
+	}
+	res = goproxytest.Do(proxy, httptest.NewRequest("GET", backend.URL+"/?q=c", nil), nil)
+	if res.Response.StatusCode != http.StatusBadGateway || res.Upstream != nil {
+		t.Errorf("Expected a request without recorded response to fail, got %v", res.Response.Status)
+	}
+	if missing := c.Missing(); len(missing) != 1 || missing[0] != "GET "+backend.URL+"/?q=c" {
+		t.Errorf("Unexpected missing responses %v", missing)
+	}
+}
+
+func TestClock(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := goproxytest.NewClock(start)
+	newProxy := func() *goproxy.ProxyHttpServer {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.Clock = clock
+		proxy.Rand = rand.New(rand.NewSource(1))
+		proxy.RequestIDHeader = goproxy.DefaultRequestIDHeader
+		return proxy
+	}
+
+	// the forged certificates are valid at the time of the clock
+	proxy := newProxy()
+	config, err := goproxy.TLSConfigFromCA(&goproxy.GoproxyCa)("example.com:443", &goproxy.ProxyCtx{Proxy: proxy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.NotBefore.Before(start) || !leaf.NotAfter.After(start) || leaf.NotBefore.Before(start.AddDate(0, -2, 0)) {
+		t.Errorf("Expected the certificate to be valid in %v, got %v - %v", start, leaf.NotBefore, leaf.NotAfter)
+	}
+
+	// the request IDs depend on Rand only
+	ids := make([]string, 2)
+	for i := range ids {
+		res := goproxytest.Do(newProxy(), httptest.NewRequest("GET", "http://example.com/", nil), http.NotFoundHandler())
+		ids[i] = res.Upstream.Header.Get(goproxy.DefaultRequestIDHeader)
+	}
+	if ids[0] == "" || ids[0] != ids[1] {
+		t.Errorf("Expected the same request IDs from the same Rand, got %q", ids)
+	}
+
+	// handlers time out when the clock is advanced
+	proxy.HandlerTimeout = time.Second
+	release := make(chan struct{})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		<-release
+		return req, nil
+	})
+	done := make(chan *goproxytest.Result)
+	go func() {
+		done <- goproxytest.Do(proxy, httptest.NewRequest("GET", "http://example.com/", nil), http.NotFoundHandler())
+	}()
+	for clock.Timers() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	res := <-done
+	close(release)
+	if res.Response.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("Expected the handler to time out, got %v", res.Response.Status)
+	}
+}
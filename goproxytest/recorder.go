@@ -0,0 +1,81 @@
+package goproxytest
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"github.com/mixcode/goproxy"
+)
+
+// Result is the outcome of a request sent by Do.
+type Result struct {
+	// Response is the response received by the client, and Body its body
+	Response *http.Response
+	Body     []byte
+	// Upstream is the request as it reached the upstream handler, nil if a request
+	// handler of the proxy answered it
+	Upstream *http.Request
+}
+
+// upstreamKey is the context key of the upstream handler of a request sent by Do
+type upstreamKey struct{}
+
+// answeredProxies are the proxies on which the handler answering the requests of Do is
+// registered
+var answeredProxies sync.Map
+
+// Do runs the handlers of proxy on req, a request to the proxy such as those made by
+// httptest.NewRequest with an absolute URL, without network: the request is answered
+// by upstream, or 502 Bad Gateway if it is nil, instead of being sent upstream. It is
+// meant to unit test the request and response handlers of a proxy:
+//
+//	req := httptest.NewRequest("GET", "http://example.com/ads/banner.gif", nil)
+//	res := goproxytest.Do(proxy, req, http.NotFoundHandler())
+//	if res.Upstream != nil || res.Response.StatusCode != http.StatusForbidden {
+//		t.Error("Expected the ad to be blocked by the proxy")
+//	}
+//
+// The first call registers a request handler on proxy, running after the others, which
+// only handles the requests sent by Do.
+func Do(proxy *goproxy.ProxyHttpServer, req *http.Request, upstream http.Handler) *Result {
+	if _, loaded := answeredProxies.LoadOrStore(proxy, true); !loaded {
+		proxy.OnRequest().Priority(lastPriority).DoFunc(answerUpstream)
+	}
+	res := &Result{}
+	if upstream == nil {
+		upstream = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		})
+	}
+	answer := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res.Upstream = r
+		upstream.ServeHTTP(w, r)
+	})
+	req = req.WithContext(context.WithValue(req.Context(), upstreamKey{}, answer))
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	res.Response = w.Result()
+	res.Body, _ = io.ReadAll(res.Response.Body)
+	return res
+}
+
+func answerUpstream(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	upstream, ok := req.Context().Value(upstreamKey{}).(http.Handler)
+	if !ok {
+		return req, nil
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		if req.Body == nil {
+			req.Body = http.NoBody
+		}
+		w := httptest.NewRecorder()
+		upstream.ServeHTTP(w, req)
+		resp := w.Result()
+		resp.Request = req
+		return resp, nil
+	})
+	return req, nil
+}
@@ -0,0 +1,349 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// MaxGraphQLBody is the size of the largest request body parsed by GraphQLOperations.
+const MaxGraphQLBody = 1 << 20
+
+// GraphQLOperation is a GraphQL operation requested by a client.
+type GraphQLOperation struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+	Extensions    map[string]interface{} `json:"extensions"`
+
+	// Type is the type of the operation executed: "query", "mutation" or "subscription".
+	// It is empty if Query could not be parsed, e.g. for persisted queries sent by hash.
+	Type string `json:"-"`
+	// Name is the name of the operation executed, empty for anonymous operations.
+	Name string `json:"-"`
+	// Fields are the names of the top-level fields selected by the operation, e.g. the
+	// mutations it runs, fragments included.
+	Fields []string `json:"-"`
+}
+
+// parsedGraphQL are the operations of a request body, once parsed
+type parsedGraphQL struct {
+	body       io.ReadCloser
+	operations []*GraphQLOperation
+}
+
+const graphQLKey = "goproxy.graphql"
+
+// GraphQLOperations returns the GraphQL operations of req: those of a POST request with a
+// JSON body, batched or not, or with an application/graphql body, and the one of a GET
+// request with query parameters. It returns nil for other requests and bodies larger
+// than MaxGraphQLBody. The bytes read are put back in front of the body, and the result
+// is kept for the following calls on the same request.
+//
+//	proxy.OnRequest(goproxy.GraphQLFieldIs("deleteUser")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Forbidden mutation")
+//	})
+func GraphQLOperations(req *http.Request, ctx *ProxyCtx) []*GraphQLOperation {
+	if req.Method == http.MethodGet {
+		q := req.URL.Query()
+		if q.Get("query") == "" && q.Get("extensions") == "" {
+			return nil
+		}
+		op := &GraphQLOperation{Query: q.Get("query"), OperationName: q.Get("operationName")}
+		if json.Unmarshal([]byte(q.Get("variables")), &op.Variables) != nil {
+			op.Variables = nil
+		}
+		if json.Unmarshal([]byte(q.Get("extensions")), &op.Extensions) != nil {
+			op.Extensions = nil
+		}
+		op.parse()
+		return []*GraphQLOperation{op}
+	}
+	if v, ok := ctx.ReqData.Get(graphQLKey); ok {
+		if p := v.(*parsedGraphQL); p.body == req.Body {
+			return p.operations
+		}
+	}
+	if req.Method != http.MethodPost || req.Body == nil || req.Body == http.NoBody ||
+		!mediaTypeIs(req.Header.Get("Content-Type"), []string{"application/json", "application/graphql"}) {
+		return nil
+	}
+	buf := make([]byte, MaxGraphQLBody+1)
+	n, err := io.ReadFull(req.Body, buf)
+	req.Body = &peekedBody{io.MultiReader(bytes.NewReader(buf[:n]), &errReader{req.Body, err}), req.Body}
+	var operations []*GraphQLOperation
+	if n <= MaxGraphQLBody && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		operations = parseGraphQLBody(req.Header.Get("Content-Type"), buf[:n])
+	}
+	ctx.ReqData.Set(graphQLKey, &parsedGraphQL{req.Body, operations})
+	return operations
+}
+
+func parseGraphQLBody(contentType string, body []byte) []*GraphQLOperation {
+	var operations []*GraphQLOperation
+	if mediaTypeIs(contentType, []string{"application/graphql"}) {
+		operations = []*GraphQLOperation{{Query: string(body)}}
+	} else if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		if json.Unmarshal(body, &operations) != nil {
+			return nil
+		}
+	} else {
+		op := &GraphQLOperation{}
+		if json.Unmarshal(body, op) != nil {
+			return nil
+		}
+		operations = []*GraphQLOperation{op}
+	}
+	for _, op := range operations {
+		if op == nil {
+			return nil
+		}
+		op.parse()
+	}
+	return operations
+}
+
+// GraphQLOperationIs returns a ReqCondition testing whether one of the GraphQL
+// operations of the request has one of the given names.
+func GraphQLOperationIs(names ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, op := range GraphQLOperations(req, ctx) {
+			for _, name := range names {
+				if op.Name == name {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// GraphQLTypeIs returns a ReqCondition testing whether one of the GraphQL operations of
+// the request is of one of the given types, e.g. "mutation".
+func GraphQLTypeIs(types ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, op := range GraphQLOperations(req, ctx) {
+			for _, t := range types {
+				if op.Type == t {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// GraphQLFieldIs returns a ReqCondition testing whether one of the GraphQL operations of
+// the request selects one of the given top-level fields. Unlike operation names, which
+// clients choose freely, fields identify what the operation does.
+func GraphQLFieldIs(fields ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, op := range GraphQLOperations(req, ctx) {
+			for _, f := range op.Fields {
+				for _, field := range fields {
+					if f == field {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	}
+}
+
+// graphQLDefinition is an operation or fragment definition of a GraphQL document
+type graphQLDefinition struct {
+	kind, name string
+	// selection are the tokens of the selection set, braces excluded
+	selection []string
+}
+
+// parse sets the Type, Name and Fields of the operation executed by op.
+func (op *GraphQLOperation) parse() {
+	definitions := parseGraphQLDocument(op.Query)
+	fragments := map[string]*graphQLDefinition{}
+	var executed *graphQLDefinition
+	count := 0
+	for _, d := range definitions {
+		if d.kind == "fragment" {
+			fragments[d.name] = d
+			continue
+		}
+		count++
+		if (op.OperationName == "" && count == 1) || (op.OperationName != "" && d.name == op.OperationName) {
+			executed = d
+		}
+	}
+	if executed == nil || (op.OperationName == "" && count > 1) {
+		return
+	}
+	op.Type, op.Name = executed.kind, executed.name
+	op.Fields = topLevelFields(executed.selection, fragments, map[string]bool{})
+}
+
+// topLevelFields returns the fields of a selection set, expanding its fragments.
+func topLevelFields(selection []string, fragments map[string]*graphQLDefinition, expanded map[string]bool) []string {
+	var fields []string
+	depth := 0
+	for i := 0; i < len(selection); i++ {
+		t := selection[i]
+		switch {
+		case t == "{" || t == "(" || t == "[":
+			depth++
+		case t == "}" || t == ")" || t == "]":
+			depth--
+		case depth > 0:
+		case t == "...":
+			if i+1 < len(selection) && selection[i+1] != "on" && selection[i+1] != "{" && selection[i+1] != "@" {
+				// fragment spread
+				name := selection[i+1]
+				i++
+				if f, ok := fragments[name]; ok && !expanded[name] {
+					expanded[name] = true
+					fields = append(fields, topLevelFields(f.selection, fragments, expanded)...)
+				}
+				continue
+			}
+			// inline fragment: its fields are at the same level
+			j := i + 1
+			for j < len(selection) && selection[j] != "{" {
+				j++
+			}
+			end := matchingBrace(selection, j)
+			if j < len(selection) {
+				fields = append(fields, topLevelFields(selection[j+1:end], fragments, expanded)...)
+			}
+			i = end
+		case t == "@":
+			// directive, its name is skipped
+			i++
+		case t == ":" || t == "$" || t == "!" || t == "=":
+		case i+1 < len(selection) && selection[i+1] == ":":
+			// alias
+		default:
+			fields = append(fields, t)
+		}
+	}
+	return fields
+}
+
+// matchingBrace returns the index of the brace closing the one at i.
+func matchingBrace(tokens []string, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "{":
+			depth++
+		case "}":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens)
+}
+
+// parseGraphQLDocument returns the definitions of a GraphQL document.
+func parseGraphQLDocument(query string) []*graphQLDefinition {
+	tokens := tokenizeGraphQL(query)
+	var definitions []*graphQLDefinition
+	for i := 0; i < len(tokens); {
+		d := &graphQLDefinition{kind: "query"}
+		switch tokens[i] {
+		case "query", "mutation", "subscription", "fragment":
+			d.kind = tokens[i]
+			if i+1 < len(tokens) && isGraphQLName(tokens[i+1]) {
+				d.name = tokens[i+1]
+			}
+		case "{":
+		default:
+			// type system definitions and the like are skipped
+			i++
+			continue
+		}
+		start := i
+		for start < len(tokens) && tokens[start] != "{" {
+			if tokens[start] == "(" {
+				// variable definitions may have object default values
+				for depth := 0; start < len(tokens); start++ {
+					if tokens[start] == "(" {
+						depth++
+					} else if tokens[start] == ")" {
+						if depth--; depth == 0 {
+							break
+						}
+					}
+				}
+			}
+			start++
+		}
+		end := matchingBrace(tokens, start)
+		if start < len(tokens) {
+			d.selection = tokens[start+1 : end]
+		}
+		definitions = append(definitions, d)
+		i = end + 1
+	}
+	return definitions
+}
+
+func isGraphQLName(s string) bool {
+	return s != "" && (s[0] == '_' || ('a' <= s[0] && s[0] <= 'z') || ('A' <= s[0] && s[0] <= 'Z'))
+}
+
+// tokenizeGraphQL splits a GraphQL document into names, numbers and punctuators,
+// dropping comments, commas and strings.
+func tokenizeGraphQL(query string) []string {
+	query = strings.TrimPrefix(query, "\ufeff")
+	var tokens []string
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(query) && query[i] != '\n' && query[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], `"""`):
+			// block string, in which only \""" is escaped
+			for i += 3; i < len(query) && !strings.HasPrefix(query[i:], `"""`); i++ {
+				if strings.HasPrefix(query[i:], `\"""`) {
+					i += 3
+				}
+			}
+			i += 3
+		case c == '"':
+			for i++; i < len(query) && query[i] != '"'; i++ {
+				if query[i] == '\\' {
+					i++
+				}
+			}
+			i++
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, "...")
+			i += 3
+		case isGraphQLName(query[i:]):
+			j := i + 1
+			for j < len(query) && (isGraphQLName(query[j:]) || ('0' <= query[j] && query[j] <= '9')) {
+				j++
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		case c == '-' || ('0' <= c && c <= '9'):
+			j := i + 1
+			for j < len(query) && strings.IndexByte("0123456789.eE+-", query[j]) >= 0 {
+				j++
+			}
+			tokens = append(tokens, query[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
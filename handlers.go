@@ -0,0 +1,282 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registration is returned when registering a handler on the proxy. It allows
+// removing the handler while the proxy is running.
+type Registration struct {
+	// stats must be aligned for atomic operations on 32 bit platforms
+	stats    HandlerStats
+	list     *handlerList
+	priority int
+	handler  interface{}
+}
+
+// HandlerStats are the statistics of a request or response handler: the number of
+// calls, of panics, of timeouts and of slow calls (see ProxyHttpServer.HandlerTimeout),
+// and the total time spent in the handler.
+type HandlerStats struct {
+	Calls, Panics, Timeouts, Slow int64
+	Time                          time.Duration
+}
+
+// Stats returns the statistics of the handler.
+func (r *Registration) Stats() HandlerStats {
+	return HandlerStats{
+		Calls:    atomic.LoadInt64(&r.stats.Calls),
+		Panics:   atomic.LoadInt64(&r.stats.Panics),
+		Timeouts: atomic.LoadInt64(&r.stats.Timeouts),
+		Slow:     atomic.LoadInt64(&r.stats.Slow),
+		Time:     time.Duration(atomic.LoadInt64((*int64)(&r.stats.Time))),
+	}
+}
+
+// HandlerPanicError is the error of a handler which panicked, with the recovered value
+// and the stack of the panic.
+type HandlerPanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("goproxy: handler panic: %v", e.Value)
+}
+
+// ErrHandlerTimeout is the error of a handler running longer than
+// ProxyHttpServer.HandlerTimeout.
+var ErrHandlerTimeout = errors.New("goproxy: handler timed out")
+
+func callHandler(f func() interface{}) (v interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &HandlerPanicError{Value: p, Stack: debug.Stack()}
+		}
+	}()
+	return f(), nil
+}
+
+// runHandler runs f, calling the handler of r with ctx and the request or response
+// it filters, recovering its panics and enforcing HandlerTimeout.
+func (proxy *ProxyHttpServer) runHandler(r *Registration, ctx *ProxyCtx, req *http.Request, resp *http.Response,
+	f func(ctx *ProxyCtx, req *http.Request, resp *http.Response) interface{}) (interface{}, error) {
+	clock := proxy.clock()
+	start := clock.Now()
+	var v interface{}
+	var err error
+	if proxy.HandlerTimeout <= 0 {
+		v, err = callHandler(func() interface{} {
+			return f(ctx, req, resp)
+		})
+	} else {
+		type result struct {
+			v   interface{}
+			err error
+		}
+		// the handler works on copies, an abandoned handler would race with the proxy
+		c := newHandlerCopy(ctx, req, resp)
+		done := make(chan result, 1)
+		go func() {
+			v, err := callHandler(func() interface{} {
+				return f(c.ctx, c.request(req), c.response(resp))
+			})
+			done <- result{v, err}
+		}()
+		timeout, stop := clock.NewTimer(proxy.HandlerTimeout)
+		select {
+		case res := <-done:
+			stop()
+			v, err = c.restore(res.v), res.err
+		case <-timeout:
+			err = ErrHandlerTimeout
+			ctx.abandoned = true
+		}
+	}
+	d := clock.Now().Sub(start)
+	atomic.AddInt64(&r.stats.Calls, 1)
+	atomic.AddInt64((*int64)(&r.stats.Time), int64(d))
+	if proxy.SlowHandler > 0 && d > proxy.SlowHandler {
+		atomic.AddInt64(&r.stats.Slow, 1)
+		ctx.Warnf("Slow handler: %v", d)
+	}
+	switch e := err.(type) {
+	case nil:
+		return v, nil
+	case *HandlerPanicError:
+		atomic.AddInt64(&r.stats.Panics, 1)
+		ctx.Warnf("Handler panic: %v\n%s", e.Value, e.Stack)
+	default:
+		atomic.AddInt64(&r.stats.Timeouts, 1)
+		ctx.Warnf("Handler timed out after %v", d)
+	}
+	ctx.Error = err
+	if proxy.HandlerFailed != nil {
+		proxy.HandlerFailed(ctx, err)
+	}
+	return nil, err
+}
+
+// handlerCopy holds the copies of the context of an exchange, and of the requests and
+// responses it refers to, a handler runs on with HandlerTimeout. They are copied back
+// once the handler returned in time, a handler abandoned by the timeout keeping them.
+type handlerCopy struct {
+	ctx, orig *ProxyCtx
+	// the copies of the originals
+	reqs  map[*http.Request]*http.Request
+	resps map[*http.Response]*http.Response
+}
+
+func newHandlerCopy(ctx *ProxyCtx, req *http.Request, resp *http.Response) *handlerCopy {
+	c := &handlerCopy{
+		ctx:   new(ProxyCtx),
+		orig:  ctx,
+		reqs:  map[*http.Request]*http.Request{},
+		resps: map[*http.Response]*http.Response{},
+	}
+	*c.ctx = *ctx
+	c.ctx.Req, c.ctx.Resp = c.request(ctx.Req), c.response(ctx.Resp)
+	c.request(req)
+	c.response(resp)
+	return c
+}
+
+// request returns the copy of r, made on first use.
+func (c *handlerCopy) request(r *http.Request) *http.Request {
+	if r == nil {
+		return nil
+	}
+	if cp, ok := c.reqs[r]; ok {
+		return cp
+	}
+	cp := r.Clone(r.Context())
+	c.reqs[r] = cp
+	return cp
+}
+
+// response returns the copy of r, made on first use.
+func (c *handlerCopy) response(r *http.Response) *http.Response {
+	if r == nil {
+		return nil
+	}
+	if cp, ok := c.resps[r]; ok {
+		return cp
+	}
+	cp := new(http.Response)
+	*cp = *r
+	cp.Header, cp.Trailer = r.Header.Clone(), r.Trailer.Clone()
+	cp.Request = c.request(r.Request)
+	c.resps[r] = cp
+	return cp
+}
+
+// restore copies the copies back into the originals, and returns v, the result of the
+// handler, referring to the originals instead of the copies.
+func (c *handlerCopy) restore(v interface{}) interface{} {
+	origRequest := func(r *http.Request) *http.Request {
+		for orig, cp := range c.reqs {
+			if cp == r {
+				return orig
+			}
+		}
+		return r
+	}
+	origResponse := func(r *http.Response) *http.Response {
+		for orig, cp := range c.resps {
+			if cp == r {
+				return orig
+			}
+		}
+		return r
+	}
+	for orig, cp := range c.reqs {
+		*orig = *cp
+	}
+	for orig, cp := range c.resps {
+		*orig = *cp
+		orig.Request = origRequest(cp.Request)
+	}
+	*c.orig = *c.ctx
+	c.orig.Req, c.orig.Resp = origRequest(c.ctx.Req), origResponse(c.ctx.Resp)
+	switch v := v.(type) {
+	case filteredRequest:
+		return filteredRequest{origRequest(v.req), origResponse(v.resp)}
+	case *http.Response:
+		return origResponse(v)
+	}
+	return v
+}
+
+// handlerErrorResponse answers a request whose handler failed with err.
+func (proxy *ProxyHttpServer) handlerErrorResponse(req *http.Request, ctx *ProxyCtx, err error) *http.Response {
+	if err == ErrHandlerTimeout {
+		return NewResponse(req, ContentTypeText, http.StatusGatewayTimeout, "Proxy handler timed out\n")
+	}
+	return NewResponse(req, ContentTypeText, http.StatusInternalServerError, "Proxy handler failed\n")
+}
+
+// Remove unregisters the handler. Requests already being filtered may still use it.
+// It returns false if the handler was already removed.
+func (r *Registration) Remove() bool {
+	return r.list.remove(r)
+}
+
+// Priority returns the priority the handler was registered with.
+func (r *Registration) Priority() int {
+	return r.priority
+}
+
+// handlerList is a list of handlers sorted by decreasing priority, handlers of the
+// same priority being kept in registration order. The list is copied on write so
+// that it can be changed while requests are being filtered.
+type handlerList struct {
+	mu      sync.RWMutex
+	entries []*Registration
+}
+
+func (l *handlerList) add(handler interface{}, priority int) *Registration {
+	r := &Registration{list: l, priority: priority, handler: handler}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := len(l.entries)
+	for i > 0 && l.entries[i-1].priority < priority {
+		i--
+	}
+	entries := make([]*Registration, 0, len(l.entries)+1)
+	entries = append(entries, l.entries[:i]...)
+	entries = append(entries, r)
+	l.entries = append(entries, l.entries[i:]...)
+	return r
+}
+
+func (l *handlerList) remove(r *Registration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, e := range l.entries {
+		if e == r {
+			entries := make([]*Registration, 0, len(l.entries)-1)
+			entries = append(entries, l.entries[:i]...)
+			l.entries = append(entries, l.entries[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// snapshot returns the current handlers, the returned slice must not be modified.
+func (l *handlerList) snapshot() []*Registration {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.entries
+}
+
+// upgradeHandlerFunc is an UpgradeHandler wrapped with its conditions. It returns
+// false if the conditions did not match.
+type upgradeHandlerFunc func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *ProxyCtx) bool
@@ -0,0 +1,191 @@
+package goproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Header operations, see HeaderOp.
+const (
+	HeaderAdd    = "add"
+	HeaderSet    = "set"
+	HeaderRemove = "remove"
+	HeaderRename = "rename"
+)
+
+// HeaderOp is an operation of a rule with the headers action. It adds a value to the
+// header Name, sets it, removes it, or renames it To, in the request or, if Response,
+// in its response:
+//
+//	{"hosts": ["api.example.com"], "action": "headers", "headers": [
+//		{"op": "set", "name": "Authorization", "value": "Bearer 0123456789"},
+//		{"op": "add", "name": "X-Forwarded-User", "value": "${client_id}"},
+//		{"op": "remove", "name": "Server", "response": true}
+//	]}
+//
+// Values may refer to the request with ${method}, ${scheme}, ${host}, ${hostname},
+// ${path}, ${url}, ${client_id}, ${client_ip}, ${session}, ${header:NAME} and
+// ${query:NAME}, and to the response status with ${status}.
+type HeaderOp struct {
+	Op       string `json:"op"`
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+	To       string `json:"to,omitempty"`
+	Response bool   `json:"response,omitempty"`
+
+	value headerTemplate
+}
+
+// headerTemplate is a parsed HeaderOp value, alternating literals and variables
+type headerTemplate []templatePart
+
+type templatePart struct {
+	literal  string
+	variable string
+	arg      string
+}
+
+var templateVars = map[string]bool{
+	"method": true, "scheme": true, "host": true, "hostname": true, "path": true, "url": true,
+	"client_id": true, "client_ip": true, "session": true, "status": true,
+	"header": true, "query": true,
+}
+
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for s != "" {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			t = append(t, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{literal: s[:i]})
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated ${ in %q", s)
+		}
+		part := templatePart{variable: s[i+2 : i+end]}
+		if j := strings.IndexByte(part.variable, ':'); j >= 0 {
+			part.variable, part.arg = part.variable[:j], part.variable[j+1:]
+		}
+		if !templateVars[part.variable] || (part.arg != "") != (part.variable == "header" || part.variable == "query") {
+			return nil, fmt.Errorf("unknown variable ${%s}", s[i+2:i+end])
+		}
+		t = append(t, part)
+		s = s[i+end+1:]
+	}
+	return t, nil
+}
+
+func (t headerTemplate) expand(req *http.Request, resp *http.Response, ctx *ProxyCtx) string {
+	var b strings.Builder
+	for _, part := range t {
+		switch part.variable {
+		case "":
+			b.WriteString(part.literal)
+		case "method":
+			b.WriteString(req.Method)
+		case "scheme":
+			b.WriteString(req.URL.Scheme)
+		case "host":
+			b.WriteString(req.URL.Host)
+		case "hostname":
+			b.WriteString(req.URL.Hostname())
+		case "path":
+			b.WriteString(req.URL.Path)
+		case "url":
+			b.WriteString(req.URL.String())
+		case "client_id":
+			b.WriteString(ctx.ClientID)
+		case "client_ip":
+			b.WriteString(IdentifyBySourceIP(req, ctx))
+		case "session":
+			b.WriteString(strconv.FormatInt(ctx.Session, 10))
+		case "status":
+			if resp != nil {
+				b.WriteString(strconv.Itoa(resp.StatusCode))
+			}
+		case "header":
+			b.WriteString(req.Header.Get(part.arg))
+		case "query":
+			b.WriteString(req.URL.Query().Get(part.arg))
+		}
+	}
+	return b.String()
+}
+
+func (op *HeaderOp) validate() error {
+	switch op.Op {
+	case HeaderAdd, HeaderSet:
+		value, err := parseHeaderTemplate(op.Value)
+		if err != nil {
+			return fmt.Errorf("header %s: %v", op.Name, err)
+		}
+		op.value = value
+	case HeaderRemove:
+	case HeaderRename:
+		if op.To == "" {
+			return fmt.Errorf("header %s: rename without to", op.Name)
+		}
+	default:
+		return fmt.Errorf("header %s: unknown op %q", op.Name, op.Op)
+	}
+	if op.Name == "" {
+		return fmt.Errorf("header op %s without name", op.Op)
+	}
+	return nil
+}
+
+// apply carries out op on h, the headers of req or of its response resp.
+func (op *HeaderOp) apply(h http.Header, req *http.Request, resp *http.Response, ctx *ProxyCtx) {
+	switch op.Op {
+	case HeaderAdd:
+		h.Add(op.Name, op.value.expand(req, resp, ctx))
+	case HeaderSet:
+		h.Set(op.Name, op.value.expand(req, resp, ctx))
+	case HeaderRemove:
+		h.Del(op.Name)
+	case HeaderRename:
+		if values := h.Values(op.Name); len(values) > 0 {
+			h.Del(op.Name)
+			h[http.CanonicalHeaderKey(op.To)] = values
+		}
+	}
+}
+
+const responseHeaderOpsKey = "goproxy.responseHeaderOps"
+
+// applyHeaderOps carries out the request operations of ops on req, and keeps the
+// response ones for handleResponse.
+func applyHeaderOps(ops []HeaderOp, req *http.Request, ctx *ProxyCtx) {
+	var pending []HeaderOp
+	if v, ok := ctx.ReqData.Get(responseHeaderOpsKey); ok {
+		pending = v.([]HeaderOp)
+	}
+	for i := range ops {
+		if ops[i].Response {
+			pending = append(pending, ops[i])
+		} else {
+			ops[i].apply(req.Header, req, nil, ctx)
+		}
+	}
+	if len(pending) > 0 {
+		ctx.ReqData.Set(responseHeaderOpsKey, pending)
+	}
+}
+
+// applyResponseHeaderOps carries out the response operations kept by applyHeaderOps.
+func applyResponseHeaderOps(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	v, ok := ctx.ReqData.Get(responseHeaderOpsKey)
+	if !ok || resp == nil {
+		return resp
+	}
+	for _, op := range v.([]HeaderOp) {
+		op.apply(resp.Header, ctx.Req, resp, ctx)
+	}
+	return resp
+}
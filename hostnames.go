@@ -0,0 +1,280 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidHost is the error of hosts NormalizeHost rejects.
+var ErrInvalidHost = errors.New("goproxy: invalid host")
+
+// NormalizeHost returns the canonical form of host, a host name or IP address with an
+// optional port, which the proxy matches its handlers against and dials: host names
+// are lowercased, without trailing dot, and their internationalized labels are encoded
+// in punycode (IDNA), IP addresses are in their shortest form, IPv6 ones bracketed
+// when a port follows, and ports are without leading zeros. Hosts which could be read
+// differently by the handlers and the resolver, e.g. "127.1", fail with ErrInvalidHost.
+//
+// Fullwidth forms of ASCII characters and the ideographic full stops are mapped to
+// ASCII, the other Unicode normalizations of UTS #46 are not applied.
+func NormalizeHost(host string) (string, error) {
+	name, port, err := splitHostPort(host)
+	if err != nil {
+		return "", err
+	}
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 || strings.IndexFunc(port, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+			return "", fmt.Errorf("%v: port %q", ErrInvalidHost, port)
+		}
+		port = strconv.FormatUint(p, 10)
+	}
+	if name, err = normalizeHostname(name); err != nil {
+		return "", err
+	}
+	if port == "" {
+		return name, nil
+	}
+	return net.JoinHostPort(name, port), nil
+}
+
+// splitHostPort splits host into a host name or IP address and a port, which may be
+// missing, unlike with net.SplitHostPort.
+func splitHostPort(host string) (name, port string, err error) {
+	switch {
+	case strings.HasPrefix(host, "["):
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return "", "", fmt.Errorf("%v: %q", ErrInvalidHost, host)
+		}
+		name, rest := host[1:end], host[end+1:]
+		if net.ParseIP(name) == nil || strings.Contains(name, ".") && !strings.Contains(name, ":") {
+			return "", "", fmt.Errorf("%v: %q", ErrInvalidHost, host)
+		}
+		if rest == "" {
+			return name, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("%v: %q", ErrInvalidHost, host)
+		}
+		return name, rest[1:], nil
+	case strings.Count(host, ":") > 1:
+		// an IPv6 address without port
+		return host, "", nil
+	case strings.Contains(host, ":"):
+		i := strings.LastIndexByte(host, ':')
+		return host[:i], host[i+1:], nil
+	}
+	return host, "", nil
+}
+
+// hostWithoutPort returns the host name or IP address of host, with or without port,
+// IPv6 addresses being unbracketed.
+func hostWithoutPort(host string) string {
+	name, _, err := splitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return name
+}
+
+// withPort returns host, with or without port, with the given port if it has none.
+func withPort(host, port string) string {
+	name, p, err := splitHostPort(host)
+	if err != nil || p != "" {
+		return host
+	}
+	return net.JoinHostPort(name, port)
+}
+
+func normalizeHostname(name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("%v: empty", ErrInvalidHost)
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String(), nil
+	}
+	if strings.Contains(name, ":") {
+		return "", fmt.Errorf("%v: %q", ErrInvalidHost, name)
+	}
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '。', r == '．', r == '｡':
+			return '.'
+		case r >= '！' && r <= '～':
+			return r - 0xfee0
+		}
+		return r
+	}, name)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String(), nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", fmt.Errorf("%v: empty label in %q", ErrInvalidHost, name)
+		}
+		if !isASCII(label) {
+			encoded, err := punycode(label)
+			if err != nil {
+				return "", err
+			}
+			label = "xn--" + encoded
+		}
+		if len(label) > 63 {
+			return "", fmt.Errorf("%v: label too long in %q", ErrInvalidHost, name)
+		}
+		for _, c := range []byte(label) {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("%v: %q", ErrInvalidHost, name)
+			}
+		}
+		labels[i] = label
+	}
+	// a numeric top-level label is an IP address some resolvers accept, as "127.1" or
+	// "0x7f.1", not a host name
+	last := labels[len(labels)-1]
+	if strings.IndexFunc(last, func(r rune) bool { return r < '0' || r > '9' }) < 0 ||
+		strings.HasPrefix(last, "0x") && strings.IndexFunc(last[2:], func(r rune) bool {
+			return !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f')
+		}) < 0 {
+		return "", fmt.Errorf("%v: numeric host %q", ErrInvalidHost, name)
+	}
+	name = strings.Join(labels, ".")
+	if len(name) > 253 {
+		return "", fmt.Errorf("%v: too long", ErrInvalidHost)
+	}
+	return name, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// The parameters of punycode, see RFC 3492.
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+// punycode encodes a label as the part of an A-label following "xn--".
+func punycode(label string) (string, error) {
+	runes := []rune(label)
+	out := make([]byte, 0, 2*len(label))
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	b := len(out)
+	if b > 0 {
+		out = append(out, '-')
+	}
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for h := b; h < len(runes); {
+		m := int(utf8.MaxRune) + 1
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (h + 1)
+		if delta < 0 {
+			return "", fmt.Errorf("%v: cannot encode %q", ErrInvalidHost, label)
+		}
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, h+1, h == b)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// normalizeRequestHost normalizes the hosts of the URL and Host header of req, see
+// NormalizeHost.
+func normalizeRequestHost(req *http.Request) error {
+	if req.URL.Host != "" {
+		host, err := NormalizeHost(req.URL.Host)
+		if err != nil {
+			return err
+		}
+		req.URL.Host = host
+	}
+	if req.Host != "" {
+		host, err := NormalizeHost(req.Host)
+		if err != nil {
+			return err
+		}
+		req.Host = host
+	}
+	return nil
+}
+
+// invalidHostResponse answers the requests whose host is invalid.
+func invalidHostResponse(req *http.Request, err error) *http.Response {
+	return NewResponse(req, ContentTypeText, http.StatusBadRequest, err.Error()+"\n")
+}
@@ -0,0 +1,159 @@
+package goproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HostOverrides maps the hosts of requests and tunnels to the addresses the proxy dials
+// instead, like curl --resolve, e.g. to send the traffic of a production host to a
+// staging server:
+//
+//	proxy.HostOverrides = &goproxy.HostOverrides{}
+//	proxy.HostOverrides.Set("api.example.com:443", "10.0.0.12:8443")
+//	proxy.HostOverrides.Set("www.example.com", "10.0.0.13")
+//	proxy.HostOverrides.Set("docker.local", "unix:/var/run/docker.sock")
+//
+// Addresses starting with "unix:" are paths of unix domain sockets, dialed directly
+// even when ConnectDial sends the tunnels through another proxy.
+// Only the dialed address changes: the Host header, the SNI and the verification of
+// upstream certificates still use the original host. Overrides apply to CONNECT
+// tunnels, MITM'd and plain requests, and may be changed at any time. Changing them
+// closes the idle upstream connections, connections in use keep their address until
+// they are closed.
+type HostOverrides struct {
+	mu sync.RWMutex
+	// m maps "host:port" and "host" to "addr:port", "addr" or "unix:path"
+	m          map[string]string
+	transports []*http.Transport
+}
+
+// Set overrides host, with a port or for all of them, to addr, with a port or keeping
+// the one dialed.
+func (o *HostOverrides) Set(host, addr string) {
+	o.mu.Lock()
+	if o.m == nil {
+		o.m = make(map[string]string)
+	}
+	o.m[host] = addr
+	o.mu.Unlock()
+	o.closeIdle()
+}
+
+// Delete removes the override of host.
+func (o *HostOverrides) Delete(host string) {
+	o.mu.Lock()
+	delete(o.m, host)
+	o.mu.Unlock()
+	o.closeIdle()
+}
+
+// Replace replaces all the overrides with those of m.
+func (o *HostOverrides) Replace(m map[string]string) {
+	o.mu.Lock()
+	o.m = make(map[string]string, len(m))
+	for host, addr := range m {
+		o.m[host] = addr
+	}
+	o.mu.Unlock()
+	o.closeIdle()
+}
+
+// Overrides returns a copy of the overrides.
+func (o *HostOverrides) Overrides() map[string]string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	m := make(map[string]string, len(o.m))
+	for host, addr := range o.m {
+		m[host] = addr
+	}
+	return m
+}
+
+// Hosts returns the sorted overridden hosts.
+func (o *HostOverrides) Hosts() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	hosts := make([]string, 0, len(o.m))
+	for host := range o.m {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Lookup returns the address to dial for addr, a "host:port", and whether it is
+// overridden. An override of the host and port wins over one of the host.
+func (o *HostOverrides) Lookup(addr string) (string, bool) {
+	if o == nil {
+		return addr, false
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if to, ok := o.m[addr]; ok {
+		return to, true
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, false
+	}
+	to, ok := o.m[host]
+	if !ok {
+		return addr, false
+	}
+	if strings.HasPrefix(to, unixPrefix) {
+		return to, true
+	}
+	if _, _, err := net.SplitHostPort(to); err != nil {
+		to = net.JoinHostPort(to, port)
+	}
+	return to, true
+}
+
+const unixPrefix = "unix:"
+
+// dialAddr returns the network and address to dial for addr, once overridden.
+func dialAddr(network, addr string) (string, string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return network, addr
+}
+
+func (o *HostOverrides) closeIdle() {
+	o.mu.RLock()
+	transports := o.transports
+	o.mu.RUnlock()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+type hostOverridesKey struct {
+	base      *http.Transport
+	overrides *HostOverrides
+}
+
+// transport returns a clone of base dialing the overridden addresses.
+func (o *HostOverrides) transport(cache *transportCache, base *http.Transport) *http.Transport {
+	return cache.get(hostOverridesKey{base, o}, func() *http.Transport {
+		t := base.Clone()
+		dial := base.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		t.DialContext = func(c context.Context, network, addr string) (net.Conn, error) {
+			addr, _ = o.Lookup(addr)
+			network, addr = dialAddr(network, addr)
+			return dial(c, network, addr)
+		}
+		o.mu.Lock()
+		o.transports = append(o.transports, t)
+		o.mu.Unlock()
+		return t
+	})
+}
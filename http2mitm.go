@@ -0,0 +1,139 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// offerHTTP2 returns a copy of config offering HTTP/2 to clients, before HTTP/1.1.
+func offerHTTP2(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	protos := []string{"h2", "http/1.1"}
+	for _, p := range config.NextProtos {
+		if p != "h2" && p != "http/1.1" {
+			protos = append(protos, p)
+		}
+	}
+	config.NextProtos = protos
+	return config
+}
+
+// connListener is a net.Listener accepting a single connection, then blocking until
+// it is closed.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if c := l.conn; c != nil {
+		l.conn = nil
+		return c, nil
+	}
+	<-l.closed
+	return nil, errors.New("goproxy: connection closed")
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tcp" }
+func (dummyAddr) String() string  { return "mitm" }
+
+// serveMitmHTTP2 serves the requests of a MITM'd client which negotiated HTTP/2 on
+// conn, each of them in its own stream and goroutine, until the client closes conn.
+func (proxy *ProxyHttpServer) serveMitmHTTP2(connCtx *ProxyCtx, r *http.Request, conn *tls.Conn) {
+	l := &connListener{conn: conn, closed: make(chan struct{})}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			proxy.serveMitmHTTP2Request(connCtx, r, w, req)
+		}),
+		ConnState: func(c net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				l.Close()
+			}
+		},
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+	srv.Serve(l)
+}
+
+func (proxy *ProxyHttpServer) serveMitmHTTP2Request(connCtx *ProxyCtx, r *http.Request, w http.ResponseWriter, req *http.Request) {
+	tunnelID, seq := connCtx.nextInTunnel()
+	ctx := proxy.newCtx(ProxyCtx{Host: r.Host, Req: req, Proxy: proxy, TunnelID: tunnelID, Seq: seq, UserData: connCtx.UserData, ConnData: connCtx.ConnData, ReqData: NewData(), Transport: connCtx.Transport, ClientID: connCtx.ClientID, ClientCert: connCtx.ClientCert, ClientHello: connCtx.ClientHello, ClientTLSState: connCtx.ClientTLSState, http2: true, clientAddr: connCtx.clientAddr})
+	req.RemoteAddr = connCtx.clientAddr
+	proxy.identifyClient(req, ctx)
+	req.URL.Scheme, req.URL.Host = "https", req.Host
+	ctx.Logf("req %v (%s) over HTTP/2", r.Host, req.Host)
+
+	x := &exchange{proxy: proxy, ctx: ctx}
+	req, resp, origBody := x.run(req)
+	if resp == nil {
+		// resets the stream, not the connection
+		panic(http.ErrAbortHandler)
+	}
+	defer resp.Body.Close()
+	if err := writeHTTP2Response(w, resp, bodyLengthKnown(resp, origBody)); err != nil {
+		ctx.Warnf("Cannot write HTTP/2 response to mitm'd client: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	resp.Body.Close()
+	proxy.releaseCtx(ctx)
+}
+
+// writeHTTP2Response writes resp to the stream of w, flushing every piece of the body
+// as soon as it is read, and sends its trailers once the body is read. The body is sent
+// with its original Content-Length if lengthKnown.
+func writeHTTP2Response(w http.ResponseWriter, resp *http.Response, lengthKnown bool) error {
+	h := w.Header()
+	for k, vs := range resp.Header {
+		h[k] = vs
+	}
+	h.Del("Content-Length")
+	if lengthKnown && resp.ContentLength >= 0 && len(resp.Trailer) == 0 {
+		h.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// the trailer is complete once the body is read
+	for k, vs := range resp.Trailer {
+		h[http.TrailerPrefix+k] = vs
+	}
+	return nil
+}
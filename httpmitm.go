@@ -0,0 +1,159 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+)
+
+// httpMitmUpstream is the persistent upstream connection of a ConnectHTTPMitm tunnel.
+// It is redialed when the upstream server closes it between requests.
+type httpMitmUpstream struct {
+	proxy  *ProxyHttpServer
+	ctx    *ProxyCtx
+	conn   net.Conn
+	reader *bufio.Reader
+	// reused is true once a response was read from conn
+	reused bool
+	// used is set by roundTrip, reset for every request of the tunnel
+	used bool
+}
+
+func (u *httpMitmUpstream) dial() error {
+	conn, err := u.proxy.connectDial(u.ctx, "tcp", u.ctx.Host)
+	if err != nil {
+		return err
+	}
+	u.conn, u.reader, u.reused = conn, bufio.NewReader(conn), false
+	return nil
+}
+
+func (u *httpMitmUpstream) close() {
+	if u.conn != nil {
+		u.conn.Close()
+		u.conn = nil
+	}
+}
+
+// roundTrip sends req on the upstream connection and reads its response. Requests
+// without body are retried once on a fresh connection if a reused connection was
+// closed by the upstream server in the meantime.
+func (u *httpMitmUpstream) roundTrip(req *http.Request) (*http.Response, error) {
+	u.used = true
+	for {
+		if u.conn == nil {
+			if err := u.dial(); err != nil {
+				return nil, err
+			}
+		}
+		reused := u.reused
+		err := req.Write(u.conn)
+		var resp *http.Response
+		if err == nil {
+			resp, err = http.ReadResponse(u.reader, req)
+		}
+		if err == nil {
+			u.reused = true
+			return resp, nil
+		}
+		u.close()
+		if !reused || (req.Body != nil && req.Body != http.NoBody) {
+			return nil, err
+		}
+		u.ctx.Logf("Upstream connection closed, redialing %s: %v", u.ctx.Host, err)
+	}
+}
+
+// serveHTTPMitm proxies the plain HTTP/1.1 requests sent by the client through a
+// CONNECT tunnel, filtering them like regular proxy requests, each with its own context.
+// Pipelined requests are served in order, the requests to the CONNECT host are sent on
+// the upstream connection of the tunnel, kept alive between requests, and upgraded
+// connections (101 Switching Protocols) are passed to the OnUpgrade handlers.
+func (proxy *ProxyHttpServer) serveHTTPMitm(ctx *ProxyCtx, r *http.Request, clientConn, targetSiteCon net.Conn) {
+	upstream := &httpMitmUpstream{proxy: proxy, ctx: ctx, conn: targetSiteCon, reader: bufio.NewReader(targetSiteCon)}
+	defer upstream.close()
+	defer clientConn.Close()
+
+	client := proxy.HTTPMitmValidation.newReader(clientConn)
+	for {
+		if err := proxy.HTTPMitmValidation.check(client); err != nil {
+			if invalid, ok := err.(*InvalidRequestError); ok {
+				ctx.Error = err
+				ctx.Warnf("Rejecting MITM HTTP client request: %v", err)
+				if resp := proxy.HTTPMitmValidation.reject(invalid, ctx); resp != nil {
+					resp.Write(clientConn)
+				}
+			}
+			return
+		}
+		req, err := http.ReadRequest(client)
+		if err != nil {
+			if err != io.EOF {
+				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
+			}
+			return
+		}
+		req.RemoteAddr = ctx.clientAddr
+		// the tunnel goes to the CONNECT host, whatever the Host header says
+		req.URL.Scheme, req.URL.Host = "http", ctx.Host
+		tunnelID, seq := ctx.nextInTunnel()
+		ctx := proxy.newCtx(ProxyCtx{Host: ctx.Host, Req: req, Proxy: proxy, TunnelID: tunnelID, Seq: seq, UserData: ctx.UserData, ConnData: ctx.ConnData, ReqData: NewData(), Transport: ctx.Transport, ClientID: ctx.ClientID, UpstreamConnectHeader: ctx.UpstreamConnectHeader, clientAddr: ctx.clientAddr, httpMitm: upstream})
+		proxy.identifyClient(req, ctx)
+		websocket := isWebSocketRequest(req)
+		if websocket {
+			ctx.Logf("Request looks like websocket upgrade.")
+		}
+		upstream.used = false
+		x := &exchange{proxy: proxy, ctx: ctx, prepare: func(req *http.Request) {
+			removeHopByHopHeaders(req.Header)
+		}}
+		req, resp, origBody := x.run(req)
+		if resp == nil {
+			return
+		}
+
+		if resp.StatusCode == http.StatusSwitchingProtocols && origBody != nil {
+			// the upgraded connection is the one of the tunnel, unless the request
+			// was sent elsewhere by the handlers
+			targetSide, ok := origBody.(io.ReadWriteCloser)
+			if upstream.used {
+				targetSide, ok = bufferedConn(upstream.conn, upstream.reader), true
+			}
+			if !ok {
+				ctx.Warnf("Cannot upgrade the connection of MITM HTTP client: the upstream connection is not writable")
+				resp.Body.Close()
+				return
+			}
+			if err := resp.Write(clientConn); err != nil {
+				ctx.Warnf("Cannot write upgrade response to MITM HTTP client: %v", err)
+				return
+			}
+			clientSide := bufferedConn(clientConn, client)
+			if !websocket {
+				proxy.upgrade(ctx, resp, clientSide, targetSide)
+			} else if !proxy.serveUpgrade(ctx, resp, clientSide, targetSide) {
+				proxy.proxyWebsocket(ctx, targetSide, targetSide, clientSide, clientSide)
+			}
+			return
+		}
+
+		if proxy.Draining() {
+			resp.Close = true
+		}
+		err = resp.Write(clientConn)
+		resp.Body.Close()
+		if err != nil {
+			ctx.Warnf("Cannot write response to MITM HTTP client: %v", err)
+			return
+		}
+		if upstream.used && origBody != nil && (resp.Body != origBody || resp.Close) {
+			// the upstream response was not read to its end, or the server is closing
+			upstream.close()
+		}
+		proxy.releaseCtx(ctx)
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
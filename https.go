@@ -5,17 +5,20 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"sync/atomic"
 )
 
 type ConnectActionLiteral int
@@ -47,36 +50,74 @@ type ConnectAction struct {
 	TLSConfig func(host string, ctx *ProxyCtx) (*tls.Config, error)
 }
 
-func stripPort(s string) string {
-	ix := strings.IndexRune(s, ']') // "[IPv6:ADDR::SPEC]:port"
-	if ix > -1 {
-		return s[:ix+1]
-	}
-
-	ix = strings.IndexRune(s, ':') // "IPv4.AD.DR.SPEC:port"
-	if ix == -1 {
-		return s
+func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
+	if tr := proxy.Transport(); tr.DialContext != nil {
+		return tr.DialContext(context.Background(), network, addr)
 	}
-	return s[:ix]
+	return net.Dial(network, addr)
 }
 
-func (proxy *ProxyHttpServer) dial(network, addr string) (c net.Conn, err error) {
-	if proxy.Tr.DialContext != nil {
-		return proxy.Tr.DialContext(context.Background(), network, addr)
+func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (net.Conn, error) {
+	conn, err := proxy.UpstreamLimiter.dial(ctx, addr, func() (net.Conn, error) {
+		to, ok := proxy.HostOverrides.Lookup(addr)
+		if !ok {
+			return proxy.dialUpstream(ctx, network, addr)
+		}
+		ctx.Logf("Dialing %s instead of %s", to, addr)
+		if network, to := dialAddr(network, to); network == "unix" {
+			// unix sockets are local, and not reachable through ConnectDial
+			return proxy.dial(network, to)
+		}
+		return proxy.dialUpstream(ctx, network, to)
+	})
+	if err == nil {
+		if err = proxy.sendProxyHeader(ctx, conn); err != nil {
+			conn.Close()
+			conn = nil
+		}
 	}
-	return net.Dial(network, addr)
+	return conn, err
 }
 
-func (proxy *ProxyHttpServer) connectDial(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
-	if proxy.ConnectDialWithReq == nil && proxy.ConnectDial == nil {
+func (proxy *ProxyHttpServer) dialUpstream(ctx *ProxyCtx, network, addr string) (c net.Conn, err error) {
+	dialWithReq, dial := proxy.connectDials()
+	if dialWithReq == nil && dial == nil {
 		return proxy.dial(network, addr)
 	}
 
-	if proxy.ConnectDialWithReq != nil {
-		return proxy.ConnectDialWithReq(ctx.Req, network, addr)
+	if dialWithReq != nil {
+		c, err = dialWithReq(ctx.Req, network, addr)
+	} else {
+		c, err = dial(network, addr)
 	}
+	if pc, ok := c.(*proxiedConn); ok {
+		// the tunnel uses the connection itself, keeping its half-close methods, and
+		// its *net.TCPConn for the epoll tunnels
+		ctx.UpstreamConnectHeader = pc.connectResp.Header
+		c = pc.Conn
+	}
+	return
+}
 
-	return proxy.ConnectDial(network, addr)
+// proxiedConn is a connection established through an upstream proxy with CONNECT,
+// carrying the response of the upstream proxy.
+type proxiedConn struct {
+	net.Conn
+	connectResp *http.Response
+}
+
+// writeConnectOK accepts the CONNECT request of the client, sending the headers
+// handlers added to ctx.ConnectResponseHeader.
+func writeConnectOK(w io.Writer, ctx *ProxyCtx) {
+	if len(ctx.ConnectResponseHeader) == 0 {
+		w.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		return
+	}
+	bw := bufio.NewWriter(w)
+	io.WriteString(bw, "HTTP/1.0 200 OK\r\n")
+	ctx.ConnectResponseHeader.Write(bw)
+	io.WriteString(bw, "\r\n")
+	bw.Flush()
 }
 
 type halfClosable interface {
@@ -88,7 +129,25 @@ type halfClosable interface {
 var _ halfClosable = (*net.TCPConn)(nil)
 
 func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request) {
-	ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, certStore: proxy.CertStore}
+	ctx := &ProxyCtx{Req: r, Session: proxy.stats.newSession(true), Proxy: proxy, certStore: proxy.CertStore, ConnData: NewData(), ReqData: NewData(), clientAddr: r.RemoteAddr}
+	if err := normalizeRequestHost(r); err != nil {
+		ctx.Error = newProxyError(ctx, ErrMalformedRequest, "", err)
+		ctx.Warnf("Rejecting CONNECT: %v", err)
+		writeResponse(w, invalidHostResponse(r, err))
+		return
+	}
+	proxy.identifyClient(r, ctx)
+
+	if resp := proxy.RateLimiter.checkConnect(r, ctx); resp != nil {
+		proxy.auditConnect(ctx, ConnectDecision{Action: ConnectActionLiteral(ConnectReject).String(), Handler: -1, Error: resp.Status})
+		writeResponse(w, resp)
+		return
+	}
+	if resp := proxy.ConnLimits.checkConnect(r, ctx); resp != nil {
+		proxy.auditConnect(ctx, ConnectDecision{Action: ConnectActionLiteral(ConnectReject).String(), Handler: -1, Error: resp.Status})
+		writeResponse(w, resp)
+		return
+	}
 
 	// Hijack open client connection to directly stream data
 	hij, ok := w.(http.Hijacker)
@@ -100,41 +159,123 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 	if e != nil {
 		panic("Cannot hijack connection " + e.Error())
 	}
+	proxyResponseWriter = proxy.ConnLimits.wrapConn(proxyResponseWriter)
+	proxyResponseWriter = proxy.RateLimiter.wrapTunnel(r, ctx, proxyResponseWriter)
+	proxyResponseWriter = proxy.countTunnel(ctx, proxyResponseWriter)
 
 	// Find an appreciate connect handler
-	ctx.Logf("Running %d CONNECT handlers", len(proxy.httpsHandlers))
+	httpsHandlers := proxy.httpsHandlers.snapshot()
+	ctx.Logf("Running %d CONNECT handlers", len(httpsHandlers))
 	todo, host := OkConnect, r.URL.Host
 	ctx.Host = host
-	for i, h := range proxy.httpsHandlers {
-		newtodo, newhost := h.HandleHttpConnect(host, ctx)
+	handler := -1
+	for i, h := range httpsHandlers {
+		newtodo, newhost := h.handler.(HttpsHandler).HandleHttpConnect(host, ctx)
 
 		// If found a result, break the loop immediately
 		if newtodo != nil {
-			todo, host = newtodo, newhost
+			todo, host, handler = newtodo, newhost, i
 			ctx.Logf("on %dth handler: %v %s", i, todo, host)
 			break
 		}
 	}
 
+	decision := ConnectDecision{Action: todo.Action.String(), Handler: handler, Host: host}
+	if todo.Action == ConnectAccept || todo.Action == ConnectMitm || todo.Action == ConnectHTTPMitm {
+		if resp := proxy.LoopGuard.checkConnect(r, ctx, host); resp != nil {
+			decision.Error = resp.Status
+			proxy.auditConnect(ctx, decision)
+			if err := resp.Write(proxyResponseWriter); err != nil {
+				ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
+			}
+			proxyResponseWriter.Close()
+			return
+		}
+	}
+	if todo.Action == ConnectMitm || todo.Action == ConnectHTTPMitm {
+		if resp := proxy.ConnLimits.checkMitm(r, ctx); resp != nil {
+			decision.Error = resp.Status
+			proxy.auditConnect(ctx, decision)
+			if err := resp.Write(proxyResponseWriter); err != nil {
+				ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
+			}
+			proxyResponseWriter.Close()
+			return
+		}
+		proxyResponseWriter = proxy.ConnLimits.wrapMitm(proxyResponseWriter)
+	}
 	switch todo.Action {
 
 	case ConnectAccept:
-		if !hasPort.MatchString(host) {
-			host += ":80"
-		}
+		host = withPort(host, "80")
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
+			ctx.Error = newProxyError(ctx, ErrDialUpstream, host, err)
+			ctx.Warnf("%v", ctx.Error)
+			decision.Error = err.Error()
+			proxy.auditConnect(ctx, decision)
 			httpError(proxyResponseWriter, ctx, err)
 			return
 		}
+		proxy.auditConnect(ctx, decision)
 		ctx.Logf("Accepting CONNECT to %s", host)
-		proxyResponseWriter.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		writeConnectOK(proxyResponseWriter, ctx)
+		var sniff *TunnelSniff
+		if proxy.TunnelPolicy != nil {
+			sniff, proxyResponseWriter, targetSiteCon = proxy.applyTunnelPolicy(ctx, host, proxyResponseWriter, targetSiteCon)
+			if proxyResponseWriter == nil {
+				return
+			}
+		}
+		if proxy.CaptureClientHello && (sniff == nil || sniff.Protocol == TunnelTLS) {
+			// the servers of protocols such as SSH or SMTP speak first, their clients
+			// send no ClientHello
+			stop := interruptReadsAfter(proxy.clock(), proxyResponseWriter, proxy.tunnelSniffTimeout())
+			raw, hello, err := readClientHello(proxyResponseWriter)
+			stop()
+			if hello != nil {
+				ctx.ClientHello = hello
+				ctx.Logf("ClientHello from %s JA3 %s JA4 %s", r.RemoteAddr, hello.JA3Hash(), hello.JA4())
+			} else {
+				ctx.Logf("Cannot parse ClientHello from tunneled client: %v", err)
+			}
+			if _, err := targetSiteCon.Write(raw); err != nil {
+				ctx.Warnf("Cannot forward ClientHello to %s: %v", host, err)
+				proxyResponseWriter.Close()
+				targetSiteCon.Close()
+				return
+			}
+		}
 
+		if proxy.EpollTunnels {
+			if client, ok := epollConn(proxyResponseWriter); !ok {
+				ctx.Logf("Cannot forward the tunnel to %s with epoll, data of the client is buffered", host)
+			} else if tunnel := newEpollTunnel(client, targetSiteCon); tunnel != nil {
+				ctx.Logf("Forwarding the tunnel to %s with epoll", host)
+				tunnel.start(proxy.conns.track(ctx, ConnTunnel, host, tunnel))
+				return
+			}
+		}
+		untrack := proxy.conns.track(ctx, ConnTunnel, host, proxyResponseWriter, targetSiteCon)
 		targetTCP, targetOK := targetSiteCon.(halfClosable)
 		proxyClientTCP, clientOK := proxyResponseWriter.(halfClosable)
 		if targetOK && clientOK {
-			go copyAndClose(ctx, targetTCP, proxyClientTCP)
-			go copyAndClose(ctx, proxyClientTCP, targetTCP)
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				copyAndClose(ctx, targetTCP, proxyClientTCP)
+				wg.Done()
+			}()
+			go func() {
+				copyAndClose(ctx, proxyClientTCP, targetTCP)
+				wg.Done()
+			}()
+			go func() {
+				wg.Wait()
+				proxyResponseWriter.Close()
+				targetSiteCon.Close()
+				untrack()
+			}()
 		} else {
 			go func() {
 				var wg sync.WaitGroup
@@ -144,54 +285,33 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 				wg.Wait()
 				proxyResponseWriter.Close()
 				targetSiteCon.Close()
-
+				untrack()
 			}()
 		}
 
 	case ConnectHijack:
+		proxy.auditConnect(ctx, decision)
 		todo.Hijack(r, proxyResponseWriter, ctx)
 
 	case ConnectHTTPMitm:
-		proxyResponseWriter.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		writeConnectOK(proxyResponseWriter, ctx)
 		ctx.Logf("Assuming CONNECT is plain HTTP tunneling, mitm proxying it")
 		ctx.Host = host
 		targetSiteCon, err := proxy.connectDial(ctx, "tcp", host)
 		if err != nil {
-			ctx.Warnf("Error dialing to %s: %s", host, err.Error())
+			ctx.Error = newProxyError(ctx, ErrDialUpstream, host, err)
+			ctx.Warnf("%v", ctx.Error)
+			decision.Error = err.Error()
+			proxy.auditConnect(ctx, decision)
+			proxyResponseWriter.Close()
 			return
 		}
-		for {
-			client := bufio.NewReader(proxyResponseWriter)
-			remote := bufio.NewReader(targetSiteCon)
-			req, err := http.ReadRequest(client)
-			if err != nil && err != io.EOF {
-				ctx.Warnf("cannot read request of MITM HTTP client: %+#v", err)
-			}
-			if err != nil {
-				return
-			}
-			req, resp := proxy.filterRequest(req, ctx)
-			if resp == nil {
-				if err := req.Write(targetSiteCon); err != nil {
-					httpError(proxyResponseWriter, ctx, err)
-					return
-				}
-				resp, err = http.ReadResponse(remote, req)
-				if err != nil {
-					httpError(proxyResponseWriter, ctx, err)
-					return
-				}
-				defer resp.Body.Close()
-			}
-			resp = proxy.filterResponse(resp, ctx)
-			if err := resp.Write(proxyResponseWriter); err != nil {
-				httpError(proxyResponseWriter, ctx, err)
-				return
-			}
-		}
+		proxy.auditConnect(ctx, decision)
+		defer proxy.conns.track(ctx, ConnHTTPMitm, host, proxyResponseWriter, targetSiteCon)()
+		proxy.serveHTTPMitm(ctx, r, proxyResponseWriter, targetSiteCon)
 
 	case ConnectMitm:
-		proxyResponseWriter.Write([]byte("HTTP/1.0 200 OK\r\n\r\n"))
+		writeConnectOK(proxyResponseWriter, ctx)
 		ctx.Logf("Assuming CONNECT is TLS, mitm proxying it")
 		// this goes in a separate goroutine, so that the net/http server won't think we're
 		// still handling the request even after hijacking the connection. Those HTTP CONNECT
@@ -202,35 +322,92 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 			var err error
 			tlsConfig, err = todo.TLSConfig(host, ctx)
 			if err != nil {
+				ctx.Warnf("Cannot MITM %s: %v", host, err)
+				decision.Error = err.Error()
+				proxy.auditConnect(ctx, decision)
 				httpError(proxyResponseWriter, ctx, err)
 				return
 			}
 		}
+		if proxy.MitmClientAuth != tls.NoClientCert {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ClientAuth = proxy.MitmClientAuth
+			tlsConfig.ClientCAs = proxy.MitmClientCAs
+		}
+		if policy := proxy.MitmTLSPolicy.ForHost(host); policy != nil {
+			tlsConfig = tlsConfig.Clone()
+			policy.Apply(tlsConfig)
+		}
+		if proxy.MitmSessionTicketKeys != nil {
+			tlsConfig = tlsConfig.Clone()
+			proxy.MitmSessionTicketKeys.apply(tlsConfig)
+		}
+		if proxy.MitmHTTP2 {
+			tlsConfig = offerHTTP2(tlsConfig)
+		}
+		if proxy.ConnectAudit != nil {
+			tlsConfig = recordCertSerial(tlsConfig, &decision.CertSerial)
+		}
 		go func() {
 			//TODO: cache connections to the remote website
+			defer proxy.conns.track(ctx, ConnMitm, host, proxyResponseWriter)()
+
+			var clientConn net.Conn = proxyResponseWriter
+			if proxy.CaptureClientHello {
+				raw, hello, err := readClientHello(proxyResponseWriter)
+				if hello != nil {
+					ctx.ClientHello = hello
+					ctx.Logf("ClientHello from %s JA3 %s JA4 %s", r.RemoteAddr, hello.JA3Hash(), hello.JA4())
+				} else {
+					ctx.Logf("Cannot parse ClientHello from mitm'd client: %v", err)
+				}
+				clientConn = newReplayConn(proxyResponseWriter, raw)
+			}
 
 			// Create a TLS server toward client
-			rawClientTls := tls.Server(proxyResponseWriter, tlsConfig)
-			if err := rawClientTls.Handshake(); err != nil {
-				ctx.Warnf("Cannot handshake client %v %v", r.Host, err)
+			rawClientTls := tls.Server(clientConn, tlsConfig)
+			err := proxy.TLSWorkers.handshake(proxy.clock(), rawClientTls)
+			clientState := rawClientTls.ConnectionState()
+			decision.SNI = clientState.ServerName
+			if err != nil {
+				ctx.Error = newProxyError(ctx, ErrTLSHandshakeClient, host, err)
+				ctx.Warnf("%v", ctx.Error)
+				decision.Error = err.Error()
+				proxy.auditConnect(ctx, decision)
+				proxyResponseWriter.Close()
+				return
+			}
+			proxy.auditConnect(ctx, decision)
+			client := &mitmConn{conn: rawClientTls}
+			defer client.close()
+			ctx.ClientTLSState = &clientState
+			if certs := clientState.PeerCertificates; len(certs) > 0 {
+				ctx.ClientCert = certs[0]
+			}
+			ctx.Logf("Client TLS %s %s ALPN %q SNI %q", TLSVersionName(clientState.Version),
+				tls.CipherSuiteName(clientState.CipherSuite), clientState.NegotiatedProtocol, clientState.ServerName)
+			if clientState.NegotiatedProtocol == "h2" {
+				proxy.serveMitmHTTP2(ctx, r, rawClientTls)
 				return
 			}
-			defer rawClientTls.Close()
 
 			clientTlsReader := bufio.NewReader(rawClientTls)
+			client.reader = clientTlsReader
 			for !isEof(clientTlsReader) {
 				req, err := http.ReadRequest(clientTlsReader)
 				if err != nil && err != io.EOF {
 					return
 				}
+				tunnelID, seq := ctx.nextInTunnel()
 
-				ctx := &ProxyCtx{Host: r.Host, Req: req, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy, UserData: ctx.UserData}
+				ctx := proxy.newCtx(ProxyCtx{Host: r.Host, Req: req, Proxy: proxy, TunnelID: tunnelID, Seq: seq, UserData: ctx.UserData, ConnData: ctx.ConnData, ReqData: NewData(), Transport: ctx.Transport, ClientID: ctx.ClientID, ClientCert: ctx.ClientCert, ClientHello: ctx.ClientHello, ClientTLSState: ctx.ClientTLSState, mitmConn: client, clientAddr: ctx.clientAddr})
 
 				if err != nil {
 					ctx.Warnf("Cannot read TLS request from mitm'd client %v %v", r.Host, err)
 					return
 				}
-				req.RemoteAddr = r.RemoteAddr // since we're converting the request, need to carry over the original connecting IP as well
+				req.RemoteAddr = ctx.clientAddr // since we're converting the request, need to carry over the original connecting IP as well
+				proxy.identifyClient(req, ctx)
 				ctx.Logf("req %v (%s)", r.Host, req.Host)
 
 				if !httpsRegexp.MatchString(req.URL.String()) {
@@ -238,88 +415,58 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 					req.URL, err = url.Parse("https://" + req.Host + req.URL.String())
 				}
 
+				if err != nil {
+					ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
+					return
+				}
+
 				// Bug fix which goproxy fails to provide request
 				// information URL in the context when does HTTPS MITM
 				ctx.Req = req
 
-				// do pre-request filterings
-				req, resp := proxy.filterRequest(req, ctx)
-
-				// run the request
-				if resp == nil {
-					if isWebSocketRequest(req) {
+				x := &exchange{proxy: proxy, ctx: ctx,
+					roundTrip: func(req *http.Request) (*http.Response, error) {
+						// relay 1xx responses (100 Continue, 103 Early Hints) as they arrive
+						req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+							Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+								ctx.Logf("Relaying interim response %d", code)
+								return writeInterimResponse(rawClientTls, code, http.Header(header))
+							},
+						}))
+						return ctx.RoundTrip(req)
+					},
+					intercept: func(req *http.Request) bool {
+						if !isWebSocketRequest(req) {
+							return false
+						}
 						ctx.Logf("Request looks like websocket upgrade.")
-						proxy.serveWebsocketTLS(ctx, w, req, tlsConfig, rawClientTls)
-						return
-					}
-					if err != nil {
-						ctx.Warnf("Illegal URL %s", "https://"+r.Host+req.URL.Path)
-						return
-					}
-					removeProxyHeaders(ctx, req)
-					resp, err = ctx.RoundTrip(req)
-					if err != nil {
-						ctx.Warnf("Cannot read TLS response from mitm'd server %v", err)
-						return
-					}
-					ctx.Logf("resp %v", resp.Status)
-				}
-
-				// do post-request filterings
-				resp = proxy.filterResponse(resp, ctx)
-				defer resp.Body.Close()
-
-				// Write http response to client
-				text := resp.Status
-				statusCode := strconv.Itoa(resp.StatusCode) + " "
-				if strings.HasPrefix(text, statusCode) {
-					text = text[len(statusCode):]
-				}
-				// always use 1.1 to support chunked encoding
-				if _, err = io.WriteString(rawClientTls, "HTTP/1.1"+" "+statusCode+text+"\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response HTTP status from mitm'd client: %v", err)
-					return
+						proxy.serveWebsocketTLS(ctx, w, req, tlsConfig, rawClientTls, clientTlsReader)
+						return true
+					},
 				}
-
-				if resp.Request.Method == "HEAD" {
-					// don't change Content-Length for HEAD request
-				} else {
-					// Since we don't know the length of resp, return chunked encoded response
-					// TODO: use a more reasonable scheme
-					resp.Header.Del("Content-Length")
-					resp.Header.Set("Transfer-Encoding", "chunked")
-				}
-
-				// Force connection close otherwise chrome will keep CONNECT tunnel open forever
-				resp.Header.Set("Connection", "close")
-				if err = resp.Header.Write(rawClientTls); err != nil {
-					ctx.Warnf("Cannot write TLS response header from mitm'd client: %v", err)
-					return
-				}
-				if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-					ctx.Warnf("Cannot write TLS response header end from mitm'd client: %v", err)
+				req, resp, origBody := x.run(req)
+				if resp == nil {
 					return
 				}
 
-				if resp.Request.Method == "HEAD" {
-					// Don't write out a response body for HEAD request
-				} else {
-					chunked := newChunkedWriter(rawClientTls)
-					if _, err := io.Copy(chunked, resp.Body); err != nil {
-						ctx.Warnf("Cannot write TLS response body from mitm'd client: %v", err)
-						return
-					}
-					if err := chunked.Close(); err != nil {
-						ctx.Warnf("Cannot write TLS chunked EOF from mitm'd client: %v", err)
-						return
-					}
-					if _, err = io.WriteString(rawClientTls, "\r\n"); err != nil {
-						ctx.Warnf("Cannot write TLS response chunked trailer from mitm'd client: %v", err)
+				// Write http response to client
+				if upstream, ok := origBody.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+					if err := writeUpgradeResponse(rawClientTls, resp); err != nil {
+						ctx.Warnf("Cannot write upgrade response to mitm'd client: %v", err)
 						return
 					}
+					proxy.upgrade(ctx, resp, bufferedConn(rawClientTls, clientTlsReader), upstream)
+					return
 				}
-
+				keepAlive := proxy.MitmKeepAlive && !req.Close && !resp.Close && !proxy.Draining()
+				err = writeMitmResponse(rawClientTls, resp, bodyLengthKnown(resp, origBody), keepAlive)
+				resp.Body.Close()
 				if err != nil {
+					ctx.Warnf("Cannot write TLS response to mitm'd client: %v", err)
+					return
+				}
+				proxy.releaseCtx(ctx)
+				if !keepAlive {
 					return
 				}
 			}
@@ -327,10 +474,12 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 		}()
 
 	case ConnectProxyAuthHijack:
+		proxy.auditConnect(ctx, decision)
 		proxyResponseWriter.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n"))
 		todo.Hijack(r, proxyResponseWriter, ctx)
 
 	case ConnectReject:
+		proxy.auditConnect(ctx, decision)
 		if ctx.Resp != nil {
 			if err := ctx.Resp.Write(proxyResponseWriter); err != nil {
 				ctx.Warnf("Cannot write response that reject http CONNECT: %v", err)
@@ -341,7 +490,11 @@ func (proxy *ProxyHttpServer) handleHttps(w http.ResponseWriter, r *http.Request
 }
 
 func httpError(w io.WriteCloser, ctx *ProxyCtx, err error) {
-	if _, err := io.WriteString(w, "HTTP/1.1 502 Bad Gateway\r\n\r\n"); err != nil {
+	status := "HTTP/1.1 502 Bad Gateway\r\n\r\n"
+	if err == ErrUpstreamBusy {
+		status = "HTTP/1.1 503 Service Unavailable\r\n\r\n"
+	}
+	if _, err := io.WriteString(w, status); err != nil {
 		ctx.Warnf("Error responding to client: %s", err)
 	}
 	if err := w.Close(); err != nil {
@@ -386,9 +539,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 		return nil
 	}
 	if u.Scheme == "" || u.Scheme == "http" {
-		if !hasPort.MatchString(u.Host) {
-			u.Host += ":80"
-		}
+		u.Host = withPort(u.Host, "80")
 		return func(network, addr string) (net.Conn, error) {
 			connectReq := &http.Request{
 				Method: "CONNECT",
@@ -396,6 +547,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 				Host:   addr,
 				Header: make(http.Header),
 			}
+			proxy.LoopGuard.addVia(proxy, connectReq)
 			if connectReqHandler != nil {
 				connectReqHandler(connectReq)
 			}
@@ -404,9 +556,7 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 				return nil, err
 			}
 			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
+			// Read response, the bytes buffered after it are kept by proxiedConnection.
 			br := bufio.NewReader(c)
 			resp, err := http.ReadResponse(br, connectReq)
 			if err != nil {
@@ -422,32 +572,29 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 				c.Close()
 				return nil, errors.New("proxy refused connection" + string(resp))
 			}
-			return c, nil
+			return proxiedConnection(c, br, resp), nil
 		}
 	}
 	if u.Scheme == "https" || u.Scheme == "wss" {
-		if !hasPort.MatchString(u.Host) {
-			u.Host += ":443"
-		}
+		u.Host = withPort(u.Host, "443")
 		return func(network, addr string) (net.Conn, error) {
 			c, err := proxy.dial(network, u.Host)
 			if err != nil {
 				return nil, err
 			}
-			c = tls.Client(c, proxy.Tr.TLSClientConfig)
+			c = tls.Client(c, proxy.Transport().TLSClientConfig)
 			connectReq := &http.Request{
 				Method: "CONNECT",
 				URL:    &url.URL{Opaque: addr},
 				Host:   addr,
 				Header: make(http.Header),
 			}
+			proxy.LoopGuard.addVia(proxy, connectReq)
 			if connectReqHandler != nil {
 				connectReqHandler(connectReq)
 			}
 			connectReq.Write(c)
-			// Read response.
-			// Okay to use and discard buffered reader here, because
-			// TLS server will not speak until spoken to.
+			// Read response, the bytes buffered after it are kept by proxiedConnection.
 			br := bufio.NewReader(c)
 			resp, err := http.ReadResponse(br, connectReq)
 			if err != nil {
@@ -463,15 +610,35 @@ func (proxy *ProxyHttpServer) NewConnectDialToProxyWithHandler(https_proxy strin
 				c.Close()
 				return nil, errors.New("proxy refused connection" + string(body))
 			}
-			return c, nil
+			return proxiedConnection(c, br, resp), nil
 		}
 	}
 	return nil
 }
 
+// proxiedConnection returns the connection c tunneled through an upstream proxy, which
+// answered resp. The data the server sent along with resp, e.g. the banner of servers
+// speaking first, is read from br first.
+func proxiedConnection(c net.Conn, br *bufio.Reader, resp *http.Response) *proxiedConn {
+	if br.Buffered() > 0 {
+		c = keepHalfClose(bufferedConn(c, br), c)
+	}
+	return &proxiedConn{c, resp}
+}
+
 func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls.Config, error) {
 	return func(host string, ctx *ProxyCtx) (*tls.Config, error) {
-		hostname := stripPort(host)
+		ca := ca
+		if ca == &GoproxyCa && ctx.Proxy != nil && ctx.Proxy.CA != nil {
+			// the default actions sign with the CA of the proxy
+			ca = ctx.Proxy.CA
+		}
+		if ctx.Proxy != nil {
+			if err := ctx.Proxy.checkDemoCA(ca); err != nil {
+				return nil, err
+			}
+		}
+		hostname := hostWithoutPort(host)
 		config := defaultTLSConfig.Clone()
 		config.GetCertificate = func(hello *tls.ClientHelloInfo) (cert *tls.Certificate, err error) {
 
@@ -479,13 +646,37 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 				hostname = hello.ServerName
 			}
 
-			ctx.Logf("signing for %s", hostname)
-
+			hosts := []string{hostname}
+			if ctx.Proxy != nil {
+				if wildcard := ctx.Proxy.WildcardCerts.hosts(hostname, ctx); wildcard != nil {
+					hosts = wildcard
+				}
+			}
+			ctx.Logf("signing for %s", hosts[0])
+
+			var opts signOptions
+			if ctx.Proxy != nil {
+				opts.deterministic = ctx.Proxy.DeterministicCerts
+				opts.now = ctx.Proxy.clock().Now()
+				opts.serial = ctx.Proxy.Rand
+				if ctx.Proxy.CertExtensions != nil {
+					opts.extensions = ctx.Proxy.CertExtensions(hosts, ctx)
+				}
+			}
 			genCert := func() (*tls.Certificate, error) {
-				return signHost(*ca, []string{hostname})
+				return signHostWith(*ca, hosts, opts)
+			}
+			if ctx.Proxy != nil && ctx.Proxy.TLSWorkers != nil {
+				sign, workers, clock := genCert, ctx.Proxy.TLSWorkers, ctx.Proxy.clock()
+				genCert = func() (*tls.Certificate, error) {
+					return workers.sign(clock, sign)
+				}
 			}
 			if ctx.certStore != nil {
-				cert, err = ctx.certStore.Fetch(hostname, genCert)
+				if cache, ok := ctx.certStore.(*CertCache); ok {
+					cache.proxyClock.inherit(ctx.Proxy)
+				}
+				cert, err = ctx.certStore.Fetch(hosts[0], genCert)
 			} else {
 				cert, err = genCert()
 			}
@@ -494,3 +685,118 @@ func TLSConfigFromCA(ca *tls.Certificate) func(host string, ctx *ProxyCtx) (*tls
 		return config, nil
 	}
 }
+
+// writeInterimResponse writes an informational (1xx) response to a MITM'd client.
+func writeInterimResponse(w io.Writer, code int, header http.Header) error {
+	bw := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(bw, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code)); err != nil {
+		return err
+	}
+	if err := header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(bw, "\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// writeMitmResponse writes resp to a MITM'd client connection. The body is sent with
+// its original Content-Length if lengthKnown, chunked otherwise. Every piece of the
+// body is flushed to the client as soon as it is read from upstream, so that streamed
+// responses such as server-sent events, long polling or gRPC are not delayed.
+func writeMitmResponse(w io.Writer, resp *http.Response, lengthKnown, keepAlive bool) error {
+	bw := bufio.NewWriter(w)
+	text := resp.Status
+	statusCode := strconv.Itoa(resp.StatusCode) + " "
+	if strings.HasPrefix(text, statusCode) {
+		text = text[len(statusCode):]
+	}
+	// always use 1.1 to support chunked encoding
+	if _, err := io.WriteString(bw, "HTTP/1.1 "+statusCode+text+"\r\n"); err != nil {
+		return err
+	}
+
+	hasBody := resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified &&
+		(resp.Request == nil || resp.Request.Method != "HEAD")
+	chunked := false
+	if hasBody {
+		if len(resp.Trailer) > 0 {
+			// trailers can only be sent with chunked encoding
+			resp.Header.Set("Trailer", trailerNames(resp.Trailer))
+			lengthKnown = false
+		}
+		if lengthKnown && resp.ContentLength >= 0 {
+			resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+			resp.Header.Del("Transfer-Encoding")
+		} else {
+			resp.Header.Del("Content-Length")
+			resp.Header.Set("Transfer-Encoding", "chunked")
+			chunked = true
+		}
+	}
+	// Unless keep-alive is enabled, force connection close otherwise chrome will keep CONNECT tunnel open forever
+	if keepAlive {
+		resp.Header.Del("Connection")
+	} else {
+		resp.Header.Set("Connection", "close")
+	}
+	if err := resp.Header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(bw, "\r\n"); err != nil {
+		return err
+	}
+	if !hasBody {
+		return bw.Flush()
+	}
+
+	var body io.Writer = bw
+	var chunkedWriter io.WriteCloser
+	if chunked {
+		chunkedWriter = newChunkedWriter(bw)
+		body = chunkedWriter
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := body.Write(buf[:n]); err != nil {
+				return err
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if chunked {
+		if err := chunkedWriter.Close(); err != nil {
+			return err
+		}
+		// the trailer is complete once the body is read
+		if err := resp.Trailer.Write(bw); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(bw, "\r\n"); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// trailerNames returns the value of the Trailer header announcing the fields of trailer.
+func trailerNames(trailer http.Header) string {
+	names := make([]string, 0, len(trailer))
+	for k := range trailer {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
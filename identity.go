@@ -0,0 +1,93 @@
+package goproxy
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIdentifier returns the identity of the client sending req, or "" if unknown.
+// It is set as ProxyHttpServer.ClientIdentifier, and its result is available to the
+// handlers as ProxyCtx.ClientID.
+//
+// The identity of a CONNECT request is inherited by the requests MITM'd from its
+// tunnel, so that identifiers based on Proxy-Authorization keep working. Requests of
+// tunnels without identity are identified once decrypted, which allows identifying
+// MITM'd clients by certificate.
+type ClientIdentifier func(req *http.Request, ctx *ProxyCtx) string
+
+// IdentifyByProxyAuthUser identifies clients by the user name of their Basic
+// Proxy-Authorization header. The password is not checked, see ext/auth for that.
+func IdentifyByProxyAuthUser(req *http.Request, ctx *ProxyCtx) string {
+	auth := strings.SplitN(req.Header.Get("Proxy-Authorization"), " ", 2)
+	if len(auth) != 2 || !strings.EqualFold(auth[0], "Basic") {
+		return ""
+	}
+	credentials, err := base64.StdEncoding.DecodeString(auth[1])
+	if err != nil {
+		return ""
+	}
+	if i := strings.IndexByte(string(credentials), ':'); i >= 0 {
+		return string(credentials[:i])
+	}
+	return ""
+}
+
+// IdentifyByClientCert identifies MITM'd clients by the common name of their
+// certificate, see ProxyHttpServer.MitmClientAuth.
+func IdentifyByClientCert(req *http.Request, ctx *ProxyCtx) string {
+	if ctx.ClientCert == nil {
+		return ""
+	}
+	return ctx.ClientCert.Subject.CommonName
+}
+
+// IdentifyBySourceIP identifies clients by their IP address.
+func IdentifyBySourceIP(req *http.Request, ctx *ProxyCtx) string {
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return ip
+	}
+	return req.RemoteAddr
+}
+
+// IdentifyByHeader identifies clients by the value of a request header, e.g. one set
+// by a trusted load balancer in front of the proxy.
+func IdentifyByHeader(name string) ClientIdentifier {
+	return func(req *http.Request, ctx *ProxyCtx) string {
+		return req.Header.Get(name)
+	}
+}
+
+// FirstIdentity returns the first identity found by identifiers, e.g.
+//
+//	proxy.ClientIdentifier = goproxy.FirstIdentity(goproxy.IdentifyByProxyAuthUser, goproxy.IdentifyBySourceIP)
+func FirstIdentity(identifiers ...ClientIdentifier) ClientIdentifier {
+	return func(req *http.Request, ctx *ProxyCtx) string {
+		for _, identify := range identifiers {
+			if id := identify(req, ctx); id != "" {
+				return id
+			}
+		}
+		return ""
+	}
+}
+
+// identifyClient sets ctx.ClientID if it is not already known.
+func (proxy *ProxyHttpServer) identifyClient(req *http.Request, ctx *ProxyCtx) {
+	if ctx.ClientID == "" && proxy.ClientIdentifier != nil {
+		ctx.ClientID = proxy.ClientIdentifier(req, ctx)
+	}
+}
+
+// ClientIdIs returns a ReqCondition testing whether the identity of the client, see
+// ClientIdentifier, is one of the given ones.
+func ClientIdIs(ids ...string) ReqConditionFunc {
+	idSet := make(map[string]bool)
+	for _, id := range ids {
+		idSet[id] = true
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return ctx.ClientID != "" && idSet[ctx.ClientID]
+	}
+}
@@ -0,0 +1,307 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrProxyLoop is the Kind of the ProxyError of the requests and tunnels rejected by
+// LoopGuard.
+var ErrProxyLoop = errors.New("goproxy: request loops back to the proxy")
+
+// localIPsTTL is how long the addresses of the local interfaces are cached.
+const localIPsTTL = time.Minute
+
+// addrsResolveTimeout bounds the lookups of the hosts of LoopGuard.Addrs.
+const addrsResolveTimeout = 5 * time.Second
+
+// LoopGuard rejects the requests and CONNECT tunnels looping back to the proxy, each
+// hop holding a connection and its goroutines until the proxy runs out of them:
+//
+//	proxy.LoopGuard = &goproxy.LoopGuard{Via: "goproxy"}
+//
+// A destination is the proxy when its port is one the proxy listens on, and its host
+// resolves to the listen address, or to a loopback, unspecified or local interface
+// address if the proxy listens on all of them. The listen addresses are learned from
+// the client connections, Addrs adds the ones the proxy is reached at through NAT or
+// port forwarding.
+//
+// Chained proxies detect loops from the Via header: requests carrying the pseudonym of
+// the proxy went through it already. It is added to the requests sent upstream, by
+// ForwardingHeaders if its Via is the same, and to the CONNECT requests sent by
+// NewConnectDialToProxy, but the proxies do not forward the Via header of the CONNECT
+// requests they receive to the ones they send.
+type LoopGuard struct {
+	// Addrs are other addresses of the proxy, "host:port", e.g. its public address
+	Addrs []string
+	// Via is the pseudonym of the proxy in Via headers, ForwardingHeaders.Via if
+	// empty. Loops are not detected from Via headers if both are empty.
+	Via string
+	// Status is the status of the responses to the rejected requests, 508 Loop
+	// Detected by default
+	Status int
+	// OnLoop, if set, is called for each rejected request or tunnel with its error,
+	// matching ErrProxyLoop. It must not block.
+	OnLoop func(ctx *ProxyCtx, err error)
+	// Resolver resolves the destination hosts, net.DefaultResolver if nil
+	Resolver *net.Resolver
+
+	// listen holds the loopAddr of the listen addresses the clients connected to
+	listen sync.Map
+
+	mu       sync.Mutex
+	self     []loopAddr
+	selfPort map[string]bool
+	localIPs []net.IP
+	localAt  time.Time
+}
+
+// loopAddr is an address of the proxy, ip being unspecified if it listens on all the
+// local addresses.
+type loopAddr struct {
+	ip   net.IP
+	port string
+}
+
+// pseudonym returns the pseudonym of proxy in Via headers.
+func (l *LoopGuard) pseudonym(proxy *ProxyHttpServer) string {
+	if l.Via != "" {
+		return l.Via
+	}
+	if proxy != nil && proxy.ForwardingHeaders != nil {
+		return proxy.ForwardingHeaders.Via
+	}
+	return ""
+}
+
+// addVia adds the pseudonym of proxy to the Via header of the CONNECT request req sent
+// to an upstream proxy.
+func (l *LoopGuard) addVia(proxy *ProxyHttpServer, req *http.Request) {
+	if l == nil {
+		return
+	}
+	if name := l.pseudonym(proxy); name != "" {
+		req.Header.Add("Via", "1.1 "+name)
+	}
+}
+
+// addRequestVia adds the pseudonym of proxy to the Via header of req, about to be sent
+// upstream, unless ForwardingHeaders adds it already.
+func (l *LoopGuard) addRequestVia(proxy *ProxyHttpServer, req *http.Request) {
+	if l == nil {
+		return
+	}
+	name := l.pseudonym(proxy)
+	if name == "" || proxy.ForwardingHeaders != nil && proxy.ForwardingHeaders.Via == name {
+		return
+	}
+	req.Header.Add("Via", viaValue(req.ProtoMajor, req.ProtoMinor, name))
+}
+
+// viaLoop reports whether the Via header h names the proxy as an intermediary.
+func viaLoop(h http.Header, name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, v := range h.Values("Via") {
+		for _, hop := range strings.Split(v, ",") {
+			// received-protocol received-by [comment]
+			if f := strings.Fields(hop); len(f) >= 2 && strings.EqualFold(f[1], name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// learn records the listen address of the connection req was received on.
+func (l *LoopGuard) learn(req *http.Request) {
+	addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return
+	}
+	key := addr.String()
+	if _, ok := l.listen.Load(key); ok {
+		return
+	}
+	host, port, err := net.SplitHostPort(key)
+	if ip := net.ParseIP(host); err == nil && ip != nil {
+		l.listen.Store(key, loopAddr{ip, port})
+	}
+}
+
+// refresh updates the addresses of the local interfaces and of Addrs once they are
+// older than localIPsTTL. The lookups are made without holding l.mu, nor depending on
+// the request of ctx.
+func (l *LoopGuard) refresh(ctx *ProxyCtx) {
+	now := ctx.Proxy.clock().Now()
+	l.mu.Lock()
+	if l.selfPort != nil && now.Sub(l.localAt) < localIPsTTL {
+		l.mu.Unlock()
+		return
+	}
+	l.localAt = now
+	l.mu.Unlock()
+
+	var localIPs []net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok {
+				localIPs = append(localIPs, ipNet.IP)
+			}
+		}
+	} else {
+		ctx.Warnf("Cannot list the local addresses: %v", err)
+	}
+	var self []loopAddr
+	selfPort := make(map[string]bool)
+	resolveCtx, cancel := context.WithTimeout(context.Background(), addrsResolveTimeout)
+	defer cancel()
+	for _, addr := range l.Addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			ctx.Warnf("Ignoring invalid LoopGuard address %q: %v", addr, err)
+			continue
+		}
+		for _, ip := range l.resolve(resolveCtx, host) {
+			self = append(self, loopAddr{ip, port})
+		}
+		selfPort[port] = true
+	}
+	l.mu.Lock()
+	l.localIPs, l.self, l.selfPort = localIPs, self, selfPort
+	l.mu.Unlock()
+}
+
+func (l *LoopGuard) resolve(ctx context.Context, host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+	r := l.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		// the dial will fail too
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+func (l *LoopGuard) isLocal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, local := range l.localIPs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSelf reports whether hostport, with a port, is an address of the proxy.
+func (l *LoopGuard) isSelf(ctx *ProxyCtx, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	l.refresh(ctx)
+	var listening []loopAddr
+	l.listen.Range(func(_, v interface{}) bool {
+		if a := v.(loopAddr); a.port == port {
+			listening = append(listening, a)
+		}
+		return true
+	})
+	l.mu.Lock()
+	self, selfPort := l.self, l.selfPort[port]
+	l.mu.Unlock()
+	if len(listening) == 0 && !selfPort {
+		return false
+	}
+	reqCtx := context.Background()
+	if ctx.Req != nil {
+		reqCtx = ctx.Req.Context()
+	}
+	for _, ip := range l.resolve(reqCtx, host) {
+		for _, a := range listening {
+			if a.ip.IsUnspecified() && l.isLocal(ip) || a.ip.Equal(ip) || ip.IsUnspecified() {
+				return true
+			}
+		}
+		for _, a := range self {
+			if a.port == port && a.ip.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns the error of the request to hostport with header h if it loops back
+// to the proxy.
+func (l *LoopGuard) check(ctx *ProxyCtx, h http.Header, hostport string) error {
+	if name := l.pseudonym(ctx.Proxy); viaLoop(h, name) {
+		return &ProxyError{Kind: ErrProxyLoop, ID: ctx.ID(), Host: hostport, Err: fmt.Errorf("already went through %s", name)}
+	}
+	if l.isSelf(ctx, hostport) {
+		return &ProxyError{Kind: ErrProxyLoop, ID: ctx.ID(), Host: hostport, Err: errors.New("address of the proxy")}
+	}
+	return nil
+}
+
+func (l *LoopGuard) reject(req *http.Request, ctx *ProxyCtx, err error) *http.Response {
+	ctx.Error = err
+	ctx.Warnf("Rejecting %s: %v", req.Method, err)
+	if l.OnLoop != nil {
+		l.OnLoop(ctx, err)
+	}
+	status := l.Status
+	if status == 0 {
+		status = http.StatusLoopDetected
+	}
+	return NewResponse(req, ContentTypeText, status, err.Error()+"\n")
+}
+
+// checkConnect rejects the CONNECT request req if its tunnel to host loops back to
+// the proxy.
+func (l *LoopGuard) checkConnect(req *http.Request, ctx *ProxyCtx, host string) *http.Response {
+	if l == nil {
+		return nil
+	}
+	l.learn(req)
+	if err := l.check(ctx, req.Header, withPort(host, "80")); err != nil {
+		return l.reject(req, ctx, err)
+	}
+	return nil
+}
+
+// checkRequest rejects req, about to be sent upstream, if it loops back to the proxy.
+func (l *LoopGuard) checkRequest(req *http.Request, ctx *ProxyCtx) *http.Response {
+	if l == nil {
+		return nil
+	}
+	l.learn(req)
+	port := "80"
+	if req.URL.Scheme == "https" {
+		port = "443"
+	}
+	if err := l.check(ctx, req.Header, withPort(req.URL.Host, port)); err != nil {
+		return l.reject(req, ctx, err)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package goproxy
+
+import (
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// And returns a ReqCondition testing whether all the given ReqConditions are true.
+func And(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if !c.HandleReq(req, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or returns a ReqCondition testing whether any of the given ReqConditions is true.
+func Or(conds ...ReqCondition) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if c.HandleReq(req, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RespAnd returns a RespCondition testing whether all the given RespConditions are true.
+// As any ReqCondition is a RespCondition, request and response conditions can be mixed.
+func RespAnd(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if !c.HandleResp(resp, ctx) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// RespOr returns a RespCondition testing whether any of the given RespConditions is true.
+func RespOr(conds ...RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		for _, c := range conds {
+			if c.HandleResp(resp, ctx) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// RespNot returns a RespCondition negating the given RespCondition
+func RespNot(c RespCondition) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return !c.HandleResp(resp, ctx)
+	}
+}
+
+// MethodIs returns a ReqCondition testing whether the request method is one of the given ones.
+func MethodIs(methods ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, m := range methods {
+			if strings.EqualFold(req.Method, m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func headerIs(h http.Header, name string, values []string) bool {
+	for _, v := range h.Values(name) {
+		for _, value := range values {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func headerMatches(h http.Header, name string, re *regexp.Regexp) bool {
+	for _, v := range h.Values(name) {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReqHasHeader returns a ReqCondition testing whether the request has the given header.
+func ReqHasHeader(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return len(req.Header.Values(name)) > 0
+	}
+}
+
+// ReqHeaderIs returns a ReqCondition testing whether a value of the given request
+// header is equal to one of the given values.
+func ReqHeaderIs(name string, values ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return headerIs(req.Header, name, values)
+	}
+}
+
+// ReqHeaderMatches returns a ReqCondition testing whether a value of the given request
+// header matches the regexp.
+func ReqHeaderMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return headerMatches(req.Header, name, re)
+	}
+}
+
+// HasQueryParam returns a ReqCondition testing whether the request URL has the given
+// query parameter.
+func HasQueryParam(name string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		_, ok := req.URL.Query()[name]
+		return ok
+	}
+}
+
+// QueryParamIs returns a ReqCondition testing whether a value of the given query
+// parameter is equal to one of the given values.
+func QueryParamIs(name string, values ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, v := range req.URL.Query()[name] {
+			for _, value := range values {
+				if v == value {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// QueryParamMatches returns a ReqCondition testing whether a value of the given query
+// parameter matches the regexp.
+func QueryParamMatches(name string, re *regexp.Regexp) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		for _, v := range req.URL.Query()[name] {
+			if re.MatchString(v) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func mediaTypeIs(contentType string, types []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, typ := range types {
+		if strings.EqualFold(mediaType, typ) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReqContentTypeIs returns a ReqCondition testing whether the media type of the request
+// body is one of the given types, ignoring parameters such as the charset.
+func ReqContentTypeIs(types ...string) ReqConditionFunc {
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		return mediaTypeIs(req.Header.Get("Content-Type"), types)
+	}
+}
+
+// RespHeaderIs returns a RespCondition testing whether a value of the given response
+// header is equal to one of the given values.
+func RespHeaderIs(name string, values ...string) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && headerIs(resp.Header, name, values)
+	}
+}
+
+// RespHeaderMatches returns a RespCondition testing whether a value of the given response
+// header matches the regexp.
+func RespHeaderMatches(name string, re *regexp.Regexp) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && headerMatches(resp.Header, name, re)
+	}
+}
+
+// StatusCodeBetween returns a RespCondition testing whether the status code of the
+// response is between min and max, inclusive. For example StatusCodeBetween(500, 599)
+// matches server errors.
+func StatusCodeBetween(min, max int) RespConditionFunc {
+	return func(resp *http.Response, ctx *ProxyCtx) bool {
+		return resp != nil && resp.StatusCode >= min && resp.StatusCode <= max
+	}
+}
+
+// SrcIpInNet returns a ReqCondition testing whether the client IP of the request is in one
+// of the given CIDR networks, e.g. SrcIpInNet("10.0.0.0/8", "::1/128"). It panics if a
+// network cannot be parsed.
+func SrcIpInNet(cidrs ...string) ReqConditionFunc {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic("goproxy: SrcIpInNet: " + err.Error())
+		}
+		nets[i] = n
+	}
+	return func(req *http.Request, ctx *ProxyCtx) bool {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			host = req.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+}
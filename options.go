@@ -0,0 +1,178 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Option configures the proxy returned by NewProxy.
+type Option func(proxy *ProxyHttpServer) error
+
+// NewProxy returns a proxy configured by opts, or the error of the first invalid
+// option. Unlike setting the fields of a ProxyHttpServer after NewProxyHttpServer,
+// options are validated before the proxy serves its first request:
+//
+//	proxy, err := goproxy.NewProxy(
+//		goproxy.WithCA(ca),
+//		goproxy.WithTimeouts(goproxy.Timeouts{Dial: 10 * time.Second}),
+//		goproxy.WithRules(rules),
+//	)
+func NewProxy(opts ...Option) (*ProxyHttpServer, error) {
+	proxy := NewProxyHttpServer()
+	for _, opt := range opts {
+		if err := opt(proxy); err != nil {
+			return nil, fmt.Errorf("goproxy: %v", err)
+		}
+	}
+	return proxy, nil
+}
+
+// WithCA makes ca the CA signing the certificates of the MITM'd hosts, see
+// ProxyHttpServer.CA. It must be a CA certificate along with its private key.
+func WithCA(ca *tls.Certificate) Option {
+	return func(proxy *ProxyHttpServer) error {
+		if ca == nil || len(ca.Certificate) == 0 {
+			return errors.New("no CA certificate")
+		}
+		if ca.PrivateKey == nil {
+			return errors.New("no CA private key")
+		}
+		c := *ca
+		if c.Leaf == nil {
+			var err error
+			if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+				return err
+			}
+		}
+		if !c.Leaf.IsCA {
+			return fmt.Errorf("%q is not a CA certificate", c.Leaf.Subject.CommonName)
+		}
+		proxy.CA = &c
+		return nil
+	}
+}
+
+// WithLogger makes the proxy log to logger.
+func WithLogger(logger Logger) Option {
+	return func(proxy *ProxyHttpServer) error {
+		if logger == nil {
+			return errors.New("nil logger")
+		}
+		proxy.Logger = logger
+		return nil
+	}
+}
+
+// Timeouts are the timeouts set by WithTimeouts, zero ones are left unset.
+type Timeouts struct {
+	// Dial limits the time to connect to upstream servers, for requests and tunnels
+	Dial time.Duration
+	// TLSHandshake limits the TLS handshakes with upstream servers
+	TLSHandshake time.Duration
+	// ResponseHeader limits the time upstream servers take to answer a request with
+	// the headers of their response
+	ResponseHeader time.Duration
+	// IdleConn is how long idle upstream connections are kept
+	IdleConn time.Duration
+	// Handler limits each request and response handler, see
+	// ProxyHttpServer.HandlerTimeout
+	Handler time.Duration
+}
+
+// WithTimeouts sets the timeouts of the transport of the proxy, and of its handlers.
+func WithTimeouts(t Timeouts) Option {
+	return func(proxy *ProxyHttpServer) error {
+		if t.Dial < 0 || t.TLSHandshake < 0 || t.ResponseHeader < 0 || t.IdleConn < 0 || t.Handler < 0 {
+			return fmt.Errorf("negative timeout in %+v", t)
+		}
+		if proxy.Tr == nil {
+			proxy.Tr = &http.Transport{}
+		}
+		if t.Dial > 0 {
+			proxy.Tr.DialContext = (&net.Dialer{Timeout: t.Dial, KeepAlive: 30 * time.Second}).DialContext
+		}
+		if t.TLSHandshake > 0 {
+			proxy.Tr.TLSHandshakeTimeout = t.TLSHandshake
+		}
+		if t.ResponseHeader > 0 {
+			proxy.Tr.ResponseHeaderTimeout = t.ResponseHeader
+		}
+		if t.IdleConn > 0 {
+			proxy.Tr.IdleConnTimeout = t.IdleConn
+		}
+		if t.Handler > 0 {
+			proxy.HandlerTimeout = t.Handler
+		}
+		return nil
+	}
+}
+
+// Metrics receives the measurements of a proxy, see WithMetrics. Its methods are
+// called concurrently.
+type Metrics interface {
+	// ObserveExchange is called once the handlers produced the response of a request,
+	// with its status, 502 if there is none, and the time elapsed since the request
+	// was received.
+	ObserveExchange(ctx *ProxyCtx, status int, d time.Duration)
+	// ObserveTunnel is called when a CONNECT tunnel is closed.
+	ObserveTunnel(ctx *ProxyCtx, stats TunnelStats)
+}
+
+// The priorities of the handlers of WithMetrics, so that the request is timed before
+// the other handlers run and the response is observed as modified by them.
+const (
+	metricsRequestPriority  = 1 << 20
+	metricsResponsePriority = -1 << 20
+)
+
+const metricsStartKey = "goproxy.metricsStart"
+
+// WithMetrics reports the exchanges and tunnels of the proxy to m. Tunnels are
+// reported by setting ProxyHttpServer.TunnelClosed, after calling the previous one.
+func WithMetrics(m Metrics) Option {
+	return func(proxy *ProxyHttpServer) error {
+		if m == nil {
+			return errors.New("nil metrics")
+		}
+		proxy.OnRequest().Priority(metricsRequestPriority).DoFunc(func(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+			ctx.ReqData.Set(metricsStartKey, proxy.clock().Now())
+			return req, nil
+		})
+		proxy.OnResponse().Priority(metricsResponsePriority).DoFunc(func(resp *http.Response, ctx *ProxyCtx) *http.Response {
+			start, ok := ctx.ReqData.Get(metricsStartKey)
+			if !ok {
+				return resp
+			}
+			status := http.StatusBadGateway
+			if resp != nil {
+				status = resp.StatusCode
+			}
+			m.ObserveExchange(ctx, status, proxy.clock().Now().Sub(start.(time.Time)))
+			return resp
+		})
+		previous := proxy.TunnelClosed
+		proxy.TunnelClosed = func(ctx *ProxyCtx, stats TunnelStats) {
+			if previous != nil {
+				previous(ctx, stats)
+			}
+			m.ObserveTunnel(ctx, stats)
+		}
+		return nil
+	}
+}
+
+// WithRules installs rules on the proxy, see RuleSet.Install.
+func WithRules(rules *RuleSet) Option {
+	return func(proxy *ProxyHttpServer) error {
+		if rules == nil {
+			return errors.New("nil rules")
+		}
+		rules.Install(proxy)
+		return nil
+	}
+}
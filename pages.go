@@ -0,0 +1,215 @@
+package goproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+)
+
+// Page is a template of the responses synthesized by the proxy, like block pages. It is
+// rendered as HTML, JSON or plain text, depending on the Accept header of the request,
+// so that API clients get an error they can parse:
+//
+//	page := &goproxy.Page{
+//		Status:  http.StatusForbidden,
+//		Title:   "Social networks are blocked",
+//		Message: "{{.Host}} is blocked during work hours, ask {{.Data.contact}} for access.",
+//	}
+//	proxy.OnRequest(goproxy.ReqHostIs("social.example.com")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+//		return req, page.Response(ctx, map[string]interface{}{"contact": "it@example.com"})
+//	})
+//
+// Title and Message are text/template templates, and HTML an html/template template of
+// the whole HTML page, DefaultPageHTML if empty. They are executed with a PageData,
+// Title and Message being rendered first for HTML. A Page must not be changed once
+// rendered.
+type Page struct {
+	Status  int    `json:"status,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message,omitempty"`
+	HTML    string `json:"html,omitempty"`
+
+	once           sync.Once
+	err            error
+	title, message *texttemplate.Template
+	html           *template.Template
+}
+
+// DefaultPageHTML is the HTML template of the Pages without one.
+const DefaultPageHTML = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body><h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+</body></html>
+`
+
+// PageData is what the templates of a Page are executed with.
+type PageData struct {
+	Status int
+	// Title and Message are the rendered Title and Message of the page, for its HTML
+	// template
+	Title, Message string
+	// URL, Host and Method are those of the request, Rule, ClientID and Session those
+	// of its context
+	URL, Host, Method string
+	Rule, ClientID    string
+	Session           int64
+	Ctx               *ProxyCtx
+	// Data are the values given to Page.Response
+	Data map[string]interface{}
+}
+
+// Pages of the common synthesized responses, to be used as they are or as examples.
+var (
+	BlockedPage = &Page{
+		Status:  http.StatusForbidden,
+		Title:   "Access blocked",
+		Message: "Access to {{.URL}} is blocked by the proxy{{with .Rule}} (rule {{.}}){{end}}.",
+	}
+	AuthRequiredPage = &Page{
+		Status:  http.StatusProxyAuthRequired,
+		Title:   "Proxy authentication required",
+		Message: "The proxy requires you to sign in to access {{.Host}}.",
+	}
+	TLSInspectionPage = &Page{
+		Status:  http.StatusOK,
+		Title:   "TLS inspection",
+		Message: "The HTTPS traffic to {{.Host}} is inspected by the proxy, install its CA certificate to trust it.",
+	}
+)
+
+func (p *Page) compile() error {
+	p.once.Do(func() {
+		html := p.HTML
+		if html == "" {
+			html = DefaultPageHTML
+		}
+		if p.title, p.err = texttemplate.New("title").Parse(p.Title); p.err != nil {
+			return
+		}
+		if p.message, p.err = texttemplate.New("message").Parse(p.Message); p.err != nil {
+			return
+		}
+		p.html, p.err = template.New("html").Parse(html)
+	})
+	return p.err
+}
+
+// Validate checks that the templates of p parse.
+func (p *Page) Validate() error {
+	return p.compile()
+}
+
+// Page formats, see negotiatePage
+const (
+	pageHTML = "text/html"
+	pageJSON = "application/json"
+	pageText = "text/plain"
+)
+
+// negotiatePage returns the format of a page preferred by accept, HTML by default.
+func negotiatePage(accept string) string {
+	if accept == "" {
+		return pageHTML
+	}
+	best, bestQ := pageHTML, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		var format string
+		switch {
+		case mediaType == pageHTML, mediaType == "application/xhtml+xml":
+			format = pageHTML
+		case mediaType == pageJSON, strings.HasSuffix(mediaType, "+json"):
+			format = pageJSON
+		case mediaType == pageText:
+			format = pageText
+		case mediaType == "*/*", mediaType == "text/*":
+			// wildcards weigh less than explicit types
+			q -= 0.0001
+			format = pageHTML
+		default:
+			continue
+		}
+		if q > bestQ && q > 0 {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// Response renders p for the request of ctx, in the format the request accepts. The
+// values of data are available to the templates, and added to the JSON object of JSON
+// responses.
+func (p *Page) Response(ctx *ProxyCtx, data map[string]interface{}) *http.Response {
+	return p.render(ctx, p.Status, data)
+}
+
+func (p *Page) render(ctx *ProxyCtx, status int, data map[string]interface{}) *http.Response {
+	req := ctx.Req
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	d := &PageData{Status: status, URL: req.URL.String(), Host: req.URL.Host, Method: req.Method,
+		Rule: ctx.Rule, ClientID: ctx.ClientID, Session: ctx.Session, Ctx: ctx, Data: data}
+	if d.Host == "" {
+		d.Host = req.Host
+	}
+	if req.Method == http.MethodConnect {
+		d.URL = d.Host
+	}
+
+	var title, message, body bytes.Buffer
+	err := p.compile()
+	if err == nil {
+		err = p.title.Execute(&title, d)
+	}
+	if err == nil {
+		err = p.message.Execute(&message, d)
+	}
+	d.Title, d.Message = title.String(), message.String()
+	format := negotiatePage(req.Header.Get("Accept"))
+	switch {
+	case err != nil:
+	case format == pageJSON:
+		v := map[string]interface{}{}
+		for k, value := range data {
+			v[k] = value
+		}
+		v["status"], v["error"], v["message"], v["url"] = status, d.Title, d.Message, d.URL
+		if d.Rule != "" {
+			v["rule"] = d.Rule
+		}
+		e := json.NewEncoder(&body)
+		e.SetEscapeHTML(false)
+		err = e.Encode(v)
+	case format == pageText:
+		body.WriteString(d.Title + "\n\n" + d.Message + "\n")
+	default:
+		err = p.html.Execute(&body, d)
+	}
+	if err != nil {
+		ctx.Warnf("Cannot render page: %v", err)
+		format = pageText
+		body.Reset()
+		body.WriteString(http.StatusText(status) + "\n")
+	}
+	resp := NewResponse(req, format+"; charset=utf-8", status, body.String())
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Header.Set("Vary", "Accept")
+	return resp
+}
@@ -2,13 +2,18 @@ package goproxy
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/textproto"
 	"os"
-	"regexp"
-	"sync/atomic"
+	"strings"
+	"sync"
+	"time"
 )
 
 type LogLevel int
@@ -21,18 +26,21 @@ const (
 
 // The basic proxy type. Implements http.Handler.
 type ProxyHttpServer struct {
-	// session variable must be aligned in i386
+	// stats must be aligned in i386
 	// see http://golang.org/src/pkg/sync/atomic/doc.go#L41
-	sess int64
+	stats proxyStats
+	// cfgMu guards the fields which can be changed while serving, see SetTransport
+	cfgMu sync.RWMutex
 	// KeepDestinationHeaders indicates the proxy should retain any headers present in the http.Response before proxying
 	KeepDestinationHeaders bool
 	// setting Verbose to true will log information on each request sent to the proxy
 	Verbose         LogLevel
 	Logger          Logger
 	NonproxyHandler http.Handler
-	reqHandlers     []ReqHandler
-	respHandlers    []RespHandler
-	httpsHandlers   []HttpsHandler
+	reqHandlers     handlerList
+	respHandlers    handlerList
+	httpsHandlers   handlerList
+	upgradeHandlers handlerList
 	Tr              *http.Transport
 	// ConnectDial will be used to create TCP connections for CONNECT requests
 	// if nil Tr.Dial will be used
@@ -40,9 +48,210 @@ type ProxyHttpServer struct {
 	ConnectDialWithReq func(req *http.Request, network string, addr string) (net.Conn, error)
 	CertStore          CertStorage
 	KeepHeader         bool
-}
 
-var hasPort = regexp.MustCompile(`:\d+$`)
+	// UpstreamClientCert, if set, is consulted before sending an https request upstream.
+	// A non-nil certificate is presented to the upstream host when it asks for one,
+	// allowing the proxy to broker mTLS on behalf of its clients. See ClientCertsForHosts.
+	UpstreamClientCert func(host string, ctx *ProxyCtx) (*tls.Certificate, error)
+
+	// MitmClientAuth and MitmClientCAs configure whether the forged TLS server asks
+	// MITM'd clients for a certificate, and how it is verified. The leaf of the
+	// presented certificate is available to handlers as ProxyCtx.ClientCert.
+	MitmClientAuth tls.ClientAuthType
+	MitmClientCAs  *x509.CertPool
+
+	// CaptureClientHello makes the proxy parse the TLS ClientHello of MITM'd and
+	// accepted CONNECT tunnels and expose it as ProxyCtx.ClientHello. The ClientHello
+	// of accepted tunnels is awaited for TunnelSniffTimeout at most, the clients of
+	// protocols whose servers speak first sending none.
+	CaptureClientHello bool
+
+	// UpstreamTLSHandshake, if set, performs the TLS handshake with upstream https
+	// servers instead of crypto/tls. It is the integration point for libraries such
+	// as uTLS, e.g. to mimic ctx.ClientHello of the connecting browser (see
+	// CaptureClientHello) or a preset for selected hosts. Returning a nil conn and
+	// nil error falls back to crypto/tls. Since upstream connections are pooled,
+	// a connection may later be reused for requests of other clients; see
+	// UpstreamFingerprint to pool them per fingerprint.
+	// The returned connection must not negotiate HTTP/2.
+	UpstreamTLSHandshake func(conn net.Conn, serverName string, ctx *ProxyCtx) (net.Conn, error)
+
+	// UpstreamFingerprint, if set, is consulted before sending an https request
+	// upstream. A non-nil fingerprint, such as FingerprintChrome or FingerprintOf
+	// ctx.ClientHello, shapes the ClientHello sent to the host instead of crypto/tls
+	// and UpstreamTLSHandshake. Connections are pooled per fingerprint. See
+	// FingerprintsForHosts.
+	UpstreamFingerprint func(host string, ctx *ProxyCtx) *TLSFingerprint
+
+	// WildcardCerts, if set, makes MITM'd hosts share wildcard certificates.
+	WildcardCerts *WildcardCerts
+
+	// CertExtensions, if set, returns extra X.509 extensions of the certificates forged
+	// for MITM'd hosts, e.g. custom OIDs expected by internal agents, or
+	// CTPoisonExtension in a lab. They replace the extensions of the same OIDs the proxy
+	// sets. The certificates of CertStore keep the extensions of the context they were
+	// signed for.
+	CertExtensions func(hosts []string, ctx *ProxyCtx) []pkix.Extension
+
+	// DeterministicCerts makes the certificates forged for MITM'd hosts depend only on
+	// the CA and the hosts, so that proxies sharing a CA forge byte-identical
+	// certificates, and load-balanced clients do not see them change. Their keys are
+	// then ECDSA P-256 ones, and their validity is aligned on DeterministicCertPeriod.
+	DeterministicCerts bool
+
+	// MitmSessionTicketKeys, if set, enables TLS session resumption for MITM'd
+	// clients using the given, possibly shared, ticket keys.
+	MitmSessionTicketKeys *SessionTicketKeys
+
+	// TLSWorkers, if set, bounds the concurrent certificate signatures and handshakes
+	// of the MITM'd tunnels.
+	TLSWorkers *TLSWorkers
+
+	// MitmTLSPolicy and UpstreamTLSPolicy restrict the TLS versions and cipher
+	// suites accepted from MITM'd clients and offered to upstream servers.
+	MitmTLSPolicy     *TLSPolicy
+	UpstreamTLSPolicy *TLSPolicy
+
+	// ClientIdentifier, if set, identifies the clients of the proxy, see ProxyCtx.ClientID.
+	ClientIdentifier ClientIdentifier
+
+	// RateLimiter, if set, limits the requests and tunnels of each client.
+	RateLimiter *RateLimiter
+
+	// ConnLimits, if set, caps the hijacked and MITM'd connections of all clients.
+	ConnLimits *ConnLimits
+
+	// LoopGuard, if set, rejects the requests and tunnels looping back to the proxy.
+	LoopGuard *LoopGuard
+
+	// CookieJars, if set, keeps the cookies of each client in the proxy.
+	CookieJars *CookieJars
+
+	// CA, if set, signs the certificates of the MITM'd hosts instead of GoproxyCa for
+	// the default ConnectActions, such as MitmConnect, see WithCA.
+	CA *tls.Certificate
+
+	// RefuseDemoCA makes MITM fail with ErrDemoCA when using the bundled GoproxyCa,
+	// e.g. because SetCA was not called. See GenerateCA to create a CA.
+	// Otherwise, a warning is logged the first time the bundled CA is used, unless
+	// AllowInsecureDefaultCA acknowledges it, as the tests of the programs MITM'ing
+	// with the demo CA may do.
+	RefuseDemoCA           bool
+	AllowInsecureDefaultCA bool
+	demoCAWarning          sync.Once
+
+	// MitmKeepAlive keeps MITM'd TLS connections open between requests, instead of
+	// closing them after every response.
+	MitmKeepAlive bool
+
+	// MitmHTTP2 offers HTTP/2 to MITM'd TLS clients. Their requests go through the
+	// handlers like HTTP/1.1 ones, and are sent upstream over HTTP/2 when the server
+	// supports it. Bodies and trailers are streamed both ways, as gRPC needs, but the
+	// connections cannot be hijacked nor upgraded.
+	MitmHTTP2 bool
+
+	// ForwardingHeaders, if set, configures the Via, X-Forwarded-For and Forwarded
+	// headers added to proxied requests and responses.
+	ForwardingHeaders *ForwardingHeaders
+
+	// RequestIDHeader, if set, is the header of the correlation IDs of requests, such as
+	// DefaultRequestIDHeader. The ID sent by the client is kept, or one is generated,
+	// then it is sent upstream, echoed in the response to the client, and available as
+	// ProxyCtx.RequestID.
+	RequestIDHeader string
+
+	// HTTPMitmValidation configures the request smuggling defenses of ConnectHTTPMitm
+	// tunnels, the defaults are used if nil.
+	HTTPMitmValidation *RequestValidation
+
+	// HostOverrides, if set, maps the hosts of requests and tunnels to the addresses
+	// dialed instead.
+	HostOverrides *HostOverrides
+
+	// UpstreamProxyProtocol, if 1 or 2, makes the proxy send a PROXY protocol header of
+	// this version with the address of the client on the connections it dials for
+	// CONNECT tunnels, ConnectHTTPMitm tunnels and websockets. The pooled connections of
+	// the other requests, shared by clients, get none. See ProxyProtocolListener to
+	// accept the header.
+	UpstreamProxyProtocol int
+
+	// UpstreamLimiter, if set, limits the concurrent connections and requests to
+	// upstream servers.
+	UpstreamLimiter *UpstreamLimiter
+
+	// TunnelPolicy, if set, is called with the protocol of every accepted CONNECT
+	// tunnel, sniffed from the first bytes sent by the client or the server, and decides
+	// whether the tunnel is relayed, rejected, tarpitted, recorded or handled otherwise.
+	// The first bytes are awaited for TunnelSniffTimeout, DefaultTunnelSniffTimeout if zero.
+	TunnelPolicy       func(ctx *ProxyCtx, sniff *TunnelSniff) TunnelDecision
+	TunnelSniffTimeout time.Duration
+
+	// HandlerTimeout, if set, limits how long each request or response handler may
+	// run. A handler running longer is abandoned: the request is answered 504 Gateway
+	// Timeout while the handler keeps running in the background, its results ignored.
+	// Handlers are therefore given copies of the ProxyCtx and of the request or
+	// response, copied back when they return in time.
+	// Handlers running longer than SlowHandler are logged and counted, see
+	// Registration.Stats.
+	HandlerTimeout time.Duration
+	SlowHandler    time.Duration
+
+	// EpollTunnels is an experiment forwarding the accepted CONNECT tunnels with a few
+	// epoll workers, instead of two goroutines per tunnel, to save memory with a very
+	// large number of mostly idle tunnels. It only has an effect on Linux, in builds
+	// with the goproxy_epoll tag, and for tunnels between plain TCP connections, those
+	// of a ProxyProtocolListener included: those sniffed, rate limited, counted for
+	// TunnelClosed or limited by ConnLimits keep their goroutines.
+	EpollTunnels bool
+
+	// PoolContexts reuses the ProxyCtx of the requests once their response was sent,
+	// reducing allocations under load. Handlers keeping the contexts of requests, or
+	// using them from goroutines outliving the exchange, must call ProxyCtx.Keep. The
+	// contexts of CONNECT tunnels, those of hijacked or upgraded connections, and
+	// those of the requests whose handlers timed out are never reused either.
+	PoolContexts bool
+
+	// Clock, if set, tells the time to the proxy instead of SystemClock: the validity of
+	// the forged certificates, the handler timeouts and the durations of the exchanges
+	// and tunnels depend on it, as well as the timeouts of the queues, breakpoints and
+	// tunnel sniffing, and the cookie jars. CertCache and RateLimiter use it unless they
+	// have their own Clock. Rand, if set, is the source of the serial numbers of the
+	// forged certificates and of the generated request IDs, instead of crypto/rand.
+	// Both are meant for deterministic tests.
+	Clock Clock
+	Rand  io.Reader
+
+	// HandlerFailed, if set, is called when a request or response handler panics, with
+	// a *HandlerPanicError, or times out, with ErrHandlerTimeout. Either way the error
+	// is logged, set as ProxyCtx.Error, and the request answered with an error.
+	HandlerFailed func(ctx *ProxyCtx, err error)
+
+	// ShareRequestBody lets every request handler read the whole request body, and
+	// still sends it whole upstream: the body is buffered as the handlers read it, in
+	// memory up to BodySpillThreshold, DefaultBodySpillThreshold if zero, then in a
+	// temporary file removed once the request is sent. A handler replacing the body
+	// passes the new one to the next handlers.
+	ShareRequestBody   bool
+	BodySpillThreshold int64
+
+	// RangeMode is how Range requests are handled, so that resuming downloads works
+	// with response handlers rewriting bodies, see RangeMode.
+	RangeMode RangeMode
+
+	// TunnelClosed, if set, is called when a CONNECT tunnel is closed, whether accepted
+	// or MITM'd, e.g. to log it.
+	TunnelClosed func(ctx *ProxyCtx, stats TunnelStats)
+
+	// ConnectAudit, if set, is called with the handling of every CONNECT request, once
+	// the action chosen by the CONNECT handlers was carried out, e.g. once the TLS
+	// handshake of MITM'd clients completed. See ext/audit for a tamper-evident log.
+	ConnectAudit func(ctx *ProxyCtx, d ConnectDecision)
+
+	// transports caches the variants of Tr derived for the hooks above
+	transports transportCache
+	// conns tracks the active requests and tunnels, see ActiveConns
+	conns connTracker
+}
 
 func copyHeaders(dst, src http.Header, keepDestHeaders bool) {
 	if !keepDestHeaders {
@@ -62,13 +271,52 @@ func isEof(r *bufio.Reader) bool {
 	return err == io.EOF
 }
 
+// filteredRequest is the result of a ReqHandler
+type filteredRequest struct {
+	req  *http.Request
+	resp *http.Response
+}
+
 func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req *http.Request, resp *http.Response) {
 	req = r
-	for _, h := range proxy.reqHandlers {
-		req, resp = h.Handle(r, ctx)
+	if err := normalizeRequestHost(r); err != nil {
+		ctx.Error = newProxyError(ctx, ErrMalformedRequest, "", err)
+		ctx.Warnf("Rejecting request: %v", err)
+		return r, invalidHostResponse(r, err)
+	}
+	proxy.setRequestID(r, ctx)
+	if resp = proxy.RateLimiter.checkRequest(r, ctx); resp != nil {
+		return
+	}
+	bodies := proxy.shareRequestBody(r)
+	defer func() {
+		bodies.done(r, req, resp)
+		if req != nil && req.RemoteAddr == "" {
+			// a request made by a handler comes from the same client
+			req.RemoteAddr = ctx.ClientAddr()
+		}
+		if resp == nil {
+			proxy.stripRange(req, ctx)
+		}
+	}()
+	for _, h := range proxy.reqHandlers.snapshot() {
+		h := h
+		bodies.next(r)
+		v, err := proxy.runHandler(h, ctx, r, nil, func(ctx *ProxyCtx, r *http.Request, _ *http.Response) interface{} {
+			req, resp := h.handler.(ReqHandler).Handle(r, ctx)
+			return filteredRequest{req, resp}
+		})
+		if err != nil {
+			return r, proxy.handlerErrorResponse(r, ctx, err)
+		}
+		req, resp = v.(filteredRequest).req, v.(filteredRequest).resp
 		// non-nil resp means the handler decided to skip sending the request
 		// and return canned response instead.
 		if resp != nil {
+			if req == nil {
+				// keep the request for the connection handling of MITM loops
+				req = r
+			}
 			break
 		}
 	}
@@ -76,9 +324,25 @@ func (proxy *ProxyHttpServer) filterRequest(r *http.Request, ctx *ProxyCtx) (req
 }
 func (proxy *ProxyHttpServer) filterResponse(respOrig *http.Response, ctx *ProxyCtx) (resp *http.Response) {
 	resp = respOrig
-	for _, h := range proxy.respHandlers {
+	var upstreamBody io.ReadCloser
+	if respOrig != nil {
+		upstreamBody = respOrig.Body
+	}
+	defer func() { resp = proxy.serveRange(resp, upstreamBody, ctx) }()
+	proxy.responseRequestID(resp, ctx)
+	for _, h := range proxy.respHandlers.snapshot() {
+		h, in := h, resp
 		ctx.Resp = resp
-		resp = h.Handle(resp, ctx)
+		v, err := proxy.runHandler(h, ctx, nil, in, func(ctx *ProxyCtx, _ *http.Request, in *http.Response) interface{} {
+			return h.handler.(RespHandler).Handle(in, ctx)
+		})
+		if err != nil {
+			if _, panicked := err.(*HandlerPanicError); panicked && in != nil && in.Body != nil {
+				in.Body.Close()
+			}
+			return proxy.handlerErrorResponse(ctx.Req, ctx, err)
+		}
+		resp = v.(*http.Response)
 	}
 	return
 }
@@ -89,17 +353,6 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	// If no Accept-Encoding header exists, Transport will add the headers it can accept
 	// and would wrap the response body with the relevant reader.
 	r.Header.Del("Accept-Encoding")
-	// curl can add that, see
-	// https://jdebp.eu./FGA/web-proxy-connection-header.html
-	r.Header.Del("Proxy-Connection")
-	r.Header.Del("Proxy-Authenticate")
-	r.Header.Del("Proxy-Authorization")
-	// Connection, Authenticate and Authorization are single hop Header:
-	// http://www.w3.org/Protocols/rfc2616/rfc2616.txt
-	// 14.10 Connection
-	//   The Connection general-header field allows the sender to specify
-	//   options that are desired for that particular connection and MUST NOT
-	//   be communicated by proxies over further connections.
 
 	// When server reads http request it sets req.Close to true if
 	// "Connection" header contains "close".
@@ -110,7 +363,65 @@ func removeProxyHeaders(ctx *ProxyCtx, r *http.Request) {
 	if r.Header.Get("Connection") == "close" {
 		r.Close = false
 	}
-	r.Header.Del("Connection")
+	removeHopByHopHeaders(r.Header)
+}
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1, along with the
+// proxy specific ones. They are meant for a single connection and must not be
+// forwarded by proxies.
+// curl can add Proxy-Connection, see
+// https://jdebp.eu./FGA/web-proxy-connection-header.html
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from h, as well as the
+// headers listed in its Connection header. Upgrade requests and responses keep
+// their "Connection: Upgrade" and Upgrade headers, and "TE: trailers" is kept
+// for the upstream server to know trailers are supported.
+func removeHopByHopHeaders(h http.Header) {
+	upgrade := ""
+	if headerContains(h, "Connection", "upgrade") {
+		upgrade = h.Get("Upgrade")
+	}
+	trailers := headerContains(h, "Te", "trailers")
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// removeResponseHopByHopHeaders removes the hop-by-hop headers from the headers h of
+// a response, but the Proxy-Authenticate challenges of the proxy itself, added by
+// handlers. Those of upstream responses are for the proxy, and were removed as the
+// responses arrived.
+func removeResponseHopByHopHeaders(h http.Header) {
+	challenges := h.Values("Proxy-Authenticate")
+	removeHopByHopHeaders(h)
+	for _, c := range challenges {
+		h.Add("Proxy-Authenticate", c)
+	}
 }
 
 type flushWriter struct {
@@ -130,61 +441,55 @@ func (fw flushWriter) Write(p []byte) (int, error) {
 // Standard net/http function. Shouldn't be used directly, http.Serve will use it.
 func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	//r.Header["X-Forwarded-For"] = w.RemoteAddr()
+	if r.URL.IsAbs() || r.Method == "CONNECT" {
+		if proxy.rejectDraining(w) {
+			return
+		}
+	}
 	if r.Method == "CONNECT" {
 		proxy.handleHttps(w, r)
 	} else {
-		ctx := &ProxyCtx{Req: r, Session: atomic.AddInt64(&proxy.sess, 1), Proxy: proxy}
+		ctx := proxy.newCtx(ProxyCtx{Req: r, Proxy: proxy, ConnData: NewData(), ReqData: NewData(), clientAddr: r.RemoteAddr})
+		proxy.identifyClient(r, ctx)
 
-		var err error
 		ctx.Logf("Got request %v %v %v %v", r.URL.Path, r.Host, r.Method, r.URL.String())
 		if !r.URL.IsAbs() {
 			proxy.NonproxyHandler.ServeHTTP(w, r)
 			return
 		}
-		r, resp := proxy.filterRequest(r, ctx)
-
-		if resp == nil {
-			if isWebSocketRequest(r) {
-				ctx.Logf("Request looks like websocket upgrade.")
-				proxy.serveWebsocket(ctx, w, r)
-			}
-
-			if !proxy.KeepHeader {
-				removeProxyHeaders(ctx, r)
-			}
-			resp, err = ctx.RoundTrip(r)
-			if err != nil {
-				ctx.Error = err
-				resp = proxy.filterResponse(nil, ctx)
-
+		done := false
+		defer func() {
+			if done {
+				proxy.releaseCtx(ctx)
 			}
-			if resp != nil {
-				ctx.Logf("Received response %v", resp.Status)
+		}()
+		defer proxy.conns.track(ctx, ConnHTTP, r.URL.Host)()
+		upgraded := false
+		x := &exchange{proxy: proxy, ctx: ctx, intercept: func(req *http.Request) bool {
+			if !isWebSocketRequest(req) {
+				return false
 			}
-		}
-
-		var origBody io.ReadCloser
-
-		if resp != nil {
-			origBody = resp.Body
-			defer origBody.Close()
-		}
-
-		resp = proxy.filterResponse(resp, ctx)
-
+			ctx.Logf("Request looks like websocket upgrade.")
+			proxy.serveWebsocket(ctx, w, req)
+			upgraded = true
+			return true
+		}}
+		r, resp, origBody := x.run(r)
 		if resp == nil {
-			var errorString string
-			if ctx.Error != nil {
-				errorString = "error read response " + r.URL.Host + " : " + ctx.Error.Error()
-				ctx.Logf(errorString)
-				http.Error(w, ctx.Error.Error(), 500)
-			} else {
-				errorString = "error read response " + r.URL.Host
+			if !upgraded && !ctx.hijacked() {
+				errorString := "error read response " + r.URL.Host
 				ctx.Logf(errorString)
 				http.Error(w, errorString, 500)
 			}
 			return
 		}
+		if origBody != nil {
+			defer origBody.Close()
+		}
+		if upstream, ok := origBody.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			proxy.hijackUpgrade(ctx, w, resp, upstream)
+			return
+		}
 		ctx.Logf("Copying response to client %v [%d]", resp.Status, resp.StatusCode)
 		// http.ResponseWriter will take care of filling the correct response length
 		// Setting it now, might impose wrong value, contradicting the actual new
@@ -192,10 +497,16 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		// We keep the original body to remove the header only if things changed.
 		// This will prevent problems with HEAD requests where there's no body, yet,
 		// the Content-Length header should be set.
-		if origBody != resp.Body {
+		if !bodyLengthKnown(resp, origBody) {
 			resp.Header.Del("Content-Length")
 		}
 		copyHeaders(w.Header(), resp.Header, proxy.KeepDestinationHeaders)
+		if proxy.Draining() {
+			w.Header().Set("Connection", "close")
+		}
+		if len(resp.Trailer) > 0 {
+			w.Header().Set("Trailer", trailerNames(resp.Trailer))
+		}
 		w.WriteHeader(resp.StatusCode)
 		var copyWriter io.Writer = w
 		if w.Header().Get("content-type") == "text/event-stream" {
@@ -204,24 +515,32 @@ func (proxy *ProxyHttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		}
 
 		nr, err := io.Copy(copyWriter, resp.Body)
+		for k, vs := range resp.Trailer {
+			w.Header()[k] = vs
+		}
 		if err := resp.Body.Close(); err != nil {
 			ctx.Warnf("Can't close response body %v", err)
 		}
+		proxy.RateLimiter.countBytes(r, ctx, nr)
 		ctx.Logf("Copied %v bytes to client error=%v", nr, err)
+		done = true
 	}
 }
 
 // NewProxyHttpServer creates and returns a proxy server, logging to stderr by default
 func NewProxyHttpServer() *ProxyHttpServer {
 	proxy := ProxyHttpServer{
-		Logger:        log.New(os.Stderr, "", log.LstdFlags),
-		reqHandlers:   []ReqHandler{},
-		respHandlers:  []RespHandler{},
-		httpsHandlers: []HttpsHandler{},
+		Logger: log.New(os.Stderr, "", log.LstdFlags),
 		NonproxyHandler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			http.Error(w, "This is a proxy server. Does not respond to non-proxy requests.", 500)
 		}),
-		Tr: &http.Transport{TLSClientConfig: tlsClientSkipVerify, Proxy: http.ProxyFromEnvironment},
+		Tr: &http.Transport{
+			TLSClientConfig: tlsClientSkipVerify,
+			Proxy:           http.ProxyFromEnvironment,
+			// wait for the upstream 100 Continue before reading the body of the
+			// client, lest it be asked for a body the upstream server rejects
+			ExpectContinueTimeout: time.Second,
+		},
 	}
 
 	proxy.ConnectDial = dialerFromEnv(&proxy)
@@ -6,7 +6,11 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"io"
@@ -14,16 +18,23 @@ import (
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/mixcode/goproxy"
 	goproxy_image "github.com/mixcode/goproxy/ext/image"
+	"github.com/mixcode/goproxy/goproxytest"
 )
 
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
@@ -1015,3 +1026,3715 @@ func TestResponseContentLength(t *testing.T) {
 		t.Fatalf("Wrong response Content-Length.")
 	}
 }
+
+func TestPerRequestTransport(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	used := false
+	proxy.OnRequest(goproxy.UrlIs("/bobo")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.Transport = RoundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			used = true
+			return http.DefaultTransport.RoundTrip(req)
+		})
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo through the per-request transport, got", r)
+	}
+	if !used {
+		t.Error("per-request transport was not used")
+	}
+}
+
+type RoundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f RoundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestUpstreamClientCert(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			io.WriteString(w, "anonymous")
+			return
+		}
+		io.WriteString(w, r.TLS.PeerCertificates[0].Subject.CommonName)
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	conns := make(chan net.Conn, 10)
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns <- c
+		}
+	}
+	s.StartTLS()
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.UpstreamClientCert = goproxy.ClientCertsForHosts(map[string]tls.Certificate{
+		"127.0.0.1": goproxy.GoproxyCa,
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(s.URL, client, t)); r != goproxy.GoproxyCa.Leaf.Subject.CommonName {
+		t.Error("Expected upstream to see the client certificate, got", r)
+	}
+
+	// a certificate loaded again for every request still reuses the connections
+	for len(conns) > 0 {
+		<-conns
+	}
+	proxy.UpstreamClientCert = func(host string, ctx *goproxy.ProxyCtx) (*tls.Certificate, error) {
+		cert := goproxy.GoproxyCa
+		return &cert, nil
+	}
+	for i := 0; i < 3; i++ {
+		getOrFail(s.URL, client, t)
+	}
+	if n := len(conns); n != 0 {
+		t.Error("Expected the requests to reuse the upstream connection, got new connections:", n)
+	}
+}
+
+func TestMitmClientCert(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmClientAuth = tls.RequireAnyClientCert
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.ClientCert == nil {
+			return nil, goproxy.TextResponse(req, "no cert")
+		}
+		return nil, goproxy.TextResponse(req, ctx.ClientCert.Subject.CommonName)
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{goproxy.GoproxyCa},
+	}
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != goproxy.GoproxyCa.Leaf.Subject.CommonName {
+		t.Error("Expected the client certificate on ctx, got", r)
+	}
+}
+
+func TestCaptureClientHello(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CaptureClientHello = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.ClientHello == nil {
+			return nil, goproxy.TextResponse(req, "no hello")
+		}
+		return nil, goproxy.TextResponse(req, ctx.ClientHello.JA4())
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	r := string(getOrFail(https.URL+"/bobo", client, t))
+	if !regexp.MustCompile(`^t13i\d{4}(h2|h1|00)_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(r) {
+		t.Error("Expected a JA4 fingerprint of the client, got", r)
+	}
+}
+
+func TestCaptureClientHelloServerFirst(t *testing.T) {
+	// a server sending a banner first, then echoing
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "listen")
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.WriteString(c, "220 ready\r\n")
+		io.Copy(c, c)
+		c.Close()
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CaptureClientHello = true
+	proxy.TunnelSniffTimeout = 200 * time.Millisecond
+	_, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", s.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", l.Addr(), l.Addr())
+	r := bufio.NewReader(c)
+	if resp, err := http.ReadResponse(r, nil); err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT", err)
+	}
+	// shorter than a TLS record header
+	io.WriteString(c, "HI\n")
+	if banner, err := r.ReadString('\n'); err != nil || banner != "220 ready\r\n" {
+		t.Errorf("Expected the banner of the server, got %q %v", banner, err)
+	}
+	if echo, err := r.ReadString('\n'); err != nil || echo != "HI\n" {
+		t.Errorf("Expected the partially read data to be forwarded, got %q %v", echo, err)
+	}
+}
+
+func TestUpstreamTLSHandshake(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var hosts []string
+	proxy.UpstreamTLSHandshake = func(conn net.Conn, serverName string, ctx *goproxy.ProxyCtx) (net.Conn, error) {
+		if ctx == nil {
+			t.Error("handshake hook called without ProxyCtx")
+		}
+		hosts = append(hosts, serverName)
+		c := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		return c, c.Handshake()
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected bobo, got", r)
+	}
+	if len(hosts) != 1 || hosts[0] != "127.0.0.1" {
+		t.Error("Expected a single handshake with 127.0.0.1, got", hosts)
+	}
+}
+
+func TestUpstreamFingerprint(t *testing.T) {
+	var mu sync.Mutex
+	var hellos []*tls.ClientHelloInfo
+	conns := 0
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	upstream.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		hellos = append(hellos, hello)
+		mu.Unlock()
+		return nil, nil
+	}}
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	handshakes := 0
+	custom := &goproxy.TLSFingerprint{
+		Name: "custom",
+		Handshake: func(conn net.Conn, config *tls.Config) (net.Conn, error) {
+			handshakes++
+			if config.ServerName != "127.0.0.1" {
+				t.Error("Expected the handshake with 127.0.0.1, got", config.ServerName)
+			}
+			c := tls.Client(conn, config)
+			return c, c.Handshake()
+		},
+	}
+	proxy.UpstreamFingerprint = func(host string, ctx *goproxy.ProxyCtx) *goproxy.TLSFingerprint {
+		switch ctx.Req.URL.Path {
+		case "/chrome":
+			return goproxy.FingerprintChrome
+		case "/custom":
+			return custom
+		}
+		return goproxy.FingerprintFirefox
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, path := range []string{"/firefox", "/firefox", "/chrome", "/custom"} {
+		if r := string(getOrFail(upstream.URL+path, client, t)); r != "ok" {
+			t.Error("Expected ok, got", r)
+		}
+	}
+	if conns != 3 || len(hellos) != 3 {
+		t.Fatal("Expected a connection per fingerprint, got", conns, "connections and", len(hellos), "handshakes")
+	}
+	hasP521 := func(hello *tls.ClientHelloInfo) bool {
+		for _, c := range hello.SupportedCurves {
+			if c == tls.CurveP521 {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasP521(hellos[0]) || hasP521(hellos[1]) {
+		t.Error("Expected P-521 offered by the firefox fingerprint only, got", hellos[0].SupportedCurves, hellos[1].SupportedCurves)
+	}
+	if len(hellos[0].SupportedProtos) != 1 || hellos[0].SupportedProtos[0] != "http/1.1" {
+		t.Error("Expected h2 left out of ALPN for HTTP/1.1 clients, got", hellos[0].SupportedProtos)
+	}
+	if handshakes != 1 {
+		t.Error("Expected the handshake of the custom fingerprint to be used once, got", handshakes)
+	}
+}
+
+func TestFingerprintOf(t *testing.T) {
+	hello := &goproxy.ClientHello{
+		Version:           tls.VersionTLS12,
+		CipherSuites:      []uint16{0x0a0a, tls.TLS_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		SupportedGroups:   []uint16{0x1a1a, uint16(tls.X25519), 0x11ec},
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		ALPN:              []string{"h2", "http/1.1"},
+	}
+	fp := goproxy.FingerprintOf(hello)
+	if !strings.HasPrefix(fp.Name, "ja3:") {
+		t.Error("Expected a fingerprint named after JA3, got", fp.Name)
+	}
+	if len(fp.CipherSuites) != 2 || fp.CipherSuites[1] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("Expected the GREASE-free cipher suites, got", fp.CipherSuites)
+	}
+	if len(fp.CurvePreferences) != 1 || fp.CurvePreferences[0] != tls.X25519 {
+		t.Error("Expected the groups supported by crypto/tls, got", fp.CurvePreferences)
+	}
+	if fp.MinVersion != tls.VersionTLS12 || fp.MaxVersion != tls.VersionTLS13 {
+		t.Error("Expected TLS 1.2 to 1.3, got", fp.MinVersion, fp.MaxVersion)
+	}
+}
+
+func TestMitmSessionResumption(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	keys, err := goproxy.NewSessionTicketKeys()
+	panicOnErr(err, "NewSessionTicketKeys")
+	proxy.MitmSessionTicketKeys = keys
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	config := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	resumed := func() bool {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "dial proxy")
+		defer c.Close()
+		creq, _ := http.NewRequest("CONNECT", https.URL, nil)
+		creq.Write(c)
+		resp, err := http.ReadResponse(bufio.NewReader(c), creq)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatal("Cannot CONNECT through proxy", err)
+		}
+		tc := tls.Client(c, config)
+		req, _ := http.NewRequest("GET", https.URL+"/bobo", nil)
+		req.Write(tc)
+		resp, err = http.ReadResponse(bufio.NewReader(tc), req)
+		panicOnErr(err, "read mitm response")
+		ioutil.ReadAll(resp.Body)
+		return tc.ConnectionState().DidResume
+	}
+	if resumed() {
+		t.Error("first connection should not resume a session")
+	}
+	if !resumed() {
+		t.Error("second connection should resume the session")
+	}
+	panicOnErr(keys.Rotate(), "Rotate")
+	if !resumed() {
+		t.Error("session should resume with the previous ticket key after rotation")
+	}
+}
+
+func TestTLSStateOnCtx(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx.ClientTLSState == nil || ctx.UpstreamTLSState == nil {
+			return goproxy.TextResponse(ctx.Req, "missing TLS state")
+		}
+		return goproxy.TextResponse(ctx.Req, goproxy.TLSVersionName(ctx.ClientTLSState.Version)+" "+
+			goproxy.TLSVersionName(ctx.UpstreamTLSState.Version))
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "TLS 1.3 TLS 1.3" {
+		t.Error("Expected TLS versions of both connections, got", r)
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.MitmTLSPolicy = &goproxy.TLSPolicy{MinVersion: tls.VersionTLS13}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	}
+
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("TLS 1.2 client should be rejected by the MITM policy")
+	}
+
+	proxy.MitmTLSPolicy.Hosts = map[string]*goproxy.TLSPolicy{
+		"127.0.0.1": {MinVersion: tls.VersionTLS12},
+	}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Host override should accept TLS 1.2, got", r)
+	}
+}
+
+func TestUpstreamTLSIsWeak(t *testing.T) {
+	weak := httptest.NewUnstartedServer(ConstantHanlder("weak"))
+	weakCipher := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256}
+	weak.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: weakCipher}
+	weak.StartTLS()
+	defer weak.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true,
+		CipherSuites: append(weakCipher, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse(goproxy.UpstreamTLSIsWeak).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Body.Close()
+		return goproxy.TextResponse(ctx.Req, goproxy.CheckTLSState(ctx.UpstreamTLSState, time.Now()).Error())
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(weak.URL, client, t)); r != "insecure cipher suite TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256" {
+		t.Error("Expected a warning for the weak upstream, got", r)
+	}
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Strong upstream should not be affected, got", r)
+	}
+
+	// the certificate of the test server expires in 2084
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.Clock = goproxytest.NewClock(time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC))
+	proxy.Tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnResponse(goproxy.UpstreamTLSIsWeak).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Body.Close()
+		return goproxy.TextResponse(ctx.Req, "expired")
+	})
+	client, l = oneShotProxy(proxy, t)
+	defer l.Close()
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "expired" {
+		t.Error("Expected the certificate to be checked at the time of the proxy clock, got", r)
+	}
+}
+
+func TestMitmStreamingResponse(t *testing.T) {
+	received := make(chan bool)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			return
+		}
+		io.WriteString(w, "data: second\n\n")
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(s.URL)
+	panicOnErr(err, "get event stream")
+	defer resp.Body.Close()
+	buf := bufio.NewReader(resp.Body)
+	line, err := buf.ReadString('\n')
+	if err != nil || line != "data: first\n" {
+		t.Fatal("Expected first event before the stream ends, got", line, err)
+	}
+	close(received)
+	rest, _ := ioutil.ReadAll(buf)
+	if string(rest) != "\ndata: second\n\n" {
+		t.Error("Expected second event, got", string(rest))
+	}
+}
+
+func TestMitmKeepAlive(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmKeepAlive = true
+	connects := 0
+	proxy.OnRequest(goproxy.ReqConditionFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		connects++
+		return true
+	})).HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 3; i++ {
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+			t.Error("Expected bobo, got", r)
+		}
+	}
+	if connects != 1 {
+		t.Error("Expected the MITM'd connection to be reused, got CONNECTs:", connects)
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		io.WriteString(w, "body")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer s.Close()
+	plain := httptest.NewServer(s.Config.Handler)
+	defer plain.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{s.URL, plain.URL} {
+		resp, err := client.Get(u)
+		panicOnErr(err, "get")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "body" || resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("Expected body and trailer from %s, got %q %v", u, b, resp.Trailer)
+		}
+	}
+}
+
+func TestMitmInterimResponses(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).ExpectContinueTimeout = 5 * time.Second
+
+	var interim []int
+	var link string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim = append(interim, code)
+			if code == http.StatusEarlyHints {
+				link = header.Get("Link")
+			}
+			return nil
+		},
+	}
+	req, _ := http.NewRequest("POST", s.URL, strings.NewReader("posted"))
+	req.Header.Set("Expect", "100-continue")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	start := time.Now()
+	resp, err := client.Do(req)
+	panicOnErr(err, "post")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "posted" {
+		t.Error("Expected posted body to be echoed, got", string(b))
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("100 Continue was not relayed, client waited for its timeout")
+	}
+	// the server sends 100 Continue only once the handler reads the body
+	if len(interim) != 2 || interim[0] != http.StatusEarlyHints || interim[1] != http.StatusContinue || link == "" {
+		t.Error("Expected 100 and 103 responses to be relayed, got", interim, link)
+	}
+}
+
+func TestExpectContinueRejected(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "too large", http.StatusRequestEntityTooLarge)
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).ExpectContinueTimeout = 5 * time.Second
+
+	body := &watchedReader{Reader: strings.NewReader("large body")}
+	req, _ := http.NewRequest("POST", s.URL, body)
+	req.ContentLength = int64(len("large body"))
+	req.Header.Set("Expect", "100-continue")
+	resp, err := client.Do(req)
+	panicOnErr(err, "post")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("Expected the upstream rejection, got", resp.Status)
+	}
+	if atomic.LoadInt32(&body.read) != 0 {
+		t.Error("Client was asked for the body the upstream server rejected")
+	}
+}
+
+// watchedReader records whether it was read from.
+type watchedReader struct {
+	io.Reader
+	read int32
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	atomic.StoreInt32(&r.read, 1)
+	return r.Reader.Read(p)
+}
+
+func TestHandleConnectReq(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	althttps := httptest.NewTLSServer(ConstantHanlder("althttps"))
+	defer althttps.Close()
+	proxy.OnRequest().HandleConnectReqFunc(func(req *http.Request, host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if req.Header.Get("X-Route-To") == "alt" {
+			return goproxy.OkConnect, althttps.Listener.Addr().String()
+		}
+		return nil, ""
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).ProxyConnectHeader = http.Header{"X-Route-To": {"alt"}}
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "althttps" {
+		t.Error("Expected CONNECT to be routed by header, got", r)
+	}
+}
+
+func TestChainedTunnelHalfClose(t *testing.T) {
+	// a server answering once the client closed its side
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer server.Close()
+	go func() {
+		for {
+			c, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := io.ReadAll(c)
+				io.WriteString(c, "got "+string(b))
+			}()
+		}
+	}()
+
+	_, l := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer l.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = proxy.NewConnectDialToProxy(l.URL)
+	_, l2 := oneShotProxy(proxy, t)
+	defer l2.Close()
+
+	c, err := net.Dial("tcp", l2.Listener.Addr().String())
+	panicOnErr(err, "Dial")
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", server.Addr(), server.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through the chained proxies", err)
+	}
+	io.WriteString(c, "hello")
+	c.(*net.TCPConn).CloseWrite()
+	if b, err := io.ReadAll(br); err != nil || string(b) != "got hello" {
+		t.Errorf("Expected the half-close to reach the server through the chained proxies, got %q %v", b, err)
+	}
+}
+
+func TestConnectResponseHeaders(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.ConnectResponseHeader = http.Header{"Via": {"1.1 first"}}
+		return goproxy.OkConnect, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	proxy2 := goproxy.NewProxyHttpServer()
+	proxy2.ConnectDial = proxy2.NewConnectDialToProxy(l.URL)
+	proxy2.OnRequest().HandleConnect(goproxy.FuncHttpsHandler(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	}))
+	proxy2.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.TextResponse(req, ctx.UpstreamConnectHeader.Get("Via"))
+	})
+	_, l2 := oneShotProxy(proxy2, t)
+	defer l2.Close()
+
+	c, err := net.Dial("tcp", l2.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	buf := bufio.NewReader(c)
+	writeConnect(c)
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+	req.Write(c)
+	if r := readResponse(buf); r != "1.1 first" {
+		t.Error("Expected the upstream CONNECT response header, got", r)
+	}
+}
+
+func TestForwardingHeaders(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("Via"), r.Header.Get("X-Forwarded-For"), r.Header.Get("Forwarded"))
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ForwardingHeaders = &goproxy.ForwardingHeaders{
+		Via:           "goproxy",
+		XForwardedFor: goproxy.ForwardedAppend,
+		Forwarded:     goproxy.ForwardedAnonymize,
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	req, _ := http.NewRequest("GET", s.URL, nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	resp, err := client.Do(req)
+	panicOnErr(err, "get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "1.1 goproxy|10.0.0.1, 127.0.0.1|for=unknown" {
+		t.Error("Unexpected forwarding headers", string(b))
+	}
+	if via := resp.Header.Get("Via"); via != "1.1 goproxy" {
+		t.Error("Expected Via on the response, got", via)
+	}
+}
+
+func TestHopByHopHeaders(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "X-Upstream-Hop")
+		w.Header().Set("X-Upstream-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		fmt.Fprintf(w, "%q %q %q", r.Header.Get("X-Client-Hop"), r.Header.Get("Keep-Alive"), r.Header.Get("Te"))
+	}))
+	defer s.Close()
+	plain := httptest.NewServer(s.Config.Handler)
+	defer plain.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{s.URL, plain.URL} {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set("Connection", "X-Client-Hop")
+		req.Header.Set("X-Client-Hop", "1")
+		req.Header.Set("Keep-Alive", "timeout=5")
+		req.Header.Set("Te", "trailers")
+		resp, err := client.Do(req)
+		panicOnErr(err, "get")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != `"" "" "trailers"` {
+			t.Error("Hop-by-hop request headers reached", u, string(b))
+		}
+		if resp.Header.Get("X-Upstream-Hop") != "" || resp.Header.Get("Keep-Alive") != "" {
+			t.Error("Hop-by-hop response headers reached the client from", u, resp.Header)
+		}
+	}
+}
+
+func TestHTTPMitmRejectsSmuggling(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, smuggled := range []string{
+		"POST /bobo HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+		"POST /bobo HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nContent-Length: 5\r\n\r\nabcde",
+		"GET /bobo HTTP/1.1\r\nHost: x\r\nX-Folded: a\r\n b\r\n\r\n",
+		"GET /bobo HTTP/1.1\r\nHost: x\r\nX-Big: " + strings.Repeat("a", goproxy.DefaultMaxHeaderBytes) + "\r\n\r\n",
+	} {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "dial")
+		buf := bufio.NewReader(c)
+		writeConnect(c)
+		resp, err := http.ReadResponse(buf, nil)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatal("Cannot CONNECT through proxy", err)
+		}
+		io.WriteString(c, smuggled)
+		resp, err = http.ReadResponse(buf, nil)
+		if err != nil || resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Expected request to be rejected: %q %v", smuggled[:40], err)
+		}
+		c.Close()
+	}
+}
+
+func TestHTTPMitmPipeliningAndUpgrade(t *testing.T) {
+	var conns int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			io.WriteString(w, r.URL.Path)
+			return
+		}
+		c, buf, err := w.(http.Hijacker).Hijack()
+		panicOnErr(err, "hijack")
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		line, _ := buf.ReadString('\n')
+		io.WriteString(c, "echo "+line)
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	buf := bufio.NewReader(c)
+	io.WriteString(c, "CONNECT "+s.Listener.Addr().String()+" HTTP/1.1\r\nHost: "+s.Listener.Addr().String()+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+
+	// pipelined requests
+	io.WriteString(c, "GET /one HTTP/1.1\r\nHost: x\r\n\r\nGET /two HTTP/1.1\r\nHost: x\r\n\r\n")
+	for _, expected := range []string{"/one", "/two"} {
+		if r := readResponse(buf); r != expected {
+			t.Error("Expected", expected, "got", r)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Error("Expected the upstream connection to be reused, got connections:", n)
+	}
+
+	io.WriteString(c, "GET /up HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello\n")
+	resp, err = http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected upgrade response", err)
+	}
+	if line, _ := buf.ReadString('\n'); line != "echo hello\n" {
+		t.Error("Expected upgraded connection to be tunneled, got", line)
+	}
+}
+
+func TestHTTPMitmWebsocket(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, buf, err := w.(http.Hijacker).Hijack()
+		panicOnErr(err, "hijack")
+		defer c.Close()
+		// the first frame is sent along with the handshake response
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n\x81\x02hi")
+		frame := make([]byte, 4)
+		io.ReadFull(buf, frame)
+		c.Write(frame)
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return goproxy.HTTPMitmConnect, host
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	buf := bufio.NewReader(c)
+	io.WriteString(c, "CONNECT "+s.Listener.Addr().String()+" HTTP/1.1\r\nHost: "+s.Listener.Addr().String()+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	io.WriteString(c, "GET /ws HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	resp, err = http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected websocket handshake response", err)
+	}
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(buf, frame); err != nil || string(frame) != "\x81\x02hi" {
+		t.Errorf("Expected the first frame, got %q %v", frame, err)
+	}
+	c.Write([]byte("\x81\x02yo"))
+	if _, err := io.ReadFull(buf, frame); err != nil || string(frame) != "\x81\x02yo" {
+		t.Errorf("Expected the echoed frame, got %q %v", frame, err)
+	}
+}
+
+func TestHTTPMitmRequestContexts(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.UserData = "connect"
+		return goproxy.HTTPMitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-User-Data", fmt.Sprint(ctx.UserData))
+		ctx.UserData = "request"
+		if req.URL.Path == "/rt" {
+			ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, "round tripper"), nil
+			})
+		}
+		return req, nil
+	})
+	var latency time.Duration
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		latency = ctx.Latency
+		return resp
+	})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-User-Data"))
+	}))
+	defer s.Close()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	buf := bufio.NewReader(c)
+	io.WriteString(c, "CONNECT "+s.Listener.Addr().String()+" HTTP/1.1\r\nHost: "+s.Listener.Addr().String()+"\r\n\r\n")
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	for _, expected := range []string{"connect", "connect", "round tripper"} {
+		path := "/"
+		if expected == "round tripper" {
+			path = "/rt"
+		}
+		io.WriteString(c, "GET "+path+" HTTP/1.1\r\nHost: x\r\n\r\n")
+		if r := readResponse(buf); r != expected {
+			t.Error("Expected", expected, "got", r)
+		}
+		if expected == "connect" && latency <= 0 {
+			t.Error("Expected the latency of the tunneled request to be set")
+		}
+	}
+}
+
+// upgradeEcho switches the connection to the requested protocol and echoes it
+var upgradeEcho = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	c, buf, err := w.(http.Hijacker).Hijack()
+	panicOnErr(err, "hijack")
+	defer c.Close()
+	io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: "+r.Header.Get("Upgrade")+"\r\n\r\n")
+	io.Copy(c, buf)
+})
+
+func readUpgrade(t *testing.T, c io.ReadWriter, target, host string) *bufio.Reader {
+	io.WriteString(c, "GET "+target+" HTTP/1.1\r\nHost: "+host+"\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	buf := bufio.NewReader(c)
+	resp, err := http.ReadResponse(buf, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatal("Expected upgrade response", resp, err)
+	}
+	return buf
+}
+
+func TestUpgradeTunneled(t *testing.T) {
+	s := httptest.NewServer(upgradeEcho)
+	defer s.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	buf := readUpgrade(t, c, s.URL+"/", s.Listener.Addr().String())
+	io.WriteString(c, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(buf, b); err != nil || string(b) != "ping" {
+		t.Errorf("Expected the upgraded connection to be tunneled, got %q %v", b, err)
+	}
+}
+
+func TestOnUpgradeMitm(t *testing.T) {
+	s := httptest.NewTLSServer(upgradeEcho)
+	defer s.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnUpgrade(goproxy.UpgradeProtocolIs("other")).DoFunc(func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *goproxy.ProxyCtx) {
+		t.Error("Handler called for another protocol")
+	})
+	proxy.OnUpgrade(goproxy.UpgradeProtocolIs("echo")).DoFunc(func(resp *http.Response, client, upstream io.ReadWriteCloser, ctx *goproxy.ProxyCtx) {
+		// uppercase what the client sends
+		b := make([]byte, 4)
+		io.ReadFull(client, b)
+		upstream.Write(bytes.ToUpper(b))
+		io.ReadFull(upstream, b)
+		client.Write(b)
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+s.Listener.Addr().String()+" HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	tc := tls.Client(c, acceptAllCerts)
+	buf := readUpgrade(t, tc, "/", s.Listener.Addr().String())
+	io.WriteString(tc, "ping")
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(buf, b); err != nil || string(b) != "PING" {
+		t.Errorf("Expected the OnUpgrade handler to handle the connection, got %q %v", b, err)
+	}
+}
+
+func TestHijackTLSConn(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		conn, err := ctx.HijackTLSConn()
+		if err != nil {
+			t.Error("Cannot hijack MITM'd connection", err)
+			return req, nil
+		}
+		if _, err := ctx.HijackTLSConn(); err != goproxy.ErrHijacked {
+			t.Error("Expected ErrHijacked, got", err)
+		}
+		go func() {
+			defer conn.Close()
+			// the pipelined data is returned first
+			b := make([]byte, 4)
+			io.ReadFull(conn, b)
+			io.WriteString(conn, "hijacked "+string(b))
+		}()
+		return req, nil
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "dial")
+	defer c.Close()
+	io.WriteString(c, "CONNECT "+https.Listener.Addr().String()+" HTTP/1.1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through proxy", err)
+	}
+	tc := tls.Client(c, acceptAllCerts)
+	io.WriteString(tc, "GET /bobo HTTP/1.1\r\nHost: "+https.Listener.Addr().String()+"\r\n\r\nping")
+	b, err := ioutil.ReadAll(tc)
+	if string(b) != "hijacked ping" {
+		t.Errorf("Expected the hijacker to answer, got %q %v", b, err)
+	}
+	if _, err := (&goproxy.ProxyCtx{}).HijackTLSConn(); err != goproxy.ErrNotMitmTLS {
+		t.Error("Expected ErrNotMitmTLS, got", err)
+	}
+}
+
+func TestConnAndReqData(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmKeepAlive = true
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.ConnData.Set("host", host)
+		ctx.ReqData.Set("connect", true)
+		return goproxy.MitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if ctx.ReqData.Bool("connect") || ctx.ConnData.String("host") != https.Listener.Addr().String() {
+			t.Error("Unexpected data in MITM'd request context", ctx.ReqData.Keys(), ctx.ConnData.Keys())
+		}
+		ctx.ReqData.Set("n", ctx.ConnData.Add("requests", 1))
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusOK, strconv.Itoa(ctx.ReqData.Int("n")))
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, expected := range []string{"1", "2", "3"} {
+		if r := string(getOrFail(https.URL+"/bobo", client, t)); r != expected {
+			t.Error("Expected", expected, "got", r)
+		}
+	}
+}
+
+func TestComposedConditions(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.Or(
+		goproxy.And(goproxy.MethodIs("POST"), goproxy.ReqHeaderIs("X-Api", "1", "2"), goproxy.ReqContentTypeIs("application/json")),
+		goproxy.QueryParamMatches("q", regexp.MustCompile("^ma")),
+	)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return nil, goproxy.TextResponse(req, "matched")
+	})
+	proxy.OnResponse(goproxy.RespAnd(
+		goproxy.StatusCodeBetween(200, 299),
+		goproxy.SrcIpInNet("127.0.0.0/8", "::1/128"),
+		goproxy.RespNot(goproxy.RespHeaderIs("Content-Type", "text/plain")),
+	)).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Matched", "yes")
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		method, query, header, contentType string
+		expected                           string
+	}{
+		{"POST", "", "2", "application/json; charset=utf-8", "matched"},
+		{"POST", "", "3", "application/json", "bobo"},
+		{"GET", "", "1", "application/json", "bobo"},
+		{"GET", "q=match", "", "", "matched"},
+		{"GET", "q=nomatch", "", "", "bobo"},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+"/bobo?"+tc.query, nil)
+		req.Header.Set("X-Api", tc.header)
+		req.Header.Set("Content-Type", tc.contentType)
+		resp, err := client.Do(req)
+		panicOnErr(err, "client.Do")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.expected {
+			t.Errorf("%+v: expected %s, got %s", tc, tc.expected, b)
+		}
+		if matched := resp.Header.Get("X-Matched") == "yes"; matched != (tc.expected == "bobo") {
+			t.Errorf("%+v: unexpected X-Matched header %q", tc, resp.Header.Get("X-Matched"))
+		}
+	}
+}
+
+func TestHandlerPriorityAndRemoval(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	respond := func(body string) func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+			return nil, goproxy.TextResponse(req, body)
+		}
+	}
+	low := proxy.OnRequest().DoFunc(respond("low"))
+	high := proxy.OnRequest().Priority(10).DoFunc(respond("high"))
+	proxy.OnRequest().Priority(10).DoFunc(respond("second high"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "high" {
+		t.Error("Expected the handler with the highest priority to run first, got", r)
+	}
+	if !high.Remove() || high.Remove() {
+		t.Error("Expected Remove to return true only once")
+	}
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "second high" {
+		t.Error("Expected handlers of the same priority to run in registration order, got", r)
+	}
+	proxy.OnRequest(goproxy.ReqHostIs("unknown")).Priority(20).DoFunc(respond("unknown"))
+	proxy.OnRequest().Priority(-1).DoFunc(respond("lowest"))
+	if r := string(getOrFail(srv.URL+"/bobo", client, t)); r != "second high" {
+		t.Error("Expected the second high priority handler, got", r)
+	}
+	if low.Priority() != 0 || high.Priority() != 10 {
+		t.Error("Unexpected priorities", low.Priority(), high.Priority())
+	}
+}
+
+func TestRuleSet(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Rule")+r.Header.Get("X-Drop"))
+	}))
+	defer s.Close()
+	f, err := ioutil.TempFile("", "rules*.json")
+	panicOnErr(err, "TempFile")
+	defer os.Remove(f.Name())
+	write := func(config string, mtime time.Time) {
+		panicOnErr(ioutil.WriteFile(f.Name(), []byte(config), 0600), "WriteFile")
+		panicOnErr(os.Chtimes(f.Name(), mtime, mtime), "Chtimes")
+	}
+	write(`{"rules": [
+		{"name": "drop", "action": "rewrite", "remove_headers": ["X-Drop"]},
+		{"paths": ["/blocked/"], "action": "block", "status": 404, "body": "blocked"},
+		{"paths": ["/old/*"], "methods": ["GET"], "action": "redirect", "location": "/new"},
+		{"paths": ["/"], "action": "rewrite", "set_headers": {"X-Rule": "rewritten"}},
+		{"hosts": ["`+https.Listener.Addr().String()+`"], "action": "block", "status": 451}
+	]}`, time.Now().Add(-time.Hour))
+	rules, err := goproxy.LoadRules(f.Name())
+	panicOnErr(err, "LoadRules")
+	proxy := goproxy.NewProxyHttpServer()
+	rules.Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	expect := func(url string, status int, body string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("X-Drop", "dropped")
+		resp, err := client.Do(req)
+		if err != nil {
+			if status != 0 {
+				t.Error("Unexpected error", url, err)
+			}
+			return
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != status || string(b) != body {
+			t.Errorf("%s: expected %d %q, got %d %q", url, status, body, resp.StatusCode, b)
+		}
+	}
+	expect(s.URL+"/blocked/a", 404, "blocked")
+	expect(s.URL+"/ok", 200, "rewritten")
+	expect(s.URL+"/old/page", http.StatusFound, "")
+	expect(https.URL+"/bobo", 0, "")
+
+	write(`{"rules": [{"hosts": ["`+s.Listener.Addr().String()+`"], "paths": ["/ok"], "action": "reject"}]}`, time.Now())
+	stop := rules.WatchFile(10 * time.Millisecond)
+	defer stop()
+	for i := 0; i < 100 && len(rules.Rules()) != 1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	expect(s.URL+"/ok", http.StatusForbidden, "")
+	expect(s.URL+"/blocked/a", 200, "dropped")
+	expect(https.URL+"/bobo", 200, "bobo")
+
+	write(`{"rules": [{"action": "explode"}]}`, time.Now().Add(time.Hour))
+	if err := rules.Reload(); err == nil || len(rules.Rules()) != 1 {
+		t.Error("Expected a failed reload to keep the previous rules", err)
+	}
+}
+
+func TestRuleSetYAML(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Rule"))
+	}))
+	defer s.Close()
+	f, err := ioutil.TempFile("", "rules*.yaml")
+	panicOnErr(err, "TempFile")
+	defer os.Remove(f.Name())
+	panicOnErr(ioutil.WriteFile(f.Name(), []byte(`
+rules:
+  - paths: [/blocked/]
+    action: block
+    status: 404
+    body: blocked
+  - name: tag
+    action: rewrite
+    set_headers:
+      X-Rule: rewritten
+`), 0600), "WriteFile")
+	rules, err := goproxy.LoadRules(f.Name())
+	panicOnErr(err, "LoadRules")
+	proxy := goproxy.NewProxyHttpServer()
+	rules.Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(s.URL + "/blocked/a")
+	panicOnErr(err, "get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 404 || string(b) != "blocked" {
+		t.Errorf("Expected the YAML block rule to apply, got %d %q", resp.StatusCode, b)
+	}
+	if r := string(getOrFail(s.URL+"/ok", client, t)); r != "rewritten" {
+		t.Error("Expected the YAML rewrite rule to apply, got", r)
+	}
+
+	if _, err := goproxy.ParseRulesYAML([]byte("rules:\n  - action: explode\n")); err == nil {
+		t.Error("Expected an unknown action to be rejected")
+	}
+	if _, err := goproxy.ParseRulesYAML([]byte("rules: [")); err == nil {
+		t.Error("Expected malformed YAML to be rejected")
+	}
+}
+
+func TestScriptPolicy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Tenant"))
+	}))
+	defer s.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	policy := &goproxy.ScriptPolicy{
+		Connect: goproxy.MustCompileExpr(`host == "` + https.Listener.Addr().String() + `" ? "reject" : ""`),
+		Request: goproxy.MustCompileExpr(`startsWith(path, "/admin") ? "deny:401" : path == "/old" ? "redirect:/new" : query("loop") != "" ? loop(1) : "allow"`),
+		SetHeaders: map[string]*goproxy.Expr{
+			"X-Tenant": goproxy.MustCompileExpr(`header("X-User") != "" ? "tenant-" + lower(header("X-User")) : ""`),
+		},
+	}
+	policy.Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for _, tc := range []struct {
+		path, user string
+		status     int
+		body       string
+	}{
+		{"/admin/x", "", 401, "Request denied by policy\n"},
+		{"/old", "", http.StatusFound, ""},
+		{"/ok", "Bob", 200, "tenant-bob"},
+		{"/ok?loop=1", "", 403, "Request denied by policy\n"},
+	} {
+		req, _ := http.NewRequest("GET", s.URL+tc.path, nil)
+		req.Header.Set("X-User", tc.user)
+		req.Header.Set("X-Tenant", "forged")
+		resp, err := client.Do(req)
+		panicOnErr(err, "client.Do")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || string(b) != tc.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.path, tc.status, tc.body, resp.StatusCode, b)
+		}
+	}
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected the CONNECT request to be rejected")
+	}
+}
+
+func TestCADownload(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	(&goproxy.CADownload{}).Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	get := func(path string) (*http.Response, []byte) {
+		resp, err := client.Get("http://goproxy.ca" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return resp, body
+	}
+	if resp, body := get("/"); resp.StatusCode != 200 || !strings.Contains(string(body), `href="/ca.mobileconfig"`) {
+		t.Error("Expected the instructions page, got", resp.Status, string(body))
+	}
+	if _, body := get("/ca.crt"); !bytes.Equal(body, goproxy.GoproxyCa.Leaf.Raw) {
+		t.Error("Expected the DER certificate")
+	}
+	resp, body := get("/ca.pem")
+	if resp.Header.Get("Content-Type") != "application/x-pem-file" || !bytes.HasPrefix(body, []byte("-----BEGIN CERTIFICATE-----")) {
+		t.Error("Expected the PEM certificate, got", string(body))
+	}
+	if bytes.Contains(body, []byte("PRIVATE")) {
+		t.Error("The private key must not be served")
+	}
+	_, body = get("/ca.mobileconfig")
+	if !bytes.HasPrefix(body, []byte(`<?xml version="1.0"`)) || !bytes.Contains(body, []byte(base64.StdEncoding.EncodeToString(goproxy.GoproxyCa.Leaf.Raw))) ||
+		!bytes.Contains(body, []byte("<string>com.apple.security.root</string>")) {
+		t.Error("Unexpected configuration profile", string(body))
+	}
+	if resp, _ := get("/other"); resp.StatusCode != 404 {
+		t.Error("Expected 404 for unknown paths, got", resp.Status)
+	}
+}
+
+func TestGenerateCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := dir+"/ca.pem", dir+"/ca.key"
+	opts := &goproxy.CAOptions{KeyType: goproxy.KeyECDSAP384, Validity: 24 * time.Hour, PermittedDNSDomains: []string{"example.com"}}
+	ca, err := goproxy.LoadOrGenerateCA(certFile, keyFile, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := ca.Leaf
+	if !leaf.IsCA || !leaf.MaxPathLenZero || leaf.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth ||
+		leaf.PermittedDNSDomains[0] != "example.com" || leaf.NotAfter.After(time.Now().Add(25*time.Hour)) {
+		t.Error("Unexpected CA certificate", leaf)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Expected the key to be private", info, err)
+	}
+	loaded, err := goproxy.LoadOrGenerateCA(certFile, keyFile, opts)
+	if err != nil || !bytes.Equal(loaded.Certificate[0], ca.Certificate[0]) {
+		t.Fatal("Expected the persisted CA to be loaded", err)
+	}
+	if goproxy.IsDemoCA(ca) || !goproxy.IsDemoCA(&goproxy.GoproxyCa) {
+		t.Error("IsDemoCA failed")
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.RefuseDemoCA = true
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	if _, err := client.Get(https.URL + "/bobo"); err == nil {
+		t.Error("Expected MITM with the demo CA to be refused")
+	}
+
+	proxy = goproxy.NewProxyHttpServer()
+	proxy.RefuseDemoCA = true
+	mitm := &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: goproxy.TLSConfigFromCA(loaded)}
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		return mitm, host
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	proxyUrl, _ := url.Parse(s.URL)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, Proxy: http.ProxyURL(proxyUrl)}}
+	if resp := string(getOrFail(https.URL+"/bobo", client, t)); resp != "bobo" {
+		t.Error("Wrong response when MITM'd with the generated CA", resp)
+	}
+}
+
+func TestClientIdentifier(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientIdentifier = goproxy.FirstIdentity(goproxy.IdentifyByProxyAuthUser, goproxy.IdentifyBySourceIP)
+	rules, err := goproxy.ParseRules([]byte(`{"rules": [{"clients": ["bob"], "action": "block", "status": 403}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules.Install(proxy)
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.ClientIdIs("alice", "127.0.0.1")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusOK, ctx.ClientID)
+	})
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	clientAs := func(user string) *http.Client {
+		proxyUrl, _ := url.Parse(s.URL)
+		if user != "" {
+			proxyUrl.User = url.UserPassword(user, "password")
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyUrl)}}
+	}
+	for _, test := range []struct {
+		user, url, expected string
+	}{
+		{"alice", srv.URL + "/bobo", "alice"},
+		{"alice", https.URL + "/bobo", "alice"},
+		{"", srv.URL + "/bobo", "127.0.0.1"},
+		{"", https.URL + "/bobo", "127.0.0.1"},
+	} {
+		if r := string(getOrFail(test.url, clientAs(test.user), t)); r != test.expected {
+			t.Errorf("Expected the client of %s as %q to be identified as %q, got %q", test.url, test.user, test.expected, r)
+		}
+	}
+	resp, err := clientAs("bob").Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected the rule of bob to apply, got", resp.Status)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientIdentifier = goproxy.IdentifyByProxyAuthUser
+	proxy.RateLimiter = &goproxy.RateLimiter{
+		Limits: goproxy.RateLimits{RequestsPerSecond: 0.1, Burst: 2},
+		ClientLimits: map[string]goproxy.RateLimits{
+			"alice": {MaxTunnels: 1},
+			"bob":   {BytesPerDay: 6},
+		},
+		Reject: func(req *http.Request, ctx *goproxy.ProxyCtx, err error) *http.Response {
+			if err == goproxy.ErrQuotaExceeded {
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusPaymentRequired, "pay up")
+			}
+			return nil
+		},
+	}
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+
+	getAs := func(user string) *http.Response {
+		proxyUrl, _ := url.Parse(s.URL)
+		if user != "" {
+			proxyUrl.User = url.UserPassword(user, "password")
+		}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+		resp, err := client.Get(srv.URL + "/bobo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp := getAs("")
+		if resp.StatusCode != expected {
+			t.Errorf("Expected request %d to get %d, got %s", i, expected, resp.Status)
+		}
+		if expected == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("Expected a Retry-After header when rate limited")
+		}
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusPaymentRequired} {
+		if resp := getAs("bob"); resp.StatusCode != expected {
+			t.Errorf("Expected request %d of bob to get %d, got %s", i, expected, resp.Status)
+		}
+	}
+	if usage := proxy.RateLimiter.Usage("bob"); usage.BytesToday < 8 {
+		t.Error("Expected bob to have transferred at least 8 bytes, got", usage.BytesToday)
+	}
+
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("CONNECT", "//"+https.Listener.Addr().String(), nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:password")))
+		req.Write(c)
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp.StatusCode
+	}
+	first, status := connect()
+	if status != http.StatusOK {
+		t.Fatal("Expected the first tunnel of alice to be accepted, got", status)
+	}
+	second, status := connect()
+	second.Close()
+	if status != http.StatusTooManyRequests {
+		t.Error("Expected the second tunnel of alice to be rejected, got", status)
+	}
+	first.Close()
+	for i := 0; proxy.RateLimiter.Usage("alice").Tunnels > 0; i++ {
+		if i == 100 {
+			t.Fatal("Expected the tunnel of alice to be released when closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, status := connect()
+	third.Close()
+	if status != http.StatusOK {
+		t.Error("Expected a new tunnel of alice to be accepted once the first one closed, got", status)
+	}
+}
+
+func TestUpstreamLimiter(t *testing.T) {
+	entered, unblock := make(chan bool), make(chan bool)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			entered <- true
+			<-unblock
+		}
+		io.WriteString(w, "done")
+	}))
+	defer slow.Close()
+	// the per host limits ignore the port, use another host name for the busy host
+	slowURL := strings.Replace(slow.URL, "127.0.0.1", "localhost", 1)
+
+	newProxy := func(limiter *goproxy.UpstreamLimiter) (*httptest.Server, *http.Client) {
+		proxy := goproxy.NewProxyHttpServer()
+		proxy.UpstreamLimiter = limiter
+		s := httptest.NewServer(proxy)
+		proxyUrl, _ := url.Parse(s.URL)
+		return s, &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	}
+	get := func(client *http.Client, url string) int {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for i, limiter := range []*goproxy.UpstreamLimiter{
+		{MaxRequestsPerHost: 1, MaxQueue: -1},
+		{MaxRequestsPerHost: 1, QueueTimeout: 10 * time.Millisecond},
+	} {
+		s, client := newProxy(limiter)
+		done := make(chan int)
+		go func() { done <- get(client, slowURL+"/slow") }()
+		<-entered
+		if status := get(client, slowURL+"/"); status != http.StatusServiceUnavailable {
+			t.Errorf("Expected a second request to the busy host to fail with limiter %d, got %d", i, status)
+		}
+		if status := get(client, srv.URL+"/bobo"); status != http.StatusOK {
+			t.Errorf("Expected a request to another host to succeed with limiter %d, got %d", i, status)
+		}
+		unblock <- true
+		if status := <-done; status != http.StatusOK {
+			t.Error("Expected the slow request to succeed, got", status)
+		}
+		if status := get(client, slowURL+"/"); status != http.StatusOK {
+			t.Errorf("Expected a request to succeed once the host is free with limiter %d, got %d", i, status)
+		}
+		s.Close()
+	}
+
+	s, client := newProxy(&goproxy.UpstreamLimiter{MaxRequests: 1})
+	defer s.Close()
+	done := make(chan int)
+	go func() { done <- get(client, slowURL+"/slow") }()
+	<-entered
+	queued := make(chan int)
+	go func() { queued <- get(client, srv.URL+"/bobo") }()
+	select {
+	case status := <-queued:
+		t.Fatal("Expected the request to wait for a free slot, got", status)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unblock <- true
+	if status := <-done; status != http.StatusOK {
+		t.Error("Expected the slow request to succeed, got", status)
+	}
+	if status := <-queued; status != http.StatusOK {
+		t.Error("Expected the queued request to succeed, got", status)
+	}
+
+	s, _ = newProxy(&goproxy.UpstreamLimiter{MaxConnsPerHost: 1, MaxQueue: -1})
+	defer s.Close()
+	connect := func() (net.Conn, int) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("CONNECT", "//"+https.Listener.Addr().String(), nil)
+		req.Write(c)
+		resp, err := http.ReadResponse(bufio.NewReader(c), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, resp.StatusCode
+	}
+	first, status := connect()
+	if status != http.StatusOK {
+		t.Fatal("Expected the first tunnel to be accepted, got", status)
+	}
+	second, status := connect()
+	second.Close()
+	if status != http.StatusServiceUnavailable {
+		t.Error("Expected a second tunnel to the host to be refused, got", status)
+	}
+	first.Close()
+	for i := 0; ; i++ {
+		third, status := connect()
+		third.Close()
+		if status == http.StatusOK {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Expected a tunnel to be accepted once the first one closed, got", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSniffedContentType(t *testing.T) {
+	png := []byte("\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("x", 1000))
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/png":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write(png)
+		case "/html":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			io.WriteString(w, "<!DOCTYPE html><html><body>hi</body></html>")
+		}
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.SniffedContentTypeIs("image/")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		resp.Header.Set("X-Sniffed", goproxy.SniffContentType(resp, ctx))
+		return resp
+	})
+	proxy.OnResponse(goproxy.SniffedContentTypeIs("text/html")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusOK, "rewritten html")
+	})
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	resp, err := client.Get(backend.URL + "/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("X-Sniffed") != "image/png" || !bytes.Equal(body, png) {
+		t.Errorf("Expected the mislabeled PNG to be sniffed and passed intact, got %q and %d bytes", resp.Header.Get("X-Sniffed"), len(body))
+	}
+	if r := string(getOrFail(backend.URL+"/html", client, t)); r != "rewritten html" {
+		t.Errorf("Expected the mislabeled HTML to be rewritten, got %q", r)
+	}
+}
+
+func TestCookieJars(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: req.URL.Query().Get("user"), Path: "/"})
+		}
+		io.WriteString(w, req.Header.Get("Cookie"))
+	}))
+	defer backend.Close()
+
+	var mu sync.Mutex
+	saved := map[string][]goproxy.JarCookie{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientIdentifier = goproxy.IdentifyByHeader("X-Client")
+	proxy.CookieJars = &goproxy.CookieJars{
+		Isolate: true,
+		Load: func(client string) []goproxy.JarCookie {
+			if client == "carol" {
+				return []goproxy.JarCookie{{Name: "session", Value: "restored", Domain: "127.0.0.1", Path: "/", HostOnly: true}}
+			}
+			return nil
+		},
+		Save: func(client string, cookies []goproxy.JarCookie) {
+			mu.Lock()
+			saved[client] = cookies
+			mu.Unlock()
+		},
+	}
+	proxy.OnRequest(goproxy.UrlHasPrefix("127.0.0.1")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Path == "/freeze" {
+			ctx.CookieJar().Freeze(true)
+		}
+		return req, nil
+	})
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	get := func(clientID, path string) (string, string) {
+		req, _ := http.NewRequest("GET", backend.URL+path, nil)
+		req.Header.Set("X-Client", clientID)
+		req.Header.Set("Cookie", "own=1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b), resp.Header.Get("Set-Cookie")
+	}
+
+	if cookies, setCookie := get("alice", "/login?user=alice"); cookies != "" || setCookie != "" {
+		t.Errorf("Expected the cookies to be isolated from the client, got %q and %q", cookies, setCookie)
+	}
+	if cookies, _ := get("alice", "/"); cookies != "session=alice" {
+		t.Error("Expected the session cookie of alice from her jar, got", cookies)
+	}
+	if cookies, _ := get("bob", "/"); cookies != "" {
+		t.Error("Expected bob to have an empty jar, got", cookies)
+	}
+	get("bob", "/freeze")
+	get("bob", "/login?user=bob")
+	if cookies, _ := get("bob", "/"); cookies != "" {
+		t.Error("Expected the frozen jar of bob to stay empty, got", cookies)
+	}
+	if cookies, _ := get("carol", "/"); cookies != "session=restored" {
+		t.Error("Expected the cookies of carol to be loaded, got", cookies)
+	}
+	mu.Lock()
+	if len(saved["alice"]) != 1 || saved["alice"][0].Value != "alice" || saved["bob"] != nil {
+		t.Errorf("Unexpected saved cookies %+v", saved)
+	}
+	mu.Unlock()
+
+	proxy.CookieJars.Isolate = false
+	if cookies, _ := get("alice", "/"); cookies != "own=1; session=alice" {
+		t.Error("Expected the cookies of alice and of her jar, got", cookies)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "backend")
+		w.Header().Set("X-Internal", "1")
+		io.WriteString(w, r.Header.Get("Authorization")+"|"+r.Header.Get("Referer")+"|"+r.Header.Get("X-Renamed")+"|"+strings.Join(r.Header.Values("X-Via"), ","))
+	}))
+	defer s.Close()
+	rules, err := goproxy.ParseRules([]byte(`{"rules": [
+		{"hosts": ["` + s.Listener.Addr().String() + `"], "paths": ["/api/"], "action": "headers", "headers": [
+			{"op": "set", "name": "Authorization", "value": "Bearer ${query:user}-${method}"},
+			{"op": "remove", "name": "Referer"},
+			{"op": "rename", "name": "X-Original", "to": "X-Renamed"},
+			{"op": "add", "name": "X-Via", "value": "${client_id}"},
+			{"op": "remove", "name": "Server", "response": true},
+			{"op": "rename", "name": "X-Internal", "to": "X-Public", "response": true},
+			{"op": "set", "name": "X-Status", "value": "${status} ${path}", "response": true}
+		]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ClientIdentifier = goproxy.IdentifyByHeader("X-Client")
+	rules.Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	get := func(path string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", s.URL+path, nil)
+		req.Header.Set("Referer", "http://referer/")
+		req.Header.Set("X-Original", "original")
+		req.Header.Set("X-Via", "client")
+		req.Header.Set("X-Client", "alice")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+	resp, body := get("/api/x?user=bob")
+	if body != "Bearer bob-GET||original|client,alice" {
+		t.Error("Unexpected request headers", body)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("X-Public") != "1" || resp.Header.Get("X-Internal") != "" || resp.Header.Get("X-Status") != "200 /api/x" {
+		t.Error("Unexpected response headers", resp.Header)
+	}
+	resp, body = get("/other")
+	if body != "|http://referer/||client" || resp.Header.Get("Server") != "backend" {
+		t.Error("Expected requests not matching the rule to be unchanged, got", body, resp.Header)
+	}
+
+	for _, bad := range []string{
+		`{"op": "set", "name": "X", "value": "${unknown}"}`,
+		`{"op": "set", "name": "X", "value": "${header}"}`,
+		`{"op": "rename", "name": "X"}`,
+		`{"op": "explode", "name": "X"}`,
+	} {
+		if _, err := goproxy.ParseRules([]byte(`{"rules": [{"action": "headers", "headers": [` + bad + `]}]}`)); err == nil {
+			t.Error("Expected an error for", bad)
+		}
+	}
+}
+
+func TestMitmHTTP2(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+		w.Header().Set("X-Handled", r.Header.Get("X-Handled"))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// echo every message as soon as it is received
+		buf := make([]byte, 64)
+		for {
+			n, err := r.Body.Read(buf)
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	s.EnableHTTP2 = true
+	s.StartTLS()
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.MitmHTTP2 = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-Handled", "yes")
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+
+	pr, pw := io.Pipe()
+	req, _ := http.NewRequest("POST", s.URL+"/stream", pr)
+	req.Header.Set("Te", "trailers")
+	done := make(chan struct{})
+	var resp *http.Response
+	go func() {
+		defer close(done)
+		var err error
+		if resp, err = client.Do(req); err != nil {
+			t.Error(err)
+		}
+	}()
+	io.WriteString(pw, "ping")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the response to start before the end of the request body")
+	}
+	if resp == nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Header.Get("X-Proto") != "HTTP/2.0" || resp.Header.Get("X-Handled") != "yes" {
+		t.Errorf("Expected HTTP/2 on both sides through the handlers, got %s %v", resp.Proto, resp.Header)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(resp.Body, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected the message to be echoed while streaming, got %q %v", buf, err)
+	}
+	io.WriteString(pw, "pong")
+	pw.Close()
+	b, _ := ioutil.ReadAll(resp.Body)
+	if string(b) != "pong" || resp.Trailer.Get("Grpc-Status") != "0" {
+		t.Errorf("Expected the rest of the body and the trailer, got %q %v", b, resp.Trailer)
+	}
+}
+
+func TestGraphQL(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	var mu sync.Mutex
+	var seen []string
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		for _, op := range goproxy.GraphQLOperations(req, ctx) {
+			mu.Lock()
+			seen = append(seen, fmt.Sprintf("%s %s %v", op.Type, op.Name, op.Fields))
+			mu.Unlock()
+		}
+		return req, nil
+	})
+	proxy.OnRequest(goproxy.GraphQLFieldIs("deleteUser")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "forbidden")
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, c := range []struct {
+		body, expected string
+		status         int
+	}{
+		{`{"query": "query Me { me { id } }"}`, "query Me [me]", 200},
+		{`{"query": "# comment\nquery A { a } mutation B($id: ID = \"{\") { x: deleteUser(id: $id, opts: {soft: true}) { ok } ...F } fragment F on Mutation { audit @include(if: true) ... on Mutation { log } }", "operationName": "B", "variables": {"id": 1}}`,
+			"mutation B [deleteUser audit log]", 403},
+		{`[{"query": "{ a b(x: [1, 2]) { c } }"}, {"query": "subscription S { \"\"\"doc\"\"\" feed }"}]`, "query  [a b]|subscription S [feed]", 200},
+	} {
+		seen = nil
+		resp, err := client.Post(backend.URL, "application/json", strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if got := strings.Join(seen, "|"); got != c.expected {
+			t.Errorf("Expected operations %q, got %q", c.expected, got)
+		}
+		if resp.StatusCode != c.status || (c.status == 200 && string(b) != c.body) {
+			t.Errorf("Expected %d and the body to be forwarded, got %d %q", c.status, resp.StatusCode, b)
+		}
+	}
+
+	seen = nil
+	getOrFail(backend.URL+"?query="+url.QueryEscape("mutation { deleteUser(id: 1) }"), client, t)
+	if len(seen) != 1 || seen[0] != "mutation  [deleteUser]" {
+		t.Error("Expected the operation of a GET request, got", seen)
+	}
+}
+
+func TestTunnelPolicy(t *testing.T) {
+	// echo servers, sending banner first
+	echo := func(banner string) net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		panicOnErr(err, "listen")
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					io.WriteString(c, banner)
+					io.Copy(c, c)
+					c.Close()
+				}()
+			}
+		}()
+		return l
+	}
+	smtp := echo("220 mail.example.com ESMTP ready\r\n")
+	defer smtp.Close()
+	silent := echo("")
+	defer silent.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CaptureClientHello = true
+	proxy.TunnelSniffTimeout = 500 * time.Millisecond
+	var mu sync.Mutex
+	var protocols []goproxy.TunnelProtocol
+	var recorded bytes.Buffer
+	proxy.TunnelPolicy = func(ctx *goproxy.ProxyCtx, sniff *goproxy.TunnelSniff) goproxy.TunnelDecision {
+		mu.Lock()
+		protocols = append(protocols, sniff.Protocol)
+		mu.Unlock()
+		switch sniff.Protocol {
+		case goproxy.TunnelSSH:
+			return goproxy.TunnelDecision{Action: goproxy.TunnelReject}
+		case goproxy.TunnelSMTP:
+			return goproxy.TunnelDecision{RecordClient: &recorded}
+		}
+		return goproxy.TunnelDecision{}
+	}
+	client, s := oneShotProxy(proxy, t)
+	defer s.Close()
+
+	if r := string(getOrFail(https.URL+"/bobo", client, t)); r != "bobo" {
+		t.Error("Expected an allowed TLS tunnel, got", r)
+	}
+
+	connect := func(l net.Listener) (net.Conn, *bufio.Reader) {
+		c, err := net.Dial("tcp", s.Listener.Addr().String())
+		panicOnErr(err, "dial")
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", l.Addr(), l.Addr())
+		r := bufio.NewReader(c)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatal("Cannot CONNECT", err)
+		}
+		return c, r
+	}
+	c, r := connect(smtp)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if banner, err := r.ReadString('\n'); err != nil || !strings.HasPrefix(banner, "220 ") {
+		t.Errorf("Expected the banner of the server, got %q %v", banner, err)
+	}
+	io.WriteString(c, "EHLO client\r\n")
+	if echo, err := r.ReadString('\n'); err != nil || echo != "EHLO client\r\n" {
+		t.Errorf("Expected the tunnel to be relayed, got %q %v", echo, err)
+	}
+	c.Close()
+
+	c, r = connect(silent)
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "SSH-2.0-OpenSSH_9.0\r\n")
+	if b, _ := ioutil.ReadAll(r); strings.Contains(string(b), "SSH") {
+		t.Errorf("Expected the SSH tunnel to be rejected, got %q", b)
+	}
+	c.Close()
+
+	if !strings.HasPrefix(recorded.String(), "EHLO client") {
+		t.Errorf("Expected the SMTP client data to be recorded, got %q", recorded.String())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if fmt.Sprint(protocols) != "[tls smtp ssh]" {
+		t.Error("Unexpected protocols", protocols)
+	}
+}
+
+func TestPages(t *testing.T) {
+	rules, err := goproxy.ParseRules([]byte(`{"rules": [
+		{"name": "no-admin", "paths": ["/admin"], "action": "block", "status": 451,
+			"page": {"title": "Admin blocked", "message": "{{.Method}} {{.URL}} is blocked by {{.Rule}}"}}
+	]}`))
+	panicOnErr(err, "ParseRules")
+	proxy := goproxy.NewProxyHttpServer()
+	rules.Install(proxy)
+	page := &goproxy.Page{Title: "Hello {{.Data.who}}", Message: "{{.Host}}"}
+	proxy.OnRequest(goproxy.UrlHasPrefix("/hello")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, page.Response(ctx, map[string]interface{}{"who": "<bob>"})
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	get := func(path, accept string) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", srv.URL+path, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		panicOnErr(err, "client.Do")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	resp, body := get("/admin", "application/json")
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &v); err != nil || resp.StatusCode != 451 ||
+		v["error"] != "Admin blocked" || v["message"] != "GET "+srv.URL+"/admin is blocked by no-admin" || v["rule"] != "no-admin" {
+		t.Errorf("Expected a JSON page, got %d %s", resp.StatusCode, body)
+	}
+	resp, body = get("/admin", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, "<h1>Admin blocked</h1>") {
+		t.Errorf("Expected an HTML page, got %s %s", resp.Header.Get("Content-Type"), body)
+	}
+	resp, body = get("/admin", "text/plain, application/json;q=0.5")
+	if !strings.HasPrefix(body, "Admin blocked\n\nGET ") {
+		t.Errorf("Expected a text page, got %s", body)
+	}
+	resp, body = get("/hello", "")
+	if resp.StatusCode != 403 || !strings.Contains(body, "<h1>Hello &lt;bob&gt;</h1>") || !strings.Contains(body, srv.Listener.Addr().String()) {
+		t.Errorf("Expected an escaped HTML page, got %d %s", resp.StatusCode, body)
+	}
+
+	if _, err := goproxy.ParseRules([]byte(`{"rules": [{"action": "block", "page": {"title": "{{.Oops"}}]}`)); err == nil {
+		t.Error("Expected a broken page template to be refused")
+	}
+}
+
+func TestResponseConditions(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d, err := time.ParseDuration(r.URL.Query().Get("sleep")); err == nil {
+			time.Sleep(d)
+		}
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(r.URL.Path)))
+		w.WriteHeader(status)
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer s.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	var matched []string
+	var mu sync.Mutex
+	record := func(name string) goproxy.FuncRespHandler {
+		return func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+			mu.Lock()
+			matched = append(matched, name+" "+ctx.Req.URL.Path)
+			mu.Unlock()
+			return resp
+		}
+	}
+	proxy.OnResponse(goproxy.StatusClassIs(5), goproxy.LatencyOver(50*time.Millisecond)).Do(record("slow5xx"))
+	proxy.OnResponse(goproxy.StatusClassIs(2, 3)).Do(record("ok"))
+	proxy.OnResponse(goproxy.ResponseSizeOver(4)).Do(record("large"))
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{"/a?status=500", "/b?status=503&sleep=100ms", "/c?status=204", "/large?status=404"} {
+		resp, err := client.Get(s.URL + u)
+		panicOnErr(err, "Get")
+		resp.Body.Close()
+	}
+	if expected := "[slow5xx /b ok /c large /large]"; fmt.Sprint(matched) != expected {
+		t.Errorf("Expected %s, got %v", expected, matched)
+	}
+}
+
+func TestHandlerFailures(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.HandlerTimeout = 100 * time.Millisecond
+	proxy.SlowHandler = 20 * time.Millisecond
+	var failures int32
+	proxy.HandlerFailed = func(ctx *goproxy.ProxyCtx, err error) {
+		if _, ok := err.(*goproxy.HandlerPanicError); ok || err == goproxy.ErrHandlerTimeout {
+			atomic.AddInt32(&failures, 1)
+		}
+	}
+	reqReg := proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		switch req.URL.Path {
+		case "/panic":
+			panic("request handler")
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+		case "/timeout":
+			time.Sleep(300 * time.Millisecond)
+		}
+		return req, nil
+	})
+	respReg := proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx.Req.URL.Path == "/bobo" && ctx.Req.URL.RawQuery == "panic" {
+			var m map[string]string
+			m["x"] = "nil map"
+		}
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/bobo", 200},
+		{"/panic", 500},
+		{"/bobo?panic", 500},
+		{"/slow", 404},
+		{"/timeout", 504},
+		{"/bobo", 200},
+	} {
+		resp, err := client.Get(srv.URL + tc.path)
+		panicOnErr(err, "Get")
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d, got %d", tc.path, tc.status, resp.StatusCode)
+		}
+	}
+	if n := atomic.LoadInt32(&failures); n != 3 {
+		t.Errorf("Expected 3 failures, got %d", n)
+	}
+	if s := reqReg.Stats(); s.Calls != 6 || s.Panics != 1 || s.Timeouts != 1 || s.Slow != 2 {
+		t.Errorf("Unexpected request handler stats %+v", s)
+	}
+	if s := respReg.Stats(); s.Calls != 6 || s.Panics != 1 {
+		t.Errorf("Unexpected response handler stats %+v", s)
+	}
+}
+
+func TestHandlerOutlivingTimeout(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.HandlerTimeout = 50 * time.Millisecond
+	proxy.PoolContexts = true
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var done sync.WaitGroup
+	done.Add(2)
+	proxy.OnRequest(goproxy.UrlHasPrefix("127.0.0.1")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.Path != "/slow" {
+			return req, nil
+		}
+		defer done.Done()
+		// an abandoned handler keeps using the request and its context, unsynchronized
+		// with the proxy
+		time.Sleep(100 * time.Millisecond)
+		req.Header.Set("X-Abandoned", "1")
+		ctx.Req.URL.Path = "/abandoned"
+		ctx.UserData = "abandoned"
+		ctx.Error = errors.New("abandoned")
+		ctx.ReqData.Set("abandoned", true)
+		if conn, err := ctx.HijackTLSConn(); err == nil {
+			conn.Close()
+		}
+		return req, nil
+	})
+	proxy.OnResponse(goproxy.UrlHasPrefix("127.0.0.1")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx.Req.URL.RawQuery != "slow" {
+			return resp
+		}
+		defer done.Done()
+		time.Sleep(100 * time.Millisecond)
+		resp.Header.Set("X-Abandoned", "1")
+		ctx.Resp = nil
+		ctx.Error = errors.New("abandoned")
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{https.URL + "/bobo?slow", https.URL + "/slow"} {
+		resp, err := client.Get(u)
+		panicOnErr(err, "Get")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("%s: expected the handler to time out, got %d", u, resp.StatusCode)
+		}
+	}
+	done.Wait()
+}
+
+func TestShareRequestBody(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goproxy-test")
+	panicOnErr(err, "TempDir")
+	defer os.RemoveAll(tmp)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", tmp)
+
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer echo.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ShareRequestBody = true
+	proxy.BodySpillThreshold = 1000
+	var seen []int
+	read := func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		b, err := ioutil.ReadAll(req.Body)
+		panicOnErr(err, "ReadAll")
+		seen = append(seen, len(b))
+		return req, nil
+	}
+	proxy.OnRequest().DoFunc(read)
+	proxy.OnRequest().DoFunc(read)
+	proxy.OnRequest(goproxy.UrlIs(strings.TrimPrefix(echo.URL, "http://") + "/upper")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		b, _ := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(b)))
+		return req, nil
+	})
+	proxy.OnRequest().DoFunc(read)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		path, body, expected string
+	}{
+		{"/", "short body", "short body"},
+		{"/", strings.Repeat("long body ", 1000), strings.Repeat("long body ", 1000)},
+		{"/upper", "replaced body", "REPLACED BODY"},
+	} {
+		seen = nil
+		resp, err := client.Post(echo.URL+tc.path, "text/plain", strings.NewReader(tc.body))
+		panicOnErr(err, "Post")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.expected {
+			t.Errorf("%s: expected %d bytes upstream, got %d", tc.path, len(tc.expected), len(b))
+		}
+		for _, n := range seen {
+			if n != len(tc.body) {
+				t.Errorf("%s: expected the handlers to read %d bytes, got %v", tc.path, len(tc.body), seen)
+				break
+			}
+		}
+	}
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("Expected the spilled bodies to be removed, got %d files", len(files))
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "goproxy-test")
+	panicOnErr(err, "TempDir")
+	defer os.RemoveAll(tmp)
+
+	buf := &goproxy.SpillBuffer{Threshold: 10, MaxSize: 25, Dir: tmp}
+	if _, err := buf.Write([]byte("0123456789")); err != nil || buf.Spilled() {
+		t.Fatalf("Expected the data to stay in memory, got %v", err)
+	}
+	if _, err := buf.Write([]byte("abcdefghij")); err != nil || !buf.Spilled() {
+		t.Fatalf("Expected the data to be spilled, got %v", err)
+	}
+	if n, err := io.Copy(buf, strings.NewReader("klmnopqrst")); n != 5 || err != goproxy.ErrSpillBufferFull {
+		t.Errorf("Expected the buffer to be full after 5 bytes, got %d %v", n, err)
+	}
+	body := buf.Body()
+	b, err := ioutil.ReadAll(body)
+	if string(b) != "0123456789abcdefghijklmno" || err != nil {
+		t.Errorf("Unexpected buffered data %q %v", b, err)
+	}
+	if b, _ := ioutil.ReadAll(io.NewSectionReader(buf, 8, 4)); string(b) != "89ab" {
+		t.Errorf("Unexpected section %q", b)
+	}
+	body.Close()
+	if _, err := buf.ReadAt(make([]byte, 1), 0); err == nil {
+		t.Error("Expected a closed buffer to fail")
+	}
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("Expected the temporary file to be removed, got %d files", len(files))
+	}
+}
+
+func TestRangeMode(t *testing.T) {
+	var upstreamRanges []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRanges = append(upstreamRanges, r.Header.Get("Range"))
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("abcdefghij"))
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://") + "/rewrite")).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(bytes.ToUpper(b)))
+		resp.ContentLength = -1
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		mode               goproxy.RangeMode
+		path, rangeHeader  string
+		ifRange            string
+		status             int
+		body, contentRange string
+		acceptRanges       string
+	}{
+		{goproxy.RangePassthrough, "/rewrite", "bytes=2-5", "", 206, "CDEF", "bytes 2-5/10", "bytes"},
+		{goproxy.RangeServe, "/plain", "bytes=2-5", "", 206, "cdef", "bytes 2-5/10", "bytes"},
+		{goproxy.RangeServe, "/rewrite", "bytes=-3", `"v1"`, 206, "HIJ", "bytes 7-9/10", "bytes"},
+		{goproxy.RangeServe, "/rewrite", "bytes=8-", `"v0"`, 200, "ABCDEFGHIJ", "", "bytes"},
+		{goproxy.RangeServe, "/plain", "bytes=20-", "", 416, "", "bytes */10", "bytes"},
+		{goproxy.RangeStrip, "/plain", "bytes=8-", "", 206, "ij", "bytes 8-9/10", "bytes"},
+		{goproxy.RangeStrip, "/rewrite", "bytes=8-", "", 200, "ABCDEFGHIJ", "", ""},
+	} {
+		proxy.RangeMode = tc.mode
+		upstreamRanges = nil
+		req, _ := http.NewRequest("GET", backend.URL+tc.path, nil)
+		req.Header.Set("Range", tc.rangeHeader)
+		if tc.ifRange != "" {
+			req.Header.Set("If-Range", tc.ifRange)
+		}
+		resp, err := client.Do(req)
+		panicOnErr(err, "Do")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		name := fmt.Sprint(tc.mode, tc.path, tc.rangeHeader)
+		if resp.StatusCode != tc.status || string(b) != tc.body {
+			t.Errorf("%s: expected %d %q, got %d %q", name, tc.status, tc.body, resp.StatusCode, b)
+		}
+		if got := resp.Header.Get("Content-Range"); got != tc.contentRange {
+			t.Errorf("%s: expected Content-Range %q, got %q", name, tc.contentRange, got)
+		}
+		if got := resp.Header.Get("Accept-Ranges"); got != tc.acceptRanges {
+			t.Errorf("%s: expected Accept-Ranges %q, got %q", name, tc.acceptRanges, got)
+		}
+		if tc.mode != goproxy.RangePassthrough && (len(upstreamRanges) != 1 || upstreamRanges[0] != "") {
+			t.Errorf("%s: expected the range to be removed upstream, got %q", name, upstreamRanges)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains; preload")
+		w.Header().Set("Expect-CT", "max-age=86400, enforce")
+		w.Header().Set("Public-Key-Pins", `pin-sha256="abc"; max-age=5184000`)
+	}))
+	defer backend.Close()
+	policy := &goproxy.SecurityHeaders{}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnResponse(goproxy.ReqHostIs(strings.TrimPrefix(backend.URL, "http://"))).Do(policy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		policy         goproxy.SecurityHeaders
+		hsts, expectCT string
+		hpkp           bool
+	}{
+		{goproxy.SecurityHeaders{}, "max-age=31536000; includeSubDomains; preload", "max-age=86400, enforce", true},
+		{goproxy.SecurityHeaders{HSTS: goproxy.HSTSNoSubdomains, HSTSMaxAge: time.Hour}, "max-age=3600", "max-age=86400, enforce", true},
+		{goproxy.SecurityHeaders{HSTS: goproxy.HSTSClear, ExpectCT: true}, "max-age=0", "", true},
+		{*goproxy.RelaxedSecurityHeaders, "", "", false},
+	} {
+		*policy = tc.policy
+		resp, err := client.Get(backend.URL)
+		panicOnErr(err, "Get")
+		resp.Body.Close()
+		if got := resp.Header.Get("Strict-Transport-Security"); got != tc.hsts {
+			t.Errorf("%+v: expected HSTS %q, got %q", tc.policy, tc.hsts, got)
+		}
+		if got := resp.Header.Get("Expect-CT"); got != tc.expectCT {
+			t.Errorf("%+v: expected Expect-CT %q, got %q", tc.policy, tc.expectCT, got)
+		}
+		if got := resp.Header.Get("Public-Key-Pins") != ""; got != tc.hpkp {
+			t.Errorf("%+v: expected HPKP %v, got %v", tc.policy, tc.hpkp, got)
+		}
+	}
+}
+
+func TestFollowRedirects(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			http.Redirect(w, r, "c?x=1", http.StatusTemporaryRedirect)
+		case "/c":
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.RawQuery)
+		case "/loop1":
+			http.Redirect(w, r, "/loop2", http.StatusFound)
+		case "/loop2":
+			http.Redirect(w, r, "/loop1", http.StatusFound)
+		}
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		ctx.FollowRedirects, _ = strconv.Atoi(req.Header.Get("X-Follow"))
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	for _, tc := range []struct {
+		method, path string
+		follow       int
+		status       int
+		body         string
+	}{
+		{"GET", "/a", 0, 302, ""},
+		{"GET", "/a", 5, 200, "GET x=1"},
+		{"POST", "/a", 5, 200, "GET x=1"},
+		{"GET", "/a", 1, 307, ""},
+		{"GET", "/loop1", 5, 508, ""},
+	} {
+		req, _ := http.NewRequest(tc.method, backend.URL+tc.path, strings.NewReader("body"))
+		req.Header.Set("X-Follow", strconv.Itoa(tc.follow))
+		resp, err := client.Do(req)
+		panicOnErr(err, "Do")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || (tc.body != "" && string(b) != tc.body) {
+			t.Errorf("%s %s following %d: expected %d %q, got %d %q", tc.method, tc.path, tc.follow, tc.status, tc.body, resp.StatusCode, b)
+		}
+	}
+}
+
+func TestResponseHelpers(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		switch req.URL.Path {
+		case "/stream":
+			pr, pw := io.Pipe()
+			go func() {
+				for i := 0; i < 3; i++ {
+					fmt.Fprintf(pw, "chunk %d\n", i)
+				}
+				pw.Close()
+			}()
+			return req, goproxy.NewStreamResponse(req, goproxy.ContentTypeText, http.StatusOK, pr, -1)
+		case "/json":
+			resp, err := goproxy.NewJSONResponse(req, http.StatusCreated, map[string]int{"id": 7})
+			panicOnErr(err, "NewJSONResponse")
+			return req, resp
+		case "/file":
+			resp, err := goproxy.NewFileResponse(req, "test_data/panda.png")
+			panicOnErr(err, "NewFileResponse")
+			return req, resp
+		case "/none":
+			return req, goproxy.NoContentResponse(req)
+		case "/cached":
+			return req, goproxy.NotModifiedResponse(req, `"v1"`)
+		}
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	panda, err := ioutil.ReadFile("test_data/panda.png")
+	panicOnErr(err, "ReadFile")
+	for _, tc := range []struct {
+		path, contentType string
+		status            int
+		body              string
+	}{
+		{"/stream", "text/plain", 200, "chunk 0\nchunk 1\nchunk 2\n"},
+		{"/json", "application/json", 201, `{"id":7}` + "\n"},
+		{"/file", "image/png", 200, string(panda)},
+		{"/none", "", 204, ""},
+		{"/cached", "", 304, ""},
+	} {
+		resp, err := client.Get(srv.URL + tc.path)
+		panicOnErr(err, "Get")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || resp.Header.Get("Content-Type") != tc.contentType || string(b) != tc.body {
+			t.Errorf("%s: expected %d %s with %d bytes, got %d %s with %d bytes", tc.path, tc.status, tc.contentType, len(tc.body), resp.StatusCode, resp.Header.Get("Content-Type"), len(b))
+		}
+	}
+	if _, err := goproxy.NewFileResponse(nil, "test_data"); err == nil {
+		t.Error("Expected a directory to fail")
+	}
+}
+
+func TestFileServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://") + "/cdn/")).Do(&goproxy.FileServer{
+		Root:        http.Dir("test_data"),
+		Prefix:      "/cdn/",
+		Fallthrough: true,
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	panda, err := ioutil.ReadFile("test_data/panda.png")
+	panicOnErr(err, "ReadFile")
+	resp, err := client.Get(backend.URL + "/cdn/panda.png")
+	panicOnErr(err, "Get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/png" || !bytes.Equal(b, panda) {
+		t.Errorf("Expected the file, got %d %s with %d bytes", resp.StatusCode, resp.Header.Get("Content-Type"), len(b))
+	}
+
+	req, _ := http.NewRequest("GET", backend.URL+"/cdn/panda.png", nil)
+	req.Header.Set("Range", "bytes=1-3")
+	resp, err = client.Do(req)
+	panicOnErr(err, "Do")
+	b, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 206 || string(b) != string(panda[1:4]) {
+		t.Errorf("Expected a range of the file, got %d %q", resp.StatusCode, b)
+	}
+
+	req, _ = http.NewRequest("GET", backend.URL+"/cdn/panda.png", nil)
+	req.Header.Set("If-Modified-Since", resp.Header.Get("Last-Modified"))
+	resp, err = client.Do(req)
+	panicOnErr(err, "Do")
+	resp.Body.Close()
+	if resp.StatusCode != 304 {
+		t.Errorf("Expected the file not to be modified, got %d", resp.StatusCode)
+	}
+
+	// missing files and other paths go upstream
+	for _, path := range []string{"/cdn/missing.js", "/other"} {
+		if body := string(getOrFail(backend.URL+path, client, t)); body != "upstream" {
+			t.Errorf("%s: expected the upstream response, got %q", path, body)
+		}
+	}
+}
+
+func TestMapRules(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "mapped "+r.Host+" "+r.URL.Path)
+	}))
+	defer target.Close()
+	dir, err := os.Getwd()
+	panicOnErr(err, "Getwd")
+	rules, err := goproxy.ParseRules([]byte(`{"rules": [
+		{"hosts": ["api.example.com"], "paths": ["/v1/"], "action": "map_remote", "map_to": "` + target.URL + `/v2/"},
+		{"hosts": ["api.example.com"], "action": "map_remote", "map_to": "` + target.URL + `"},
+		{"hosts": ["cdn.example.com"], "paths": ["/img/"], "action": "map_local", "map_to": "` + dir + `/test_data"},
+		{"hosts": ["cdn.example.com"], "paths": ["/logo.png"], "action": "map_local", "map_to": "` + dir + `/test_data/panda.png"}
+	]}`))
+	panicOnErr(err, "ParseRules")
+	if _, err := goproxy.ParseRules([]byte(`{"rules": [{"action": "map_remote", "map_to": "/local"}]}`)); err == nil {
+		t.Error("Expected a map_remote rule without host to fail")
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	rules.Install(proxy)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	targetHost := strings.TrimPrefix(target.URL, "http://")
+	for u, expected := range map[string]string{
+		"http://api.example.com/v1/users?id=1": "mapped " + targetHost + " /v2/users",
+		"http://api.example.com/other":         "mapped " + targetHost + " /other",
+	} {
+		if body := string(getOrFail(u, client, t)); body != expected {
+			t.Errorf("%s: expected %q, got %q", u, expected, body)
+		}
+	}
+	panda, err := ioutil.ReadFile("test_data/panda.png")
+	panicOnErr(err, "ReadFile")
+	for _, u := range []string{"http://cdn.example.com/img/panda.png", "http://cdn.example.com/logo.png"} {
+		if body := getOrFail(u, client, t); !bytes.Equal(body, panda) {
+			t.Errorf("%s: expected the local file, got %d bytes", u, len(body))
+		}
+	}
+	resp, err := client.Get("http://cdn.example.com/img/missing.png")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected a missing local file to be 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Edited"))
+	}))
+	defer backend.Close()
+	ch := make(chan *goproxy.Breakpoint, 1)
+	bps := &goproxy.Breakpoints{Notify: ch, Timeout: 100 * time.Millisecond}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://") + "/held")).Do(bps.Request())
+	proxy.OnResponse(goproxy.UrlHasPrefix(strings.TrimPrefix(backend.URL, "http://") + "/held")).Do(bps.Response())
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	go func() {
+		b := <-ch
+		if held := bps.Held(); len(held) != 1 || held[0] != b || b.IsResponse() {
+			t.Errorf("Unexpected held breakpoints %v", held)
+		}
+		b.Req.Header.Set("X-Edited", "request")
+		b.Continue()
+		b = <-ch
+		if !b.IsResponse() || bps.Get(b.ID) != b {
+			t.Errorf("Expected a response breakpoint, got %+v", b)
+		}
+		b.Resp.Body.Close()
+		b.Resp = goproxy.NewResponse(b.Req, goproxy.ContentTypeText, http.StatusTeapot, "edited response")
+		b.Continue()
+	}()
+	resp, err := client.Get(backend.URL + "/held")
+	panicOnErr(err, "Get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || string(b) != "edited response" {
+		t.Errorf("Expected the edited response, got %d %q", resp.StatusCode, b)
+	}
+
+	// nobody resumes them this time
+	start := time.Now()
+	if body := string(getOrFail(backend.URL+"/held", client, t)); body != "" || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("Expected the breakpoints to time out, got %q after %v", body, time.Since(start))
+	}
+	if held := bps.Held(); len(held) != 0 {
+		t.Errorf("Expected no breakpoint held, got %d", len(held))
+	}
+}
+
+func TestHostOverrides(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.HostOverrides = &goproxy.HostOverrides{}
+	proxy.HostOverrides.Set("staging.invalid", srv.Listener.Addr().String())
+	proxy.HostOverrides.Set("secure.invalid:443", https.Listener.Addr().String())
+	proxy.OnRequest(goproxy.ReqHostIs("secure.invalid:443")).HandleConnect(goproxy.AlwaysMitm)
+	var hosts []string
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		hosts = append(hosts, req.Host)
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	proxy.HostOverrides.Set("any.invalid", "127.0.0.1")
+	if to, ok := proxy.HostOverrides.Lookup("any.invalid:8080"); !ok || to != "127.0.0.1:8080" {
+		t.Errorf("Expected the port to be kept, got %q", to)
+	}
+	proxy.HostOverrides.Delete("any.invalid")
+	if body := string(getOrFail("http://staging.invalid/bobo", client, t)); body != "bobo" {
+		t.Errorf("Expected the overridden host to be dialed, got %q", body)
+	}
+	if body := string(getOrFail("https://secure.invalid/bobo", client, t)); body != "bobo" {
+		t.Errorf("Expected the overridden MITM'd host to be dialed, got %q", body)
+	}
+	if len(hosts) != 2 || hosts[0] != "staging.invalid" || hosts[1] != "secure.invalid" {
+		t.Errorf("Expected the Host headers to be kept, got %v", hosts)
+	}
+
+	proxy.HostOverrides.Delete("staging.invalid")
+	if got := proxy.HostOverrides.Hosts(); len(got) != 1 || got[0] != "secure.invalid:443" {
+		t.Errorf("Unexpected overrides %v", got)
+	}
+	if resp, err := client.Get("http://staging.invalid/bobo"); err == nil {
+		if resp.StatusCode == http.StatusOK {
+			t.Error("Expected the removed override not to be dialed")
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestHostOverridesUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	panicOnErr(err, "TempDir")
+	defer os.RemoveAll(dir)
+	listen := func(name string) net.Listener {
+		l, err := net.Listen("unix", filepath.Join(dir, name))
+		panicOnErr(err, "Listen")
+		return l
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "unix "+r.Host)
+	})
+	plain := httptest.NewUnstartedServer(handler)
+	plain.Listener = listen("plain.sock")
+	plain.Start()
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.Listener = listen("secure.sock")
+	secure.StartTLS()
+	defer secure.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.HostOverrides = &goproxy.HostOverrides{}
+	proxy.HostOverrides.Replace(map[string]string{
+		"plain.invalid":      "unix:" + filepath.Join(dir, "plain.sock"),
+		"secure.invalid:443": "unix:" + filepath.Join(dir, "secure.sock"),
+		"tunnel.invalid":     "unix:" + filepath.Join(dir, "secure.sock"),
+	})
+	proxy.OnRequest(goproxy.ReqHostIs("secure.invalid:443")).HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	if body := string(getOrFail("http://plain.invalid/", client, t)); body != "unix plain.invalid" {
+		t.Errorf("Expected the unix socket to be dialed, got %q", body)
+	}
+	if body := string(getOrFail("https://secure.invalid/", client, t)); body != "unix secure.invalid" {
+		t.Errorf("Expected the unix socket to be dialed for the MITM'd host, got %q", body)
+	}
+	if body := string(getOrFail("https://tunnel.invalid/", client, t)); body != "unix tunnel.invalid" {
+		t.Errorf("Expected the unix socket to be dialed for the tunnel, got %q", body)
+	}
+}
+
+func TestServeUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy")
+	panicOnErr(err, "TempDir")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.sock")
+	l, err := goproxy.Listen("unix:" + path)
+	panicOnErr(err, "Listen")
+	if _, err := goproxy.Listen("unix:" + path); err == nil {
+		t.Error("Expected a socket in use not to be replaced")
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve(l) }()
+	proxyUrl, _ := url.Parse("http://proxy.sock")
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(proxyUrl),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	if body := string(getOrFail(srv.URL+"/bobo", client, t)); body != "bobo" {
+		t.Errorf("Expected the proxy to serve the unix socket, got %q", body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	panicOnErr(proxy.Shutdown(ctx), "Shutdown")
+	select {
+	case err := <-served:
+		if err != http.ErrServerClosed {
+			t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected Serve to return on Shutdown")
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	// the upstream echoes the PROXY header it gets
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer upstream.Close()
+	go func() {
+		for {
+			c, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(c).ReadString('\n')
+			io.WriteString(c, line)
+			c.Close()
+		}
+	}()
+
+	var mu sync.Mutex
+	var addrs []string
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.UpstreamProxyProtocol = 1
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		mu.Lock()
+		addrs = append(addrs, req.RemoteAddr)
+		mu.Unlock()
+		return req, nil
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	go proxy.Serve(&goproxy.ProxyProtocolListener{Listener: l})
+	defer proxy.Shutdown(context.Background())
+
+	request := func(header []byte, req string) string {
+		c, err := net.Dial("tcp", l.Addr().String())
+		panicOnErr(err, "Dial")
+		defer c.Close()
+		c.Write(append(header, req...))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := ioutil.ReadAll(c)
+		return string(b)
+	}
+	get := "GET " + srv.URL + "/bobo HTTP/1.1\r\nHost: " + srv.Listener.Addr().String() + "\r\nConnection: close\r\n\r\n"
+	if resp := request([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 8080\r\n"), get); !strings.HasSuffix(resp, "bobo") {
+		t.Errorf("Unexpected response with a v1 header %q", resp)
+	}
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24")
+	v2 = append(v2, net.ParseIP("2001:db8::1")...)
+	v2 = append(v2, net.ParseIP("2001:db8::2")...)
+	v2 = append(v2, 0x1f, 0x90, 0x1f, 0x91)
+	if resp := request(v2, get); !strings.HasSuffix(resp, "bobo") {
+		t.Errorf("Unexpected response with a v2 header %q", resp)
+	}
+	if resp := request(nil, get); resp != "" {
+		t.Errorf("Expected a connection without header to be closed, got %q", resp)
+	}
+	mu.Lock()
+	if len(addrs) != 2 || addrs[0] != "203.0.113.7:5555" || addrs[1] != "[2001:db8::1]:8080" {
+		t.Errorf("Expected the addresses of the headers, got %v", addrs)
+	}
+	mu.Unlock()
+
+	connect := "CONNECT " + upstream.Addr().String() + " HTTP/1.1\r\nHost: " + upstream.Addr().String() + "\r\n\r\n"
+	resp := request([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 5555 8080\r\n"), connect)
+	if !strings.HasSuffix(resp, "\r\n\r\nPROXY TCP4 203.0.113.7 127.0.0.1 5555 "+strings.TrimPrefix(upstream.Addr().String(), "127.0.0.1:")+"\r\n") {
+		t.Errorf("Expected the upstream to get the address of the client, got %q", resp)
+	}
+}
+
+func TestProxyProtocolHalfClose(t *testing.T) {
+	// a server answering once the client closed its side
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer server.Close()
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		io.WriteString(c, "got "+string(b))
+	}()
+
+	proxy := goproxy.NewProxyHttpServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	go proxy.Serve(&goproxy.ProxyProtocolListener{Listener: l})
+	defer proxy.Shutdown(context.Background())
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	panicOnErr(err, "Dial")
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\nCONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", server.Addr(), server.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through the proxy", err)
+	}
+	io.WriteString(c, "hello")
+	c.(*net.TCPConn).CloseWrite()
+	if b, err := io.ReadAll(br); err != nil || string(b) != "got hello" {
+		t.Errorf("Expected the half-close of a PROXY protocol client to reach the server, got %q %v", b, err)
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ForwardingHeaders = &goproxy.ForwardingHeaders{XForwardedFor: goproxy.ForwardedAppend}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var mu sync.Mutex
+	var addrs []string
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		mu.Lock()
+		addrs = append(addrs, ctx.ClientAddr())
+		mu.Unlock()
+		// a new request, without RemoteAddr
+		r, err := http.NewRequest(req.Method, req.URL.String(), nil)
+		panicOnErr(err, "NewRequest")
+		return r, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	client.Transport.(*http.Transport).DisableKeepAlives = true
+
+	for _, u := range []string{srv.URL + "/bobo", backend.URL} {
+		body := string(getOrFail(u, client, t))
+		if u == backend.URL && body != "127.0.0.1" {
+			t.Errorf("Expected the client address in X-Forwarded-For, got %q", body)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, addr := range addrs {
+		if host, _, err := net.SplitHostPort(addr); err != nil || host != "127.0.0.1" {
+			t.Errorf("Unexpected client address %q", addr)
+		}
+	}
+	if len(addrs) != 2 {
+		t.Errorf("Expected 2 requests, got %v", addrs)
+	}
+}
+
+func TestForwardedProtoAndHost(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s|%s", r.Host, r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Forwarded-Host"), r.Header.Get("Forwarded"))
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ForwardingHeaders = &goproxy.ForwardingHeaders{
+		XForwardedProto: goproxy.ForwardedSet,
+		XForwardedHost:  goproxy.ForwardedAppend,
+		Forwarded:       goproxy.ForwardedSet,
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	host := backend.Listener.Addr().String()
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	req.Header.Set("X-Forwarded-Proto", "ftp")
+	req.Header.Set("X-Forwarded-Host", "edge.example.com")
+	resp, err := client.Do(req)
+	panicOnErr(err, "get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	expected := host + "|https|edge.example.com, " + host + `|for=127.0.0.1;proto=https;host="` + host + `"`
+	if string(b) != expected {
+		t.Errorf("Expected forwarding headers %q, got %q", expected, b)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for host, expected := range map[string]string{
+		"Example.COM":          "example.com",
+		"example.com.:0443":    "example.com:443",
+		"bücher.example":       "xn--bcher-kva.example",
+		"München.de:80":        "xn--mnchen-3ya.de:80",
+		"日本語。ｊｐ":               "xn--wgv71a119e.jp",
+		"[::FFFF:127.0.0.1]":   "127.0.0.1",
+		"[2001:DB8::0001]:443": "[2001:db8::1]:443",
+		"2001:db8::1":          "2001:db8::1",
+		"010.0.0.1":            "",
+		"127.1":                "",
+		"0x7f.1":               "",
+		"example.com:0":        "",
+		"example.com:65536":    "",
+		"example.com:+80":      "",
+		"exa mple.com":         "",
+		"example..com":         "",
+		"[example.com]:80":     "",
+		"":                     "",
+	} {
+		got, err := goproxy.NormalizeHost(host)
+		if expected == "" && err == nil {
+			t.Errorf("Expected %q to be rejected, got %q", host, got)
+		} else if expected != "" && got != expected {
+			t.Errorf("Expected %q to be normalized to %q, got %q (%v)", host, expected, got, err)
+		}
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest(goproxy.ReqHostIs("blocked.example:443")).HandleConnect(goproxy.AlwaysReject)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+	for _, host := range []string{"BLOCKED.example.:443", "blocked.example:0443", "127.1:443"} {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "Dial")
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err == nil && resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected the CONNECT to %s to be rejected", host)
+		}
+	}
+	resp, err := client.Get("http://127.1/")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a numeric host to be rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestIPv6Hosts(t *testing.T) {
+	l6, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v6")
+	}))
+	backend.Listener = l6
+	backend.StartTLS()
+	defer backend.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.SrcIpIs("::1")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		req.Header.Set("X-From-V6", "1")
+		return req, nil
+	})
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp != nil && ctx.Req.Header.Get("X-From-V6") == "" {
+			resp.Header.Set("X-Not-V6", "1")
+		}
+		return resp
+	})
+	pl, err := net.Listen("tcp", "[::1]:0")
+	panicOnErr(err, "Listen")
+	s := httptest.NewUnstartedServer(proxy)
+	s.Listener = pl
+	s.Start()
+	defer s.Close()
+
+	// the certificate forged for the IPv6 address must be valid for it
+	proxyUrl, _ := url.Parse(s.URL)
+	goproxyCA := x509.NewCertPool()
+	goproxyCA.AddCert(goproxy.GoproxyCa.Leaf)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: goproxyCA}, Proxy: http.ProxyURL(proxyUrl)}}
+	resp, err := client.Get(backend.URL)
+	panicOnErr(err, "Get")
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "v6" || resp.Header.Get("X-Not-V6") != "" {
+		t.Errorf("Unexpected response %q from the IPv6 host, matched by SrcIpIs: %v", b, resp.Header.Get("X-Not-V6") == "")
+	}
+}
+
+func TestWildcardCerts(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	cache := goproxy.NewCertCache()
+	proxy.CertStore = cache
+	proxy.WildcardCerts = &goproxy.WildcardCerts{
+		// a naive registrable domain, for the test
+		Domain: func(host string) (string, error) {
+			labels := strings.Split(host, ".")
+			return strings.Join(labels[len(labels)-2:], "."), nil
+		},
+		Match: func(host string, ctx *goproxy.ProxyCtx) bool {
+			return host != "own.example.test"
+		},
+	}
+	proxy.HostOverrides = &goproxy.HostOverrides{}
+	for _, host := range []string{"example.test", "a.example.test", "b.example.test", "own.example.test", "x.y.example.test"} {
+		proxy.HostOverrides.Set(host, https.Listener.Addr().String())
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for host, names := range map[string]string{
+		"a.example.test":   "*.example.test example.test",
+		"b.example.test":   "*.example.test example.test",
+		"example.test":     "*.example.test example.test",
+		"own.example.test": "own.example.test",
+		"x.y.example.test": "*.y.example.test y.example.test",
+	} {
+		resp, err := client.Get("https://" + host + "/bobo")
+		panicOnErr(err, "Get")
+		resp.Body.Close()
+		if got := strings.Join(resp.TLS.PeerCertificates[0].DNSNames, " "); got != names {
+			t.Errorf("Expected the certificate of %s to be for %q, got %q", host, names, got)
+		}
+	}
+	if cache.Len() != 3 {
+		t.Errorf("Expected 3 certificates to be signed, got %d", cache.Len())
+	}
+}
+
+func TestCertExtensions(t *testing.T) {
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.CertExtensions = func(hosts []string, ctx *goproxy.ProxyCtx) []pkix.Extension {
+		return []pkix.Extension{{Id: oid, Value: []byte(ctx.Req.URL.Hostname())}, goproxy.SCTListExtension([]byte("placeholder"))}
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	found := map[string]string{}
+	for _, ext := range resp.TLS.PeerCertificates[0].Extensions {
+		found[ext.Id.String()] = string(ext.Value)
+	}
+	if found[oid.String()] != "127.0.0.1" {
+		t.Errorf("Expected the custom extension, got %q", found)
+	}
+	if sct := found[goproxy.OIDCTSCTList.String()]; sct != "\x04\x0f\x00\x0d\x00\x0bplaceholder" {
+		t.Errorf("Expected the SCT list extension, got %q", sct)
+	}
+}
+
+func TestCertCacheRenewal(t *testing.T) {
+	cache := goproxy.NewCertCache()
+	cache.RenewBefore = time.Hour
+	validity := 2 * time.Hour
+	gen := func() (*tls.Certificate, error) {
+		return &tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(validity)}}, nil
+	}
+	fetch := func() *tls.Certificate {
+		cert, err := cache.Fetch("example.com", gen)
+		panicOnErr(err, "Fetch")
+		return cert
+	}
+
+	first := fetch()
+	if fetch() != first || cache.Renewals() != 0 {
+		t.Fatal("Expected the certificate to be cached")
+	}
+
+	// expired certificates are renewed before being served
+	validity = -time.Minute
+	cache.Flush()
+	fetch()
+	validity = 2 * time.Hour
+	if cert := fetch(); cert.Leaf.NotAfter.Before(time.Now()) || cache.Renewals() != 1 {
+		t.Fatalf("Expected the expired certificate to be renewed, got %v, %d renewals", cert.Leaf.NotAfter, cache.Renewals())
+	}
+
+	// certificates close to their expiry are renewed in the background
+	validity = 30 * time.Minute
+	cache.Flush()
+	near := fetch()
+	validity = 2 * time.Hour
+	if fetch() != near {
+		t.Error("Expected the certificate close to its expiry to be served while it is renewed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.Renewals() != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cert := fetch(); cert == near || cache.Renewals() != 2 {
+		t.Errorf("Expected the certificate to be renewed in the background, %d renewals", cache.Renewals())
+	}
+
+	// and by Renew
+	validity = 30 * time.Minute
+	cache.Flush()
+	fetch()
+	validity = 2 * time.Hour
+	if n := cache.Renew(); n != 1 || cache.Renew() != 0 || cache.Renewals() != 3 {
+		t.Errorf("Expected Renew to renew a certificate, renewed %d, %d renewals", n, cache.Renewals())
+	}
+}
+
+func TestClockInherited(t *testing.T) {
+	clock := goproxytest.NewClock(time.Now().AddDate(-10, 0, 0))
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Clock = clock
+	proxy.RateLimiter = &goproxy.RateLimiter{Limits: goproxy.RateLimits{RequestsPerSecond: 1, Burst: 2}}
+	cache := goproxy.NewCertCache()
+	proxy.CertStore = cache
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	s := httptest.NewServer(proxy)
+	defer s.Close()
+	proxyUrl, _ := url.Parse(s.URL)
+
+	get := func(u string) int {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: acceptAllCerts, Proxy: http.ProxyURL(proxyUrl), DisableKeepAlives: true}}
+		resp, err := client.Get(u)
+		panicOnErr(err, "get")
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if status := get(srv.URL + "/bobo"); status != expected {
+			t.Fatalf("Expected request %d to get %d, got %d", i, expected, status)
+		}
+	}
+	clock.Advance(time.Second)
+	if status := get(srv.URL + "/bobo"); status != http.StatusOK {
+		t.Error("Expected the rate limit to follow the clock of the proxy, got", status)
+	}
+
+	// the certificates forged ten years ago are still valid for the cache, the CONNECT
+	// requests and the MITM'd ones are both rate limited
+	for i := 0; i < 2; i++ {
+		clock.Advance(2 * time.Second)
+		if status := get(https.URL + "/bobo"); status != http.StatusOK {
+			t.Fatal("Expected the MITM'd request to succeed, got", status)
+		}
+	}
+	if n := cache.Renewals(); n != 0 {
+		t.Error("Expected the certificate cache to follow the clock of the proxy, got renewals:", n)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Request-ID"))
+	}))
+	defer backend.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.RequestIDHeader = goproxy.DefaultRequestIDHeader
+	proxy.MitmKeepAlive = true
+	var mu sync.Mutex
+	var ids []string
+	var tunnel int64
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		tunnel = ctx.Session
+		return goproxy.MitmConnect, host
+	})
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		mu.Lock()
+		ids = append(ids, ctx.ID())
+		mu.Unlock()
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	get := func(id string) (echoed, sent string) {
+		req, _ := http.NewRequest("GET", backend.URL, nil)
+		if id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		resp, err := client.Do(req)
+		panicOnErr(err, "Get")
+		b, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return string(b), resp.Header.Get("X-Request-ID")
+	}
+	if upstream, echoed := get("client-id"); upstream != "client-id" || echoed != "client-id" {
+		t.Errorf("Expected the request ID of the client to be propagated, got %q and %q", upstream, echoed)
+	}
+	if upstream, echoed := get(""); len(upstream) != 32 || echoed != upstream {
+		t.Errorf("Expected a generated request ID, got %q and %q", upstream, echoed)
+	}
+	if upstream, _ := get("bad id"); upstream == "bad id" {
+		t.Error("Expected an invalid request ID to be replaced")
+	}
+	want := []string{fmt.Sprint(tunnel, ".1"), fmt.Sprint(tunnel, ".2"), fmt.Sprint(tunnel, ".3")}
+	if strings.Join(ids, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected the requests of the tunnel to be numbered %v, got %v", want, ids)
+	}
+}
+
+func TestExchangeUpstreamErrors(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	addr := closed.Addr().String()
+	closed.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	var mu sync.Mutex
+	var errs int
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if resp == nil && ctx.Error != nil {
+			mu.Lock()
+			errs++
+			mu.Unlock()
+		}
+		return resp
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	// plain and MITM'd requests fail the same way
+	for _, u := range []string{"http://" + addr + "/", "https://" + addr + "/"} {
+		resp, err := client.Get(u)
+		panicOnErr(err, "Get "+u)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected 502 Bad Gateway for %s, got %v", u, resp.Status)
+		}
+	}
+	if errs != 2 {
+		t.Errorf("Expected the response handlers to see 2 errors, got %d", errs)
+	}
+}
+
+type countingMetrics struct {
+	mu        sync.Mutex
+	exchanges map[int]int
+	tunnels   int
+}
+
+func (m *countingMetrics) ObserveExchange(ctx *goproxy.ProxyCtx, status int, d time.Duration) {
+	m.mu.Lock()
+	m.exchanges[status]++
+	m.mu.Unlock()
+}
+
+func (m *countingMetrics) ObserveTunnel(ctx *goproxy.ProxyCtx, stats goproxy.TunnelStats) {
+	m.mu.Lock()
+	m.tunnels++
+	m.mu.Unlock()
+}
+
+func TestNewProxy(t *testing.T) {
+	for _, opt := range []goproxy.Option{
+		goproxy.WithCA(nil),
+		goproxy.WithCA(&tls.Certificate{Certificate: https.TLS.Certificates[0].Certificate}),
+		goproxy.WithLogger(nil),
+		goproxy.WithTimeouts(goproxy.Timeouts{Dial: -time.Second}),
+		goproxy.WithRules(nil),
+	} {
+		if _, err := goproxy.NewProxy(opt); err == nil {
+			t.Error("Expected an invalid option to fail")
+		}
+	}
+
+	ca, err := goproxy.GenerateCA(nil)
+	panicOnErr(err, "GenerateCA")
+	metrics := &countingMetrics{exchanges: make(map[int]int)}
+	proxy, err := goproxy.NewProxy(
+		goproxy.WithCA(ca),
+		goproxy.WithTimeouts(goproxy.Timeouts{Dial: 5 * time.Second, ResponseHeader: 5 * time.Second}),
+		goproxy.WithMetrics(metrics),
+	)
+	panicOnErr(err, "NewProxy")
+	if proxy.Tr.ResponseHeaderTimeout != 5*time.Second {
+		t.Error("Expected the timeouts to be set on the transport")
+	}
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	resp, err := client.Get(https.URL + "/bobo")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	if issuer := resp.TLS.PeerCertificates[0].Issuer.CommonName; issuer != ca.Leaf.Subject.CommonName {
+		t.Errorf("Expected the certificate to be signed by the CA of the proxy, got %q", issuer)
+	}
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	getOrFail(srv.URL+"/bobo", client, t)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		metrics.mu.Lock()
+		exchanges, tunnels := metrics.exchanges[200], metrics.tunnels
+		metrics.mu.Unlock()
+		if exchanges == 2 && tunnels == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 exchanges and a tunnel, got %d and %d", exchanges, tunnels)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRuntimeReconfiguration(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var dials int32
+	counting := &http.Transport{DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				getOrFail(srv.URL+"/bobo", client, t)
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		proxy.SetVerbose(goproxy.LOGLEVEL_NONE)
+		proxy.SetTransport(&http.Transport{})
+		proxy.SetConnectDial(nil)
+	}
+	proxy.SetTransport(counting)
+	wg.Wait()
+
+	client.Transport.(*http.Transport).CloseIdleConnections()
+	getOrFail(srv.URL+"/bobo", client, t)
+	if proxy.Transport() != counting || atomic.LoadInt32(&dials) == 0 {
+		t.Error("Expected the requests to be sent with the new transport")
+	}
+}
+
+func TestPoolContexts(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.PoolContexts = true
+	var mu sync.Mutex
+	sessions := make(map[int64]bool)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if _, ok := ctx.ReqData.Get("key"); ok || ctx.UserData != nil {
+			t.Errorf("Expected a reset context, got %+v", ctx)
+		}
+		ctx.UserData = "used"
+		ctx.ReqData.Set("key", "value")
+		mu.Lock()
+		sessions[ctx.Session] = true
+		mu.Unlock()
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for i := 0; i < 20; i++ {
+		getOrFail(srv.URL+"/bobo", client, t)
+	}
+	resp, err := client.Get(https.URL + "/bobo")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	stats := proxy.Stats()
+	if stats.Requests != 20 || stats.Tunnels != 1 || len(sessions) != 20 {
+		t.Errorf("Expected 20 requests with distinct sessions and a tunnel, got %+v and %d sessions", stats, len(sessions))
+	}
+	if stats.ContextsReused == 0 {
+		t.Error("Expected contexts to be reused")
+	}
+}
+
+func TestPoolContextsKeep(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.PoolContexts = true
+	kept := make(chan string, 1)
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if req.URL.RawQuery == "keep" {
+			ctx.Keep()
+			go func() {
+				// other requests are served meanwhile
+				time.Sleep(100 * time.Millisecond)
+				if ctx.Proxy == nil {
+					kept <- "reset"
+					return
+				}
+				kept <- ctx.Req.URL.RawQuery
+			}()
+		}
+		return req, nil
+	})
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	getOrFail(srv.URL+"/bobo?keep", client, t)
+	for i := 0; i < 10; i++ {
+		getOrFail(srv.URL+"/bobo", client, t)
+	}
+	if q := <-kept; q != "keep" {
+		t.Error("Expected the kept context not to be reused, got", q)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	var mu sync.Mutex
+	var saturated []error
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnLimits = &goproxy.ConnLimits{MaxConns: 2, MaxMitm: 1, Status: http.StatusTooManyRequests, RetryAfter: 2 * time.Second,
+		OnSaturated: func(ctx *goproxy.ProxyCtx, err error) {
+			mu.Lock()
+			saturated = append(saturated, err)
+			mu.Unlock()
+		}}
+	mitmHost := https.Listener.Addr().String()
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if host == mitmHost {
+			return goproxy.MitmConnect, host
+		}
+		return nil, ""
+	})
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	connect := func(host string, status int) net.Conn {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "Dial")
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		panicOnErr(err, "ReadResponse")
+		if resp.StatusCode != status {
+			t.Errorf("Expected the CONNECT to %s to be answered %d, got %s", host, status, resp.Status)
+		}
+		if status != http.StatusOK && resp.Header.Get("Retry-After") != "2" {
+			t.Errorf("Expected a Retry-After header, got %q", resp.Header.Get("Retry-After"))
+		}
+		return c
+	}
+	waitUsage := func(conns, mitm int) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if u := proxy.ConnLimits.Usage(); u.Conns == conns && u.Mitm == mitm {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected %d connections and %d MITM'd ones, got %+v", conns, mitm, proxy.ConnLimits.Usage())
+	}
+	plainHost := srv.Listener.Addr().String()
+
+	mitm := connect(mitmHost, http.StatusOK)
+	connect(mitmHost, http.StatusTooManyRequests).Close()
+	// the rejected tunnel is released once the proxy closed it
+	waitUsage(1, 1)
+	tunnel := connect(plainHost, http.StatusOK)
+	connect(plainHost, http.StatusTooManyRequests).Close()
+	waitUsage(2, 1)
+	if u := proxy.ConnLimits.Usage(); u.Rejected != 2 {
+		t.Errorf("Expected 2 rejected CONNECT requests, got %d", u.Rejected)
+	}
+	mu.Lock()
+	if len(saturated) != 2 || saturated[0] != goproxy.ErrTooManyMitm || saturated[1] != goproxy.ErrTooManyConns {
+		t.Errorf("Unexpected saturation events %v", saturated)
+	}
+	mu.Unlock()
+
+	mitm.Close()
+	tunnel.Close()
+	waitUsage(0, 0)
+	connect(plainHost, http.StatusOK).Close()
+}
+
+func TestProxyErrors(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	addr := closed.Addr().String()
+	closed.Close()
+
+	proxy := goproxy.NewProxyHttpServer()
+	// upstream certificates are verified, the test server's is not trusted
+	proxy.Tr = &http.Transport{}
+	proxy.OnRequest(goproxy.ReqHostIs(https.Listener.Addr().String())).HandleConnect(goproxy.AlwaysMitm)
+	proxy.OnRequest(goproxy.UrlHasPrefix(srv.Listener.Addr().String() + "/panic")).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		panic("boom")
+	})
+	var mu sync.Mutex
+	var errs []error
+	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+		if ctx.Error != nil {
+			mu.Lock()
+			errs = append(errs, ctx.Error)
+			mu.Unlock()
+		}
+		return resp
+	})
+	tunnelErrs := make(chan error, 10)
+	proxy.TunnelClosed = func(ctx *goproxy.ProxyCtx, stats goproxy.TunnelStats) {
+		tunnelErrs <- ctx.Error
+	}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	for _, u := range []string{"http://" + addr + "/", https.URL + "/bobo", srv.URL + "/panic", "http://127.1/"} {
+		resp, err := client.Get(u)
+		panicOnErr(err, "Get "+u)
+		resp.Body.Close()
+	}
+	expected := []error{goproxy.ErrDialUpstream, goproxy.ErrTLSHandshakeUpstream, goproxy.ErrHandlerPanic, goproxy.ErrMalformedRequest}
+	mu.Lock()
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), errs)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, expected[i]) {
+			t.Errorf("Expected error %d to be %v, got %v", i, expected[i], err)
+		}
+	}
+	var proxyErr *goproxy.ProxyError
+	if !errors.As(errs[0], &proxyErr) || proxyErr.Host != addr || proxyErr.ID == "" || errors.Unwrap(errs[0]) == nil {
+		t.Errorf("Expected the dial error to carry its host, context and cause, got %#v", proxyErr)
+	}
+	mu.Unlock()
+
+	// a client which is not speaking TLS to a MITM'd tunnel
+	c, err := net.Dial("tcp", l.Listener.Addr().String())
+	panicOnErr(err, "Dial")
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", https.Listener.Addr(), https.Listener.Addr())
+	br := bufio.NewReader(c)
+	_, err = http.ReadResponse(br, nil)
+	panicOnErr(err, "ReadResponse")
+	io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	defer c.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case err := <-tunnelErrs:
+			if errors.Is(err, goproxy.ErrTLSHandshakeClient) {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Expected the tunnel to fail with ErrTLSHandshakeClient")
+		}
+	}
+}
+
+func TestLoopGuard(t *testing.T) {
+	proxy := goproxy.NewProxyHttpServer()
+	var loops int32
+	proxy.LoopGuard = &goproxy.LoopGuard{Via: "goproxy-test", OnLoop: func(ctx *goproxy.ProxyCtx, err error) {
+		if !errors.Is(err, goproxy.ErrProxyLoop) || !errors.Is(ctx.Error, goproxy.ErrProxyLoop) {
+			t.Error("Expected the loop error to match ErrProxyLoop, got", err)
+		}
+		atomic.AddInt32(&loops, 1)
+	}}
+	client, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	status := func(req *http.Request) int {
+		resp, err := client.Do(req)
+		panicOnErr(err, "client.Do")
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	req, _ := http.NewRequest("GET", srv.URL+"/bobo", nil)
+	if s := status(req); s != http.StatusOK {
+		t.Error("Expected the request to the backend to be proxied, got", s)
+	}
+	req, _ = http.NewRequest("GET", l.URL+"/bobo", nil)
+	if s := status(req); s != http.StatusLoopDetected {
+		t.Error("Expected the request to the proxy to be rejected, got", s)
+	}
+	req, _ = http.NewRequest("GET", srv.URL+"/bobo", nil)
+	req.Header.Set("Via", "1.1 other, 1.1 goproxy-test (goproxy)")
+	if s := status(req); s != http.StatusLoopDetected {
+		t.Error("Expected the request which went through the proxy to be rejected, got", s)
+	}
+	req.Header.Set("Via", "1.1 other")
+	if s := status(req); s != http.StatusOK {
+		t.Error("Expected the request through another proxy to be proxied, got", s)
+	}
+
+	_, port, _ := net.SplitHostPort(l.Listener.Addr().String())
+	for _, host := range []string{"127.0.0.1:" + port, "0.0.0.0:" + port} {
+		c, err := net.Dial("tcp", l.Listener.Addr().String())
+		panicOnErr(err, "dial")
+		fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		panicOnErr(err, "read CONNECT response")
+		if resp.StatusCode != http.StatusLoopDetected {
+			t.Errorf("Expected CONNECT %s to be rejected, got %d", host, resp.StatusCode)
+		}
+		c.Close()
+	}
+	if n := atomic.LoadInt32(&loops); n != 4 {
+		t.Error("Expected 4 loops, got", n)
+	}
+}
+
+func TestLoopGuardChain(t *testing.T) {
+	// two proxies forwarding to each other, without ForwardingHeaders
+	a, b := goproxy.NewProxyHttpServer(), goproxy.NewProxyHttpServer()
+	var loops int32
+	a.LoopGuard = &goproxy.LoopGuard{Via: "a", OnLoop: func(ctx *goproxy.ProxyCtx, err error) {
+		atomic.AddInt32(&loops, 1)
+	}}
+	b.LoopGuard = &goproxy.LoopGuard{Via: "b"}
+	var hops int32
+	b.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if atomic.AddInt32(&hops, 1) > 5 {
+			return req, goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusInternalServerError, "loop not detected")
+		}
+		return req, nil
+	})
+	sa, sb := httptest.NewServer(a), httptest.NewServer(b)
+	defer sa.Close()
+	defer sb.Close()
+	ua, _ := url.Parse(sa.URL)
+	ub, _ := url.Parse(sb.URL)
+	a.Tr = &http.Transport{Proxy: http.ProxyURL(ub)}
+	b.Tr = &http.Transport{Proxy: http.ProxyURL(ua)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(ua)}}
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	panicOnErr(err, "Get")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Error("Expected the loop through the chain to be detected, got", resp.StatusCode)
+	}
+	if n := atomic.LoadInt32(&loops); n != 1 {
+		t.Error("Expected the first proxy to detect the loop once, got", n)
+	}
+}
@@ -0,0 +1,335 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultProxyHeaderTimeout is how long a ProxyProtocolListener waits for the PROXY
+// header of a connection, unless specified.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// ErrProxyHeader is the error of connections with a missing or malformed PROXY header.
+var ErrProxyHeader = errors.New("goproxy: invalid PROXY protocol header")
+
+// proxyV2Signature starts the headers of version 2 of the PROXY protocol
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolListener accepts connections starting with a PROXY protocol header,
+// version 1 or 2, as sent by L4 load balancers such as HAProxy or AWS NLB, so that the
+// RemoteAddr of the connections, and of their requests, is the address of the real
+// client:
+//
+//	l, err := net.Listen("tcp", ":8080")
+//	...
+//	proxy.Serve(&goproxy.ProxyProtocolListener{Listener: l})
+//
+// The headers are read concurrently, so that slow clients do not delay the others, and
+// connections with an invalid header are closed. Headers of the LOCAL command, e.g. of
+// health checks, keep the address of the peer.
+type ProxyProtocolListener struct {
+	net.Listener
+	// Trusted, if set, tells whether the header of a peer is trusted. The connections of
+	// the other peers keep their address, and must not send a header.
+	Trusted func(peer net.Addr) bool
+	// Optional accepts connections without header, keeping their address
+	Optional bool
+	// HeaderTimeout is how long the header is waited for, DefaultProxyHeaderTimeout if
+	// zero
+	HeaderTimeout time.Duration
+	// ErrorLog, if set, is called with the connections closed for their header
+	ErrorLog func(peer net.Addr, err error)
+	// Clock, if set, tells the time of HeaderTimeout instead of the Clock of the proxy
+	// serving the listener, see ProxyHttpServer.Clock
+	Clock Clock
+
+	once  sync.Once
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+
+	proxyClock inheritedClock
+}
+
+// Accept returns the next connection whose header was read.
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	l.once.Do(l.start)
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *ProxyProtocolListener) start() {
+	l.conns = make(chan net.Conn)
+	l.done = make(chan struct{})
+	go l.acceptLoop()
+}
+
+func (l *ProxyProtocolListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			// retry on temporary errors, as http.Server does
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.readHeader(c)
+	}
+}
+
+func (l *ProxyProtocolListener) readHeader(c net.Conn) {
+	timeout := l.HeaderTimeout
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	trusted := l.Trusted == nil || l.Trusted(c.RemoteAddr())
+	stop := interruptReadsAfter(l.proxyClock.or(l.Clock), c, timeout)
+	conn, err := readProxyHeader(c, trusted, l.Optional || !trusted)
+	stop()
+	if err != nil {
+		if l.ErrorLog != nil {
+			l.ErrorLog(c.RemoteAddr(), err)
+		}
+		c.Close()
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// proxyProtocolConn is a connection with the addresses of its PROXY header.
+type proxyProtocolConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// errNoHalfClose is returned by the half-close methods of the connections wrapping a
+// connection without them
+var errNoHalfClose = errors.New("goproxy: connection does not support half-close")
+
+// CloseWrite and CloseRead half-close the connection, like the *net.TCPConn it usually
+// wraps, so that tunnels keep closing each direction separately.
+func (c *proxyProtocolConn) CloseWrite() error {
+	if hc, ok := c.Conn.(halfClosable); ok {
+		return hc.CloseWrite()
+	}
+	return errNoHalfClose
+}
+
+func (c *proxyProtocolConn) CloseRead() error {
+	if hc, ok := c.Conn.(halfClosable); ok {
+		return hc.CloseRead()
+	}
+	return errNoHalfClose
+}
+
+// epollConn returns the connection the epoll workers forward the tunnel of the client
+// connection c with: the connection of a PROXY header, once the data read along with
+// the header was consumed. ok is false while some of it is buffered.
+func epollConn(c net.Conn) (conn net.Conn, ok bool) {
+	pc, isProxyProtocol := c.(*proxyProtocolConn)
+	if !isProxyProtocol {
+		return c, true
+	}
+	if pc.r.Buffered() > 0 {
+		return c, false
+	}
+	return pc.Conn, true
+}
+
+// readProxyHeader reads the PROXY header starting c, if trusted.
+func readProxyHeader(c net.Conn, trusted, optional bool) (net.Conn, error) {
+	r := bufio.NewReader(c)
+	pc := &proxyProtocolConn{Conn: c, r: r, remote: c.RemoteAddr(), local: c.LocalAddr()}
+	var err error
+	version := 0
+	if b, _ := r.Peek(1); len(b) == 1 {
+		switch b[0] {
+		case 'P':
+			if b, _ := r.Peek(6); string(b) == "PROXY " {
+				version = 1
+			}
+		case '\r':
+			if b, _ := r.Peek(len(proxyV2Signature)); bytes.Equal(b, proxyV2Signature) {
+				version = 2
+			}
+		}
+	}
+	switch {
+	case version != 0 && !trusted:
+		return nil, fmt.Errorf("%v from untrusted peer", ErrProxyHeader)
+	case version == 1:
+		err = readProxyHeaderV1(r, pc)
+	case version == 2:
+		err = readProxyHeaderV2(r, pc)
+	case !optional:
+		return nil, fmt.Errorf("%v: missing", ErrProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func readProxyHeaderV1(r *bufio.Reader, pc *proxyProtocolConn) error {
+	// the header is at most 107 bytes long
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%v: %v", ErrProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%v: unterminated", ErrProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("%v: %q", ErrProxyHeader, line)
+	}
+	src, err1 := parseProxyAddr(fields[2], fields[4])
+	dst, err2 := parseProxyAddr(fields[3], fields[5])
+	if err1 != nil || err2 != nil || (src.IP.To4() != nil) != (fields[1] == "TCP4") {
+		return fmt.Errorf("%v: %q", ErrProxyHeader, line)
+	}
+	pc.remote, pc.local = src, dst
+	return nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader, pc *proxyProtocolConn) error {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return fmt.Errorf("%v: %v", ErrProxyHeader, err)
+	}
+	if head[12]>>4 != 2 {
+		return fmt.Errorf("%v: version %d", ErrProxyHeader, head[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fmt.Errorf("%v: %v", ErrProxyHeader, err)
+	}
+	switch head[12] & 0xf {
+	case 0:
+		// LOCAL, the connection of the load balancer itself
+		return nil
+	case 1:
+	default:
+		return fmt.Errorf("%v: command %d", ErrProxyHeader, head[12]&0xf)
+	}
+	var size int
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6
+		size = net.IPv6len
+	default:
+		// other protocols keep the address of the peer
+		return nil
+	}
+	if len(body) < 2*size+4 {
+		return fmt.Errorf("%v: short addresses", ErrProxyHeader)
+	}
+	pc.remote = &net.TCPAddr{IP: net.IP(body[:size]), Port: int(binary.BigEndian.Uint16(body[2*size:]))}
+	pc.local = &net.TCPAddr{IP: net.IP(body[size : 2*size]), Port: int(binary.BigEndian.Uint16(body[2*size+2:]))}
+	return nil
+}
+
+// writeProxyHeader sends the header of the given version of the PROXY protocol to w,
+// for a connection from src to dst.
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, _ := src.(*net.TCPAddr)
+	d, _ := dst.(*net.TCPAddr)
+	same := s != nil && d != nil && (s.IP.To4() != nil) == (d.IP.To4() != nil)
+	if version == 1 {
+		if !same {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP6"
+		if s.IP.To4() != nil {
+			proto = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, s.IP, d.IP, s.Port, d.Port)
+		return err
+	}
+	b := append([]byte{}, proxyV2Signature...)
+	if !same {
+		_, err := w.Write(append(b, 0x20, 0, 0, 0))
+		return err
+	}
+	srcIP, dstIP, family := s.IP.To4(), d.IP.To4(), byte(0x11)
+	if srcIP == nil {
+		srcIP, dstIP, family = s.IP.To16(), d.IP.To16(), 0x21
+	}
+	b = append(b, 0x21, family, 0, byte(2*len(srcIP)+4))
+	b = append(b, srcIP...)
+	b = append(b, dstIP...)
+	b = append(b, byte(s.Port>>8), byte(s.Port), byte(d.Port>>8), byte(d.Port))
+	_, err := w.Write(b)
+	return err
+}
+
+// sendProxyHeader sends the PROXY header of the client of ctx on conn, an upstream
+// connection, see ProxyHttpServer.UpstreamProxyProtocol.
+func (proxy *ProxyHttpServer) sendProxyHeader(ctx *ProxyCtx, conn net.Conn) error {
+	if proxy.UpstreamProxyProtocol == 0 {
+		return nil
+	}
+	var src net.Addr
+	if host, port, err := net.SplitHostPort(ctx.ClientAddr()); err == nil {
+		if addr, err := parseProxyAddr(host, port); err == nil {
+			src = addr
+		}
+	}
+	return writeProxyHeader(conn, proxy.UpstreamProxyProtocol, src, conn.RemoteAddr())
+}
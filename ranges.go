@@ -0,0 +1,179 @@
+package goproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// RangeMode is how the proxy handles the Range requests, whose partial responses
+// cannot be rewritten by the response handlers.
+type RangeMode int
+
+const (
+	// RangePassthrough sends the Range requests upstream as they are, the response
+	// handlers seeing partial responses.
+	RangePassthrough RangeMode = iota
+	// RangeStrip removes the Range and If-Range headers of the requests sent
+	// upstream, so that the response handlers see whole bodies. The requested range
+	// is cut from the responses left untouched by the handlers, and the rewritten
+	// responses are sent whole, without Accept-Ranges, so that clients do not try to
+	// resume them.
+	RangeStrip
+	// RangeServe removes the Range and If-Range headers of the requests sent upstream
+	// too, and cuts the requested range from every response, the rewritten bodies
+	// being buffered in a SpillBuffer to be measured.
+	RangeServe
+)
+
+// rangeRequest is the Range request removed from a request sent upstream.
+type rangeRequest struct {
+	rangeHeader, ifRange string
+}
+
+// stripRange removes the Range headers of req, to be served by serveRange.
+func (proxy *ProxyHttpServer) stripRange(req *http.Request, ctx *ProxyCtx) {
+	if proxy.RangeMode == RangePassthrough || req.Method != http.MethodGet || req.Header.Get("Range") == "" {
+		return
+	}
+	ctx.rangeReq = &rangeRequest{req.Header.Get("Range"), req.Header.Get("If-Range")}
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+}
+
+// parseRange parses a Range header of a single byte range, for a body of size bytes,
+// -1 if unknown. It returns ok false if the range cannot be served and should be
+// ignored, and satisfiable false if it is out of the body.
+func parseRange(s string, size int64) (start, length int64, ok, satisfiable bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(s, prefix) || strings.Contains(s, ",") {
+		return 0, 0, false, false
+	}
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return 0, 0, false, false
+	}
+	first, last := strings.TrimSpace(s[len(prefix):i]), strings.TrimSpace(s[i+1:])
+	if first == "" {
+		// suffix range, the last bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 || size < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if size >= 0 && end >= size {
+			end = size - 1
+		}
+	} else if size < 0 {
+		return 0, 0, false, false
+	}
+	if size >= 0 && start >= size {
+		return 0, 0, true, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// ifRangeMatches tells whether the If-Range validator v matches resp: a strong ETag
+// or the exact Last-Modified date.
+func ifRangeMatches(v string, resp *http.Response) bool {
+	if strings.HasPrefix(v, `"`) {
+		etag := resp.Header.Get("ETag")
+		return etag != "" && etag == v
+	}
+	return !strings.HasPrefix(v, "W/") && v == resp.Header.Get("Last-Modified")
+}
+
+// rangeBody is the body of a partial response made by serveRange, of known length.
+type rangeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// serveRange cuts the range requested to the proxy from resp, see RangeMode. The body
+// of resp was rewritten by the handlers if it is not upstreamBody.
+func (proxy *ProxyHttpServer) serveRange(resp *http.Response, upstreamBody io.ReadCloser, ctx *ProxyCtx) *http.Response {
+	r := ctx.rangeReq
+	if r == nil || resp == nil || resp.StatusCode != http.StatusOK || resp.Body == nil {
+		return resp
+	}
+	ctx.rangeReq = nil
+	rewritten := resp.Body != upstreamBody
+	if rewritten && proxy.RangeMode == RangeStrip {
+		resp.Header.Del("Accept-Ranges")
+		return resp
+	}
+	if r.ifRange != "" && !ifRangeMatches(r.ifRange, resp) {
+		return resp
+	}
+	size := resp.ContentLength
+	var body io.Reader = resp.Body
+	if rewritten {
+		buf := &SpillBuffer{}
+		_, err := io.Copy(buf, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			buf.Close()
+			ctx.Warnf("Cannot buffer the response to serve range %s: %v", r.rangeHeader, err)
+			return NewResponse(ctx.Req, ContentTypeText, http.StatusBadGateway, "Cannot read the response body\n")
+		}
+		size = buf.Len()
+		resp.Body = buf.Body()
+		body = resp.Body
+	}
+	start, length, ok, satisfiable := parseRange(r.rangeHeader, size)
+	if !ok {
+		return resp
+	}
+	resp.Header.Set("Accept-Ranges", "bytes")
+	total := "*"
+	if size >= 0 {
+		total = strconv.FormatInt(size, 10)
+	}
+	if !satisfiable {
+		resp.Body.Close()
+		unsatisfiable := NewResponse(ctx.Req, ContentTypeText, http.StatusRequestedRangeNotSatisfiable, "")
+		unsatisfiable.Header.Set("Accept-Ranges", "bytes")
+		unsatisfiable.Header.Set("Content-Range", "bytes */"+total)
+		return unsatisfiable
+	}
+	if _, err := io.CopyN(io.Discard, body, start); err != nil {
+		resp.Body.Close()
+		ctx.Warnf("Cannot skip to range %s: %v", r.rangeHeader, err)
+		return NewResponse(ctx.Req, ContentTypeText, http.StatusBadGateway, "Cannot read the response body\n")
+	}
+	ctx.Logf("Serving range %s of %s bytes", r.rangeHeader, total)
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = fmt.Sprintf("%d %s", http.StatusPartialContent, http.StatusText(http.StatusPartialContent))
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, start+length-1, total))
+	resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	resp.ContentLength = length
+	resp.Body = &rangeBody{io.LimitReader(body, length), resp.Body}
+	return resp
+}
+
+// bodyLengthKnown tells whether the ContentLength of resp is its actual length: its body
+// is the one of upstream, or a range of it.
+func bodyLengthKnown(resp *http.Response, upstreamBody io.ReadCloser) bool {
+	if _, ok := resp.Body.(*rangeBody); ok {
+		return true
+	}
+	return resp.Body == upstreamBody
+}
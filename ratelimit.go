@@ -0,0 +1,268 @@
+package goproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Errors passed to RateLimiter.Reject, telling which limit was reached.
+var (
+	ErrTooManyTunnels = errors.New("too many concurrent tunnels")
+	ErrRateLimited    = errors.New("too many requests")
+	ErrQuotaExceeded  = errors.New("daily transfer quota exceeded")
+)
+
+// RateLimits are the limits of a client, zero values meaning unlimited.
+type RateLimits struct {
+	// MaxTunnels is the number of CONNECT tunnels a client may keep open
+	MaxTunnels int `json:"max_tunnels,omitempty"`
+	// RequestsPerSecond limits the rate of requests, including CONNECT requests and
+	// the requests MITM'd from tunnels, allowing bursts of Burst requests (at least
+	// one second worth of requests by default)
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	// BytesPerDay limits the bytes transferred through tunnels and of the plain
+	// responses, per UTC day. The transfer exceeding it completes, but the following
+	// requests are rejected.
+	BytesPerDay int64 `json:"bytes_per_day,omitempty"`
+}
+
+// RateLimiter limits the requests of the clients of the proxy, identified by
+// ProxyCtx.ClientID (see ClientIdentifier) or else by IP address:
+//
+//	proxy.RateLimiter = &goproxy.RateLimiter{Limits: goproxy.RateLimits{MaxTunnels: 20, RequestsPerSecond: 10}}
+//
+// Requests beyond the limits are answered with 429 Too Many Requests, or with the
+// response returned by Reject.
+type RateLimiter struct {
+	Limits RateLimits
+	// ClientLimits overrides Limits for the given clients
+	ClientLimits map[string]RateLimits
+	// Reject, if set, returns the response to a request rejected because of err, one
+	// of ErrTooManyTunnels, ErrRateLimited and ErrQuotaExceeded. It may for example
+	// answer 407 Proxy Authentication Required to clients without identity.
+	Reject func(req *http.Request, ctx *ProxyCtx, err error) *http.Response
+	// Clock, if set, tells the time of the rate limits and daily quotas, instead of
+	// the Clock of the proxy, see ProxyHttpServer.Clock.
+	Clock Clock
+
+	mu      sync.Mutex
+	clients map[string]*clientUsage
+
+	proxyClock inheritedClock
+}
+
+// clientUsage is the state of the limits of a client
+type clientUsage struct {
+	tunnels  int
+	tokens   float64
+	refilled time.Time
+	day      string
+	bytes    int64
+}
+
+// maxIdleClients is the number of clients above which idle ones are forgotten
+const maxIdleClients = 10000
+
+// RateUsage is the usage of a client, see RateLimiter.Usage.
+type RateUsage struct {
+	Tunnels    int   `json:"tunnels"`
+	BytesToday int64 `json:"bytes_today"`
+}
+
+func clientKey(req *http.Request, ctx *ProxyCtx) string {
+	if ctx.ClientID != "" {
+		return ctx.ClientID
+	}
+	return IdentifyBySourceIP(req, ctx)
+}
+
+func (rl *RateLimiter) limits(key string) RateLimits {
+	if l, ok := rl.ClientLimits[key]; ok {
+		return l
+	}
+	return rl.Limits
+}
+
+func today(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+// usage returns the state of key, rl.mu being held.
+func (rl *RateLimiter) usage(key string, now time.Time) *clientUsage {
+	if rl.clients == nil {
+		rl.clients = make(map[string]*clientUsage)
+	}
+	u, ok := rl.clients[key]
+	if !ok {
+		if len(rl.clients) >= maxIdleClients {
+			rl.prune(now)
+		}
+		u = &clientUsage{tokens: math.Inf(1), refilled: now, day: today(now)}
+		rl.clients[key] = u
+	}
+	if d := today(now); d != u.day {
+		u.day, u.bytes = d, 0
+	}
+	return u
+}
+
+// prune forgets the clients without tunnels, quota usage and rate limiting.
+func (rl *RateLimiter) prune(now time.Time) {
+	for key, u := range rl.clients {
+		if u.tunnels == 0 && (u.bytes == 0 || u.day != today(now)) && now.Sub(u.refilled) > time.Minute {
+			delete(rl.clients, key)
+		}
+	}
+}
+
+// take checks the limits of a new request, and reserves a tunnel for CONNECT requests.
+func (rl *RateLimiter) take(key string, tunnel bool) (time.Duration, error) {
+	limits := rl.limits(key)
+	now := rl.proxyClock.or(rl.Clock).Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	u := rl.usage(key, now)
+	if limits.BytesPerDay > 0 && u.bytes >= limits.BytesPerDay {
+		tomorrow := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+		return tomorrow.Sub(now), ErrQuotaExceeded
+	}
+	if tunnel && limits.MaxTunnels > 0 && u.tunnels >= limits.MaxTunnels {
+		return 0, ErrTooManyTunnels
+	}
+	if rps := limits.RequestsPerSecond; rps > 0 {
+		burst := float64(limits.Burst)
+		if burst < 1 {
+			burst = math.Max(1, math.Ceil(rps))
+		}
+		u.tokens = math.Min(burst, u.tokens+now.Sub(u.refilled).Seconds()*rps)
+		u.refilled = now
+		if u.tokens < 1 {
+			return time.Duration((1 - u.tokens) / rps * float64(time.Second)), ErrRateLimited
+		}
+		u.tokens--
+	}
+	if tunnel {
+		u.tunnels++
+	}
+	return 0, nil
+}
+
+func (rl *RateLimiter) release(key string) {
+	rl.mu.Lock()
+	if u, ok := rl.clients[key]; ok && u.tunnels > 0 {
+		u.tunnels--
+	}
+	rl.mu.Unlock()
+}
+
+func (rl *RateLimiter) addBytes(key string, n int64) {
+	if n <= 0 {
+		return
+	}
+	rl.mu.Lock()
+	rl.usage(key, rl.proxyClock.or(rl.Clock).Now()).bytes += n
+	rl.mu.Unlock()
+}
+
+// Usage returns the current usage of a client.
+func (rl *RateLimiter) Usage(client string) RateUsage {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	u := rl.usage(client, rl.proxyClock.or(rl.Clock).Now())
+	return RateUsage{Tunnels: u.tunnels, BytesToday: u.bytes}
+}
+
+func (rl *RateLimiter) reject(req *http.Request, ctx *ProxyCtx, err error, retry time.Duration) *http.Response {
+	ctx.Warnf("Rate limiting %s: %v", clientKey(req, ctx), err)
+	if rl.Reject != nil {
+		if resp := rl.Reject(req, ctx, err); resp != nil {
+			return resp
+		}
+	}
+	resp := NewResponse(req, ContentTypeText, http.StatusTooManyRequests, fmt.Sprintf("%s\n", err))
+	if retry > 0 {
+		resp.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	}
+	return resp
+}
+
+// checkRequest returns the response rejecting req, or nil if it is allowed.
+func (rl *RateLimiter) checkRequest(req *http.Request, ctx *ProxyCtx) *http.Response {
+	if rl == nil {
+		return nil
+	}
+	rl.proxyClock.inherit(ctx.Proxy)
+	if retry, err := rl.take(clientKey(req, ctx), false); err != nil {
+		return rl.reject(req, ctx, err, retry)
+	}
+	return nil
+}
+
+// checkConnect rejects the CONNECT request req, or reserves a tunnel which is released
+// when the connection returned by wrapTunnel is closed.
+func (rl *RateLimiter) checkConnect(req *http.Request, ctx *ProxyCtx) *http.Response {
+	if rl == nil {
+		return nil
+	}
+	rl.proxyClock.inherit(ctx.Proxy)
+	if retry, err := rl.take(clientKey(req, ctx), true); err != nil {
+		return rl.reject(req, ctx, err, retry)
+	}
+	return nil
+}
+
+// countBytes counts the bytes of a plain response sent to a client.
+func (rl *RateLimiter) countBytes(req *http.Request, ctx *ProxyCtx, n int64) {
+	if rl != nil {
+		rl.addBytes(clientKey(req, ctx), n)
+	}
+}
+
+// limitedConn counts the bytes transferred through a tunnel, and releases it on Close.
+type limitedConn struct {
+	net.Conn
+	limiter *RateLimiter
+	key     string
+	once    sync.Once
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.limiter.addBytes(c.key, int64(n))
+	return n, err
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.limiter.addBytes(c.key, int64(n))
+	return n, err
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.key) })
+	return c.Conn.Close()
+}
+
+// wrapTunnel returns the client connection of a tunnel reserved by checkConnect.
+func (rl *RateLimiter) wrapTunnel(req *http.Request, ctx *ProxyCtx, conn net.Conn) net.Conn {
+	if rl == nil {
+		return conn
+	}
+	return keepHalfClose(&limitedConn{Conn: conn, limiter: rl, key: clientKey(req, ctx)}, conn)
+}
+
+// writeResponse writes resp to w, for responses sent before the proxy handles a request.
+func writeResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	copyHeaders(w.Header(), resp.Header, false)
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
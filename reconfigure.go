@@ -0,0 +1,59 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// The Tr, ConnectDial and Verbose fields of a proxy may only be set before it serves
+// requests. The following methods change them while it serves, without data races.
+
+// SetTransport replaces the transport sending requests upstream. The idle connections
+// of the previous transport and of the clones derived from it are closed, requests
+// in flight complete with it.
+func (proxy *ProxyHttpServer) SetTransport(tr *http.Transport) {
+	proxy.cfgMu.Lock()
+	old := proxy.Tr
+	proxy.Tr = tr
+	proxy.cfgMu.Unlock()
+	if old != nil && old != tr {
+		proxy.transports.flush()
+		old.CloseIdleConnections()
+	}
+}
+
+// Transport returns the transport sending requests upstream, Tr.
+func (proxy *ProxyHttpServer) Transport() *http.Transport {
+	proxy.cfgMu.RLock()
+	defer proxy.cfgMu.RUnlock()
+	return proxy.Tr
+}
+
+// SetConnectDial replaces the ConnectDial function dialing the tunnels of CONNECT
+// requests, nil to dial them directly. It applies to the tunnels dialed from then on.
+func (proxy *ProxyHttpServer) SetConnectDial(dial func(network, addr string) (net.Conn, error)) {
+	proxy.cfgMu.Lock()
+	proxy.ConnectDial = dial
+	proxy.cfgMu.Unlock()
+}
+
+// SetVerbose changes the log level of the proxy.
+func (proxy *ProxyHttpServer) SetVerbose(level LogLevel) {
+	proxy.cfgMu.Lock()
+	proxy.Verbose = level
+	proxy.cfgMu.Unlock()
+}
+
+// LogLevel returns the log level of the proxy, Verbose.
+func (proxy *ProxyHttpServer) LogLevel() LogLevel {
+	proxy.cfgMu.RLock()
+	defer proxy.cfgMu.RUnlock()
+	return proxy.Verbose
+}
+
+// connectDials returns the ConnectDialWithReq and ConnectDial functions of the proxy.
+func (proxy *ProxyHttpServer) connectDials() (withReq func(req *http.Request, network, addr string) (net.Conn, error), dial func(network, addr string) (net.Conn, error)) {
+	proxy.cfgMu.RLock()
+	defer proxy.cfgMu.RUnlock()
+	return proxy.ConnectDialWithReq, proxy.ConnectDial
+}
@@ -0,0 +1,90 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// isRedirect tells whether resp is a redirect which may be followed.
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+// redirectRequest returns the request following the redirect resp to req, or nil if
+// the body of req cannot be sent again.
+func redirectRequest(req *http.Request, resp *http.Response) (*http.Request, error) {
+	loc, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, err
+	}
+	next := req.Clone(req.Context())
+	next.URL, next.Host, next.RequestURI = loc, "", ""
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		// followed without the body, with GET but for HEAD requests, as net/http does
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			next.Method = http.MethodGet
+		}
+		next.Body, next.GetBody, next.ContentLength = nil, nil, 0
+		for k := range next.Header {
+			if strings.HasPrefix(k, "Content-") {
+				next.Header.Del(k)
+			}
+		}
+	default:
+		if req.Body == nil || req.Body == http.NoBody {
+			break
+		}
+		if req.GetBody == nil {
+			return nil, nil
+		}
+		if next.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.EqualFold(loc.Hostname(), req.URL.Hostname()) {
+		// the credentials are not sent to other hosts
+		next.Header.Del("Authorization")
+		next.Header.Del("Cookie")
+	}
+	return next, nil
+}
+
+// followRedirects follows up to ctx.FollowRedirects redirects from resp, the response to
+// req, with send. A redirect loop is answered with 508 Loop Detected, and the redirects
+// which cannot be followed are returned as they are.
+func (ctx *ProxyCtx) followRedirects(req *http.Request, resp *http.Response, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	visited := map[string]bool{req.Method + " " + req.URL.String(): true}
+	for hops := 0; isRedirect(resp); hops++ {
+		if hops >= ctx.FollowRedirects {
+			ctx.Warnf("Not following more than %d redirects from %s", ctx.FollowRedirects, ctx.Req.URL)
+			return resp, nil
+		}
+		next, err := redirectRequest(req, resp)
+		if err != nil || next == nil {
+			ctx.Warnf("Cannot follow the redirect of %s to %s: %v", req.URL, resp.Header.Get("Location"), err)
+			return resp, nil
+		}
+		// drain the body so that the connection may be reused
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4<<10))
+		resp.Body.Close()
+		key := next.Method + " " + next.URL.String()
+		if visited[key] {
+			ctx.Warnf("Redirect loop from %s at %s", ctx.Req.URL, next.URL)
+			return NewResponse(ctx.Req, ContentTypeText, http.StatusLoopDetected, "Redirect loop at "+next.URL.String()+"\n"), nil
+		}
+		visited[key] = true
+		ctx.Logf("Following redirect %d to %s %s", resp.StatusCode, next.Method, next.URL)
+		req = next
+		if resp, err = send(req); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
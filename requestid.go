@@ -0,0 +1,97 @@
+package goproxy
+
+import (
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// DefaultRequestIDHeader is the usual header of correlation IDs, see
+// ProxyHttpServer.RequestIDHeader.
+const DefaultRequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLen is the length above which the request IDs of clients are replaced
+const maxRequestIDLen = 128
+
+// ID returns the identifier of ctx: its Session, "12", for plain requests and
+// tunnels, and the Session of the tunnel followed by the number of the request in
+// the tunnel, "12.3", for the requests MITM'd from a CONNECT tunnel, so that they
+// can be related to it in logs.
+func (ctx *ProxyCtx) ID() string {
+	if ctx.Seq == 0 {
+		return strconv.FormatInt(ctx.Session, 10)
+	}
+	return strconv.FormatInt(ctx.TunnelID, 10) + "." + strconv.FormatInt(ctx.Seq, 10)
+}
+
+// nextInTunnel returns the TunnelID and Seq of the next request MITM'd from the
+// tunnel of the CONNECT context ctx.
+func (ctx *ProxyCtx) nextInTunnel() (tunnel, seq int64) {
+	return ctx.Session, atomic.AddInt64(&ctx.tunnelSeq, 1)
+}
+
+// logID is the prefix of the log messages of ctx
+func (ctx *ProxyCtx) logID() string {
+	if ctx.Seq == 0 {
+		return padID(ctx.Session & 0xFF)
+	}
+	return padID(ctx.TunnelID&0xFF) + "." + strconv.FormatInt(ctx.Seq, 10)
+}
+
+func padID(id int64) string {
+	s := strconv.FormatInt(id, 10)
+	for len(s) < 3 {
+		s = "0" + s
+	}
+	return s
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID(random io.Reader) string {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(random, b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// setRequestID sets the RequestID of ctx from the RequestIDHeader of req, generating
+// one if the client did not send a valid one, and makes sure the request sent
+// upstream carries it.
+func (proxy *ProxyHttpServer) setRequestID(req *http.Request, ctx *ProxyCtx) {
+	if proxy.RequestIDHeader == "" {
+		return
+	}
+	id := req.Header.Get(proxy.RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID(proxy.random())
+	}
+	req.Header.Set(proxy.RequestIDHeader, id)
+	ctx.RequestID = id
+}
+
+// responseRequestID echoes the RequestID of ctx in resp, unless resp has one already.
+func (proxy *ProxyHttpServer) responseRequestID(resp *http.Response, ctx *ProxyCtx) {
+	if proxy.RequestIDHeader == "" || ctx.RequestID == "" || resp == nil {
+		return
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Header.Get(proxy.RequestIDHeader) == "" {
+		resp.Header.Set(proxy.RequestIDHeader, ctx.RequestID)
+	}
+}
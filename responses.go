@@ -2,8 +2,14 @@ package goproxy
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
+	"path/filepath"
 )
 
 // Will generate a valid http response to the given request the response will have
@@ -31,9 +37,86 @@ func NewResponse(r *http.Request, contentType string, status int, body string) *
 const (
 	ContentTypeText = "text/plain"
 	ContentTypeHtml = "text/html"
+	ContentTypeJSON = "application/json"
 )
 
 // Alias for NewResponse(r,ContentTypeText,http.StatusAccepted,text)
 func TextResponse(r *http.Request, text string) *http.Response {
 	return NewResponse(r, ContentTypeText, http.StatusAccepted, text)
 }
+
+// NewStreamResponse is like NewResponse, with a body streamed from body, of length bytes
+// or -1 if unknown. The body is closed with the response if it is an io.Closer.
+func NewStreamResponse(r *http.Request, contentType string, status int, body io.Reader, length int64) *http.Response {
+	resp := NewResponse(r, contentType, status, "")
+	rc, ok := body.(io.ReadCloser)
+	if !ok {
+		rc = ioutil.NopCloser(body)
+	}
+	resp.Body, resp.ContentLength = rc, length
+	return resp
+}
+
+// NewJSONResponse returns a response with v encoded as JSON.
+func NewJSONResponse(r *http.Request, status int, v interface{}) (*http.Response, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return NewResponse(r, ContentTypeJSON, status, string(b)+"\n"), nil
+}
+
+var errIsDirectory = errors.New("is a directory")
+
+// NewFileResponse returns a 200 OK response with the content of a file, streamed from
+// disk. Its content type is the one of the file extension, or sniffed from the content,
+// and its Last-Modified header the modification time of the file.
+func NewFileResponse(r *http.Request, name string) (*http.Response, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
+		err = &os.PathError{Op: "open", Path: name, Err: errIsDirectory}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(f, buf[:])
+		contentType = http.DetectContentType(buf[:n])
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	resp := NewStreamResponse(r, contentType, http.StatusOK, f, info.Size())
+	resp.Header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	return resp, nil
+}
+
+// NoContentResponse returns a 204 No Content response.
+func NoContentResponse(r *http.Request) *http.Response {
+	return emptyResponse(r, http.StatusNoContent)
+}
+
+// NotModifiedResponse returns a 304 Not Modified response, with the ETag of the
+// resource if not empty.
+func NotModifiedResponse(r *http.Request, etag string) *http.Response {
+	resp := emptyResponse(r, http.StatusNotModified)
+	if etag != "" {
+		resp.Header.Set("ETag", etag)
+	}
+	return resp
+}
+
+func emptyResponse(r *http.Request, status int) *http.Response {
+	resp := NewResponse(r, "", status, "")
+	resp.Header.Del("Content-Type")
+	resp.Body = http.NoBody
+	return resp
+}
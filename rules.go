@@ -0,0 +1,516 @@
+package goproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions, see Rule.Action.
+const (
+	RuleMitm      = "mitm"
+	RuleTunnel    = "tunnel"
+	RuleReject    = "reject"
+	RuleBlock     = "block"
+	RuleRedirect  = "redirect"
+	RuleRewrite   = "rewrite"
+	RuleHeaders   = "headers"
+	RuleMapRemote = "map_remote"
+	RuleMapLocal  = "map_local"
+)
+
+// Rule is a declarative policy rule of a RuleSet. A rule matches a request if its host,
+// path, method and client identity (see ClientIdentifier) match one of the given ones,
+// an empty list matching anything.
+// Hosts are compared without port unless given one, and "*.example.com" matches the
+// subdomains of example.com. Paths are prefixes, or patterns of path.Match if they contain a '*'.
+//
+// The mitm, tunnel and reject actions apply to CONNECT requests, the first matching
+// rule deciding how the tunnel is handled. The block, redirect and reject actions answer
+// requests, and CONNECT requests for block, with Status and Body or a redirect to
+// Location; block and reject answer with Page instead of Body if set, e.g.
+// {"title": "Blocked", "message": "{{.Host}} is blocked"}. The rewrite action sets and removes request headers, and the headers action
+// applies the HeaderOps of Headers to the request and its response; both let the
+// following rules apply.
+//
+// The map_remote action sends the request to the scheme, host and port of the URL
+// MapTo, e.g. "http://localhost:8080/v2/", its path replacing the prefix of Paths the
+// request matched, or prefixing the path of the request. The map_local action answers
+// the request with the local file MapTo, or with the file of the directory MapTo at the
+// path of the request, stripped of its matched prefix. Both end the rules evaluation,
+// and need the tunnels of HTTPS hosts to be MITM'd.
+type Rule struct {
+	Name          string            `json:"name,omitempty"`
+	Hosts         []string          `json:"hosts,omitempty"`
+	Paths         []string          `json:"paths,omitempty"`
+	Methods       []string          `json:"methods,omitempty"`
+	Clients       []string          `json:"clients,omitempty"`
+	Action        string            `json:"action"`
+	Status        int               `json:"status,omitempty"`
+	Body          string            `json:"body,omitempty"`
+	Page          *Page             `json:"page,omitempty"`
+	Location      string            `json:"location,omitempty"`
+	SetHeaders    map[string]string `json:"set_headers,omitempty"`
+	RemoveHeaders []string          `json:"remove_headers,omitempty"`
+	Headers       []HeaderOp        `json:"headers,omitempty"`
+	MapTo         string            `json:"map_to,omitempty"`
+}
+
+// RulesConfig is the format of a rules file:
+//
+//	{"rules": [
+//		{"hosts": ["*.ads.example"], "action": "block", "status": 404},
+//		{"hosts": ["api.example.com"], "action": "mitm"},
+//		{"hosts": ["api.example.com"], "paths": ["/v1/"], "action": "rewrite", "set_headers": {"X-Api-Version": "1"}},
+//		{"hosts": ["*.example.org"], "action": "headers", "headers": [{"op": "remove", "name": "Referer"}]},
+//		{"hosts": ["api.example.com"], "paths": ["/v2/"], "action": "map_remote", "map_to": "http://localhost:8080/"},
+//		{"hosts": ["cdn.example.com"], "paths": ["/js/"], "action": "map_local", "map_to": "/home/me/src/app/dist"}
+//	]}
+//
+// or its YAML equivalent, with the same keys:
+//
+//	rules:
+//	  - hosts: ["*.ads.example"]
+//	    action: block
+//	    status: 404
+//	  - hosts: [api.example.com]
+//	    action: mitm
+type RulesConfig struct {
+	Rules []Rule `json:"rules"`
+}
+
+func (rule *Rule) validate() error {
+	switch rule.Action {
+	case RuleMitm, RuleTunnel, RuleReject, RuleBlock, RuleRewrite:
+	case RuleHeaders:
+		for i := range rule.Headers {
+			if err := rule.Headers[i].validate(); err != nil {
+				return fmt.Errorf("rule %q: %v", rule.Name, err)
+			}
+		}
+	case RuleRedirect:
+		if rule.Location == "" {
+			return fmt.Errorf("rule %q: redirect without location", rule.Name)
+		}
+	case RuleMapRemote:
+		u, err := url.Parse(rule.MapTo)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("rule %q: bad map_to URL %q", rule.Name, rule.MapTo)
+		}
+	case RuleMapLocal:
+		if rule.MapTo == "" {
+			return fmt.Errorf("rule %q: map_local without map_to", rule.Name)
+		}
+	default:
+		return fmt.Errorf("rule %q: unknown action %q", rule.Name, rule.Action)
+	}
+	for _, p := range rule.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("rule %q: bad path %q: %v", rule.Name, p, err)
+		}
+	}
+	if rule.Page != nil {
+		if err := rule.Page.Validate(); err != nil {
+			return fmt.Errorf("rule %q: bad page: %v", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if _, _, err := net.SplitHostPort(p); err == nil {
+			// the pattern includes the port
+			if p == host {
+				return true
+			}
+		} else if p == hostname || strings.HasPrefix(p, "*.") && strings.HasSuffix(hostname, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPath(patterns []string, p string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if strings.Contains(pattern, "*") {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		} else if strings.HasPrefix(p, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchedPrefix returns the prefix of patterns p matched, "" if none did.
+func matchedPrefix(patterns []string, p string) string {
+	for _, pattern := range patterns {
+		if !strings.Contains(pattern, "*") && strings.HasPrefix(p, pattern) {
+			return pattern
+		}
+	}
+	return ""
+}
+
+func matchMethod(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchClient(clients []string, ctx *ProxyCtx) bool {
+	if len(clients) == 0 {
+		return true
+	}
+	for _, c := range clients {
+		if c == ctx.ClientID {
+			return true
+		}
+	}
+	return false
+}
+
+// label names the rule of index i for ProxyCtx.Rule.
+func (rule *Rule) label(i int) string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("#%d", i)
+}
+
+func (rule *Rule) response(req *http.Request, ctx *ProxyCtx) *http.Response {
+	status := rule.Status
+	if rule.Action == RuleRedirect {
+		if status == 0 {
+			status = http.StatusFound
+		}
+		resp := NewResponse(req, ContentTypeText, status, rule.Body)
+		resp.Header.Set("Location", rule.Location)
+		return resp
+	}
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if rule.Page != nil {
+		if rule.Status == 0 {
+			status = rule.Page.Status
+		}
+		return rule.Page.render(ctx, status, nil)
+	}
+	return NewResponse(req, ContentTypeText, status, rule.Body)
+}
+
+// mapRemote changes the URL of req to the one of the map_remote rule.
+func (rule *Rule) mapRemote(req *http.Request) {
+	target, _ := url.Parse(rule.MapTo)
+	u := *req.URL
+	u.Scheme, u.Host = target.Scheme, target.Host
+	if target.Path != "" {
+		rest := strings.TrimPrefix(strings.TrimPrefix(u.Path, matchedPrefix(rule.Paths, u.Path)), "/")
+		u.Path = target.Path
+		if rest != "" {
+			u.Path = strings.TrimSuffix(target.Path, "/") + "/" + rest
+		}
+		u.RawPath = ""
+	}
+	req.URL, req.Host = &u, u.Host
+}
+
+// mapLocal answers req with the local file of the map_local rule.
+func (rule *Rule) mapLocal(req *http.Request, ctx *ProxyCtx) *http.Response {
+	info, err := os.Stat(rule.MapTo)
+	if err != nil {
+		ctx.Warnf("Cannot map %s to %s: %v", req.URL, rule.MapTo, err)
+		return NewResponse(req, ContentTypeText, http.StatusNotFound, "Not found\n")
+	}
+	if info.IsDir() {
+		_, resp := (&FileServer{Root: http.Dir(rule.MapTo), Prefix: matchedPrefix(rule.Paths, req.URL.Path)}).Handle(req, ctx)
+		return resp
+	}
+	return handlerResponse(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, rule.MapTo)
+	}), req, req)
+}
+
+// RuleSet applies the rules of a JSON or YAML configuration file to the proxy, and can
+// reload them while the proxy is running. If a reload fails, the previous rules are kept.
+type RuleSet struct {
+	file string
+	yaml bool
+
+	mu      sync.RWMutex
+	rules   []Rule
+	modTime time.Time
+
+	logger Logger
+}
+
+// LoadRules reads the rules of a RulesConfig file, in YAML if its extension is .yaml
+// or .yml and in JSON otherwise.
+func LoadRules(file string) (*RuleSet, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	rs := &RuleSet{file: file, yaml: ext == ".yaml" || ext == ".yml"}
+	if err := rs.Reload(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+// ParseRules parses the rules of a RulesConfig JSON document. The returned RuleSet
+// has no file to reload from.
+func ParseRules(data []byte) (*RuleSet, error) {
+	rules, err := parseRules(data, false)
+	if err != nil {
+		return nil, err
+	}
+	return &RuleSet{rules: rules}, nil
+}
+
+// ParseRulesYAML parses the rules of a RulesConfig YAML document. The returned
+// RuleSet has no file to reload from.
+func ParseRulesYAML(data []byte) (*RuleSet, error) {
+	rules, err := parseRules(data, true)
+	if err != nil {
+		return nil, err
+	}
+	return &RuleSet{rules: rules}, nil
+}
+
+func parseRules(data []byte, isYAML bool) ([]Rule, error) {
+	if isYAML {
+		// go through JSON, so that YAML documents use the keys of the json tags
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		var err error
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+	var config RulesConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	for i := range config.Rules {
+		if err := config.Rules[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return config.Rules, nil
+}
+
+// Reload reads the rules file again.
+func (rs *RuleSet) Reload() error {
+	if rs.file == "" {
+		return nil
+	}
+	info, err := os.Stat(rs.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(rs.file)
+	if err != nil {
+		return err
+	}
+	rules, err := parseRules(data, rs.yaml)
+	if err != nil {
+		return fmt.Errorf("%s: %v", rs.file, err)
+	}
+	rs.mu.Lock()
+	rs.rules, rs.modTime = rules, info.ModTime()
+	rs.mu.Unlock()
+	return nil
+}
+
+// Rules returns the rules currently applied.
+func (rs *RuleSet) Rules() []Rule {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.rules
+}
+
+// SetRules replaces the rules applied, until the next reload of the rules file.
+func (rs *RuleSet) SetRules(rules []Rule) error {
+	for i := range rules {
+		if err := rules[i].validate(); err != nil {
+			return err
+		}
+	}
+	rs.mu.Lock()
+	rs.rules = rules
+	rs.mu.Unlock()
+	return nil
+}
+
+func (rs *RuleSet) reload() {
+	if err := rs.Reload(); err != nil {
+		if rs.logger != nil {
+			rs.logger.Printf("WARN: cannot reload rules: %v", err)
+		}
+		return
+	}
+	if rs.logger != nil {
+		rs.logger.Printf("INFO: reloaded rules from %s", rs.file)
+	}
+}
+
+// WatchSignal reloads the rules when the process receives one of the given signals,
+// SIGHUP by default. Call the returned function to stop watching.
+func (rs *RuleSet) WatchSignal(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	ch := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(ch, sigs...)
+	go func() {
+		for {
+			select {
+			case <-ch:
+				rs.reload()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+		})
+	}
+}
+
+// WatchFile reloads the rules when the modification time of the rules file changes,
+// checking it at the given interval. Call the returned function to stop watching.
+func (rs *RuleSet) WatchFile(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	rs.mu.RLock()
+	last := rs.modTime
+	rs.mu.RUnlock()
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// a file failing to load is not read again until it changes
+				if info, err := os.Stat(rs.file); err == nil && !info.ModTime().Equal(last) {
+					last = info.ModTime()
+					rs.reload()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Install registers the handlers applying the rules on proxy, and logs reloads to
+// its Logger. Rules changed by a reload apply to the following requests.
+func (rs *RuleSet) Install(proxy *ProxyHttpServer) {
+	rs.logger = proxy.Logger
+	proxy.OnRequest().HandleConnectFunc(rs.handleConnect)
+	proxy.OnRequest().DoFunc(rs.handleRequest)
+	proxy.OnResponse().DoFunc(applyResponseHeaderOps)
+}
+
+func (rs *RuleSet) handleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	for i, rule := range rs.Rules() {
+		if len(rule.Paths) > 0 || !matchMethod(rule.Methods, http.MethodConnect) || !matchHost(rule.Hosts, host) || !matchClient(rule.Clients, ctx) {
+			continue
+		}
+		switch rule.Action {
+		case RuleMitm:
+			ctx.Logf("CONNECT to %s matches rule %d %q: mitm", host, i, rule.Name)
+			ctx.Rule = rule.label(i)
+			return MitmConnect, host
+		case RuleTunnel:
+			ctx.Logf("CONNECT to %s matches rule %d %q: tunnel", host, i, rule.Name)
+			ctx.Rule = rule.label(i)
+			return OkConnect, host
+		case RuleReject, RuleBlock:
+			ctx.Logf("CONNECT to %s matches rule %d %q: %s", host, i, rule.Name, rule.Action)
+			ctx.Rule = rule.label(i)
+			if rule.Action == RuleBlock {
+				ctx.Resp = rule.response(ctx.Req, ctx)
+			}
+			return RejectConnect, host
+		}
+	}
+	return nil, ""
+}
+
+func (rs *RuleSet) handleRequest(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	for i, rule := range rs.Rules() {
+		if !matchMethod(rule.Methods, req.Method) || !matchHost(rule.Hosts, req.URL.Host) || !matchPath(rule.Paths, req.URL.Path) || !matchClient(rule.Clients, ctx) {
+			continue
+		}
+		switch rule.Action {
+		case RuleRewrite:
+			ctx.Logf("Request to %s matches rule %d %q: rewrite", req.URL, i, rule.Name)
+			ctx.Rule = rule.label(i)
+			for _, name := range rule.RemoveHeaders {
+				req.Header.Del(name)
+			}
+			for name, value := range rule.SetHeaders {
+				req.Header.Set(name, value)
+			}
+		case RuleHeaders:
+			ctx.Logf("Request to %s matches rule %d %q: headers", req.URL, i, rule.Name)
+			ctx.Rule = rule.label(i)
+			applyHeaderOps(rule.Headers, req, ctx)
+		case RuleBlock, RuleReject, RuleRedirect:
+			ctx.Logf("Request to %s matches rule %d %q: %s", req.URL, i, rule.Name, rule.Action)
+			ctx.Rule = rule.label(i)
+			return req, rule.response(req, ctx)
+		case RuleMapRemote:
+			ctx.Rule = rule.label(i)
+			from := req.URL.String()
+			rule.mapRemote(req)
+			ctx.Logf("Request to %s matches rule %d %q: mapped to %s", from, i, rule.Name, req.URL)
+			return req, nil
+		case RuleMapLocal:
+			ctx.Logf("Request to %s matches rule %d %q: mapped to %s", req.URL, i, rule.Name, rule.MapTo)
+			ctx.Rule = rule.label(i)
+			return req, rule.mapLocal(req, ctx)
+		}
+	}
+	return req, nil
+}
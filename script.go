@@ -0,0 +1,169 @@
+package goproxy
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ScriptPolicy decides the fate of requests and CONNECT requests with expressions, see
+// Expr for the language. The expressions are evaluated with the variables:
+//
+//	method, host, path, url, client_ip  strings
+//	header(name), query(name)            functions returning the first value, or ""
+//	client_id                            identity of the client, see ClientIdentifier
+//	session                              number
+//	connect                              true for CONNECT requests
+//
+// Connect returns "mitm", "tunnel", "reject", or "" to leave the decision to the
+// other handlers. Request returns "" or "allow" to send the request, "deny" or
+// "deny:<status>" to answer with an error, or "redirect:<url>". SetHeaders computes
+// request headers, an empty value removing the header. For example:
+//
+//	policy := &goproxy.ScriptPolicy{
+//		Connect: goproxy.MustCompileExpr(`endsWith(host, ".example.com:443") ? "mitm" : ""`),
+//		Request: goproxy.MustCompileExpr(`method == "DELETE" && !(client_ip in ["10.0.0.1"]) ? "deny:405" : "allow"`),
+//	}
+//	policy.Install(proxy)
+//
+// Expressions failing to evaluate, e.g. because they exceed Limits, deny the request
+// unless FailOpen is set.
+type ScriptPolicy struct {
+	Connect    *Expr
+	Request    *Expr
+	SetHeaders map[string]*Expr
+	Limits     ExprLimits
+	FailOpen   bool
+}
+
+func (p *ScriptPolicy) vars(req *http.Request, ctx *ProxyCtx) map[string]interface{} {
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		clientIP = req.RemoteAddr
+	}
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	return map[string]interface{}{
+		"method":    req.Method,
+		"host":      host,
+		"path":      req.URL.Path,
+		"url":       req.URL.String(),
+		"client_ip": clientIP,
+		"client_id": ctx.ClientID,
+		"session":   ctx.Session,
+		"connect":   req.Method == http.MethodConnect,
+		"header": ExprFunc(func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("header", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			return req.Header.Get(s[0]), nil
+		}),
+		"query": ExprFunc(func(args ...interface{}) (interface{}, error) {
+			s, err := stringArgs("query", 1, args)
+			if err != nil {
+				return nil, err
+			}
+			return req.URL.Query().Get(s[0]), nil
+		}),
+	}
+}
+
+func (p *ScriptPolicy) eval(e *Expr, vars map[string]interface{}, ctx *ProxyCtx) (string, error) {
+	limits := p.Limits
+	if limits.Clock == nil {
+		limits.Clock = ctx.Proxy.clock()
+	}
+	v, err := e.Eval(vars, limits)
+	if err != nil {
+		ctx.Warnf("Cannot evaluate %q: %v", e, err)
+		return "", err
+	}
+	return toString(v), nil
+}
+
+// Install registers the handlers applying the policy on proxy.
+func (p *ScriptPolicy) Install(proxy *ProxyHttpServer) {
+	if p.Connect != nil {
+		proxy.OnRequest().HandleConnectFunc(p.handleConnect)
+	}
+	if p.Request != nil || len(p.SetHeaders) > 0 {
+		proxy.OnRequest().DoFunc(p.handleRequest)
+	}
+}
+
+func (p *ScriptPolicy) handleConnect(host string, ctx *ProxyCtx) (*ConnectAction, string) {
+	decision, err := p.eval(p.Connect, p.vars(ctx.Req, ctx), ctx)
+	if err != nil && !p.FailOpen {
+		return RejectConnect, host
+	}
+	switch decision {
+	case "mitm":
+		return MitmConnect, host
+	case "tunnel":
+		return OkConnect, host
+	case "reject", "deny":
+		return RejectConnect, host
+	case "":
+	default:
+		ctx.Warnf("Unknown CONNECT decision %q of %q", decision, p.Connect)
+	}
+	return nil, ""
+}
+
+func (p *ScriptPolicy) handleRequest(req *http.Request, ctx *ProxyCtx) (*http.Request, *http.Response) {
+	vars := p.vars(req, ctx)
+	if p.Request != nil {
+		decision, err := p.eval(p.Request, vars, ctx)
+		if err != nil {
+			if p.FailOpen {
+				return req, nil
+			}
+			return req, NewResponse(req, ContentTypeText, http.StatusForbidden, "Request denied by policy\n")
+		}
+		if resp := p.decide(decision, req, ctx); resp != nil {
+			return req, resp
+		}
+	}
+	for name, e := range p.SetHeaders {
+		value, err := p.eval(e, vars, ctx)
+		switch {
+		case err != nil:
+		case value == "":
+			req.Header.Del(name)
+		default:
+			req.Header.Set(name, value)
+		}
+	}
+	return req, nil
+}
+
+func (p *ScriptPolicy) decide(decision string, req *http.Request, ctx *ProxyCtx) *http.Response {
+	verb, arg := decision, ""
+	if i := strings.IndexByte(decision, ':'); i >= 0 {
+		verb, arg = decision[:i], decision[i+1:]
+	}
+	switch verb {
+	case "", "allow":
+		return nil
+	case "deny":
+		status := http.StatusForbidden
+		if arg != "" {
+			if s, err := strconv.Atoi(arg); err == nil && s >= 100 && s <= 999 {
+				status = s
+			}
+		}
+		ctx.Logf("Request to %s denied by policy", req.URL)
+		return NewResponse(req, ContentTypeText, status, "Request denied by policy\n")
+	case "redirect":
+		ctx.Logf("Request to %s redirected to %s by policy", req.URL, arg)
+		resp := NewResponse(req, ContentTypeText, http.StatusFound, "")
+		resp.Header.Set("Location", arg)
+		return resp
+	}
+	ctx.Warnf("Unknown request decision %q of %q", decision, p.Request)
+	return nil
+}
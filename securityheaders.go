@@ -0,0 +1,115 @@
+package goproxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HSTSAction tells what SecurityHeaders do with the Strict-Transport-Security header.
+type HSTSAction int
+
+const (
+	// HSTSKeep leaves the header, its max-age capped to SecurityHeaders.HSTSMaxAge
+	HSTSKeep HSTSAction = iota
+	// HSTSNoSubdomains removes the includeSubDomains and preload directives, so that
+	// the other hosts of the domain may still be intercepted
+	HSTSNoSubdomains
+	// HSTSStrip removes the header
+	HSTSStrip
+	// HSTSClear replaces the header with max-age=0, making the browsers forget the
+	// HSTS state they remember for the host
+	HSTSClear
+)
+
+// SecurityHeaders is a response handler relaxing the security headers which get in the
+// way of interception: HSTS, which prevents clicking through certificate errors and
+// may cover a whole domain, Expect-CT, which rejects certificates missing from the CT
+// logs as the ones of the proxy, and the long deprecated HPKP. It is typically
+// registered for the hosts of a lab environment:
+//
+//	proxy.OnResponse(goproxy.ReqHostIs("app.lab.example.com:443")).Do(&goproxy.SecurityHeaders{
+//		HSTS:     goproxy.HSTSClear,
+//		ExpectCT: true,
+//		HPKP:     true,
+//	})
+//
+// The changed headers are logged.
+type SecurityHeaders struct {
+	HSTS HSTSAction
+	// HSTSMaxAge, if positive, caps the max-age of the HSTS headers kept
+	HSTSMaxAge time.Duration
+	// ExpectCT removes the Expect-CT header
+	ExpectCT bool
+	// HPKP removes the Public-Key-Pins and Public-Key-Pins-Report-Only headers
+	HPKP bool
+}
+
+// RelaxedSecurityHeaders removes all the security headers hindering interception.
+var RelaxedSecurityHeaders = &SecurityHeaders{HSTS: HSTSStrip, ExpectCT: true, HPKP: true}
+
+// rewriteHSTS returns the HSTS header value rewritten by s.
+func (s *SecurityHeaders) rewriteHSTS(value string) string {
+	var directives []string
+	for _, d := range strings.Split(value, ";") {
+		d = strings.TrimSpace(d)
+		name := strings.ToLower(d)
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name = strings.TrimSpace(name[:i])
+		}
+		switch {
+		case d == "":
+			continue
+		case s.HSTS == HSTSNoSubdomains && (name == "includesubdomains" || name == "preload"):
+			continue
+		case name == "max-age" && s.HSTSMaxAge > 0:
+			v := strings.Trim(strings.TrimSpace(d[strings.IndexByte(d, '=')+1:]), `"`)
+			maxAge := int64(s.HSTSMaxAge / time.Second)
+			if age, err := strconv.ParseInt(v, 10, 64); err == nil && age < maxAge {
+				maxAge = age
+			}
+			d = "max-age=" + strconv.FormatInt(maxAge, 10)
+		}
+		directives = append(directives, d)
+	}
+	return strings.Join(directives, "; ")
+}
+
+func (s *SecurityHeaders) Handle(resp *http.Response, ctx *ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	h := resp.Header
+	if hsts := h.Get("Strict-Transport-Security"); hsts != "" {
+		var rewritten string
+		switch s.HSTS {
+		case HSTSStrip:
+		case HSTSClear:
+			rewritten = "max-age=0"
+		default:
+			rewritten = s.rewriteHSTS(hsts)
+		}
+		if rewritten == "" {
+			ctx.Logf("Removing Strict-Transport-Security: %s", hsts)
+			h.Del("Strict-Transport-Security")
+		} else if rewritten != hsts {
+			ctx.Logf("Rewriting Strict-Transport-Security: %s to %s", hsts, rewritten)
+			h.Set("Strict-Transport-Security", rewritten)
+		}
+	}
+	var removed []string
+	if s.ExpectCT {
+		removed = append(removed, "Expect-CT")
+	}
+	if s.HPKP {
+		removed = append(removed, "Public-Key-Pins", "Public-Key-Pins-Report-Only")
+	}
+	for _, name := range removed {
+		if v := h.Get(name); v != "" {
+			ctx.Logf("Removing %s: %s", name, v)
+			h.Del(name)
+		}
+	}
+	return resp
+}
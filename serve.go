@@ -0,0 +1,177 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Serve serves the proxy on the connections accepted from l, e.g. a unix socket or a
+// listener inherited from systemd, until Shutdown is called or l fails. It returns
+// http.ErrServerClosed after Shutdown.
+func (proxy *ProxyHttpServer) Serve(l net.Listener) error {
+	srv := &http.Server{Handler: proxy}
+	if !proxy.conns.addServer(srv) {
+		l.Close()
+		return http.ErrServerClosed
+	}
+	defer proxy.conns.removeServer(srv)
+	if pl, ok := l.(*ProxyProtocolListener); ok {
+		pl.proxyClock.inherit(proxy)
+	}
+	return srv.Serve(l)
+}
+
+// ListenAndServe listens on addr, see Listen, and serves the proxy on it.
+func (proxy *ProxyHttpServer) ListenAndServe(addr string) error {
+	l, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return proxy.Serve(l)
+}
+
+// Listen listens on addr, a TCP "host:port" or the path of a unix socket prefixed with
+// "unix:". A stale unix socket left at the path is removed first.
+func Listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// The environment of systemd socket activation, see sd_listen_fds(3).
+const (
+	listenFdsStart = 3
+	envListenPid   = "LISTEN_PID"
+	envListenFds   = "LISTEN_FDS"
+	envListenNames = "LISTEN_FDNAMES"
+)
+
+// SystemdListener is a listening socket passed by systemd socket activation.
+type SystemdListener struct {
+	net.Listener
+	// Name is the FileDescriptorName of the socket unit, or "unknown"
+	Name string
+}
+
+// SystemdListeners returns the listening sockets passed to the process by systemd
+// socket activation, in the order of the socket unit, or none if the process was not
+// socket activated. The environment of socket activation is then cleared, so that it is
+// not inherited by child processes.
+func SystemdListeners() ([]SystemdListener, error) {
+	pid, err := strconv.Atoi(os.Getenv(envListenPid))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envListenFds))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", envListenFds, os.Getenv(envListenFds))
+	}
+	var names []string
+	if v := os.Getenv(envListenNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	os.Unsetenv(envListenPid)
+	os.Unsetenv(envListenFds)
+	os.Unsetenv(envListenNames)
+
+	listeners := make([]SystemdListener, 0, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %d (%s) of systemd: %v", listenFdsStart+i, name, err)
+		}
+		listeners = append(listeners, SystemdListener{Listener: l, Name: name})
+	}
+	return listeners, nil
+}
+
+// ErrNotSocketActivated is returned by ServeSystemd when the process was not started by
+// systemd socket activation.
+var ErrNotSocketActivated = errors.New("goproxy: not socket activated by systemd")
+
+// ServeSystemd serves the proxy on all the sockets passed by systemd socket activation,
+// until Shutdown is called or one of them fails.
+func (proxy *ProxyHttpServer) ServeSystemd() error {
+	listeners, err := SystemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return ErrNotSocketActivated
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- proxy.Serve(l)
+		}(l)
+	}
+	err = <-errs
+	if err != http.ErrServerClosed {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	return err
+}
+
+// addServer records a server started by Serve, to be shut down by Shutdown, unless the
+// proxy is already draining.
+func (t *connTracker) addServer(srv *http.Server) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.draining {
+		return false
+	}
+	if t.servers == nil {
+		t.servers = make(map[*http.Server]struct{})
+	}
+	t.servers[srv] = struct{}{}
+	return true
+}
+
+func (t *connTracker) removeServer(srv *http.Server) {
+	t.mu.Lock()
+	delete(t.servers, srv)
+	t.mu.Unlock()
+}
+
+// shutdownServers stops the servers started by Serve from accepting connections, and
+// closes their idle ones.
+func (t *connTracker) shutdownServers() {
+	t.mu.Lock()
+	servers := make([]*http.Server, 0, len(t.servers))
+	for srv := range t.servers {
+		servers = append(servers, srv)
+	}
+	t.mu.Unlock()
+	for _, srv := range servers {
+		// Shutdown waits for the active connections, which Shutdown of the proxy does
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		srv.Shutdown(ctx)
+	}
+}
@@ -0,0 +1,166 @@
+package goproxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// DefaultBodySpillThreshold is the size above which shared request bodies and
+// SpillBuffers are buffered in a temporary file, unless specified.
+const DefaultBodySpillThreshold = 1 << 20
+
+// sharedBody buffers a request body as it is read, so that each of its readers reads
+// it whole. The source is read lazily, as the readers need it.
+type sharedBody struct {
+	mu     sync.Mutex
+	src    io.ReadCloser
+	buf    *SpillBuffer
+	chunk  []byte
+	err    error
+	closed bool
+	// prev is the shared body src was made from by a handler, if any
+	prev *sharedBody
+}
+
+func newSharedBody(src io.ReadCloser, threshold int64, prev *sharedBody) *sharedBody {
+	return &sharedBody{src: src, buf: &SpillBuffer{Threshold: threshold}, prev: prev}
+}
+
+func (b *sharedBody) readAt(p []byte, off int64) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	for off >= b.buf.Len() && b.err == nil {
+		if b.chunk == nil {
+			b.chunk = make([]byte, 32<<10)
+		}
+		n, err := b.src.Read(b.chunk)
+		if _, werr := b.buf.Write(b.chunk[:n]); werr != nil {
+			err = werr
+		}
+		b.err = err
+	}
+	if off < b.buf.Len() {
+		n, err := b.buf.ReadAt(p, off)
+		if err == io.EOF {
+			// the rest is yet to be read from src
+			err = nil
+		}
+		return n, err
+	}
+	return 0, b.err
+}
+
+func (b *sharedBody) close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.buf.Close()
+	err := b.src.Close()
+	if b.prev != nil {
+		b.prev.close()
+	}
+	return err
+}
+
+// reader returns a reader of the whole body. Closing the final reader releases the
+// shared body, closing the others does nothing.
+func (b *sharedBody) reader(final bool) *sharedBodyReader {
+	return &sharedBodyReader{body: b, final: final}
+}
+
+type sharedBodyReader struct {
+	body  *sharedBody
+	off   int64
+	final bool
+}
+
+func (r *sharedBodyReader) Read(p []byte) (int, error) {
+	n, err := r.body.readAt(p, r.off)
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *sharedBodyReader) Close() error {
+	if r.final {
+		return r.body.close()
+	}
+	return nil
+}
+
+// requestBodies gives every request handler a reader of the whole request body, see
+// ProxyHttpServer.ShareRequestBody.
+type requestBodies struct {
+	threshold int64
+	body      *sharedBody
+	current   *sharedBodyReader
+}
+
+func (proxy *ProxyHttpServer) shareRequestBody(r *http.Request) *requestBodies {
+	if !proxy.ShareRequestBody || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	threshold := proxy.BodySpillThreshold
+	if threshold <= 0 {
+		threshold = DefaultBodySpillThreshold
+	}
+	b := &requestBodies{threshold: threshold, body: newSharedBody(r.Body, threshold, nil)}
+	b.current = b.body.reader(false)
+	r.Body = b.current
+	return b
+}
+
+// next prepares the body of r for the next handler: a body read by the previous one is
+// read again from the start, and a body it replaced is shared in turn.
+func (b *requestBodies) next(r *http.Request) {
+	if b == nil {
+		return
+	}
+	switch {
+	case r.Body == b.current:
+		if b.current.off == 0 {
+			return
+		}
+	case r.Body == nil || r.Body == http.NoBody:
+		b.body.close()
+		b.body, b.current = nil, nil
+		return
+	default:
+		b.body = newSharedBody(r.Body, b.threshold, b.body)
+	}
+	b.current = b.body.reader(false)
+	r.Body = b.current
+}
+
+// done gives the body to the request sent upstream, once the handlers ran, or releases
+// it when none is sent.
+func (b *requestBodies) done(r, req *http.Request, resp *http.Response) {
+	if b == nil {
+		return
+	}
+	if resp == nil && req != nil && req != r && req.Body != r.Body {
+		// a new request with a body of its own, which may still read the shared one
+		if b.body != nil && req.Body != nil {
+			shared := b.body
+			req.Body = &releasingBody{ReadCloser: req.Body, release: func() { shared.close() }}
+		}
+		return
+	}
+	b.next(r)
+	if b.body == nil {
+		return
+	}
+	if resp != nil || req == nil {
+		b.body.close()
+		return
+	}
+	r.Body = b.body.reader(true)
+	req.Body = r.Body
+}
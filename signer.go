@@ -9,12 +9,15 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/big"
 	"math/rand"
 	"net"
 	"runtime"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -40,6 +43,23 @@ func hashSortedBigInt(lst []string) *big.Int {
 var goproxySignerVersion = ":goroxy1"
 
 func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err error) {
+	return signHostWith(ca, hosts, signOptions{})
+}
+
+// signOptions customizes the certificates forged by signHostWith
+type signOptions struct {
+	// extensions are added to the certificate, see ProxyHttpServer.CertExtensions
+	extensions []pkix.Extension
+	// deterministic certificates depend only on the CA and the hosts, see
+	// ProxyHttpServer.DeterministicCerts
+	deterministic bool
+	// now is the time the certificate is forged at, and serial the source of its
+	// serial number, see ProxyHttpServer.Clock and Rand
+	now    time.Time
+	serial io.Reader
+}
+
+func signHostWith(ca tls.Certificate, hosts []string, opts signOptions) (cert *tls.Certificate, err error) {
 	var x509ca *x509.Certificate
 
 	// Use the provided ca and not the global GoproxyCa for certificate generation.
@@ -47,10 +67,21 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		return
 	}
 
-	start := time.Unix(time.Now().Unix()-2592000, 0) // 2592000  = 30 day
-	end := time.Unix(time.Now().Unix()+31536000, 0)  // 31536000 = 365 day
+	now := opts.now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	start := time.Unix(now.Unix()-2592000, 0) // 2592000  = 30 day
+	end := time.Unix(now.Unix()+31536000, 0)  // 31536000 = 365 day
 
 	serial := big.NewInt(rand.Int63())
+	if opts.serial != nil {
+		var b [8]byte
+		if _, err = io.ReadFull(opts.serial, b[:]); err != nil {
+			return
+		}
+		serial = new(big.Int).SetUint64(binary.BigEndian.Uint64(b[:]) >> 1)
+	}
 	template := x509.Certificate{
 		// TODO(elazar): instead of this ugly hack, just encode the certificate and hash the binary form.
 		SerialNumber: serial,
@@ -64,23 +95,43 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
+		ExtraExtensions:       opts.extensions,
 	}
 	for _, h := range hosts {
-		if ip := net.ParseIP(h); ip != nil {
+		// clients reject IP addresses in DNS names, they need IP SANs
+		if ip := certIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
+			if template.Subject.CommonName == "" {
+				template.Subject.CommonName = ip.String()
+			}
 		} else {
 			template.DNSNames = append(template.DNSNames, h)
 			template.Subject.CommonName = h
 		}
 	}
 
+	var certpriv crypto.Signer
+	if opts.deterministic {
+		var caSigner crypto.Signer
+		if certpriv, caSigner, err = deterministicCert(ca, hosts, &template, now); err != nil {
+			return
+		}
+		var derBytes []byte
+		if derBytes, err = x509.CreateCertificate(nil, &template, x509ca, certpriv.Public(), caSigner); err != nil {
+			return
+		}
+		return &tls.Certificate{
+			Certificate: [][]byte{derBytes, ca.Certificate[0]},
+			PrivateKey:  certpriv,
+		}, nil
+	}
+
 	hash := hashSorted(append(hosts, goproxySignerVersion, ":"+runtime.Version()))
 	var csprng CounterEncryptorRand
 	if csprng, err = NewCounterEncryptorRandFromKey(ca.PrivateKey, hash); err != nil {
 		return
 	}
 
-	var certpriv crypto.Signer
 	switch ca.PrivateKey.(type) {
 	case *rsa.PrivateKey:
 		if certpriv, err = rsa.GenerateKey(&csprng, 2048); err != nil {
@@ -105,6 +156,20 @@ func signHost(ca tls.Certificate, hosts []string) (cert *tls.Certificate, err er
 	}, nil
 }
 
+// certIP returns the IP address of host, which may be a bracketed IPv6 address with a
+// zone, or nil for a host name.
+func certIP(host string) net.IP {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 func init() {
 	// Avoid deterministic random numbers
 	rand.Seed(time.Now().UnixNano())
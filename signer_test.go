@@ -1,14 +1,17 @@
 package goproxy
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -102,6 +105,22 @@ func TestSignerEcdsaX509(t *testing.T) {
 	testSignerX509(t, EcdsaCa)
 }
 
+func TestSignerIPAddresses(t *testing.T) {
+	cert, err := signHost(GoproxyCa, []string{"10.0.0.1", "[2001:db8::1]", "fe80::1%eth0"})
+	orFatal("signHost", err, t)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	orFatal("ParseCertificate", err, t)
+	if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 3 {
+		t.Fatalf("Expected IP SANs only, got DNS %v IP %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	for _, host := range []string{"10.0.0.1", "2001:db8::1", "fe80::1"} {
+		orFatal("VerifyHostname "+host, leaf.VerifyHostname(host), t)
+	}
+	if leaf.Subject.CommonName != "10.0.0.1" {
+		t.Errorf("Expected the first IP address as common name, got %q", leaf.Subject.CommonName)
+	}
+}
+
 var c *tls.Certificate
 var e error
 
@@ -163,3 +182,73 @@ func init() {
 		panic("Error parsing ecdsa CA " + err.Error())
 	}
 }
+
+func TestSignerDeterministic(t *testing.T) {
+	for _, ca := range []tls.Certificate{GoproxyCa, EcdsaCa} {
+		sign := func(hosts ...string) *x509.Certificate {
+			cert, err := signHostWith(ca, hosts, signOptions{deterministic: true})
+			orFatal("signHostWith", err, t)
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			orFatal("ParseCertificate", err, t)
+			return leaf
+		}
+		first, second := sign("example.com", "10.0.0.1"), sign("10.0.0.1", "example.com")
+		if !bytes.Equal(first.Raw, second.Raw) {
+			t.Errorf("Expected identical certificates, got serials %v and %v", first.SerialNumber, second.SerialNumber)
+		}
+		ca.Leaf, _ = x509.ParseCertificate(ca.Certificate[0])
+		orFatal("CheckSignatureFrom", first.CheckSignatureFrom(ca.Leaf), t)
+		other := sign("example.org")
+		if other.SerialNumber.Cmp(first.SerialNumber) == 0 || bytes.Equal(other.RawSubjectPublicKeyInfo, first.RawSubjectPublicKeyInfo) {
+			t.Errorf("Expected another serial and key for another host")
+		}
+		if now := time.Now(); now.Before(first.NotBefore) || now.After(first.NotAfter) {
+			t.Errorf("Expected a currently valid certificate, got %v to %v", first.NotBefore, first.NotAfter)
+		}
+	}
+}
+
+func TestTLSWorkers(t *testing.T) {
+	workers := &TLSWorkers{Signers: 2}
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	gen := func() (*tls.Certificate, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		cert, err := signHost(GoproxyCa, []string{"example.com"})
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return cert, err
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := workers.sign(SystemClock, gen); err != nil {
+				t.Error("sign", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 certificates signed at once, got %d", maxRunning)
+	}
+
+	// a client which never speaks holds the only handshake slot
+	workers = &TLSWorkers{Handshakes: 1, QueueTimeout: 50 * time.Millisecond}
+	config := &tls.Config{Certificates: []tls.Certificate{GoproxyCa}}
+	idle, peer := net.Pipe()
+	defer peer.Close()
+	go workers.handshake(SystemClock, tls.Server(idle, config))
+	time.Sleep(20 * time.Millisecond)
+	conn, _ := net.Pipe()
+	if err := workers.handshake(SystemClock, tls.Server(conn, config)); err != ErrTLSBusy {
+		t.Errorf("Expected the handshake to wait for a slot and fail with ErrTLSBusy, got %v", err)
+	}
+}
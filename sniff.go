@@ -0,0 +1,87 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes considered by http.DetectContentType
+const sniffLen = 512
+
+// sniffed is the content type of a body, once peeked
+type sniffed struct {
+	body        io.ReadCloser
+	contentType string
+}
+
+const sniffedKey = "goproxy.sniffed"
+
+// SniffContentType returns the content type of the body of resp detected from its
+// first bytes with http.DetectContentType, which is more reliable than the
+// Content-Type header of many servers. The bytes read are put back in front of the
+// body, and the result is kept for the following calls on the same response.
+//
+// Since it waits for the first 512 bytes of the body, the Content-Type header is
+// returned instead for server-sent events, as well as for bodies which are empty or
+// still compressed.
+func SniffContentType(resp *http.Response, ctx *ProxyCtx) string {
+	if v, ok := ctx.ReqData.Get(sniffedKey); ok {
+		if s := v.(*sniffed); s.body == resp.Body {
+			return s.contentType
+		}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if resp.Body == nil || resp.Body == http.NoBody || resp.StatusCode < 200 ||
+		strings.HasPrefix(contentType, "text/event-stream") ||
+		(resp.Header.Get("Content-Encoding") != "" && resp.Header.Get("Content-Encoding") != "identity") {
+		return contentType
+	}
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(resp.Body, buf)
+	if n > 0 {
+		contentType = http.DetectContentType(buf[:n])
+	}
+	resp.Body = &peekedBody{io.MultiReader(bytes.NewReader(buf[:n]), &errReader{resp.Body, err}), resp.Body}
+	ctx.ReqData.Set(sniffedKey, &sniffed{resp.Body, contentType})
+	return contentType
+}
+
+type peekedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// errReader reads r, unless reading its first bytes failed with err
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *errReader) Read(p []byte) (int, error) {
+	if r.err != nil && r.err != io.EOF && r.err != io.ErrUnexpectedEOF {
+		return 0, r.err
+	}
+	return r.r.Read(p)
+}
+
+// SniffedContentTypeIs returns a RespCondition testing whether the content type of the
+// response, as sniffed by SniffContentType, starts with one of the given prefixes,
+// e.g. "image/" or "text/html":
+//
+//	proxy.OnResponse(goproxy.SniffedContentTypeIs("image/")).Do(imageHandler)
+func SniffedContentTypeIs(prefixes ...string) RespCondition {
+	return RespConditionFunc(func(resp *http.Response, ctx *ProxyCtx) bool {
+		if resp == nil {
+			return false
+		}
+		contentType := SniffContentType(resp, ctx)
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(contentType, prefix) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,182 @@
+package goproxy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrSpillBufferFull is returned by the writes exceeding SpillBuffer.MaxSize.
+var ErrSpillBufferFull = errors.New("goproxy: spill buffer full")
+
+// SpillBuffer buffers data in memory up to Threshold bytes, and in a temporary file
+// above, for the handlers which must read a body whole, e.g. to scan it, without
+// holding large downloads in memory:
+//
+//	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+//		buf := &goproxy.SpillBuffer{MaxSize: 4 << 30}
+//		_, err := io.Copy(buf, resp.Body)
+//		resp.Body.Close()
+//		if err != nil {
+//			buf.Close()
+//			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway, err.Error())
+//		}
+//		if infected(buf.Reader()) {
+//			buf.Close()
+//			return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusForbidden, "Infected")
+//		}
+//		resp.Body = buf.Body()
+//		return resp
+//	})
+//
+// The temporary file is removed by Close, or as soon as it is created on the systems
+// allowing it, so that it does not outlive the process. A SpillBuffer is safe for
+// concurrent use, and must not be copied after first use.
+type SpillBuffer struct {
+	// Threshold is the size above which the data are written to a temporary file,
+	// DefaultBodySpillThreshold if zero
+	Threshold int64
+	// MaxSize, if positive, is the size of the largest data buffered, the writes
+	// beyond failing with ErrSpillBufferFull
+	MaxSize int64
+	// Dir is the directory of the temporary file, the default one of the system if
+	// empty
+	Dir string
+
+	mu      sync.RWMutex
+	mem     []byte
+	file    *os.File
+	removed bool
+	size    int64
+	closed  bool
+}
+
+// Len returns the number of bytes buffered.
+func (b *SpillBuffer) Len() int64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.size
+}
+
+// Spilled tells whether the data were written to a temporary file.
+func (b *SpillBuffer) Spilled() bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.file != nil
+}
+
+func (b *SpillBuffer) spill() error {
+	f, err := os.CreateTemp(b.Dir, "goproxy-spill-")
+	if err != nil {
+		return err
+	}
+	// unlinked at once where open files can be, closing the file is enough then
+	b.removed = os.Remove(f.Name()) == nil
+	if _, err := f.Write(b.mem); err != nil {
+		b.closeFile(f)
+		return err
+	}
+	b.file, b.mem = f, nil
+	return nil
+}
+
+func (b *SpillBuffer) closeFile(f *os.File) error {
+	err := f.Close()
+	if !b.removed {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Write appends p to the buffer.
+func (b *SpillBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	var err error
+	if b.MaxSize > 0 && b.size+int64(len(p)) > b.MaxSize {
+		p, err = p[:b.MaxSize-b.size], ErrSpillBufferFull
+	}
+	threshold := b.Threshold
+	if threshold <= 0 {
+		threshold = DefaultBodySpillThreshold
+	}
+	if b.file == nil && b.size+int64(len(p)) > threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	n := len(p)
+	if b.file == nil {
+		b.mem = append(b.mem, p...)
+	} else {
+		var werr error
+		if n, werr = b.file.WriteAt(p, b.size); werr != nil {
+			err = werr
+		}
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// ReadAt reads the buffered data at off.
+func (b *SpillBuffer) ReadAt(p []byte, off int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	if off >= b.size {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > b.size-off {
+		p, err = p[:b.size-off], io.EOF
+	}
+	if b.file == nil {
+		return copy(p, b.mem[off:]), err
+	}
+	n, ferr := b.file.ReadAt(p, off)
+	if ferr != nil {
+		err = ferr
+	}
+	return n, err
+}
+
+// Reader returns a reader of the data buffered so far.
+func (b *SpillBuffer) Reader() *io.SectionReader {
+	return io.NewSectionReader(b, 0, b.Len())
+}
+
+// Body returns a reader of the data buffered so far, closing the buffer when closed,
+// to replace the body of a request or response.
+func (b *SpillBuffer) Body() io.ReadCloser {
+	return spillBody{b.Reader(), b}
+}
+
+type spillBody struct {
+	*io.SectionReader
+	buf *SpillBuffer
+}
+
+func (b spillBody) Close() error {
+	return b.buf.Close()
+}
+
+// Close releases the memory and removes the temporary file.
+func (b *SpillBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.mem = nil
+	if b.file == nil {
+		return nil
+	}
+	return b.closeFile(b.file)
+}
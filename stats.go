@@ -0,0 +1,76 @@
+package goproxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ProxyStats are the counters of a proxy, see ProxyHttpServer.Stats.
+type ProxyStats struct {
+	// Requests is the number of requests received, MITM'd ones included, and Tunnels
+	// the number of CONNECT requests. Together they are the number of sessions.
+	Requests int64
+	Tunnels  int64
+	// ContextsReused is the number of request contexts taken from the pool, see
+	// ProxyHttpServer.PoolContexts
+	ContextsReused int64
+}
+
+// proxyStats holds the counters of a proxy, updated atomically. It must stay the first
+// field of ProxyHttpServer so that its counters are aligned on 32 bits platforms, see
+// the bugs section of sync/atomic.
+type proxyStats struct {
+	sessions       int64
+	requests       int64
+	tunnels        int64
+	contextsReused int64
+}
+
+// newSession returns the Session of a new request or tunnel context.
+func (s *proxyStats) newSession(tunnel bool) int64 {
+	if tunnel {
+		atomic.AddInt64(&s.tunnels, 1)
+	} else {
+		atomic.AddInt64(&s.requests, 1)
+	}
+	return atomic.AddInt64(&s.sessions, 1)
+}
+
+// Stats returns the counters of the proxy.
+func (proxy *ProxyHttpServer) Stats() ProxyStats {
+	return ProxyStats{
+		Requests:       atomic.LoadInt64(&proxy.stats.requests),
+		Tunnels:        atomic.LoadInt64(&proxy.stats.tunnels),
+		ContextsReused: atomic.LoadInt64(&proxy.stats.contextsReused),
+	}
+}
+
+// ctxPool holds the request contexts released by the proxies with PoolContexts.
+var ctxPool sync.Pool
+
+// newCtx returns the context of a new request, initialized from c, reusing a
+// released context if PoolContexts is set.
+func (proxy *ProxyHttpServer) newCtx(c ProxyCtx) *ProxyCtx {
+	c.Session = proxy.stats.newSession(false)
+	if proxy.PoolContexts {
+		if ctx, ok := ctxPool.Get().(*ProxyCtx); ok {
+			atomic.AddInt64(&proxy.stats.contextsReused, 1)
+			*ctx = c
+			return ctx
+		}
+	}
+	ctx := new(ProxyCtx)
+	*ctx = c
+	return ctx
+}
+
+// releaseCtx returns ctx to the pool once its exchange is over, if PoolContexts is set.
+// The contexts kept by handlers, and those of the exchanges whose handlers timed out,
+// are not reused, as they may still be in use.
+func (proxy *ProxyHttpServer) releaseCtx(ctx *ProxyCtx) {
+	if !proxy.PoolContexts || ctx.hijacked() || ctx.abandoned || ctx.kept {
+		return
+	}
+	*ctx = ProxyCtx{}
+	ctxPool.Put(ctx)
+}
@@ -0,0 +1,70 @@
+package goproxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+)
+
+// DefaultSessionTicketKeysKept is the number of keys kept by SessionTicketKeys.Rotate,
+// tickets encrypted with older keys are no longer accepted.
+const DefaultSessionTicketKeysKept = 3
+
+// SessionTicketKeys holds the keys used to encrypt TLS session tickets issued by
+// the MITM TLS server, so that returning clients can resume their sessions instead
+// of doing full handshakes. Proxy instances behind a load balancer can share tickets
+// by setting the same keys with Set.
+type SessionTicketKeys struct {
+	mu   sync.RWMutex
+	keys [][32]byte
+}
+
+// NewSessionTicketKeys returns a SessionTicketKeys holding a single random key.
+func NewSessionTicketKeys() (*SessionTicketKeys, error) {
+	k := &SessionTicketKeys{}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate generates a new random key used for issuing tickets from now on. Tickets
+// issued with the previous DefaultSessionTicketKeysKept-1 keys are still accepted.
+func (k *SessionTicketKeys) Rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([][32]byte{key}, k.keys...)
+	if len(k.keys) > DefaultSessionTicketKeysKept {
+		k.keys = k.keys[:DefaultSessionTicketKeysKept]
+	}
+	return nil
+}
+
+// Set replaces the keys. The first key is used to issue new tickets, all of them
+// are accepted for resumption.
+func (k *SessionTicketKeys) Set(keys [][32]byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([][32]byte(nil), keys...)
+}
+
+// Keys returns a copy of the current keys, the first one being the active key.
+func (k *SessionTicketKeys) Keys() [][32]byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([][32]byte(nil), k.keys...)
+}
+
+// apply configures config to use the current keys.
+func (k *SessionTicketKeys) apply(config *tls.Config) {
+	keys := k.Keys()
+	if len(keys) == 0 {
+		return
+	}
+	config.SessionTicketsDisabled = false
+	config.SetSessionTicketKeys(keys)
+}
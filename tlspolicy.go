@@ -0,0 +1,75 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TLSPolicy restricts the TLS versions and cipher suites used on one side of the
+// proxy. Zero values leave the crypto/tls defaults in place.
+type TLSPolicy struct {
+	// MinVersion is the minimal accepted TLS version, e.g. tls.VersionTLS12
+	MinVersion uint16
+	// CipherSuites lists the allowed TLS 1.0-1.2 cipher suites, TLS 1.3 suites
+	// are not configurable.
+	CipherSuites []uint16
+	// Hosts overrides the policy for the given host names (without port)
+	Hosts map[string]*TLSPolicy
+}
+
+// ForHost returns the policy applying to host, nil if p is nil.
+func (p *TLSPolicy) ForHost(host string) *TLSPolicy {
+	if p == nil {
+		return nil
+	}
+	if hp, ok := p.Hosts[hostWithoutPort(host)]; ok {
+		return hp
+	}
+	return p
+}
+
+// Apply sets the policy on config.
+func (p *TLSPolicy) Apply(config *tls.Config) {
+	if p.MinVersion != 0 {
+		config.MinVersion = p.MinVersion
+	}
+	if p.CipherSuites != nil {
+		config.CipherSuites = p.CipherSuites
+	}
+}
+
+// CheckTLSState returns an error describing why the TLS connection described by
+// state is weak: a protocol older than TLS 1.2, an insecure cipher suite or a peer
+// certificate not valid at now. It returns nil for strong connections.
+func CheckTLSState(state *tls.ConnectionState, now time.Time) error {
+	if state.Version < tls.VersionTLS12 {
+		return fmt.Errorf("deprecated protocol %s", TLSVersionName(state.Version))
+	}
+	for _, c := range tls.InsecureCipherSuites() {
+		if c.ID == state.CipherSuite {
+			return fmt.Errorf("insecure cipher suite %s", c.Name)
+		}
+	}
+	for _, cert := range state.PeerCertificates {
+		if now.After(cert.NotAfter) || now.Before(cert.NotBefore) {
+			return fmt.Errorf("certificate %q is not valid at %v", cert.Subject.CommonName, now.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// UpstreamTLSIsWeak is a RespCondition matching responses received from upstream
+// over a weak TLS connection, as defined by CheckTLSState at the time of the Clock of
+// the proxy. It can be used to reject
+// such responses or to substitute a warning page:
+//
+//	proxy.OnResponse(goproxy.UpstreamTLSIsWeak).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+//		resp.Body.Close()
+//		return goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, http.StatusBadGateway,
+//			"upstream TLS is weak: "+goproxy.CheckTLSState(ctx.UpstreamTLSState, time.Now()).Error())
+//	})
+var UpstreamTLSIsWeak RespConditionFunc = func(resp *http.Response, ctx *ProxyCtx) bool {
+	return ctx.UpstreamTLSState != nil && CheckTLSState(ctx.UpstreamTLSState, ctx.Proxy.clock().Now()) != nil
+}
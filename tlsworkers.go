@@ -0,0 +1,109 @@
+package goproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrTLSBusy is returned when a certificate or a handshake waited for a TLSWorkers slot
+// longer than its QueueTimeout.
+var ErrTLSBusy = errors.New("goproxy: too many concurrent TLS handshakes")
+
+// TLSWorkers bounds the CPU spent on the TLS side of MITM'd tunnels, so that a burst of
+// new tunnels queues instead of slowing down every connection of the proxy:
+//
+//	proxy.TLSWorkers = &goproxy.TLSWorkers{Handshakes: 64, QueueTimeout: 10 * time.Second}
+//
+// The certificates forged for the MITM'd hosts are signed by a fixed pool of Signers
+// goroutines, and the handshakes with the MITM'd clients are limited to Handshakes at
+// once. Certificates found in the CertStore are not signed again, and cost nothing.
+type TLSWorkers struct {
+	// Signers is the number of goroutines signing certificates, runtime.GOMAXPROCS
+	// if zero. They are started on first use and never stopped.
+	Signers int
+	// Handshakes is the number of concurrent handshakes with MITM'd clients,
+	// unlimited if zero
+	Handshakes int
+	// QueueTimeout, if set, is how long a certificate or a handshake waits for a
+	// worker before failing with ErrTLSBusy, closing the tunnel
+	QueueTimeout time.Duration
+
+	once       sync.Once
+	jobs       chan func()
+	handshakes chan struct{}
+}
+
+func (w *TLSWorkers) start() {
+	w.once.Do(func() {
+		n := w.Signers
+		if n <= 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		w.jobs = make(chan func())
+		for i := 0; i < n; i++ {
+			go func() {
+				for job := range w.jobs {
+					job()
+				}
+			}()
+		}
+		if w.Handshakes > 0 {
+			w.handshakes = make(chan struct{}, w.Handshakes)
+		}
+	})
+}
+
+// queueDeadline returns the channel receiving once QueueTimeout elapsed on clock, nil
+// if it is unset, and the function releasing its timer.
+func (w *TLSWorkers) queueDeadline(clock Clock) (<-chan time.Time, func() bool) {
+	if w.QueueTimeout <= 0 {
+		return nil, func() bool { return false }
+	}
+	return clock.NewTimer(w.QueueTimeout)
+}
+
+// sign returns the certificate generated by gen on one of the signers, the queue
+// timeout elapsing on clock.
+func (w *TLSWorkers) sign(clock Clock, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	if w == nil {
+		return gen()
+	}
+	w.start()
+	var cert *tls.Certificate
+	var err error
+	done := make(chan struct{})
+	job := func() {
+		cert, err = gen()
+		close(done)
+	}
+	deadline, stop := w.queueDeadline(clock)
+	defer stop()
+	select {
+	case w.jobs <- job:
+	case <-deadline:
+		return nil, ErrTLSBusy
+	}
+	<-done
+	return cert, err
+}
+
+// handshake runs the server handshake of conn once a handshake slot is free, the
+// queue timeout elapsing on clock.
+func (w *TLSWorkers) handshake(clock Clock, conn *tls.Conn) error {
+	if w == nil || w.Handshakes <= 0 {
+		return conn.Handshake()
+	}
+	w.start()
+	deadline, stop := w.queueDeadline(clock)
+	select {
+	case w.handshakes <- struct{}{}:
+		stop()
+	case <-deadline:
+		return ErrTLSBusy
+	}
+	defer func() { <-w.handshakes }()
+	return conn.Handshake()
+}
@@ -0,0 +1,148 @@
+package goproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"net/http"
+	"sync"
+)
+
+// maxTransports bounds the number of transports derived from ProxyHttpServer.Tr, so
+// that hooks returning a different certificate or policy for every request cannot
+// make the proxy grow without limit.
+const maxTransports = 256
+
+// transportCache holds transports derived from ProxyHttpServer.Tr, such as clones
+// presenting a client certificate, so that their connections are still pooled. Once
+// it holds maxTransports, an arbitrary one is evicted and its idle connections closed.
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[interface{}]*http.Transport
+}
+
+func (c *transportCache) get(key interface{}, build func() *http.Transport) *http.Transport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if t, ok := c.transports[key]; ok {
+		return t
+	}
+	t := build()
+	if c.transports == nil {
+		c.transports = make(map[interface{}]*http.Transport)
+	}
+	if len(c.transports) >= maxTransports {
+		for k, evicted := range c.transports {
+			delete(c.transports, k)
+			evicted.CloseIdleConnections()
+			break
+		}
+	}
+	c.transports[key] = t
+	return t
+}
+
+// flush forgets the cached transports, closing their idle connections.
+func (c *transportCache) flush() {
+	c.mu.Lock()
+	transports := c.transports
+	c.transports = nil
+	c.mu.Unlock()
+	for _, t := range transports {
+		t.CloseIdleConnections()
+	}
+}
+
+type clientCertKey struct {
+	base *http.Transport
+	host string
+	leaf [sha256.Size]byte
+}
+
+func newClientCertKey(base *http.Transport, host string, cert *tls.Certificate) clientCertKey {
+	key := clientCertKey{base: base, host: host}
+	if len(cert.Certificate) > 0 {
+		key.leaf = sha256.Sum256(cert.Certificate[0])
+	}
+	return key
+}
+
+type tlsPolicyKey struct {
+	base   *http.Transport
+	policy *TLSPolicy
+}
+
+type http2Key struct {
+	base *http.Transport
+}
+
+type handshakeKey struct {
+	base *http.Transport
+}
+
+// cloneTLSClientConfig clones tr, making sure the clone has its own TLSClientConfig.
+func cloneTLSClientConfig(tr *http.Transport) *http.Transport {
+	t := tr.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	return t
+}
+
+// upstreamTransport returns the transport to be used for req, taking the
+// HostOverrides, UpstreamClientCert, UpstreamTLSPolicy, UpstreamFingerprint and
+// UpstreamTLSHandshake settings into account, and attempting HTTP/2 for the requests
+// of MITM'd HTTP/2 clients.
+func (proxy *ProxyHttpServer) upstreamTransport(req *http.Request, ctx *ProxyCtx) (*http.Transport, error) {
+	tr := proxy.Transport()
+	if proxy.HostOverrides != nil {
+		tr = proxy.HostOverrides.transport(&proxy.transports, tr)
+	}
+	if req.URL.Scheme != "https" {
+		return tr, nil
+	}
+	host := req.URL.Hostname()
+	if proxy.UpstreamClientCert != nil {
+		cert, err := proxy.UpstreamClientCert(host, ctx)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			base := tr
+			tr = proxy.transports.get(newClientCertKey(base, host, cert), func() *http.Transport {
+				t := cloneTLSClientConfig(base)
+				t.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+				return t
+			})
+		}
+	}
+	if policy := proxy.UpstreamTLSPolicy.ForHost(host); policy != nil {
+		base := tr
+		tr = proxy.transports.get(tlsPolicyKey{base, policy}, func() *http.Transport {
+			t := cloneTLSClientConfig(base)
+			policy.Apply(t.TLSClientConfig)
+			return t
+		})
+	}
+	if ctx != nil && ctx.http2 {
+		base := tr
+		tr = proxy.transports.get(http2Key{base}, func() *http.Transport {
+			t := base.Clone()
+			t.ForceAttemptHTTP2 = true
+			return t
+		})
+	}
+	if proxy.UpstreamFingerprint != nil {
+		if fp := proxy.UpstreamFingerprint(host, ctx); fp != nil {
+			return proxy.fingerprintTransport(tr, fp), nil
+		}
+	}
+	if proxy.UpstreamTLSHandshake != nil {
+		base := tr
+		tr = proxy.transports.get(handshakeKey{base}, func() *http.Transport {
+			t := base.Clone()
+			t.DialTLSContext = proxy.dialUpstreamTLS(base)
+			return t
+		})
+	}
+	return tr, nil
+}
@@ -0,0 +1,262 @@
+//go:build linux && goproxy_epoll
+// +build linux,goproxy_epoll
+
+package goproxy
+
+import (
+	"errors"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// epollBufferSize is the size of the read buffer of an epoll worker
+const epollBufferSize = 32 * 1024
+
+// epollWorker forwards the data of many tunnels, watching their sockets with its own
+// epoll instance from a single goroutine.
+type epollWorker struct {
+	epfd int
+	buf  []byte
+
+	mu    sync.Mutex
+	sides map[int32]*epollSide
+}
+
+// epollSide is a socket of a tunnel, forwarding what it reads to peer.
+type epollSide struct {
+	tunnel *epollTunnel
+	conn   *net.TCPConn
+	fd     int
+	peer   *epollSide
+	// eof is set once the socket was read to its end
+	eof bool
+	// pending is the data read from peer which could not be written to the socket yet
+	pending []byte
+}
+
+// epollTunnel is a CONNECT tunnel forwarded by an epollWorker instead of a pair of
+// goroutines.
+type epollTunnel struct {
+	worker         *epollWorker
+	client, target epollSide
+	done           func()
+	closed         bool
+}
+
+var (
+	epollWorkersOnce sync.Once
+	epollWorkers     []*epollWorker
+	epollWorkersErr  error
+	epollNext        uint32
+)
+
+func startEpollWorkers() {
+	n := runtime.GOMAXPROCS(0)
+	for i := 0; i < n; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			epollWorkersErr = err
+			return
+		}
+		w := &epollWorker{epfd: epfd, buf: make([]byte, epollBufferSize), sides: make(map[int32]*epollSide)}
+		epollWorkers = append(epollWorkers, w)
+		go w.run()
+	}
+}
+
+func rawFD(conn *net.TCPConn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if err := rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// newEpollTunnel returns a tunnel forwarding the data between client and target, or
+// nil if they are not both plain TCP connections, e.g. when they are wrapped to count
+// their bytes. The tunnel must then be started.
+func newEpollTunnel(client, target net.Conn) *epollTunnel {
+	clientTCP, ok := client.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	targetTCP, ok := target.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	epollWorkersOnce.Do(startEpollWorkers)
+	if epollWorkersErr != nil || len(epollWorkers) == 0 {
+		return nil
+	}
+	clientFD, err := rawFD(clientTCP)
+	if err != nil {
+		return nil
+	}
+	targetFD, err := rawFD(targetTCP)
+	if err != nil {
+		return nil
+	}
+	t := &epollTunnel{worker: epollWorkers[atomic.AddUint32(&epollNext, 1)%uint32(len(epollWorkers))]}
+	t.client = epollSide{tunnel: t, conn: clientTCP, fd: clientFD, peer: &t.target}
+	t.target = epollSide{tunnel: t, conn: targetTCP, fd: targetFD, peer: &t.client}
+	return t
+}
+
+// start registers the sockets of the tunnel with its worker. done is called once the
+// tunnel is closed.
+func (t *epollTunnel) start(done func()) {
+	w := t.worker
+	w.mu.Lock()
+	t.done = done
+	if t.closed {
+		// closed by CloseConn or Shutdown before it started
+		w.mu.Unlock()
+		done()
+		return
+	}
+	for _, s := range []*epollSide{&t.client, &t.target} {
+		w.sides[int32(s.fd)] = s
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(s.fd)}
+		if err := syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, s.fd, &ev); err != nil {
+			done = t.closeLocked()
+			w.mu.Unlock()
+			done()
+			return
+		}
+	}
+	w.mu.Unlock()
+}
+
+// Close closes both connections of the tunnel.
+func (t *epollTunnel) Close() error {
+	t.worker.mu.Lock()
+	done := t.closeLocked()
+	t.worker.mu.Unlock()
+	if done != nil {
+		done()
+	}
+	return nil
+}
+
+// closeLocked closes the tunnel, and returns its done function if it was open.
+func (t *epollTunnel) closeLocked() func() {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	w := t.worker
+	for _, s := range []*epollSide{&t.client, &t.target} {
+		if w.sides[int32(s.fd)] == s {
+			delete(w.sides, int32(s.fd))
+			syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_DEL, s.fd, nil)
+		}
+		s.conn.Close()
+	}
+	return t.done
+}
+
+// watch updates the events the worker waits for on the socket of s: readable while its
+// data can be forwarded to its peer, writable while data is pending for it.
+func (w *epollWorker) watch(s *epollSide) error {
+	var events uint32
+	if !s.eof && len(s.peer.pending) == 0 {
+		events |= syscall.EPOLLIN
+	}
+	if len(s.pending) > 0 {
+		events |= syscall.EPOLLOUT
+	}
+	ev := syscall.EpollEvent{Events: events, Fd: int32(s.fd)}
+	return syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_MOD, s.fd, &ev)
+}
+
+func (w *epollWorker) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(w.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			w.mu.Lock()
+			var done func()
+			if s, ok := w.sides[ev.Fd]; ok {
+				if err := w.handle(s, ev.Events); err != nil {
+					done = s.tunnel.closeLocked()
+				}
+			}
+			w.mu.Unlock()
+			if done != nil {
+				done()
+			}
+		}
+	}
+}
+
+var errTunnelDone = errors.New("tunnel done")
+
+// handle forwards the data of s as its socket is ready, and returns an error once the
+// tunnel must be closed.
+func (w *epollWorker) handle(s *epollSide, events uint32) error {
+	if events&syscall.EPOLLERR != 0 {
+		return errTunnelDone
+	}
+	if events&syscall.EPOLLOUT != 0 && len(s.pending) > 0 {
+		if err := w.flush(s); err != nil {
+			return err
+		}
+	}
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP) != 0 && !s.eof && len(s.peer.pending) == 0 {
+		n, err := syscall.Read(s.fd, w.buf)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+		case err != nil:
+			return err
+		case n == 0:
+			s.eof = true
+			syscall.Shutdown(s.peer.fd, syscall.SHUT_WR)
+		default:
+			s.peer.pending = append(s.peer.pending[:0], w.buf[:n]...)
+			if err := w.flush(s.peer); err != nil {
+				return err
+			}
+		}
+	} else if events&syscall.EPOLLHUP != 0 && s.eof {
+		// both directions of the socket are closed, nothing can be sent to it anymore
+		return errTunnelDone
+	}
+	if s.eof && s.peer.eof && len(s.pending) == 0 && len(s.peer.pending) == 0 {
+		return errTunnelDone
+	}
+	if err := w.watch(s); err != nil {
+		return err
+	}
+	return w.watch(s.peer)
+}
+
+// flush writes the pending data of s to its socket, as much as it accepts.
+func (w *epollWorker) flush(s *epollSide) error {
+	for len(s.pending) > 0 {
+		n, err := syscall.Write(s.fd, s.pending)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		s.pending = s.pending[n:]
+	}
+	return nil
+}
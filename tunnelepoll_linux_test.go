@@ -0,0 +1,187 @@
+//go:build linux && goproxy_epoll
+// +build linux,goproxy_epoll
+
+package goproxy_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mixcode/goproxy"
+)
+
+// epollLogger counts the tunnels forwarded with epoll
+type epollLogger struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (l *epollLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if strings.Contains(fmt.Sprintf(format, v...), "with epoll") {
+		l.n++
+	}
+}
+
+func (l *epollLogger) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+func TestEpollTunnels(t *testing.T) {
+	// an echo server, closing its side once the client closed its own
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+		}
+	}()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.EpollTunnels = true
+	proxy.Verbose = goproxy.LOGLEVEL_VERBOSE
+	logger := &epollLogger{}
+	proxy.Logger = logger
+	_, l := oneShotProxy(proxy, t)
+	defer l.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := net.Dial("tcp", l.Listener.Addr().String())
+			panicOnErr(err, "Dial")
+			defer c.Close()
+			fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+			br := bufio.NewReader(c)
+			resp, err := http.ReadResponse(br, nil)
+			panicOnErr(err, "ReadResponse")
+			if resp.StatusCode != 200 {
+				t.Errorf("Unexpected CONNECT response %v", resp.Status)
+				return
+			}
+			payload := bytes.Repeat([]byte{byte('a' + i)}, 4<<20)
+			go func() {
+				c.Write(payload)
+				c.(*net.TCPConn).CloseWrite()
+			}()
+			got, err := io.ReadAll(br)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Errorf("Expected the payload to be echoed through the tunnel, got %d bytes, %v", len(got), err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(proxy.ActiveConns()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(proxy.ActiveConns()); n != 0 {
+		t.Errorf("Expected the tunnels to be closed, %d still active", n)
+	}
+	if n := logger.count(); n != 4 {
+		t.Errorf("Expected the tunnels to be forwarded with epoll, %d were", n)
+	}
+}
+
+func TestEpollChainedTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	_, l := oneShotProxy(goproxy.NewProxyHttpServer(), t)
+	defer l.Close()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.ConnectDial = proxy.NewConnectDialToProxy(l.URL)
+	proxy.EpollTunnels = true
+	proxy.Verbose = goproxy.LOGLEVEL_VERBOSE
+	logger := &epollLogger{}
+	proxy.Logger = logger
+	_, l2 := oneShotProxy(proxy, t)
+	defer l2.Close()
+
+	c, err := net.Dial("tcp", l2.Listener.Addr().String())
+	panicOnErr(err, "Dial")
+	defer c.Close()
+	fmt.Fprintf(c, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through the chained proxies", err)
+	}
+	io.WriteString(c, "hello")
+	c.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(br); err != nil || string(got) != "hello" {
+		t.Errorf("Expected the payload to be echoed through the tunnel, got %q %v", got, err)
+	}
+	if n := logger.count(); n != 1 {
+		t.Error("Expected the tunnel through the upstream proxy to be forwarded with epoll")
+	}
+}
+
+func TestEpollProxyProtocolTunnel(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(c, c)
+		c.Close()
+	}()
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.EpollTunnels = true
+	proxy.Verbose = goproxy.LOGLEVEL_VERBOSE
+	logger := &epollLogger{}
+	proxy.Logger = logger
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	panicOnErr(err, "Listen")
+	go proxy.Serve(&goproxy.ProxyProtocolListener{Listener: l})
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	panicOnErr(err, "Dial")
+	defer c.Close()
+	fmt.Fprintf(c, "PROXY TCP4 10.0.0.1 10.0.0.2 1234 80\r\nCONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", echo.Addr(), echo.Addr())
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal("Cannot CONNECT through the proxy", err)
+	}
+	io.WriteString(c, "hello")
+	c.(*net.TCPConn).CloseWrite()
+	if got, err := io.ReadAll(br); err != nil || string(got) != "hello" {
+		t.Errorf("Expected the payload to be echoed through the tunnel, got %q %v", got, err)
+	}
+	if n := logger.count(); n != 1 {
+		t.Error("Expected the tunnel of a PROXY protocol client to be forwarded with epoll")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux || !goproxy_epoll
+// +build !linux !goproxy_epoll
+
+package goproxy
+
+import "net"
+
+// epollTunnel is only available on Linux, in builds with the goproxy_epoll tag.
+type epollTunnel struct{}
+
+func newEpollTunnel(client, target net.Conn) *epollTunnel {
+	return nil
+}
+
+func (t *epollTunnel) start(done func()) {}
+
+func (t *epollTunnel) Close() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package goproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// TunnelProtocol is the protocol of an accepted CONNECT tunnel, as sniffed from its
+// first bytes.
+type TunnelProtocol string
+
+const (
+	TunnelTLS     TunnelProtocol = "tls"
+	TunnelSSH     TunnelProtocol = "ssh"
+	TunnelHTTP    TunnelProtocol = "http"
+	TunnelSMTP    TunnelProtocol = "smtp"
+	TunnelUnknown TunnelProtocol = "unknown"
+)
+
+// TunnelSniff is what the proxy learnt from the first bytes of a tunnel.
+type TunnelSniff struct {
+	Protocol TunnelProtocol
+	// ClientData and ServerData are the first bytes received from the client and the
+	// server, if any. Since SMTP servers speak first, their clients usually send
+	// nothing before the server did.
+	ClientData []byte
+	ServerData []byte
+}
+
+// TunnelAction is what happens to an accepted tunnel once sniffed.
+type TunnelAction int
+
+const (
+	// TunnelAllow relays the tunnel as usual
+	TunnelAllow TunnelAction = iota
+	// TunnelReject closes the tunnel
+	TunnelReject
+	// TunnelTarpit closes the connection to the server, and keeps the client waiting
+	// without ever answering it
+	TunnelTarpit
+)
+
+// DefaultTarpit is how long TunnelTarpit holds the clients, unless specified.
+const DefaultTarpit = time.Minute
+
+// TunnelDecision is the decision of a TunnelPolicy.
+type TunnelDecision struct {
+	Action TunnelAction
+	// Tarpit is how long TunnelTarpit holds the client, DefaultTarpit if zero
+	Tarpit time.Duration
+	// RecordClient and RecordServer, if set, receive a copy of the data sent by the
+	// client and by the server through an allowed tunnel.
+	RecordClient io.Writer
+	RecordServer io.Writer
+	// Handle, if set, takes over an allowed tunnel instead of the proxy. It is called
+	// with the connections to the client and to the server, from which the sniffed
+	// data is read again first, and must close them.
+	Handle func(client, server net.Conn)
+}
+
+// DefaultTunnelSniffTimeout is how long the first bytes of a tunnel are awaited, unless
+// ProxyHttpServer.TunnelSniffTimeout is set.
+const DefaultTunnelSniffTimeout = 3 * time.Second
+
+// sniffTunnel reads the first bytes sent through a tunnel by the client and by the
+// server, as soon as one of them spoke or timeout elapsed on clock, and classifies the
+// protocol.
+func sniffTunnel(clock Clock, client, server net.Conn, timeout time.Duration) *TunnelSniff {
+	read := func(c net.Conn, ch chan<- []byte) {
+		buf := make([]byte, 1024)
+		n, _ := c.Read(buf)
+		ch <- buf[:n]
+	}
+	clientData, serverData := make(chan []byte, 1), make(chan []byte, 1)
+	go read(client, clientData)
+	go read(server, serverData)
+	fire, stop := clock.NewTimer(timeout)
+	defer stop()
+	// the other read is interrupted, what it got so far is kept
+	past := time.Unix(1, 0)
+	s := &TunnelSniff{}
+	select {
+	case s.ClientData = <-clientData:
+		server.SetReadDeadline(past)
+		s.ServerData = <-serverData
+	case s.ServerData = <-serverData:
+		client.SetReadDeadline(past)
+		s.ClientData = <-clientData
+	case <-fire:
+		client.SetReadDeadline(past)
+		server.SetReadDeadline(past)
+		s.ClientData, s.ServerData = <-clientData, <-serverData
+	}
+	client.SetReadDeadline(time.Time{})
+	server.SetReadDeadline(time.Time{})
+	s.Protocol = classifyTunnel(s.ClientData, s.ServerData)
+	return s
+}
+
+var httpMethods = [][]byte{[]byte("GET "), []byte("POST "), []byte("HEAD "), []byte("PUT "), []byte("DELETE "),
+	[]byte("OPTIONS "), []byte("PATCH "), []byte("CONNECT "), []byte("TRACE "), []byte("PRI * HTTP/2.0")}
+
+func classifyTunnel(client, server []byte) TunnelProtocol {
+	switch {
+	case len(client) >= 3 && client[0] == 0x16 && client[1] == 0x03:
+		// handshake record
+		return TunnelTLS
+	case bytes.HasPrefix(client, []byte("SSH-")) || bytes.HasPrefix(server, []byte("SSH-")):
+		return TunnelSSH
+	case bytes.HasPrefix(server, []byte("220")) && bytes.Contains(bytes.ToUpper(server), []byte("SMTP")),
+		bytes.HasPrefix(bytes.ToUpper(client), []byte("EHLO ")), bytes.HasPrefix(bytes.ToUpper(client), []byte("HELO ")):
+		return TunnelSMTP
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(client, m) {
+			return TunnelHTTP
+		}
+	}
+	return TunnelUnknown
+}
+
+// teeConn copies the data read from a connection to w
+type teeConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.w.Write(p[:n])
+	}
+	return n, err
+}
+
+// tunnelSniffTimeout returns how long the first bytes of the clients of tunnels are
+// awaited.
+func (proxy *ProxyHttpServer) tunnelSniffTimeout() time.Duration {
+	if proxy.TunnelSniffTimeout == 0 {
+		return DefaultTunnelSniffTimeout
+	}
+	return proxy.TunnelSniffTimeout
+}
+
+// applyTunnelPolicy sniffs the tunnel to host between client and server and applies the
+// decision of TunnelPolicy. It returns the connections to relay, with the sniffed data
+// put back in front, or nil connections if the tunnel was taken care of.
+func (proxy *ProxyHttpServer) applyTunnelPolicy(ctx *ProxyCtx, host string, client, server net.Conn) (*TunnelSniff, net.Conn, net.Conn) {
+	sniff := sniffTunnel(proxy.clock(), client, server, proxy.tunnelSniffTimeout())
+	ctx.Logf("Tunnel to %s sniffed as %s", host, sniff.Protocol)
+	d := proxy.TunnelPolicy(ctx, sniff)
+	switch d.Action {
+	case TunnelReject:
+		ctx.Logf("Rejecting %s tunnel to %s", sniff.Protocol, host)
+		client.Close()
+		server.Close()
+		return sniff, nil, nil
+	case TunnelTarpit:
+		ctx.Logf("Tarpitting %s tunnel to %s", sniff.Protocol, host)
+		server.Close()
+		tarpit := d.Tarpit
+		if tarpit == 0 {
+			tarpit = DefaultTarpit
+		}
+		go func() {
+			stop := interruptReadsAfter(proxy.clock(), client, tarpit)
+			io.Copy(io.Discard, client)
+			stop()
+			client.Close()
+		}()
+		return sniff, nil, nil
+	}
+	client = keepHalfClose(newReplayConn(client, sniff.ClientData), client)
+	server = keepHalfClose(newReplayConn(server, sniff.ServerData), server)
+	if d.RecordClient != nil {
+		client = keepHalfClose(teeConn{client, d.RecordClient}, client)
+	}
+	if d.RecordServer != nil {
+		server = keepHalfClose(teeConn{server, d.RecordServer}, server)
+	}
+	if d.Handle != nil {
+		untrack := proxy.conns.track(ctx, ConnTunnel, host, client, server)
+		go func() {
+			defer untrack()
+			d.Handle(client, server)
+		}()
+		return sniff, nil, nil
+	}
+	return sniff, client, server
+}
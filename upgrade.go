@@ -0,0 +1,92 @@
+package goproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// serveUpgrade hands the connections of an upgraded request to the first matching
+// UpgradeHandler, and closes them once it returns. It returns false if no handler
+// matched, leaving the connections to the caller.
+func (proxy *ProxyHttpServer) serveUpgrade(ctx *ProxyCtx, resp *http.Response, client, upstream io.ReadWriteCloser) bool {
+	for _, h := range proxy.upgradeHandlers.snapshot() {
+		if h.handler.(upgradeHandlerFunc)(resp, client, upstream, ctx) {
+			client.Close()
+			upstream.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// upgrade passes an upgraded connection to the OnUpgrade handlers, or tunnels it
+// as is if none of them matched.
+func (proxy *ProxyHttpServer) upgrade(ctx *ProxyCtx, resp *http.Response, client, upstream io.ReadWriteCloser) {
+	if proxy.serveUpgrade(ctx, resp, client, upstream) {
+		return
+	}
+	ctx.Logf("Connection upgraded to %q, tunneling", resp.Header.Get("Upgrade"))
+	tunnel(ctx, client, upstream)
+}
+
+// bufferedConn returns a connection reading from r, which holds data of c already
+// buffered before the upgrade.
+func bufferedConn(c net.Conn, r io.Reader) net.Conn {
+	return &replayConn{Conn: c, r: r}
+}
+
+// tunnel copies bytes between two connections until one side is closed.
+func tunnel(ctx *ProxyCtx, client, upstream io.ReadWriteCloser) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		copyOrWarn(ctx, upstream, client, &wg)
+		upstream.Close()
+	}()
+	go func() {
+		copyOrWarn(ctx, client, upstream, &wg)
+		client.Close()
+	}()
+	wg.Wait()
+}
+
+// writeUpgradeResponse writes the status line and headers of a 101 Switching
+// Protocols response, which has no body.
+func writeUpgradeResponse(w io.Writer, resp *http.Response) error {
+	bw := bufio.NewWriter(w)
+	text := http.StatusText(resp.StatusCode)
+	if _, err := io.WriteString(bw, "HTTP/1.1 "+strconv.Itoa(resp.StatusCode)+" "+text+"\r\n"); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(bw); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(bw, "\r\n"); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// hijackUpgrade sends an upgrade response to the client of w and passes both connections
+// to upgrade. upstream is the body of the response returned by http.Transport.
+func (proxy *ProxyHttpServer) hijackUpgrade(ctx *ProxyCtx, w http.ResponseWriter, resp *http.Response, upstream io.ReadWriteCloser) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		panic("httpserver does not support hijacking")
+	}
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		ctx.Warnf("Hijack error: %v", err)
+		return
+	}
+	if err := writeUpgradeResponse(clientConn, resp); err != nil {
+		ctx.Warnf("Cannot write upgrade response to client: %v", err)
+		clientConn.Close()
+		return
+	}
+	proxy.upgrade(ctx, resp, bufferedConn(clientConn, clientBuf.Reader), upstream)
+}
@@ -0,0 +1,241 @@
+package goproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUpstreamBusy is returned when a dial or request exceeds the limits of the
+// UpstreamLimiter of the proxy, and no slot was freed in time.
+var ErrUpstreamBusy = errors.New("goproxy: too many concurrent upstream connections")
+
+// UpstreamLimiter limits the concurrent connections and requests of the proxy to the
+// upstream servers, globally and per destination host name regardless of the port, to
+// protect small origins and the proxy itself:
+//
+//	proxy.UpstreamLimiter = &goproxy.UpstreamLimiter{MaxRequestsPerHost: 8, QueueTimeout: 10 * time.Second}
+//
+// Connections are the ones dialed for CONNECT tunnels and websockets, held until they
+// are closed. Requests are the plain and MITM'd requests sent with ProxyCtx.RoundTrip,
+// held until their response body is closed. Zero values mean unlimited.
+//
+// Dials and requests over a limit wait in a queue for a slot to be freed, and fail with
+// ErrUpstreamBusy, answered with 503 Service Unavailable, when the queue is full or
+// after QueueTimeout.
+type UpstreamLimiter struct {
+	MaxConns           int
+	MaxConnsPerHost    int
+	MaxRequests        int
+	MaxRequestsPerHost int
+	// QueueTimeout is how long dials and requests wait for a slot, as long as the
+	// client waits if zero
+	QueueTimeout time.Duration
+	// MaxQueue is the number of dials and requests that may wait for the slots of a
+	// limit, beyond which they fail immediately. It is unlimited if zero, and negative
+	// values disable queueing.
+	MaxQueue int
+
+	mu   sync.Mutex
+	sems map[semKey]*semaphore
+}
+
+// semKey identifies a limit, host being empty for the global ones
+type semKey struct {
+	requests bool
+	host     string
+}
+
+// semaphore holds the slots of a limit. It is forgotten once it has no users, that is
+// no holders nor waiters.
+type semaphore struct {
+	slots   chan struct{}
+	users   int
+	waiting int
+}
+
+// acquire takes a slot of the limits of host, waiting for it if needed, at most
+// QueueTimeout on clock.
+func (l *UpstreamLimiter) acquire(clock Clock, ctx context.Context, requests bool, host string) (func(), error) {
+	max, maxPerHost := l.MaxConns, l.MaxConnsPerHost
+	if requests {
+		max, maxPerHost = l.MaxRequests, l.MaxRequestsPerHost
+	}
+	var deadline <-chan time.Time
+	if l.QueueTimeout > 0 {
+		c, stop := clock.NewTimer(l.QueueTimeout)
+		defer stop()
+		deadline = c
+	}
+	var releases []func()
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	host = strings.ToLower(hostWithoutPort(host))
+	for _, limit := range []struct {
+		key semKey
+		n   int
+	}{{semKey{requests, host}, maxPerHost}, {semKey{requests, ""}, max}} {
+		if limit.n <= 0 {
+			continue
+		}
+		r, err := l.take(ctx, deadline, limit.key, limit.n)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		releases = append(releases, r)
+	}
+	var once sync.Once
+	return func() { once.Do(release) }, nil
+}
+
+func (l *UpstreamLimiter) take(ctx context.Context, deadline <-chan time.Time, key semKey, n int) (func(), error) {
+	l.mu.Lock()
+	s, ok := l.sems[key]
+	if !ok {
+		if l.sems == nil {
+			l.sems = make(map[semKey]*semaphore)
+		}
+		s = &semaphore{slots: make(chan struct{}, n)}
+		l.sems[key] = s
+	}
+	s.users++
+	release := func() {
+		<-s.slots
+		l.mu.Lock()
+		l.done(key, s)
+		l.mu.Unlock()
+	}
+	select {
+	case s.slots <- struct{}{}:
+		l.mu.Unlock()
+		return release, nil
+	default:
+	}
+	if l.MaxQueue < 0 || (l.MaxQueue > 0 && s.waiting >= l.MaxQueue) {
+		l.done(key, s)
+		l.mu.Unlock()
+		return nil, ErrUpstreamBusy
+	}
+	s.waiting++
+	l.mu.Unlock()
+
+	var err error
+	select {
+	case s.slots <- struct{}{}:
+	case <-deadline:
+		err = ErrUpstreamBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.waiting--
+	if err != nil {
+		l.done(key, s)
+		return nil, err
+	}
+	return release, nil
+}
+
+// done forgets a user of s, l.mu being held.
+func (l *UpstreamLimiter) done(key semKey, s *semaphore) {
+	if s.users--; s.users == 0 {
+		delete(l.sems, key)
+	}
+}
+
+// dial dials addr once a connection slot is available, releasing it when the
+// returned connection is closed.
+func (l *UpstreamLimiter) dial(ctx *ProxyCtx, addr string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if l == nil {
+		return dial()
+	}
+	reqCtx := context.Background()
+	if ctx.Req != nil {
+		reqCtx = ctx.Req.Context()
+	}
+	release, err := l.acquire(ctx.Proxy.clock(), reqCtx, false, addr)
+	if err != nil {
+		ctx.Warnf("Cannot dial %s: %v", addr, err)
+		return nil, err
+	}
+	c, err := dial()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return keepHalfClose(&releasingConn{Conn: c, release: release}, c), nil
+}
+
+// roundTrip sends req once a request slot is available, releasing it when the
+// response body is closed.
+func (l *UpstreamLimiter) roundTrip(req *http.Request, ctx *ProxyCtx, roundTrip func() (*http.Response, error)) (*http.Response, error) {
+	if l == nil {
+		return roundTrip()
+	}
+	release, err := l.acquire(ctx.Proxy.clock(), req.Context(), true, req.URL.Host)
+	if err != nil {
+		ctx.Warnf("Cannot send request to %s: %v", req.URL.Host, err)
+		return nil, err
+	}
+	resp, err := roundTrip()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if resp.Body == nil {
+		release()
+		return resp, nil
+	}
+	body := &releasingBody{ReadCloser: resp.Body, release: release}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// keep upgraded connections writable
+		resp.Body = releasingRWBody{body, rw}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// upstreamBusyResponse answers the requests failing with ErrUpstreamBusy.
+func upstreamBusyResponse(req *http.Request) *http.Response {
+	return NewResponse(req, ContentTypeText, http.StatusServiceUnavailable, ErrUpstreamBusy.Error()+"\n")
+}
+
+type releasingConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *releasingConn) Close() error {
+	c.release()
+	return c.Conn.Close()
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	b.release()
+	return b.ReadCloser.Close()
+}
+
+type releasingRWBody struct {
+	*releasingBody
+	w io.Writer
+}
+
+func (b releasingRWBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
@@ -0,0 +1,91 @@
+package goproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+type proxyCtxKey struct{}
+
+// withProxyCtx attaches ctx to the request context, so that dial hooks called by
+// the transport can find out on behalf of which proxy request they run.
+func withProxyCtx(req *http.Request, ctx *ProxyCtx) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), proxyCtxKey{}, ctx))
+}
+
+func proxyCtxFromContext(c context.Context) *ProxyCtx {
+	ctx, _ := c.Value(proxyCtxKey{}).(*ProxyCtx)
+	return ctx
+}
+
+func (proxy *ProxyHttpServer) dialUpstreamTLS(base *http.Transport) func(c context.Context, network, addr string) (net.Conn, error) {
+	return proxy.dialTLS(base, func(conn net.Conn, config *tls.Config, ctx *ProxyCtx) (net.Conn, error) {
+		return proxy.UpstreamTLSHandshake(conn, config.ServerName, ctx)
+	})
+}
+
+// dialTLS returns a DialTLSContext dialing like base and handing the connection to
+// handshake along with a copy of the TLS configuration of base. A nil conn and nil
+// error returned by handshake fall back to crypto/tls with that configuration.
+func (proxy *ProxyHttpServer) dialTLS(base *http.Transport, handshake func(conn net.Conn, config *tls.Config, ctx *ProxyCtx) (net.Conn, error)) func(c context.Context, network, addr string) (net.Conn, error) {
+	return func(c context.Context, network, addr string) (net.Conn, error) {
+		var conn net.Conn
+		var err error
+		if base.DialContext != nil {
+			conn, err = base.DialContext(c, network, addr)
+		} else {
+			conn, err = (&net.Dialer{}).DialContext(c, network, addr)
+		}
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config := &tls.Config{}
+		if base.TLSClientConfig != nil {
+			config = base.TLSClientConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		ctx := proxyCtxFromContext(c)
+		tlsConn, err := handshake(conn, config, ctx)
+		if err != nil {
+			conn.Close()
+			return nil, newProxyError(ctx, ErrTLSHandshakeUpstream, addr, err)
+		}
+		if tlsConn != nil {
+			return tlsConn, nil
+		}
+
+		// fall back to crypto/tls
+		client := tls.Client(conn, config)
+		if err := client.Handshake(); err != nil {
+			conn.Close()
+			return nil, newProxyError(ctx, ErrTLSHandshakeUpstream, addr, err)
+		}
+		return client, nil
+	}
+}
+
+// TLSVersionName returns the name of a TLS version, such as "TLS 1.3".
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionSSL30:
+		return "SSLv3"
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04X", version)
+}
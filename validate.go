@@ -0,0 +1,151 @@
+package goproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxHeaderBytes is the default limit on the size of the request line and
+// headers of requests read from HTTP MITM tunnels.
+const DefaultMaxHeaderBytes = 64 << 10
+
+// RequestValidation configures the checks applied to requests read from plain HTTP
+// MITM tunnels (ConnectHTTPMitm) before they are parsed, so that the proxy can't be
+// used as a request smuggling vector: invalid request lines, obsolete line folding,
+// conflicting Content-Length and Transfer-Encoding headers and oversized header blocks
+// are rejected.
+type RequestValidation struct {
+	// MaxHeaderBytes limits the size of the request line and headers,
+	// DefaultMaxHeaderBytes if zero.
+	MaxHeaderBytes int
+	// Reject, if set, returns the response sent to the client before closing the
+	// tunnel when a request is rejected. By default a 400 Bad Request is sent.
+	Reject func(err *InvalidRequestError, ctx *ProxyCtx) *http.Response
+}
+
+// InvalidRequestError is the error reported when a request fails RequestValidation.
+type InvalidRequestError struct {
+	Reason string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return "invalid request: " + e.Reason
+}
+
+func (v *RequestValidation) maxHeaderBytes() int {
+	if v == nil || v.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return v.MaxHeaderBytes
+}
+
+func (v *RequestValidation) reject(err *InvalidRequestError, ctx *ProxyCtx) *http.Response {
+	if v != nil && v.Reject != nil {
+		return v.Reject(err, ctx)
+	}
+	resp := NewResponse(ctx.Req, ContentTypeText, http.StatusBadRequest, err.Error())
+	resp.Close = true
+	return resp
+}
+
+// newReader returns a buffered reader for requests read from r, large enough to
+// hold a complete header block.
+func (v *RequestValidation) newReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, v.maxHeaderBytes()+4)
+}
+
+// check peeks the next request header block of br, and validates it. It returns
+// nil without consuming anything if the request looks sane; and the underlying
+// read error if the connection ended before a complete header block was received.
+func (v *RequestValidation) check(br *bufio.Reader) error {
+	max := v.maxHeaderBytes()
+	if _, err := br.Peek(1); err != nil {
+		return err
+	}
+	for {
+		b, _ := br.Peek(br.Buffered())
+		if end := bytes.Index(b, []byte("\r\n\r\n")); end >= 0 {
+			return checkHeaderBlock(string(b[:end]))
+		}
+		if end := bytes.Index(b, []byte("\n\n")); end >= 0 {
+			return checkHeaderBlock(string(b[:end]))
+		}
+		if len(b) >= max {
+			return &InvalidRequestError{"header block too large"}
+		}
+		if _, err := br.Peek(len(b) + 1); err != nil {
+			return err
+		}
+	}
+}
+
+func isTokenChar(c byte) bool {
+	return c > ' ' && c < 0x7f && !strings.ContainsRune(`"(),/:;<=>?@[\]{}`, rune(c))
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkHeaderBlock(block string) error {
+	lines := strings.Split(strings.TrimLeft(block, "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+
+	parts := strings.Split(lines[0], " ")
+	if len(parts) != 3 || !isToken(parts[0]) || parts[1] == "" ||
+		(parts[2] != "HTTP/1.1" && parts[2] != "HTTP/1.0") {
+		return &InvalidRequestError{"malformed request line"}
+	}
+
+	var contentLengths, transferEncodings []string
+	for _, line := range lines[1:] {
+		if line == "" || line[0] == ' ' || line[0] == '\t' {
+			return &InvalidRequestError{"obsolete line folding"}
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 || !isToken(line[:colon]) {
+			return &InvalidRequestError{"malformed header line"}
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		if strings.ContainsAny(value, "\r\x00") {
+			return &InvalidRequestError{"invalid header value"}
+		}
+		switch strings.ToLower(line[:colon]) {
+		case "content-length":
+			contentLengths = append(contentLengths, value)
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, strings.Split(value, ",")...)
+		}
+	}
+
+	if len(transferEncodings) > 0 {
+		if len(contentLengths) > 0 {
+			return &InvalidRequestError{"both Content-Length and Transfer-Encoding"}
+		}
+		if !strings.EqualFold(strings.TrimSpace(transferEncodings[len(transferEncodings)-1]), "chunked") {
+			return &InvalidRequestError{"Transfer-Encoding does not end with chunked"}
+		}
+	}
+	for _, cl := range contentLengths {
+		if cl != contentLengths[0] {
+			return &InvalidRequestError{"conflicting Content-Length"}
+		}
+		if cl == "" || strings.Trim(cl, "0123456789") != "" {
+			return &InvalidRequestError{"malformed Content-Length"}
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/tls"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
@@ -25,11 +26,13 @@ func isWebSocketRequest(r *http.Request) bool {
 		headerContains(r.Header, "Upgrade", "websocket")
 }
 
-func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn) {
-	targetURL := url.URL{Scheme: "wss", Host: req.URL.Host, Path: req.URL.Path}
+func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request, tlsConfig *tls.Config, clientConn *tls.Conn, clientReader io.Reader) {
+	targetURL := url.URL{Scheme: "wss", Host: withPort(req.URL.Host, "443"), Path: req.URL.Path}
 
 	// Connect to upstream
-	targetConn, err := tls.Dial("tcp", targetURL.Host, tlsConfig)
+	targetConn, err := proxy.UpstreamLimiter.dial(ctx, targetURL.Host, func() (net.Conn, error) {
+		return tls.Dial("tcp", targetURL.Host, tlsConfig)
+	})
 	if err != nil {
 		ctx.Warnf("Error dialing target site: %v", err)
 		return
@@ -37,17 +40,21 @@ func (proxy *ProxyHttpServer) serveWebsocketTLS(ctx *ProxyCtx, w http.ResponseWr
 	defer targetConn.Close()
 
 	// Perform handshake
-	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
+	resp, targetReader, err := proxy.websocketHandshake(ctx, req, targetConn, clientConn)
+	if err != nil {
 		ctx.Warnf("Websocket handshake error: %v", err)
 		return
 	}
+	if proxy.serveUpgrade(ctx, resp, bufferedConn(clientConn, clientReader), bufferedConn(targetConn, targetReader)) {
+		return
+	}
 
 	// Proxy wss connection
-	proxy.proxyWebsocket(ctx, targetConn, clientConn)
+	proxy.proxyWebsocket(ctx, targetConn, targetReader, clientConn, clientReader)
 }
 
 func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWriter, req *http.Request) {
-	targetURL := url.URL{Scheme: "ws", Host: req.URL.Host, Path: req.URL.Path}
+	targetURL := url.URL{Scheme: "ws", Host: withPort(req.URL.Host, "80"), Path: req.URL.Path}
 
 	targetConn, err := proxy.connectDial(ctx, "tcp", targetURL.Host)
 	if err != nil {
@@ -61,28 +68,35 @@ func (proxy *ProxyHttpServer) serveWebsocket(ctx *ProxyCtx, w http.ResponseWrite
 	if !ok {
 		panic("httpserver does not support hijacking")
 	}
-	clientConn, _, err := hj.Hijack()
+	clientConn, clientBuf, err := hj.Hijack()
 	if err != nil {
 		ctx.Warnf("Hijack error: %v", err)
 		return
 	}
 
 	// Perform handshake
-	if err := proxy.websocketHandshake(ctx, req, targetConn, clientConn); err != nil {
+	resp, targetReader, err := proxy.websocketHandshake(ctx, req, targetConn, clientConn)
+	if err != nil {
 		ctx.Warnf("Websocket handshake error: %v", err)
 		return
 	}
+	if proxy.serveUpgrade(ctx, resp, bufferedConn(clientConn, clientBuf.Reader), bufferedConn(targetConn, targetReader)) {
+		return
+	}
 
 	// Proxy ws connection
-	proxy.proxyWebsocket(ctx, targetConn, clientConn)
+	proxy.proxyWebsocket(ctx, targetConn, targetReader, clientConn, clientBuf.Reader)
 }
 
-func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) error {
+// websocketHandshake forwards the upgrade request to the target and its response
+// to the client. It returns the response along with the reader of the target connection,
+// which may already hold websocket frames sent right after the handshake.
+func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Request, targetSiteConn io.ReadWriter, clientConn io.ReadWriter) (*http.Response, *bufio.Reader, error) {
 	// write handshake request to target
 	err := req.Write(targetSiteConn)
 	if err != nil {
 		ctx.Warnf("Error writing upgrade request: %v", err)
-		return err
+		return nil, nil, err
 	}
 
 	targetTLSReader := bufio.NewReader(targetSiteConn)
@@ -91,7 +105,7 @@ func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Reques
 	resp, err := http.ReadResponse(targetTLSReader, req)
 	if err != nil {
 		ctx.Warnf("Error reading handhsake response  %v", err)
-		return err
+		return nil, nil, err
 	}
 
 	// Run response through handlers
@@ -101,12 +115,14 @@ func (proxy *ProxyHttpServer) websocketHandshake(ctx *ProxyCtx, req *http.Reques
 	err = resp.Write(clientConn)
 	if err != nil {
 		ctx.Warnf("Error writing handshake response: %v", err)
-		return err
+		return nil, nil, err
 	}
-	return nil
+	return resp, targetTLSReader, nil
 }
 
-func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, dest io.ReadWriter, source io.ReadWriter) {
+// proxyWebsocket copies websocket traffic in both directions, reading from the
+// given readers which may hold data buffered before the upgrade.
+func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, dest io.Writer, destReader io.Reader, source io.Writer, sourceReader io.Reader) {
 	errChan := make(chan error, 2)
 	cp := func(dst io.Writer, src io.Reader) {
 		_, err := io.Copy(dst, src)
@@ -115,7 +131,7 @@ func (proxy *ProxyHttpServer) proxyWebsocket(ctx *ProxyCtx, dest io.ReadWriter,
 	}
 
 	// Start proxying websocket data
-	go cp(dest, source)
-	go cp(source, dest)
+	go cp(dest, sourceReader)
+	go cp(source, destReader)
 	<-errChan
 }
@@ -0,0 +1,55 @@
+package goproxy
+
+import (
+	"net"
+	"strings"
+)
+
+// WildcardCerts makes the proxy forge wildcard certificates for MITM'd hosts,
+// "*.example.com" for "www.example.com", so that the hosts of a domain share one
+// certificate instead of each getting its own, which spares signing a certificate for
+// every shard of CDN-heavy sites:
+//
+//	proxy.CertStore = goproxy.NewCertCache()
+//	proxy.WildcardCerts = &goproxy.WildcardCerts{Domain: publicsuffix.EffectiveTLDPlusOne}
+//
+// where publicsuffix is golang.org/x/net/publicsuffix. A wildcard covers a single
+// label, and is never made for a public suffix, such as "*.co.uk", which clients reject:
+// the parent of the host must be within its registrable domain, as returned by Domain.
+// The certificate of a registrable domain, "example.com", is also valid for
+// "*.example.com", and conversely. IP addresses always get their own certificate.
+type WildcardCerts struct {
+	// Domain returns the registrable domain of a host, its public suffix and the label
+	// before. No wildcard is made if nil or when it fails.
+	Domain func(host string) (string, error)
+	// Match, if set, tells which hosts get wildcard certificates, all of them if nil.
+	Match func(host string, ctx *ProxyCtx) bool
+}
+
+// hosts returns the hosts the certificate of host is signed for, the wildcard first,
+// or nil if host gets a certificate of its own.
+func (w *WildcardCerts) hosts(host string, ctx *ProxyCtx) []string {
+	if w == nil || w.Domain == nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	if w.Match != nil && !w.Match(host, ctx) {
+		return nil
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	domain, err := w.Domain(host)
+	if err != nil || domain == "" {
+		return nil
+	}
+	parent := host
+	if host != domain {
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return nil
+		}
+		parent = host[i+1:]
+		if parent != domain && !strings.HasSuffix(parent, "."+domain) {
+			return nil
+		}
+	}
+	return []string{"*." + parent, parent}
+}